@@ -0,0 +1,233 @@
+// Command simdevice emulates thermostat devices talking to the api server over the mqtt device protocol, so
+// the device pipeline can be demoed and load tested without hardware. Every device acts on the desired state
+// the server publishes on <prefix>/<id>/desired, reports the temperature of its room on <prefix>/<id>/reported
+// as the equipment heats or cools it, and publishes whether it's online on <prefix>/<id>/status. Runs are
+// reproducible with a -scenario file and a -seed, for regression testing control logic against them
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// mqttTimeout is how long to wait for the broker to acknowledge a connect, publish or subscribe
+	mqttTimeout = 10 * time.Second
+
+	// heatRate and coolRate are how many degrees the equipment moves the room per step while running, and
+	// leakRate the share of the difference with the outdoor temperature the room drifts by per step.
+	// occupantGain is how many degrees the people in an occupied home warm it by per step
+	heatRate     = 1.0
+	coolRate     = 1.0
+	leakRate     = 0.05
+	occupantGain = 0.2
+)
+
+// desiredState is the part of the thermostat the server publishes that a device acts on
+type desiredState struct {
+	CurrentTemp   int    `json:"currentTemp"`
+	OperatingMode string `json:"mode"`
+	CoolSetPoint  int    `json:"coolSetPoint"`
+	HeatSetPoint  int    `json:"heatSetPoint"`
+}
+
+// device is a single emulated thermostat and the room it sits in
+type device struct {
+	sync.Mutex
+	id      int
+	prefix  string
+	client  mqtt.Client
+	temp    float64
+	desired *desiredState
+
+	// preset is set when the scenario starts the room at a temperature of its own rather than the server's
+	preset bool
+
+	// noise is the most degrees a reading is off by, at random from rng
+	noise float64
+	rng   *rand.Rand
+}
+
+// step runs the equipment of the device for a single step and returns the new room temperature. The room
+// drifts toward the outdoor temperature unless the equipment is working against it, and warms up while the
+// home is occupied
+func (d *device) step(outdoor float64, occupied bool) float64 {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.desired == nil {
+		return d.temp
+	}
+
+	switch {
+	case d.desired.OperatingMode == "heat" && d.temp < float64(d.desired.HeatSetPoint):
+		d.temp = math.Min(d.temp+heatRate, float64(d.desired.HeatSetPoint))
+	case d.desired.OperatingMode == "cool" && d.temp > float64(d.desired.CoolSetPoint):
+		d.temp = math.Max(d.temp-coolRate, float64(d.desired.CoolSetPoint))
+	default:
+		d.temp += (outdoor - d.temp) * leakRate
+	}
+	if occupied {
+		d.temp += occupantGain
+	}
+
+	return d.temp
+}
+
+// topic returns the topic of the device for the given kind of message
+func (d *device) topic(kind string) string {
+	return d.prefix + "/" + strconv.Itoa(d.id) + "/" + kind
+}
+
+// handleDesired takes on the desired state the server published. The room starts out at the temperature
+// the server last knew of
+func (d *device) handleDesired(_ mqtt.Client, msg mqtt.Message) {
+	var desired desiredState
+	if err := json.Unmarshal(msg.Payload(), &desired); err != nil {
+		log.Println("device", d.id, "failed to unmarshal its desired state with error:", err)
+		return
+	}
+
+	d.Lock()
+	if d.desired == nil && !d.preset {
+		d.temp = float64(desired.CurrentTemp)
+	}
+	d.desired = &desired
+	d.Unlock()
+}
+
+// connect connects the device to the broker, leaving its offline status behind as its last will for when
+// it drops off
+func (d *device) connect(broker, clientPrefix string) error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientPrefix+strconv.Itoa(d.id)).
+		SetAutoReconnect(true).
+		SetWill(d.topic("status"), "offline", 1, true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			if err := wait(c.Subscribe(d.topic("desired"), 1, d.handleDesired)); err != nil {
+				log.Println("device", d.id, "failed to subscribe to its desired state with error:", err)
+			}
+			if err := wait(c.Publish(d.topic("status"), 1, true, "online")); err != nil {
+				log.Println("device", d.id, "failed to publish its status with error:", err)
+			}
+		})
+
+	d.client = mqtt.NewClient(opts)
+	return wait(d.client.Connect())
+}
+
+// read returns the reading of the sensor of the device for the room temperature, off by up to its noise
+func (d *device) read(temp float64) int {
+	if d.noise > 0 {
+		temp += (d.rng.Float64()*2 - 1) * d.noise
+	}
+	return int(math.Round(temp))
+}
+
+// report publishes the current room temperature of the device, once it knows what it should be doing
+func (d *device) report(temp float64) error {
+	d.Lock()
+	ready := d.desired != nil
+	d.Unlock()
+	if !ready {
+		return nil
+	}
+
+	jsn, err := json.Marshal(map[string]int{"currentTemp": d.read(temp)})
+	if err != nil {
+		return err
+	}
+
+	return wait(d.client.Publish(d.topic("reported"), 1, false, jsn))
+}
+
+// disconnect publishes the offline status of the device and disconnects it
+func (d *device) disconnect() {
+	wait(d.client.Publish(d.topic("status"), 1, true, "offline"))
+	d.client.Disconnect(250)
+}
+
+// wait blocks until the token completes or times out
+func wait(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New("timed out waiting for the broker")
+	}
+	return token.Error()
+}
+
+func main() {
+	broker := flag.String("broker", "tcp://localhost:1883", "mqtt broker the server reaches the devices through, the same as its -device-broker")
+	prefix := flag.String("prefix", "thermostats/devices", "prefix of the device topics, the same as the -device-topic-prefix of the server")
+	clientPrefix := flag.String("client-prefix", "simdevice-", "prefix of the mqtt client ids, which are named <prefix><id>")
+	count := flag.Int("devices", 2, "number of devices to emulate")
+	firstID := flag.Int("first-id", 1, "id of the thermostat the first device belongs to; the others follow in order")
+	interval := flag.Duration("interval", 5*time.Second, "how often every device reports the temperature of its room")
+	outdoor := flag.Float64("outdoor", 50, "outdoor temperature rooms drift toward while the equipment is off, without a -scenario")
+	scenarioFile := flag.String("scenario", "", "json scenario file setting the starting room temperatures and the outdoor temperature and occupancy over the run")
+	seed := flag.Int64("seed", 0, "seed of the sensor noise, so runs with the same seed and scenario report the same readings; random when 0")
+	noise := flag.Float64("noise", 0, "most degrees a reading is off from the room temperature by, at random")
+	flag.Parse()
+
+	sc := constantScenario(*outdoor, *interval)
+	if *scenarioFile != "" {
+		var err error
+		if sc, err = loadScenario(*scenarioFile, *interval); err != nil {
+			log.Fatalln("failed to load the scenario with error:", err)
+		}
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Println("simulating with seed", *seed)
+
+	var devices []*device
+	for i := 0; i < *count; i++ {
+		d := &device{id: *firstID + i, prefix: *prefix, noise: *noise}
+
+		// every device draws from a source of its own, so its readings don't depend on the others
+		d.rng = rand.New(rand.NewSource(*seed + int64(d.id)))
+		d.temp, d.preset = sc.room(d.id)
+		if err := d.connect(*broker, *clientPrefix); err != nil {
+			log.Fatalln("device", d.id, "failed to connect to", *broker, "with error:", err)
+		}
+		devices = append(devices, d)
+	}
+	log.Println("emulating", len(devices), "devices on", *broker)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	var elapsed time.Duration
+	for {
+		select {
+		case <-ticker.C:
+			outdoor, occupied := sc.at(elapsed)
+			for _, d := range devices {
+				if err := d.report(d.step(outdoor, occupied)); err != nil {
+					log.Println("device", d.id, "failed to report its temperature with error:", err)
+				}
+			}
+			elapsed += sc.step
+		case <-stop:
+			for _, d := range devices {
+				d.disconnect()
+			}
+			return
+		}
+	}
+}
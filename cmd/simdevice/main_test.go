@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestStep(t *testing.T) {
+	tests := []struct {
+		name    string
+		temp    float64
+		desired *desiredState
+		want    float64
+	}{
+		{"waits for desired state", 70, nil, 70},
+		{"heats toward set point", 60, &desiredState{OperatingMode: "heat", HeatSetPoint: 65}, 61},
+		{"stops heating at set point", 64.5, &desiredState{OperatingMode: "heat", HeatSetPoint: 65}, 65},
+		{"cools toward set point", 80, &desiredState{OperatingMode: "cool", CoolSetPoint: 72}, 79},
+		{"stops cooling at set point", 72.5, &desiredState{OperatingMode: "cool", CoolSetPoint: 72}, 72},
+		{"drifts while off", 70, &desiredState{OperatingMode: "off"}, 69},
+		{"drifts once satisfied", 70, &desiredState{OperatingMode: "heat", HeatSetPoint: 65}, 69},
+	}
+
+	for _, tt := range tests {
+		d := &device{temp: tt.temp, desired: tt.desired}
+		if got := d.step(50, false); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestOccupiedStep(t *testing.T) {
+	d := &device{temp: 70, desired: &desiredState{OperatingMode: "off"}}
+	if got := d.step(70, true); got != 70+occupantGain {
+		t.Errorf("expected the occupants to warm the room to %v, got %v", 70+occupantGain, got)
+	}
+}
+
+func TestSeededReadings(t *testing.T) {
+	readings := func(seed int64) []int {
+		d := &device{id: 1, noise: 2, rng: rand.New(rand.NewSource(seed))}
+		var got []int
+		for i := 0; i < 20; i++ {
+			got = append(got, d.read(70))
+		}
+		return got
+	}
+
+	first, again := readings(42), readings(42)
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("expected the same seed to give the same readings, got %v and %v", first, again)
+		}
+		if first[i] < 68 || first[i] > 72 {
+			t.Fatalf("expected the readings to be off by no more than the noise, got %v", first)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// scenario is a run of the simulator, loaded from the file given by -scenario, that starts the rooms at
+// known temperatures and varies the outdoor temperature and whether the home is occupied over the run the
+// same way every time. Times are offsets from the start of the run in simulated time, which moves on by
+// Step with every report, so a run doesn't depend on how fast it happens
+type scenario struct {
+	Step      string             `json:"step"`      // e.g. "5m", defaults to -interval
+	Repeat    string             `json:"repeat"`    // e.g. "24h" to start the curves over, held at their last point when empty
+	Rooms     map[string]float64 `json:"rooms"`     // temperature each room starts at by thermostat id, the server's otherwise
+	Outdoor   []outdoorPoint     `json:"outdoor"`   // followed in a straight line from one point to the next
+	Occupancy []occupancyPoint   `json:"occupancy"` // each holds until the next
+
+	step   time.Duration
+	repeat time.Duration
+}
+
+// outdoorPoint is the outdoor temperature at a point of the run
+type outdoorPoint struct {
+	At   string  `json:"at"`
+	Temp float64 `json:"temp"`
+
+	at time.Duration
+}
+
+// occupancyPoint is whether the home is occupied from a point of the run on
+type occupancyPoint struct {
+	At       string `json:"at"`
+	Occupied bool   `json:"occupied"`
+
+	at time.Duration
+}
+
+// constantScenario returns the scenario of a run without a file, at a constant outdoor temperature in an
+// empty home
+func constantScenario(outdoor float64, step time.Duration) *scenario {
+	return &scenario{Outdoor: []outdoorPoint{{Temp: outdoor}}, step: step}
+}
+
+// loadScenario reads the scenario file at path, defaulting its step to the given one
+func loadScenario(path string, step time.Duration) (*scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if err := s.parse(step); err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return &s, nil
+}
+
+// parse parses the durations of the scenario and puts its points in order
+func (s *scenario) parse(step time.Duration) error {
+	s.step = step
+	if s.Step != "" {
+		d, err := time.ParseDuration(s.Step)
+		if err != nil || d <= 0 {
+			return errors.New("the step '" + s.Step + "' must be a positive duration such as '5m'")
+		}
+		s.step = d
+	}
+	if s.Repeat != "" {
+		d, err := time.ParseDuration(s.Repeat)
+		if err != nil || d <= 0 {
+			return errors.New("the repeat '" + s.Repeat + "' must be a positive duration such as '24h'")
+		}
+		s.repeat = d
+	}
+	for id := range s.Rooms {
+		if _, err := strconv.Atoi(id); err != nil {
+			return errors.New("the room '" + id + "' must be the id of a thermostat")
+		}
+	}
+
+	if len(s.Outdoor) == 0 {
+		return errors.New("the outdoor temperature needs at least one point")
+	}
+	var err error
+	for i := range s.Outdoor {
+		if s.Outdoor[i].at, err = offset("outdoor", s.Outdoor[i].At); err != nil {
+			return err
+		}
+	}
+	for i := range s.Occupancy {
+		if s.Occupancy[i].at, err = offset("occupancy", s.Occupancy[i].At); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(s.Outdoor, func(i, j int) bool { return s.Outdoor[i].at < s.Outdoor[j].at })
+	sort.SliceStable(s.Occupancy, func(i, j int) bool { return s.Occupancy[i].at < s.Occupancy[j].at })
+	return nil
+}
+
+// offset parses how far into the run a point of the given curve is, the start when it's empty
+func offset(curve, at string) (time.Duration, error) {
+	if at == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(at)
+	if err != nil || d < 0 {
+		return 0, errors.New("the " + curve + " point at '" + at + "' must be at a duration into the run such as '6h'")
+	}
+	return d, nil
+}
+
+// room returns the temperature the room of the thermostat with the given id starts at, if the scenario
+// sets one
+func (s *scenario) room(id int) (float64, bool) {
+	temp, ok := s.Rooms[strconv.Itoa(id)]
+	return temp, ok
+}
+
+// at returns the outdoor temperature and whether the home is occupied the given simulated time into the run
+func (s *scenario) at(elapsed time.Duration) (float64, bool) {
+	if s.repeat > 0 {
+		elapsed %= s.repeat
+	}
+
+	outdoor := s.Outdoor[0].Temp
+	for i, p := range s.Outdoor {
+		if p.at > elapsed {
+			if i > 0 {
+				prev := s.Outdoor[i-1]
+				share := float64(elapsed-prev.at) / float64(p.at-prev.at)
+				outdoor = prev.Temp + (p.Temp-prev.Temp)*share
+			}
+			break
+		}
+		outdoor = p.Temp
+	}
+
+	occupied := false
+	for _, p := range s.Occupancy {
+		if p.at > elapsed {
+			break
+		}
+		occupied = p.Occupied
+	}
+	return outdoor, occupied
+}
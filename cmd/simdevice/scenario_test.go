@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestScenario(t *testing.T) {
+	s, err := loadScenario("testdata/winter-day.json", time.Second)
+	if err != nil {
+		t.Fatalf("failed to load the scenario: %s", err)
+	}
+	if s.step != 10*time.Minute {
+		t.Fatalf("expected a step of 10m, got %s", s.step)
+	}
+	if temp, ok := s.room(2); !ok || temp != 58 {
+		t.Fatalf("expected room 2 to start at 58, got %v %v", temp, ok)
+	}
+	if _, ok := s.room(1); ok {
+		t.Fatalf("expected room 1 to start at the temperature of the server")
+	}
+
+	tests := []struct {
+		elapsed  time.Duration
+		outdoor  float64
+		occupied bool
+	}{
+		{0, 40, false},
+		{6 * time.Hour, 50, false},
+		{18 * time.Hour, 60, true},
+		{30 * time.Hour, 50, false},
+	}
+	for _, tt := range tests {
+		if outdoor, occupied := s.at(tt.elapsed); outdoor != tt.outdoor || occupied != tt.occupied {
+			t.Errorf("%s: expected %v %v, got %v %v", tt.elapsed, tt.outdoor, tt.occupied, outdoor, occupied)
+		}
+	}
+
+	for _, body := range []string{`{"outdoor": []}`, `{"step": "-5m", "outdoor": [{"temp": 40}]}`, `{"rooms": {"den": 60}, "outdoor": [{"temp": 40}]}`} {
+		var bad scenario
+		json.Unmarshal([]byte(body), &bad)
+		if err := bad.parse(time.Second); err == nil {
+			t.Errorf("expected %s to be rejected", body)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Command thermload generates load against a running api server with a configurable mix of reads and
+// writes, and reports the throughput and latency percentiles of every kind of request when done. Reads are
+// spread over listing every thermostat, fetching a single one and fetching a single field of one, while
+// writes update the setpoints of a thermostat
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// request kinds the load is made up of
+const (
+	kindList  = "list"
+	kindGet   = "get"
+	kindField = "field"
+	kindWrite = "write"
+)
+
+// loadConfig is how the load is generated
+type loadConfig struct {
+	target     string
+	token      string
+	ids        []int
+	writeRatio float64
+}
+
+// result is the outcome of a single request
+type result struct {
+	kind    string
+	latency time.Duration
+	failed  bool
+}
+
+// stats collects the results of every kind of request
+type stats struct {
+	sync.Mutex
+	latencies map[string][]time.Duration
+	failures  map[string]int
+}
+
+// record adds the result of a request
+func (s *stats) record(r result) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.latencies[r.kind] = append(s.latencies[r.kind], r.latency)
+	if r.failed {
+		s.failures[r.kind]++
+	}
+}
+
+// percentile returns the latency the given share of the sorted latencies is at or below
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// report writes the throughput and latencies of every kind of request over the elapsed time
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	kinds := make([]string, 0, len(s.latencies))
+	for kind := range s.latencies {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "kind\trequests\tfailed\treq/s\tp50\tp90\tp99\tmax\t")
+	var total, failed int
+	for _, kind := range kinds {
+		l := s.latencies[kind]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		total += len(l)
+		failed += s.failures[kind]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n", kind, len(l), s.failures[kind], float64(len(l))/elapsed.Seconds(),
+			percentile(l, 0.5), percentile(l, 0.9), percentile(l, 0.99), l[len(l)-1])
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t%.1f\t\t\t\t\t\n", total, failed, float64(total)/elapsed.Seconds())
+	tw.Flush()
+}
+
+// pick returns the kind of the next request, writing at the configured ratio and spreading reads evenly
+func (c *loadConfig) pick(rnd *rand.Rand) string {
+	if rnd.Float64() < c.writeRatio {
+		return kindWrite
+	}
+	return []string{kindList, kindGet, kindField}[rnd.Intn(3)]
+}
+
+// newRequest builds a request of the given kind against a random thermostat
+func (c *loadConfig) newRequest(kind string, rnd *rand.Rand) (*http.Request, error) {
+	id := strconv.Itoa(c.ids[rnd.Intn(len(c.ids))])
+
+	var req *http.Request
+	var err error
+	switch kind {
+	case kindList:
+		req, err = http.NewRequest("GET", c.target+"/v1/thermostats", nil)
+	case kindGet:
+		req, err = http.NewRequest("GET", c.target+"/v1/thermostats/"+id, nil)
+	case kindField:
+		req, err = http.NewRequest("GET", c.target+"/v1/thermostats/"+id+"/currentTemp", nil)
+	case kindWrite:
+		heat := 60 + rnd.Intn(10)
+		body := `{"heatSetPoint": ` + strconv.Itoa(heat) + `, "coolSetPoint": ` + strconv.Itoa(heat+10) + `}`
+		req, err = http.NewRequest("PUT", c.target+"/v1/thermostats/"+id, strings.NewReader(body))
+	default:
+		return nil, errors.New("unknown request kind " + kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// worker sends requests one after the other until the deadline, or at the given rate when it's above zero
+func worker(client *http.Client, c *loadConfig, s *stats, deadline time.Time, rate float64, seed int64) {
+	rnd := rand.New(rand.NewSource(seed))
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for time.Now().Before(deadline) {
+		if tick != nil {
+			<-tick
+		}
+
+		kind := c.pick(rnd)
+		req, err := c.newRequest(kind, rnd)
+		if err != nil {
+			log.Fatalln("failed to build a request with error:", err)
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		failed := err != nil
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			failed = resp.StatusCode != http.StatusOK
+		}
+		s.record(result{kind: kind, latency: time.Since(start), failed: failed})
+	}
+}
+
+// login exchanges the username and password for an access token
+func login(target, username, password string) (string, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.Post(target+"/v1/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("login failed with status " + resp.Status)
+	}
+
+	var tokens struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// parseIDs parses a comma separated list of thermostat ids
+func parseIDs(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, errors.New("invalid thermostat id " + part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "base url of the server to load")
+	duration := flag.Duration("duration", 30*time.Second, "how long to generate load for")
+	concurrency := flag.Int("concurrency", 8, "number of clients sending requests at the same time")
+	rate := flag.Float64("rate", 0, "requests per second every client sends, or as fast as possible when 0")
+	writeRatio := flag.Float64("write-ratio", 0.1, "share of the requests that are writes, from 0 to 1")
+	ids := flag.String("ids", "1,2", "comma separated ids of the thermostats to read and write")
+	username := flag.String("user", "", "user to log in as when the server requires authentication")
+	password := flag.String("password", "", "password of -user")
+	flag.Parse()
+
+	if *writeRatio < 0 || *writeRatio > 1 {
+		log.Fatalln("-write-ratio must be between 0 and 1")
+	}
+	c := &loadConfig{target: strings.TrimSuffix(*target, "/"), writeRatio: *writeRatio}
+	var err error
+	if c.ids, err = parseIDs(*ids); err != nil {
+		log.Fatalln("failed to parse -ids with error:", err)
+	}
+	if *username != "" {
+		if c.token, err = login(c.target, *username, *password); err != nil {
+			log.Fatalln("failed to log in to", c.target, "with error:", err)
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	s := &stats{latencies: make(map[string][]time.Duration), failures: make(map[string]int)}
+
+	log.Println("loading", c.target, "with", *concurrency, "clients for", *duration)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			worker(client, c, s, deadline, *rate, seed)
+		}(start.UnixNano() + int64(i))
+	}
+	wg.Wait()
+
+	s.report(os.Stdout, time.Since(start))
+}
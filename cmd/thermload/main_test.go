@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	cases := map[float64]time.Duration{
+		0.5:  50 * time.Millisecond,
+		0.9:  90 * time.Millisecond,
+		0.99: 99 * time.Millisecond,
+		1:    100 * time.Millisecond,
+	}
+	for p, expected := range cases {
+		if got := percentile(sorted, p); got != expected {
+			t.Errorf("expected p%v to be %s, got %s", p*100, expected, got)
+		}
+	}
+
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("expected no latency without results, got %s", got)
+	}
+}
+
+func TestPick(t *testing.T) {
+	c := &loadConfig{writeRatio: 0.25}
+	rnd := rand.New(rand.NewSource(1))
+
+	var writes int
+	for i := 0; i < 10000; i++ {
+		if c.pick(rnd) == kindWrite {
+			writes++
+		}
+	}
+	if writes < 2300 || writes > 2700 {
+		t.Fatalf("expected about a quarter of 10000 requests to write, got %d", writes)
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	ids, err := parseIDs("1, 2,5")
+	if err != nil || len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 5 {
+		t.Fatalf("expected ids 1, 2 and 5, got %v %v", ids, err)
+	}
+
+	if _, err := parseIDs("1,x"); err == nil {
+		t.Fatal("expected an error for an invalid id")
+	}
+}
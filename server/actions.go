@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// actionInterval is how often the scheduled actions are checked for a run that is due
+	actionInterval = time.Second
+
+	// actionPreviews is how many of the next runs of a scheduled action are previewed
+	actionPreviews = 5
+)
+
+// scheduledAction is an update applied to a thermostat whenever its cron expression fires, sent in and
+// returned through the api @ /v1/actions. The expression is a standard five field one evaluated in the
+// local time of the server, unless it starts with a time zone such as CRON_TZ=America/Chicago. Instead of
+// a cron expression, an action can be anchored to the sunrise or sunset at -latitude and -longitude, moved
+// by an offset such as -30m
+type scheduledAction struct {
+	ID           int              `json:"id"`
+	ThermostatID int              `json:"thermostatId"`
+	Cron         string           `json:"cron,omitempty"`
+	Sun          string           `json:"sun,omitempty"`
+	Offset       string           `json:"offset,omitempty"`
+	Update       updateThermostat `json:"update"`
+	LastRun      *time.Time       `json:"lastRun,omitempty"`
+	LastError    string           `json:"lastError,omitempty"`
+	NextRuns     []time.Time      `json:"nextRuns"`
+
+	schedule cron.Schedule
+	next     time.Time
+}
+
+// actionStore holds the scheduled actions, persisting them to -actions-file so they survive a restart
+type actionStore struct {
+	sync.Mutex
+	actions map[int]*scheduledAction
+	lastID  int
+}
+
+var actions = &actionStore{actions: make(map[int]*scheduledAction)}
+
+// parseCron parses the cron expression of a scheduled action, which follows the holiday calendar
+func parseCron(expr string) (cron.Schedule, *errResponse) {
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Cron Expression",
+			Description: "The cron expression '" + expr + "' is not valid: " + err.Error() + ". It needs five fields, e.g. '30 6 * * 1-5' for 6:30 on weekdays.",
+		}
+	}
+	if spec, ok := schedule.(*cron.SpecSchedule); ok {
+		return newHolidaySchedule(spec), nil
+	}
+	return schedule, nil
+}
+
+// parseTrigger parses what the action is triggered by, either its cron expression or the sun event with
+// its offset
+func parseTrigger(a scheduledAction) (cron.Schedule, *errResponse) {
+	if a.Sun == "" {
+		if a.Offset != "" {
+			return nil, &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Offset",
+				Description: "An offset can only be given with sun: 'sunrise' or 'sunset'.",
+			}
+		}
+		return parseCron(a.Cron)
+	}
+
+	if a.Cron != "" {
+		return nil, &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Trigger",
+			Description: "An action is either scheduled with a cron expression or at the sun, not both.",
+		}
+	}
+	if a.Sun != sunrise && a.Sun != sunset {
+		return nil, &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Sun Event",
+			Description: "The sun event '" + a.Sun + "' is not valid. Valid choices are 'sunrise' or 'sunset'.",
+		}
+	}
+	var offset time.Duration
+	if a.Offset != "" {
+		var err error
+		if offset, err = time.ParseDuration(a.Offset); err != nil {
+			return nil, &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Offset",
+				Description: "The offset '" + a.Offset + "' is not a valid duration, e.g. '-30m' or '1h15m'.",
+			}
+		}
+	}
+	if cfg.Latitude == 0 && cfg.Longitude == 0 {
+		return nil, &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Location Not Configured",
+			Description: "Actions can only be scheduled at the sun once the server is started with -latitude and -longitude.",
+		}
+	}
+
+	return sunSchedule{event: a.Sun, offset: offset, lat: cfg.Latitude, lon: cfg.Longitude}, nil
+}
+
+// nextRuns returns the next n times the schedule fires after the given time
+func nextRuns(schedule cron.Schedule, after time.Time, n int) []time.Time {
+	runs := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		after = schedule.Next(after)
+		if after.IsZero() {
+			break
+		}
+		runs = append(runs, after)
+	}
+	return runs
+}
+
+// copy returns a copy of the action that's safe to use without the lock, previewing its next runs
+func (a *scheduledAction) copy() scheduledAction {
+	copied := *a
+	copied.NextRuns = []time.Time{}
+	if !a.next.IsZero() {
+		copied.NextRuns = append([]time.Time{a.next}, nextRuns(a.schedule, a.next, actionPreviews-1)...)
+	}
+	return copied
+}
+
+// load restores the scheduled actions persisted at path. A missing file means there are none
+func (s *actionStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []*scheduledAction
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := clock.Now()
+	for _, a := range saved {
+		schedule, errRes := parseTrigger(*a)
+		if errRes != nil {
+			return errors.New("action " + strconv.Itoa(a.ID) + ": " + errRes.Description)
+		}
+		a.schedule = schedule
+		a.next = schedule.Next(now)
+		a.NextRuns = nil
+		s.actions[a.ID] = a
+		if a.ID > s.lastID {
+			s.lastID = a.ID
+		}
+	}
+	return nil
+}
+
+// save persists every scheduled action to -actions-file, if given. The lock must be held
+func (s *actionStore) save() error {
+	if cfg.ActionsFile == "" {
+		return nil
+	}
+
+	saved := make([]*scheduledAction, 0, len(s.actions))
+	for _, a := range s.actions {
+		saved = append(saved, a)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+
+	jsn, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.ActionsFile, jsn, 0644)
+}
+
+// Add schedules a new action, returning it with its id
+func (s *actionStore) Add(a scheduledAction, schedule cron.Schedule) (scheduledAction, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	a.ID = s.lastID + 1
+	a.LastRun, a.LastError, a.NextRuns = nil, "", nil
+	a.schedule = schedule
+	a.next = schedule.Next(clock.Now())
+
+	s.actions[a.ID] = &a
+	if err := s.save(); err != nil {
+		delete(s.actions, a.ID)
+		return scheduledAction{}, err
+	}
+	s.lastID = a.ID
+
+	return a.copy(), nil
+}
+
+// Replace replaces every action of the thermostat with the given ones, whose schedules are already parsed,
+// returning them with their ids
+func (s *actionStore) Replace(thermostatID int, replacing []scheduledAction) ([]scheduledAction, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, lastID := s.actions, s.lastID
+	s.actions = make(map[int]*scheduledAction)
+	for id, a := range previous {
+		if a.ThermostatID != thermostatID {
+			s.actions[id] = a
+		}
+	}
+
+	now := clock.Now()
+	for i := range replacing {
+		a := replacing[i]
+		s.lastID++
+		a.ID, a.ThermostatID = s.lastID, thermostatID
+		a.LastRun, a.LastError, a.NextRuns = nil, "", nil
+		a.next = a.schedule.Next(now)
+		s.actions[a.ID] = &a
+	}
+	if err := s.save(); err != nil {
+		s.actions, s.lastID = previous, lastID
+		return nil, err
+	}
+
+	replaced := make([]scheduledAction, 0, len(replacing))
+	for id := lastID + 1; id <= s.lastID; id++ {
+		replaced = append(replaced, s.actions[id].copy())
+	}
+	return replaced, nil
+}
+
+// Action returns the scheduled action with the given id
+func (s *actionStore) Action(id int) (scheduledAction, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	a, ok := s.actions[id]
+	if !ok {
+		return scheduledAction{}, false
+	}
+	return a.copy(), true
+}
+
+// Actions returns the scheduled actions of the thermostat with the given id, or of every thermostat when
+// it's 0, by id
+func (s *actionStore) Actions(thermostatID int) []scheduledAction {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []scheduledAction{}
+	for _, a := range s.actions {
+		if thermostatID == 0 || a.ThermostatID == thermostatID {
+			list = append(list, a.copy())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// Remove unschedules the action with the given id, reporting whether there was one
+func (s *actionStore) Remove(id int) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	a, ok := s.actions[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.actions, id)
+	if err := s.save(); err != nil {
+		s.actions[id] = a
+		return true, err
+	}
+	return true, nil
+}
+
+// due returns the actions whose next run has come, moving them on to the run after it
+func (s *actionStore) due(now time.Time) []*scheduledAction {
+	s.Lock()
+	defer s.Unlock()
+
+	var due []*scheduledAction
+	for _, a := range s.actions {
+		if a.next.IsZero() || a.next.After(now) {
+			continue
+		}
+		due = append(due, a)
+		a.next = a.schedule.Next(now)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+
+	return due
+}
+
+// reschedule moves every action on to its next run after now, e.g. once the holiday calendar changed
+func (s *actionStore) reschedule(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, a := range s.actions {
+		a.next = a.schedule.Next(now)
+	}
+}
+
+// ran records the outcome of a run of the action
+func (s *actionStore) ran(a *scheduledAction, at time.Time, errRes *errResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	a.LastRun = &at
+	a.LastError = ""
+	if errRes != nil {
+		a.LastError = errRes.Description
+	}
+	if err := s.save(); err != nil {
+		log.Println("failed to persist the scheduled actions with error:", err)
+	}
+}
+
+// reset drops every scheduled action
+func (s *actionStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.actions = make(map[int]*scheduledAction)
+	s.lastID = 0
+}
+
+// apply applies the update of the action to its thermostat. Scheduled actions are automated writes, so
+// they're skipped while the thermostat can't be written to
+func (a *scheduledAction) apply() *errResponse {
+	if errRes := checkReadOnly(); errRes != nil {
+		return errRes
+	}
+	t, errRes := home.Thermostat(a.ThermostatID)
+	if errRes != nil {
+		return errRes
+	}
+	if errRes := checkAutomatedWrite(t); errRes != nil {
+		return errRes
+	}
+	if errRes := checkDisabled(t, a.Update); errRes != nil {
+		return errRes
+	}
+	if errRes := checkOffline(t); errRes != nil {
+		return errRes
+	}
+
+	_, err := retryChanged(t, func(current *thermostat) (*thermostat, error) {
+		return home.UpdateThermostat(current, a.Update)
+	})
+	if err != nil {
+		return commitError(err)
+	}
+	return nil
+}
+
+// runActions applies the scheduled actions as they come due until stop is closed. Only the leader writes,
+// as with every other automated change
+func runActions(interval time.Duration, stop <-chan struct{}) {
+	for clock.sleep(interval, stop) {
+		if !cluster.IsLeader() {
+			continue
+		}
+		runDueActions(clock.Now())
+	}
+}
+
+// runDueActions applies every scheduled action whose next run has come by now
+func runDueActions(now time.Time) {
+	for _, a := range actions.due(now) {
+		debugln(subsystemScheduler, "running scheduled action", a.ID, "on thermostat", a.ThermostatID)
+		errRes := a.apply()
+		if errRes != nil {
+			log.Println("skipped scheduled action", a.ID, "on thermostat", a.ThermostatID, "-", errRes.Description)
+		}
+		actions.ran(a, now, errRes)
+	}
+}
+
+// actionID returns the id of the action in the path, or the error to send back for it
+func actionID(req *fasthttp.RequestCtx) (int, *errResponse) {
+	id, err := strconv.Atoi(req.UserValue("action").(string))
+	if err != nil {
+		return 0, &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid identifier provided",
+			Description: err.Error(),
+		}
+	}
+	return id, nil
+}
+
+// actionNotFound returns the error sent back for an action that doesn't exist
+func actionNotFound(id int) *errResponse {
+	return &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "No scheduled action found for id: " + strconv.Itoa(id),
+	}
+}
+
+// GetActions is the handler to return the scheduled actions, optionally only those of the thermostat given
+// by ?thermostat
+func GetActions(req *fasthttp.RequestCtx) {
+	var thermostatID int
+	if s := req.QueryArgs().Peek("thermostat"); len(s) > 0 {
+		var err error
+		if thermostatID, err = strconv.Atoi(string(s)); err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid identifier provided",
+				Description: err.Error(),
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, actions.Actions(thermostatID))
+}
+
+// PostAction is the handler to schedule a new action
+func PostAction(req *fasthttp.RequestCtx) {
+	var a scheduledAction
+	if err := unmarshalStrict(req.PostBody(), &a); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	schedule, errRes := parseTrigger(a)
+	if errRes == nil {
+		errRes = validateData(a.Update)
+	}
+	if errRes == nil {
+		errRes = checkUserRange(requestUser(req), a.Update.HeatSetPoint, a.Update.CoolSetPoint)
+	}
+	if errRes == nil {
+		_, errRes = home.Thermostat(a.ThermostatID)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	added, err := actions.Add(a, schedule)
+	if err != nil {
+		res := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to persist scheduled action",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, res)
+		return
+	}
+
+	req.Response.Header.Set("Location", "/v1/actions/"+strconv.Itoa(added.ID))
+	req.SetStatusCode(http.StatusCreated)
+	sendJSON(req, added)
+}
+
+// GetAction is the handler to return a scheduled action along with a preview of its next runs
+func GetAction(req *fasthttp.RequestCtx) {
+	id, errRes := actionID(req)
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	a, ok := actions.Action(id)
+	if !ok {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, actionNotFound(id))
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, a)
+}
+
+// DeleteAction is the handler to unschedule an action
+func DeleteAction(req *fasthttp.RequestCtx) {
+	id, errRes := actionID(req)
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	found, err := actions.Remove(id)
+	if err != nil {
+		res := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to persist scheduled action",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, res)
+		return
+	}
+	if !found {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, actionNotFound(id))
+		return
+	}
+
+	req.SetStatusCode(http.StatusNoContent)
+}
+
+// GetActionPreview is the handler to preview the next runs of the cron expression given by ?cron, or of
+// the sun event given by ?sun and ?offset, without scheduling anything
+func GetActionPreview(req *fasthttp.RequestCtx) {
+	args := req.QueryArgs()
+	schedule, errRes := parseTrigger(scheduledAction{
+		Cron:   string(args.Peek("cron")),
+		Sun:    string(args.Peek("sun")),
+		Offset: string(args.Peek("offset")),
+	})
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, nextRuns(schedule, clock.Now(), actionPreviews))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// postAction schedules the action in the body, returning the status code and the action scheduled
+func postAction(base, body string, t *testing.T) (int, scheduledAction) {
+	resp, err := http.Post(base+"/v1/actions", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var a scheduledAction
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+			t.Fatalf("failed to decode the scheduled action: %s", err)
+		}
+		if loc := resp.Header.Get("Location"); loc != "/v1/actions/"+strconv.Itoa(a.ID) {
+			t.Fatalf("expected the location of the scheduled action, got %q", loc)
+		}
+	}
+	return resp.StatusCode, a
+}
+
+func TestScheduledActions(t *testing.T) {
+	base := newTestServer(t)
+
+	if code, _ := postAction(base, `{"thermostatId": 1, "cron": "every morning", "update": {"fan": "on"}}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid cron expression, got %d", http.StatusBadRequest, code)
+	}
+	if code, _ := postAction(base, `{"thermostatId": 1, "cron": "0 7 * * *", "update": {"fan": "sideways"}}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid update, got %d", http.StatusBadRequest, code)
+	}
+	if code, _ := postAction(base, `{"thermostatId": 999, "cron": "0 7 * * *", "update": {"fan": "on"}}`, t); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for an unknown thermostat, got %d", http.StatusNotFound, code)
+	}
+
+	code, a := postAction(base, `{"thermostatId": 1, "cron": "*/15 * * * *", "update": {"fan": "on", "heatSetPoint": 62}}`, t)
+	if code != http.StatusCreated || a.ID != 1 || len(a.NextRuns) != actionPreviews {
+		t.Fatalf("expected the action to be scheduled with a preview of its next runs, got %d %+v", code, a)
+	}
+	for i := 1; i < len(a.NextRuns); i++ {
+		if gap := a.NextRuns[i].Sub(a.NextRuns[i-1]); gap != 15*time.Minute {
+			t.Fatalf("expected the runs to be 15 minutes apart, got %s", gap)
+		}
+	}
+
+	var list []scheduledAction
+	get(base+"/v1/actions?thermostat=2", t, &list)
+	if len(list) != 0 {
+		t.Fatalf("expected no actions for thermostat 2, got %+v", list)
+	}
+
+	// the update is applied once the next run comes
+	first := a.NextRuns[0]
+	runDueActions(first)
+	var th thermostat
+	get(base+"/v1/thermostats/1", t, &th)
+	if th.FanMode != "on" || th.HeatSetPoint != 62 {
+		t.Fatalf("expected the update to be applied, got fan %s and heat set point %d", th.FanMode, th.HeatSetPoint)
+	}
+	get(base+"/v1/actions/1", t, &a)
+	if a.LastRun == nil || !a.LastRun.Equal(first) || !a.NextRuns[0].Equal(first.Add(15*time.Minute)) || a.LastError != "" {
+		t.Fatalf("expected the run to be recorded, got %+v", a)
+	}
+
+	// a fresh server picks the action back up from the actions file
+	saved := actions.Actions(0)
+	actions.reset()
+	if err := actions.load(cfg.ActionsFile); err != nil {
+		t.Fatalf("failed to load the actions file: %s", err)
+	}
+	if restored := actions.Actions(0); len(restored) != 1 || restored[0].Cron != saved[0].Cron || restored[0].Update.HeatSetPoint != 62 {
+		t.Fatalf("expected the action to be restored, got %+v", restored)
+	}
+
+	if code := del(base+"/v1/actions/1", t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected status %d when deleting the action, got %d", http.StatusNoContent, code)
+	}
+	if code := del(base+"/v1/actions/1", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for a deleted action, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestActionPreview(t *testing.T) {
+	base := newTestServer(t)
+
+	var runs []time.Time
+	get(base+"/v1/actions/preview?cron="+url.QueryEscape("CRON_TZ=UTC 30 6 * * 1-5"), t, &runs)
+	if len(runs) != actionPreviews {
+		t.Fatalf("expected %d runs, got %v", actionPreviews, runs)
+	}
+	for _, run := range runs {
+		if run = run.UTC(); run.Hour() != 6 || run.Minute() != 30 || run.Weekday() == time.Saturday || run.Weekday() == time.Sunday {
+			t.Fatalf("expected every run to be at 6:30 on a weekday, got %s", run)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// defaultAdjustStep is how many degrees an increment or decrement moves the setpoints by, unless a step
+	// is given
+	defaultAdjustStep = 1
+
+	// maxAdjustStep is the biggest step an increment or decrement can take
+	maxAdjustStep = 10
+)
+
+// adjustRequest is the optional body sent in through the api @ /v1/thermostats/:id/increment and
+// /v1/thermostats/:id/decrement
+type adjustRequest struct {
+	Step     int    `json:"step"`     // degrees to move by, 1 by default
+	SetPoint string `json:"setPoint"` // "heat" or "cool", by default the setpoints of the current mode
+}
+
+// adjusted returns the update that moves the setpoints of the thermostat by the given degrees. Without a
+// setpoint to move, those of the current mode move as a boost does: the heat set point in heat, the cool
+// set point in cool and both in auto
+func adjusted(target *thermostat, setPoint string, by int) (updateThermostat, *errResponse) {
+	heat, cool := setPoint == "heat", setPoint == "cool"
+	switch {
+	case setPoint != "" && !heat && !cool:
+		return updateThermostat{}, &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Set Point",
+			Description: "The set point to adjust must be 'heat' or 'cool'.",
+		}
+	case setPoint == "" && target.OperatingMode != "heat" && target.OperatingMode != "cool" && target.OperatingMode != "auto":
+		return updateThermostat{}, &errResponse{
+			Code:        http.StatusConflict,
+			Msg:         "Nothing To Adjust",
+			Description: "Thermostat " + strconv.Itoa(target.ID) + " is in " + target.OperatingMode + " mode. Give the set point to adjust with 'setPoint'.",
+		}
+	case setPoint == "":
+		heat, cool = target.OperatingMode != "cool", target.OperatingMode != "heat"
+	}
+
+	var desired updateThermostat
+	if heat {
+		desired.HeatSetPoint = target.HeatSetPoint + by
+		if errRes := validateHeatSetPt(desired.HeatSetPoint); errRes != nil {
+			return desired, errRes
+		}
+	}
+	if cool {
+		desired.CoolSetPoint = target.CoolSetPoint + by
+		if errRes := validateCoolSetPt(desired.CoolSetPoint); errRes != nil {
+			return desired, errRes
+		}
+	}
+	return desired, nil
+}
+
+// adjust moves the setpoints of the thermostat of the request up or down by the step given, so buttons and
+// voice assistants can nudge the temperature without reading it first
+func adjust(req *fasthttp.RequestCtx, direction int) {
+	var body adjustRequest
+	if len(req.PostBody()) > 0 {
+		if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid JSON body provided",
+				Description: err.Error(),
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+	if body.Step == 0 {
+		body.Step = defaultAdjustStep
+	}
+	if body.Step < 0 || body.Step > maxAdjustStep {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Step",
+			Description: "The step must be from 1 to " + strconv.Itoa(maxAdjustStep) + " degrees.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	desired, errRes := adjusted(target, body.SetPoint, direction*body.Step)
+	if errRes == nil {
+		errRes = checkUserRange(requestUser(req), desired.HeatSetPoint, desired.CoolSetPoint)
+	}
+	if errRes == nil {
+		errRes = checkDisabled(target, desired)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	updated, err := home.UpdateThermostat(target, desired)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// PostIncrement is the handler to raise the setpoints of a specific thermostat
+func PostIncrement(req *fasthttp.RequestCtx) {
+	adjust(req, 1)
+}
+
+// PostDecrement is the handler to lower the setpoints of a specific thermostat
+func PostDecrement(req *fasthttp.RequestCtx) {
+	adjust(req, -1)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// postAdjust posts to the increment or decrement endpoint of the thermostat at url, returning the status
+// code and the thermostat
+func postAdjust(url, body string, t *testing.T) (int, thermostat) {
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var th thermostat
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&th); err != nil {
+			t.Fatalf("failed to decode the thermostat: %s", err)
+		}
+	}
+	return resp.StatusCode, th
+}
+
+func TestAdjust(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1"
+
+	target, _ := home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+
+	// without a body the setpoint of the mode moves by a degree
+	if code, th := postAdjust(url+"/increment", "", t); code != http.StatusOK || th.HeatSetPoint != 69 || th.CoolSetPoint != 74 {
+		t.Fatalf("expected the heat set point to go up by 1, got %d %+v", code, th)
+	}
+	if code, th := postAdjust(url+"/decrement", `{"step": 3}`, t); code != http.StatusOK || th.HeatSetPoint != 66 {
+		t.Fatalf("expected the heat set point to go down by 3, got %d %+v", code, th)
+	}
+	if code, th := postAdjust(url+"/increment", `{"step": 2, "setPoint": "cool"}`, t); code != http.StatusOK || th.HeatSetPoint != 66 || th.CoolSetPoint != 76 {
+		t.Fatalf("expected the cool set point to go up by 2, got %d %+v", code, th)
+	}
+
+	target, _ = home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "auto"})
+	if code, th := postAdjust(url+"/decrement", "", t); code != http.StatusOK || th.HeatSetPoint != 65 || th.CoolSetPoint != 75 {
+		t.Fatalf("expected both set points to go down in auto, got %d %+v", code, th)
+	}
+
+	for _, body := range []string{`{"step": -1}`, `{"step": 11}`, `{"setPoint": "fan"}`} {
+		if code, _ := postAdjust(url+"/decrement", body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	target, _ = home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{HeatSetPoint: minHeatSetPt + 1})
+	if code, _ := postAdjust(url+"/decrement", `{"step": 2, "setPoint": "heat"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d below the allowed range, got %d", http.StatusBadRequest, code)
+	}
+
+	target, _ = home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "off", HeatSetPoint: 65})
+	if code, _ := postAdjust(url+"/increment", "", t); code != http.StatusConflict {
+		t.Fatalf("expected status %d when off, got %d", http.StatusConflict, code)
+	}
+	if code, th := postAdjust(url+"/increment", `{"setPoint": "heat"}`, t); code != http.StatusOK || th.HeatSetPoint != 66 {
+		t.Fatalf("expected the heat set point to go up when named, got %d %+v", code, th)
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	alertFiring       = "firing"
+	alertAcknowledged = "acknowledged"
+	alertResolved     = "resolved"
+
+	// maxAlerts is how many alerts are kept. Once there are more, the oldest resolved ones are forgotten
+	maxAlerts = 1000
+
+	// maxNoteLength is the longest note that can be added to an alert
+	maxNoteLength = 1000
+)
+
+// alertNote is a note added to an alert, e.g. by whoever is on call
+type alertNote struct {
+	Time   time.Time `json:"time"`
+	Author string    `json:"author,omitempty"`
+	Text   string    `json:"text"`
+}
+
+// alert is raised by an anomaly, a safety limit, a device going offline or failing equipment and returned through the api @
+// /v1/alerts. It fires until someone acknowledges it and stays open until it's resolved, either by hand or
+// when what raised it clears: a device coming back online or a safety limit deactivating. Firing again
+// while open counts up instead of raising another alert. Alerts raised during a suppression window are
+// marked as suppressed. Equipment alerts are routed to whoever is OnCall when they fire, see /v1/oncall
+type alert struct {
+	ID             int         `json:"id"`
+	ThermostatID   int         `json:"thermostatId"`
+	Type           string      `json:"type"`
+	Severity       string      `json:"severity"`
+	Detail         string      `json:"detail"`
+	State          string      `json:"state"`
+	Suppressed     bool        `json:"suppressed,omitempty"`
+	OnCall         string      `json:"onCall,omitempty"`
+	Count          int         `json:"count"`
+	FiredAt        time.Time   `json:"firedAt"`
+	LastFiredAt    time.Time   `json:"lastFiredAt"`
+	AcknowledgedAt *time.Time  `json:"acknowledgedAt,omitempty"`
+	AcknowledgedBy string      `json:"acknowledgedBy,omitempty"`
+	ResolvedAt     *time.Time  `json:"resolvedAt,omitempty"`
+	ResolvedBy     string      `json:"resolvedBy,omitempty"`
+	Notes          []alertNote `json:"notes"`
+}
+
+// suppression silences the alerts of a thermostat, or of every thermostat when ThermostatID is 0, for a
+// window of time, e.g. during planned work. Type limits it to one type of alert. It's sent in and returned
+// through the api @ /v1/suppressions
+type suppression struct {
+	ID           int       `json:"id"`
+	ThermostatID int       `json:"thermostatId,omitempty"`
+	Type         string    `json:"type,omitempty"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// alertRequest is the optional body sent in through the api @ /v1/alerts/:alert/acknowledge and
+// /v1/alerts/:alert/resolve, and the required one @ /v1/alerts/:alert/notes
+type alertRequest struct {
+	Note string `json:"note"`
+}
+
+// alertStore provides safe concurrent access to the alerts and suppression windows
+type alertStore struct {
+	sync.Mutex
+	alerts       []*alert
+	suppressions []suppression
+	lastID       int
+	lastSuppID   int
+}
+
+var alerts = &alertStore{}
+
+// alertTypes are the types of event that raise alerts
+var alertTypes = []string{eventAnomaly, eventSafety, eventOffline, eventEquipment}
+
+// raisesAlert reports whether an event of the type and severity raises an alert. Safety events only do
+// when a limit activates, their info events tell that it deactivated
+func raisesAlert(typ, severity string) bool {
+	return typ == eventAnomaly || typ == eventOffline || typ == eventEquipment || typ == eventSafety && severity != severityInfo
+}
+
+// reset forgets every alert and suppression window
+func (s *alertStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.alerts = nil
+	s.suppressions = nil
+	s.lastID = 0
+	s.lastSuppID = 0
+}
+
+// Observe raises, bumps or resolves the alerts of the thermostat for the event about it. Users are
+// notified of every new alert that isn't suppressed
+func (s *alertStore) Observe(typ string, t *thermostat, severity, detail string, now time.Time) {
+	switch {
+	case raisesAlert(typ, severity):
+		if a, raised := s.fire(typ, t.ID, severity, detail, now); raised && !a.Suppressed {
+			notifyAlert(a)
+		}
+	case typ == eventSafety:
+		s.clear(eventSafety, t.ID, now)
+	case typ == eventOnline:
+		s.clear(eventOffline, t.ID, now)
+	}
+}
+
+// open returns the alert of the type that is open on the thermostat, if any. The caller must hold the lock
+func (s *alertStore) open(typ string, thermostatID int) *alert {
+	for _, a := range s.alerts {
+		if a.Type == typ && a.ThermostatID == thermostatID && a.State != alertResolved {
+			return a
+		}
+	}
+	return nil
+}
+
+// fire raises an alert, or counts up the one already open for the same thermostat and type, returning the
+// alert and whether it was raised
+func (s *alertStore) fire(typ string, thermostatID int, severity, detail string, now time.Time) (alert, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if a := s.open(typ, thermostatID); a != nil {
+		a.Count++
+		a.LastFiredAt = now
+		a.Severity = severity
+		a.Detail = detail
+		return copyAlert(a), false
+	}
+
+	s.lastID++
+	a := &alert{
+		ID:           s.lastID,
+		ThermostatID: thermostatID,
+		Type:         typ,
+		Severity:     severity,
+		Detail:       detail,
+		State:        alertFiring,
+		Suppressed:   s.suppressed(typ, thermostatID, now),
+		Count:        1,
+		FiredAt:      now,
+		LastFiredAt:  now,
+		Notes:        []alertNote{},
+	}
+	if typ == eventEquipment {
+		a.OnCall, _ = onCall.Routes(now)
+	}
+	s.alerts = append(s.alerts, a)
+	s.prune()
+	return copyAlert(a), true
+}
+
+// clear resolves the alert of the type open on the thermostat, now that what raised it has cleared
+func (s *alertStore) clear(typ string, thermostatID int, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	if a := s.open(typ, thermostatID); a != nil {
+		a.State = alertResolved
+		a.ResolvedAt = &now
+	}
+}
+
+// prune forgets the oldest resolved alerts while there are more than maxAlerts. The caller must hold the
+// lock
+func (s *alertStore) prune() {
+	for i := 0; len(s.alerts) > maxAlerts && i < len(s.alerts); {
+		if s.alerts[i].State == alertResolved {
+			s.alerts = append(s.alerts[:i], s.alerts[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// PurgeResolved forgets the resolved alerts of the thermostat and returns how many were forgotten. Open
+// alerts are kept, as what raised them hasn't cleared
+func (s *alertStore) PurgeResolved(thermostatID int) int {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.alerts[:0]
+	for _, a := range s.alerts {
+		if a.ThermostatID == thermostatID && a.State == alertResolved {
+			continue
+		}
+		kept = append(kept, a)
+	}
+	purged := len(s.alerts) - len(kept)
+	s.alerts = kept
+	return purged
+}
+
+// Forget removes every alert of the thermostat, open or not, and the suppression windows of it alone, as it
+// is removed
+func (s *alertStore) Forget(thermostatID int) {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.alerts[:0]
+	for _, a := range s.alerts {
+		if a.ThermostatID != thermostatID {
+			kept = append(kept, a)
+		}
+	}
+	s.alerts = kept
+
+	supps := s.suppressions[:0]
+	for _, sp := range s.suppressions {
+		if sp.ThermostatID != thermostatID {
+			supps = append(supps, sp)
+		}
+	}
+	s.suppressions = supps
+}
+
+// ForgetUser removes the user from the alerts, as who they were routed to, who acknowledged or resolved
+// them and the author of their notes, and returns how many alerts named the user. The notes themselves are
+// kept, as the record of the alert
+func (s *alertStore) ForgetUser(username string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	forgotten := 0
+	for _, a := range s.alerts {
+		named := false
+		if a.OnCall == username {
+			a.OnCall, named = "", true
+		}
+		if a.AcknowledgedBy == username {
+			a.AcknowledgedBy, named = "", true
+		}
+		if a.ResolvedBy == username {
+			a.ResolvedBy, named = "", true
+		}
+		for i := range a.Notes {
+			if a.Notes[i].Author == username {
+				a.Notes[i].Author, named = "", true
+			}
+		}
+		if named {
+			forgotten++
+		}
+	}
+	return forgotten
+}
+
+// suppressed reports whether a suppression window covers an alert of the type on the thermostat at the
+// given time. The caller must hold the lock
+func (s *alertStore) suppressed(typ string, thermostatID int, now time.Time) bool {
+	for _, sp := range s.suppressions {
+		if (sp.ThermostatID == 0 || sp.ThermostatID == thermostatID) && (sp.Type == "" || sp.Type == typ) &&
+			!now.Before(sp.Start) && now.Before(sp.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyAlert returns a copy of the alert that's safe to use without the lock
+func copyAlert(a *alert) alert {
+	copied := *a
+	copied.Notes = append([]alertNote{}, a.Notes...)
+	return copied
+}
+
+// Alerts returns the alerts, newest first, of the given state, thermostat and type, any of which may be
+// empty to match every alert
+func (s *alertStore) Alerts(state string, thermostatID int, typ string) []alert {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []alert{}
+	for i := len(s.alerts) - 1; i >= 0; i-- {
+		a := s.alerts[i]
+		if (state == "" || a.State == state) && (thermostatID == 0 || a.ThermostatID == thermostatID) && (typ == "" || a.Type == typ) {
+			list = append(list, copyAlert(a))
+		}
+	}
+	return list
+}
+
+// Alert returns the alert with the given id
+func (s *alertStore) Alert(id int) (alert, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, a := range s.alerts {
+		if a.ID == id {
+			return copyAlert(a), true
+		}
+	}
+	return alert{}, false
+}
+
+// Update moves the alert with the given id to the state given, unless it's empty, and adds the note, unless
+// it's empty. Resolved alerts can still be annotated but not moved
+func (s *alertStore) Update(id int, state, author, note string, now time.Time) (alert, *errResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	var a *alert
+	for _, candidate := range s.alerts {
+		if candidate.ID == id {
+			a = candidate
+		}
+	}
+	if a == nil {
+		return alert{}, alertNotFound(id)
+	}
+
+	switch {
+	case state != "" && a.State == alertResolved:
+		return alert{}, &errResponse{
+			Code:        http.StatusConflict,
+			Msg:         "Alert Resolved",
+			Description: "Alert " + strconv.Itoa(id) + " is already resolved.",
+		}
+	case state == alertAcknowledged && a.State == alertAcknowledged:
+		return alert{}, &errResponse{
+			Code:        http.StatusConflict,
+			Msg:         "Alert Acknowledged",
+			Description: "Alert " + strconv.Itoa(id) + " was already acknowledged by " + a.AcknowledgedBy + " at " + a.AcknowledgedAt.Format(time.RFC3339) + ".",
+		}
+	case state == alertAcknowledged:
+		a.AcknowledgedAt, a.AcknowledgedBy = &now, author
+	case state == alertResolved:
+		a.ResolvedAt, a.ResolvedBy = &now, author
+	}
+	if state != "" {
+		a.State = state
+	}
+	if note != "" {
+		a.Notes = append(a.Notes, alertNote{Time: now, Author: author, Text: note})
+	}
+	return copyAlert(a), nil
+}
+
+// Suppressions returns the suppression windows that haven't ended by now, in the order they start
+func (s *alertStore) Suppressions(now time.Time) []suppression {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []suppression{}
+	for _, sp := range s.suppressions {
+		if now.Before(sp.End) {
+			list = append(list, sp)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// Suppress adds the suppression window, dropping those that have ended
+func (s *alertStore) Suppress(sp suppression, now time.Time) suppression {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.suppressions[:0]
+	for _, existing := range s.suppressions {
+		if now.Before(existing.End) {
+			kept = append(kept, existing)
+		}
+	}
+	s.lastSuppID++
+	sp.ID = s.lastSuppID
+	s.suppressions = append(kept, sp)
+	return sp
+}
+
+// Unsuppress removes the suppression window with the given id, reporting whether it existed
+func (s *alertStore) Unsuppress(id int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, sp := range s.suppressions {
+		if sp.ID == id {
+			s.suppressions = append(s.suppressions[:i], s.suppressions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// alertNotFound returns the error sent back for an alert that doesn't exist
+func alertNotFound(id int) *errResponse {
+	return &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "No alert found for id: " + strconv.Itoa(id),
+	}
+}
+
+// paramID returns the integer id in the given path param of the request
+func paramID(req *fasthttp.RequestCtx, param string) (int, *errResponse) {
+	id, err := strconv.Atoi(req.UserValue(param).(string))
+	if err != nil {
+		return 0, &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid identifier provided",
+			Description: err.Error(),
+		}
+	}
+	return id, nil
+}
+
+// validAlertType makes sure the alert type given is one alerts are raised for, or empty
+func validAlertType(typ string) *errResponse {
+	if typ == "" {
+		return nil
+	}
+	for _, valid := range alertTypes {
+		if typ == valid {
+			return nil
+		}
+	}
+	return &errResponse{
+		Code:        http.StatusBadRequest,
+		Msg:         "Invalid Alert Type",
+		Description: "The alert type provided is not valid. Valid choices are: 'anomaly', 'safety', 'offline' or 'equipment'.",
+	}
+}
+
+// GetAlerts is the handler to return the alerts, newest first, optionally only those in the state given by
+// ?state, of the thermostat given by ?thermostat or of the type given by ?type
+func GetAlerts(req *fasthttp.RequestCtx) {
+	args := req.QueryArgs()
+	state := string(args.Peek("state"))
+	typ := string(args.Peek("type"))
+
+	var errRes *errResponse
+	if state != "" && state != alertFiring && state != alertAcknowledged && state != alertResolved {
+		errRes = &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Alert State",
+			Description: "The alert state provided is not valid. Valid choices are: 'firing', 'acknowledged' or 'resolved'.",
+		}
+	}
+	if errRes == nil {
+		errRes = validAlertType(typ)
+	}
+	var thermostatID int
+	if s := args.Peek("thermostat"); errRes == nil && len(s) > 0 {
+		var err error
+		if thermostatID, err = strconv.Atoi(string(s)); err != nil {
+			errRes = &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid identifier provided",
+				Description: err.Error(),
+			}
+		}
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, alerts.Alerts(state, thermostatID, typ))
+}
+
+// GetAlert is the handler to return a single alert
+func GetAlert(req *fasthttp.RequestCtx) {
+	id, errRes := paramID(req, "alert")
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	a, ok := alerts.Alert(id)
+	if !ok {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, alertNotFound(id))
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, a)
+}
+
+// updateAlert moves the alert of the request to the given state, adding the note in the body if any. A note
+// is required when there's no state to move to
+func updateAlert(req *fasthttp.RequestCtx, state string) {
+	id, errRes := paramID(req, "alert")
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	var body alertRequest
+	if len(req.PostBody()) > 0 || state == "" {
+		if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid JSON body provided",
+				Description: err.Error(),
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+	if (state == "" && body.Note == "") || len(body.Note) > maxNoteLength {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Note",
+			Description: "Notes must be from 1 to " + strconv.Itoa(maxNoteLength) + " characters long.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	a, errRes := alerts.Update(id, state, requestUser(req), body.Note, time.Now())
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, a)
+}
+
+// PostAcknowledge is the handler to acknowledge a firing alert, e.g. when someone on call picks it up
+func PostAcknowledge(req *fasthttp.RequestCtx) {
+	updateAlert(req, alertAcknowledged)
+}
+
+// PostResolve is the handler to resolve an open alert
+func PostResolve(req *fasthttp.RequestCtx) {
+	updateAlert(req, alertResolved)
+}
+
+// PostAlertNote is the handler to add a note to an alert without changing its state
+func PostAlertNote(req *fasthttp.RequestCtx) {
+	updateAlert(req, "")
+}
+
+// GetSuppressions is the handler to return the suppression windows that haven't ended
+func GetSuppressions(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, alerts.Suppressions(time.Now()))
+}
+
+// PostSuppression is the handler to add a suppression window, starting now unless a start is given
+func PostSuppression(req *fasthttp.RequestCtx) {
+	var sp suppression
+	if err := unmarshalStrict(req.PostBody(), &sp); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	now := time.Now()
+	if sp.Start.IsZero() {
+		sp.Start = now
+	}
+	errRes := validAlertType(sp.Type)
+	if errRes == nil && (!sp.End.After(sp.Start) || !sp.End.After(now)) {
+		errRes = &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Suppression Window",
+			Description: "The suppression window must end after it starts and after now.",
+		}
+	}
+	if errRes == nil && sp.ThermostatID != 0 {
+		_, errRes = home.Thermostat(sp.ThermostatID)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	added := alerts.Suppress(sp, now)
+	req.Response.Header.Set("Location", "/v1/suppressions/"+strconv.Itoa(added.ID))
+	req.SetStatusCode(http.StatusCreated)
+	sendJSON(req, added)
+}
+
+// DeleteSuppression is the handler to end a suppression window early
+func DeleteSuppression(req *fasthttp.RequestCtx) {
+	id, errRes := paramID(req, "suppression")
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	if !alerts.Unsuppress(id) {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "No suppression window found for id: " + strconv.Itoa(id),
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	req.SetStatusCode(http.StatusNoContent)
+}
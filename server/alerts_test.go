@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// postJSON posts the body to url, decoding the response into v when the request succeeds
+func postJSON(url, body string, t *testing.T, v interface{}) int {
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode/100 == 2 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("failed to decode the response: %s", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAlertLifecycle(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/alerts"
+
+	// going offline twice raises a single alert
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventOffline, t1, severityWarning, "Thermostat 1 went offline.")
+	publishDetail(eventOffline, t1, severityWarning, "Thermostat 1 went offline.")
+	var firing []alert
+	get(url+"?state=firing", t, &firing)
+	if len(firing) != 1 || firing[0].Type != eventOffline || firing[0].Count != 2 {
+		t.Fatalf("expected a single offline alert fired twice, got %+v", firing)
+	}
+	id := "/" + strconv.Itoa(firing[0].ID)
+
+	var a alert
+	if code := postJSON(url+id+"/acknowledge", `{"note": "looking into it"}`, t, &a); code != http.StatusOK || a.State != alertAcknowledged || a.AcknowledgedAt == nil || len(a.Notes) != 1 {
+		t.Fatalf("expected the alert to be acknowledged with a note, got %d %+v", code, a)
+	}
+	if code := postJSON(url+id+"/acknowledge", "", t, nil); code != http.StatusConflict {
+		t.Fatalf("expected status %d acknowledging twice, got %d", http.StatusConflict, code)
+	}
+	if code := postJSON(url+id+"/notes", `{}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an empty note, got %d", http.StatusBadRequest, code)
+	}
+
+	// coming back online resolves it, after which it can only be annotated
+	publishDetail(eventOnline, t1, severityInfo, "Thermostat 1 is back online.")
+	get(url+id, t, &a)
+	if a.State != alertResolved || a.ResolvedAt == nil {
+		t.Fatalf("expected the alert to be resolved, got %+v", a)
+	}
+	if code := postJSON(url+id+"/resolve", "", t, nil); code != http.StatusConflict {
+		t.Fatalf("expected status %d resolving twice, got %d", http.StatusConflict, code)
+	}
+	if code := postJSON(url+id+"/notes", `{"note": "router rebooted"}`, t, &a); code != http.StatusOK || len(a.Notes) != 2 {
+		t.Fatalf("expected the note to be added, got %d %+v", code, a)
+	}
+
+	// safety alerts clear once the limit deactivates, anomalies only by hand
+	publishDetail(eventSafety, t1, severityCritical, "Overheat protection activated.")
+	publishDetail(eventSafety, t1, severityInfo, "Overheat protection deactivated.")
+	publishDetail(eventAnomaly, t1, severityWarning, "Temperature jumped.")
+	var list []alert
+	get(url+"?type=safety", t, &list)
+	if len(list) != 1 || list[0].State != alertResolved {
+		t.Fatalf("expected the safety alert to be resolved, got %+v", list)
+	}
+	get(url+"?state=firing&thermostat=1", t, &list)
+	if len(list) != 1 || list[0].Type != eventAnomaly {
+		t.Fatalf("expected the anomaly to still fire, got %+v", list)
+	}
+	if code := postJSON(url+"/"+strconv.Itoa(list[0].ID)+"/resolve", "", t, &a); code != http.StatusOK || a.State != alertResolved {
+		t.Fatalf("expected the anomaly to be resolved, got %d %+v", code, a)
+	}
+
+	for _, query := range []string{"?state=open", "?type=change", "?thermostat=one"} {
+		resp, err := http.Get(url + query)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, query, resp.StatusCode)
+		}
+	}
+	if code := postJSON(url+"/99/acknowledge", "", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for an unknown alert, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestAlertSuppression(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/suppressions"
+
+	end := time.Now().Add(time.Hour).Format(time.RFC3339)
+	for _, body := range []string{`{"end": "2001-01-01T00:00:00Z"}`, `{"type": "change", "end": "` + end + `"}`, `{"thermostatId": 99, "end": "` + end + `"}`} {
+		if code := postJSON(url, body, t, nil); code != http.StatusBadRequest && code != http.StatusNotFound {
+			t.Fatalf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	var sp suppression
+	if code := postJSON(url, `{"thermostatId": 2, "type": "anomaly", "end": "`+end+`", "reason": "filter change"}`, t, &sp); code != http.StatusCreated || sp.ID == 0 {
+		t.Fatalf("expected the suppression window to be added, got %d %+v", code, sp)
+	}
+
+	t1, _ := home.Thermostat(1)
+	t2, _ := home.Thermostat(2)
+	publishDetail(eventAnomaly, t1, severityWarning, "Temperature jumped.")
+	publishDetail(eventAnomaly, t2, severityWarning, "Temperature jumped.")
+	publishDetail(eventOffline, t2, severityWarning, "Thermostat 2 went offline.")
+	for _, a := range alerts.Alerts("", 0, "") {
+		if suppressed := a.ThermostatID == 2 && a.Type == eventAnomaly; a.Suppressed != suppressed {
+			t.Fatalf("expected only the anomaly of thermostat 2 to be suppressed, got %+v", a)
+		}
+	}
+
+	var windows []suppression
+	get(url, t, &windows)
+	if len(windows) != 1 || windows[0].Reason != "filter change" {
+		t.Fatalf("expected the suppression window to be listed, got %+v", windows)
+	}
+	if code := del(url+"/"+strconv.Itoa(sp.ID), t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected status %d ending the window, got %d", http.StatusNoContent, code)
+	}
+	if code := del(url+"/"+strconv.Itoa(sp.ID), t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for an unknown window, got %d", http.StatusNotFound, code)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpConfirmTimeout is how long a publish waits for the broker to confirm it before giving up
+const amqpConfirmTimeout = 5 * time.Second
+
+// amqpPublisher publishes events to a durable topic exchange. Every publish is confirmed by the broker, and
+// a dropped connection is re-established on the next publish
+type amqpPublisher struct {
+	sync.Mutex
+	url        string
+	exchange   string
+	routingKey string // template supporting the {home}, {type} and {id} placeholders
+	home       string
+
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+}
+
+// newAMQPPublisher creates a publisher and makes the first connection so configuration errors surface on
+// startup
+func newAMQPPublisher(url, exchange, routingKey, home string) (*amqpPublisher, error) {
+	a := &amqpPublisher{
+		url:        url,
+		exchange:   exchange,
+		routingKey: routingKey,
+		home:       home,
+	}
+
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// connect dials the broker, declares the exchange and puts the channel into confirm mode. The caller must
+// hold the lock unless the publisher isn't shared yet
+func (a *amqpPublisher) connect() error {
+	conn, err := amqp.Dial(a.url)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err := ch.ExchangeDeclare(a.exchange, "topic", true, false, false, false, nil); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return err
+	}
+
+	a.conn = conn
+	a.ch = ch
+	a.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	return nil
+}
+
+// reset closes the current connection so the next publish reconnects. The caller must hold the lock
+func (a *amqpPublisher) reset() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+	a.conn = nil
+	a.ch = nil
+}
+
+// key fills in the routing key template for the event
+func (a *amqpPublisher) key(e event) string {
+	return strings.NewReplacer(
+		"{home}", a.home,
+		"{type}", e.Type,
+		"{id}", strconv.Itoa(e.ID),
+	).Replace(a.routingKey)
+}
+
+// Publish implements the publisher interface. A failed publish is retried once on a fresh connection
+func (a *amqpPublisher) Publish(e event) error {
+	jsn, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	msg := amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    e.Time,
+		Headers:      amqp.Table{"schema": int32(e.Schema)},
+		Body:         jsn,
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if err = a.publish(e, msg); err != nil {
+		a.reset()
+		err = a.publish(e, msg)
+	}
+
+	return err
+}
+
+// publish sends a single message and waits for the broker to confirm it. The caller must hold the lock
+func (a *amqpPublisher) publish(e event, msg amqp.Publishing) error {
+	if a.conn == nil || a.conn.IsClosed() {
+		if err := a.connect(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), amqpConfirmTimeout)
+	defer cancel()
+
+	if err := a.ch.PublishWithContext(ctx, a.exchange, a.key(e), false, false, msg); err != nil {
+		return err
+	}
+
+	select {
+	case c, ok := <-a.confirms:
+		if !ok {
+			return errors.New("channel closed before the broker confirmed the publish")
+		}
+		if !c.Ack {
+			return errors.New("broker rejected the publish")
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting for the broker to confirm the publish")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reading is a single temperature observed on a thermostat
+type reading struct {
+	temp int
+	at   time.Time
+}
+
+// anomalyDetector keeps the temperatures each thermostat reported within the detection window and raises an
+// anomaly when the temperature moves faster than expected, e.g. an open door or a failing hvac unit
+type anomalyDetector struct {
+	sync.Mutex
+	readings  map[int][]reading
+	lastAlert map[int]time.Time
+}
+
+var anomalies = anomalyDetector{
+	readings:  make(map[int][]reading),
+	lastAlert: make(map[int]time.Time),
+}
+
+// reset forgets every reading and alert
+func (d *anomalyDetector) reset() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.readings = make(map[int][]reading)
+	d.lastAlert = make(map[int]time.Time)
+}
+
+// Forget drops the readings of the thermostat, as it is removed
+func (d *anomalyDetector) Forget(id int) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.readings, id)
+	delete(d.lastAlert, id)
+}
+
+// Observe records the current temperature of the thermostat and raises an anomaly event if it moved by at
+// least the configured delta within the configured window. A thermostat is alerted on at most once per window
+func (d *anomalyDetector) Observe(t *thermostat) {
+	if cfg.AnomalyDelta <= 0 {
+		return
+	}
+
+	now := clock.Now()
+
+	d.Lock()
+
+	// drop the readings that fell out of the window before adding the new one
+	kept := d.readings[t.ID][:0]
+	for _, r := range d.readings[t.ID] {
+		if now.Sub(r.at) <= cfg.AnomalyWindow {
+			kept = append(kept, r)
+		}
+	}
+	kept = append(kept, reading{temp: t.CurrentTemp, at: now})
+	d.readings[t.ID] = kept
+
+	var detail string
+	for _, r := range kept {
+		change := t.CurrentTemp - r.temp
+		if change >= cfg.AnomalyDelta || -change >= cfg.AnomalyDelta {
+			detail = "Temperature changed by " + strconv.Itoa(change) + " degrees Fahrenheit within " + now.Sub(r.at).Round(time.Second).String() + "."
+			break
+		}
+	}
+
+	if detail == "" || now.Sub(d.lastAlert[t.ID]) < cfg.AnomalyWindow {
+		d.Unlock()
+		return
+	}
+	d.lastAlert[t.ID] = now
+
+	d.Unlock()
+
+	log.Println("anomaly detected on thermostat", t.ID, "-", detail)
+	publishDetail(eventAnomaly, t, severityWarning, detail)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAnomalyDetection(t *testing.T) {
+	th := &thermostat{ID: 1000, CurrentTemp: 70}
+	anomalies.Observe(th)
+	anomalies.Observe(&thermostat{ID: 1000, CurrentTemp: 68})
+
+	anomalies.Lock()
+	_, alerted := anomalies.lastAlert[1000]
+	anomalies.Unlock()
+	if alerted {
+		t.Fatal("expected a 2 degree change not to be reported as an anomaly")
+	}
+
+	anomalies.Observe(&thermostat{ID: 1000, CurrentTemp: 64})
+
+	anomalies.Lock()
+	_, alerted = anomalies.lastAlert[1000]
+	anomalies.Unlock()
+	if !alerted {
+		t.Fatalf("expected a %d degree drop to be reported as an anomaly", 6)
+	}
+}
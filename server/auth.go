@@ -0,0 +1,530 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// usernameKey is the user value the username an authenticated request was made by is kept under
+	usernameKey = "username"
+
+	// sessionSweepInterval is how often the sessions whose tokens expired are dropped
+	sessionSweepInterval = time.Minute
+
+	// unknownUserHash is compared against for a username that doesn't exist, so a login takes as long
+	// whether or not the user does and doesn't give away which usernames exist
+	unknownUserHash = "$2a$10$3oTLlfuNjmqUxsLqJxoRiOjqye6QG3KriJ4uSVTWumKwN3GBAmQBi"
+)
+
+// user is a single api account as read from the users file. The password must be a bcrypt hash so no
+// plain text passwords are ever kept on disk or in memory. SetPointRange narrows the setpoints the user
+// may set, e.g. for kids or tenants. TelegramID and DiscordID link the chat accounts the bots take
+// commands from as the user. Only admins may use the routes under /v1/admin/
+type user struct {
+	Username      string         `json:"username"`
+	Password      string         `json:"password"`
+	Admin         bool           `json:"admin,omitempty"`
+	SetPointRange *setPointRange `json:"setPointRange,omitempty"`
+	TelegramID    string         `json:"telegramId,omitempty"`
+	DiscordID     string         `json:"discordId,omitempty"`
+}
+
+// setPointRange is the range of setpoints a user may set, narrower than the one a thermostat allows
+type setPointRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// credentials is the body sent in through the api @ /v1/auth/login
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// refreshRequest is the body sent in through the api @ /v1/auth/refresh and /v1/auth/logout
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// tokenResponse is sent back to the client after a successful login or refresh
+type tokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"` // seconds until the access token expires
+}
+
+// session ties a short-lived access token and a longer-lived refresh token to the user they were issued to
+type session struct {
+	username       string
+	accessToken    string
+	refreshToken   string
+	accessExpires  time.Time
+	refreshExpires time.Time
+}
+
+// sessionStore provides safe concurrent access to the configured users and every session issued to them.
+// Sessions are kept server-side so a refresh token can be revoked at any time
+type sessionStore struct {
+	sync.Mutex
+	users     map[string]string // username -> bcrypt password hash
+	admins    map[string]bool
+	ranges    map[string]setPointRange
+	chatUsers map[string]string // platform:chat user id -> username
+	byAccess  map[string]*session
+	byRefresh map[string]*session
+}
+
+var sessions = sessionStore{
+	users:     make(map[string]string),
+	admins:    make(map[string]bool),
+	ranges:    make(map[string]setPointRange),
+	chatUsers: make(map[string]string),
+	byAccess:  make(map[string]*session),
+	byRefresh: make(map[string]*session),
+}
+
+// unauthorized builds the error response returned for any failed authentication attempt
+func unauthorized(description string) *errResponse {
+	return &errResponse{
+		Code:        http.StatusUnauthorized,
+		Msg:         "Unauthorized",
+		Description: description,
+	}
+}
+
+// reset forgets every user and session
+func (s *sessionStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.users = make(map[string]string)
+	s.admins = make(map[string]bool)
+	s.ranges = make(map[string]setPointRange)
+	s.chatUsers = make(map[string]string)
+	s.byAccess = make(map[string]*session)
+	s.byRefresh = make(map[string]*session)
+}
+
+// loadUsers reads the api users from the json file at path, replacing any previously loaded users
+func (s *sessionStore) loadUsers(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var list []user
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	linked := make(map[string]string)
+	admins := 0
+	for _, u := range list {
+		if u.Admin {
+			admins++
+		}
+		if r := u.SetPointRange; r != nil && (r.Min < minHeatSetPt || r.Min > r.Max || r.Max > maxCoolSetPt) {
+			return errors.New("the setpoint range of user " + u.Username + " must run from " + strconv.Itoa(minHeatSetPt) + " to " + strconv.Itoa(maxCoolSetPt) + " at most")
+		}
+		for platform, id := range map[string]string{channelTelegram: u.TelegramID, channelDiscord: u.DiscordID} {
+			if id == "" {
+				continue
+			}
+			if other, ok := linked[platform+":"+id]; ok {
+				return errors.New("the " + platform + " account " + id + " is linked to both user " + other + " and user " + u.Username)
+			}
+			linked[platform+":"+id] = u.Username
+		}
+	}
+
+	if admins == 0 && len(list) > 0 {
+		log.Println("none of the users in " + path + " is an admin, so nobody can use the routes under /v1/admin/")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.users = make(map[string]string)
+	s.admins = make(map[string]bool)
+	s.ranges = make(map[string]setPointRange)
+	s.chatUsers = make(map[string]string)
+	for _, u := range list {
+		s.users[u.Username] = u.Password
+		if u.Admin {
+			s.admins[u.Username] = true
+		}
+		if u.SetPointRange != nil {
+			s.ranges[u.Username] = *u.SetPointRange
+		}
+		if u.TelegramID != "" {
+			s.chatUsers[channelTelegram+":"+u.TelegramID] = u.Username
+		}
+		if u.DiscordID != "" {
+			s.chatUsers[channelDiscord+":"+u.DiscordID] = u.Username
+		}
+	}
+
+	return nil
+}
+
+// Enabled reports whether authentication is required, which is the case as soon as any user is configured
+func (s *sessionStore) Enabled() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.users) > 0
+}
+
+// newToken generates a random, url safe token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// issue creates a new session for the given user. The caller must hold the lock
+func (s *sessionStore) issue(username string) (*tokenResponse, *errResponse) {
+	access, err := newToken()
+	if err != nil {
+		return nil, &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Token Generation Failed",
+			Description: err.Error(),
+		}
+	}
+	refresh, err := newToken()
+	if err != nil {
+		return nil, &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Token Generation Failed",
+			Description: err.Error(),
+		}
+	}
+
+	now := time.Now()
+	sess := &session{
+		username:       username,
+		accessToken:    access,
+		refreshToken:   refresh,
+		accessExpires:  now.Add(cfg.AccessTokenTTL),
+		refreshExpires: now.Add(cfg.RefreshTokenTTL),
+	}
+	s.byAccess[access] = sess
+	s.byRefresh[refresh] = sess
+
+	return &tokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(cfg.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// revoke removes both tokens of a session. The caller must hold the lock
+func (s *sessionStore) revoke(sess *session) {
+	delete(s.byAccess, sess.accessToken)
+	delete(s.byRefresh, sess.refreshToken)
+}
+
+// Login verifies the credentials given and starts a new session for the user. The password is checked
+// without holding the lock, as bcrypt is slow on purpose and would hold up every request meanwhile
+func (s *sessionStore) Login(creds credentials) (*tokenResponse, *errResponse) {
+	s.Lock()
+	hash, ok := s.users[creds.Username]
+	s.Unlock()
+
+	if !ok {
+		hash = unknownUserHash
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(creds.Password)) != nil || !ok {
+		return nil, unauthorized("The username or password provided is incorrect.")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// the users may have been loaded again while the password was checked
+	if s.users[creds.Username] != hash {
+		return nil, unauthorized("The username or password provided is incorrect.")
+	}
+	return s.issue(creds.Username)
+}
+
+// Refresh exchanges a valid refresh token for a brand new session. The old refresh token is revoked so
+// each one can only ever be used once
+func (s *sessionStore) Refresh(refreshToken string) (*tokenResponse, *errResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, ok := s.byRefresh[refreshToken]
+	if !ok {
+		return nil, unauthorized("The refresh token provided is invalid or has been revoked.")
+	}
+
+	s.revoke(sess)
+	if time.Now().After(sess.refreshExpires) {
+		return nil, unauthorized("The refresh token provided has expired.")
+	}
+
+	return s.issue(sess.username)
+}
+
+// Logout revokes the session the refresh token belongs to, invalidating its access token along with it
+func (s *sessionStore) Logout(refreshToken string) *errResponse {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, ok := s.byRefresh[refreshToken]
+	if !ok {
+		return unauthorized("The refresh token provided is invalid or has been revoked.")
+	}
+
+	s.revoke(sess)
+	return nil
+}
+
+// Authenticate returns the username the access token was issued to, if it is still valid
+func (s *sessionStore) Authenticate(accessToken string) (string, *errResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, ok := s.byAccess[accessToken]
+	if !ok {
+		return "", unauthorized("The access token provided is invalid or has been revoked.")
+	}
+
+	if time.Now().After(sess.accessExpires) {
+		delete(s.byAccess, accessToken)
+		return "", unauthorized("The access token provided has expired. Use your refresh token to obtain a new one.")
+	}
+
+	return sess.username, nil
+}
+
+// sweep drops the access tokens that expired by now, and the sessions whose refresh token did
+func (s *sessionStore) sweep(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for token, sess := range s.byAccess {
+		if now.After(sess.accessExpires) {
+			delete(s.byAccess, token)
+		}
+	}
+	for _, sess := range s.byRefresh {
+		if now.After(sess.refreshExpires) {
+			s.revoke(sess)
+		}
+	}
+}
+
+// sweepSessions drops the expired sessions every interval until stop is closed, as the tokens of clients
+// that never come back would otherwise be held forever
+func sweepSessions(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		sessions.sweep(time.Now())
+	}
+}
+
+// requiresAuth reports whether the request must carry a valid access token. That is the case once api users
+// are configured, unless the request came in on a listener without token authentication
+func requiresAuth(req *fasthttp.RequestCtx) bool {
+	return sessions.Enabled() && req.UserValue(trustedKey) == nil
+}
+
+// Known reports whether there is an api user with the username
+func (s *sessionStore) Known(username string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.users[username]
+	return ok
+}
+
+// EndSessions revokes every session of the user and returns how many there were
+func (s *sessionStore) EndSessions(username string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	ended := 0
+	for _, sess := range s.byRefresh {
+		if sess.username == username {
+			s.revoke(sess)
+			ended++
+		}
+	}
+	return ended
+}
+
+// Range returns the setpoint range the user is restricted to, if any
+func (s *sessionStore) Range(username string) (setPointRange, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	r, ok := s.ranges[username]
+	return r, ok
+}
+
+// Admin reports whether the api user is an admin
+func (s *sessionStore) Admin(username string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.admins[username]
+}
+
+// ChatUser returns the api user the account of the chat platform is linked to, if any
+func (s *sessionStore) ChatUser(platform, id string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	username, ok := s.chatUsers[platform+":"+id]
+	return username, ok
+}
+
+// requestUser returns the username the request was authenticated as, or an empty one when it needed no
+// authentication
+func requestUser(req *fasthttp.RequestCtx) string {
+	username, _ := req.UserValue(usernameKey).(string)
+	return username
+}
+
+// checkUserRange makes sure the setpoints given are within the range the user is restricted to, if any.
+// Setpoints of 0 aren't being set and always pass
+func checkUserRange(username string, setPoints ...int) *errResponse {
+	r, ok := sessions.Range(username)
+	if !ok {
+		return nil
+	}
+
+	for _, sp := range setPoints {
+		if sp != 0 && (sp < r.Min || sp > r.Max) {
+			return &errResponse{
+				Code:        http.StatusForbidden,
+				Msg:         "Setpoint Not Permitted",
+				Description: "User " + username + " may only set setpoints from " + strconv.Itoa(r.Min) + " to " + strconv.Itoa(r.Max) + " degrees Fahrenheit.",
+			}
+		}
+	}
+	return nil
+}
+
+// changedSetPoints returns the setpoints of the updated thermostat that differ from the target, for
+// checkUserRange to only check what is being changed
+func changedSetPoints(target, updated *thermostat) []int {
+	var changed []int
+	if updated.HeatSetPoint != target.HeatSetPoint {
+		changed = append(changed, updated.HeatSetPoint)
+	}
+	if updated.CoolSetPoint != target.CoolSetPoint {
+		changed = append(changed, updated.CoolSetPoint)
+	}
+	return changed
+}
+
+// authorize validates the bearer token in the Authorization header of the request
+func authorize(req *fasthttp.RequestCtx) (string, *errResponse) {
+	header := string(req.Request.Header.Peek("Authorization"))
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", unauthorized("A bearer access token must be provided in the Authorization header.")
+	}
+
+	return sessions.Authenticate(strings.TrimPrefix(header, "Bearer "))
+}
+
+// PostLogin is the handler to exchange a username and password for an access and refresh token
+func PostLogin(req *fasthttp.RequestCtx) {
+	var creds credentials
+	if err := unmarshalStrict(req.PostBody(), &creds); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	tokens, errRes := sessions.Login(creds)
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, tokens)
+}
+
+// PostRefresh is the handler to exchange a refresh token for a new access and refresh token
+func PostRefresh(req *fasthttp.RequestCtx) {
+	var body refreshRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	tokens, errRes := sessions.Refresh(body.RefreshToken)
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, tokens)
+}
+
+// PostLogout is the handler to revoke a session so neither of its tokens can be used again
+func PostLogout(req *fasthttp.RequestCtx) {
+	var body refreshRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	if errRes := sessions.Logout(body.RefreshToken); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func authRequest(h fasthttp.RequestHandler, body string, t *testing.T, v interface{}) int {
+	var req fasthttp.RequestCtx
+	req.Request.Header.SetMethod("POST")
+	req.Request.SetBodyString(body)
+	h(&req)
+
+	if v != nil && len(req.Response.Body()) > 0 {
+		if err := json.Unmarshal(req.Response.Body(), v); err != nil {
+			t.Fatalf("unmarshal failed: %s", err)
+		}
+	}
+
+	return req.Response.StatusCode()
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+
+	// remove the user again afterwards so the shared test server goes back to being unauthenticated
+	sessions.Lock()
+	sessions.users["jon"] = string(hash)
+	sessions.Unlock()
+	defer func() {
+		sessions.Lock()
+		delete(sessions.users, "jon")
+		sessions.Unlock()
+	}()
+
+	if code := authRequest(PostLogin, `{"username": "jon", "password": "wrong"}`, t, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for bad password, got %d", http.StatusUnauthorized, code)
+	}
+	if code := authRequest(PostLogin, `{"username": "nobody", "password": "secret"}`, t, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for an unknown user, got %d", http.StatusUnauthorized, code)
+	}
+
+	var tokens tokenResponse
+	if code := authRequest(PostLogin, `{"username": "jon", "password": "secret"}`, t, &tokens); code != http.StatusOK {
+		t.Fatalf("expected status %d for login, got %d", http.StatusOK, code)
+	}
+	if user, errRes := sessions.Authenticate(tokens.AccessToken); errRes != nil || user != "jon" {
+		t.Fatalf("expected access token to authenticate jon, got %q (%v)", user, errRes)
+	}
+
+	// refreshing rotates both tokens and revokes the old pair
+	var refreshed tokenResponse
+	if code := authRequest(PostRefresh, `{"refreshToken": "`+tokens.RefreshToken+`"}`, t, &refreshed); code != http.StatusOK {
+		t.Fatalf("expected status %d for refresh, got %d", http.StatusOK, code)
+	}
+	if _, errRes := sessions.Authenticate(tokens.AccessToken); errRes == nil {
+		t.Fatal("expected old access token to be revoked after refresh")
+	}
+	if code := authRequest(PostRefresh, `{"refreshToken": "`+tokens.RefreshToken+`"}`, t, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected reused refresh token to be rejected, got %d", code)
+	}
+
+	if code := authRequest(PostLogout, `{"refreshToken": "`+refreshed.RefreshToken+`"}`, t, nil); code != http.StatusOK {
+		t.Fatalf("expected status %d for logout, got %d", http.StatusOK, code)
+	}
+	if _, errRes := sessions.Authenticate(refreshed.AccessToken); errRes == nil {
+		t.Fatal("expected access token to be revoked after logout")
+	}
+}
+
+func TestSessionSweep(t *testing.T) {
+	newTestServer(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+	sessions.Lock()
+	sessions.users["jon"] = string(hash)
+	sessions.Unlock()
+	defer sessions.reset()
+
+	for i := 0; i < 2; i++ {
+		if _, errRes := sessions.Login(credentials{Username: "jon", Password: "secret"}); errRes != nil {
+			t.Fatalf("failed to log in: %s", errRes.Description)
+		}
+	}
+	count := func() (int, int) {
+		sessions.Lock()
+		defer sessions.Unlock()
+		return len(sessions.byAccess), len(sessions.byRefresh)
+	}
+
+	// the sessions outlive their access tokens until their refresh tokens expire as well
+	now := time.Now()
+	sessions.sweep(now.Add(cfg.AccessTokenTTL + time.Second))
+	if access, refresh := count(); access != 0 || refresh != 2 {
+		t.Fatalf("expected only the access tokens to be dropped, got %d and %d", access, refresh)
+	}
+	sessions.sweep(now.Add(cfg.RefreshTokenTTL + time.Second))
+	if access, refresh := count(); access != 0 || refresh != 0 {
+		t.Fatalf("expected the expired sessions to be dropped, got %d and %d", access, refresh)
+	}
+}
+
+func TestUserSetPointRange(t *testing.T) {
+	base := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "users.json")
+	write := func(users string) {
+		if err := ioutil.WriteFile(path, []byte(users), 0600); err != nil {
+			t.Fatalf("failed to write the users: %s", err)
+		}
+	}
+
+	write(`[{"username": "kid", "password": "` + string(hash) + `", "setPointRange": {"min": 72, "max": 66}}]`)
+	if err := sessions.loadUsers(path); err == nil {
+		t.Fatalf("expected a range running backwards to be rejected")
+	}
+
+	// reset the users afterwards so the shared test server goes back to being unauthenticated
+	write(`[{"username": "kid", "password": "` + string(hash) + `", "setPointRange": {"min": 66, "max": 72}}, {"username": "parent", "password": "` + string(hash) + `"}]`)
+	if err := sessions.loadUsers(path); err != nil {
+		t.Fatalf("failed to load the users: %s", err)
+	}
+	defer sessions.reset()
+
+	put := func(username, body string) (int, errResponse) {
+		tokens, errRes := sessions.Login(credentials{Username: username, Password: "secret"})
+		if errRes != nil {
+			t.Fatalf("failed to log in as %s: %s", username, errRes.Description)
+		}
+		req, err := http.NewRequest("PUT", base+"/v1/thermostats/1", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create new PUT request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		defer resp.Body.Close()
+
+		var res errResponse
+		json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+
+	code, res := put("kid", `{"heatSetPoint": 75}`)
+	if code != http.StatusForbidden || !strings.Contains(res.Description, "from 66 to 72") {
+		t.Fatalf("expected status %d with the allowed range, got %d %+v", http.StatusForbidden, code, res)
+	}
+	if code, _ := put("kid", `{"heatSetPoint": 70, "coolSetPoint": 72}`); code != http.StatusOK {
+		t.Fatalf("expected status %d within the range, got %d", http.StatusOK, code)
+	}
+	if code, _ := put("parent", `{"heatSetPoint": 75, "coolSetPoint": 78}`); code != http.StatusOK {
+		t.Fatalf("expected status %d for a user without a range, got %d", http.StatusOK, code)
+	}
+
+	// the same goes for json-rpc
+	body := `{"jsonrpc": "2.0", "method": "updateThermostat", "params": {"id": 1, "coolSetPoint": 80}, "id": 1}`
+	if res := handleRPC([]byte(body), "kid", nil).(*rpcResponse); res.Error == nil {
+		t.Fatalf("expected the rpc update to be rejected")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// benchThermostats is how many thermostats the store benchmarks run against
+const benchThermostats = 100
+
+var (
+	benchOnce   sync.Once
+	benchTarget int
+)
+
+// newBenchHome returns a home of n thermostats, separate from the one the server uses
+func newBenchHome(n int) *currentState {
+	h := &currentState{thermostats: make(map[int]*thermostat, n)}
+	for id := 1; id <= n; id++ {
+		h.thermostats[id] = &thermostat{
+			ID:            id,
+			Name:          defaultNamePrefix + strconv.Itoa(id),
+			CurrentTemp:   defaultSetPt,
+			OperatingMode: defaultOpMode,
+			CoolSetPoint:  defaultSetPt,
+			HeatSetPoint:  defaultSetPt,
+			FanMode:       defaultFan,
+			LastChanged:   time.Now(),
+			DisplayOrder:  id,
+			Tags:          []string{"floor:" + strconv.Itoa(id%3)},
+		}
+	}
+	return h
+}
+
+// benchThermostat returns the id of the thermostat the handler benchmarks write to, so the thermostats the
+// tests rely on are left alone
+func benchThermostat() string {
+	benchOnce.Do(func() {
+		benchTarget, _ = home.AddThermostat(updateThermostat{Name: "Bench Thermostat"})
+	})
+	return strconv.Itoa(benchTarget)
+}
+
+// quietLogs discards the log for the rest of the benchmark, as writing faster than the events are
+// dispatched logs every dropped event and the log lines would garble the results
+func quietLogs(b *testing.B) {
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+}
+
+// benchRequest runs a request through the router of the api without going over the network
+func benchRequest(b *testing.B, handler fasthttp.RequestHandler, method, uri string, body []byte) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var req fasthttp.RequestCtx
+		req.Request.Header.SetMethod(method)
+		req.Request.SetRequestURI(uri)
+		req.Request.SetBody(body)
+
+		handler(&req)
+		req.Response.BodyWriteTo(ioutil.Discard)
+		if code := req.Response.StatusCode(); code != fasthttp.StatusOK {
+			b.Fatalf("%s %s failed with status %d: %s", method, uri, code, req.Response.Body())
+		}
+	}
+}
+
+func BenchmarkStoreThermostat(b *testing.B) {
+	h := newBenchHome(benchThermostats)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Thermostat(i%benchThermostats + 1)
+	}
+}
+
+func BenchmarkStoreThermostats(b *testing.B) {
+	h := newBenchHome(benchThermostats)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Thermostats()
+	}
+}
+
+func BenchmarkStoreUpdateThermostat(b *testing.B) {
+	quietLogs(b)
+	h := newBenchHome(benchThermostats)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target, _ := h.Thermostat(i%benchThermostats + 1)
+		h.UpdateThermostat(target, updateThermostat{CoolSetPoint: 70 + i%10, HeatSetPoint: 60 + i%10})
+	}
+}
+
+func BenchmarkStoreAddThermostat(b *testing.B) {
+	quietLogs(b)
+	h := newBenchHome(benchThermostats)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// remove it again, so every add scans the same number of thermostats
+		id, _ := h.AddThermostat(updateThermostat{})
+		h.Lock()
+		delete(h.thermostats, id)
+		h.Unlock()
+	}
+}
+
+func BenchmarkStoreParallelReadWrite(b *testing.B) {
+	quietLogs(b)
+	h := newBenchHome(benchThermostats)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			target, _ := h.Thermostat(i%benchThermostats + 1)
+			if i%10 == 0 {
+				h.UpdateThermostat(target, updateThermostat{CoolSetPoint: 70 + i%10, HeatSetPoint: 60 + i%10})
+			}
+		}
+	})
+}
+
+func BenchmarkJSONMarshalThermostat(b *testing.B) {
+	t, _ := newBenchHome(benchThermostats).Thermostat(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(t); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONMarshalThermostats(b *testing.B) {
+	therms := newBenchHome(benchThermostats).Thermostats()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(therms); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONUnmarshalUpdate(b *testing.B) {
+	body := []byte(`{"name": "Den", "mode": "cool", "coolSetPoint": 74, "heatSetPoint": 64, "fan": "auto", "tags": ["floor:1"]}`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var desired updateThermostat
+		if err := json.Unmarshal(body, &desired); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendThermostat(b *testing.B) {
+	t, _ := newBenchHome(benchThermostats).Thermostat(1)
+	var buf []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = appendThermostat(buf[:0], t)
+	}
+}
+
+func BenchmarkAppendThermostats(b *testing.B) {
+	therms := newBenchHome(benchThermostats).Thermostats()
+	var buf []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = appendThermostats(buf[:0], therms)
+	}
+}
+
+func BenchmarkHandlerGetThermostats(b *testing.B) {
+	benchRequest(b, newRouter(listenerSpec{}).Handler, "GET", "/v1/thermostats", nil)
+}
+
+func BenchmarkHandlerGetThermostat(b *testing.B) {
+	benchRequest(b, newRouter(listenerSpec{}).Handler, "GET", "/v1/thermostats/"+benchThermostat(), nil)
+}
+
+func BenchmarkHandlerGetField(b *testing.B) {
+	benchRequest(b, newRouter(listenerSpec{}).Handler, "GET", "/v1/thermostats/"+benchThermostat()+"/currentTemp", nil)
+}
+
+func BenchmarkHandlerPutThermostat(b *testing.B) {
+	quietLogs(b)
+	benchRequest(b, newRouter(listenerSpec{}).Handler, "PUT", "/v1/thermostats/"+benchThermostat(), []byte(`{"coolSetPoint": 74, "heatSetPoint": 64}`))
+}
+
+// benchmarkSend sends a fleet of 500 thermostats to a client that discards the response
+func benchmarkSend(b *testing.B, send func(req *fasthttp.RequestCtx, therms []*thermostat)) {
+	therms := newBenchHome(500).Thermostats()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var req fasthttp.RequestCtx
+		send(&req, therms)
+		if err := req.Response.BodyWriteTo(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendJSONFleet(b *testing.B) {
+	benchmarkSend(b, func(req *fasthttp.RequestCtx, therms []*thermostat) { sendJSON(req, therms) })
+}
+
+func BenchmarkSendThermostatsFleet(b *testing.B) {
+	benchmarkSend(b, sendThermostats)
+}
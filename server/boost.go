@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// boostInterval is how often the thermostats are checked for a boost that is over
+const boostInterval = time.Second
+
+// boostRequest is the body sent in through the api @ /v1/thermostats/:id/boost
+type boostRequest struct {
+	Delta    int    `json:"delta"`    // degrees the setpoints move by, e.g. 3 or -2
+	Duration string `json:"duration"` // e.g. "2h", defaults to the configured boost duration
+}
+
+// boost is a temporary move of the setpoints of a thermostat, which go back to what they were once it's
+// over. The setpoints of the current mode move: the heat set point in heat, the cool set point in cool and
+// both in auto
+type boost struct {
+	Delta              int       `json:"delta"`
+	Until              time.Time `json:"until"`
+	RevertHeatSetPoint int       `json:"revertHeatSetPoint"`
+	RevertCoolSetPoint int       `json:"revertCoolSetPoint"`
+}
+
+// timeLeft returns how long it is until the given time, to the second
+func timeLeft(until time.Time) string {
+	left := until.Sub(clock.Now()).Round(time.Second)
+	if left < 0 {
+		left = 0
+	}
+	return left.String()
+}
+
+// MarshalJSON adds the time the boost has left, so clients don't need a clock of their own to show it
+func (b boost) MarshalJSON() ([]byte, error) {
+	type plain boost
+	return json.Marshal(struct {
+		plain
+		Remaining string `json:"remaining"`
+	}{plain(b), timeLeft(b.Until)})
+}
+
+// appendBoost appends the json encoding of the boost to dst the way MarshalJSON does
+func appendBoost(dst []byte, b *boost) ([]byte, bool) {
+	var ok bool
+	dst = append(dst, `{"delta":`...)
+	dst = strconv.AppendInt(dst, int64(b.Delta), 10)
+	dst = append(dst, `,"until":`...)
+	if dst, ok = appendJSONTime(dst, b.Until); !ok {
+		return dst, false
+	}
+	dst = append(dst, `,"revertHeatSetPoint":`...)
+	dst = strconv.AppendInt(dst, int64(b.RevertHeatSetPoint), 10)
+	dst = append(dst, `,"revertCoolSetPoint":`...)
+	dst = strconv.AppendInt(dst, int64(b.RevertCoolSetPoint), 10)
+	dst = append(dst, `,"remaining":`...)
+	dst = appendJSONString(dst, timeLeft(b.Until))
+	return append(dst, '}'), true
+}
+
+// boosted returns the thermostat with the setpoints of its mode moved by the delta, starting from those
+// it reverts to when it's already boosted
+func boosted(target *thermostat, delta int, until time.Time) (*thermostat, *errResponse) {
+	if target.OperatingMode != "heat" && target.OperatingMode != "cool" && target.OperatingMode != "auto" {
+		return nil, &errResponse{
+			Code:        http.StatusConflict,
+			Msg:         "Nothing To Boost",
+			Description: "Thermostat " + strconv.Itoa(target.ID) + " is in " + target.OperatingMode + " mode. Only thermostats that heat or cool can be boosted.",
+		}
+	}
+
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	b := &boost{Delta: delta, Until: until, RevertHeatSetPoint: target.HeatSetPoint, RevertCoolSetPoint: target.CoolSetPoint}
+	if target.Boost != nil {
+		b.RevertHeatSetPoint, b.RevertCoolSetPoint = target.Boost.RevertHeatSetPoint, target.Boost.RevertCoolSetPoint
+	}
+	updated.HeatSetPoint, updated.CoolSetPoint = b.RevertHeatSetPoint, b.RevertCoolSetPoint
+	if updated.OperatingMode != "cool" {
+		updated.HeatSetPoint += delta
+		if errRes := validateHeatSetPt(updated.HeatSetPoint); errRes != nil {
+			return nil, errRes
+		}
+	}
+	if updated.OperatingMode != "heat" {
+		updated.CoolSetPoint += delta
+		if errRes := validateCoolSetPt(updated.CoolSetPoint); errRes != nil {
+			return nil, errRes
+		}
+	}
+	updated.Boost = b
+
+	return &updated, nil
+}
+
+// SetBoost commits the boosted thermostat
+func (home *currentState) SetBoost(updated *thermostat) (*thermostat, error) {
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeBoost, updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, updated)
+	publishHVAC(transitions)
+
+	return updated, nil
+}
+
+// EndBoost puts the setpoints of the thermostat back to what they were before it was boosted
+func (home *currentState) EndBoost(target *thermostat) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	if target.Boost != nil {
+		updated.HeatSetPoint, updated.CoolSetPoint = target.Boost.RevertHeatSetPoint, target.Boost.RevertCoolSetPoint
+	}
+	updated.Boost = nil
+
+	return home.SetBoost(&updated)
+}
+
+// endBoosts ends the boosts that are over until stop is closed. Only the leader writes, as with every other
+// automated change, and nothing is written while the service is read-only
+func endBoosts(interval time.Duration, stop <-chan struct{}) {
+	for clock.sleep(interval, stop) {
+		if !cluster.IsLeader() || checkReadOnly() != nil {
+			continue
+		}
+		endDueBoosts(clock.Now())
+	}
+}
+
+// endDueBoosts ends every boost that is over by now
+func endDueBoosts(now time.Time) {
+	for _, t := range home.Thermostats() {
+		if t.Boost != nil && !now.Before(t.Boost.Until) {
+			_, err := retryChanged(t, func(current *thermostat) (*thermostat, error) {
+				// the boost may have been ended or replaced in the meantime
+				if current.Boost == nil || now.Before(current.Boost.Until) {
+					return current, nil
+				}
+				return home.EndBoost(current)
+			})
+			if err != nil {
+				log.Println("failed to end the boost of thermostat", t.ID, "with error:", err)
+			}
+		}
+	}
+}
+
+// PostBoost is the handler to boost the setpoints of a specific thermostat for a while, e.g. 3 degrees
+// warmer for 2 hours
+func PostBoost(req *fasthttp.RequestCtx) {
+	var body boostRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	if body.Delta == 0 {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Delta",
+			Description: "The delta must be the degrees to move the setpoints by, such as 3 or -2.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	duration := cfg.BoostDuration
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 || d > cfg.MaxBoostDuration {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Duration",
+				Description: "The duration provided must be a positive duration such as '90m' or '2h', no longer than " + cfg.MaxBoostDuration.String() + ".",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+		duration = d
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	// disabled thermostats can't be controlled until they are enabled again
+	if errRes := checkDisabled(target, updateThermostat{HeatSetPoint: body.Delta}); errRes != nil {
+		req.SetStatusCode(http.StatusConflict)
+		sendJSON(req, errRes)
+		return
+	}
+
+	updated, errRes := boosted(target, body.Delta, clock.Now().Add(duration))
+	if errRes == nil {
+		errRes = checkUserRange(requestUser(req), changedSetPoints(target, updated)...)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	updated, err := home.SetBoost(updated)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// DeleteBoost is the handler to end the boost of a specific thermostat early
+func DeleteBoost(req *fasthttp.RequestCtx) {
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	if target.Boost == nil {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "Thermostat " + strconv.Itoa(target.ID) + " isn't boosted.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	updated, err := home.EndBoost(target)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// postBoost boosts the thermostat at url, returning the status code and the boosted thermostat
+func postBoost(url, body string, t *testing.T) (int, thermostat) {
+	resp, err := http.Post(url+"/boost", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var th thermostat
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&th); err != nil {
+			t.Fatalf("failed to decode the thermostat: %s", err)
+		}
+	}
+	return resp.StatusCode, th
+}
+
+func TestBoost(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1"
+
+	target, _ := home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+
+	for _, body := range []string{`{"delta": 0}`, `{"delta": 3, "duration": "13h"}`, `{"delta": 3, "duration": "soon"}`, `{"delta": 40}`} {
+		if code, _ := postBoost(url, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	code, th := postBoost(url, `{"delta": 3, "duration": "2h"}`, t)
+	if code != http.StatusOK || th.HeatSetPoint != 71 || th.CoolSetPoint != 74 || th.Boost == nil {
+		t.Fatalf("expected the heat set point to be boosted by 3, got %d %+v", code, th)
+	}
+	var body struct {
+		Boost struct {
+			Remaining string `json:"remaining"`
+		} `json:"boost"`
+	}
+	get(url, t, &body)
+	if left, err := time.ParseDuration(body.Boost.Remaining); err != nil || left < 119*time.Minute || left > 2*time.Hour {
+		t.Fatalf("expected about 2h of boost to remain, got %q", body.Boost.Remaining)
+	}
+
+	// boosting again starts from the setpoints from before the boost
+	if _, th = postBoost(url, `{"delta": -2, "duration": "30m"}`, t); th.HeatSetPoint != 66 || th.Boost.RevertHeatSetPoint != 68 {
+		t.Fatalf("expected the new boost to replace the old one, got %+v", th)
+	}
+
+	// renaming keeps the boost, and it reverts once it's over
+	target, _ = home.Thermostat(1)
+	target, _ = home.UpdateThermostat(target, updateThermostat{Name: "Den"})
+	if target.Boost == nil {
+		t.Fatalf("expected the boost to be kept when renaming")
+	}
+	endDueBoosts(time.Now().Add(31 * time.Minute))
+	var reverted thermostat
+	get(url, t, &reverted)
+	if reverted.HeatSetPoint != 68 || reverted.Boost != nil {
+		t.Fatalf("expected the boost to have reverted, got %+v", reverted)
+	}
+
+	// changing the setpoints ends the boost
+	postBoost(url, `{"delta": 2}`, t)
+	target, _ = home.Thermostat(1)
+	if target, _ = home.UpdateThermostat(target, updateThermostat{HeatSetPoint: 65}); target.Boost != nil {
+		t.Fatalf("expected changing the setpoints to end the boost")
+	}
+
+	postBoost(url, `{"delta": 2}`, t)
+	if code := del(url+"/boost", t, &th); code != http.StatusOK || th.HeatSetPoint != 65 {
+		t.Fatalf("expected ending the boost to revert the setpoints, got %d %+v", code, th)
+	}
+	if code := del(url+"/boost", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d without a boost, got %d", http.StatusNotFound, code)
+	}
+
+	target, _ = home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "off"})
+	if code, _ := postBoost(url, `{"delta": 2}`, t); code != http.StatusConflict {
+		t.Fatalf("expected status %d when off, got %d", http.StatusConflict, code)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+	"github.com/valyala/fasthttp"
+)
+
+// errBreakerTimeout is returned for calls that took longer than -breaker-timeout. The call itself carries on
+// in the background, but the caller is released
+var errBreakerTimeout = errors.New("call timed out")
+
+// breaker guards the calls to an external integration. After -breaker-failures calls in a row fail or time
+// out the breaker opens and every call fails straight away for -breaker-cooldown, after which a single call
+// is let through to probe whether the integration has recovered. That way a stuck upstream holds up at most
+// a handful of goroutines instead of every one that calls it
+type breaker struct {
+	// the counters come first to keep them 64-bit aligned for atomic access on 32-bit platforms
+	successes uint64
+	failures  uint64
+	rejected  uint64
+
+	cb      *gobreaker.CircuitBreaker
+	timeout time.Duration
+}
+
+// breakerStatus is the state of a single breaker returned through the api @ /readyz
+type breakerStatus struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	Successes uint64 `json:"successes"`
+	Failures  uint64 `json:"failures"`
+	Rejected  uint64 `json:"rejected"`
+}
+
+// readiness is the body returned through the api @ /readyz
+type readiness struct {
+	Status   string          `json:"status"`
+	Breakers []breakerStatus `json:"breakers"`
+}
+
+// breakerRegistry holds the breaker of every configured integration
+type breakerRegistry struct {
+	sync.Mutex
+	breakers []*breaker
+}
+
+var breakers breakerRegistry
+
+func init() {
+	prometheus.MustRegister(breakerCollector{})
+}
+
+// newBreaker returns a breaker for the named integration with the configured thresholds, registering it so
+// its state is reported by /readyz and /metrics
+func newBreaker(name string) *breaker {
+	b := &breaker{timeout: cfg.BreakerTimeout}
+	failures := uint32(cfg.BreakerFailures)
+	b.cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        name,
+		MaxRequests: 1,
+		Timeout:     cfg.BreakerCooldown,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return failures > 0 && counts.ConsecutiveFailures >= failures
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			log.Println("circuit breaker of", name, "went from", from.String(), "to", to.String())
+		},
+	})
+
+	breakers.Lock()
+	breakers.breakers = append(breakers.breakers, b)
+	breakers.Unlock()
+	return b
+}
+
+// call runs f unless the breaker is open, counting an error or a call that takes longer than the timeout as
+// a failure
+func (b *breaker) call(f func() error) error {
+	_, err := b.cb.Execute(func() (interface{}, error) {
+		if b.timeout <= 0 {
+			return nil, f()
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- f() }()
+
+		timer := time.NewTimer(b.timeout)
+		defer timer.Stop()
+		select {
+		case err := <-done:
+			return nil, err
+		case <-timer.C:
+			return nil, errBreakerTimeout
+		}
+	})
+
+	switch {
+	case err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests:
+		atomic.AddUint64(&b.rejected, 1)
+		return errors.New(b.cb.Name() + " is unavailable: " + err.Error())
+	case err != nil:
+		atomic.AddUint64(&b.failures, 1)
+	default:
+		atomic.AddUint64(&b.successes, 1)
+	}
+	return err
+}
+
+// Status returns the state of the breaker along with how many calls went through it
+func (b *breaker) Status() breakerStatus {
+	return breakerStatus{
+		Name:      b.cb.Name(),
+		State:     b.cb.State().String(),
+		Successes: atomic.LoadUint64(&b.successes),
+		Failures:  atomic.LoadUint64(&b.failures),
+		Rejected:  atomic.LoadUint64(&b.rejected),
+	}
+}
+
+// Statuses returns the state of every breaker
+func (r *breakerRegistry) Statuses() []breakerStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	statuses := make([]breakerStatus, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		statuses = append(statuses, b.Status())
+	}
+	return statuses
+}
+
+// reset forgets every breaker
+func (r *breakerRegistry) reset() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.breakers = nil
+}
+
+// guardedPublisher is a publisher whose every event goes through a breaker
+type guardedPublisher struct {
+	publisher
+	breaker *breaker
+}
+
+// guard wraps the publisher of the named integration in a breaker
+func guard(name string, p publisher) publisher {
+	return guardedPublisher{publisher: p, breaker: newBreaker(name)}
+}
+
+// Publish implements the publisher interface
+func (p guardedPublisher) Publish(e event) error {
+	return p.breaker.call(func() error { return p.publisher.Publish(e) })
+}
+
+// GetReadyz is the handler to return the state of every external integration. An open breaker marks the
+// server as degraded, but it still responds with 200 as the api keeps serving and taking the node out of
+// rotation wouldn't bring the integration back
+func GetReadyz(req *fasthttp.RequestCtx) {
+	res := readiness{Status: "ok", Breakers: breakers.Statuses()}
+	for _, b := range res.Breakers {
+		if b.State != gobreaker.StateClosed.String() {
+			res.Status = "degraded"
+		}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, res)
+}
+
+var (
+	breakerStateDesc = prometheus.NewDesc("thermostat_breaker_state",
+		"State of the circuit breaker of an external integration: 0 closed, 1 half-open, 2 open",
+		[]string{"integration"}, nil)
+	breakerCallsDesc = prometheus.NewDesc("thermostat_breaker_calls_total",
+		"Calls to an external integration by result: success, failure or rejected by an open breaker",
+		[]string{"integration", "result"}, nil)
+)
+
+// breakerCollector exports the state of every breaker to prometheus
+type breakerCollector struct{}
+
+// Describe implements the prometheus.Collector interface
+func (breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerStateDesc
+	ch <- breakerCallsDesc
+}
+
+// Collect implements the prometheus.Collector interface
+func (breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	for _, b := range breakers.breakers {
+		name := b.cb.Name()
+		ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, float64(b.cb.State()), name)
+		ch <- prometheus.MustNewConstMetric(breakerCallsDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&b.successes)), name, "success")
+		ch <- prometheus.MustNewConstMetric(breakerCallsDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&b.failures)), name, "failure")
+		ch <- prometheus.MustNewConstMetric(breakerCallsDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&b.rejected)), name, "rejected")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingPublisher fails every event until it's told to recover
+type failingPublisher struct {
+	failing bool
+	calls   int
+}
+
+func (p *failingPublisher) Publish(e event) error {
+	p.calls++
+	if p.failing {
+		return errors.New("upstream unavailable")
+	}
+	return nil
+}
+
+func TestBreaker(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.BreakerFailures = 3
+		c.BreakerCooldown = 100 * time.Millisecond
+	})
+
+	upstream := &failingPublisher{failing: true}
+	p := guard("upstream", upstream)
+	for i := 0; i < 5; i++ {
+		if err := p.Publish(event{}); err == nil {
+			t.Fatal("expected publishing to a failing upstream to fail")
+		}
+	}
+	if upstream.calls != 3 {
+		t.Fatalf("expected the breaker to stop calling the upstream after %d failures, got %d calls", 3, upstream.calls)
+	}
+
+	var res readiness
+	get(base+"/readyz", t, &res)
+	if res.Status != "degraded" || len(res.Breakers) != 1 || res.Breakers[0].State != "open" || res.Breakers[0].Rejected != 2 {
+		t.Fatalf("expected an open breaker that rejected 2 calls, got %+v", res)
+	}
+
+	resp, err := http.Get(base + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get the metrics: %s", err)
+	}
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		`thermostat_breaker_state{integration="upstream"} 2`,
+		`thermostat_breaker_calls_total{integration="upstream",result="failure"} 3`,
+		`thermostat_breaker_calls_total{integration="upstream",result="rejected"} 2`,
+	} {
+		if !strings.Contains(string(metrics), line) {
+			t.Fatalf("expected the metrics to contain %s, got:\n%s", line, metrics)
+		}
+	}
+
+	// once the cooldown is over a probe goes through and closes the breaker again
+	upstream.failing = false
+	time.Sleep(150 * time.Millisecond)
+	if err := p.Publish(event{}); err != nil {
+		t.Fatalf("expected the probe to reach the recovered upstream, got %s", err)
+	}
+	get(base+"/readyz", t, &res)
+	if res.Status != "ok" || res.Breakers[0].State != "closed" {
+		t.Fatalf("expected the breaker to close after a successful probe, got %+v", res)
+	}
+}
+
+func TestBreakerTimeout(t *testing.T) {
+	newTestServer(t, func(c *config) {
+		c.BreakerTimeout = 50 * time.Millisecond
+	})
+
+	release := make(chan struct{})
+	defer close(release)
+
+	b := newBreaker("stuck")
+	start := time.Now()
+	if err := b.call(func() error { <-release; return nil }); err != errBreakerTimeout {
+		t.Fatalf("expected a stuck call to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the caller to be released after the timeout, took %s", elapsed)
+	}
+	if status := b.Status(); status.Failures != 1 {
+		t.Fatalf("expected the timeout to count as a failure, got %+v", status)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// chaosSettings are the failures injected into the api, sent in and returned through the api @
+// /v1/admin/chaos. Only available when the server is started with -chaos
+type chaosSettings struct {
+	Latency   string  `json:"latency"`   // e.g. "250ms", added to every api request
+	Jitter    string  `json:"jitter"`    // e.g. "100ms", random extra latency of up to this much
+	ErrorRate float64 `json:"errorRate"` // share of api requests that fail with a 500, from 0 to 1
+}
+
+// spikeRequest is the body sent in through the api @ /v1/admin/chaos/thermostats/:id/spike
+type spikeRequest struct {
+	Delta int `json:"delta"` // degrees the current temperature jumps by, may be negative
+}
+
+// offlineRequest is the body sent in through the api @ /v1/admin/chaos/thermostats/:id/offline
+type offlineRequest struct {
+	Offline bool `json:"offline"`
+}
+
+// chaosMonkey provides safe concurrent access to the failures injected into the api
+type chaosMonkey struct {
+	sync.Mutex
+	settings  chaosSettings
+	latency   time.Duration
+	jitter    time.Duration
+	errorRate float64
+}
+
+var chaos chaosMonkey
+
+// Settings is a getter to provide safe concurrent read access to the injected failures
+func (c *chaosMonkey) Settings() chaosSettings {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.settings
+}
+
+// SetSettings changes the injected failures, leaving them unchanged when the settings are invalid
+func (c *chaosMonkey) SetSettings(settings chaosSettings) *errResponse {
+	var latency, jitter time.Duration
+	var err error
+	if settings.Latency != "" {
+		if latency, err = time.ParseDuration(settings.Latency); err != nil || latency < 0 {
+			return invalidChaos("The latency must be a positive duration, e.g. '250ms'.")
+		}
+	}
+	if settings.Jitter != "" {
+		if jitter, err = time.ParseDuration(settings.Jitter); err != nil || jitter < 0 {
+			return invalidChaos("The jitter must be a positive duration, e.g. '100ms'.")
+		}
+	}
+	if settings.ErrorRate < 0 || settings.ErrorRate > 1 {
+		return invalidChaos("The error rate must be between 0 and 1.")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.settings = settings
+	c.latency = latency
+	c.jitter = jitter
+	c.errorRate = settings.ErrorRate
+
+	return nil
+}
+
+// invalidChaos returns the error invalid chaos settings are rejected with
+func invalidChaos(description string) *errResponse {
+	return &errResponse{
+		Code:        http.StatusBadRequest,
+		Msg:         "Invalid Chaos Settings",
+		Description: description,
+	}
+}
+
+// inject delays the request by the configured latency and then returns the error the request should fail
+// with, if it was picked to fail. The admin routes are left alone so chaos can always be turned off again
+func (c *chaosMonkey) inject(req *fasthttp.RequestCtx) *errResponse {
+	if !cfg.Chaos || strings.HasPrefix(string(req.Path()), "/v1/admin/") {
+		return nil
+	}
+
+	c.Lock()
+	delay := c.latency
+	if c.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.jitter)))
+	}
+	fail := c.errorRate > 0 && rand.Float64() < c.errorRate
+	c.Unlock()
+
+	time.Sleep(delay)
+	if !fail {
+		return nil
+	}
+
+	return &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Internal Server Error",
+		Description: "An error was injected by chaos testing.",
+	}
+}
+
+// checkOffline returns the error writes to a thermostat are rejected with while its device is offline
+func checkOffline(t *thermostat) *errResponse {
+	if !t.Offline {
+		return nil
+	}
+
+	return &errResponse{
+		Code:        http.StatusServiceUnavailable,
+		Msg:         "Device Offline",
+		Description: "Thermostat " + strconv.Itoa(t.ID) + " is offline and can't be reached until it reconnects.",
+	}
+}
+
+// GetChaos is the handler to return the failures injected into the api
+func GetChaos(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, chaos.Settings())
+}
+
+// PutChaos is the handler to change the failures injected into the api
+func PutChaos(req *fasthttp.RequestCtx) {
+	var body chaosSettings
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	if errRes := chaos.SetSettings(body); errRes != nil {
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, chaos.Settings())
+}
+
+// PostSpike is the handler to make the current temperature of a specific thermostat jump, as if its sensor
+// misread. The spike goes through the safety limits and anomaly detection like any reading would
+func PostSpike(req *fasthttp.RequestCtx) {
+	var body spikeRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	updated, err := home.RecordTemp(target, target.CurrentTemp+body.Delta)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// PutOffline is the handler to take the device of a specific thermostat offline, or bring it back online
+func PutOffline(req *fasthttp.RequestCtx) {
+	var body offlineRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	updated, err := home.SetOffline(target, body.Offline)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
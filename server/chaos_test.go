@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// chaosRequest runs a request through a router built with the chaos testing endpoints
+func chaosRequest(t *testing.T, method, uri, body string, v interface{}) int {
+	cfg.Chaos = true
+	defer func() { cfg.Chaos = false }()
+
+	var req fasthttp.RequestCtx
+	req.Request.Header.SetMethod(method)
+	req.Request.SetRequestURI(uri)
+	req.Request.SetBodyString(body)
+	newRouter(listenerSpec{}).Handler(&req)
+
+	if v != nil {
+		if err := json.Unmarshal(req.Response.Body(), v); err != nil {
+			t.Fatalf("unmarshal of %s %s response failed: %s", method, uri, err)
+		}
+	}
+	return req.Response.StatusCode()
+}
+
+func TestChaosErrors(t *testing.T) {
+	defer chaos.SetSettings(chaosSettings{})
+
+	if code := chaosRequest(t, "PUT", "/v1/admin/chaos", `{"errorRate": 2}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid error rate, got %d", http.StatusBadRequest, code)
+	}
+	if code := chaosRequest(t, "PUT", "/v1/admin/chaos", `{"latency": "1ms", "errorRate": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status %d when injecting errors, got %d", http.StatusOK, code)
+	}
+
+	if code := chaosRequest(t, "GET", "/v1/thermostats", "", nil); code != http.StatusInternalServerError {
+		t.Fatalf("expected an injected status %d, got %d", http.StatusInternalServerError, code)
+	}
+
+	// the admin routes stay reachable so chaos can be turned off again
+	var settings chaosSettings
+	if code := chaosRequest(t, "GET", "/v1/admin/chaos", "", &settings); code != http.StatusOK || settings.ErrorRate != 1 {
+		t.Fatalf("expected the chaos settings to be returned, got %d %+v", code, settings)
+	}
+}
+
+func TestChaosSpike(t *testing.T) {
+	id := strconv.Itoa(addThermostat(t, updateThermostat{Name: "Boiler Room Thermostat", OperatingMode: "heat"}))
+
+	var th thermostat
+	if code := chaosRequest(t, "POST", "/v1/admin/chaos/thermostats/"+id+"/spike", `{"delta": 30}`, &th); code != http.StatusOK {
+		t.Fatalf("expected status %d for a spike, got %d", http.StatusOK, code)
+	}
+	if th.CurrentTemp != 101 || th.PreviousTemp != 71 || !th.OverheatProtection {
+		t.Fatalf("expected the spike to trip overheat protection, got %+v", th)
+	}
+}
+
+func TestChaosOffline(t *testing.T) {
+	id := strconv.Itoa(addThermostat(t, updateThermostat{Name: "Shed Thermostat"}))
+
+	var th thermostat
+	if code := chaosRequest(t, "PUT", "/v1/admin/chaos/thermostats/"+id+"/offline", `{"offline": true}`, &th); code != http.StatusOK || !th.Offline {
+		t.Fatalf("expected the thermostat to go offline, got %d %+v", code, th)
+	}
+	if code := chaosRequest(t, "PUT", "/v1/thermostats/"+id, `{"fan": "on"}`, nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d for a write to an offline thermostat, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	chaosRequest(t, "PUT", "/v1/admin/chaos/thermostats/"+id+"/offline", `{"offline": false}`, nil)
+	if code := chaosRequest(t, "PUT", "/v1/thermostats/"+id, `{"fan": "on"}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status %d once the thermostat is back online, got %d", http.StatusOK, code)
+	}
+}
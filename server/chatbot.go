@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// chatHelp is the reply to /help and to commands the bot doesn't know
+const chatHelp = "Commands:\n" +
+	"/status [thermostat] - temperatures and setpoints\n" +
+	"/set <thermostat> [heat|cool] <temp> - set the setpoint of the current mode, or the one given\n" +
+	"/mode <thermostat> <mode> - switch to off, heat, cool, auto or fan\n" +
+	"Thermostats are given by name or id."
+
+// chatSeverityIcons lead the alert messages of the chat bots so the severity shows at a glance
+var chatSeverityIcons = map[string]string{
+	severityInfo:     "ℹ️",
+	severityWarning:  "⚠️",
+	severityCritical: "🚨",
+}
+
+// chatUnlinked is the reply to chat accounts that aren't linked to an api user
+func chatUnlinked(platform, id string) string {
+	return "This " + platform + " account (" + id + ") isn't linked to an api user. Add it to the user in the users file to use the bot."
+}
+
+// runChatCommand runs the chat command of the api user and returns the reply. Commands go through the api
+// routes as the user, so they're held to exactly the same checks as a request made with their token
+func runChatCommand(username, text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return chatHelp
+	}
+	// telegram addresses commands in groups to the bot, as in /status@thermostat_bot
+	command := strings.SplitN(fields[0], "@", 2)[0]
+	args := fields[1:]
+
+	switch command {
+	case "/status":
+		if len(args) == 0 {
+			var therms []*thermostat
+			if _, reply, ok := requestAs(username, "GET", "/v1/thermostats", nil, &therms); !ok {
+				return reply
+			}
+			lines := make([]string, 0, len(therms))
+			for _, t := range therms {
+				lines = append(lines, chatStatus(t))
+			}
+			return strings.Join(lines, "\n")
+		}
+		t, reply := chatThermostat(strings.Join(args, " "))
+		if t == nil {
+			return reply
+		}
+		return chatStatus(t)
+
+	case "/set":
+		if len(args) < 2 {
+			return "Usage: /set <thermostat> [heat|cool] <temp>"
+		}
+		temp, err := strconv.Atoi(args[len(args)-1])
+		if err != nil {
+			return "The temperature '" + args[len(args)-1] + "' must be a whole number of degrees."
+		}
+		args = args[:len(args)-1]
+		setPoint := strings.ToLower(args[len(args)-1])
+		if setPoint == "heat" || setPoint == "cool" {
+			args = args[:len(args)-1]
+		} else {
+			setPoint = ""
+		}
+		t, reply := chatThermostat(strings.Join(args, " "))
+		if t == nil {
+			return reply
+		}
+		if setPoint == "" {
+			switch t.OperatingMode {
+			case "heat", "cool":
+				setPoint = t.OperatingMode
+			default:
+				return t.Name + " is in " + t.OperatingMode + " mode. Say which set point to change, e.g. /set " + t.Name + " heat " + strconv.Itoa(temp)
+			}
+		}
+		body := map[string]int{setPoint + "SetPoint": temp}
+		status, reply, ok := requestAs(username, "PUT", "/v1/thermostats/"+strconv.Itoa(t.ID), body, nil)
+		if !ok {
+			return reply
+		}
+		return chatUpdated(t, status)
+
+	case "/mode":
+		if len(args) < 2 {
+			return "Usage: /mode <thermostat> <mode>"
+		}
+		t, reply := chatThermostat(strings.Join(args[:len(args)-1], " "))
+		if t == nil {
+			return reply
+		}
+		body := map[string]string{"mode": strings.ToLower(args[len(args)-1])}
+		status, reply, ok := requestAs(username, "PUT", "/v1/thermostats/"+strconv.Itoa(t.ID), body, nil)
+		if !ok {
+			return reply
+		}
+		return chatUpdated(t, status)
+	}
+
+	return chatHelp
+}
+
+// chatUpdated returns the reply to a command that updated the thermostat with the given status, which is
+// 202 when its device is offline and the update waits for it to reconnect
+func chatUpdated(t *thermostat, status int) string {
+	if status == http.StatusAccepted {
+		return "Queued. " + t.Name + " is offline, the change is made as soon as it reconnects."
+	}
+	if t, errRes := home.Thermostat(t.ID); errRes == nil {
+		return "Done. " + chatStatus(t)
+	}
+	return "Done."
+}
+
+// chatThermostat finds the thermostat by id or by name, ignoring case, or returns the reply saying it
+// wasn't found
+func chatThermostat(nameOrID string) (*thermostat, string) {
+	for _, t := range home.Thermostats() {
+		if strconv.Itoa(t.ID) == nameOrID || strings.EqualFold(t.Name, nameOrID) {
+			return t, ""
+		}
+	}
+	return nil, "There is no thermostat called '" + nameOrID + "'. Send /status to list them."
+}
+
+// chatStatus describes the thermostat in a single line
+func chatStatus(t *thermostat) string {
+	status := t.Name + " (" + strconv.Itoa(t.ID) + "): " + strconv.Itoa(t.CurrentTemp) + "°F, " + t.OperatingMode + " mode, heat to " +
+		strconv.Itoa(t.HeatSetPoint) + ", cool to " + strconv.Itoa(t.CoolSetPoint)
+	if t.Offline {
+		status += ", offline"
+	}
+	return status
+}
+
+// chatText formats the notification as a plain text chat message
+func chatText(n notification) string {
+	if n.Alert != nil {
+		a := n.Alert
+		name := "thermostat " + strconv.Itoa(a.ThermostatID)
+		if t, errRes := home.Thermostat(a.ThermostatID); errRes == nil && t.Name != "" {
+			name = t.Name + " (" + name + ")"
+		}
+		return chatSeverityIcons[a.Severity] + " " + strings.ToUpper(a.Severity[:1]) + a.Severity[1:] + " " + a.Type + " alert on " + name + "\n" + a.Detail
+	}
+
+	d := n.Digest
+	lines := []string{"📊 Daily summary of " + n.Home}
+	for _, t := range d.Thermostats {
+		lines = append(lines, "• "+t.Name+": "+strconv.Itoa(t.MinTemp)+"–"+strconv.Itoa(t.MaxTemp)+"°F, heating "+t.HeatingRuntime+", cooling "+t.CoolingRuntime)
+	}
+	lines = append(lines, strconv.Itoa(len(d.Alerts))+" alerts fired.")
+	return strings.Join(lines, "\n")
+}
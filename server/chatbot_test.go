@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestChatBots(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the discord key: %s", err)
+	}
+	base := newTestServer(t, func(c *config) {
+		c.TelegramToken = "bot-token"
+		c.TelegramSecret = "webhook-secret"
+		c.DiscordPublicKey = hex.EncodeToString(pub)
+		c.OfflineTTL = time.Hour
+	})
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "users.json")
+	users := `[{"username": "kid", "password": "` + string(hash) + `", "setPointRange": {"min": 66, "max": 72}, "telegramId": "111", "discordId": "222"}]`
+	if err := ioutil.WriteFile(path, []byte(users), 0600); err != nil {
+		t.Fatalf("failed to write the users: %s", err)
+	}
+	if err := sessions.loadUsers(path); err != nil {
+		t.Fatalf("failed to load the users: %s", err)
+	}
+	defer sessions.reset()
+
+	telegram := func(secret, from, text string) (int, telegramMessage) {
+		req, _ := http.NewRequest("POST", base+"/v1/chat/telegram", strings.NewReader(`{"message": {"from": {"id": `+from+`}, "chat": {"id": 5}, "text": "`+text+`"}}`))
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		defer resp.Body.Close()
+
+		var reply telegramMessage
+		json.NewDecoder(resp.Body).Decode(&reply)
+		return resp.StatusCode, reply
+	}
+
+	if code, _ := telegram("guess", "111", "/status"); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d without the secret, got %d", http.StatusUnauthorized, code)
+	}
+	if _, reply := telegram("webhook-secret", "999", "/status"); !strings.Contains(reply.Text, "isn't linked") {
+		t.Fatalf("expected unlinked accounts to be turned away, got %+v", reply)
+	}
+
+	// commands are held to the setpoint range of the linked user
+	target, _ := home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+	if _, reply := telegram("webhook-secret", "111", "/set "+target.Name+" 75"); !strings.Contains(reply.Text, "from 66 to 72") {
+		t.Fatalf("expected the setpoint to be out of range, got %+v", reply)
+	}
+	_, reply := telegram("webhook-secret", "111", "/set@thermostat_bot 1 70")
+	if reply.Method != "sendMessage" || reply.ChatID != "5" || !strings.HasPrefix(reply.Text, "Done.") {
+		t.Fatalf("expected the setpoint to be set, got %+v", reply)
+	}
+	if target, _ = home.Thermostat(1); target.HeatSetPoint != 70 {
+		t.Fatalf("expected a heat set point of 70, got %d", target.HeatSetPoint)
+	}
+	if _, reply := telegram("webhook-secret", "111", "/status"); !strings.Contains(reply.Text, "heat to 70") {
+		t.Fatalf("expected the status of every thermostat, got %+v", reply)
+	}
+
+	// a change to a thermostat whose device is offline is queued, which is no failure
+	target, _ = home.Thermostat(1)
+	home.SetOffline(target, true)
+	if _, reply := telegram("webhook-secret", "111", "/set 1 71"); !strings.HasPrefix(reply.Text, "Queued.") {
+		t.Fatalf("expected the setpoint to be queued, got %+v", reply)
+	}
+	target, _ = home.Thermostat(1)
+	home.SetOffline(target, false)
+	if target, _ = home.Thermostat(1); target.HeatSetPoint != 71 {
+		t.Fatalf("expected the queued set point of 71 once back online, got %d", target.HeatSetPoint)
+	}
+
+	discord := func(body string, key ed25519.PrivateKey) (int, discordResponse) {
+		req, _ := http.NewRequest("POST", base+"/v1/chat/discord", strings.NewReader(body))
+		timestamp := "1700000000"
+		req.Header.Set("X-Signature-Timestamp", timestamp)
+		req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(key, []byte(timestamp+body))))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		defer resp.Body.Close()
+
+		var res discordResponse
+		json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+
+	_, forged, _ := ed25519.GenerateKey(rand.Reader)
+	if code, _ := discord(`{"type": 1}`, forged); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for a forged signature, got %d", http.StatusUnauthorized, code)
+	}
+	if code, res := discord(`{"type": 1}`, priv); code != http.StatusOK || res.Type != discordPong {
+		t.Fatalf("expected the ping to be answered, got %d %+v", code, res)
+	}
+	set := `{"type": 2, "data": {"name": "set", "options": [{"name": "thermostat", "value": "1"}, {"name": "setpoint", "value": "cool"}, {"name": "temp", "value": 72}]}, "member": {"user": {"id": "222"}}}`
+	if _, res := discord(set, priv); res.Type != discordMessage || res.Data == nil || !strings.Contains(res.Data.Content, "cool to 72") {
+		t.Fatalf("expected the cool set point to be set, got %+v", res)
+	}
+}
+
+func TestTelegramNotifications(t *testing.T) {
+	sent := make(chan telegramMessage, 10)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botbot-token/sendMessage" {
+			t.Errorf("expected the message to be sent by the bot, got %s", r.URL.Path)
+		}
+		var msg telegramMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		sent <- msg
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer api.Close()
+	defer func(u string) { telegramAPI = u }(telegramAPI)
+	telegramAPI = api.URL
+
+	base := newTestServer(t, func(c *config) {
+		c.TelegramToken = "bot-token"
+		c.TelegramSecret = "webhook-secret"
+	})
+
+	body := `{"channels": [{"type": "telegram", "chatId": "5"}]}`
+	req, _ := http.NewRequest("PUT", base+"/v1/notifications/kid", bytes.NewBufferString(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventOffline, t1, severityWarning, "Thermostat 1 went offline.")
+	select {
+	case msg := <-sent:
+		if msg.ChatID != "5" || !strings.Contains(msg.Text, "offline alert on "+t1.Name) {
+			t.Fatalf("expected the alert to be sent to the chat, got %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the alert to be sent")
+	}
+}
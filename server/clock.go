@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// maxClockSpeed is the most times faster than real time the virtual clock can run
+	maxClockSpeed = 1000
+
+	// maxClockAdvance is the most the virtual clock can be stepped forward at once, and clockStep how far
+	// apart the points in between are that the scheduler and the automated features run at
+	maxClockAdvance = 7 * 24 * time.Hour
+	clockStep       = time.Minute
+)
+
+// clockSettings are sent in and returned through the api @ /v1/admin/clock. Only available when the server
+// is started with -virtual-clock
+type clockSettings struct {
+	Now     time.Time `json:"now"`
+	Speed   float64   `json:"speed"`   // times faster than real time, 0 stops the clock so it's only stepped
+	Virtual bool      `json:"virtual"` // false while the clock is the wall clock
+}
+
+// advanceRequest is the body sent in through the api @ /v1/admin/clock/advance
+type advanceRequest struct {
+	Duration string `json:"duration"` // e.g. "90m", how far to step the clock forward
+}
+
+// virtualClock is the time the thermostats, the scheduler and the automated features go by. It's the wall
+// clock unless it was sped up, stopped or stepped, which makes demos of a day of schedules take minutes and
+// tests of them reproducible. Sessions, alerts, notifications and the connections to other services always
+// go by the wall clock
+type virtualClock struct {
+	sync.Mutex
+	speed float64
+
+	// the virtual time was base at the real time since, and has run at speed since then. Both are zero
+	// while the clock is the wall clock
+	base  time.Time
+	since time.Time
+
+	// changed is closed and replaced whenever the speed is changed or the clock is stepped, waking up
+	// everything waiting for it
+	changed chan struct{}
+}
+
+var clock = newClock()
+
+// newClock returns a clock that is the wall clock
+func newClock() *virtualClock {
+	return &virtualClock{speed: 1, changed: make(chan struct{})}
+}
+
+// reset turns the clock back into the wall clock
+func (c *virtualClock) reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.speed = 1
+	c.base, c.since = time.Time{}, time.Time{}
+	c.notify()
+}
+
+// Now returns the current virtual time
+func (c *virtualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now()
+}
+
+// now returns the current virtual time. The lock must be held
+func (c *virtualClock) now() time.Time {
+	if c.base.IsZero() {
+		return time.Now()
+	}
+	return c.base.Add(time.Duration(float64(time.Since(c.since)) * c.speed))
+}
+
+// notify wakes up everything waiting on the clock. The lock must be held
+func (c *virtualClock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Settings returns the current virtual time and speed of the clock
+func (c *virtualClock) Settings() clockSettings {
+	c.Lock()
+	defer c.Unlock()
+
+	return clockSettings{Now: c.now(), Speed: c.speed, Virtual: !c.base.IsZero()}
+}
+
+// SetSpeed runs the clock the given times faster than real time from now on, stopping it at 0
+func (c *virtualClock) SetSpeed(speed float64) *errResponse {
+	if speed < 0 || speed > maxClockSpeed {
+		return invalidClock("The speed must be from 0, which stops the clock, to " + strconv.Itoa(maxClockSpeed) + " times real time.")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.base, c.since = c.now(), time.Now()
+	c.speed = speed
+	c.notify()
+	return nil
+}
+
+// step moves the clock forward by d, returning the virtual time it was moved to
+func (c *virtualClock) step(d time.Duration) time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	c.base, c.since = c.now().Add(d), time.Now()
+	c.notify()
+	return c.base
+}
+
+// Advance steps the clock forward by d, running the scheduler and the automated features at every minute in
+// between, so whatever was due over that time happens in order. In a cluster only the leader runs them
+func (c *virtualClock) Advance(d time.Duration) *errResponse {
+	if d <= 0 || d > maxClockAdvance {
+		return invalidClock("The duration must be a positive duration such as '90m' or '24h', no longer than " + maxClockAdvance.String() + ".")
+	}
+
+	for d > 0 {
+		step := clockStep
+		if d < step {
+			step = d
+		}
+		d -= step
+
+		now := c.step(step)
+		if cluster.IsLeader() {
+			runAutomation(now)
+		}
+	}
+	return nil
+}
+
+// sleep waits until interval has passed on the clock at its current speed, waiting again from the start
+// whenever the clock is changed. It returns false as soon as stop is closed
+func (c *virtualClock) sleep(interval time.Duration, stop <-chan struct{}) bool {
+	for {
+		c.Lock()
+		speed, changed := c.speed, c.changed
+		c.Unlock()
+
+		// a stopped clock only moves when it's stepped
+		var timer *time.Timer
+		var elapsed <-chan time.Time
+		if speed > 0 {
+			timer = time.NewTimer(time.Duration(float64(interval) / speed))
+			elapsed = timer.C
+		}
+
+		select {
+		case <-stop:
+			stopTimer(timer)
+			return false
+		case <-elapsed:
+			return true
+		case <-changed:
+			stopTimer(timer)
+		}
+	}
+}
+
+// stopTimer stops the timer, if there is one
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// runAutomation brings the scheduler and every automated feature up to the given time
+func runAutomation(now time.Time) {
+	runDueActions(now)
+	endDueBoosts(now)
+	endDueFanTimers(now)
+	updateQuiet(now)
+	updateSleep(now)
+	updatePrecondition(now)
+	releaseDueLockouts(now)
+}
+
+// invalidClock returns the error invalid clock settings are rejected with
+func invalidClock(description string) *errResponse {
+	return &errResponse{
+		Code:        http.StatusBadRequest,
+		Msg:         "Invalid Clock Settings",
+		Description: description,
+	}
+}
+
+// GetClock is the handler to return the virtual time and the speed the clock runs at
+func GetClock(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, clock.Settings())
+}
+
+// PutClock is the handler to change the speed the clock runs at, e.g. 60 for an hour a minute
+func PutClock(req *fasthttp.RequestCtx) {
+	var body clockSettings
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	if errRes := clock.SetSpeed(body.Speed); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, clock.Settings())
+}
+
+// DeleteClock is the handler to turn the clock back into the wall clock
+func DeleteClock(req *fasthttp.RequestCtx) {
+	clock.reset()
+
+	// the scheduled actions were due by the virtual time, which may have run ahead
+	actions.reschedule(clock.Now())
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, clock.Settings())
+}
+
+// PostAdvance is the handler to step the clock forward, running whatever is due along the way before it
+// responds
+func PostAdvance(req *fasthttp.RequestCtx) {
+	var body advanceRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	d, err := time.ParseDuration(body.Duration)
+	if err != nil {
+		d = 0
+	}
+	if errRes := clock.Advance(d); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, clock.Settings())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.VirtualClock = true
+		c.ClockSpeed = 0
+	})
+
+	var settings clockSettings
+	get(base+"/v1/admin/clock", t, &settings)
+	if settings.Speed != 0 || !settings.Virtual {
+		t.Fatalf("expected the clock to start stopped, got %+v", settings)
+	}
+	start := settings.Now
+
+	for _, body := range []string{`{"speed": -1}`, `{"speed": 5000}`} {
+		if code := put(base+"/v1/admin/clock", body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+	for _, body := range []string{`{"duration": "soon"}`, `{"duration": "-1h"}`, `{"duration": "200h"}`} {
+		if code := postJSON(base+"/v1/admin/clock/advance", body, t, nil); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	// the boost ends once the clock is stepped past it, not before
+	target, _ := home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+	if code, _ := postBoost(base+"/v1/thermostats/1", `{"delta": 3, "duration": "2h"}`, t); code != http.StatusOK {
+		t.Fatalf("expected the thermostat to be boosted, got %d", code)
+	}
+	endDueBoosts(clock.Now())
+	if th, _ := home.Thermostat(1); th.Boost == nil {
+		t.Fatalf("expected the boost to last while the clock is stopped")
+	}
+
+	if code := postJSON(base+"/v1/admin/clock/advance", `{"duration": "90m"}`, t, &settings); code != http.StatusOK || !settings.Now.Equal(start.Add(90*time.Minute)) {
+		t.Fatalf("expected the clock to be stepped 90 minutes, got %d %+v", code, settings)
+	}
+	if th, _ := home.Thermostat(1); th.Boost == nil || !th.LastChanged.Before(start.Add(time.Minute)) {
+		t.Fatalf("expected the boost to be left with 30 minutes to go, got %+v", th)
+	}
+	postJSON(base+"/v1/admin/clock/advance", `{"duration": "45m"}`, t, nil)
+	th, _ := home.Thermostat(1)
+	if th.Boost != nil || th.HeatSetPoint != 68 || !th.LastChanged.Equal(start.Add(2*time.Hour)) {
+		t.Fatalf("expected the boost to end at exactly 2 hours on the clock, got %+v", th)
+	}
+
+	// a sped up clock runs ahead of the wall clock, and deleting it goes back to the wall clock
+	if code := put(base+"/v1/admin/clock", `{"speed": 1000}`, t); code != http.StatusOK {
+		t.Fatalf("expected the clock to be sped up, got %d", code)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if ahead := clock.Now().Sub(start.Add(135 * time.Minute)); ahead < 10*time.Second {
+		t.Fatalf("expected the clock to run 1000 times real time, got %s ahead", ahead)
+	}
+	if code := del(base+"/v1/admin/clock", t, &settings); code != http.StatusOK || settings.Virtual || settings.Speed != 1 {
+		t.Fatalf("expected the wall clock back, got %d %+v", code, settings)
+	}
+}
+
+func TestVirtualClockRoutes(t *testing.T) {
+	base := newTestServer(t)
+
+	if code := put(base+"/v1/admin/clock", `{"speed": 10}`, t); code != http.StatusNotFound && code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected the clock endpoints to be served only with -virtual-clock, got %d", code)
+	}
+}
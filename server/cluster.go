@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// elector decides which node of a cluster leads. Only the leader accepts writes and runs the automation,
+// such as publishing telemetry, while every node serves reads
+type elector interface {
+	IsLeader() bool
+	Leader() string // address of the leader, empty when unknown
+	Status() clusterStatus
+}
+
+// clusterStatus is the view this node has of the cluster, returned through the api @ /v1/cluster/status
+type clusterStatus struct {
+	Node         string          `json:"node,omitempty"`
+	Leader       string          `json:"leader,omitempty"`
+	Leading      bool            `json:"leading"`
+	Healthy      bool            `json:"healthy"`
+	State        string          `json:"state,omitempty"`
+	AppliedIndex uint64          `json:"appliedIndex,omitempty"`
+	LastIndex    uint64          `json:"lastIndex,omitempty"`
+	Members      []clusterMember `json:"members,omitempty"`
+}
+
+// clusterMember is a node of the cluster, known to this node
+type clusterMember struct {
+	Node    string `json:"node"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+// standalone is the elector of a node that isn't part of a cluster, which always leads
+type standalone struct{}
+
+// IsLeader implements the elector interface
+func (standalone) IsLeader() bool { return true }
+
+// Leader implements the elector interface
+func (standalone) Leader() string { return "" }
+
+// Status implements the elector interface
+func (standalone) Status() clusterStatus { return clusterStatus{Leading: true, Healthy: true} }
+
+var cluster elector = standalone{}
+
+// clusterSessionTTL is how long, in seconds, leadership outlives a leader that stopped responding
+const clusterSessionTTL = 10
+
+// etcdElector campaigns for leadership of the cluster through an etcd election
+type etcdElector struct {
+	sync.Mutex
+	node    string
+	leading bool
+	leader  string
+}
+
+// newEtcdElector connects to etcd and starts campaigning for leadership as the node, which is the address
+// other nodes send writes to
+func newEtcdElector(endpoints []string, key, node string) (*etcdElector, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e := &etcdElector{node: node}
+	go e.run(client, key)
+
+	return e, nil
+}
+
+// IsLeader implements the elector interface
+func (e *etcdElector) IsLeader() bool {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.leading
+}
+
+// Leader implements the elector interface
+func (e *etcdElector) Leader() string {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.leader
+}
+
+// Status implements the elector interface. Membership is kept by etcd, so only the leader is known
+func (e *etcdElector) Status() clusterStatus {
+	e.Lock()
+	defer e.Unlock()
+
+	return clusterStatus{
+		Node:    e.node,
+		Leader:  e.leader,
+		Leading: e.leading,
+		Healthy: e.leader != "",
+	}
+}
+
+// run campaigns for leadership for as long as the process lives, starting over whenever the session with
+// etcd is lost
+func (e *etcdElector) run(client *clientv3.Client, key string) {
+	for {
+		err := e.campaign(client, key)
+
+		e.Lock()
+		wasLeading := e.leading
+		e.leading = false
+		e.Unlock()
+
+		if wasLeading {
+			log.Println("lost cluster leadership with error:", err)
+		} else {
+			log.Println("cluster election failed with error:", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// campaign waits to be elected and then leads until the session with etcd is lost
+func (e *etcdElector) campaign(client *clientv3.Client, key string) error {
+	session, err := concurrency.NewSession(client, concurrency.WithTTL(clusterSessionTTL))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-session.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// keep track of who is leading so writes can be pointed at them
+	election := concurrency.NewElection(session, key)
+	go func() {
+		for res := range election.Observe(ctx) {
+			if len(res.Kvs) > 0 {
+				e.Lock()
+				e.leader = string(res.Kvs[0].Value)
+				e.Unlock()
+			}
+		}
+	}()
+
+	if err := election.Campaign(ctx, e.node); err != nil {
+		return err
+	}
+
+	e.Lock()
+	e.leading = true
+	e.leader = e.node
+	e.Unlock()
+	log.Println("elected cluster leader as", e.node)
+
+	<-ctx.Done()
+	return errors.New("session with etcd expired")
+}
+
+// advertisedNode returns the address other nodes and clients reach this node on, built from the hostname
+// and the port of -addr unless given by -cluster-node
+func advertisedNode() (string, error) {
+	if cfg.ClusterNode != "" {
+		return cfg.ClusterNode, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	_, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return "", err
+	}
+
+	return "http://" + net.JoinHostPort(hostname, port), nil
+}
+
+// checkLeader returns the error writes are rejected with on nodes that aren't leading the cluster
+func checkLeader() *errResponse {
+	if cluster.IsLeader() {
+		return nil
+	}
+
+	description := "This node isn't the cluster leader and only serves reads."
+	if leader := cluster.Leader(); leader != "" {
+		description += " Send writes to the leader at " + leader + "."
+	}
+
+	return &errResponse{
+		Code:        http.StatusServiceUnavailable,
+		Msg:         "Not Leader",
+		Description: description,
+	}
+}
+
+// GetClusterStatus is the handler to return the view this node has of the cluster. Nodes that aren't
+// healthy respond with 503, so the endpoint can be used as a health check
+func GetClusterStatus(req *fasthttp.RequestCtx) {
+	status := cluster.Status()
+	if status.Healthy {
+		req.SetStatusCode(http.StatusOK)
+	} else {
+		req.SetStatusCode(http.StatusServiceUnavailable)
+	}
+
+	sendJSON(req, status)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// follower is an elector of a node that never leads
+type follower struct {
+	leader string
+}
+
+func (f follower) IsLeader() bool { return false }
+func (f follower) Leader() string { return f.leader }
+func (f follower) Status() clusterStatus {
+	return clusterStatus{Leader: f.leader, Healthy: true}
+}
+
+func TestFollowerRejectsWrites(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/" + strconv.Itoa(addThermostat(t, updateThermostat{Name: "Loft Thermostat"}))
+
+	cluster = follower{leader: "http://10.0.0.5:8080"}
+	defer func() { cluster = standalone{} }()
+
+	if code := put(url, `{"fan": "on"}`, t); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d for a write to a follower, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	var th *thermostat
+	get(url, t, &th)
+	if th == nil || th.FanMode != "auto" {
+		t.Fatalf("expected followers to keep serving reads of the unchanged thermostat, got %+v", th)
+	}
+}
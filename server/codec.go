@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The api spends most of its time encoding thermostats, so they and the errors have encoders of their own
+// that produce exactly what encoding/json does without reflection, writing into pooled buffers. Every other
+// value goes through encoding/json, as do the update bodies, which it already decodes in a couple of
+// allocations. Thermostats themselves are never pooled: the store hands out the
+// same immutable records to every reader, so recycling one would change it under whoever still holds it.
+// TestAppendThermostat fails when a field is added to the thermostat without adding it here
+
+// jsonBuffers holds the buffers responses are encoded into
+var jsonBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// maxPooledBuffer is the largest buffer put back into the pool, so one huge response doesn't stay around
+const maxPooledBuffer = 64 * 1024
+
+// approxThermostatSize is about how long a thermostat is once encoded
+const approxThermostatSize = 320
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSON appends the json encoding of v to dst, reporting false when v has no encoder of its own
+func appendJSON(dst []byte, v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case *thermostat:
+		return appendThermostat(dst, v)
+	case []*thermostat:
+		return appendThermostats(dst, v)
+	case *errResponse:
+		if v == nil {
+			return append(dst, "null"...), true
+		}
+		dst = append(dst, `{"code":`...)
+		dst = strconv.AppendInt(dst, int64(v.Code), 10)
+		dst = append(dst, `,"message":`...)
+		dst = appendJSONString(dst, v.Msg)
+		dst = append(dst, `,"description":`...)
+		dst = appendJSONString(dst, v.Description)
+		return append(dst, '}'), true
+	}
+
+	return dst, false
+}
+
+// appendThermostats appends the json encoding of a list of thermostats to dst
+func appendThermostats(dst []byte, therms []*thermostat) ([]byte, bool) {
+	if therms == nil {
+		return append(dst, "null"...), true
+	}
+
+	// grow the buffer once up front rather than every time a thermostat doesn't fit
+	if n := len(dst) + len(therms)*approxThermostatSize; cap(dst) < n {
+		dst = append(make([]byte, 0, n), dst...)
+	}
+
+	dst = append(dst, '[')
+	for i, t := range therms {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		var ok bool
+		if dst, ok = appendThermostat(dst, t); !ok {
+			return dst, false
+		}
+	}
+	return append(dst, ']'), true
+}
+
+// appendThermostat appends the json encoding of the thermostat to dst. Times encoding/json would reject
+// report false, leaving the error to encoding/json
+func appendThermostat(dst []byte, t *thermostat) ([]byte, bool) {
+	if t == nil {
+		return append(dst, "null"...), true
+	}
+
+	var ok bool
+	dst = append(dst, `{"id":`...)
+	dst = strconv.AppendInt(dst, int64(t.ID), 10)
+	dst = append(dst, `,"name":`...)
+	dst = appendJSONString(dst, t.Name)
+	dst = append(dst, `,"currentTemp":`...)
+	dst = strconv.AppendInt(dst, int64(t.CurrentTemp), 10)
+	dst = append(dst, `,"previousTemp":`...)
+	dst = strconv.AppendInt(dst, int64(t.PreviousTemp), 10)
+	dst = append(dst, `,"mode":`...)
+	dst = appendJSONString(dst, t.OperatingMode)
+	dst = append(dst, `,"coolSetPoint":`...)
+	dst = strconv.AppendInt(dst, int64(t.CoolSetPoint), 10)
+	dst = append(dst, `,"heatSetPoint":`...)
+	dst = strconv.AppendInt(dst, int64(t.HeatSetPoint), 10)
+	dst = append(dst, `,"fan":`...)
+	dst = appendJSONString(dst, t.FanMode)
+	dst = append(dst, `,"lastChanged":`...)
+	if dst, ok = appendJSONTime(dst, t.LastChanged); !ok {
+		return dst, false
+	}
+	dst = append(dst, `,"freezeProtection":`...)
+	dst = strconv.AppendBool(dst, t.FreezeProtection)
+	dst = append(dst, `,"overheatProtection":`...)
+	dst = strconv.AppendBool(dst, t.OverheatProtection)
+	if t.MaintenanceUntil != nil {
+		dst = append(dst, `,"maintenanceUntil":`...)
+		if dst, ok = appendJSONTime(dst, *t.MaintenanceUntil); !ok {
+			return dst, false
+		}
+	}
+	dst = append(dst, `,"disabled":`...)
+	dst = strconv.AppendBool(dst, t.Disabled)
+	dst = append(dst, `,"displayOrder":`...)
+	dst = strconv.AppendInt(dst, int64(t.DisplayOrder), 10)
+	if len(t.Tags) > 0 {
+		dst = append(dst, `,"tags":[`...)
+		for i, tag := range t.Tags {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendJSONString(dst, tag)
+		}
+		dst = append(dst, ']')
+	}
+	if l := t.Location; l != nil {
+		dst = append(dst, `,"location":{"building":`...)
+		dst = appendJSONString(dst, l.Building)
+		if l.Floor != "" {
+			dst = append(dst, `,"floor":`...)
+			dst = appendJSONString(dst, l.Floor)
+		}
+		if l.Room != "" {
+			dst = append(dst, `,"room":`...)
+			dst = appendJSONString(dst, l.Room)
+		}
+		dst = append(dst, '}')
+	}
+	if t.Offline {
+		dst = append(dst, `,"offline":true`...)
+	}
+	if t.HVACState != "" {
+		dst = append(dst, `,"hvacState":`...)
+		dst = appendJSONString(dst, t.HVACState)
+	}
+	if t.HVACStage != 0 {
+		dst = append(dst, `,"hvacStage":`...)
+		dst = strconv.AppendInt(dst, int64(t.HVACStage), 10)
+	}
+	if t.HVACSince != nil {
+		dst = append(dst, `,"hvacSince":`...)
+		if dst, ok = appendJSONTime(dst, *t.HVACSince); !ok {
+			return dst, false
+		}
+	}
+	if t.CycleEnded != nil {
+		dst = append(dst, `,"cycleEnded":`...)
+		if dst, ok = appendJSONTime(dst, *t.CycleEnded); !ok {
+			return dst, false
+		}
+	}
+	if t.Boost != nil {
+		dst = append(dst, `,"boost":`...)
+		if dst, ok = appendBoost(dst, t.Boost); !ok {
+			return dst, false
+		}
+	}
+	if t.FanTimer != nil {
+		dst = append(dst, `,"fanTimer":`...)
+		if dst, ok = appendFanTimer(dst, t.FanTimer); !ok {
+			return dst, false
+		}
+	}
+	if t.QuietHours != nil {
+		dst = append(dst, `,"quietHours":{"windows":`...)
+		if t.QuietHours.Windows == nil {
+			dst = append(dst, "null"...)
+		} else {
+			dst = append(dst, '[')
+			for i, w := range t.QuietHours.Windows {
+				if i > 0 {
+					dst = append(dst, ',')
+				}
+				dst = append(dst, `{"start":`...)
+				dst = appendJSONString(dst, w.Start)
+				dst = append(dst, `,"end":`...)
+				dst = appendJSONString(dst, w.End)
+				dst = append(dst, '}')
+			}
+			dst = append(dst, ']')
+		}
+		dst = append(dst, `,"allow":`...)
+		dst = strconv.AppendBool(dst, t.QuietHours.Allow)
+		dst = append(dst, '}')
+	}
+	if t.Quiet {
+		dst = append(dst, `,"quiet":true`...)
+	}
+	if t.Sleep != nil {
+		dst = append(dst, `,"sleep":{"bedtime":`...)
+		dst = appendJSONString(dst, t.Sleep.Bedtime)
+		dst = append(dst, `,"wake":`...)
+		dst = appendJSONString(dst, t.Sleep.Wake)
+		dst = append(dst, `,"delta":`...)
+		dst = strconv.AppendInt(dst, int64(t.Sleep.Delta), 10)
+		dst = append(dst, `,"ramp":`...)
+		dst = appendJSONString(dst, t.Sleep.Ramp)
+		dst = append(dst, '}')
+	}
+	if t.SleepOffset != 0 {
+		dst = append(dst, `,"sleepOffset":`...)
+		dst = strconv.AppendInt(dst, int64(t.SleepOffset), 10)
+	}
+	if t.SleepHeld {
+		dst = append(dst, `,"sleepHeld":true`...)
+	}
+	if p := t.Precondition; p != nil {
+		dst = append(dst, `,"precondition":{"hotAbove":`...)
+		dst = strconv.AppendInt(dst, int64(p.HotAbove), 10)
+		dst = append(dst, `,"coldBelow":`...)
+		dst = strconv.AppendInt(dst, int64(p.ColdBelow), 10)
+		dst = append(dst, `,"offset":`...)
+		dst = strconv.AppendInt(dst, int64(p.Offset), 10)
+		dst = append(dst, `,"lead":`...)
+		dst = appendJSONString(dst, p.Lead)
+		dst = append(dst, `,"lowest":`...)
+		dst = strconv.AppendInt(dst, int64(p.Lowest), 10)
+		dst = append(dst, `,"highest":`...)
+		dst = strconv.AppendInt(dst, int64(p.Highest), 10)
+		dst = append(dst, '}')
+	}
+	if t.PreconditionOffset != 0 {
+		dst = append(dst, `,"preconditionOffset":`...)
+		dst = strconv.AppendInt(dst, int64(t.PreconditionOffset), 10)
+	}
+	if t.PreconditionHeld {
+		dst = append(dst, `,"preconditionHeld":true`...)
+	}
+	if len(t.Overrides) > 0 {
+		dst = append(dst, `,"overrides":[`...)
+		for i, name := range t.Overrides {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendJSONString(dst, name)
+		}
+		dst = append(dst, ']')
+	}
+	if t.Revision != 0 {
+		dst = append(dst, `,"revision":`...)
+		dst = strconv.AppendInt(dst, int64(t.Revision), 10)
+	}
+
+	return append(dst, '}'), true
+}
+
+// appendJSONTime appends the time the way time.Time marshals to json, reporting false for the times it
+// refuses to marshal: years outside 0 to 9999 and zone offsets with seconds
+func appendJSONTime(dst []byte, t time.Time) ([]byte, bool) {
+	if y := t.Year(); y < 0 || y > 9999 {
+		return dst, false
+	}
+	if _, offset := t.Zone(); offset%60 != 0 {
+		return dst, false
+	}
+
+	dst = append(dst, '"')
+	dst = t.AppendFormat(dst, time.RFC3339Nano)
+	return append(dst, '"'), true
+}
+
+// appendJSONString appends s as a json string the way encoding/json does, escaping html characters and
+// replacing invalid utf-8 with the replacement character
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		// line and paragraph separators break javascript that embeds the json
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+// marshalThermostat appends the json encoding of the thermostat to dst, falling back to encoding/json for
+// the thermostats appendThermostat can't encode
+func marshalThermostat(dst []byte, t *thermostat) ([]byte, error) {
+	if jsn, ok := appendThermostat(dst, t); ok {
+		return jsn, nil
+	}
+
+	jsn, err := json.Marshal(t)
+	return append(dst, jsn...), err
+}
+
+// marshalJSON encodes v into a buffer from the pool, which must be handed back with releaseJSON once the
+// encoding has been written
+func marshalJSON(v interface{}) (*[]byte, []byte, error) {
+	buf := jsonBuffers.Get().(*[]byte)
+	if jsn, ok := appendJSON((*buf)[:0], v); ok {
+		return buf, jsn, nil
+	}
+
+	jsn, err := json.Marshal(v)
+	return buf, jsn, err
+}
+
+// releaseJSON hands a buffer from marshalJSON back to the pool, keeping the space it grew to
+func releaseJSON(buf *[]byte, jsn []byte) {
+	if cap(jsn) > maxPooledBuffer {
+		return
+	}
+	if cap(jsn) > cap(*buf) {
+		*buf = jsn[:0]
+	}
+	jsonBuffers.Put(buf)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// trickyStrings need escaping in json one way or another
+var trickyStrings = []string{
+	"",
+	"Living Room",
+	`quote " and backslash \`,
+	"<script>&amp;</script>",
+	"tab\tnewline\ncarriage\rform\fback\b",
+	"\x00\x01\x1f\x7f",
+	"héllo wörld ☃ 🌡",
+	"line\u2028paragraph\u2029",
+	"invalid \xff\xfe utf-8 \xe2\x82",
+}
+
+// filledThermostat returns a thermostat with every field set, so a field the encoder doesn't know about
+// changes the encoding
+func filledThermostat(t *testing.T, s string) *thermostat {
+	zone := time.FixedZone("test", -5*60*60)
+	therm := &thermostat{}
+	v := reflect.ValueOf(therm).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch f.Interface().(type) {
+		case int:
+			f.SetInt(int64(i + 1))
+		case string:
+			f.SetString(s)
+		case bool:
+			f.SetBool(true)
+		case time.Time:
+			f.Set(reflect.ValueOf(time.Date(2024, 3, 9, 14, 5, 7, 123456789, zone)))
+		case *time.Time:
+			until := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+			f.Set(reflect.ValueOf(&until))
+		case *boost:
+			f.Set(reflect.ValueOf(&boost{Delta: 3, Until: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), RevertHeatSetPoint: 68, RevertCoolSetPoint: 74}))
+		case *fanTimer:
+			f.Set(reflect.ValueOf(&fanTimer{Until: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), RevertFanMode: s}))
+		case *quietHours:
+			f.Set(reflect.ValueOf(&quietHours{Windows: []quietWindow{{Start: s, End: "07:00"}, {Start: "13:00", End: s}}, Allow: true}))
+		case *sleepProfile:
+			f.Set(reflect.ValueOf(&sleepProfile{Bedtime: s, Wake: "06:30", Delta: -4, Ramp: s}))
+		case *preconditionProfile:
+			f.Set(reflect.ValueOf(&preconditionProfile{HotAbove: 95, ColdBelow: -5, Offset: 3, Lead: s, Lowest: 70, Highest: 74}))
+		case *location:
+			f.Set(reflect.ValueOf(&location{Building: s, Floor: "2", Room: s}))
+		case []string:
+			f.Set(reflect.ValueOf([]string{s, "floor:1"}))
+		default:
+			t.Fatalf("no value for field %s of type %s, add it here and to appendThermostat", v.Type().Field(i).Name, f.Type())
+		}
+	}
+	return therm
+}
+
+func TestAppendThermostat(t *testing.T) {
+	therms := []*thermostat{nil, {}, {LastChanged: time.Now()}}
+	for _, s := range trickyStrings {
+		therms = append(therms, filledThermostat(t, s))
+	}
+
+	for _, therm := range therms {
+		expected, err := json.Marshal(therm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := marshalThermostat(nil, therm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(expected) {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+
+	expected, _ := json.Marshal(therms)
+	if got, ok := appendJSON(nil, therms); !ok || string(got) != string(expected) {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestAppendThermostatFallback(t *testing.T) {
+	// times encoding/json refuses to marshal or marshals on its own terms are left to it
+	for _, tm := range []time.Time{
+		time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(-1, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("odd", 30)),
+	} {
+		therm := &thermostat{LastChanged: tm}
+		if _, ok := appendThermostat(nil, therm); ok {
+			t.Errorf("expected no encoding for a thermostat last changed at %s", tm)
+		}
+		expected, expectedErr := json.Marshal(therm)
+		got, err := marshalThermostat(nil, therm)
+		if string(got) != string(expected) || (err == nil) != (expectedErr == nil) {
+			t.Errorf("expected %s and %v for a thermostat last changed at %s, got %s and %v", expected, expectedErr, tm, got, err)
+		}
+	}
+}
+
+func TestAppendErrResponse(t *testing.T) {
+	for _, s := range trickyStrings {
+		res := &errResponse{Code: 400, Msg: s, Description: s + "!"}
+		expected, _ := json.Marshal(res)
+		if got, ok := appendJSON(nil, res); !ok || string(got) != string(expected) {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+}
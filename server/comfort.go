@@ -0,0 +1,193 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// defaultComfortWindow is how far back the comfort of a thermostat is reported without ?window=
+	defaultComfortWindow = 24 * time.Hour
+
+	// the temperature within comfortTolerance degrees of the setpoint counts as comfortable, while at
+	// comfortTolerance+comfortFalloff degrees off it no longer counts at all
+	comfortTolerance = 1
+	comfortFalloff   = 4
+)
+
+// comfortReport holds how well a thermostat kept to its setpoints over a window, returned through the api @
+// /v1/thermostats/:id/comfort. Only the time the thermostat was online in heat, cool or auto mode is
+// tracked, as there is no setpoint to keep to otherwise. In auto mode anywhere between the setpoints is on
+// target. The score runs from 100, always within a degree of the setpoint, down to 0, always 5 or more off
+type comfortReport struct {
+	ThermostatID     int            `json:"thermostatId"`
+	From             time.Time      `json:"from"`
+	To               time.Time      `json:"to"`
+	Tracked          string         `json:"tracked"`
+	WithinOnePercent float64        `json:"withinOnePercent"`
+	AverageDeviation float64        `json:"averageDeviation"`
+	Score            int            `json:"score"`
+	Overshoot        overshootStats `json:"overshoot"`
+}
+
+// overshootStats describe how often and how far heating went past the heat setpoint, or cooling below the
+// cool setpoint, by more than a degree. Each stretch of time past it counts as a single overshoot
+type overshootStats struct {
+	Count       int     `json:"count"`
+	Duration    string  `json:"duration"`
+	MaxDegrees  int     `json:"maxDegrees"`
+	MeanDegrees float64 `json:"meanDegrees"`
+}
+
+// deviation returns how far the temperature of the thermostat is from its setpoint and how far it overshot
+// it, or false when there is no setpoint to keep to
+func deviation(t *thermostat) (int, int, bool) {
+	if t.Disabled || t.Offline {
+		return 0, 0, false
+	}
+
+	switch t.OperatingMode {
+	case "heat":
+		off := t.CurrentTemp - t.HeatSetPoint
+		if off > comfortTolerance {
+			return off, off, true
+		}
+		return abs(off), 0, true
+	case "cool":
+		off := t.CoolSetPoint - t.CurrentTemp
+		if off > comfortTolerance {
+			return off, off, true
+		}
+		return abs(off), 0, true
+	case "auto":
+		switch {
+		case t.CurrentTemp < t.HeatSetPoint:
+			return t.HeatSetPoint - t.CurrentTemp, 0, true
+		case t.CurrentTemp > t.CoolSetPoint:
+			return t.CurrentTemp - t.CoolSetPoint, 0, true
+		}
+		return 0, 0, true
+	}
+	return 0, 0, false
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Comfort reports how well the thermostat with the given id kept to its setpoints from the given time until
+// now. Every record of the thermostat holds until the next, so only the window within the latest
+// -journal-size changes is known
+func (home *currentState) Comfort(id int, from time.Time) comfortReport {
+	now := clock.Now()
+	report := comfortReport{ThermostatID: id, From: from, To: now}
+
+	home.Lock()
+	var states []*thermostat
+	var times []time.Time
+	current := home.journal.base[id]
+	for _, c := range home.journal.changes {
+		if c.Snapshot {
+			continue
+		}
+		for _, t := range c.Thermostats {
+			if t.ID != id {
+				continue
+			}
+			if !c.Time.After(from) {
+				current = t
+				continue
+			}
+			states = append(states, t)
+			times = append(times, c.Time)
+		}
+	}
+	home.Unlock()
+	if current != nil {
+		states = append([]*thermostat{current}, states...)
+		times = append([]time.Time{from}, times...)
+	}
+
+	var tracked, within, overshooting time.Duration
+	var deviationTotal, comfortTotal, overshootTotal float64
+	inOvershoot := false
+	for i, t := range states {
+		end := now
+		if i+1 < len(times) {
+			end = times[i+1]
+		}
+		held := end.Sub(times[i])
+		off, over, ok := deviation(t)
+		if !ok || held <= 0 {
+			inOvershoot = inOvershoot && ok
+			continue
+		}
+
+		tracked += held
+		deviationTotal += float64(off) * held.Seconds()
+		if off <= comfortTolerance {
+			within += held
+			comfortTotal += held.Seconds()
+		} else {
+			comfortTotal += math.Max(0, 1-float64(off-comfortTolerance)/comfortFalloff) * held.Seconds()
+		}
+
+		if over == 0 {
+			inOvershoot = false
+			continue
+		}
+		if !inOvershoot {
+			report.Overshoot.Count++
+			inOvershoot = true
+		}
+		overshooting += held
+		overshootTotal += float64(over) * held.Seconds()
+		if over > report.Overshoot.MaxDegrees {
+			report.Overshoot.MaxDegrees = over
+		}
+	}
+
+	report.Tracked = tracked.String()
+	report.Overshoot.Duration = overshooting.String()
+	if tracked > 0 {
+		report.WithinOnePercent = math.Round(float64(within)/float64(tracked)*1000) / 10
+		report.AverageDeviation = math.Round(deviationTotal/tracked.Seconds()*10) / 10
+		report.Score = int(math.Round(comfortTotal / tracked.Seconds() * 100))
+	}
+	if overshooting > 0 {
+		report.Overshoot.MeanDegrees = math.Round(overshootTotal/overshooting.Seconds()*10) / 10
+	}
+	return report
+}
+
+// GetComfort is the handler to return how well a thermostat kept to its setpoints over the last 24 hours,
+// or the ?window= given as a duration such as 168h, e.g. for facilities reporting
+func GetComfort(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	window := defaultComfortWindow
+	if w := string(req.QueryArgs().Peek("window")); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid window provided",
+				Description: "The window '" + w + "' must be a positive duration, e.g. 24h or 168h.",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+		window = d
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, home.Comfort(t.ID, clock.Now().Add(-window)))
+}
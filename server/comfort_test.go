@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestComfort(t *testing.T) {
+	now := time.Now()
+	heating := func(temp int) *thermostat {
+		return &thermostat{ID: 1, OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74, CurrentTemp: temp}
+	}
+	off := heating(68)
+	off.OperatingMode = "off"
+
+	// on target for an hour, 4 degrees over for an hour, back on target for an hour and then switched off
+	h := &currentState{journal: journal{
+		base: map[int]*thermostat{1: heating(67)},
+		changes: []change{
+			{Time: now.Add(-3 * time.Hour), Thermostats: []*thermostat{heating(72)}},
+			{Time: now.Add(-2 * time.Hour), Thermostats: []*thermostat{heating(68)}},
+			{Time: now.Add(-time.Hour), Thermostats: []*thermostat{off}},
+		},
+	}}
+
+	r := h.Comfort(1, now.Add(-4*time.Hour))
+	if r.Tracked != (3*time.Hour).String() || r.WithinOnePercent != 66.7 || r.AverageDeviation != 1.7 || r.Score != 75 {
+		t.Fatalf("expected two of three tracked hours within a degree, got %+v", r)
+	}
+	if o := r.Overshoot; o.Count != 1 || o.MaxDegrees != 4 || o.MeanDegrees != 4 || o.Duration != time.Hour.String() {
+		t.Fatalf("expected a single overshoot of 4 degrees for an hour, got %+v", o)
+	}
+
+	// the window only takes in the part of the history after it starts
+	if r := h.Comfort(1, now.Add(-150*time.Minute)); r.Tracked != (90*time.Minute).String() || r.Overshoot.Duration != (30*time.Minute).String() {
+		t.Fatalf("expected 90 tracked minutes, got %+v", r)
+	}
+}
+
+func TestGetComfort(t *testing.T) {
+	base := newTestServer(t)
+
+	var r comfortReport
+	get(base+"/v1/thermostats/1/comfort?window=1h", t, &r)
+	if r.ThermostatID != 1 || r.To.Sub(r.From).Round(time.Minute) != time.Hour {
+		t.Fatalf("expected the comfort of thermostat 1 over the last hour, got %+v", r)
+	}
+
+	resp, err := http.Get(base + "/v1/thermostats/1/comfort?window=week")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid window, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
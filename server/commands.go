@@ -0,0 +1,255 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// retryPolicy is how often and how far apart a command that failed to reach a device is retried
+type retryPolicy struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+}
+
+// devicePolicy returns the configured retry policy of the device drivers
+func devicePolicy() retryPolicy {
+	return retryPolicy{Attempts: cfg.DeviceAttempts, Base: cfg.DeviceRetryBase, Max: cfg.DeviceRetryMax}
+}
+
+// backoff returns how long to wait before the given retry, starting at 1. The wait doubles from the base
+// with every retry up to the max, and a random part of it is taken so devices that failed together don't
+// all retry at the same moment
+func (p retryPolicy) backoff(retry int) time.Duration {
+	wait := p.Base
+	for i := 1; i < retry && wait < p.Max; i++ {
+		wait *= 2
+	}
+	if wait > p.Max {
+		wait = p.Max
+	}
+	if wait <= 0 {
+		return 0
+	}
+
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// pendingCommand is a command on its way to a device, returned through the api @
+// /v1/thermostats/:id/commands
+type pendingCommand struct {
+	Driver      string    `json:"driver"`
+	Command     string    `json:"command"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	QueuedAt    time.Time `json:"queuedAt"`
+	NextAttempt time.Time `json:"nextAttempt"`
+
+	send    func() error
+	sending bool
+
+	// done is called with the outcome once the command is delivered or dropped
+	done []func(err error)
+}
+
+// commandKey identifies the queue of the commands a driver sends to the device of a thermostat
+type commandKey struct {
+	driver string
+	id     int
+}
+
+// commandQueue holds the commands the drivers send to the devices. Every driver has a queue per device that
+// is sent in order by a goroutine of its own, retrying each command with backoff while the device is
+// unreachable, so one unreachable device never holds up the others. A command that is queued while one
+// of the same kind is still waiting replaces it, as only the latest state matters to a device
+type commandQueue struct {
+	sync.Mutex
+	pending map[commandKey][]*pendingCommand
+
+	// drivers are the names of the drivers that send a command for every change
+	drivers []string
+
+	// stop is closed to stop every goroutine sending commands
+	stop chan struct{}
+}
+
+var commands = &commandQueue{pending: make(map[commandKey][]*pendingCommand), stop: make(chan struct{})}
+
+// register adds a driver that sends a command for every change
+func (q *commandQueue) register(driver string) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drivers = append(q.drivers, driver)
+}
+
+// Drivers returns the names of the drivers that send a command for every change
+func (q *commandQueue) Drivers() []string {
+	q.Lock()
+	defer q.Unlock()
+
+	return append([]string(nil), q.drivers...)
+}
+
+// enqueue queues the command of the driver for the device of the thermostat. done, when given, is called
+// with the outcome once the command is delivered or dropped, which for a command that gets replaced is the
+// outcome of the one replacing it
+func (q *commandQueue) enqueue(driver string, id int, command string, send func() error, done func(err error)) {
+	q.Lock()
+	defer q.Unlock()
+
+	key := commandKey{driver: driver, id: id}
+	queue := q.pending[key]
+	for _, c := range queue {
+		if c.Command == command && !c.sending {
+			c.send = send
+			c.Attempts = 0
+			c.QueuedAt = time.Now()
+			if done != nil {
+				c.done = append(c.done, done)
+			}
+			return
+		}
+	}
+
+	c := &pendingCommand{
+		Driver:      driver,
+		Command:     command,
+		QueuedAt:    time.Now(),
+		NextAttempt: time.Now(),
+		send:        send,
+	}
+	if done != nil {
+		c.done = append(c.done, done)
+	}
+	q.pending[key] = append(queue, c)
+	if len(queue) == 0 {
+		go q.drain(key, q.stop)
+	}
+}
+
+// drain sends the queued commands of the key one at a time until none are left or stop is closed
+func (q *commandQueue) drain(key commandKey, stop chan struct{}) {
+	for {
+		q.Lock()
+		if q.stop != stop {
+			q.Unlock()
+			return
+		}
+		queue := q.pending[key]
+		if len(queue) == 0 {
+			delete(q.pending, key)
+			q.Unlock()
+			return
+		}
+		c := queue[0]
+		c.sending = true
+		c.Attempts++
+		send := c.send
+		q.Unlock()
+
+		err := send()
+		debugln(subsystemDrivers, "sent", c.Command, "to the device of thermostat", key.id, "through", key.driver, "on attempt", c.Attempts, "with error:", err)
+
+		q.Lock()
+		if q.stop != stop {
+			q.Unlock()
+			return
+		}
+		c.sending = false
+		policy := devicePolicy()
+		var wait time.Duration
+		var done []func(err error)
+		switch {
+		case err == nil:
+			q.remove(key, c)
+			done = c.done
+		case c.Attempts >= policy.Attempts:
+			log.Println("giving up on sending", c.Command, "to the device of thermostat", key.id, "through", key.driver, "after", c.Attempts, "attempts with error:", err)
+			q.remove(key, c)
+			done = c.done
+		default:
+			wait = policy.backoff(c.Attempts)
+			c.LastError = err.Error()
+			c.NextAttempt = time.Now().Add(wait)
+		}
+		q.Unlock()
+
+		for _, f := range done {
+			f(err)
+		}
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// remove takes the command out of the queue of the key
+func (q *commandQueue) remove(key commandKey, c *pendingCommand) {
+	queue := q.pending[key]
+	for i := range queue {
+		if queue[i] == c {
+			q.pending[key] = append(queue[:i:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pending returns the commands still on their way to the device of the thermostat, oldest first
+func (q *commandQueue) Pending(id int) []pendingCommand {
+	q.Lock()
+	defer q.Unlock()
+
+	pending := []pendingCommand{}
+	for key, queue := range q.pending {
+		if key.id != id {
+			continue
+		}
+		for _, c := range queue {
+			pending = append(pending, *c)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].QueuedAt.Before(pending[j].QueuedAt) })
+
+	return pending
+}
+
+// reset stops sending and drops every queued command
+func (q *commandQueue) reset() {
+	q.Lock()
+	defer q.Unlock()
+
+	close(q.stop)
+	q.stop = make(chan struct{})
+	q.pending = make(map[commandKey][]*pendingCommand)
+	q.drivers = nil
+}
+
+// GetCommands is the handler to return the commands still on their way to the device of a thermostat, e.g.
+// while it's unreachable
+func GetCommands(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, commands.Pending(t.ID))
+}
+
+// sendCommand queues a command of the driver for the device of the thermostat, sending it through the
+// breaker of the driver. The job of an asynchronous write that committed the thermostat learns the outcome
+func sendCommand(b *breaker, t *thermostat, command string, send func() error) {
+	driver := b.cb.Name()
+	commands.enqueue(driver, t.ID, command, func() error { return b.call(send) }, jobs.claim(t, driver))
+}
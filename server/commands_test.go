@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{Attempts: 10, Base: 100 * time.Millisecond, Max: time.Second}
+	cases := map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 5: time.Second, 50: time.Second}
+	for retry, wait := range cases {
+		for i := 0; i < 100; i++ {
+			if got := p.backoff(retry); got < wait/2 || got > wait {
+				t.Fatalf("expected retry %d to wait between %s and %s, got %s", retry, wait/2, wait, got)
+			}
+		}
+	}
+}
+
+// flakyDevice fails every command until it's told to come back
+type flakyDevice struct {
+	sync.Mutex
+	reachable bool
+	received  []string
+}
+
+func (d *flakyDevice) send(command string) func() error {
+	return func() error {
+		d.Lock()
+		defer d.Unlock()
+
+		if !d.reachable {
+			return errors.New("device unreachable")
+		}
+		d.received = append(d.received, command)
+		return nil
+	}
+}
+
+func TestCommandQueue(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.DeviceRetryBase = 20 * time.Millisecond
+		c.DeviceRetryMax = 50 * time.Millisecond
+		c.BreakerCooldown = 10 * time.Millisecond
+	})
+
+	device := &flakyDevice{}
+	b := newBreaker("devices")
+	sendCommand(b, &thermostat{ID: 1}, "desired", device.send("first"))
+	sendCommand(b, &thermostat{ID: 1}, "reboot", device.send("reboot"))
+
+	// wait for a failed attempt, so the pending commands are visible with the error
+	var pending []pendingCommand
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		get(base+"/v1/thermostats/1/commands", t, &pending)
+		if len(pending) == 2 && pending[0].Attempts > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 pending commands to be retried, got %+v", pending)
+		}
+	}
+	if pending[0].Driver != "devices" || pending[0].Command != "desired" || pending[0].LastError != "device unreachable" || pending[1].Command != "reboot" {
+		t.Fatalf("unexpected pending commands %+v", pending)
+	}
+
+	// only the latest desired state is sent once the device is back
+	sendCommand(b, &thermostat{ID: 1}, "desired", device.send("second"))
+	device.Lock()
+	device.reachable = true
+	device.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		get(base+"/v1/thermostats/1/commands", t, &pending)
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected every command to reach the device, still pending %+v", pending)
+		}
+	}
+
+	device.Lock()
+	defer device.Unlock()
+	if len(device.received) != 2 || device.received[0] != "second" || device.received[1] != "reboot" {
+		t.Fatalf("expected the device to receive the latest desired state and then the reboot, got %v", device.received)
+	}
+}
+
+func TestCommandQueueGivesUp(t *testing.T) {
+	newTestServer(t, func(c *config) {
+		c.DeviceAttempts = 3
+		c.DeviceRetryBase = time.Millisecond
+		c.DeviceRetryMax = time.Millisecond
+	})
+
+	device := &flakyDevice{}
+	var attempts int
+	var mu sync.Mutex
+	commands.enqueue("devices", 2, "desired", func() error {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		return device.send("desired")()
+	}, nil)
+
+	for deadline := time.Now().Add(5 * time.Second); len(commands.Pending(2)) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the command to be dropped after 3 attempts")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Fatalf("expected %d attempts, got %d", 3, attempts)
+	}
+}
+
+func TestGetCommandsNotFound(t *testing.T) {
+	base := newTestServer(t)
+	resp, err := http.Get(base + "/v1/thermostats/999/commands")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d for an unknown thermostat, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
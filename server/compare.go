@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// comparison is returned through the api @ /v1/thermostats/compare
+type comparison struct {
+	IDs         []int       `json:"ids"`
+	Differences int         `json:"differences"`
+	Fields      []fieldDiff `json:"fields"`
+}
+
+// fieldDiff holds the value of a single field of each compared thermostat, in the order they were given
+type fieldDiff struct {
+	Field     string        `json:"field"`
+	Values    []interface{} `json:"values"`
+	Different bool          `json:"different"`
+}
+
+// compareFields are the fields of a thermostat that are compared, by their json name
+var compareFields = []string{"name", "currentTemp", "mode", "coolSetPoint", "heatSetPoint", "fan", "tags", "disabled",
+	"maintenanceUntil", "freezeProtection", "overheatProtection"}
+
+// compareThermostats diffs the thermostats field by field
+func compareThermostats(therms []*thermostat) (*comparison, error) {
+	res := &comparison{}
+
+	var values []map[string]interface{}
+	for _, t := range therms {
+		res.IDs = append(res.IDs, t.ID)
+
+		// go through json so every field is compared exactly as the api shows it
+		jsn, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(jsn, &v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	for _, field := range compareFields {
+		diff := fieldDiff{Field: field}
+		for _, v := range values {
+			diff.Values = append(diff.Values, v[field])
+			if !reflect.DeepEqual(v[field], values[0][field]) {
+				diff.Different = true
+			}
+		}
+		if diff.Different {
+			res.Differences++
+		}
+		res.Fields = append(res.Fields, diff)
+	}
+
+	return res, nil
+}
+
+// CompareThermostats is the handler to diff the settings of the two thermostats given by ?ids=1,2
+func CompareThermostats(req *fasthttp.RequestCtx) {
+	ids := strings.Split(string(req.QueryArgs().Peek("ids")), ",")
+	if len(ids) != 2 {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid identifiers provided",
+			Description: "Exactly two thermostat ids must be given to compare, e.g. ?ids=1,2",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	var therms []*thermostat
+	for _, idStr := range ids {
+		id, err := strconv.Atoi(strings.TrimSpace(idStr))
+		if err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid identifier provided",
+				Description: err.Error(),
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+
+		t, errRes := home.Thermostat(id)
+		if errRes != nil {
+			req.SetStatusCode(http.StatusNotFound)
+			sendJSON(req, errRes)
+			return
+		}
+		therms = append(therms, t)
+	}
+
+	res, err := compareThermostats(therms)
+	if err != nil {
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to compare thermostats",
+			Description: err.Error(),
+		})
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, res)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCompareThermostats(t *testing.T) {
+	base := newTestServer(t)
+	a, _ := home.AddThermostat(updateThermostat{Name: "Den", OperatingMode: "heat", Tags: []string{"floor:1"}})
+	b, _ := home.AddThermostat(updateThermostat{Name: "Den", OperatingMode: "cool", Tags: []string{"floor:1"}})
+
+	var res comparison
+	get(base+"/v1/thermostats/compare?ids="+strconv.Itoa(a)+","+strconv.Itoa(b), t, &res)
+	if len(res.IDs) != 2 || res.IDs[0] != a || res.IDs[1] != b {
+		t.Fatalf("expected thermostats %d and %d to be compared, got %v", a, b, res.IDs)
+	}
+	if res.Differences != 1 {
+		t.Fatalf("expected only the mode to differ, got %d differences", res.Differences)
+	}
+
+	for _, diff := range res.Fields {
+		if diff.Different != (diff.Field == "mode") {
+			t.Fatalf("expected only the mode to differ, got %+v", diff)
+		}
+		if diff.Field == "mode" && (diff.Values[0] != "heat" || diff.Values[1] != "cool") {
+			t.Fatalf("expected the modes heat and cool, got %v", diff.Values)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// config holds the runtime settings of the api server. All values can be overridden through command
+// line flags, and the defaults are what the server runs with when no flags are given
+type config struct {
+	Addr              string
+	Server            string
+	Listeners         listenerFlags
+	TLSAddr           string
+	TLSCert           string
+	TLSKey            string
+	HTTP3             bool
+	Home              string
+	PublicURL         string
+	ReadOnlyFile      string
+	ActionsFile       string
+	HolidaysFile      string
+	NotificationsFile string
+	GroupsFile        string
+	HistoryFile       string
+	OnCallFile        string
+	InstallersFile    string
+	ReceiptsFile      string
+	Latitude          float64
+	Longitude         float64
+	UsersFile         string
+	AccessTokenTTL    time.Duration
+	RefreshTokenTTL   time.Duration
+
+	ReadTimeout   time.Duration
+	WriteTimeout  time.Duration
+	IdleTimeout   time.Duration
+	MaxConnsPerIP int
+	Concurrency   int
+
+	MaintenanceDuration    time.Duration
+	MaxMaintenanceDuration time.Duration
+	BoostDuration          time.Duration
+	MaxBoostDuration       time.Duration
+	FanTimerDuration       time.Duration
+	MaxFanTimerDuration    time.Duration
+
+	FreezeProtectTemp   int
+	OverheatProtectTemp int
+	OverheatAction      string
+	HVACMinOff          time.Duration
+	SecondStageDelta    int
+
+	AnomalyDelta  int
+	AnomalyWindow time.Duration
+
+	ForecastURL      string
+	ForecastInterval time.Duration
+
+	EquipmentInterval    time.Duration
+	EquipmentDegradation int
+	EquipmentMaxCycle    time.Duration
+
+	TelemetryInterval time.Duration
+	KafkaBrokers      string
+	KafkaTopicPrefix  string
+	NATSURL           string
+	NATSSubjectPrefix string
+	AMQPURL           string
+	AMQPExchange      string
+	AMQPRoutingKey    string
+
+	AWSIoTEndpoint    string
+	AWSIoTClientID    string
+	AWSIoTCert        string
+	AWSIoTKey         string
+	AWSIoTCA          string
+	AWSIoTThingPrefix string
+
+	DeviceBroker      string
+	DeviceClientID    string
+	DeviceTopicPrefix string
+	DeviceAttempts    int
+	DeviceRetryBase   time.Duration
+	DeviceRetryMax    time.Duration
+	DeliveryAttempts  int
+	DeliveryRetryBase time.Duration
+	DeliveryRetryMax  time.Duration
+	JobTTL            time.Duration
+	OfflineTTL        time.Duration
+	PairingTTL        time.Duration
+
+	RetainHistory       time.Duration
+	RetainAudit         time.Duration
+	RetainNotifications time.Duration
+
+	InfluxURL      string
+	InfluxOrg      string
+	InfluxBucket   string
+	InfluxToken    string
+	InfluxInterval time.Duration
+
+	MetricsThermostats    string
+	MetricsLabels         string
+	MetricsMaxThermostats int
+
+	SlackToken       string
+	TelegramToken    string
+	TelegramSecret   string
+	DiscordPublicKey string
+	IFTTTServiceKey  string
+
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	BreakerTimeout  time.Duration
+
+	SentryDSN         string
+	SentryEnvironment string
+
+	VaultAddr       string
+	VaultToken      string
+	VaultSecret     string
+	AWSSecretID     string
+	AWSSecretRegion string
+	SecretsRefresh  time.Duration
+
+	Chaos bool
+
+	VirtualClock bool
+	ClockSpeed   float64
+
+	ClusterEtcd string
+	ClusterNode string
+	RaftAddr    string
+	RaftDir     string
+	RaftPeers   string
+
+	WALFile         string
+	WALCompactAfter int
+	JournalSize     int
+
+	ReplicaOf       string
+	ReplicaUser     string
+	ReplicaPassword string
+
+	SyncListen  string
+	SyncCentral string
+	SyncSite    string
+	SyncToken   string
+	SyncTLS     bool
+	SyncBuffer  int
+}
+
+var cfg config
+
+func init() {
+	cfg.register(flag.CommandLine)
+}
+
+// register defines a flag for every option of the configuration on the flag set, setting each option to its
+// default
+func (c *config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", ":8080", "address to serve the api on")
+	fs.Var(&c.Listeners, "listen", "listener to serve the api on instead of -addr, repeatable: the address or unix:/path followed by the options tls, groups=api+admin+auth and auth=none")
+	fs.StringVar(&c.TLSAddr, "tls-addr", "", "address to also serve the api on over tls with http/2, e.g. :8443; disabled when empty")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "path to the pem encoded certificate for -tls-addr")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "path to the pem encoded private key for -tls-addr")
+	fs.BoolVar(&c.HTTP3, "http3", false, "also serve http/3 over quic on the udp port of -tls-addr")
+	fs.StringVar(&c.Server, "server", "fasthttp", "http server to serve the api with: 'fasthttp' or 'nethttp' for compatibility with standard net/http middleware")
+	fs.StringVar(&c.Home, "home", "home", "name of the home served, used to tell deployments apart in published events")
+	fs.StringVar(&c.PublicURL, "public-url", "", "url devices and installers reach the server at, e.g. https://hq.example.com, encoded in provisioning qr codes; the url of the request when empty")
+	fs.StringVar(&c.ReadOnlyFile, "readonly-file", "readonly.json", "file the read-only mode is persisted to so it survives a restart")
+	fs.StringVar(&c.ActionsFile, "actions-file", "actions.json", "file the scheduled actions are persisted to so they survive a restart; they only live in memory when empty")
+	fs.StringVar(&c.HolidaysFile, "holidays-file", "holidays.json", "file the holiday calendar is persisted to so it survives a restart; it only lives in memory when empty")
+	fs.StringVar(&c.NotificationsFile, "notifications-file", "notifications.json", "file the notification preferences of the users are persisted to so they survive a restart; they only live in memory when empty")
+	fs.StringVar(&c.InstallersFile, "installers-file", "installers.json", "file the installer grants and thermostat installations are persisted to so they survive a restart; they only live in memory when empty")
+	fs.StringVar(&c.ReceiptsFile, "receipts-file", "receipts.json", "file the receipts of the data deleted by purges and retention limits are persisted to so they survive a restart; they only live in memory when empty")
+	fs.StringVar(&c.OnCallFile, "oncall-file", "oncall.json", "file the on-call rotation is persisted to so it survives a restart; it only lives in memory when empty")
+	fs.StringVar(&c.HistoryFile, "history-file", "history.json", "file the history imported from other thermostat vendors is persisted to so it survives a restart; it only lives in memory when empty")
+	fs.StringVar(&c.GroupsFile, "groups-file", "groups.json", "file the settings of the thermostat groups are persisted to so they survive a restart; they only live in memory when empty")
+	fs.Float64Var(&c.Latitude, "latitude", 0, "latitude of the home in degrees, north positive, which actions scheduled at sunrise or sunset need")
+	fs.Float64Var(&c.Longitude, "longitude", 0, "longitude of the home in degrees, east positive, which actions scheduled at sunrise or sunset need")
+	fs.StringVar(&c.UsersFile, "users", "", "path to a json file of api users; authentication is disabled when empty")
+	fs.DurationVar(&c.AccessTokenTTL, "access-token-ttl", 15*time.Minute, "lifetime of an access token")
+	fs.DurationVar(&c.RefreshTokenTTL, "refresh-token-ttl", 30*24*time.Hour, "lifetime of a refresh token")
+
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 10*time.Second, "longest a client may take to send a request, so slow clients can't hold connections open; 0 for no limit")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 30*time.Second, "longest sending a response may take; 0 for no limit")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 2*time.Minute, "how long an idle keep-alive connection is held open for the next request; -read-timeout is used when 0")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", 0, "most connections a single client ip may hold open at once; 0 for no limit, which suits servers behind a proxy that all clients share the ip of")
+	fs.IntVar(&c.Concurrency, "concurrency", fasthttp.DefaultConcurrency, "most connections served at once, beyond which new ones are turned away; 0 for no limit")
+
+	fs.DurationVar(&c.MaintenanceDuration, "maintenance-duration", 2*time.Hour, "how long maintenance mode lasts when no duration is given")
+	fs.DurationVar(&c.MaxMaintenanceDuration, "max-maintenance-duration", 24*time.Hour, "longest maintenance window that can be requested")
+	fs.DurationVar(&c.BoostDuration, "boost-duration", time.Hour, "how long a boost of the setpoints lasts when no duration is given")
+	fs.DurationVar(&c.MaxBoostDuration, "max-boost-duration", 12*time.Hour, "longest boost of the setpoints that can be requested")
+	fs.DurationVar(&c.FanTimerDuration, "fan-timer-duration", 30*time.Minute, "how long a fan timer runs the fan when no duration is given")
+	fs.DurationVar(&c.MaxFanTimerDuration, "max-fan-timer-duration", 12*time.Hour, "longest fan timer that can be requested")
+
+	fs.IntVar(&c.FreezeProtectTemp, "freeze-protect-temp", 40, "temperature below which the heat is forced on regardless of mode; 0 disables freeze protection")
+	fs.IntVar(&c.OverheatProtectTemp, "overheat-protect-temp", 90, "temperature above which overheat protection takes over regardless of mode; 0 disables overheat protection")
+	fs.StringVar(&c.OverheatAction, "overheat-action", "cool", "what overheat protection does above the ceiling: 'cool' forces cooling, 'off' shuts the equipment down")
+	fs.DurationVar(&c.HVACMinOff, "hvac-min-off", 5*time.Minute, "shortest time the equipment stays off between two heating or cooling cycles, protecting compressors from short cycling; 0 disables the lockout")
+	fs.IntVar(&c.SecondStageDelta, "second-stage-delta", 3, "degrees the temperature must be from the setpoint for two-stage equipment to run its second stage; 0 for single-stage equipment")
+
+	fs.IntVar(&c.AnomalyDelta, "anomaly-delta", 5, "temperature change in degrees that is reported as an anomaly; 0 disables detection")
+	fs.DurationVar(&c.AnomalyWindow, "anomaly-window", 10*time.Minute, "time window a temperature change must happen within to be an anomaly")
+	fs.StringVar(&c.ForecastURL, "forecast-url", "", "open-meteo compatible forecast api the hourly temperatures at -latitude and -longitude are fetched from for pre-conditioning, e.g. https://api.open-meteo.com/v1/forecast; disabled when empty")
+	fs.DurationVar(&c.ForecastInterval, "forecast-interval", time.Hour, "how often the forecast is fetched")
+	fs.DurationVar(&c.EquipmentInterval, "equipment-interval", time.Hour, "how often the equipment of every thermostat is analyzed for signs of failing; 0 disables the analysis")
+	fs.IntVar(&c.EquipmentDegradation, "equipment-degradation", 25, "percent more time per degree the equipment takes to reach the setpoint this week than last week that raises an equipment alert; 0 disables the check")
+	fs.DurationVar(&c.EquipmentMaxCycle, "equipment-max-cycle", 2*time.Hour, "longest the equipment runs without reaching the setpoint before an equipment alert is raised; 0 disables the check")
+
+	fs.DurationVar(&c.TelemetryInterval, "telemetry-interval", time.Minute, "how often telemetry events are published; 0 disables them")
+	fs.StringVar(&c.KafkaBrokers, "kafka-brokers", "", "comma separated kafka brokers to publish events to; disabled when empty")
+	fs.StringVar(&c.KafkaTopicPrefix, "kafka-topic-prefix", "thermostats", "prefix of the kafka topics, which are named <prefix>.<event type>, e.g. <prefix>.change")
+	fs.StringVar(&c.NATSURL, "nats-url", "", "url of the nats server to publish events to and answer reads from; disabled when empty")
+	fs.StringVar(&c.NATSSubjectPrefix, "nats-subject-prefix", "thermostats", "prefix of the nats subjects, e.g. <prefix>.change.<id> and <prefix>.get")
+	fs.StringVar(&c.AMQPURL, "amqp-url", "", "url of the rabbitmq broker to publish events to; disabled when empty")
+	fs.StringVar(&c.AMQPExchange, "amqp-exchange", "thermostats", "name of the topic exchange events are published to")
+	fs.StringVar(&c.AMQPRoutingKey, "amqp-routing-key", "{home}.{type}.{id}", "routing key template of published events, supporting {home}, {type} and {id}")
+
+	fs.StringVar(&c.AWSIoTEndpoint, "aws-iot-endpoint", "", "aws iot data endpoint to mirror thermostats into thing shadows; disabled when empty")
+	fs.StringVar(&c.AWSIoTClientID, "aws-iot-client-id", "thermostat-api", "mqtt client id used to connect to aws iot")
+	fs.StringVar(&c.AWSIoTCert, "aws-iot-cert", "", "path to the device certificate used to connect to aws iot")
+	fs.StringVar(&c.AWSIoTKey, "aws-iot-key", "", "path to the private key of the device certificate")
+	fs.StringVar(&c.AWSIoTCA, "aws-iot-ca", "", "path to the root ca of aws iot; the system roots are used when empty")
+	fs.StringVar(&c.AWSIoTThingPrefix, "aws-iot-thing-prefix", "thermostat-", "prefix of the thing names, which are named <prefix><id>")
+
+	fs.StringVar(&c.DeviceBroker, "device-broker", "", "mqtt broker the thermostat devices report readings and receive their desired state through, e.g. tcp://localhost:1883; disabled when empty")
+	fs.StringVar(&c.DeviceClientID, "device-client-id", "thermostat-api", "mqtt client id used to connect to the device broker")
+	fs.StringVar(&c.DeviceTopicPrefix, "device-topic-prefix", "thermostats/devices", "prefix of the device topics, e.g. <prefix>/<id>/desired and <prefix>/<id>/reported")
+	fs.IntVar(&c.DeviceAttempts, "device-attempts", 10, "most times a command is sent to an unreachable device, or to aws iot, before it's dropped")
+	fs.DurationVar(&c.DeviceRetryBase, "device-retry-base", 500*time.Millisecond, "wait before the first retry of a command to an unreachable device, which doubles with every retry")
+	fs.DurationVar(&c.DeviceRetryMax, "device-retry-max", time.Minute, "longest wait between two retries of a command to an unreachable device")
+	fs.IntVar(&c.DeliveryAttempts, "delivery-attempts", 3, "most times an event is published, or a notification sent, before it lands in the dead letter queue @ /v1/admin/dlq")
+	fs.DurationVar(&c.DeliveryRetryBase, "delivery-retry-base", 200*time.Millisecond, "wait before the first retry of an event or a notification, which doubles with every retry")
+	fs.DurationVar(&c.DeliveryRetryMax, "delivery-retry-max", 5*time.Second, "longest wait between two retries of an event or a notification")
+	fs.DurationVar(&c.JobTTL, "job-ttl", time.Hour, "how long the status of an asynchronous write is kept after it was made")
+	fs.DurationVar(&c.PairingTTL, "pairing-ttl", 7*24*time.Hour, "how long the pairing token of a provisioning qr code can be claimed by a device for")
+	fs.DurationVar(&c.OfflineTTL, "offline-ttl", 0, "how long an update of a thermostat whose device is offline is queued for it to reconnect, unless the write gives a ?ttl=; such writes are rejected when 0")
+
+	fs.DurationVar(&c.RetainHistory, "retain-history", 0, "how long the imported history of a thermostat is kept after the interval it covers; it's kept until purged when 0")
+	fs.DurationVar(&c.RetainAudit, "retain-audit", 0, "how long an entry of the audit log is kept; entries are kept until purged, or until there are 1000 newer ones, when 0")
+	fs.DurationVar(&c.RetainNotifications, "retain-notifications", 0, "how long the delivery log and dead-lettered notifications are kept; they're kept until purged, or crowded out by newer ones, when 0")
+
+	fs.StringVar(&c.InfluxURL, "influx-url", "", "url of the influxdb server to write telemetry to; disabled when empty")
+	fs.StringVar(&c.InfluxOrg, "influx-org", "", "influxdb organization owning the bucket")
+	fs.StringVar(&c.InfluxBucket, "influx-bucket", "thermostats", "influxdb bucket telemetry is written to")
+	fs.StringVar(&c.InfluxToken, "influx-token", "", "influxdb api token with write access to the bucket")
+	fs.DurationVar(&c.InfluxInterval, "influx-interval", 10*time.Second, "how often a sample of every thermostat is written to influxdb")
+
+	fs.StringVar(&c.MetricsThermostats, "metrics-thermostats", "", "comma separated ids or tags of the thermostats whose temperature, setpoints and state are exported to /metrics, or * for every one; none are when empty")
+	fs.StringVar(&c.MetricsLabels, "metrics-labels", "home,zone,thermostat_id,name", "comma separated labels the metrics of a thermostat carry, out of home, zone, thermostat_id and name; leaving out name keeps renames from starting new series")
+	fs.IntVar(&c.MetricsMaxThermostats, "metrics-max-thermostats", 1000, "most thermostats exported to /metrics, those with the lowest ids; the others are counted by thermostat_metrics_dropped")
+
+	fs.StringVar(&c.SlackToken, "slack-token", "", "slack bot token notifications are posted to slack channels by name with; only incoming webhooks can be used when empty")
+	fs.StringVar(&c.TelegramToken, "telegram-token", "", "telegram bot token the bot sends alerts and replies to commands with; the telegram bot is disabled when empty")
+	fs.StringVar(&c.TelegramSecret, "telegram-secret", "", "secret token the webhook of the telegram bot was set with, which proves the updates posted to /v1/chat/telegram come from telegram")
+	fs.StringVar(&c.DiscordPublicKey, "discord-public-key", "", "hex public key of the discord application, which the slash commands posted to /v1/chat/discord are verified with; the discord bot is disabled when empty")
+	fs.StringVar(&c.IFTTTServiceKey, "ifttt-service-key", "", "service key of the ifttt service, which ifttt sends with every request to /ifttt/v1; the ifttt triggers and actions are disabled when empty")
+
+	fs.IntVar(&c.BreakerFailures, "breaker-failures", 5, "failed calls in a row after which the circuit breaker of an external integration opens and calls to it fail straight away; 0 never opens it")
+	fs.DurationVar(&c.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long a circuit breaker stays open before a single call is let through to probe the integration")
+	fs.DurationVar(&c.BreakerTimeout, "breaker-timeout", 10*time.Second, "longest a call to an external integration may take before it counts as failed; 0 for no limit")
+
+	fs.StringVar(&c.SentryDSN, "sentry-dsn", "", "sentry dsn panics and internal errors are reported to; disabled when empty")
+	fs.StringVar(&c.SentryEnvironment, "sentry-environment", "production", "environment reported to sentry")
+
+	fs.StringVar(&c.VaultAddr, "vault-addr", "", "address of the vault server to load the secrets from, e.g. https://vault.example.com:8200, overriding their flags; they come from their flags when empty")
+	fs.StringVar(&c.VaultToken, "vault-token", "", "vault token to read -vault-secret with; VAULT_TOKEN when empty")
+	fs.StringVar(&c.VaultSecret, "vault-secret", "secret/data/thermostat", "api path under /v1 of the kv version 2 secret the secrets are loaded from, with a field named after the flag of each secret, e.g. slack-token")
+	fs.StringVar(&c.AWSSecretID, "aws-secret-id", "", "name or arn of the aws secrets manager secret to load the secrets from, a json object with a value named after the flag of each secret, overriding their flags; they come from their flags when empty")
+	fs.StringVar(&c.AWSSecretRegion, "aws-secret-region", "", "aws region of -aws-secret-id; AWS_REGION when empty")
+	fs.DurationVar(&c.SecretsRefresh, "secrets-refresh", 5*time.Minute, "how often the secrets are loaded again from -vault-addr or -aws-secret-id to pick up rotated ones; they're only loaded at startup when 0")
+
+	fs.BoolVar(&c.Chaos, "chaos", false, "serve the chaos testing endpoints under /v1/admin/chaos to inject latency, errors, temperature spikes and offline devices; never enable in production")
+	fs.BoolVar(&c.VirtualClock, "virtual-clock", false, "serve the virtual clock endpoints under /v1/admin/clock to speed up, stop and step the time the scheduler and the automated features go by; never enable in production")
+	fs.Float64Var(&c.ClockSpeed, "clock-speed", 1, "times faster than real time the thermostats, the scheduler and the automated features run, up to 1000; 0 stops the clock so it only moves when stepped through /v1/admin/clock/advance")
+
+	fs.StringVar(&c.ClusterEtcd, "cluster-etcd", "", "comma separated etcd endpoints to elect a cluster leader through; the node runs standalone when empty")
+	fs.StringVar(&c.ClusterNode, "cluster-node", "", "address other nodes and clients reach this node on, e.g. http://10.0.0.5:8080; defaults to the hostname and -addr")
+	fs.StringVar(&c.RaftAddr, "raft-addr", "", "address to serve raft on, e.g. :7000, replicating the thermostats across the -raft-peers; disabled when empty")
+	fs.StringVar(&c.RaftDir, "raft-dir", "raft", "directory the raft log and snapshots are kept in")
+	fs.StringVar(&c.RaftPeers, "raft-peers", "", "comma separated nodes of the initial raft cluster including this one, each given as <-cluster-node>=<raft address>")
+
+	fs.StringVar(&c.WALFile, "wal-file", "", "write-ahead log every change is appended to and replayed from at startup; changes only live in memory when empty")
+	fs.IntVar(&c.WALCompactAfter, "wal-compact-after", 1000, "number of changes after which the write-ahead log is compacted into a snapshot")
+	fs.IntVar(&c.JournalSize, "journal-size", 10000, "number of the latest changes kept in memory, which the thermostats can be rebuilt from and GET /v1/admin/changes lists")
+
+	fs.StringVar(&c.ReplicaOf, "replica-of", "", "base url of a primary to follow as a read replica, e.g. http://10.0.0.5:8080; disabled when empty")
+	fs.StringVar(&c.ReplicaUser, "replica-user", "", "username to log in to the primary with, when it requires authentication")
+	fs.StringVar(&c.ReplicaPassword, "replica-password", "", "password to log in to the primary with")
+
+	fs.StringVar(&c.SyncListen, "sync-listen", "", "address to accept the grpc sync streams of on-premise agents on, e.g. :9090, making this the central instance of a fleet; disabled when empty")
+	fs.StringVar(&c.SyncCentral, "sync-central", "", "grpc address of the central instance to sync the state and telemetry of this site to as an agent, e.g. central.example.com:9090; disabled when empty")
+	fs.StringVar(&c.SyncSite, "sync-site", "", "name of the site this agent syncs, -home when empty")
+	fs.StringVar(&c.SyncToken, "sync-token", "", "secret the agents authenticate to the central instance with; agents aren't authenticated when empty")
+	fs.BoolVar(&c.SyncTLS, "sync-tls", false, "sync over tls, the central instance serving the -tls-cert and -tls-key certificate")
+	fs.IntVar(&c.SyncBuffer, "sync-buffer", 10000, "number of events an agent buffers while the central instance can't be reached, dropping the oldest beyond it")
+}
+
+// defaultConfig returns the configuration the server runs with when no flags are given
+func defaultConfig() config {
+	var c config
+	c.register(flag.NewFlagSet("defaults", flag.ContinueOnError))
+	return c
+}
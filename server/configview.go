@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// secretFlags are never shown through the api, only whether they are set. Every flag holding a credential
+// belongs here as soon as it's added
+var secretFlags = []string{
+	"influx-token", "sentry-dsn", "replica-password", "sync-token", "vault-token",
+	// the tokens the notification integrations authenticate with
+	"slack-token", "telegram-token", "telegram-secret", "ifttt-service-key",
+	// the brokers take their credentials, or a token in place of the user, in the url
+	"amqp-url", "nats-url",
+}
+
+// configValue is a single setting returned through the api @ /v1/admin/config
+type configValue struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Default string `json:"default"`
+	Source  string `json:"source"` // "flag" when given on the command line, else "default"
+	Usage   string `json:"usage"`
+}
+
+// redact hides the value of secret settings and the password of urls
+func redact(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if inArray(name, secretFlags) {
+		return "REDACTED"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// effectiveConfig returns every setting of the flag set with the value it runs with and where that value
+// came from
+func effectiveConfig(fs *flag.FlagSet) []configValue {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var values []configValue
+	fs.VisitAll(func(f *flag.Flag) {
+		// leave out the flags the go test runner adds
+		if strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+
+		source := "default"
+		if given[f.Name] {
+			source = "flag"
+		}
+
+		values = append(values, configValue{
+			Name:    f.Name,
+			Value:   redact(f.Name, f.Value.String()),
+			Default: redact(f.Name, f.DefValue),
+			Source:  source,
+			Usage:   f.Usage,
+		})
+	})
+
+	return values
+}
+
+// GetConfig is the handler to return the effective configuration of the server, with secrets redacted
+func GetConfig(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, effectiveConfig(flag.CommandLine))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// crashServerEnv tells a child process to run the server a crash test kills, given as <addr>,<wal file>
+const crashServerEnv = "THERMOSTAT_CRASH_SERVER"
+
+// TestCrashServer is the server the crash tests run in a child process. It only runs when started by them
+func TestCrashServer(t *testing.T) {
+	spec := os.Getenv(crashServerEnv)
+	if spec == "" {
+		t.Skip("only runs as the server of the crash tests")
+	}
+
+	addr, walFile, _ := strings.Cut(spec, ",")
+	cfg.Addr = addr
+	cfg.WALFile = walFile
+	cfg.ReadOnlyFile = filepath.Join(filepath.Dir(walFile), "readonly.json")
+	serve()
+}
+
+// crashServer is a server running in a child process, which can be killed at any moment
+type crashServer struct {
+	cmd    *exec.Cmd
+	url    string
+	output bytes.Buffer
+}
+
+// startCrashServer starts the server on addr with the write-ahead log and waits for it to serve
+func startCrashServer(t *testing.T, addr, walFile string) *crashServer {
+	s := &crashServer{url: "http://" + addr}
+	s.cmd = exec.Command(os.Args[0], "-test.run=^TestCrashServer$")
+	s.cmd.Env = append(os.Environ(), crashServerEnv+"="+addr+","+walFile)
+	s.cmd.Stdout = &s.output
+	s.cmd.Stderr = &s.output
+	if err := s.cmd.Start(); err != nil {
+		t.Fatalf("failed to start the server: %s", err)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if resp, err := http.Get(s.url + "/v1/thermostats"); err == nil {
+			resp.Body.Close()
+			return s
+		}
+		if time.Now().After(deadline) {
+			s.kill()
+			t.Fatalf("timed out waiting for the server to start:\n%s", s.output.String())
+		}
+	}
+}
+
+// kill stops the server without giving it a chance to clean up
+func (s *crashServer) kill() {
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+// crashWrites keeps track of the writes the server acknowledged, which must all survive a crash
+type crashWrites struct {
+	sync.Mutex
+	added map[string]int // name of every added thermostat to its id
+	gens  map[int]int    // generation of the last acknowledged update of every thermostat
+}
+
+// genThermostat is the body of the update of a given generation. The setpoints are derived from the
+// generation named, so a thermostat that was only partly updated can be told apart
+func genThermostat(gen int) string {
+	return `{"name": "gen-` + strconv.Itoa(gen) + `", "coolSetPoint": ` + strconv.Itoa(70+gen%10) + `, "heatSetPoint": ` + strconv.Itoa(60+gen%10) + `}`
+}
+
+// sendJSONRequest sends the body to the server, returning the status code
+func sendJSONRequest(method, url, body string, v interface{}) (int, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if v != nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated) {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// verifyCrashInvariants checks the state of a restarted server against the writes it acknowledged before
+// it was killed
+func verifyCrashInvariants(t *testing.T, s *crashServer, writes *crashWrites) {
+	var therms []*thermostat
+	if code, err := sendJSONRequest("GET", s.url+"/v1/thermostats", "", &therms); err != nil || code != http.StatusOK {
+		t.Fatalf("failed to list the thermostats after a restart: %d %v", code, err)
+	}
+
+	byID := make(map[int]*thermostat)
+	byName := make(map[string]int)
+	for _, th := range therms {
+		if _, ok := byID[th.ID]; ok {
+			t.Fatalf("thermostat id %d is used more than once", th.ID)
+		}
+		byID[th.ID] = th
+		byName[th.Name]++
+
+		// no partial updates: the setpoints must be those of the generation named
+		if gen, err := strconv.Atoi(strings.TrimPrefix(th.Name, "gen-")); err == nil {
+			if th.CoolSetPoint != 70+gen%10 || th.HeatSetPoint != 60+gen%10 {
+				t.Fatalf("thermostat %d was partly updated to generation %d: %+v", th.ID, gen, th)
+			}
+		}
+	}
+
+	writes.Lock()
+	defer writes.Unlock()
+
+	// every acknowledged add must have survived under its own id
+	for name, id := range writes.added {
+		th, ok := byID[id]
+		if !ok {
+			t.Fatalf("acknowledged thermostat %d (%s) was lost", id, name)
+		}
+		if th.Name != name && !strings.HasPrefix(th.Name, "gen-") {
+			t.Fatalf("thermostat %d was added as %s but is now %s", id, name, th.Name)
+		}
+		if byName[name] > 1 {
+			t.Fatalf("thermostat %s was added more than once", name)
+		}
+	}
+
+	// every acknowledged update must have survived, while one in flight may or may not have
+	for id, acked := range writes.gens {
+		gen, err := strconv.Atoi(strings.TrimPrefix(byID[id].Name, "gen-"))
+		if err != nil || gen < acked {
+			t.Fatalf("acknowledged generation %d of thermostat %d was lost, got %+v", acked, id, byID[id])
+		}
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("kills and restarts the server, which takes a while")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	walFile := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	writes := &crashWrites{added: make(map[string]int), gens: make(map[int]int)}
+	for round := 0; round < 3; round++ {
+		s := startCrashServer(t, addr, walFile)
+		verifyCrashInvariants(t, s, writes)
+
+		// keep adding and updating thermostats until the server is killed
+		var wg sync.WaitGroup
+		for w := 0; w < 2; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for n := 0; ; n++ {
+					name := "added-" + strconv.Itoa(round) + "-" + strconv.Itoa(w) + "-" + strconv.Itoa(n)
+					var th thermostat
+					if code, err := sendJSONRequest("POST", s.url+"/v1/thermostats", `{"name": "`+name+`"}`, &th); err != nil || code != http.StatusCreated {
+						return
+					}
+					writes.Lock()
+					writes.added[name] = th.ID
+					writes.Unlock()
+
+					for gen := 1; gen <= 5; gen++ {
+						if code, err := sendJSONRequest("PUT", s.url+"/v1/thermostats/"+strconv.Itoa(th.ID), genThermostat(gen), nil); err != nil || code != http.StatusOK {
+							return
+						}
+						writes.Lock()
+						writes.gens[th.ID] = gen
+						writes.Unlock()
+					}
+				}
+			}(w)
+		}
+
+		time.Sleep(time.Duration(200+100*round) * time.Millisecond)
+		s.kill()
+		wg.Wait()
+	}
+
+	s := startCrashServer(t, addr, walFile)
+	defer s.kill()
+	verifyCrashInvariants(t, s, writes)
+
+	writes.Lock()
+	defer writes.Unlock()
+	if len(writes.added) == 0 {
+		t.Fatal("expected the server to acknowledge some writes before being killed")
+	}
+}
+
+var errInjected = errors.New("injected storage error")
+
+// faultyFile fails every nth write, after writing half of the entry, and every nth flush to disk
+type faultyFile struct {
+	walFile
+	writes, failWrite int
+	syncs, failSync   int
+}
+
+// Write implements the walFile interface
+func (f *faultyFile) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes%f.failWrite == 0 {
+		n, _ := f.walFile.Write(p[:len(p)/2])
+		return n, errInjected
+	}
+	return f.walFile.Write(p)
+}
+
+// Sync implements the walFile interface
+func (f *faultyFile) Sync() error {
+	f.syncs++
+	if f.syncs%f.failSync == 0 {
+		return errInjected
+	}
+	return f.walFile.Sync()
+}
+
+func TestWALStorageErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	h := newWALHome()
+	h.thermostats[2] = &thermostat{ID: 2, Name: "gen-0", DisplayOrder: 2}
+	w, err := openWAL(path, 0, h)
+	if err != nil {
+		t.Fatalf("failed to open the write-ahead log: %s", err)
+	}
+	w.file = &faultyFile{walFile: w.file, failWrite: 3, failSync: 5}
+
+	var failures int
+	for gen := 1; gen <= 50; gen++ {
+		before, _ := h.Thermostat(1)
+
+		// change both thermostats at once, which must never be applied or recovered partly
+		err := w.Write(newChange(changeUpdate, []*thermostat{renamed(h, 1, "gen-"+strconv.Itoa(gen)), renamed(h, 2, "gen-"+strconv.Itoa(gen))}))
+		after, _ := h.Thermostat(1)
+		if err != nil {
+			failures++
+			if after != before {
+				t.Fatalf("generation %d was applied although it couldn't be logged", gen)
+			}
+		} else if after.Name != "gen-"+strconv.Itoa(gen) {
+			t.Fatalf("generation %d was logged but not applied, got %+v", gen, after)
+		}
+	}
+	if failures == 0 {
+		t.Fatal("expected some writes to fail")
+	}
+
+	recovered, _ := recoverHome(t, path)
+	for id := 1; id <= 2; id++ {
+		if recovered.thermostats[id].Name != h.thermostats[id].Name {
+			t.Fatalf("expected thermostat %d to recover as %s, got %s", id, h.thermostats[id].Name, recovered.thermostats[id].Name)
+		}
+	}
+}
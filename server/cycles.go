@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cycle is a single run of the equipment of a thermostat heating or cooling, returned through the api @
+// /v1/thermostats/:id/cycles. DegreesMoved is how far the temperature went in the direction of the mode,
+// so a cycle that heats or cools without effect shows up with none or less. The cycle still running has
+// no end, and its duration and degrees are those so far
+type cycle struct {
+	Mode         string     `json:"mode"`
+	Start        time.Time  `json:"start"`
+	End          *time.Time `json:"end,omitempty"`
+	Duration     string     `json:"duration"`
+	StartTemp    int        `json:"startTemp"`
+	EndTemp      int        `json:"endTemp"`
+	DegreesMoved int        `json:"degreesMoved"`
+}
+
+// finish settles the duration and the degrees moved of the cycle at the given record of its thermostat
+func (c *cycle) finish(t *thermostat, end time.Time) {
+	c.EndTemp = t.CurrentTemp
+	// the wall clock is used, so the duration matches the start and end that are returned
+	c.Duration = end.Round(0).Sub(c.Start.Round(0)).String()
+	c.DegreesMoved = c.EndTemp - c.StartTemp
+	if c.Mode == hvacCooling {
+		c.DegreesMoved = -c.DegreesMoved
+	}
+}
+
+// Cycles returns the heating and cooling cycles of the thermostat with the given id, oldest first. They are
+// derived from the transitions of its operating state in the journal, so only the cycles within the latest
+// -journal-size changes are known
+func (home *currentState) Cycles(id int) []cycle {
+	home.Lock()
+	defer home.Unlock()
+
+	cycles := []cycle{}
+	var running *cycle
+	next := func(t *thermostat) {
+		if t == nil || t.HVACSince == nil {
+			return
+		}
+		if running != nil && t.HVACState != running.Mode {
+			end := *t.HVACSince
+			running.End = &end
+			running.finish(t, end)
+			cycles = append(cycles, *running)
+			running = nil
+		}
+		if running == nil && (t.HVACState == hvacHeating || t.HVACState == hvacCooling) {
+			running = &cycle{Mode: t.HVACState, Start: *t.HVACSince, StartTemp: t.CurrentTemp}
+		}
+	}
+
+	next(home.journal.base[id])
+	for _, c := range home.journal.changes {
+		if c.Snapshot {
+			continue
+		}
+		for _, t := range c.Thermostats {
+			if t.ID == id {
+				next(t)
+			}
+		}
+	}
+	if running != nil {
+		running.finish(home.thermostats[id], clock.Now())
+		cycles = append(cycles, *running)
+	}
+
+	return cycles
+}
+
+// GetCycles is the handler to return the heating and cooling cycles of a thermostat, e.g. to diagnose
+// equipment that is short cycling
+func GetCycles(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, home.Cycles(t.ID))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetCycles(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.HVACMinOff = 0
+	})
+
+	target, _ := home.Thermostat(1)
+	target, _ = home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+	for _, temp := range []int{64, 66, 69, 70, 75, 73} {
+		target, _ = home.RecordTemp(target, temp)
+	}
+	target, _ = home.UpdateThermostat(target, updateThermostat{OperatingMode: "cool"})
+	home.RecordTemp(target, 76)
+
+	// the defaults start out heating until the first update, then it heats from 64 to 69 and cools from 76
+	var cycles []cycle
+	get(base+"/v1/thermostats/1/cycles", t, &cycles)
+	if len(cycles) != 3 {
+		t.Fatalf("expected 3 cycles, got %+v", cycles)
+	}
+	heat := cycles[1]
+	if heat.Mode != hvacHeating || heat.StartTemp != 64 || heat.EndTemp != 69 || heat.DegreesMoved != 5 || heat.End == nil {
+		t.Fatalf("expected a heating cycle from 64 to 69 degrees, got %+v", heat)
+	}
+	if d, err := time.ParseDuration(heat.Duration); err != nil || d != heat.End.Sub(heat.Start) {
+		t.Fatalf("expected the duration to run from start to end, got %s", heat.Duration)
+	}
+	if last := cycles[2]; last.Mode != hvacCooling || last.End != nil || last.StartTemp != 76 {
+		t.Fatalf("expected the cooling cycle to still be running, got %+v", last)
+	}
+
+	var none []cycle
+	get(base+"/v1/thermostats/"+strconv.Itoa(addThermostat(t, updateThermostat{}))+"/cycles", t, &none)
+	if none == nil || len(none) != 0 {
+		t.Fatalf("expected no cycles for a thermostat that never ran, got %+v", none)
+	}
+
+	resp, err := http.Get(base + "/v1/thermostats/999/cycles")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d for an unknown thermostat, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// deviceReport is the reading a thermostat device publishes on <prefix>/<id>/reported
+type deviceReport struct {
+	CurrentTemp int `json:"currentTemp"`
+}
+
+const (
+	// deviceOnline and deviceOffline are the payloads of <prefix>/<id>/status. Devices publish the offline
+	// status as their last will, so the broker sends it for them when they drop off
+	deviceOnline  = "online"
+	deviceOffline = "offline"
+)
+
+// RecordTemp records a new reading of the current temperature of the thermostat, which goes through the
+// safety limits and anomaly detection
+func (home *currentState) RecordTemp(target *thermostat, temp int) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	updated.PreviousTemp = target.CurrentTemp
+	updated.CurrentTemp = temp
+	safety := applySafetyLimits(target, &updated)
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeReading, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, &updated)
+	if safety != nil {
+		publishDetail(eventSafety, &updated, safety.Severity, safety.Detail)
+	}
+	publishHVAC(transitions)
+	anomalies.Observe(&updated)
+
+	return &updated, nil
+}
+
+// SetOffline marks the device of the thermostat as offline or back online, publishing an event when that
+// changes. The updates queued while it was offline are applied as it comes back
+func (home *currentState) SetOffline(target *thermostat, offline bool) (*thermostat, error) {
+	updated := *target
+	updated.Offline = offline
+	transitions, err := home.commit(changeOffline, &updated)
+	if err != nil {
+		return nil, err
+	}
+	publishHVAC(transitions)
+
+	if offline != target.Offline {
+		typ, severity, detail := eventOnline, severityInfo, "Thermostat "+strconv.Itoa(target.ID)+" is back online."
+		if offline {
+			typ, severity, detail = eventOffline, severityWarning, "Thermostat "+strconv.Itoa(target.ID)+" went offline."
+		}
+		publishDetail(typ, &updated, severity, detail)
+		if !offline {
+			return home.applyQueued(&updated)
+		}
+	}
+
+	return &updated, nil
+}
+
+// deviceBridge talks to the thermostat devices over mqtt. The desired state of every thermostat is
+// published, retained, on <prefix>/<id>/desired for its device to act on, while devices publish their
+// readings on <prefix>/<id>/reported and whether they are online on <prefix>/<id>/status
+type deviceBridge struct {
+	client  mqtt.Client
+	prefix  string
+	breaker *breaker
+}
+
+// newDeviceBridge connects to the mqtt broker the devices use, e.g. tcp://localhost:1883
+func newDeviceBridge(broker, clientID, prefix string) (*deviceBridge, error) {
+	d := &deviceBridge{
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		breaker: newBreaker("devices"),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("lost connection to the device broker with error:", err)
+		}).
+		SetOnConnectHandler(d.onConnect)
+
+	d.client = mqtt.NewClient(opts)
+	if err := waitIoT(d.client.Connect()); err != nil {
+		return nil, err
+	}
+	commands.register("devices")
+
+	return d, nil
+}
+
+// onConnect subscribes to the devices and publishes the desired state of every thermostat, so devices are
+// brought up to date after every (re)connect
+func (d *deviceBridge) onConnect(c mqtt.Client) {
+	if err := waitIoT(c.Subscribe(d.prefix+"/+/reported", 1, d.handleReported)); err != nil {
+		log.Println("failed to subscribe to device readings with error:", err)
+	}
+	if err := waitIoT(c.Subscribe(d.prefix+"/+/status", 1, d.handleStatus)); err != nil {
+		log.Println("failed to subscribe to device status with error:", err)
+	}
+
+	for _, t := range home.Thermostats() {
+		d.send(t)
+	}
+}
+
+// send queues the thermostat as the desired state of its device, which is retried until the broker takes it
+func (d *deviceBridge) send(t *thermostat) {
+	sendCommand(d.breaker, t, "desired", func() error { return d.desire(t) })
+}
+
+// desire publishes the thermostat as the desired state of its device
+func (d *deviceBridge) desire(t *thermostat) error {
+	jsn, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return waitIoT(d.client.Publish(d.prefix+"/"+strconv.Itoa(t.ID)+"/desired", 1, true, jsn))
+}
+
+// Publish implements the publisher interface. Only changes affect what a device should be doing
+func (d *deviceBridge) Publish(e event) error {
+	if e.Type == eventChange {
+		d.send(e.Thermostat)
+	}
+	return nil
+}
+
+// device returns the thermostat the topic <prefix>/<id>/<kind> belongs to
+func (d *deviceBridge) device(topic string) (*thermostat, error) {
+	parts := strings.Split(strings.TrimPrefix(topic, d.prefix+"/"), "/")
+	if len(parts) != 2 {
+		return nil, errors.New("unexpected device topic " + topic)
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.New("unexpected device topic " + topic)
+	}
+
+	t, errRes := home.Thermostat(id)
+	if errRes != nil {
+		return nil, errors.New(errRes.Description)
+	}
+
+	return t, nil
+}
+
+// deviceAccepted reports whether messages from devices are applied right now. Like any other write they
+// are dropped while the service is read-only, and only the leader of a cluster applies them
+func deviceAccepted() bool {
+	if !cluster.IsLeader() {
+		return false
+	}
+	if errRes := checkReadOnly(); errRes != nil {
+		return false
+	}
+
+	return true
+}
+
+// handleReported records the temperature a device read
+func (d *deviceBridge) handleReported(_ mqtt.Client, msg mqtt.Message) {
+	if !deviceAccepted() {
+		return
+	}
+
+	target, err := d.device(msg.Topic())
+	if err != nil {
+		log.Println("ignoring device reading -", err)
+		return
+	}
+
+	debugln(subsystemDrivers, "device reading", string(msg.Payload()), "for thermostat", target.ID)
+	var report deviceReport
+	if err := json.Unmarshal(msg.Payload(), &report); err != nil {
+		log.Println("failed to unmarshal device reading for thermostat", target.ID, "with error:", err)
+		return
+	}
+	if report.CurrentTemp == target.CurrentTemp {
+		return
+	}
+
+	_, err = retryChanged(target, func(current *thermostat) (*thermostat, error) {
+		return home.RecordTemp(current, report.CurrentTemp)
+	})
+	if err != nil {
+		log.Println("failed to record the device reading of thermostat", target.ID, "with error:", err)
+	}
+}
+
+// handleStatus marks the thermostat offline or online as its device comes and goes
+func (d *deviceBridge) handleStatus(_ mqtt.Client, msg mqtt.Message) {
+	if !deviceAccepted() {
+		return
+	}
+
+	target, err := d.device(msg.Topic())
+	if err != nil {
+		log.Println("ignoring device status -", err)
+		return
+	}
+
+	var offline bool
+	switch string(msg.Payload()) {
+	case deviceOnline:
+	case deviceOffline:
+		offline = true
+	default:
+		log.Println("ignoring unknown status", string(msg.Payload()), "of the device of thermostat", target.ID)
+		return
+	}
+	_, err = retryChanged(target, func(current *thermostat) (*thermostat, error) {
+		return home.SetOffline(current, offline)
+	})
+	if err != nil {
+		log.Println("failed to record the device status of thermostat", target.ID, "with error:", err)
+	}
+}
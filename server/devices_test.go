@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// deviceMessage is a message a device published to the broker
+type deviceMessage struct {
+	topic   string
+	payload string
+}
+
+func (m deviceMessage) Duplicate() bool   { return false }
+func (m deviceMessage) Qos() byte         { return 1 }
+func (m deviceMessage) Retained() bool    { return false }
+func (m deviceMessage) Topic() string     { return m.topic }
+func (m deviceMessage) MessageID() uint16 { return 0 }
+func (m deviceMessage) Payload() []byte   { return []byte(m.payload) }
+func (m deviceMessage) Ack()              {}
+
+func TestDeviceReadings(t *testing.T) {
+	d := &deviceBridge{prefix: "thermostats/devices"}
+	id, _ := home.AddThermostat(updateThermostat{Name: "Greenhouse Thermostat"})
+	topic := "thermostats/devices/" + strconv.Itoa(id)
+
+	d.handleReported(nil, deviceMessage{topic + "/reported", `{"currentTemp": 76}`})
+	th, _ := home.Thermostat(id)
+	if th.CurrentTemp != 76 || th.PreviousTemp != 71 {
+		t.Fatalf("expected the reading to be recorded, got %+v", th)
+	}
+
+	d.handleStatus(nil, deviceMessage{topic + "/status", deviceOffline})
+	if th, _ := home.Thermostat(id); !th.Offline {
+		t.Fatalf("expected the thermostat to go offline with its device, got %+v", th)
+	}
+	d.handleStatus(nil, deviceMessage{topic + "/status", deviceOnline})
+	if th, _ := home.Thermostat(id); th.Offline {
+		t.Fatalf("expected the thermostat to come back online with its device, got %+v", th)
+	}
+
+	// readings for thermostats that don't exist are ignored
+	d.handleReported(nil, deviceMessage{"thermostats/devices/99999/reported", `{"currentTemp": 76}`})
+	if _, errRes := home.Thermostat(99999); errRes == nil {
+		t.Fatal("expected a reading for an unknown thermostat not to add it")
+	}
+}
+
+func TestDeviceReadingKeepsChanges(t *testing.T) {
+	id, _ := home.AddThermostat(updateThermostat{Name: "Attic Thermostat", OperatingMode: "heat", HeatSetPoint: 72, CoolSetPoint: 76})
+	read, _ := home.Thermostat(id)
+
+	// the setpoint is changed after the reading's thermostat was read, so the stale copy can't be committed
+	current, _ := home.Thermostat(id)
+	if _, err := home.UpdateThermostat(current, updateThermostat{HeatSetPoint: 60}); err != nil {
+		t.Fatalf("failed to change the setpoint: %s", err)
+	}
+	if _, err := home.RecordTemp(read, 75); err != errThermostatChanged {
+		t.Fatalf("expected a stale reading to be rejected, got %v", err)
+	}
+
+	// devices record it again on the current thermostat instead
+	d := &deviceBridge{prefix: "thermostats/devices"}
+	d.handleReported(nil, deviceMessage{"thermostats/devices/" + strconv.Itoa(id) + "/reported", `{"currentTemp": 75}`})
+	if th, _ := home.Thermostat(id); th.CurrentTemp != 75 || th.HeatSetPoint != 60 {
+		t.Fatalf("expected the reading to be recorded keeping the setpoint, got %+v", th)
+	}
+	if _, err := retryChanged(read, func(current *thermostat) (*thermostat, error) {
+		return home.RecordTemp(current, 74)
+	}); err != nil {
+		t.Fatalf("expected the reading to be recorded on the current thermostat, got %v", err)
+	}
+	if th, _ := home.Thermostat(id); th.CurrentTemp != 74 || th.HeatSetPoint != 60 {
+		t.Fatalf("expected the stale reading to be recorded keeping the setpoint, got %+v", th)
+	}
+}
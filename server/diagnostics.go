@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maxLogLines is how many of the most recent log lines are kept for the diagnostics bundle
+const maxLogLines = 1000
+
+// logRing keeps the most recent lines written to the log, for the diagnostics bundle
+type logRing struct {
+	sync.Mutex
+	lines []string
+}
+
+var recentLogs = &logRing{}
+
+func init() {
+	// the log still goes to stderr, it's only copied
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+}
+
+// Write keeps the lines written, forgetting the oldest beyond maxLogLines. The log writes a line at a time
+func (l *logRing) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.lines = append(l.lines, strings.TrimRight(string(p), "\n"))
+	if len(l.lines) > maxLogLines {
+		l.lines = l.lines[len(l.lines)-maxLogLines:]
+	}
+	return len(p), nil
+}
+
+// Lines returns the lines kept, oldest first
+func (l *logRing) Lines() []string {
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
+
+// storeStats counts what the stores behind the api hold, and what the runtime does, for the diagnostics
+// bundle
+func storeStats() map[string]int {
+	count := func(l sync.Locker, n func() int) int {
+		l.Lock()
+		defer l.Unlock()
+		return n()
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return map[string]int{
+		"thermostats":        len(home.Thermostats()),
+		"actions":            count(actions, func() int { return len(actions.actions) }),
+		"alerts":             count(alerts, func() int { return len(alerts.alerts) }),
+		"suppressions":       count(alerts, func() int { return len(alerts.suppressions) }),
+		"deadLetters":        count(deadLetters, func() int { return len(deadLetters.letters) }),
+		"deliveries":         count(deliveryLog, func() int { return len(deliveryLog.records) }),
+		"deliveriesQueued":   len(deliveries),
+		"jobs":               count(jobs, func() int { return len(jobs.jobs) }),
+		"groups":             count(groups, func() int { return len(groups.settings) }),
+		"historyThermostats": count(history, func() int { return len(history.records) }),
+		"offlineThermostats": count(offlineWrites, func() int { return len(offlineWrites.queued) }),
+		"commandsPending": count(commands, func() int {
+			n := 0
+			for _, pending := range commands.pending {
+				n += len(pending)
+			}
+			return n
+		}),
+		"sessions":         count(&sessions, func() int { return len(sessions.byAccess) }),
+		"rpcSubscribers":   count(rpcSubscribers, func() int { return len(rpcSubscribers.subscribers) }),
+		"fleetSites":       count(fleet, func() int { return len(fleet.sites) }),
+		"auditEntries":     count(installers, func() int { return len(installers.audit) }),
+		"deletionReceipts": count(receipts, func() int { return len(receipts.receipts) }),
+		"goroutines":       runtime.NumGoroutine(),
+		"heapAllocBytes":   int(mem.HeapAlloc),
+	}
+}
+
+// writeDiagnostics writes the diagnostics bundle as a zip of the build, the effective configuration with
+// secrets redacted, the store stats, the recent log and a dump of every goroutine
+func writeDiagnostics(w io.Writer, now time.Time) error {
+	z := zip.NewWriter(w)
+	add := func(name string, write func(w io.Writer) error) error {
+		f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		return write(f)
+	}
+	addJSON := func(name string, v interface{}) error {
+		return add(name, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(v)
+		})
+	}
+
+	if err := addJSON("version.json", currentBuild(now)); err != nil {
+		return err
+	}
+	if err := addJSON("config.json", effectiveConfig(flag.CommandLine)); err != nil {
+		return err
+	}
+	if err := addJSON("stats.json", storeStats()); err != nil {
+		return err
+	}
+	if err := add("logs.txt", func(w io.Writer) error {
+		for _, line := range recentLogs.Lines() {
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := add("goroutines.txt", func(w io.Writer) error {
+		return pprof.Lookup("goroutine").WriteTo(w, 2)
+	}); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// GetDiagnostics is the handler to download the diagnostics bundle to attach to a support ticket. Handing
+// it out is recorded in the audit log
+func GetDiagnostics(req *fasthttp.RequestCtx) {
+	now := time.Now()
+
+	var b bytes.Buffer
+	if err := writeDiagnostics(&b, now); err != nil {
+		res := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to write the diagnostics bundle",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, res)
+		return
+	}
+	installers.Audit(auditEntry{Time: now, Username: requestUser(req), Role: roleAdmin, Method: string(req.Method()), Path: string(req.Path()), Status: http.StatusOK,
+		Detail: "downloaded the diagnostics bundle"})
+
+	req.Response.Header.Set("Content-Disposition", `attachment; filename="diagnostics-`+now.UTC().Format("20060102T150405Z")+`.zip"`)
+	req.Response.Header.Set("Cache-Control", "no-store")
+	req.SetContentType("application/zip")
+	req.SetStatusCode(http.StatusOK)
+	req.SetBody(b.Bytes())
+}
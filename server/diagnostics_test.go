@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	base := newTestServer(t)
+	log.Println("diagnostics test marker")
+
+	resp, err := http.Get(base + "/v1/admin/diagnostics")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" ||
+		!strings.HasPrefix(resp.Header.Get("Content-Disposition"), `attachment; filename="diagnostics-`) {
+		t.Fatalf("expected a zip to download, got %d %s", resp.StatusCode, resp.Header)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("failed to read the bundle: %s", err)
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", f.Name, err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+	}
+
+	var build buildInfo
+	if err := json.Unmarshal([]byte(files["version.json"]), &build); err != nil || build.GoVersion == "" {
+		t.Fatalf("expected the build, got %s (%v)", files["version.json"], err)
+	}
+	var stats map[string]int
+	if err := json.Unmarshal([]byte(files["stats.json"]), &stats); err != nil || stats["thermostats"] != 2 || stats["goroutines"] == 0 {
+		t.Fatalf("expected the store stats, got %s (%v)", files["stats.json"], err)
+	}
+	if !strings.Contains(files["config.json"], `"name": "addr"`) {
+		t.Fatalf("expected the configuration, got %s", files["config.json"])
+	}
+	if !strings.Contains(files["logs.txt"], "diagnostics test marker") {
+		t.Fatal("expected the recent log")
+	}
+	if !strings.Contains(files["goroutines.txt"], "goroutine ") {
+		t.Fatal("expected a goroutine dump")
+	}
+
+	if audit := installers.AuditLog("", roleAdmin); len(audit) != 1 || audit[0].Path != "/v1/admin/diagnostics" {
+		t.Fatalf("expected the download to be audited, got %+v", audit)
+	}
+}
+
+func TestLogRing(t *testing.T) {
+	var l logRing
+	for i := 0; i < maxLogLines+5; i++ {
+		l.Write([]byte("line\n"))
+	}
+	if lines := l.Lines(); len(lines) != maxLogLines || lines[0] != "line" {
+		t.Fatalf("expected the last %d lines, got %d", maxLogLines, len(lines))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// enabledRequest is the body sent in through the api @ /v1/thermostats/:id/enabled
+type enabledRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// checkDisabled returns the error updates to the setpoints, operating mode or fan mode of a disabled
+// thermostat are rejected with. Renaming a disabled thermostat is still allowed
+func checkDisabled(t *thermostat, desired updateThermostat) *errResponse {
+	if !t.Disabled {
+		return nil
+	}
+
+	if desired.OperatingMode == "" && desired.FanMode == "" && desired.CoolSetPoint == 0 && desired.HeatSetPoint == 0 {
+		return nil
+	}
+
+	return &errResponse{
+		Code:        http.StatusConflict,
+		Msg:         "Thermostat Disabled",
+		Description: "Thermostat " + strconv.Itoa(t.ID) + " is disabled. Its setpoints, operating mode and fan mode can't be changed until it is enabled again.",
+	}
+}
+
+// activeThermostats filters out the disabled thermostats, which are left out of any reporting
+func activeThermostats(therms []*thermostat) []*thermostat {
+	var active []*thermostat
+	for _, t := range therms {
+		if !t.Disabled {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+// SetEnabled enables or disables the thermostat
+func (home *currentState) SetEnabled(target *thermostat, enabled bool) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	updated.Disabled = !enabled
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeEnabled, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, &updated)
+	publishHVAC(transitions)
+
+	return &updated, nil
+}
+
+// PutEnabled is the handler to enable or disable a specific thermostat
+func PutEnabled(req *fasthttp.RequestCtx) {
+	var body enabledRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	updated, err := home.SetEnabled(target, body.Enabled)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestDisabledThermostat(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/" + strconv.Itoa(addThermostat(t, updateThermostat{Name: "Garage Thermostat"}))
+
+	if code := put(url+"/enabled", `{"enabled": false}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d disabling the thermostat, got %d", http.StatusOK, code)
+	}
+
+	if code := put(url, `{"mode": "heat"}`, t); code != http.StatusConflict {
+		t.Fatalf("expected status %d changing the mode of a disabled thermostat, got %d", http.StatusConflict, code)
+	}
+	if code := put(url, `{"name": "Old Garage Thermostat"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d renaming a disabled thermostat, got %d", http.StatusOK, code)
+	}
+
+	var th *thermostat
+	get(url, t, &th)
+	if !th.Disabled || th.Name != "Old Garage Thermostat" {
+		t.Fatalf("expected the renamed thermostat to stay disabled, got %+v", th)
+	}
+	for _, active := range activeThermostats(home.Thermostats()) {
+		if active.ID == th.ID {
+			t.Fatal("expected the disabled thermostat to be left out of reports")
+		}
+	}
+
+	if code := put(url+"/enabled", `{"enabled": true}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d enabling the thermostat, got %d", http.StatusOK, code)
+	}
+	if code := put(url, `{"mode": "heat"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d changing the mode of an enabled thermostat, got %d", http.StatusOK, code)
+	}
+}
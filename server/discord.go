@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// channelDiscord posts the notification as a message to a discord incoming webhook
+const channelDiscord = "discord"
+
+const (
+	// discord interaction types and the types of the responses to them
+	discordPing               = 1
+	discordApplicationCommand = 2
+	discordPong               = 1
+	discordMessage            = 4
+
+	// discordEphemeral only shows the reply to the user who sent the command
+	discordEphemeral = 64
+)
+
+// discordInteraction is what discord posts to the interactions endpoint @ /v1/chat/discord for every slash
+// command. The user is the member in a server and the user in a direct message
+type discordInteraction struct {
+	Type int `json:"type"`
+	Data struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+	} `json:"data"`
+	Member *struct {
+		User discordUser `json:"user"`
+	} `json:"member"`
+	User *discordUser `json:"user"`
+}
+
+// discordUser is the discord account that sent an interaction
+type discordUser struct {
+	ID string `json:"id"`
+}
+
+// discordResponse is the response to an interaction
+type discordResponse struct {
+	Type int                  `json:"type"`
+	Data *discordResponseData `json:"data,omitempty"`
+}
+
+// discordResponseData is the message replied to an interaction
+type discordResponseData struct {
+	Content string `json:"content"`
+	Flags   int    `json:"flags,omitempty"`
+}
+
+// command rebuilds the slash command as the text of a chat command, e.g. /set upstairs 72
+func (i discordInteraction) command() string {
+	words := []string{"/" + i.Data.Name}
+	for _, o := range i.Data.Options {
+		var s string
+		if err := json.Unmarshal(o.Value, &s); err != nil {
+			s = string(o.Value)
+		}
+		words = append(words, s)
+	}
+	return strings.Join(words, " ")
+}
+
+// discordKey decodes the hex public key of a discord application
+func discordKey(s string) (ed25519.PublicKey, bool) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(key), true
+}
+
+// verifyDiscord checks the signature discord signs every interaction with using the public key of the
+// application
+func verifyDiscord(req *fasthttp.RequestCtx) bool {
+	key, ok := discordKey(cfg.DiscordPublicKey)
+	if !ok {
+		return false
+	}
+	sig, err := hex.DecodeString(string(req.Request.Header.Peek("X-Signature-Ed25519")))
+	if err != nil {
+		return false
+	}
+	signed := append(append([]byte{}, req.Request.Header.Peek("X-Signature-Timestamp")...), req.PostBody()...)
+	return ed25519.Verify(key, signed, sig)
+}
+
+// sendDiscord posts the notification to the discord incoming webhook of the channel, returning the status
+// discord responded with
+func (ch notificationChannel) sendDiscord(n notification) (int, error) {
+	jsn, err := json.Marshal(discordResponseData{Content: chatText(n)})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := notifyClient.Post(ch.URL, "application/json", bytes.NewReader(jsn))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, errors.New("discord responded with " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// PostDiscord is the handler of the interactions endpoint discord posts the slash commands of the bot to.
+// Only commands of discord accounts linked to an api user are acted on, as that user
+func PostDiscord(req *fasthttp.RequestCtx) {
+	req.SetContentType("application/json")
+	if cfg.DiscordPublicKey == "" {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "The discord bot isn't configured, see -discord-public-key.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+	if !verifyDiscord(req) {
+		req.SetStatusCode(http.StatusUnauthorized)
+		sendJSON(req, unauthorized("The interaction isn't signed by the key of -discord-public-key."))
+		return
+	}
+
+	var interaction discordInteraction
+	if err := json.Unmarshal(req.PostBody(), &interaction); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	if interaction.Type == discordPing {
+		sendJSON(req, discordResponse{Type: discordPong})
+		return
+	}
+	if interaction.Type != discordApplicationCommand {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Unsupported Interaction",
+			Description: "Only slash commands are supported.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	from := discordUser{}
+	if interaction.Member != nil {
+		from = interaction.Member.User
+	} else if interaction.User != nil {
+		from = *interaction.User
+	}
+	reply := chatUnlinked(channelDiscord, from.ID)
+	if username, ok := sessions.ChatUser(channelDiscord, from.ID); ok {
+		reply = runChatCommand(username, interaction.command())
+	}
+	sendJSON(req, discordResponse{Type: discordMessage, Data: &discordResponseData{Content: reply, Flags: discordEphemeral}})
+}
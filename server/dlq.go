@@ -0,0 +1,336 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// the kinds of dead letters, an event a publisher failed to take or a notification a channel failed to
+	// take
+	deadLetterEvent        = "event"
+	deadLetterNotification = "notification"
+
+	// maxDeadLetters is how many dead letters are kept, the oldest being dropped first
+	maxDeadLetters = 1000
+)
+
+// deadLetter is an event or a notification that couldn't be delivered after every retry, returned through
+// the api @ /v1/admin/dlq. The target is the publisher the event was for, e.g. kafka or devices, or the type
+// of channel the notification was for
+type deadLetter struct {
+	ID           int           `json:"id"`
+	Kind         string        `json:"kind"`
+	Target       string        `json:"target"`
+	Event        *event        `json:"event,omitempty"`
+	Notification *notification `json:"notification,omitempty"`
+	Error        string        `json:"error"`
+	Attempts     int           `json:"attempts"`
+	FailedAt     time.Time     `json:"failedAt"`
+
+	// what the dead letter is redriven through
+	publisher publisher
+	delivery  delivery
+}
+
+// deadLetterStore holds the latest dead letters, by id
+type deadLetterStore struct {
+	sync.Mutex
+	letters []*deadLetter
+	lastID  int
+}
+
+var deadLetters = &deadLetterStore{}
+
+// deliveryPolicy returns the retry policy of events and notifications of the configuration. The dispatcher
+// and the deliveries are handed it as they start, as they run alongside the next server setting up its own
+func deliveryPolicy(c config) retryPolicy {
+	return retryPolicy{Attempts: c.DeliveryAttempts, Base: c.DeliveryRetryBase, Max: c.DeliveryRetryMax}
+}
+
+// publisherName returns the name a publisher goes by in the dead letter queue
+func publisherName(p publisher) string {
+	switch p := p.(type) {
+	case guardedPublisher:
+		return p.breaker.cb.Name()
+	case *shadowSync:
+		return "aws-iot"
+	case *deviceBridge:
+		return "devices"
+	case *rpcHub:
+		return "rpc"
+	case *iftttFeed:
+		return "ifttt"
+	}
+	return "publisher"
+}
+
+// publishWithRetry hands the event to the publisher, retrying as the policy of -delivery-attempts says. An
+// event that fails every attempt lands in the dead letter queue. Retries stop early once the breaker of the
+// publisher is open, as it would only turn them away, or once stop is closed
+func publishWithRetry(p publisher, e event, policy retryPolicy, stop <-chan struct{}) {
+	var err error
+	attempts := 0
+	for attempts < policy.Attempts {
+		attempts++
+		if err = p.Publish(e); err == nil {
+			return
+		}
+		if gp, ok := p.(guardedPublisher); ok && gp.breaker.cb.State() == gobreaker.StateOpen {
+			break
+		}
+		if attempts == policy.Attempts {
+			break
+		}
+		select {
+		case <-time.After(policy.backoff(attempts)):
+			continue
+		case <-stop:
+		}
+		break
+	}
+
+	log.Println("failed to publish", e.Type, "event for thermostat", e.ID, "to", publisherName(p), "after", attempts, "attempts with error:", err)
+	deadLetters.add(&deadLetter{
+		Kind:      deadLetterEvent,
+		Target:    publisherName(p),
+		Event:     &e,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		publisher: p,
+	})
+}
+
+// reset empties the queue
+func (s *deadLetterStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.letters = nil
+	s.lastID = 0
+}
+
+// add puts the dead letter in the queue, failed now
+func (s *deadLetterStore) add(l *deadLetter) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastID++
+	l.ID = s.lastID
+	l.FailedAt = time.Now()
+	s.letters = append(s.letters, l)
+	if len(s.letters) > maxDeadLetters {
+		s.letters = s.letters[len(s.letters)-maxDeadLetters:]
+	}
+}
+
+// List returns the dead letters, oldest first, only those for the target if one is given
+func (s *deadLetterStore) List(target string) []deadLetter {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []deadLetter{}
+	for _, l := range s.letters {
+		if target == "" || l.Target == target {
+			list = append(list, *l)
+		}
+	}
+	return list
+}
+
+// find returns the index of the dead letter, or -1. The lock must be held
+func (s *deadLetterStore) find(id int) int {
+	for i, l := range s.letters {
+		if l.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// notFound is the error for a dead letter that isn't in the queue
+func (s *deadLetterStore) notFound(id int) *errResponse {
+	return &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "Dead letter " + strconv.Itoa(id) + " isn't in the queue, it was redriven, removed or never existed.",
+	}
+}
+
+// Letter returns the dead letter
+func (s *deadLetterStore) Letter(id int) (deadLetter, *errResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	i := s.find(id)
+	if i < 0 {
+		return deadLetter{}, s.notFound(id)
+	}
+	return *s.letters[i], nil
+}
+
+// Remove drops the dead letter from the queue
+func (s *deadLetterStore) Remove(id int) *errResponse {
+	s.Lock()
+	defer s.Unlock()
+
+	i := s.find(id)
+	if i < 0 {
+		return s.notFound(id)
+	}
+	s.letters = append(s.letters[:i], s.letters[i+1:]...)
+	return nil
+}
+
+// Purge drops every dead letter, or only those for the target if one is given, returning how many were
+// dropped
+func (s *deadLetterStore) Purge(target string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.letters[:0]
+	for _, l := range s.letters {
+		if target != "" && l.Target != target {
+			kept = append(kept, l)
+		}
+	}
+	purged := len(s.letters) - len(kept)
+	s.letters = kept
+	return purged
+}
+
+// PurgeNotifications drops the dead-lettered notifications to the user, or to every user when empty, that
+// failed before the given time, or every one of them when it's zero, and returns how many were dropped
+func (s *deadLetterStore) PurgeNotifications(username string, before time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.letters[:0]
+	for _, l := range s.letters {
+		if l.Kind == deadLetterNotification && (username == "" || l.Notification != nil && l.Notification.Username == username) &&
+			(before.IsZero() || l.FailedAt.Before(before)) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	purged := len(s.letters) - len(kept)
+	s.letters = kept
+	return purged
+}
+
+// Redrive delivers the dead letter again, taking it out of the queue. An event is published there and then,
+// staying in the queue if it fails again, while a notification is queued for delivery with a fresh round of
+// retries and lands back in the queue as a new dead letter if they all fail. It returns whether the dead
+// letter was delivered rather than queued
+func (s *deadLetterStore) Redrive(id int) (bool, *errResponse) {
+	l, errRes := s.Letter(id)
+	if errRes != nil {
+		return false, errRes
+	}
+
+	if l.Kind == deadLetterNotification {
+		d := l.delivery
+		d.attempt = 0
+		select {
+		case deliveries <- d:
+		default:
+			return false, &errResponse{
+				Code:        http.StatusServiceUnavailable,
+				Msg:         "Service Unavailable",
+				Description: "The delivery queue is full, try again later.",
+			}
+		}
+		s.Remove(id)
+		return false, nil
+	}
+
+	if err := l.publisher.Publish(*l.Event); err != nil {
+		s.Lock()
+		if i := s.find(id); i >= 0 {
+			s.letters[i].Attempts++
+			s.letters[i].Error = err.Error()
+			s.letters[i].FailedAt = time.Now()
+		}
+		s.Unlock()
+		return false, &errResponse{
+			Code:        http.StatusBadGateway,
+			Msg:         "Bad Gateway",
+			Description: "Publishing to " + l.Target + " failed again with error: " + err.Error(),
+		}
+	}
+	s.Remove(id)
+	return true, nil
+}
+
+// GetDeadLetters is the handler to return the dead letter queue, with ?target= for the dead letters of a
+// single publisher or type of channel
+func GetDeadLetters(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, deadLetters.List(string(req.QueryArgs().Peek("target"))))
+}
+
+// GetDeadLetter is the handler to return a single dead letter
+func GetDeadLetter(req *fasthttp.RequestCtx) {
+	id, errRes := paramID(req, "letter")
+	var l deadLetter
+	if errRes == nil {
+		l, errRes = deadLetters.Letter(id)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, l)
+}
+
+// PostRedrive is the handler to deliver a dead letter again. It responds with 204 once an event is
+// published, and with 202 once a notification is queued for delivery
+func PostRedrive(req *fasthttp.RequestCtx) {
+	id, errRes := paramID(req, "letter")
+	delivered := false
+	if errRes == nil {
+		delivered, errRes = deadLetters.Redrive(id)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	if delivered {
+		req.SetStatusCode(http.StatusNoContent)
+		return
+	}
+	req.SetStatusCode(http.StatusAccepted)
+}
+
+// DeleteDeadLetter is the handler to drop a dead letter without delivering it
+func DeleteDeadLetter(req *fasthttp.RequestCtx) {
+	id, errRes := paramID(req, "letter")
+	if errRes == nil {
+		errRes = deadLetters.Remove(id)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusNoContent)
+}
+
+// DeleteDeadLetters is the handler to empty the dead letter queue, or only drop the dead letters of
+// ?target=, responding with how many were dropped
+func DeleteDeadLetters(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, map[string]int{"purged": deadLetters.Purge(string(req.QueryArgs().Peek("target")))})
+}
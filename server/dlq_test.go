@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyPublisher fails every event while it's down, counting the attempts
+type flakyPublisher struct {
+	down  int32
+	calls int32
+}
+
+func (p *flakyPublisher) Publish(e event) error {
+	atomic.AddInt32(&p.calls, 1)
+	if atomic.LoadInt32(&p.down) == 1 {
+		return errors.New("upstream unavailable")
+	}
+	return nil
+}
+
+// waitDeadLetters polls the dead letter queue until it holds n dead letters
+func waitDeadLetters(base string, n int, t *testing.T) []deadLetter {
+	var list []deadLetter
+	for i := 0; i < 200; i++ {
+		get(base+"/v1/admin/dlq", t, &list)
+		if len(list) == n {
+			return list
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d dead letters, got %+v", n, list)
+	return nil
+}
+
+func TestDeadLetterEvents(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.DeliveryAttempts = 3
+		c.DeliveryRetryBase = time.Millisecond
+	})
+
+	upstream := &flakyPublisher{down: 1}
+	saved := publishers.List()
+	publishers.Set(append(saved[:len(saved):len(saved)], upstream))
+	defer publishers.Set(saved)
+
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventAnomaly, t1, severityWarning, "Temperature jumped.")
+	list := waitDeadLetters(base, 1, t)
+	l := list[0]
+	if l.Kind != deadLetterEvent || l.Target != "publisher" || l.Attempts != 3 || l.Event == nil || l.Event.Type != eventAnomaly || l.Error == "" {
+		t.Fatalf("expected the anomaly event after 3 attempts, got %+v", l)
+	}
+	if calls := atomic.LoadInt32(&upstream.calls); calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+
+	// redriving fails while the upstream is still down, and keeps the dead letter
+	url := base + "/v1/admin/dlq/" + strconv.Itoa(l.ID)
+	if code := postJSON(url+"/redrive", "", t, nil); code != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, code)
+	}
+	get(url, t, &l)
+	if l.Attempts != 4 {
+		t.Fatalf("expected the failed redrive to count as an attempt, got %+v", l)
+	}
+
+	atomic.StoreInt32(&upstream.down, 0)
+	if code := postJSON(url+"/redrive", "", t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+	waitDeadLetters(base, 0, t)
+	if code := postJSON(url+"/redrive", "", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for a redriven dead letter, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestDeadLetterNotifications(t *testing.T) {
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hook.Close()
+
+	base := newTestServer(t, func(c *config) {
+		c.DeliveryAttempts = 2
+		c.DeliveryRetryBase = time.Millisecond
+	})
+	if code, _ := putNotifications(base, "frank", `{"channels": [{"type": "webhook", "url": "`+hook.URL+`"}]}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventOffline, t1, severityWarning, "Thermostat 1 went offline.")
+	list := waitDeadLetters(base, 1, t)
+	l := list[0]
+	if l.Kind != deadLetterNotification || l.Target != channelWebhook || l.Attempts != 2 || l.Notification == nil || l.Notification.Username != "frank" {
+		t.Fatalf("expected the alert notification after 2 attempts, got %+v", l)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls)
+	}
+
+	// a redriven notification gets a fresh round of retries and comes back as a new dead letter
+	if code := postJSON(base+"/v1/admin/dlq/"+strconv.Itoa(l.ID)+"/redrive", "", t, nil); code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, code)
+	}
+	for i := 0; i < 200 && atomic.LoadInt32(&calls) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	list = waitDeadLetters(base, 1, t)
+	if list[0].ID == l.ID {
+		t.Fatalf("expected a new dead letter, got %+v", list[0])
+	}
+
+	var empty []deadLetter
+	get(base+"/v1/admin/dlq?target=kafka", t, &empty)
+	if len(empty) != 0 {
+		t.Fatalf("expected no dead letters for kafka, got %+v", empty)
+	}
+	if code := del(base+"/v1/admin/dlq/"+strconv.Itoa(list[0].ID), t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+	if code := del(base+"/v1/admin/dlq/"+strconv.Itoa(list[0].ID), t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, code)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// equipmentWeek is the span the recovery of this week is compared to the week before over
+	equipmentWeek = 7 * 24 * time.Hour
+
+	// equipmentMinCycles is how many finished cycles each week needs for the weeks to be compared
+	equipmentMinCycles = 3
+)
+
+// recoveryStats describe how quickly the equipment of a thermostat brought the temperature to the setpoint
+// over a week, from the cycles that finished within it
+type recoveryStats struct {
+	Cycles           int     `json:"cycles"`
+	AverageDuration  string  `json:"averageDuration"`
+	MinutesPerDegree float64 `json:"minutesPerDegree"`
+}
+
+// equipmentHealth is the analysis of the equipment of a thermostat, returned through the api @
+// /v1/thermostats/:id/equipment. The equipment is degrading when a cycle took at least -equipment-degradation
+// percent more minutes per degree moved this week than the week before, and stuck when the current cycle has
+// been running for longer than -equipment-max-cycle without reaching the setpoint
+type equipmentHealth struct {
+	ThermostatID int           `json:"thermostatId"`
+	AnalyzedAt   time.Time     `json:"analyzedAt"`
+	ThisWeek     recoveryStats `json:"thisWeek"`
+	LastWeek     recoveryStats `json:"lastWeek"`
+	Degradation  *float64      `json:"degradationPercent,omitempty"`
+	Running      *cycle        `json:"running,omitempty"`
+	Issues       []string      `json:"issues"`
+}
+
+// recovery sums up the finished cycles that started within the week from the given time
+func recovery(cycles []cycle, from time.Time) recoveryStats {
+	var stats recoveryStats
+	var total time.Duration
+	var degrees int
+	for _, c := range cycles {
+		if c.End == nil || c.Start.Before(from) || !c.Start.Before(from.Add(equipmentWeek)) {
+			continue
+		}
+		stats.Cycles++
+		total += c.End.Sub(c.Start)
+		degrees += c.DegreesMoved
+	}
+	if stats.Cycles == 0 {
+		stats.AverageDuration = time.Duration(0).String()
+		return stats
+	}
+
+	stats.AverageDuration = (total / time.Duration(stats.Cycles)).Round(time.Second).String()
+	if degrees > 0 {
+		stats.MinutesPerDegree = math.Round(total.Minutes()/float64(degrees)*10) / 10
+	}
+	return stats
+}
+
+// analyzeEquipment looks for signs of failing equipment in the cycles of the thermostat up until now
+func analyzeEquipment(id int, cycles []cycle, now time.Time) equipmentHealth {
+	h := equipmentHealth{
+		ThermostatID: id,
+		AnalyzedAt:   now,
+		ThisWeek:     recovery(cycles, now.Add(-equipmentWeek)),
+		LastWeek:     recovery(cycles, now.Add(-2*equipmentWeek)),
+		Issues:       []string{},
+	}
+
+	if h.ThisWeek.Cycles >= equipmentMinCycles && h.LastWeek.Cycles >= equipmentMinCycles && h.LastWeek.MinutesPerDegree > 0 {
+		degradation := math.Round((h.ThisWeek.MinutesPerDegree/h.LastWeek.MinutesPerDegree-1)*1000) / 10
+		h.Degradation = &degradation
+		if cfg.EquipmentDegradation > 0 && degradation >= float64(cfg.EquipmentDegradation) {
+			h.Issues = append(h.Issues, "Reaching the setpoint took "+strconv.FormatFloat(h.ThisWeek.MinutesPerDegree, 'f', -1, 64)+
+				" minutes per degree this week, up "+strconv.FormatFloat(degradation, 'f', -1, 64)+"% from "+
+				strconv.FormatFloat(h.LastWeek.MinutesPerDegree, 'f', -1, 64)+" the week before.")
+		}
+	}
+
+	if n := len(cycles); n > 0 && cycles[n-1].End == nil {
+		running := cycles[n-1]
+		h.Running = &running
+		if ran := now.Sub(running.Start); cfg.EquipmentMaxCycle > 0 && ran > cfg.EquipmentMaxCycle {
+			h.Issues = append(h.Issues, "The equipment has been "+running.Mode+" for "+ran.Round(time.Minute).String()+
+				" without reaching the setpoint, moving the temperature "+strconv.Itoa(running.DegreesMoved)+" degrees.")
+		}
+	}
+
+	return h
+}
+
+// analyzeAllEquipment raises an equipment alert on every enabled thermostat whose equipment shows signs of
+// failing every interval until stop is closed. In a cluster only the leader analyzes the equipment
+func analyzeAllEquipment(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !cluster.IsLeader() {
+			continue
+		}
+		for _, t := range activeThermostats(home.Thermostats()) {
+			checkEquipment(t, clock.Now())
+		}
+	}
+}
+
+// checkEquipment analyzes the equipment of the thermostat, raising an alert with the findings if there
+// are any
+func checkEquipment(t *thermostat, now time.Time) {
+	h := analyzeEquipment(t.ID, home.Cycles(t.ID), now)
+	if len(h.Issues) == 0 {
+		return
+	}
+
+	detail := "Possible equipment issue."
+	for _, issue := range h.Issues {
+		detail += " " + issue
+	}
+	log.Println("possible equipment issue on thermostat", t.ID, "-", detail)
+	publishDetail(eventEquipment, t, severityWarning, detail)
+}
+
+// GetEquipment is the handler to return the analysis of the equipment of a thermostat, with the recovery
+// times an equipment alert is based on
+func GetEquipment(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, analyzeEquipment(t.ID, home.Cycles(t.ID), clock.Now()))
+}
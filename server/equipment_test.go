@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// heatingCycles returns count finished heating cycles starting at the given time, an hour apart, each
+// taking the given time to move the temperature 2 degrees
+func heatingCycles(start time.Time, count int, took time.Duration) []cycle {
+	var cycles []cycle
+	for i := 0; i < count; i++ {
+		s := start.Add(time.Duration(i) * time.Hour)
+		end := s.Add(took)
+		cycles = append(cycles, cycle{Mode: hvacHeating, Start: s, End: &end, StartTemp: 66, EndTemp: 68, DegreesMoved: 2})
+	}
+	return cycles
+}
+
+func TestAnalyzeEquipment(t *testing.T) {
+	newTestServer(t, func(c *config) {
+		c.EquipmentDegradation = 25
+		c.EquipmentMaxCycle = 2 * time.Hour
+	})
+	now := time.Now()
+
+	// the same recovery both weeks is healthy
+	cycles := append(heatingCycles(now.Add(-10*24*time.Hour), 3, 20*time.Minute), heatingCycles(now.Add(-3*24*time.Hour), 3, 20*time.Minute)...)
+	h := analyzeEquipment(1, cycles, now)
+	if len(h.Issues) != 0 || h.Degradation == nil || *h.Degradation != 0 || h.ThisWeek.MinutesPerDegree != 10 {
+		t.Fatalf("expected healthy equipment, got %+v", h)
+	}
+
+	// taking half as long again to heat this week is degrading, and so is running for 3 hours
+	cycles = append(heatingCycles(now.Add(-10*24*time.Hour), 3, 20*time.Minute), heatingCycles(now.Add(-3*24*time.Hour), 3, 30*time.Minute)...)
+	cycles = append(cycles, cycle{Mode: hvacHeating, Start: now.Add(-3 * time.Hour), StartTemp: 60, EndTemp: 61, DegreesMoved: 1})
+	h = analyzeEquipment(1, cycles, now)
+	if len(h.Issues) != 2 || *h.Degradation != 50 || h.LastWeek.Cycles != 3 || h.Running == nil {
+		t.Fatalf("expected degrading and stuck equipment, got %+v", h)
+	}
+
+	// too few cycles to compare are left alone
+	if h := analyzeEquipment(1, heatingCycles(now.Add(-3*24*time.Hour), 3, 30*time.Minute), now); h.Degradation != nil || len(h.Issues) != 0 {
+		t.Fatalf("expected no comparison without cycles last week, got %+v", h)
+	}
+}
+
+func TestEquipmentAlert(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.HVACMinOff = 0
+		c.EquipmentMaxCycle = time.Minute
+	})
+
+	target, _ := home.Thermostat(1)
+	target, _ = home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 75, CoolSetPoint: 80})
+	target, _ = home.RecordTemp(target, 60)
+
+	var h equipmentHealth
+	get(base+"/v1/thermostats/1/equipment", t, &h)
+	if h.Running == nil || h.Running.Mode != hvacHeating || len(h.Issues) != 0 {
+		t.Fatalf("expected a heating cycle running without issues yet, got %+v", h)
+	}
+
+	checkEquipment(target, time.Now().Add(time.Hour))
+	var firing []alert
+	get(base+"/v1/alerts?state=firing&type=equipment", t, &firing)
+	if len(firing) != 1 || firing[0].ThermostatID != 1 || firing[0].Severity != severityWarning {
+		t.Fatalf("expected an equipment alert, got %+v", firing)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// event is a single notification about a thermostat that is handed to every configured publisher
+type event struct {
+	Schema     int         `json:"schema"`
+	Type       string      `json:"type"`
+	ID         int         `json:"id"`
+	Thermostat *thermostat `json:"thermostat"`
+	Severity   string      `json:"severity,omitempty"`
+	Detail     string      `json:"detail,omitempty"`
+	Time       time.Time   `json:"time"`
+	// Seq numbers the change events that go through the outbox of the write-ahead log, so consumers can
+	// tell an event they already got apart from a new one
+	Seq uint64 `json:"seq,omitempty"`
+
+	// outbox is the outbox the event is taken out of once it's published
+	outbox *eventOutbox
+}
+
+// publisher delivers events to a system outside of this process
+type publisher interface {
+	Publish(e event) error
+}
+
+const (
+	// eventSchema is the version of the event layout. It must be bumped whenever a field is removed or
+	// changes meaning so downstream consumers can tell the layouts apart
+	eventSchema = 1
+
+	eventChange    = "change"
+	eventDeleted   = "deleted"
+	eventTelemetry = "telemetry"
+	eventAnomaly   = "anomaly"
+	eventSafety    = "safety"
+	eventOffline   = "offline"
+	eventOnline    = "online"
+	eventHVAC      = "hvac"
+	eventEquipment = "equipment"
+
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// publisherList holds the publishers every event is handed to, which a new server sets up
+type publisherList struct {
+	sync.RWMutex
+	list []publisher
+}
+
+var (
+	publishers = &publisherList{}
+
+	// events buffers published events so a slow publisher never holds up an api request
+	events = make(chan event, 1024)
+)
+
+// List returns the publishers
+func (l *publisherList) List() []publisher {
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.list
+}
+
+// Set replaces the publishers
+func (l *publisherList) Set(list []publisher) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.list = list
+}
+
+// reset forgets every publisher, dropping the events still queued for them
+func (l *publisherList) reset() {
+	l.Set(nil)
+	for {
+		select {
+		case <-events:
+		default:
+			return
+		}
+	}
+}
+
+// publish queues an event about the thermostat for every publisher. If the queue is full the event is
+// dropped rather than blocking the caller
+func publish(typ string, t *thermostat) {
+	publishDetail(typ, t, "", "")
+}
+
+// publishDetail queues an event about the thermostat carrying a severity and a human readable detail for
+// every publisher
+func publishDetail(typ string, t *thermostat, severity, detail string) {
+	// anomalies, safety limits and devices going offline raise alerts whether or not anything is published
+	alerts.Observe(typ, t, severity, detail, time.Now())
+
+	// with a write-ahead log, change events are written to its outbox along with the change instead
+	if len(publishers.List()) == 0 || ((typ == eventChange || typ == eventDeleted) && wal != nil) {
+		return
+	}
+
+	e := event{
+		Schema:     eventSchema,
+		Type:       typ,
+		ID:         t.ID,
+		Thermostat: t,
+		Severity:   severity,
+		Detail:     detail,
+		Time:       clock.Now(),
+	}
+
+	select {
+	case events <- e:
+	default:
+		log.Println("event queue full, dropping", typ, "event for thermostat", t.ID)
+	}
+}
+
+// dispatchEvents hands every queued event to each publisher, in the order they were published, retrying with
+// the policy until stop is closed
+func dispatchEvents(policy retryPolicy, stop <-chan struct{}) {
+	for {
+		var e event
+		select {
+		case <-stop:
+			return
+		case e = <-events:
+		}
+
+		for _, p := range publishers.List() {
+			publishWithRetry(p, e, policy, stop)
+		}
+		if e.outbox != nil {
+			if err := e.outbox.ack(e); err != nil {
+				log.Println("failed to record event", e.Seq, "of the outbox as published with error:", err)
+			}
+		}
+	}
+}
+
+// publishTelemetry publishes the current state of every enabled thermostat on the given interval until stop
+// is closed. In a cluster only the leader publishes
+func publishTelemetry(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !cluster.IsLeader() {
+			continue
+		}
+		for _, t := range activeThermostats(home.Thermostats()) {
+			publish(eventTelemetry, t)
+		}
+	}
+}
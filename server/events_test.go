@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// recorder is a publisher that hands every event it is given to the test, dropping them once full
+type recorder chan event
+
+func (r recorder) Publish(e event) error {
+	select {
+	case r <- e:
+	default:
+	}
+	return nil
+}
+
+func TestPublishChange(t *testing.T) {
+	// the test server always dispatches to the json-rpc subscribers, so record alongside them
+	newTestServer(t)
+	rec := make(recorder, 16)
+	saved := publishers.List()
+	publishers.Set(append(saved[:len(saved):len(saved)], rec))
+	defer publishers.Set(saved)
+
+	newID, _ := home.AddThermostat(updateThermostat{Name: "Attic Thermostat"})
+
+	select {
+	case e := <-rec:
+		if e.Type != eventChange {
+			t.Fatalf("expected event type %s, got %s", eventChange, e.Type)
+		}
+		if e.ID != newID || e.Thermostat.Name != "Attic Thermostat" {
+			t.Fatalf("expected event for thermostat %d, got %d (%s)", newID, e.ID, e.Thermostat.Name)
+		}
+		if e.Schema != eventSchema {
+			t.Fatalf("expected schema %d, got %d", eventSchema, e.Schema)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change event was published")
+	}
+}
+
+func TestAMQPRoutingKey(t *testing.T) {
+	a := &amqpPublisher{routingKey: "{home}.{type}.{id}", home: "cabin"}
+
+	key := a.key(event{Type: eventTelemetry, ID: 7})
+	if key != "cabin.telemetry.7" {
+		t.Fatalf("expected routing key %s, got %s", "cabin.telemetry.7", key)
+	}
+}
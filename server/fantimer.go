@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fanTimerInterval is how often the thermostats are checked for a fan timer that is up
+const fanTimerInterval = time.Second
+
+// fanTimerRequest is the body sent in through the api @ /v1/thermostats/:id/fan-timer
+type fanTimerRequest struct {
+	Duration string `json:"duration"` // e.g. "30m", defaults to the configured fan timer duration
+}
+
+// fanTimer runs the fan of a thermostat until a given time, after which it goes back to its previous mode
+type fanTimer struct {
+	Until         time.Time `json:"until"`
+	RevertFanMode string    `json:"revertFan"`
+}
+
+// MarshalJSON adds the time the fan has left to run, so clients don't need a clock of their own to show it
+func (f fanTimer) MarshalJSON() ([]byte, error) {
+	type plain fanTimer
+	return json.Marshal(struct {
+		plain
+		Remaining string `json:"remaining"`
+	}{plain(f), timeLeft(f.Until)})
+}
+
+// appendFanTimer appends the json encoding of the fan timer to dst the way MarshalJSON does
+func appendFanTimer(dst []byte, f *fanTimer) ([]byte, bool) {
+	var ok bool
+	dst = append(dst, `{"until":`...)
+	if dst, ok = appendJSONTime(dst, f.Until); !ok {
+		return dst, false
+	}
+	dst = append(dst, `,"revertFan":`...)
+	dst = appendJSONString(dst, f.RevertFanMode)
+	dst = append(dst, `,"remaining":`...)
+	dst = appendJSONString(dst, timeLeft(f.Until))
+	return append(dst, '}'), true
+}
+
+// SetFanTimer runs the fan of the thermostat until the given time, keeping the mode it goes back to when a
+// timer is already running
+func (home *currentState) SetFanTimer(target *thermostat, until time.Time) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	timer := &fanTimer{Until: until, RevertFanMode: target.FanMode}
+	if target.FanTimer != nil {
+		timer.RevertFanMode = target.FanTimer.RevertFanMode
+	}
+	updated.FanMode = "on"
+	updated.FanTimer = timer
+
+	return home.commitFanTimer(&updated)
+}
+
+// EndFanTimer puts the fan of the thermostat back in the mode it was in before the timer started
+func (home *currentState) EndFanTimer(target *thermostat) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	if target.FanTimer != nil {
+		updated.FanMode = target.FanTimer.RevertFanMode
+	}
+	updated.FanTimer = nil
+
+	return home.commitFanTimer(&updated)
+}
+
+// commitFanTimer commits the thermostat with its fan timer started or ended
+func (home *currentState) commitFanTimer(updated *thermostat) (*thermostat, error) {
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeFanTimer, updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, updated)
+	publishHVAC(transitions)
+
+	return updated, nil
+}
+
+// endFanTimers ends the fan timers that are up until stop is closed. Only the leader writes, as with every
+// other automated change, and nothing is written while the service is read-only
+func endFanTimers(interval time.Duration, stop <-chan struct{}) {
+	for clock.sleep(interval, stop) {
+		if !cluster.IsLeader() || checkReadOnly() != nil {
+			continue
+		}
+		endDueFanTimers(clock.Now())
+	}
+}
+
+// endDueFanTimers ends every fan timer that is up by now
+func endDueFanTimers(now time.Time) {
+	for _, t := range home.Thermostats() {
+		if t.FanTimer != nil && !now.Before(t.FanTimer.Until) {
+			_, err := retryChanged(t, func(current *thermostat) (*thermostat, error) {
+				// the fan timer may have been ended or restarted in the meantime
+				if current.FanTimer == nil || now.Before(current.FanTimer.Until) {
+					return current, nil
+				}
+				return home.EndFanTimer(current)
+			})
+			if err != nil {
+				log.Println("failed to end the fan timer of thermostat", t.ID, "with error:", err)
+			}
+		}
+	}
+}
+
+// PostFanTimer is the handler to run the fan of a specific thermostat for a while, e.g. 30 minutes
+func PostFanTimer(req *fasthttp.RequestCtx) {
+	var body fanTimerRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	duration := cfg.FanTimerDuration
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 || d > cfg.MaxFanTimerDuration {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Duration",
+				Description: "The duration provided must be a positive duration such as '30m' or '1h', no longer than " + cfg.MaxFanTimerDuration.String() + ".",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+		duration = d
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	// disabled thermostats can't be controlled until they are enabled again
+	if errRes := checkDisabled(target, updateThermostat{FanMode: "on"}); errRes != nil {
+		req.SetStatusCode(http.StatusConflict)
+		sendJSON(req, errRes)
+		return
+	}
+
+	updated, err := home.SetFanTimer(target, clock.Now().Add(duration))
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// DeleteFanTimer is the handler to cancel the fan timer of a specific thermostat
+func DeleteFanTimer(req *fasthttp.RequestCtx) {
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	if target.FanTimer == nil {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "Thermostat " + strconv.Itoa(target.ID) + " has no fan timer running.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	updated, err := home.EndFanTimer(target)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// postFanTimer starts the fan timer of the thermostat at url, returning the status code and the thermostat
+func postFanTimer(url, body string, t *testing.T) (int, thermostat) {
+	resp, err := http.Post(url+"/fan-timer", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var th thermostat
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&th); err != nil {
+			t.Fatalf("failed to decode the thermostat: %s", err)
+		}
+	}
+	return resp.StatusCode, th
+}
+
+func TestFanTimer(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1"
+
+	target, _ := home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{FanMode: "auto"})
+
+	for _, body := range []string{`{"duration": "-5m"}`, `{"duration": "13h"}`, `{"duration": "a while"}`} {
+		if code, _ := postFanTimer(url, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	code, th := postFanTimer(url, `{}`, t)
+	if code != http.StatusOK || th.FanMode != "on" || th.FanTimer == nil || th.FanTimer.RevertFanMode != "auto" {
+		t.Fatalf("expected the fan to run, got %d %+v", code, th)
+	}
+	var body struct {
+		FanTimer struct {
+			Remaining string `json:"remaining"`
+		} `json:"fanTimer"`
+	}
+	get(url, t, &body)
+	if left, err := time.ParseDuration(body.FanTimer.Remaining); err != nil || left < 29*time.Minute || left > 30*time.Minute {
+		t.Fatalf("expected about 30m to remain, got %q", body.FanTimer.Remaining)
+	}
+
+	// restarting the timer keeps the mode to go back to, and the fan goes back to it once the time is up
+	postFanTimer(url, `{"duration": "1h"}`, t)
+	endDueFanTimers(time.Now().Add(61 * time.Minute))
+	var ended thermostat
+	get(url, t, &ended)
+	if ended.FanMode != "auto" || ended.FanTimer != nil {
+		t.Fatalf("expected the fan to go back to auto, got %+v", ended)
+	}
+
+	// the timer can be cancelled, and setting the fan mode ends it too
+	postFanTimer(url, `{"duration": "1h"}`, t)
+	if code := del(url+"/fan-timer", t, &ended); code != http.StatusOK || ended.FanMode != "auto" {
+		t.Fatalf("expected cancelling the timer to put the fan back, got %d %+v", code, ended)
+	}
+	if code := del(url+"/fan-timer", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d without a timer, got %d", http.StatusNotFound, code)
+	}
+	postFanTimer(url, `{"duration": "1h"}`, t)
+	target, _ = home.Thermostat(1)
+	if target, _ = home.UpdateThermostat(target, updateThermostat{FanMode: "on"}); target.FanTimer != nil {
+		t.Fatalf("expected setting the fan mode to end the timer")
+	}
+}
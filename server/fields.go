@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+)
+
+// thermostatField is a property of a thermostat served through the api @ /v1/thermostats/:id/:field, named
+// by its json key
+type thermostatField struct {
+	index int
+
+	// reset returns the desired state that resets the field to its default, nil when it can't be reset
+	reset func(t *thermostat) updateThermostat
+}
+
+var (
+	// thermostatFields is the registry of every property of a thermostat, built from its json keys so a
+	// property added to the thermostat is served without registering it by hand. fieldNames lists them in
+	// the order they are declared in
+	thermostatFields = map[string]*thermostatField{}
+	fieldNames       []string
+)
+
+func init() {
+	typ := reflect.TypeOf(thermostat{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		thermostatFields[name] = &thermostatField{index: i}
+		fieldNames = append(fieldNames, name)
+	}
+
+	for name, reset := range fieldResets {
+		thermostatFields[name].reset = reset
+	}
+}
+
+// value returns the value of the field on the thermostat, or false when the thermostat has none. Flags
+// always have a value, while every other zero value counts as none
+func (f *thermostatField) value(t *thermostat) (interface{}, bool) {
+	v := reflect.ValueOf(t).Elem().Field(f.index)
+	if v.Kind() != reflect.Bool && v.IsZero() {
+		return nil, false
+	}
+	return v.Interface(), true
+}
+
+// resettableFieldNames lists the fields that can be reset to their default, in the order they are declared in
+func resettableFieldNames() []string {
+	var names []string
+	for _, name := range fieldNames {
+		if thermostatFields[name].reset != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// listChoices returns the choices quoted and listed for an error description, e.g. 'a', 'b' or 'c'
+func listChoices(choices []string) string {
+	quoted := make([]string, len(choices))
+	for i, c := range choices {
+		quoted[i] = "'" + c + "'"
+	}
+	if len(quoted) < 2 {
+		return strings.Join(quoted, "")
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
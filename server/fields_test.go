@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetEveryField(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1"
+
+	target, _ := home.Thermostat(1)
+	home.RecordTemp(target, target.CurrentTemp+3)
+
+	var previous int
+	get(url+"/previousTemp", t, &previous)
+	if previous != target.CurrentTemp {
+		t.Fatalf("expected the previous temperature %d, got %d", target.CurrentTemp, previous)
+	}
+
+	// flags are served even when they're off, and every other property only when it's set
+	disabled := true
+	get(url+"/disabled", t, &disabled)
+	if disabled {
+		t.Fatalf("expected the thermostat not to be disabled")
+	}
+	var state string
+	get(url+"/hvacState", t, &state)
+	if state != hvacIdle {
+		t.Fatalf("expected the equipment to be idle, got %q", state)
+	}
+	var res errResponse
+	get(url+"/boost", t, &res)
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d for a boost the thermostat doesn't have, got %+v", http.StatusNotFound, res)
+	}
+
+	res = errResponse{}
+	get(url+"/humidity", t, &res)
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Description, "'previousTemp'") || !strings.Contains(res.Description, "'hvacState'") {
+		t.Fatalf("expected the valid properties to be listed for an unknown one, got %+v", res)
+	}
+}
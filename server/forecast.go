@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// forecastHourLayout is how the open-meteo api gives the hours of its forecast, in utc as asked
+const forecastHourLayout = "2006-01-02T15:04"
+
+// forecastPoint is the outdoor temperature forecast for the hour starting at Time
+type forecastPoint struct {
+	Time time.Time `json:"time"`
+	Temp float64   `json:"temp"`
+}
+
+// openMeteoForecast is the part of an open-meteo forecast the hourly temperatures are read from
+type openMeteoForecast struct {
+	Hourly struct {
+		Time        []string  `json:"time"`
+		Temperature []float64 `json:"temperature_2m"`
+	} `json:"hourly"`
+}
+
+// forecastStore holds the latest hourly forecast for the location of the home
+type forecastStore struct {
+	sync.Mutex
+	points    []forecastPoint
+	fetchedAt time.Time
+}
+
+var forecast = &forecastStore{}
+
+// forecastClient fetches the forecast
+var forecastClient = &http.Client{Timeout: 10 * time.Second}
+
+// reset forgets the forecast
+func (f *forecastStore) reset() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.points = nil
+	f.fetchedAt = time.Time{}
+}
+
+// set replaces the forecast with the one fetched at the given time
+func (f *forecastStore) set(points []forecastPoint, fetchedAt time.Time) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.points = points
+	f.fetchedAt = fetchedAt
+}
+
+// Forecast returns the hourly forecast and when it was fetched, zero when it never was
+func (f *forecastStore) Forecast() ([]forecastPoint, time.Time) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.points, f.fetchedAt
+}
+
+// fetchForecast fetches the hourly temperatures at -latitude and -longitude in fahrenheit from the
+// open-meteo compatible api at -forecast-url
+func fetchForecast() ([]forecastPoint, error) {
+	q := url.Values{}
+	q.Set("latitude", strconv.FormatFloat(cfg.Latitude, 'f', -1, 64))
+	q.Set("longitude", strconv.FormatFloat(cfg.Longitude, 'f', -1, 64))
+	q.Set("hourly", "temperature_2m")
+	q.Set("temperature_unit", "fahrenheit")
+	q.Set("timezone", "UTC")
+
+	resp, err := forecastClient.Get(cfg.ForecastURL + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(cfg.ForecastURL + " responded with " + resp.Status)
+	}
+	var res openMeteoForecast
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Hourly.Time) != len(res.Hourly.Temperature) {
+		return nil, errors.New("the forecast has " + strconv.Itoa(len(res.Hourly.Time)) + " hours but " + strconv.Itoa(len(res.Hourly.Temperature)) + " temperatures")
+	}
+
+	points := make([]forecastPoint, 0, len(res.Hourly.Time))
+	for i, hour := range res.Hourly.Time {
+		t, err := time.Parse(forecastHourLayout, hour)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, forecastPoint{Time: t, Temp: res.Hourly.Temperature[i]})
+	}
+	return points, nil
+}
+
+// runForecast fetches the forecast straight away and then every interval until stop is closed. A fetch
+// that fails keeps the forecast that was fetched before
+func runForecast(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if points, err := fetchForecast(); err != nil {
+			log.Println("failed to fetch the weather forecast with error:", err)
+		} else {
+			forecast.set(points, time.Now())
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	fuzzOnce   sync.Once
+	fuzzTarget int
+)
+
+// fuzzRequest runs a request through the router of the api without going over the network, failing when
+// the request takes the server down or gets anything but json back
+func fuzzRequest(t *testing.T, method, uri string, body []byte) {
+	var req fasthttp.RequestCtx
+	req.Request.Header.SetMethod(method)
+	req.Request.SetRequestURI(uri)
+	req.Request.SetBody(body)
+
+	newRouter(listenerSpec{}).Handler(&req)
+
+	if code := req.Response.StatusCode(); code >= http.StatusInternalServerError {
+		t.Fatalf("%s %s with body %q failed with status %d: %s", method, uri, body, code, req.Response.Body())
+	}
+	if strings.HasPrefix(string(req.Response.Header.ContentType()), "application/json") && len(req.Response.Body()) > 0 && !json.Valid(req.Response.Body()) {
+		t.Fatalf("%s %s with body %q responded with invalid json: %s", method, uri, body, req.Response.Body())
+	}
+}
+
+// fuzzThermostat returns the id of the thermostat the fuzz targets write to, so the thermostats the other
+// tests rely on are left alone
+func fuzzThermostat() string {
+	fuzzOnce.Do(func() {
+		fuzzTarget, _ = home.AddThermostat(updateThermostat{Name: "Fuzz Thermostat"})
+	})
+	return strconv.Itoa(fuzzTarget)
+}
+
+func FuzzPutThermostat(f *testing.F) {
+	f.Add([]byte(`{"name": "Den", "mode": "cool", "coolSetPoint": 70, "heatSetPoint": 65, "fan": "on"}`))
+	f.Add([]byte(`{"tags": ["floor:1", "floor:1"]}`))
+	f.Add([]byte(`{"coolSetPoint": 99999999999999999999}`))
+	f.Add([]byte(`{"currentTemp": 80}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(``))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		fuzzRequest(t, "PUT", "/v1/thermostats/"+fuzzThermostat(), body)
+	})
+}
+
+func FuzzGetField(f *testing.F) {
+	f.Add("1", "coolSetPoint")
+	f.Add("2", "fan")
+	f.Add("0", "name")
+	f.Add("-1", "mode")
+	f.Add("abc", "name")
+	f.Add("99999999999999999999", "heatSetPoint")
+	f.Add("1", "secret")
+	f.Add("search", "compare")
+
+	f.Fuzz(func(t *testing.T, id, field string) {
+		fuzzRequest(t, "GET", "/v1/thermostats/"+id+"/"+field, nil)
+	})
+}
+
+func FuzzGetThermostat(f *testing.F) {
+	f.Add("1")
+	f.Add("0x1")
+	f.Add("+1")
+	f.Add(" 1")
+	f.Add("search?q=%")
+	f.Add("compare?ids=1,,x")
+
+	f.Fuzz(func(t *testing.T, id string) {
+		fuzzRequest(t, "GET", "/v1/thermostats/"+id, nil)
+	})
+}
+
+func FuzzRPC(f *testing.F) {
+	f.Add([]byte(`{"jsonrpc": "2.0", "method": "getThermostat", "params": {"id": 1}, "id": 1}`))
+	f.Add([]byte(`[{"jsonrpc": "2.0", "method": "listThermostats", "id": "a"}, 1, null]`))
+	f.Add([]byte(`{"jsonrpc": "2.0", "method": "updateThermostat", "params": [1], "id": 1}`))
+	f.Add([]byte(`{"jsonrpc": "2.0", "method": "subscribe", "id": 1}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`{`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		if res := handleRPC(body, "", nil); res != nil {
+			if _, err := json.Marshal(res); err != nil {
+				t.Fatalf("rpc response to %q can't be sent: %s", body, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// groupSettingNames are the settings a group can define for its members, by json key, in the order they are
+// listed in
+var groupSettingNames = []string{"mode", "heatSetPoint", "coolSetPoint", "fan"}
+
+// groupSettings are the default settings of a group, sent in through the api @ /v1/groups/:group. A group is
+// named after a tag, and every thermostat with the tag inherits the settings the group defines unless it
+// overrides them
+type groupSettings struct {
+	OperatingMode string `json:"mode,omitempty"`
+	HeatSetPoint  int    `json:"heatSetPoint,omitempty"`
+	CoolSetPoint  int    `json:"coolSetPoint,omitempty"`
+	FanMode       string `json:"fan,omitempty"`
+}
+
+// group is a group returned through the api @ /v1/groups, along with the ids of the thermostats in it
+type group struct {
+	Name     string        `json:"name"`
+	Settings groupSettings `json:"settings"`
+	Members  []int         `json:"members"`
+}
+
+// thermostatSettings is returned through the api @ /v1/thermostats/:id/settings, telling the settings the
+// thermostat runs at apart from those it inherits and those it overrides
+type thermostatSettings struct {
+	ThermostatID int               `json:"thermostatId"`
+	Effective    groupSettings     `json:"effective"`
+	Inherited    groupSettings     `json:"inherited"`
+	Local        groupSettings     `json:"local"`
+	Sources      map[string]string `json:"sources"` // the group each inherited setting comes from
+	Overrides    []string          `json:"overrides"`
+}
+
+// settingsOf returns the settings of the thermostat a group can define
+func settingsOf(t *thermostat) groupSettings {
+	return groupSettings{
+		OperatingMode: t.OperatingMode,
+		HeatSetPoint:  t.HeatSetPoint,
+		CoolSetPoint:  t.CoolSetPoint,
+		FanMode:       t.FanMode,
+	}
+}
+
+// desiredSettings returns the settings given in the desired state a group can define
+func desiredSettings(desired updateThermostat) groupSettings {
+	return groupSettings{
+		OperatingMode: desired.OperatingMode,
+		HeatSetPoint:  desired.HeatSetPoint,
+		CoolSetPoint:  desired.CoolSetPoint,
+		FanMode:       desired.FanMode,
+	}
+}
+
+// update returns the desired state that sets the settings
+func (s groupSettings) update() updateThermostat {
+	return updateThermostat{
+		OperatingMode: s.OperatingMode,
+		HeatSetPoint:  s.HeatSetPoint,
+		CoolSetPoint:  s.CoolSetPoint,
+		FanMode:       s.FanMode,
+	}
+}
+
+// names lists the settings that are set, in the order of groupSettingNames
+func (s groupSettings) names() []string {
+	var names []string
+	for _, name := range groupSettingNames {
+		if s.has(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// has reports whether the setting by json key is set
+func (s groupSettings) has(name string) bool {
+	switch name {
+	case "mode":
+		return s.OperatingMode != ""
+	case "heatSetPoint":
+		return s.HeatSetPoint != 0
+	case "coolSetPoint":
+		return s.CoolSetPoint != 0
+	case "fan":
+		return s.FanMode != ""
+	}
+	return false
+}
+
+// copySetting copies the setting by json key from src
+func (s *groupSettings) copySetting(name string, src groupSettings) {
+	switch name {
+	case "mode":
+		s.OperatingMode = src.OperatingMode
+	case "heatSetPoint":
+		s.HeatSetPoint = src.HeatSetPoint
+	case "coolSetPoint":
+		s.CoolSetPoint = src.CoolSetPoint
+	case "fan":
+		s.FanMode = src.FanMode
+	}
+}
+
+// only returns the settings by json key, leaving the others unset
+func (s groupSettings) only(names []string) groupSettings {
+	var picked groupSettings
+	for _, name := range names {
+		picked.copySetting(name, s)
+	}
+	return picked
+}
+
+// applyGroups has the updated thermostat inherit the settings its groups define, unless it overrides them. A
+// setting given in desired overrides the groups from then on. The inherited settings are applied as the
+// thermostat joins a group, or whenever desired.inherit is set, so a thermostat only changes when it or
+// its groups do. target is nil for a thermostat being added
+func applyGroups(target, updated *thermostat, desired updateThermostat) {
+	inherited, sources := groups.Inherited(updated.Tags)
+
+	// overrides of settings none of the groups define anymore are dropped
+	overridden := make(map[string]bool)
+	if target != nil {
+		for _, name := range target.Overrides {
+			overridden[name] = sources[name] != ""
+		}
+	}
+	for _, name := range desiredSettings(desired).names() {
+		overridden[name] = sources[name] != ""
+	}
+
+	joined := target == nil || desired.inherit
+	if !joined {
+		for _, tag := range updated.Tags {
+			if !inArray(tag, target.Tags) && groups.Has(tag) {
+				joined = true
+			}
+		}
+	}
+
+	effective := settingsOf(updated)
+	updated.Overrides = nil
+	for _, name := range groupSettingNames {
+		switch {
+		case overridden[name]:
+			updated.Overrides = append(updated.Overrides, name)
+		case joined && sources[name] != "":
+			effective.copySetting(name, inherited)
+		}
+	}
+	updated.OperatingMode = effective.OperatingMode
+	updated.HeatSetPoint = effective.HeatSetPoint
+	updated.CoolSetPoint = effective.CoolSetPoint
+	updated.FanMode = effective.FanMode
+}
+
+// groupStore holds the settings of every group by name, persisting them to -groups-file so they survive a
+// restart
+type groupStore struct {
+	sync.Mutex
+	settings map[string]groupSettings
+}
+
+var groups = &groupStore{settings: make(map[string]groupSettings)}
+
+// load restores the groups persisted at path. A missing file means there are no groups
+func (s *groupStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := make(map[string]groupSettings)
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.settings = saved
+	return nil
+}
+
+// save persists the groups to -groups-file, if given. The lock must be held
+func (s *groupStore) save() error {
+	if cfg.GroupsFile == "" {
+		return nil
+	}
+
+	jsn, err := json.Marshal(s.settings)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.GroupsFile, jsn, 0644)
+}
+
+// reset forgets every group
+func (s *groupStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.settings = make(map[string]groupSettings)
+}
+
+// Names returns the name of every group in order
+func (s *groupStore) Names() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	names := make([]string, 0, len(s.settings))
+	for name := range s.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Settings returns the settings of the group, if there is one
+func (s *groupStore) Settings(name string) (groupSettings, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	settings, ok := s.settings[name]
+	return settings, ok
+}
+
+// Has reports whether there is a group by the name
+func (s *groupStore) Has(name string) bool {
+	_, ok := s.Settings(name)
+	return ok
+}
+
+// Set replaces the settings of the group, adding it if there's none by the name
+func (s *groupStore) Set(name string, settings groupSettings) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, existed := s.settings[name]
+	s.settings[name] = settings
+	if err := s.save(); err != nil {
+		if existed {
+			s.settings[name] = previous
+		} else {
+			delete(s.settings, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove removes the group, reporting whether there was one
+func (s *groupStore) Remove(name string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	settings, ok := s.settings[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.settings, name)
+	if err := s.save(); err != nil {
+		s.settings[name] = settings
+		return true, err
+	}
+	return true, nil
+}
+
+// Inherited returns the settings the groups named by the tags define, along with the group each one comes
+// from by json key. A setting more than one of the groups define comes from the first of them by name
+func (s *groupStore) Inherited(tags []string) (groupSettings, map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+
+	names := append([]string(nil), tags...)
+	sort.Strings(names)
+
+	var inherited groupSettings
+	sources := make(map[string]string)
+	for _, name := range names {
+		settings, ok := s.settings[name]
+		if !ok {
+			continue
+		}
+		for _, setting := range settings.names() {
+			if sources[setting] == "" {
+				inherited.copySetting(setting, settings)
+				sources[setting] = name
+			}
+		}
+	}
+	return inherited, sources
+}
+
+// members returns the ids of the thermostats in the group in order
+func members(name string) []int {
+	ids := []int{}
+	for _, t := range home.Thermostats() {
+		if inArray(name, t.Tags) {
+			ids = append(ids, t.ID)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// inheritGroup applies the settings of the groups of every enabled thermostat in the group to those it
+// doesn't override, after the group was changed
+func inheritGroup(name string) {
+	for _, t := range withTags(activeThermostats(home.Thermostats()), []string{name}) {
+		if _, err := home.UpdateThermostat(t, updateThermostat{inherit: true}); err != nil {
+			log.Println("failed to apply group", name, "to thermostat", t.ID, "with error:", err)
+		}
+	}
+}
+
+// groupNotFound builds the error response for a group that doesn't exist
+func groupNotFound(name string) *errResponse {
+	return &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "No group '" + name + "' exists.",
+	}
+}
+
+// sendGroupsError responds with the error the groups failed to be persisted with
+func sendGroupsError(req *fasthttp.RequestCtx, err error) {
+	res := &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Failed to persist groups",
+		Description: err.Error(),
+	}
+	reportError(req, err)
+	req.SetStatusCode(http.StatusInternalServerError)
+	sendJSON(req, res)
+}
+
+// GetGroups is the handler to list every group along with its members
+func GetGroups(req *fasthttp.RequestCtx) {
+	list := []group{}
+	for _, name := range groups.Names() {
+		settings, _ := groups.Settings(name)
+		list = append(list, group{Name: name, Settings: settings, Members: members(name)})
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, list)
+}
+
+// GetGroup is the handler to return a single group along with its members
+func GetGroup(req *fasthttp.RequestCtx) {
+	name := req.UserValue("group").(string)
+	settings, ok := groups.Settings(name)
+	if !ok {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, groupNotFound(name))
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, group{Name: name, Settings: settings, Members: members(name)})
+}
+
+// PutGroup is the handler to set the settings of a group, which every enabled thermostat with the tag of
+// the same name inherits right away unless it overrides them
+func PutGroup(req *fasthttp.RequestCtx) {
+	name := req.UserValue("group").(string)
+	if errRes := validateTags([]string{name}); errRes != nil {
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, errRes)
+		return
+	}
+
+	var body groupSettings
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	if len(body.names()) == 0 {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Group",
+			Description: "A group must define at least one of " + listChoices(groupSettingNames) + ".",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	if errRes := validateData(body.update()); errRes != nil {
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, errRes)
+		return
+	}
+	if errRes := checkUserRange(requestUser(req), body.HeatSetPoint, body.CoolSetPoint); errRes != nil {
+		req.SetStatusCode(http.StatusForbidden)
+		sendJSON(req, errRes)
+		return
+	}
+
+	if err := groups.Set(name, body); err != nil {
+		sendGroupsError(req, err)
+		return
+	}
+	inheritGroup(name)
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, group{Name: name, Settings: body, Members: members(name)})
+}
+
+// DeleteGroup is the handler to remove a group. Its members keep the settings they inherited from it, unless
+// another of their groups defines them
+func DeleteGroup(req *fasthttp.RequestCtx) {
+	name := req.UserValue("group").(string)
+	found, err := groups.Remove(name)
+	if err != nil {
+		sendGroupsError(req, err)
+		return
+	}
+	if !found {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, groupNotFound(name))
+		return
+	}
+	inheritGroup(name)
+
+	req.SetStatusCode(http.StatusNoContent)
+}
+
+// GetSettings is the handler to return the settings a specific thermostat runs at, along with those it
+// inherits from its groups and those it overrides
+func GetSettings(req *fasthttp.RequestCtx) {
+	// no need to check if this exists, already validated in middleware
+	t := req.UserValue("thermostat").(*thermostat)
+
+	effective := settingsOf(t)
+	inherited, sources := groups.Inherited(t.Tags)
+	overrides := append([]string{}, t.Overrides...)
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, thermostatSettings{
+		ThermostatID: t.ID,
+		Effective:    effective,
+		Inherited:    inherited,
+		Local:        effective.only(overrides),
+		Sources:      sources,
+		Overrides:    overrides,
+	})
+}
+
+// DeleteOverrides is the handler to clear the overrides of a specific thermostat, so it inherits every
+// setting its groups define again. Only the settings given by ?setting= are cleared, when any are
+func DeleteOverrides(req *fasthttp.RequestCtx) {
+	var names []string
+	for _, setting := range req.QueryArgs().PeekMulti("setting") {
+		if !inArray(string(setting), groupSettingNames) {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Setting",
+				Description: "The setting '" + string(setting) + "' can't be inherited. Valid choices are " + listChoices(groupSettingNames) + ".",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+		names = append(names, string(setting))
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	// disabled thermostats can't be controlled until they are enabled again
+	inherited, _ := groups.Inherited(target.Tags)
+	if errRes := checkDisabled(target, inherited.update()); errRes != nil {
+		req.SetStatusCode(http.StatusConflict)
+		sendJSON(req, errRes)
+		return
+	}
+
+	// the overrides are only carried over from the target, so clearing them on a copy drops them
+	cleared := *target
+	cleared.Overrides = nil
+	if len(names) > 0 {
+		for _, name := range target.Overrides {
+			if !inArray(name, names) {
+				cleared.Overrides = append(cleared.Overrides, name)
+			}
+		}
+	}
+
+	updated, err := home.UpdateThermostat(&cleared, updateThermostat{inherit: true})
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	base := newTestServer(t)
+	north, _ := home.AddThermostat(updateThermostat{Name: "North Office", Tags: []string{"floor:3"}})
+	south, _ := home.AddThermostat(updateThermostat{Name: "South Office", Tags: []string{"floor:3"}})
+	therm := func(id int) *thermostat {
+		th, _ := home.Thermostat(id)
+		return th
+	}
+
+	if code := put(base+"/v1/groups/floor:3", `{}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a group without settings, got %d", http.StatusBadRequest, code)
+	}
+	if code := put(base+"/v1/groups/floor:3", `{"mode": "warm"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid mode, got %d", http.StatusBadRequest, code)
+	}
+
+	// every member inherits the settings of the group, and keeps a setting it's given from then on
+	if code := put(base+"/v1/groups/floor:3", `{"mode": "heat", "heatSetPoint": 66}`, t); code != http.StatusOK {
+		t.Fatalf("expected the group to be set, got %d", code)
+	}
+	if th := therm(north); th.OperatingMode != "heat" || th.HeatSetPoint != 66 || len(th.Overrides) != 0 {
+		t.Fatalf("expected thermostat %d to inherit the settings of the group, got %+v", north, th)
+	}
+	home.UpdateThermostat(therm(south), updateThermostat{HeatSetPoint: 70})
+	if code := put(base+"/v1/groups/floor:3", `{"mode": "heat", "heatSetPoint": 67}`, t); code != http.StatusOK {
+		t.Fatalf("expected the group to be changed, got %d", code)
+	}
+	if th := therm(north); th.HeatSetPoint != 67 {
+		t.Fatalf("expected thermostat %d to inherit the change of the group, got %+v", north, th)
+	}
+	if th := therm(south); th.OperatingMode != "heat" || th.HeatSetPoint != 70 {
+		t.Fatalf("expected thermostat %d to keep its own heat setpoint, got %+v", south, th)
+	}
+
+	var settings thermostatSettings
+	get(base+"/v1/thermostats/"+strconv.Itoa(south)+"/settings", t, &settings)
+	if settings.Local.HeatSetPoint != 70 || settings.Inherited.HeatSetPoint != 67 || settings.Sources["mode"] != "floor:3" ||
+		len(settings.Overrides) != 1 || settings.Overrides[0] != "heatSetPoint" {
+		t.Fatalf("expected the heat setpoint to be overridden, got %+v", settings)
+	}
+
+	// a thermostat joining the group inherits its settings, unless it's given them
+	joined, _ := home.AddThermostat(updateThermostat{Name: "Lab", HeatSetPoint: 64})
+	home.UpdateThermostat(therm(joined), updateThermostat{Tags: []string{"floor:3"}})
+	if th := therm(joined); th.OperatingMode != "heat" || th.HeatSetPoint != 67 {
+		t.Fatalf("expected thermostat %d to inherit the settings of the group it joined, got %+v", joined, th)
+	}
+	added, _ := home.AddThermostat(updateThermostat{Name: "Storage", CoolSetPoint: 80, HeatSetPoint: 60, Tags: []string{"floor:3"}})
+	if th := therm(added); th.OperatingMode != "heat" || th.HeatSetPoint != 60 || len(th.Overrides) != 1 {
+		t.Fatalf("expected thermostat %d to override the heat setpoint it was added with, got %+v", added, th)
+	}
+
+	// clearing the overrides inherits the setting again
+	if code := del(base+"/v1/thermostats/"+strconv.Itoa(south)+"/overrides?setting=heat", t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid setting, got %d", http.StatusBadRequest, code)
+	}
+	if code := del(base+"/v1/thermostats/"+strconv.Itoa(south)+"/overrides", t, nil); code != http.StatusOK {
+		t.Fatalf("expected the overrides to be cleared, got %d", code)
+	}
+	if th := therm(south); th.HeatSetPoint != 67 || len(th.Overrides) != 0 {
+		t.Fatalf("expected thermostat %d to inherit the heat setpoint again, got %+v", south, th)
+	}
+
+	var list []group
+	get(base+"/v1/groups", t, &list)
+	if len(list) != 1 || len(list[0].Members) != 4 {
+		t.Fatalf("expected a single group of 4 thermostats, got %+v", list)
+	}
+
+	// members keep what they inherited from a removed group
+	if code := del(base+"/v1/groups/floor:3", t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected the group to be removed, got %d", code)
+	}
+	if th := therm(added); th.OperatingMode != "heat" || len(th.Overrides) != 0 {
+		t.Fatalf("expected thermostat %d to keep its settings and drop its overrides, got %+v", added, th)
+	}
+	if code := del(base+"/v1/groups/floor:3", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for a removed group, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestGroupsPersisted(t *testing.T) {
+	newTestServer(t)
+	if err := groups.Set("wing:north", groupSettings{FanMode: "on"}); err != nil {
+		t.Fatal(err)
+	}
+
+	groups.reset()
+	if err := groups.load(cfg.GroupsFile); err != nil {
+		t.Fatal(err)
+	}
+	if settings, ok := groups.Settings("wing:north"); !ok || settings.FanMode != "on" {
+		t.Fatalf("expected the group to be restored, got %+v", settings)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/valyala/fasthttp"
+)
+
+// the levels of the hierarchy thermostats are placed in, from the top down
+const (
+	levelBuilding = "building"
+	levelFloor    = "floor"
+	levelRoom     = "room"
+)
+
+// location is the place of a thermostat in the hierarchy of a commercial deployment: a room of a floor of a
+// building. The levels are named from the top down, so a thermostat can be placed in a building without
+// a floor, or on a floor without a room
+type location struct {
+	Building string `json:"building"`
+	Floor    string `json:"floor,omitempty"`
+	Room     string `json:"room,omitempty"`
+}
+
+// siteNode is a level of the hierarchy returned through the api @ /v1/buildings, with the statistics of
+// every thermostat within it rolled up. Rooms list the ids of their thermostats instead of children
+type siteNode struct {
+	Level         string       `json:"level"`
+	Name          string       `json:"name"`
+	Summary       *homeSummary `json:"summary"`
+	Children      []*siteNode  `json:"children,omitempty"`
+	ThermostatIDs []int        `json:"thermostatIds,omitempty"`
+}
+
+// within reports whether the thermostat is placed within the building, and the floor and room when given
+func within(t *thermostat, building, floor, room string) bool {
+	l := t.Location
+	return l != nil && l.Building == building && (floor == "" || l.Floor == floor) && (room == "" || l.Room == room)
+}
+
+// thermostatsWithin returns the thermostats placed within the building, and the floor and room when given
+func thermostatsWithin(therms []*thermostat, building, floor, room string) []*thermostat {
+	var placed []*thermostat
+	for _, t := range therms {
+		if within(t, building, floor, room) {
+			placed = append(placed, t)
+		}
+	}
+	return placed
+}
+
+// buildSites rolls the thermostats up into the hierarchy of the buildings they are placed in, each level in
+// order by name. Thermostats without a location are left out
+func buildSites(therms []*thermostat) []*siteNode {
+	byBuilding := make(map[string][]*thermostat)
+	for _, t := range therms {
+		if t.Location != nil {
+			byBuilding[t.Location.Building] = append(byBuilding[t.Location.Building], t)
+		}
+	}
+
+	var buildings []*siteNode
+	for _, name := range sortedKeys(byBuilding) {
+		buildings = append(buildings, buildFloors(name, byBuilding[name]))
+	}
+	return buildings
+}
+
+// buildFloors rolls the thermostats of the building up by the floors they are on
+func buildFloors(building string, therms []*thermostat) *siteNode {
+	node := &siteNode{Level: levelBuilding, Name: building, Summary: summarize(therms)}
+
+	byFloor := make(map[string][]*thermostat)
+	for _, t := range therms {
+		if t.Location.Floor != "" {
+			byFloor[t.Location.Floor] = append(byFloor[t.Location.Floor], t)
+		}
+	}
+	for _, name := range sortedKeys(byFloor) {
+		node.Children = append(node.Children, buildRooms(name, byFloor[name]))
+	}
+	return node
+}
+
+// buildRooms rolls the thermostats of the floor up by the rooms they are in
+func buildRooms(floor string, therms []*thermostat) *siteNode {
+	node := &siteNode{Level: levelFloor, Name: floor, Summary: summarize(therms)}
+
+	byRoom := make(map[string][]*thermostat)
+	for _, t := range therms {
+		if t.Location.Room != "" {
+			byRoom[t.Location.Room] = append(byRoom[t.Location.Room], t)
+		}
+	}
+	for _, name := range sortedKeys(byRoom) {
+		node.Children = append(node.Children, buildRoom(name, byRoom[name]))
+	}
+	return node
+}
+
+// buildRoom rolls up the thermostats of the room
+func buildRoom(room string, therms []*thermostat) *siteNode {
+	node := &siteNode{Level: levelRoom, Name: room, Summary: summarize(therms)}
+	for _, t := range therms {
+		node.ThermostatIDs = append(node.ThermostatIDs, t.ID)
+	}
+	sort.Ints(node.ThermostatIDs)
+	return node
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(m map[string][]*thermostat) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// siteParams returns the building, floor and room given in the path, those below the level of the route
+// being empty
+func siteParams(req *fasthttp.RequestCtx) (building, floor, room string) {
+	building, _ = req.UserValue("building").(string)
+	floor, _ = req.UserValue("floor").(string)
+	room, _ = req.UserValue("room").(string)
+	return building, floor, room
+}
+
+// siteNotFound builds the error response for a level of the hierarchy no thermostat is placed within
+func siteNotFound(building, floor, room string) *errResponse {
+	name := "building '" + building + "'"
+	if floor != "" {
+		name = "floor '" + floor + "' of the " + name
+	}
+	if room != "" {
+		name = "room '" + room + "' on the " + name
+	}
+	return &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "No thermostats were found within the " + name + ".",
+	}
+}
+
+// GetBuildings is the handler to return every building along with its floors and rooms, each with the
+// statistics of the thermostats within it
+func GetBuildings(req *fasthttp.RequestCtx) {
+	buildings := buildSites(home.Thermostats())
+	if buildings == nil {
+		buildings = []*siteNode{}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, buildings)
+}
+
+// GetSite is the handler to return a building, a floor or a room along with the levels below it, by the
+// route it's served at
+func GetSite(req *fasthttp.RequestCtx) {
+	building, floor, room := siteParams(req)
+	therms := thermostatsWithin(home.Thermostats(), building, floor, room)
+	if len(therms) == 0 {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, siteNotFound(building, floor, room))
+		return
+	}
+
+	var node *siteNode
+	switch {
+	case room != "":
+		node = buildRoom(room, therms)
+	case floor != "":
+		node = buildRooms(floor, therms)
+	default:
+		node = buildFloors(building, therms)
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, node)
+}
+
+// PutSite is the handler to apply the same update to every enabled thermostat within a building, a floor
+// or a room, by the route it's served at
+func PutSite(req *fasthttp.RequestCtx) {
+	building, floor, room := siteParams(req)
+	putAll(req, func() []*thermostat {
+		return thermostatsWithin(home.Thermostats(), building, floor, room)
+	}, siteNotFound(building, floor, room).Description)
+}
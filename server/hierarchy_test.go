@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestHierarchy(t *testing.T) {
+	base := newTestServer(t)
+	lobby, _ := home.AddThermostat(updateThermostat{Name: "Lobby", Location: &location{Building: "hq", Floor: "1", Room: "lobby"}})
+	office, _ := home.AddThermostat(updateThermostat{Name: "Office", Location: &location{Building: "hq", Floor: "2", Room: "201"}})
+	depot, _ := home.AddThermostat(updateThermostat{Name: "Depot", Location: &location{Building: "depot"}})
+
+	var buildings []*siteNode
+	get(base+"/v1/buildings", t, &buildings)
+	if len(buildings) != 2 || buildings[0].Name != "depot" || buildings[1].Name != "hq" || buildings[1].Summary.Thermostats != 2 ||
+		len(buildings[1].Children) != 2 || buildings[1].Children[1].Children[0].ThermostatIDs[0] != office {
+		t.Fatalf("expected the thermostats rolled up by building, floor and room, got %+v", buildings)
+	}
+
+	var floor siteNode
+	get(base+"/v1/buildings/hq/floors/1", t, &floor)
+	if floor.Level != levelFloor || floor.Summary.Thermostats != 1 || len(floor.Children) != 1 || floor.Children[0].Name != "lobby" {
+		t.Fatalf("expected the first floor of hq with only the lobby, got %+v", floor)
+	}
+	var missing errResponse
+	get(base+"/v1/buildings/hq/floors/9", t, &missing)
+	if missing.Code != http.StatusNotFound {
+		t.Fatalf("expected a floor without thermostats not to be found, got %+v", missing)
+	}
+
+	// a bulk update only reaches the thermostats within the building
+	if code := put(base+"/v1/buildings/hq", `{"mode": "cool"}`, t); code != http.StatusOK {
+		t.Fatalf("expected the thermostats of hq to be updated, got %d", code)
+	}
+	for id, mode := range map[int]string{lobby: "cool", office: "cool", depot: defaultOpMode} {
+		if th, _ := home.Thermostat(id); th.OperatingMode != mode || th.Location == nil {
+			t.Fatalf("expected thermostat %d to be in mode %s and keep its location, got %+v", id, mode, th)
+		}
+	}
+
+	// a room can't be given without the floor it's on, and an empty location removes it
+	if code := put(base+"/v1/thermostats/1", `{"location": {"building": "hq", "room": "lobby"}}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a room without a floor, got %d", http.StatusBadRequest, code)
+	}
+	if code := del(base+"/v1/thermostats/"+strconv.Itoa(depot)+"/location", t, nil); code != http.StatusOK {
+		t.Fatalf("expected the location to be removed, got %d", code)
+	}
+	if th, _ := home.Thermostat(depot); th.Location != nil {
+		t.Fatalf("expected thermostat %d to have no location, got %+v", depot, th.Location)
+	}
+}
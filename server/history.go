@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// runtimeRecord is an interval of the history of a thermostat from before it was managed by this server,
+// imported from the data export of another thermostat vendor, returned through the api @
+// /v1/thermostats/:id/history. The runtimes are how many seconds of the interval the equipment ran for
+type runtimeRecord struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Source       string    `json:"source"`
+	Mode         string    `json:"mode,omitempty"`
+	HeatSetPoint int       `json:"heatSetPoint,omitempty"`
+	CoolSetPoint int       `json:"coolSetPoint,omitempty"`
+	IndoorTemp   *float64  `json:"indoorTemp,omitempty"`
+	OutdoorTemp  *float64  `json:"outdoorTemp,omitempty"`
+	HeatSeconds  int       `json:"heatSeconds"`
+	CoolSeconds  int       `json:"coolSeconds"`
+	FanSeconds   int       `json:"fanSeconds"`
+}
+
+// runtimeHistory is the imported history of a thermostat within a time range, returned through the api @
+// /v1/thermostats/:id/history along with the total runtimes over it
+type runtimeHistory struct {
+	ThermostatID   int             `json:"thermostatId"`
+	HeatingRuntime string          `json:"heatingRuntime"`
+	CoolingRuntime string          `json:"coolingRuntime"`
+	FanRuntime     string          `json:"fanRuntime"`
+	Records        []runtimeRecord `json:"records"`
+}
+
+// historyStore holds the imported history of every thermostat, oldest first, persisting it to
+// -history-file so it survives a restart. Records are told apart by their start and source, so importing
+// the same export twice doesn't count it twice
+type historyStore struct {
+	sync.Mutex
+	records map[int][]runtimeRecord
+}
+
+var history = &historyStore{records: make(map[int][]runtimeRecord)}
+
+// load restores the history persisted at path. A missing file means nothing was imported
+func (s *historyStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := make(map[int][]runtimeRecord)
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.records = saved
+	return nil
+}
+
+// save persists the history to -history-file, if given. The lock must be held
+func (s *historyStore) save() error {
+	if cfg.HistoryFile == "" {
+		return nil
+	}
+
+	jsn, err := json.Marshal(s.records)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.HistoryFile, jsn, 0644)
+}
+
+// reset forgets every imported record
+func (s *historyStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.records = make(map[int][]runtimeRecord)
+}
+
+// Import adds the records to the history of the thermostat, replacing those already imported with the same
+// start from the same source, and returns how many were new
+func (s *historyStore) Import(id int, imported []runtimeRecord) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	type key struct {
+		start  int64
+		source string
+	}
+	previous := s.records[id]
+	byKey := make(map[key]int, len(previous))
+	merged := append([]runtimeRecord(nil), previous...)
+	for i, r := range merged {
+		byKey[key{r.Start.UnixNano(), r.Source}] = i
+	}
+
+	added := 0
+	for _, r := range imported {
+		k := key{r.Start.UnixNano(), r.Source}
+		if i, ok := byKey[k]; ok {
+			merged[i] = r
+			continue
+		}
+		byKey[k] = len(merged)
+		merged = append(merged, r)
+		added++
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Start.Before(merged[j].Start) })
+
+	s.records[id] = merged
+	if err := s.save(); err != nil {
+		s.records[id] = previous
+		return 0, err
+	}
+	return added, nil
+}
+
+// Purge removes the records of the thermostat, or of every thermostat when id is 0, that ended before the
+// given time, or every one of them when it's zero, and returns how many were removed
+func (s *historyStore) Purge(id int, before time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	previous := s.records
+	kept := make(map[int][]runtimeRecord, len(previous))
+	purged := 0
+	for tid, records := range previous {
+		if id != 0 && tid != id {
+			kept[tid] = records
+			continue
+		}
+		var remaining []runtimeRecord
+		for _, r := range records {
+			if before.IsZero() || r.End.Before(before) {
+				purged++
+				continue
+			}
+			remaining = append(remaining, r)
+		}
+		if len(remaining) > 0 {
+			kept[tid] = remaining
+		}
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+
+	s.records = kept
+	if err := s.save(); err != nil {
+		s.records = previous
+		return 0, err
+	}
+	return purged, nil
+}
+
+// History returns the imported history of the thermostat starting within [from, to), either of which is
+// ignored when zero
+func (s *historyStore) History(id int, from, to time.Time) runtimeHistory {
+	s.Lock()
+	defer s.Unlock()
+
+	h := runtimeHistory{ThermostatID: id, Records: []runtimeRecord{}}
+	var heat, cool, fan int
+	for _, r := range s.records[id] {
+		if !from.IsZero() && r.Start.Before(from) || !to.IsZero() && !r.Start.Before(to) {
+			continue
+		}
+		h.Records = append(h.Records, r)
+		heat, cool, fan = heat+r.HeatSeconds, cool+r.CoolSeconds, fan+r.FanSeconds
+	}
+	h.HeatingRuntime = (time.Duration(heat) * time.Second).String()
+	h.CoolingRuntime = (time.Duration(cool) * time.Second).String()
+	h.FanRuntime = (time.Duration(fan) * time.Second).String()
+	return h
+}
+
+// GetHistory is the handler to return the history of a thermostat imported from another vendor, limited to
+// the records starting from ?from and before ?to when given as RFC 3339 times
+func GetHistory(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	var bounds [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		s := string(req.QueryArgs().Peek(name))
+		if s == "" {
+			continue
+		}
+		var err error
+		if bounds[i], err = time.Parse(time.RFC3339, s); err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Time",
+				Description: "The " + name + " '" + s + "' must be an RFC 3339 time such as 2024-01-31T00:00:00Z.",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, history.History(t.ID, bounds[0], bounds[1]))
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// dateLayout is the layout of the dates of the holiday calendar
+const dateLayout = "2006-01-02"
+
+// holidaySearchDays is how many days ahead a run of a scheduled action is looked for around holidays
+const holidaySearchDays = 5 * 366
+
+// holiday is a single day of the holiday calendar. Preset is set on the holidays of the country preset,
+// which can't be removed on their own
+type holiday struct {
+	Date   string `json:"date"`
+	Name   string `json:"name"`
+	Preset bool   `json:"preset,omitempty"`
+}
+
+// holidayCalendar is the body sent in and returned through the api @ /v1/holidays. Scheduled actions run
+// on weekday holidays as they do on weekends
+type holidayCalendar struct {
+	Country  string    `json:"country,omitempty"`
+	Holidays []holiday `json:"holidays"`
+}
+
+// holidayPresets are the public holidays of the countries that can be preset, by year
+var holidayPresets = map[string]func(year int) []holiday{
+	"US": usHolidays,
+	"CA": caHolidays,
+	"GB": gbHolidays,
+}
+
+// holidayStore holds the holiday calendar, persisting it to -holidays-file so it survives a restart
+type holidayStore struct {
+	sync.Mutex
+	country string
+	manual  map[string]string
+}
+
+var holidays = &holidayStore{manual: make(map[string]string)}
+
+// validateCalendar validates a holiday calendar sent in
+func validateCalendar(c holidayCalendar) *errResponse {
+	if _, ok := holidayPresets[c.Country]; c.Country != "" && !ok {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Country",
+			Description: "There are no preset holidays for the country '" + c.Country + "'. Valid choices are 'US', 'CA' or 'GB'.",
+		}
+	}
+	for _, h := range c.Holidays {
+		if errRes := validateHoliday(h.Date, h.Name); errRes != nil {
+			return errRes
+		}
+	}
+	return nil
+}
+
+// validateHoliday validates a single manual entry of the calendar
+func validateHoliday(date, name string) *errResponse {
+	if _, err := time.Parse(dateLayout, date); err != nil {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Date",
+			Description: "The date '" + date + "' is not valid. Dates are given as YYYY-MM-DD.",
+		}
+	}
+	if name == "" {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Name",
+			Description: "Holidays must have a name.",
+		}
+	}
+	return nil
+}
+
+// load restores the holiday calendar persisted at path. A missing file means there are no holidays
+func (s *holidayStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var c holidayCalendar
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.country = c.Country
+	for _, h := range c.Holidays {
+		s.manual[h.Date] = h.Name
+	}
+	return nil
+}
+
+// save persists the calendar to -holidays-file, if given. The lock must be held
+func (s *holidayStore) save() error {
+	if cfg.HolidaysFile == "" {
+		return nil
+	}
+
+	jsn, err := json.Marshal(s.manualCalendar())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.HolidaysFile, jsn, 0644)
+}
+
+// manualCalendar returns the country preset and the manual entries of every year, by date. The lock must be
+// held
+func (s *holidayStore) manualCalendar() holidayCalendar {
+	c := holidayCalendar{Country: s.country, Holidays: []holiday{}}
+	for date, name := range s.manual {
+		c.Holidays = append(c.Holidays, holiday{Date: date, Name: name})
+	}
+	sort.Slice(c.Holidays, func(i, j int) bool { return c.Holidays[i].Date < c.Holidays[j].Date })
+	return c
+}
+
+// Manual returns the country preset and the manual entries of every year, by date, which is what the
+// calendar is persisted as
+func (s *holidayStore) Manual() holidayCalendar {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.manualCalendar()
+}
+
+// Calendar returns the holidays of the given year, those of the country preset included, by date
+func (s *holidayStore) Calendar(year int) holidayCalendar {
+	s.Lock()
+	defer s.Unlock()
+
+	c := holidayCalendar{Country: s.country, Holidays: []holiday{}}
+	seen := make(map[string]bool)
+	for date, name := range s.manual {
+		if len(date) >= 4 && date[:4] == strconv.Itoa(year) {
+			c.Holidays = append(c.Holidays, holiday{Date: date, Name: name})
+			seen[date] = true
+		}
+	}
+	if preset, ok := holidayPresets[s.country]; ok {
+		for _, h := range preset(year) {
+			if !seen[h.Date] {
+				h.Preset = true
+				c.Holidays = append(c.Holidays, h)
+			}
+		}
+	}
+	sort.Slice(c.Holidays, func(i, j int) bool { return c.Holidays[i].Date < c.Holidays[j].Date })
+
+	return c
+}
+
+// Replace replaces the whole calendar
+func (s *holidayStore) Replace(c holidayCalendar) error {
+	s.Lock()
+	defer s.Unlock()
+
+	country, manual := s.country, s.manual
+	s.country = c.Country
+	s.manual = make(map[string]string)
+	for _, h := range c.Holidays {
+		s.manual[h.Date] = h.Name
+	}
+	if err := s.save(); err != nil {
+		s.country, s.manual = country, manual
+		return err
+	}
+	return nil
+}
+
+// Set adds the manual entry for the date, or renames it
+func (s *holidayStore) Set(date, name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, existed := s.manual[date]
+	s.manual[date] = name
+	if err := s.save(); err != nil {
+		if existed {
+			s.manual[date] = previous
+		} else {
+			delete(s.manual, date)
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove removes the manual entry for the date, reporting whether there was one
+func (s *holidayStore) Remove(date string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	name, ok := s.manual[date]
+	if !ok {
+		return false, nil
+	}
+	delete(s.manual, date)
+	if err := s.save(); err != nil {
+		s.manual[date] = name
+		return true, err
+	}
+	return true, nil
+}
+
+// IsHoliday returns whether the day of t is a holiday
+func (s *holidayStore) IsHoliday(t time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	date := t.Format(dateLayout)
+	if _, ok := s.manual[date]; ok {
+		return true
+	}
+	if preset, ok := holidayPresets[s.country]; ok {
+		for _, h := range preset(t.Year()) {
+			if h.Date == date {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reset forgets every holiday
+func (s *holidayStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.country = ""
+	s.manual = make(map[string]string)
+}
+
+// isWeekdayHoliday returns whether the day of t is a holiday that doesn't fall on a weekend
+func isWeekdayHoliday(t time.Time) bool {
+	return t.Weekday() != time.Saturday && t.Weekday() != time.Sunday && holidays.IsHoliday(t)
+}
+
+// cronWildcard is the bit cron marks a field given as * with
+const cronWildcard = 1 << 63
+
+// holidaySchedule is a cron schedule that runs on weekday holidays as it does on weekends: an expression
+// restricted to weekdays skips them, and one that runs on weekends runs on them too
+type holidaySchedule struct {
+	spec *cron.SpecSchedule
+
+	// everyDay runs at the times of spec on every day, which the days spec runs on are picked from
+	everyDay *cron.SpecSchedule
+
+	// holiday is spec run on a weekday holiday, as on the weekend
+	holiday *cron.SpecSchedule
+}
+
+// newHolidaySchedule wraps the parsed cron schedule, so it follows the holiday calendar
+func newHolidaySchedule(spec *cron.SpecSchedule) holidaySchedule {
+	everyDay := *spec
+	everyDay.Dom = 1<<32 - 2 | cronWildcard
+	everyDay.Dow = 1<<7 - 1 | cronWildcard
+
+	holiday := *spec
+	holiday.Dow &= cronWildcard
+	if spec.Dow&(1<<time.Saturday|1<<time.Sunday) != 0 {
+		holiday.Dow |= 1<<7 - 1
+	}
+
+	return holidaySchedule{spec: spec, everyDay: &everyDay, holiday: &holiday}
+}
+
+// Next returns the first time the schedule runs after t, or the zero time when it doesn't run within
+// holidaySearchDays
+func (s holidaySchedule) Next(t time.Time) time.Time {
+	for i := 0; i < holidaySearchDays; i++ {
+		next := s.everyDay.Next(t)
+		if next.IsZero() {
+			return next
+		}
+
+		// cron returns times in the location of the time given, but days are those of the expression
+		day := next.In(s.spec.Location)
+		spec := s.spec
+		if isWeekdayHoliday(day) {
+			spec = s.holiday
+		}
+		if spec.Next(next.Add(-time.Second)).Equal(next) {
+			return next
+		}
+
+		// the day decides for the whole of it, so go on from the end of it
+		t = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, day.Location()).Add(-time.Second)
+	}
+	return time.Time{}
+}
+
+// nthWeekday returns the nth weekday of the month, counting from the end of it when n is negative
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	if n < 0 {
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+		return last.AddDate(0, 0, -((int(last.Weekday())-int(weekday)+7)%7 + 7*(-n-1)))
+	}
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return first.AddDate(0, 0, (int(weekday)-int(first.Weekday())+7)%7+7*(n-1))
+}
+
+// easter returns easter sunday of the year, by the anonymous gregorian algorithm
+func easter(year int) time.Time {
+	a, b, c := year%19, year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+// observed moves a holiday on a saturday to the friday before and one on a sunday to the monday after
+func observed(t time.Time) time.Time {
+	switch t.Weekday() {
+	case time.Saturday:
+		return t.AddDate(0, 0, -1)
+	case time.Sunday:
+		return t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// substitute moves a holiday on a weekend to the next weekday that isn't a holiday already
+func substitute(t time.Time, taken ...time.Time) time.Time {
+	for {
+		free := t.Weekday() != time.Saturday && t.Weekday() != time.Sunday
+		for _, other := range taken {
+			free = free && !t.Equal(other)
+		}
+		if free {
+			return t
+		}
+		t = t.AddDate(0, 0, 1)
+	}
+}
+
+// day returns the holiday on the given day
+func day(t time.Time, name string) holiday {
+	return holiday{Date: t.Format(dateLayout), Name: name}
+}
+
+// usHolidays returns the us federal holidays of the year, on the days they're observed
+func usHolidays(year int) []holiday {
+	date := func(month time.Month, d int) time.Time { return time.Date(year, month, d, 0, 0, 0, 0, time.UTC) }
+	return []holiday{
+		day(observed(date(time.January, 1)), "New Year's Day"),
+		day(nthWeekday(year, time.January, time.Monday, 3), "Martin Luther King Jr. Day"),
+		day(nthWeekday(year, time.February, time.Monday, 3), "Washington's Birthday"),
+		day(nthWeekday(year, time.May, time.Monday, -1), "Memorial Day"),
+		day(observed(date(time.June, 19)), "Juneteenth"),
+		day(observed(date(time.July, 4)), "Independence Day"),
+		day(nthWeekday(year, time.September, time.Monday, 1), "Labor Day"),
+		day(nthWeekday(year, time.October, time.Monday, 2), "Columbus Day"),
+		day(observed(date(time.November, 11)), "Veterans Day"),
+		day(nthWeekday(year, time.November, time.Thursday, 4), "Thanksgiving Day"),
+		day(observed(date(time.December, 25)), "Christmas Day"),
+	}
+}
+
+// caHolidays returns the canadian federal holidays of the year, on the days they're observed
+func caHolidays(year int) []holiday {
+	date := func(month time.Month, d int) time.Time { return time.Date(year, month, d, 0, 0, 0, 0, time.UTC) }
+	christmas := substitute(date(time.December, 25))
+	return []holiday{
+		day(substitute(date(time.January, 1)), "New Year's Day"),
+		day(easter(year).AddDate(0, 0, -2), "Good Friday"),
+		day(victoriaDay(year), "Victoria Day"),
+		day(substitute(date(time.July, 1)), "Canada Day"),
+		day(nthWeekday(year, time.September, time.Monday, 1), "Labour Day"),
+		day(nthWeekday(year, time.October, time.Monday, 2), "Thanksgiving"),
+		day(christmas, "Christmas Day"),
+		day(substitute(date(time.December, 26), christmas), "Boxing Day"),
+	}
+}
+
+// victoriaDay returns the monday before the 25th of may
+func victoriaDay(year int) time.Time {
+	t := time.Date(year, time.May, 24, 0, 0, 0, 0, time.UTC)
+	return t.AddDate(0, 0, -((int(t.Weekday()) - int(time.Monday) + 7) % 7))
+}
+
+// gbHolidays returns the bank holidays of england and wales of the year, on the days they're observed
+func gbHolidays(year int) []holiday {
+	date := func(month time.Month, d int) time.Time { return time.Date(year, month, d, 0, 0, 0, 0, time.UTC) }
+	christmas := substitute(date(time.December, 25))
+	return []holiday{
+		day(substitute(date(time.January, 1)), "New Year's Day"),
+		day(easter(year).AddDate(0, 0, -2), "Good Friday"),
+		day(easter(year).AddDate(0, 0, 1), "Easter Monday"),
+		day(nthWeekday(year, time.May, time.Monday, 1), "Early May Bank Holiday"),
+		day(nthWeekday(year, time.May, time.Monday, -1), "Spring Bank Holiday"),
+		day(nthWeekday(year, time.August, time.Monday, -1), "Summer Bank Holiday"),
+		day(christmas, "Christmas Day"),
+		day(substitute(date(time.December, 26), christmas), "Boxing Day"),
+	}
+}
+
+// calendarChanged moves every scheduled action on to its next run under the changed calendar
+func calendarChanged() {
+	actions.reschedule(clock.Now())
+}
+
+// GetHolidays is the handler to return the holiday calendar of the year given by ?year, this year when
+// none is given
+func GetHolidays(req *fasthttp.RequestCtx) {
+	year := clock.Now().Year()
+	if s := req.QueryArgs().Peek("year"); len(s) > 0 {
+		var err error
+		if year, err = strconv.Atoi(string(s)); err != nil || year < 1 {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Year",
+				Description: "The year '" + string(s) + "' is not valid.",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, holidays.Calendar(year))
+}
+
+// PutHolidays is the handler to replace the holiday calendar, its country preset and manual entries
+func PutHolidays(req *fasthttp.RequestCtx) {
+	var c holidayCalendar
+	if err := unmarshalStrict(req.PostBody(), &c); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	if errRes := validateCalendar(c); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	if err := holidays.Replace(c); err != nil {
+		sendHolidayError(req, err)
+		return
+	}
+	calendarChanged()
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, holidays.Calendar(clock.Now().Year()))
+}
+
+// PutHoliday is the handler to add a manual entry to the holiday calendar, or rename one
+func PutHoliday(req *fasthttp.RequestCtx) {
+	var h holiday
+	if err := unmarshalStrict(req.PostBody(), &h); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	h.Date = req.UserValue("date").(string)
+	if errRes := validateHoliday(h.Date, h.Name); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	if err := holidays.Set(h.Date, h.Name); err != nil {
+		sendHolidayError(req, err)
+		return
+	}
+	calendarChanged()
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, h)
+}
+
+// DeleteHoliday is the handler to remove a manual entry from the holiday calendar
+func DeleteHoliday(req *fasthttp.RequestCtx) {
+	date := req.UserValue("date").(string)
+	found, err := holidays.Remove(date)
+	if err != nil {
+		sendHolidayError(req, err)
+		return
+	}
+	if !found {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "No holiday was added for " + date + ". Holidays of the country preset can't be removed on their own.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+	calendarChanged()
+
+	req.SetStatusCode(http.StatusNoContent)
+}
+
+// sendHolidayError sends back the error of persisting the calendar
+func sendHolidayError(req *fasthttp.RequestCtx, err error) {
+	res := &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Failed to persist holiday calendar",
+		Description: err.Error(),
+	}
+	reportError(req, err)
+	req.SetStatusCode(http.StatusInternalServerError)
+	sendJSON(req, res)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHolidayPresets(t *testing.T) {
+	tests := []struct {
+		country string
+		date    string
+		name    string
+	}{
+		{"US", "2026-01-19", "Martin Luther King Jr. Day"},
+		{"US", "2026-07-03", "Independence Day"},
+		{"US", "2026-11-26", "Thanksgiving Day"},
+		{"CA", "2026-05-18", "Victoria Day"},
+		{"CA", "2026-10-12", "Thanksgiving"},
+		{"GB", "2026-04-03", "Good Friday"},
+		{"GB", "2026-04-06", "Easter Monday"},
+		{"GB", "2026-12-28", "Boxing Day"},
+	}
+
+	for _, tt := range tests {
+		found := false
+		for _, h := range holidayPresets[tt.country](2026) {
+			if h.Date == tt.date {
+				found = h.Name == tt.name
+			}
+		}
+		if !found {
+			t.Fatalf("expected %s to be %s in %s", tt.date, tt.name, tt.country)
+		}
+	}
+}
+
+func TestHolidaySchedule(t *testing.T) {
+	base := newTestServer(t)
+
+	if code := put(base+"/v1/holidays", `{"country": "XX"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an unknown country, got %d", http.StatusBadRequest, code)
+	}
+	if code := put(base+"/v1/holidays/26-11-2026", `{"name": "Thanksgiving"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid date, got %d", http.StatusBadRequest, code)
+	}
+	if code := put(base+"/v1/holidays", `{"country": "US", "holidays": [{"date": "2026-12-24", "name": "Christmas Eve"}]}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d when replacing the calendar, got %d", http.StatusOK, code)
+	}
+	if code := put(base+"/v1/holidays/2026-11-27", `{"name": "Day after Thanksgiving"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d when adding a holiday, got %d", http.StatusOK, code)
+	}
+
+	var c holidayCalendar
+	get(base+"/v1/holidays?year=2026", t, &c)
+	if c.Country != "US" || len(c.Holidays) != 13 {
+		t.Fatalf("expected the 11 us holidays and 2 added ones, got %+v", c)
+	}
+	for _, h := range c.Holidays {
+		if manual := h.Date == "2026-12-24" || h.Date == "2026-11-27"; manual == h.Preset {
+			t.Fatalf("expected only the holidays of the country to be preset, got %+v", h)
+		}
+	}
+
+	// thanksgiving and the day after it are run as weekend days
+	weekdays, _ := parseCron("CRON_TZ=UTC 0 7 * * 1-5")
+	weekends, _ := parseCron("CRON_TZ=UTC 0 9 * * 0,6")
+	from := time.Date(2026, 11, 25, 8, 0, 0, 0, time.UTC)
+	if next := weekdays.Next(from); !next.Equal(time.Date(2026, 11, 30, 7, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the weekday schedule to skip the holidays, got %s", next)
+	}
+	if next := weekends.Next(from); !next.Equal(time.Date(2026, 11, 26, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the weekend schedule to run on the holiday, got %s", next)
+	}
+
+	if code := del(base+"/v1/holidays/2026-11-26", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d when removing a preset holiday, got %d", http.StatusNotFound, code)
+	}
+	if code := del(base+"/v1/holidays/2026-11-27", t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected status %d when removing a holiday, got %d", http.StatusNoContent, code)
+	}
+	if next := weekdays.Next(from); !next.Equal(time.Date(2026, 11, 27, 7, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the weekday schedule to run the day after thanksgiving again, got %s", next)
+	}
+}
+
+func TestHolidayReschedulesActions(t *testing.T) {
+	base := newTestServer(t)
+
+	_, a := postAction(base, `{"thermostatId": 1, "cron": "CRON_TZ=UTC 0 7 * * 1-5", "update": {"heatSetPoint": 66}}`, t)
+	first := a.NextRuns[0]
+	if code := put(base+"/v1/holidays/"+first.UTC().Format(dateLayout), `{"name": "Day off"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d when adding a holiday, got %d", http.StatusOK, code)
+	}
+
+	get(base+"/v1/actions/1", t, &a)
+	if !a.NextRuns[0].After(first) {
+		t.Fatalf("expected the action to skip the new holiday, got %s", a.NextRuns[0])
+	}
+}
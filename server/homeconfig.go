@@ -0,0 +1,424 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// the operations a change of a configuration being applied is made by
+const (
+	configCreate = "create"
+	configUpdate = "update"
+	configDelete = "delete"
+)
+
+// the kinds of resources a configuration manages
+const (
+	configThermostat = "thermostat"
+	configActions    = "actions"
+	configGroup      = "group"
+	configHolidays   = "holidays"
+)
+
+// homeConfig is the declarative configuration of the home, returned through the api @ /v1/home/config and
+// applied by a PUT to it, e.g. from a git repository. Applying a configuration converges the home on it:
+// thermostats are matched by name, added when missing and updated when they differ, while the groups, the
+// holiday calendar and the scheduled actions of every thermostat are replaced by those of the
+// configuration. Applying the same configuration twice changes nothing the second time
+type homeConfig struct {
+	Thermostats []thermostatConfig       `json:"thermostats"`
+	Groups      map[string]groupSettings `json:"groups"`
+	Holidays    holidayCalendar          `json:"holidays"`
+}
+
+// thermostatConfig is the configuration of a thermostat. Settings it inherits from its groups are left out,
+// and settings that are left out are left as they are when it's applied
+type thermostatConfig struct {
+	Name          string         `json:"name"`
+	OperatingMode string         `json:"mode,omitempty"`
+	CoolSetPoint  int            `json:"coolSetPoint,omitempty"`
+	HeatSetPoint  int            `json:"heatSetPoint,omitempty"`
+	FanMode       string         `json:"fan,omitempty"`
+	Tags          []string       `json:"tags,omitempty"`
+	Location      *location      `json:"location,omitempty"`
+	Disabled      bool           `json:"disabled,omitempty"`
+	Actions       []actionConfig `json:"actions,omitempty"`
+}
+
+// actionConfig is a scheduled action in the configuration of a thermostat
+type actionConfig struct {
+	Cron   string           `json:"cron,omitempty"`
+	Sun    string           `json:"sun,omitempty"`
+	Offset string           `json:"offset,omitempty"`
+	Update updateThermostat `json:"update"`
+}
+
+// configChange is a change made to converge the home on a configuration
+type configChange struct {
+	Op   string `json:"op"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// configPlan is returned through the api @ /v1/home/config, listing the changes made to converge the home
+// on a configuration, or those that would be made with ?dryRun=true. Unmanaged are the names of the
+// thermostats the configuration leaves out, which are left as they are
+type configPlan struct {
+	Changes   []configChange `json:"changes"`
+	Unmanaged []string       `json:"unmanaged,omitempty"`
+	DryRun    bool           `json:"dryRun"`
+}
+
+// configOf returns the configuration of the thermostat, leaving out the settings it inherits from its groups
+func configOf(t *thermostat) thermostatConfig {
+	settings := settingsOf(t)
+	_, sources := groups.Inherited(t.Tags)
+	for name, group := range sources {
+		if group != "" && !inArray(name, t.Overrides) {
+			settings.copySetting(name, groupSettings{})
+		}
+	}
+
+	c := thermostatConfig{
+		Name:          t.Name,
+		OperatingMode: settings.OperatingMode,
+		CoolSetPoint:  settings.CoolSetPoint,
+		HeatSetPoint:  settings.HeatSetPoint,
+		FanMode:       settings.FanMode,
+		Tags:          t.Tags,
+		Location:      t.Location,
+		Disabled:      t.Disabled,
+	}
+	for _, a := range actions.Actions(t.ID) {
+		c.Actions = append(c.Actions, actionConfig{Cron: a.Cron, Sun: a.Sun, Offset: a.Offset, Update: a.Update})
+	}
+	return c
+}
+
+// exportConfig returns the configuration of the home
+func exportConfig() homeConfig {
+	c := homeConfig{
+		Thermostats: []thermostatConfig{},
+		Groups:      make(map[string]groupSettings),
+		Holidays:    holidays.Manual(),
+	}
+	for _, t := range home.Thermostats() {
+		c.Thermostats = append(c.Thermostats, configOf(t))
+	}
+	for _, name := range groups.Names() {
+		c.Groups[name], _ = groups.Settings(name)
+	}
+	return c
+}
+
+// update returns the desired state the thermostat is updated to by its configuration. The tags and location
+// are always given, so those left out are removed
+func (c thermostatConfig) update() updateThermostat {
+	desired := updateThermostat{
+		Name:          c.Name,
+		OperatingMode: c.OperatingMode,
+		CoolSetPoint:  c.CoolSetPoint,
+		HeatSetPoint:  c.HeatSetPoint,
+		FanMode:       c.FanMode,
+		Tags:          c.Tags,
+		Location:      c.Location,
+	}
+	if desired.Tags == nil {
+		desired.Tags = []string{}
+	}
+	if desired.Location == nil {
+		desired.Location = &location{}
+	}
+	return desired
+}
+
+// differs reports whether the configuration would change anything of the thermostat apart from its actions
+// and whether it's enabled
+func (c thermostatConfig) differs(t *thermostat) bool {
+	given := groupSettings{OperatingMode: c.OperatingMode, CoolSetPoint: c.CoolSetPoint, HeatSetPoint: c.HeatSetPoint, FanMode: c.FanMode}
+	current := settingsOf(t)
+	for _, name := range given.names() {
+		if given.only([]string{name}) != current.only([]string{name}) {
+			return true
+		}
+	}
+	if len(c.Tags) != len(t.Tags) || len(c.Tags) > 0 && !reflect.DeepEqual(c.Tags, t.Tags) {
+		return true
+	}
+
+	// an empty location is no location
+	l := c.Location
+	if l != nil && *l == (location{}) {
+		l = nil
+	}
+	return !reflect.DeepEqual(l, t.Location)
+}
+
+// sameActions reports whether the actions are configured the same
+func sameActions(a, b []actionConfig) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+// parseActions validates the actions of the configuration of a thermostat, returning them with their
+// schedules parsed
+func (c thermostatConfig) parseActions(user string) ([]scheduledAction, *errResponse) {
+	parsed := make([]scheduledAction, 0, len(c.Actions))
+	for _, ac := range c.Actions {
+		a := scheduledAction{Cron: ac.Cron, Sun: ac.Sun, Offset: ac.Offset, Update: ac.Update}
+		schedule, errRes := parseTrigger(a)
+		if errRes == nil {
+			errRes = validateData(a.Update)
+		}
+		if errRes == nil {
+			errRes = checkUserRange(user, a.Update.HeatSetPoint, a.Update.CoolSetPoint)
+		}
+		if errRes != nil {
+			return nil, errRes
+		}
+		a.schedule = schedule
+		parsed = append(parsed, a)
+	}
+	return parsed, nil
+}
+
+// invalidConfig builds the error response for a configuration that can't be applied
+func invalidConfig(code int, description string) *errResponse {
+	return &errResponse{
+		Code:        code,
+		Msg:         "Invalid Configuration",
+		Description: description,
+	}
+}
+
+// planConfig validates the configuration as the user and plans the changes that converge the home on it,
+// returning the steps that make them. Nothing is changed until the steps are run
+func planConfig(c homeConfig, user string) (configPlan, []func() error, *errResponse) {
+	plan := configPlan{Changes: []configChange{}}
+	var steps []func() error
+	change := func(op, kind, name string, step func() error) {
+		plan.Changes = append(plan.Changes, configChange{Op: op, Kind: kind, Name: name})
+		steps = append(steps, step)
+	}
+
+	// the holiday calendar goes first, so the actions are scheduled under it
+	if errRes := validateCalendar(c.Holidays); errRes != nil {
+		return plan, nil, errRes
+	}
+	if c.Holidays.Holidays == nil {
+		c.Holidays.Holidays = []holiday{}
+	}
+	for i := range c.Holidays.Holidays {
+		c.Holidays.Holidays[i].Preset = false
+	}
+	sort.Slice(c.Holidays.Holidays, func(i, j int) bool { return c.Holidays.Holidays[i].Date < c.Holidays.Holidays[j].Date })
+	if !reflect.DeepEqual(c.Holidays, holidays.Manual()) {
+		change(configUpdate, configHolidays, "", func() error {
+			if err := holidays.Replace(c.Holidays); err != nil {
+				return err
+			}
+			calendarChanged()
+			return nil
+		})
+	}
+
+	// then the groups, so thermostats join the groups they are configured with
+	for _, name := range sortedNames(c.Groups) {
+		settings := c.Groups[name]
+		if errRes := validateTags([]string{name}); errRes != nil {
+			return plan, nil, errRes
+		}
+		if len(settings.names()) == 0 {
+			return plan, nil, invalidConfig(http.StatusBadRequest, "The group '"+name+"' must define at least one of "+listChoices(groupSettingNames)+".")
+		}
+		if errRes := validateData(settings.update()); errRes != nil {
+			return plan, nil, errRes
+		}
+		if errRes := checkUserRange(user, settings.HeatSetPoint, settings.CoolSetPoint); errRes != nil {
+			return plan, nil, errRes
+		}
+
+		current, ok := groups.Settings(name)
+		if ok && current == settings {
+			continue
+		}
+		op := configUpdate
+		if !ok {
+			op = configCreate
+		}
+		name := name
+		change(op, configGroup, name, func() error {
+			if err := groups.Set(name, settings); err != nil {
+				return err
+			}
+			inheritGroup(name)
+			return nil
+		})
+	}
+	for _, name := range groups.Names() {
+		if _, ok := c.Groups[name]; !ok {
+			name := name
+			change(configDelete, configGroup, name, func() error {
+				if _, err := groups.Remove(name); err != nil {
+					return err
+				}
+				inheritGroup(name)
+				return nil
+			})
+		}
+	}
+
+	// thermostats are matched by name, so every name has to pick out a single one
+	byName := make(map[string][]*thermostat)
+	for _, t := range home.Thermostats() {
+		byName[t.Name] = append(byName[t.Name], t)
+	}
+	configured := make(map[string]bool)
+	for _, tc := range c.Thermostats {
+		if tc.Name == "" {
+			return plan, nil, invalidConfig(http.StatusBadRequest, "Every thermostat must be given a name, which it's matched by.")
+		}
+		if configured[tc.Name] {
+			return plan, nil, invalidConfig(http.StatusBadRequest, "The thermostat '"+tc.Name+"' is configured more than once.")
+		}
+		configured[tc.Name] = true
+		if len(byName[tc.Name]) > 1 {
+			return plan, nil, invalidConfig(http.StatusConflict, "The name '"+tc.Name+"' is shared by "+strconv.Itoa(len(byName[tc.Name]))+" thermostats, so it can't tell which one is configured. Rename all but one of them first.")
+		}
+
+		desired := tc.update()
+		if errRes := validateData(desired); errRes != nil {
+			return plan, nil, errRes
+		}
+		if errRes := checkUserRange(user, desired.HeatSetPoint, desired.CoolSetPoint); errRes != nil {
+			return plan, nil, errRes
+		}
+		parsed, errRes := tc.parseActions(user)
+		if errRes != nil {
+			return plan, nil, errRes
+		}
+
+		tc := tc
+		if len(byName[tc.Name]) == 0 {
+			change(configCreate, configThermostat, tc.Name, func() error {
+				id, err := home.AddThermostat(desired)
+				if err != nil {
+					return err
+				}
+				if tc.Disabled {
+					t, _ := home.Thermostat(id)
+					if _, err := home.SetEnabled(t, false); err != nil {
+						return err
+					}
+				}
+				if len(parsed) > 0 {
+					_, err := actions.Replace(id, parsed)
+					return err
+				}
+				return nil
+			})
+			continue
+		}
+
+		id := byName[tc.Name][0].ID
+		current := byName[tc.Name][0]
+		if tc.differs(current) || tc.Disabled != current.Disabled {
+			change(configUpdate, configThermostat, tc.Name, func() error {
+				t, _ := home.Thermostat(id)
+				var err error
+				if t.Disabled {
+					if t, err = home.SetEnabled(t, true); err != nil {
+						return err
+					}
+				}
+				if tc.differs(t) {
+					if t, err = home.UpdateThermostat(t, desired); err != nil {
+						return err
+					}
+				}
+				if tc.Disabled {
+					_, err = home.SetEnabled(t, false)
+				}
+				return err
+			})
+		}
+		if !sameActions(tc.Actions, configOf(current).Actions) {
+			change(configUpdate, configActions, tc.Name, func() error {
+				_, err := actions.Replace(id, parsed)
+				return err
+			})
+		}
+	}
+
+	// thermostats can't be removed through the api, so those left out are only reported
+	for _, t := range home.Thermostats() {
+		if !configured[t.Name] {
+			plan.Unmanaged = append(plan.Unmanaged, t.Name)
+		}
+	}
+
+	return plan, steps, nil
+}
+
+// sortedNames returns the names of the groups in order
+func sortedNames(m map[string]groupSettings) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetHomeConfig is the handler to export the configuration of the home as a declarative document
+func GetHomeConfig(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, exportConfig())
+}
+
+// PutHomeConfig is the handler to converge the home on a declarative configuration, returning the changes
+// made. With ?dryRun=true the changes are only planned
+func PutHomeConfig(req *fasthttp.RequestCtx) {
+	var c homeConfig
+	if err := unmarshalStrict(req.PostBody(), &c); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// everything is validated before anything is changed
+	plan, steps, errRes := planConfig(c, requestUser(req))
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	plan.DryRun = string(req.QueryArgs().Peek("dryRun")) == "true"
+	if !plan.DryRun {
+		for i, step := range steps {
+			if err := step(); err != nil {
+				res := &errResponse{
+					Code:        http.StatusInternalServerError,
+					Msg:         "Failed to apply configuration",
+					Description: "The " + plan.Changes[i].Kind + " '" + plan.Changes[i].Name + "' failed to be persisted with error: " + err.Error(),
+				}
+				reportError(req, err)
+				req.SetStatusCode(http.StatusInternalServerError)
+				sendJSON(req, res)
+				return
+			}
+		}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, plan)
+}
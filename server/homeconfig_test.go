@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// putConfig applies the configuration at url, returning the status code and the plan of the changes
+func putConfig(url string, c homeConfig, t *testing.T) (int, configPlan) {
+	body, _ := json.Marshal(c)
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var plan configPlan
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+			t.Fatalf("failed to decode the plan: %s", err)
+		}
+	}
+	return resp.StatusCode, plan
+}
+
+func TestHomeConfig(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/home/config"
+
+	// the exported configuration is what the home already is
+	var c homeConfig
+	get(url, t, &c)
+	if len(c.Thermostats) != len(home.Thermostats()) {
+		t.Fatalf("expected every thermostat to be exported, got %+v", c)
+	}
+	if code, plan := putConfig(url, c, t); code != http.StatusOK || len(plan.Changes) != 0 {
+		t.Fatalf("expected applying the export to change nothing, got %d %+v", code, plan)
+	}
+
+	first := c.Thermostats[0].Name
+	c.Groups["floor:2"] = groupSettings{OperatingMode: "heat"}
+	c.Holidays.Country = "US"
+	c.Thermostats[0].OperatingMode = ""
+	c.Thermostats[0].HeatSetPoint = 64
+	c.Thermostats[0].Tags = []string{"floor:2"}
+	c.Thermostats[0].Actions = []actionConfig{{Cron: "0 6 * * *", Update: updateThermostat{HeatSetPoint: 68}}}
+	c.Thermostats = append(c.Thermostats, thermostatConfig{Name: "Garage", Disabled: true})
+
+	// a dry run only plans the changes
+	code, plan := putConfig(url+"?dryRun=true", c, t)
+	if code != http.StatusOK || !plan.DryRun || len(plan.Changes) != 5 {
+		t.Fatalf("expected 5 planned changes, got %d %+v", code, plan)
+	}
+	if _, ok := groups.Settings("floor:2"); ok {
+		t.Fatal("expected a dry run not to change anything")
+	}
+
+	code, plan = putConfig(url, c, t)
+	if code != http.StatusOK || plan.DryRun || len(plan.Changes) != 5 {
+		t.Fatalf("expected 5 changes to be made, got %d %+v", code, plan)
+	}
+	var therm, garage *thermostat
+	for _, th := range home.Thermostats() {
+		switch th.Name {
+		case first:
+			therm = th
+		case "Garage":
+			garage = th
+		}
+	}
+	if therm.OperatingMode != "heat" || therm.HeatSetPoint != 64 || len(actions.Actions(therm.ID)) != 1 {
+		t.Fatalf("expected thermostat %q to be configured, got %+v", first, therm)
+	}
+	if garage == nil || !garage.Disabled {
+		t.Fatalf("expected a disabled garage thermostat to be added, got %+v", garage)
+	}
+	if holidays.Manual().Country != "US" {
+		t.Fatal("expected the holiday calendar to be configured")
+	}
+
+	// applying it again converges on the same home, and the export gives it back
+	if code, plan := putConfig(url, c, t); code != http.StatusOK || len(plan.Changes) != 0 {
+		t.Fatalf("expected applying the configuration again to change nothing, got %d %+v", code, plan)
+	}
+	var exported homeConfig
+	get(url, t, &exported)
+	if code, plan := putConfig(url, exported, t); code != http.StatusOK || len(plan.Changes) != 0 {
+		t.Fatalf("expected applying the new export to change nothing, got %d %+v", code, plan)
+	}
+	if exported.Thermostats[0].OperatingMode != "" {
+		t.Fatalf("expected the mode inherited from the group to be left out, got %+v", exported.Thermostats[0])
+	}
+
+	// groups left out are removed, and thermostats left out are reported
+	delete(c.Groups, "floor:2")
+	c.Thermostats = c.Thermostats[1:]
+	code, plan = putConfig(url, c, t)
+	if code != http.StatusOK || len(plan.Changes) != 1 || plan.Changes[0].Op != configDelete || len(plan.Unmanaged) != 1 || plan.Unmanaged[0] != first {
+		t.Fatalf("expected the group to be removed and %q to be unmanaged, got %d %+v", first, code, plan)
+	}
+
+	c.Thermostats = append(c.Thermostats, thermostatConfig{Name: "Garage"})
+	if code, _ := putConfig(url, c, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a thermostat configured twice, got %d", http.StatusBadRequest, code)
+	}
+}
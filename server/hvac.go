@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the operating states of the equipment of a thermostat
+const (
+	hvacIdle    = "idle"
+	hvacHeating = "heating"
+	hvacCooling = "cooling"
+	hvacFanOnly = "fan-only"
+
+	// hvacLockout is waiting out -hvac-min-off after a cycle before heating or cooling again, which protects
+	// compressors from short cycling
+	hvacLockout = "lockout"
+)
+
+// lockoutInterval is how often the thermostats are checked for a lockout that is over
+const lockoutInterval = time.Second
+
+// hvacTransition is the move of a thermostat from one operating state to another
+type hvacTransition struct {
+	thermostat *thermostat
+	from       string
+}
+
+// hvacDemand returns whether the equipment of the thermostat has to heat or cool to reach its setpoints,
+// or an empty string when it doesn't
+func hvacDemand(t *thermostat) string {
+	if t.Disabled {
+		return ""
+	}
+
+	switch {
+	case t.OperatingMode == "heat" && t.CurrentTemp < t.HeatSetPoint:
+		return hvacHeating
+	case t.OperatingMode == "cool" && t.CurrentTemp > t.CoolSetPoint:
+		return hvacCooling
+	}
+	return ""
+}
+
+// hvacStage returns the stage the equipment runs in for the given state: the second stage once the
+// temperature is -second-stage-delta from the setpoint, unless it's quiet hours or the
+// equipment is installed as single-stage, the first otherwise and none when it isn't heating or cooling
+func hvacStage(t *thermostat, state string) int {
+	var gap int
+	switch state {
+	case hvacHeating:
+		gap = t.HeatSetPoint - t.CurrentTemp
+	case hvacCooling:
+		gap = t.CurrentTemp - t.CoolSetPoint
+	default:
+		return 0
+	}
+
+	if cfg.SecondStageDelta > 0 && gap >= cfg.SecondStageDelta && !t.Quiet && installerStages(t.ID) > 1 {
+		return 2
+	}
+	return 1
+}
+
+// runHVAC moves the updated thermostat on from the operating state of the record it replaces, which is nil
+// for new thermostats, returning the transition or nil when the state stays the same. Heating and cooling
+// run until the setpoint is reached, after which the equipment is locked out for -hvac-min-off
+func runHVAC(previous, updated *thermostat, now time.Time) *hvacTransition {
+	var from string
+	if previous != nil {
+		from = previous.HVACState
+		updated.HVACState = previous.HVACState
+		updated.HVACSince = previous.HVACSince
+		updated.CycleEnded = previous.CycleEnded
+	}
+
+	demand := hvacDemand(updated)
+	to := demand
+	switch {
+	case demand == "" && updated.FanMode == "on" && !updated.Disabled && !updated.Quiet:
+		to = hvacFanOnly
+	case demand == "":
+		to = hvacIdle
+	}
+
+	running := from == hvacHeating || from == hvacCooling
+	if running && to != from {
+		updated.CycleEnded = &now
+	}
+	if demand != "" && demand != from && updated.CycleEnded != nil && now.Sub(*updated.CycleEnded) < cfg.HVACMinOff {
+		to = hvacLockout
+	}
+
+	updated.HVACStage = hvacStage(updated, to)
+
+	if to == from {
+		return nil
+	}
+	updated.HVACState = to
+	updated.HVACSince = &now
+
+	return &hvacTransition{thermostat: updated, from: from}
+}
+
+// runHVACs moves every changed thermostat on from the operating state of the record it replaces
+func (home *currentState) runHVACs(changed []*thermostat) []*hvacTransition {
+	home.Lock()
+	defer home.Unlock()
+
+	now := clock.Now()
+	var transitions []*hvacTransition
+	for _, t := range changed {
+		if tr := runHVAC(home.thermostats[t.ID], t, now); tr != nil {
+			transitions = append(transitions, tr)
+		}
+	}
+	return transitions
+}
+
+// publishHVAC publishes the transitions, counting them for the metrics. New thermostats have nothing to
+// transition from
+func publishHVAC(transitions []*hvacTransition) {
+	for _, tr := range transitions {
+		if tr.from == "" {
+			continue
+		}
+
+		hvacStats.count(tr.from, tr.thermostat.HVACState)
+		detail := "Thermostat " + strconv.Itoa(tr.thermostat.ID) + " went from " + tr.from + " to " + tr.thermostat.HVACState + "."
+		publishDetail(eventHVAC, tr.thermostat, severityInfo, detail)
+	}
+}
+
+// releaseLockouts lets the thermostats whose lockout is over heat or cool again until stop is closed. Only
+// the leader writes, as with every other automated change, and nothing is written while read-only
+func releaseLockouts(interval time.Duration, stop <-chan struct{}) {
+	for clock.sleep(interval, stop) {
+		if !cluster.IsLeader() || checkReadOnly() != nil {
+			continue
+		}
+		releaseDueLockouts(clock.Now())
+	}
+}
+
+// releaseDueLockouts lets the equipment of every thermostat whose minimum off time is over by now run again
+func releaseDueLockouts(now time.Time) {
+	for _, t := range home.Thermostats() {
+		if t.HVACState == hvacLockout && now.Sub(*t.CycleEnded) >= cfg.HVACMinOff {
+			_, err := retryChanged(t, func(current *thermostat) (*thermostat, error) {
+				// thermostats are never modified in place, so work on a copy
+				updated := *current
+				transitions, err := home.commit(changeHVAC, &updated)
+				if err != nil {
+					return nil, err
+				}
+				publishHVAC(transitions)
+				return &updated, nil
+			})
+			if err != nil {
+				log.Println("failed to release the lockout of thermostat", t.ID, "with error:", err)
+			}
+		}
+	}
+}
+
+// hvacCounter counts the transitions between the operating states, by the states they go from and to
+type hvacCounter struct {
+	sync.Mutex
+	transitions map[[2]string]uint64
+}
+
+var hvacStats = &hvacCounter{transitions: make(map[[2]string]uint64)}
+
+// count counts a single transition
+func (c *hvacCounter) count(from, to string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.transitions[[2]string{from, to}]++
+}
+
+// reset forgets every transition
+func (c *hvacCounter) reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.transitions = make(map[[2]string]uint64)
+}
+
+func init() {
+	prometheus.MustRegister(hvacCollector{})
+}
+
+var (
+	hvacStateDesc = prometheus.NewDesc("thermostat_hvac_state",
+		"Number of thermostats in an operating state: idle, heating, cooling, fan-only or lockout",
+		[]string{"state"}, nil)
+	hvacTransitionsDesc = prometheus.NewDesc("thermostat_hvac_transitions_total",
+		"Transitions of thermostats from one operating state to another",
+		[]string{"from", "to"}, nil)
+)
+
+// hvacCollector exports the operating states of the thermostats to prometheus
+type hvacCollector struct{}
+
+// Describe implements the prometheus.Collector interface
+func (hvacCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hvacStateDesc
+	ch <- hvacTransitionsDesc
+}
+
+// Collect implements the prometheus.Collector interface
+func (hvacCollector) Collect(ch chan<- prometheus.Metric) {
+	states := map[string]int{hvacIdle: 0, hvacHeating: 0, hvacCooling: 0, hvacFanOnly: 0, hvacLockout: 0}
+	for _, t := range home.Thermostats() {
+		if t.HVACState != "" {
+			states[t.HVACState]++
+		}
+	}
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(hvacStateDesc, prometheus.GaugeValue, float64(n), state)
+	}
+
+	hvacStats.Lock()
+	defer hvacStats.Unlock()
+
+	for key, n := range hvacStats.transitions {
+		ch <- prometheus.MustNewConstMetric(hvacTransitionsDesc, prometheus.CounterValue, float64(n), key[0], key[1])
+	}
+}
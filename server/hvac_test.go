@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHVAC(t *testing.T) {
+	newTestServer(t, func(c *config) {
+		c.HVACMinOff = time.Minute
+	})
+
+	start := time.Now()
+	steps := []struct {
+		after time.Duration
+		mode  string
+		fan   string
+		temp  int
+		state string
+	}{
+		{0, "heat", "auto", 65, hvacHeating},
+		{time.Minute, "heat", "auto", 66, hvacHeating},
+		{2 * time.Minute, "heat", "auto", 68, hvacIdle},
+		{150 * time.Second, "heat", "auto", 66, hvacLockout},
+		{3*time.Minute + time.Second, "heat", "auto", 66, hvacHeating},
+		{4 * time.Minute, "cool", "auto", 66, hvacIdle},
+		{5 * time.Minute, "off", "on", 66, hvacFanOnly},
+	}
+
+	current := &thermostat{ID: 1, OperatingMode: "off", FanMode: "auto", HeatSetPoint: 68, CoolSetPoint: 74}
+	runHVAC(nil, current, start)
+	for i, step := range steps {
+		updated := *current
+		updated.OperatingMode, updated.FanMode, updated.CurrentTemp = step.mode, step.fan, step.temp
+		runHVAC(current, &updated, start.Add(step.after))
+		if updated.HVACState != step.state {
+			t.Fatalf("expected step %d to be %s, got %s", i, step.state, updated.HVACState)
+		}
+		current = &updated
+	}
+	if current.CycleEnded == nil || !current.CycleEnded.Equal(start.Add(4*time.Minute)) {
+		t.Fatalf("expected the last cycle to end when the mode changed, got %v", current.CycleEnded)
+	}
+}
+
+func TestHVACTransitions(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.HVACMinOff = 0
+	})
+
+	target, _ := home.Thermostat(1)
+	target, _ = home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+	heating, _ := home.RecordTemp(target, 60)
+	if heating.HVACState != hvacHeating || heating.HVACSince == nil {
+		t.Fatalf("expected the thermostat to be heating, got %s", heating.HVACState)
+	}
+	if idle, _ := home.RecordTemp(heating, 70); idle.HVACState != hvacIdle || idle.CycleEnded == nil {
+		t.Fatalf("expected the thermostat to be idle once the setpoint was reached, got %s", idle.HVACState)
+	}
+
+	var th thermostat
+	get(base+"/v1/thermostats/1", t, &th)
+	if th.HVACState != hvacIdle {
+		t.Fatalf("expected the hvacState field to be idle, got %q", th.HVACState)
+	}
+
+	resp, err := http.Get(base + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get the metrics: %s", err)
+	}
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// the first thermostat starts out heating, until the update moves its setpoints
+	for _, line := range []string{
+		`thermostat_hvac_state{state="heating"} 0`,
+		`thermostat_hvac_transitions_total{from="idle",to="heating"} 1`,
+		`thermostat_hvac_transitions_total{from="heating",to="idle"} 2`,
+	} {
+		if !strings.Contains(string(metrics), line) {
+			t.Fatalf("expected the metrics to contain %s, got:\n%s", line, metrics)
+		}
+	}
+}
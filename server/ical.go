@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// icalDays is how many days ahead the runs of actions without a recurrence rule are exported, unless
+	// ?days is given
+	icalDays = 7
+
+	// icalMaxDays is the most days ahead the runs of those actions can be exported
+	icalMaxDays = 31
+
+	// icalUpdateProp is the property the update of an action is exported in, so importing an export gets
+	// back the very same update
+	icalUpdateProp = "X-THERMOSTAT-UPDATE"
+
+	// icalSleepProp is the property the sleep profile of the thermostat is exported in, marking the event of
+	// its sleep window
+	icalSleepProp = "X-THERMOSTAT-SLEEP"
+
+	icalTimeLayout = "20060102T150405"
+	icalLineLimit  = 75
+)
+
+// icalWeekdays are the days of the week as written by recurrence rules
+var icalWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// skippedEvent is an event of an imported calendar that couldn't be turned into a scheduled action
+type skippedEvent struct {
+	UID     string `json:"uid,omitempty"`
+	Summary string `json:"summary,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// scheduleImport is the result of importing a calendar, returned through the api @
+// /v1/thermostats/:id/schedule
+type scheduleImport struct {
+	Actions []scheduledAction `json:"actions"`
+	Skipped []skippedEvent    `json:"skipped"`
+}
+
+// icalProp is a single content line of a calendar
+type icalProp struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// icalEscape escapes a text value
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// icalUnescape reverses icalEscape
+func icalUnescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// icalFold writes the content line, folded at the line limit as calendars require
+func icalFold(b *strings.Builder, line string) {
+	for len(line) > icalLineLimit {
+		cut := icalLineLimit
+		// don't split a multi-byte character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// icalTime formats the time in the location of the schedule it comes from: utc times end in Z, times in
+// the local time of the server are floating and any other zone is named by TZID
+func icalTime(name string, t time.Time) string {
+	switch t.Location() {
+	case time.UTC:
+		return name + ":" + t.Format(icalTimeLayout) + "Z"
+	case time.Local:
+		return name + ":" + t.Format(icalTimeLayout)
+	}
+	return name + ";TZID=" + t.Location().String() + ":" + t.Format(icalTimeLayout)
+}
+
+// describeUpdate describes the update of an action, e.g. 'Mode heat, Heat 68', which parseSummary reads back
+func describeUpdate(u updateThermostat) string {
+	var parts []string
+	if u.OperatingMode != "" {
+		parts = append(parts, "Mode "+u.OperatingMode)
+	}
+	if u.HeatSetPoint != 0 {
+		parts = append(parts, "Heat "+strconv.Itoa(u.HeatSetPoint))
+	}
+	if u.CoolSetPoint != 0 {
+		parts = append(parts, "Cool "+strconv.Itoa(u.CoolSetPoint))
+	}
+	if u.FanMode != "" {
+		parts = append(parts, "Fan "+u.FanMode)
+	}
+	if len(parts) == 0 {
+		return "No change"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseSummary reads the update described by the summary of an event, as written by describeUpdate
+func parseSummary(summary string) (updateThermostat, string) {
+	var u updateThermostat
+	for _, part := range strings.Split(summary, ",") {
+		fields := strings.Fields(strings.ToLower(part))
+		if len(fields) != 2 {
+			return u, "the summary '" + summary + "' is not a list of settings such as 'Heat 68, Cool 74'"
+		}
+
+		var err error
+		switch fields[0] {
+		case "mode":
+			u.OperatingMode = fields[1]
+		case "fan":
+			u.FanMode = fields[1]
+		case "heat":
+			u.HeatSetPoint, err = strconv.Atoi(fields[1])
+		case "cool":
+			u.CoolSetPoint, err = strconv.Atoi(fields[1])
+		default:
+			return u, "the summary has an unknown setting '" + fields[0] + "'; valid ones are mode, heat, cool and fan"
+		}
+		if err != nil {
+			return u, "the set point '" + fields[1] + "' is not a number"
+		}
+	}
+	return u, ""
+}
+
+// recurrence returns the recurrence rule and first run of the action, or an empty rule when its schedule
+// can't be written as one: only expressions that run once a day at a fixed time on some days of the week
+// can
+func recurrence(a scheduledAction, now time.Time) (string, time.Time) {
+	hs, ok := a.schedule.(holidaySchedule)
+	if !ok {
+		return "", time.Time{}
+	}
+	spec := hs.spec
+	if spec.Second != 1 || bits.OnesCount64(spec.Minute) != 1 || bits.OnesCount64(spec.Hour) != 1 ||
+		spec.Dom&cronWildcard == 0 || spec.Month&cronWildcard == 0 {
+		return "", time.Time{}
+	}
+
+	// cron returns times in the location of the time given, not the one of the expression
+	first := a.schedule.Next(now).In(spec.Location)
+	if spec.Dow&cronWildcard != 0 {
+		return "FREQ=DAILY", first
+	}
+	var days []string
+	for d, name := range icalWeekdays {
+		if spec.Dow&(1<<uint(d)) != 0 {
+			days = append(days, name)
+		}
+	}
+	return "FREQ=WEEKLY;BYDAY=" + strings.Join(days, ","), first
+}
+
+// exportSchedule writes the scheduled actions of the thermostat as a calendar. Every run is an event
+// lasting until the next run of any action of the thermostat, so the calendar shows the periods the
+// setpoints hold for. Actions that can be written as a recurrence rule are a single recurring event, the
+// others, e.g. those anchored to the sun, an event for every run within the given days. The window of the
+// sleep profile is a daily event too
+func exportSchedule(t *thermostat, now time.Time, days int) string {
+	own := actions.Actions(t.ID)
+
+	// until returns when the setpoints set at the given run are changed by the next run of any action
+	until := func(run time.Time) time.Time {
+		var next time.Time
+		for _, a := range own {
+			if n := a.schedule.Next(run); !n.IsZero() && (next.IsZero() || n.Before(next)) {
+				next = n
+			}
+		}
+		return next.In(run.Location())
+	}
+
+	var b strings.Builder
+	icalFold(&b, "BEGIN:VCALENDAR")
+	icalFold(&b, "VERSION:2.0")
+	icalFold(&b, "PRODID:-//thermostat-project//"+icalEscape(cfg.Home)+"//EN")
+	icalFold(&b, "X-WR-CALNAME:"+icalEscape(t.Name))
+
+	stamp := now.UTC().Format(icalTimeLayout) + "Z"
+	event := func(uid string, start time.Time, rule string, a scheduledAction) {
+		update, _ := json.Marshal(a.Update)
+
+		icalFold(&b, "BEGIN:VEVENT")
+		icalFold(&b, "UID:"+uid)
+		icalFold(&b, "DTSTAMP:"+stamp)
+		icalFold(&b, icalTime("DTSTART", start))
+		icalFold(&b, icalTime("DTEND", until(start)))
+		if rule != "" {
+			icalFold(&b, "RRULE:"+rule)
+		}
+		icalFold(&b, "SUMMARY:"+icalEscape(describeUpdate(a.Update)))
+		icalFold(&b, icalUpdateProp+":"+icalEscape(string(update)))
+		icalFold(&b, "END:VEVENT")
+	}
+
+	end := now.AddDate(0, 0, days)
+	for _, a := range own {
+		uid := "action-" + strconv.Itoa(a.ID) + "@" + cfg.Home
+		if rule, first := recurrence(a, now); rule != "" {
+			event(uid, first, rule, a)
+			continue
+		}
+		for run := a.schedule.Next(now); !run.IsZero() && run.Before(end); run = a.schedule.Next(run) {
+			event(strconv.FormatInt(run.Unix(), 10)+"-"+uid, run.UTC(), "", a)
+		}
+	}
+
+	// the sleep window is a daily event of its own, starting from the last bedtime
+	if p := t.Sleep; p != nil {
+		profile, _ := json.Marshal(p)
+		bed, _ := minutesOf(p.Bedtime)
+		wake, _ := minutesOf(p.Wake)
+		local := now.In(time.Local)
+		start := time.Date(local.Year(), local.Month(), local.Day(), bed/60, bed%60, 0, 0, time.Local)
+		if start.After(local) {
+			start = start.AddDate(0, 0, -1)
+		}
+
+		icalFold(&b, "BEGIN:VEVENT")
+		icalFold(&b, "UID:sleep-"+strconv.Itoa(t.ID)+"@"+cfg.Home)
+		icalFold(&b, "DTSTAMP:"+stamp)
+		icalFold(&b, icalTime("DTSTART", start))
+		icalFold(&b, icalTime("DTEND", start.Add(time.Duration((wake-bed+24*60)%(24*60))*time.Minute)))
+		icalFold(&b, "RRULE:FREQ=DAILY")
+		icalFold(&b, "SUMMARY:Sleep")
+		icalFold(&b, "DESCRIPTION:"+icalEscape("The setpoints move by "+strconv.Itoa(p.Delta)+" over "+p.Ramp+" from bedtime and back before waking"))
+		icalFold(&b, icalSleepProp+":"+icalEscape(string(profile)))
+		icalFold(&b, "END:VEVENT")
+	}
+
+	icalFold(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// parseCalendar returns the properties of every event of the calendar
+func parseCalendar(body string) ([][]icalProp, *errResponse) {
+	invalid := func(desc string) *errResponse {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Calendar",
+			Description: desc,
+		}
+	}
+
+	// unfold the lines folded at the line limit
+	body = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(body)
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+
+	var events [][]icalProp
+	var event []icalProp
+	inCalendar, inEvent := false, false
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, invalid("The line '" + line + "' is not a property.")
+		}
+
+		params := strings.Split(line[:colon], ";")
+		prop := icalProp{name: strings.ToUpper(params[0]), params: map[string]string{}, value: line[colon+1:]}
+		for _, p := range params[1:] {
+			if eq := strings.Index(p, "="); eq > 0 {
+				prop.params[strings.ToUpper(p[:eq])] = strings.Trim(p[eq+1:], `"`)
+			}
+		}
+
+		switch {
+		case prop.name == "BEGIN" && prop.value == "VCALENDAR":
+			inCalendar = true
+		case prop.name == "BEGIN" && prop.value == "VEVENT":
+			inEvent, event = true, nil
+		case prop.name == "END" && prop.value == "VEVENT" && inEvent:
+			inEvent = false
+			events = append(events, event)
+		case inEvent:
+			event = append(event, prop)
+		}
+	}
+	if !inCalendar {
+		return nil, invalid("The body is not an iCalendar file, which starts with BEGIN:VCALENDAR.")
+	}
+	return events, nil
+}
+
+// importEvent turns an event into an action for the thermostat, or returns why it can't be. Only events
+// recurring every day or every week forever can, as those are what cron expressions express
+func importEvent(id int, props []icalProp) (scheduledAction, skippedEvent) {
+	find := func(name string) (icalProp, bool) {
+		for _, p := range props {
+			if p.name == name {
+				return p, true
+			}
+		}
+		return icalProp{}, false
+	}
+
+	var skipped skippedEvent
+	if uid, ok := find("UID"); ok {
+		skipped.UID = uid.value
+	}
+	summary, _ := find("SUMMARY")
+	skipped.Summary = icalUnescape(summary.value)
+	skip := func(reason string) (scheduledAction, skippedEvent) {
+		skipped.Reason = reason
+		return scheduledAction{}, skipped
+	}
+
+	if _, ok := find(icalSleepProp); ok {
+		return skip("the sleep window is set through the sleep profile of the thermostat")
+	}
+	start, ok := find("DTSTART")
+	if !ok {
+		return skip("the event has no start")
+	}
+	if len(start.value) == len("20060102") || start.params["VALUE"] == "DATE" {
+		return skip("all-day events have no time to apply the setpoints at")
+	}
+	zone := ""
+	value := start.value
+	switch {
+	case strings.HasSuffix(value, "Z"):
+		zone, value = "UTC", strings.TrimSuffix(value, "Z")
+	case start.params["TZID"] != "":
+		zone = start.params["TZID"]
+		if _, err := time.LoadLocation(zone); err != nil {
+			return skip("the time zone '" + zone + "' is unknown")
+		}
+	}
+	at, err := time.Parse(icalTimeLayout, value)
+	if err != nil {
+		return skip("the start '" + start.value + "' is not a valid date and time")
+	}
+
+	rrule, ok := find("RRULE")
+	if !ok {
+		return skip("only recurring events can be imported")
+	}
+	days := "*"
+	freq := ""
+	for _, part := range strings.Split(rrule.value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return skip("the recurrence rule '" + rrule.value + "' is not valid")
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			freq = strings.ToUpper(kv[1])
+		case "INTERVAL":
+			if kv[1] != "1" {
+				return skip("only events recurring every day or every week can be imported")
+			}
+		case "WKST":
+		case "BYDAY":
+			var nums []string
+			for _, d := range strings.Split(strings.ToUpper(kv[1]), ",") {
+				n := -1
+				for i, name := range icalWeekdays {
+					if d == name {
+						n = i
+					}
+				}
+				if n < 0 {
+					return skip("the day '" + d + "' of the recurrence rule can't be imported")
+				}
+				nums = append(nums, strconv.Itoa(n))
+			}
+			days = strings.Join(nums, ",")
+		default:
+			return skip("the recurrence rule part " + kv[0] + " can't be imported")
+		}
+	}
+	switch {
+	case freq == "WEEKLY" && days == "*":
+		days = strconv.Itoa(int(at.Weekday()))
+	case freq == "DAILY" && days != "*", freq != "DAILY" && freq != "WEEKLY":
+		return skip("only events recurring every day or every week can be imported")
+	}
+
+	a := scheduledAction{ThermostatID: id}
+	a.Cron = strconv.Itoa(at.Minute()) + " " + strconv.Itoa(at.Hour()) + " * * " + days
+	if zone != "" {
+		a.Cron = "CRON_TZ=" + zone + " " + a.Cron
+	}
+
+	if update, ok := find(icalUpdateProp); ok {
+		if err := json.Unmarshal([]byte(icalUnescape(update.value)), &a.Update); err != nil {
+			return skip("the " + icalUpdateProp + " property is not a valid update: " + err.Error())
+		}
+	} else {
+		var reason string
+		if a.Update, reason = parseSummary(skipped.Summary); reason != "" {
+			return skip(reason)
+		}
+	}
+	if errRes := validateData(a.Update); errRes != nil {
+		return skip(errRes.Description)
+	}
+	u := a.Update
+	if u.Name == "" && u.OperatingMode == "" && u.FanMode == "" && u.HeatSetPoint == 0 && u.CoolSetPoint == 0 && u.Tags == nil {
+		return skip("the event doesn't change any setting")
+	}
+
+	schedule, errRes := parseCron(a.Cron)
+	if errRes != nil {
+		return skip(errRes.Description)
+	}
+	a.schedule = schedule
+	return a, skippedEvent{}
+}
+
+// GetSchedule is the handler to export the scheduled actions of a thermostat as an iCalendar file, for
+// calendar apps to show. ?days sets how far ahead runs that don't recur by a rule are exported
+func GetSchedule(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	days := icalDays
+	if s := req.QueryArgs().Peek("days"); len(s) > 0 {
+		var err error
+		if days, err = strconv.Atoi(string(s)); err != nil || days < 1 || days > icalMaxDays {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Days",
+				Description: "The days must be a number from 1 to " + strconv.Itoa(icalMaxDays) + ".",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	req.Response.Header.Set("Content-Disposition", `attachment; filename="thermostat-`+strconv.Itoa(t.ID)+`.ics"`)
+	req.SetContentType("text/calendar; charset=utf-8")
+	req.SetStatusCode(http.StatusOK)
+	req.SetBodyString(exportSchedule(t, clock.Now(), days))
+}
+
+// PutSchedule is the handler to replace the scheduled actions of a thermostat with the recurring events of
+// an iCalendar file, each of which sets the setpoints in its summary when it starts. Events that can't be
+// imported are skipped and reported
+func PutSchedule(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	events, errRes := parseCalendar(string(req.PostBody()))
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	var imported []scheduledAction
+	res := scheduleImport{Skipped: []skippedEvent{}}
+	for _, props := range events {
+		a, skipped := importEvent(t.ID, props)
+		if skipped.Reason == "" {
+			// users restricted to a range of setpoints can't schedule any outside of it
+			if errRes := checkUserRange(requestUser(req), a.Update.HeatSetPoint, a.Update.CoolSetPoint); errRes != nil {
+				skipped.Reason = errRes.Description
+			}
+		}
+		if skipped.Reason != "" {
+			res.Skipped = append(res.Skipped, skipped)
+			continue
+		}
+		imported = append(imported, a)
+	}
+	if len(imported) == 0 {
+		errRes := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Nothing To Import",
+			Description: "None of the " + strconv.Itoa(len(events)) + " events of the calendar could be imported, so the schedule was left as it was.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, errRes)
+		return
+	}
+
+	var err error
+	if res.Actions, err = actions.Replace(t.ID, imported); err != nil {
+		errRes := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to persist scheduled action",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, res)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// putCalendar imports the calendar into the schedule of the thermostat at url, returning the status code
+// and what was imported
+func putCalendar(url, calendar string, t *testing.T) (int, scheduleImport) {
+	req, err := http.NewRequest("PUT", url+"/schedule", bytes.NewBufferString(calendar))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/calendar")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var imported scheduleImport
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&imported); err != nil {
+			t.Fatalf("failed to decode the import: %s", err)
+		}
+	}
+	return resp.StatusCode, imported
+}
+
+func TestScheduleExport(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.Latitude, c.Longitude = 41.8781, -87.6298
+	})
+
+	postAction(base, `{"thermostatId": 1, "cron": "CRON_TZ=UTC 30 6 * * 1-5", "update": {"heatSetPoint": 70}}`, t)
+	postAction(base, `{"thermostatId": 1, "cron": "CRON_TZ=UTC 0 22 * * *", "update": {"mode": "heat", "heatSetPoint": 62}}`, t)
+	postAction(base, `{"thermostatId": 1, "sun": "sunrise", "update": {"fan": "on"}}`, t)
+
+	resp, err := http.Get(base + "/v1/thermostats/1/schedule?days=3")
+	if err != nil {
+		t.Fatalf("failed to export the schedule: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Fatalf("expected a calendar, got %s", ct)
+	}
+
+	calendar := string(body)
+	for _, line := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR\r\n",
+		"RRULE:FREQ=DAILY\r\n",
+		"SUMMARY:Mode heat\\, Heat 62\r\n",
+		"SUMMARY:Fan on\r\n",
+	} {
+		if !strings.Contains(calendar, line) {
+			t.Fatalf("expected the calendar to contain %q, got:\n%s", line, calendar)
+		}
+	}
+	if events := strings.Count(calendar, "BEGIN:VEVENT"); events != 5 {
+		t.Fatalf("expected 2 recurring events and 3 sunrises, got %d events", events)
+	}
+
+	// importing the export into another thermostat gets back the recurring actions
+	code, imported := putCalendar(base+"/v1/thermostats/2", calendar, t)
+	if code != http.StatusOK || len(imported.Actions) != 2 || len(imported.Skipped) != 3 {
+		t.Fatalf("expected the 2 recurring events to be imported and the sunrises skipped, got %d %+v", code, imported)
+	}
+	if a := imported.Actions[0]; a.ThermostatID != 2 || a.Cron != "CRON_TZ=UTC 30 6 * * 1,2,3,4,5" || a.Update.HeatSetPoint != 70 {
+		t.Fatalf("expected the weekday action to be imported, got %+v", a)
+	}
+	if a := imported.Actions[1]; a.Cron != "CRON_TZ=UTC 0 22 * * *" || a.Update.OperatingMode != "heat" || a.Update.HeatSetPoint != 62 {
+		t.Fatalf("expected the daily action to be imported, got %+v", a)
+	}
+}
+
+func TestScheduleImport(t *testing.T) {
+	base := newTestServer(t)
+
+	if code, _ := putCalendar(base+"/v1/thermostats/1", "not a calendar", t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid calendar, got %d", http.StatusBadRequest, code)
+	}
+
+	calendar := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"UID:wake",
+		"DTSTART;TZID=America/Chicago:20260105T063000",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR",
+		"SUMMARY:Heat 69\\, C",
+		" ool 75",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:saturday",
+		"DTSTART:20260103T090000",
+		"RRULE:FREQ=WEEKLY",
+		"SUMMARY:Fan on",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:trip",
+		"DTSTART:20260110T080000Z",
+		"RRULE:FREQ=DAILY;COUNT=5",
+		"SUMMARY:Heat 55",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:holiday",
+		"DTSTART;VALUE=DATE:20260101",
+		"RRULE:FREQ=DAILY",
+		"SUMMARY:Heat 60",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:party",
+		"DTSTART:20260110T180000Z",
+		"RRULE:FREQ=DAILY",
+		"SUMMARY:Party time",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	postAction(base, `{"thermostatId": 1, "cron": "0 7 * * *", "update": {"heatSetPoint": 66}}`, t)
+	code, imported := putCalendar(base+"/v1/thermostats/1", calendar, t)
+	if code != http.StatusOK || len(imported.Actions) != 2 || len(imported.Skipped) != 3 {
+		t.Fatalf("expected 2 events to be imported and 3 skipped, got %d %+v", code, imported)
+	}
+	if a := imported.Actions[0]; a.Cron != "CRON_TZ=America/Chicago 30 6 * * 1,3,5" || a.Update.HeatSetPoint != 69 || a.Update.CoolSetPoint != 75 {
+		t.Fatalf("expected the wake event to be imported, got %+v", a)
+	}
+	if a := imported.Actions[1]; a.Cron != "0 9 * * 6" || a.Update.FanMode != "on" {
+		t.Fatalf("expected the saturday event to be imported, got %+v", a)
+	}
+	for i, uid := range []string{"trip", "holiday", "party"} {
+		if imported.Skipped[i].UID != uid || imported.Skipped[i].Reason == "" {
+			t.Fatalf("expected %s to be skipped with a reason, got %+v", uid, imported.Skipped[i])
+		}
+	}
+
+	// the import replaced the schedule of the thermostat
+	var list []scheduledAction
+	get(base+"/v1/actions?thermostat=1", t, &list)
+	if len(list) != 2 || list[0].ID != 2 {
+		t.Fatalf("expected the imported actions to replace the schedule, got %+v", list)
+	}
+}
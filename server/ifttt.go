@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// the triggers of the ifttt service: the temperature of a thermostat rising to or falling below a
+	// threshold, and an alert firing
+	iftttTemperatureAbove = "temperature_above"
+	iftttTemperatureBelow = "temperature_below"
+	iftttAlertFired       = "alert_fired"
+
+	// the actions of the ifttt service
+	iftttSetTemperature = "set_temperature"
+	iftttSetMode        = "set_mode"
+
+	// iftttDefaultLimit is how many trigger events a poll returns when ifttt doesn't give a limit
+	iftttDefaultLimit = 50
+
+	// maxIFTTTEntries is how many readings and alerts are kept for the triggers to be polled from
+	maxIFTTTEntries = 1000
+)
+
+// iftttRealtimeURL is the realtime api ifttt is told about new trigger events through, so it polls for
+// them straight away rather than within the hour
+var iftttRealtimeURL = "https://realtime.ifttt.com/v1/notifications"
+
+// iftttEntry is a temperature reading or an alert the triggers are matched against. Readings are only
+// kept when the temperature changed, from the last one to the new one
+type iftttEntry struct {
+	seq          int
+	time         time.Time
+	alert        bool
+	thermostatID int
+	name         string
+	from, to     int
+	alertType    string
+	severity     string
+	detail       string
+}
+
+// iftttTrigger is a trigger ifttt polls, along with the fields the user filled in for it
+type iftttTrigger struct {
+	slug   string
+	fields map[string]string
+}
+
+// iftttFeed keeps the recent readings and alerts for ifttt to poll the triggers from, and tells ifttt
+// about new ones for the triggers it polled before. It's a publisher so it sees every event
+type iftttFeed struct {
+	sync.Mutex
+	entries    []iftttEntry
+	lastSeq    int
+	temps      map[int]int
+	identities map[string]iftttTrigger
+}
+
+var ifttt = newIFTTTFeed()
+
+// newIFTTTFeed creates an empty feed
+func newIFTTTFeed() *iftttFeed {
+	return &iftttFeed{temps: make(map[int]int), identities: make(map[string]iftttTrigger)}
+}
+
+// iftttRequest is the body ifttt posts to the trigger and action endpoints
+type iftttRequest struct {
+	TriggerIdentity string            `json:"trigger_identity"`
+	TriggerFields   map[string]string `json:"triggerFields"`
+	ActionFields    map[string]string `json:"actionFields"`
+	Limit           *int              `json:"limit"`
+}
+
+// iftttError is a single error in the errors ifttt expects. SKIP tells ifttt not to retry an action
+type iftttError struct {
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message"`
+}
+
+// iftttErrors is the body of every error response to ifttt
+type iftttErrors struct {
+	Errors []iftttError `json:"errors"`
+}
+
+// reset forgets every entry and trigger
+func (f *iftttFeed) reset() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.entries = nil
+	f.lastSeq = 0
+	f.temps = make(map[int]int)
+	f.identities = make(map[string]iftttTrigger)
+}
+
+// ForgetThermostat drops the last temperature of the thermostat, as it is removed, so a reading of another
+// thermostat is never compared to it
+func (f *iftttFeed) ForgetThermostat(id int) {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.temps, id)
+}
+
+// Publish records the readings and alerts of the event, telling ifttt about the triggers they match
+func (f *iftttFeed) Publish(e event) error {
+	entry := iftttEntry{time: e.Time, thermostatID: e.ID, name: e.Thermostat.Name}
+	switch {
+	case raisesAlert(e.Type, e.Severity):
+		entry.alert = true
+		entry.alertType, entry.severity, entry.detail = e.Type, e.Severity, e.Detail
+	case e.Type == eventChange || e.Type == eventTelemetry:
+		entry.to = e.Thermostat.CurrentTemp
+	default:
+		return nil
+	}
+
+	f.Lock()
+	if !entry.alert {
+		last, known := f.temps[e.ID]
+		f.temps[e.ID] = entry.to
+		if !known || last == entry.to {
+			f.Unlock()
+			return nil
+		}
+		entry.from = last
+	}
+	f.lastSeq++
+	entry.seq = f.lastSeq
+	f.entries = append(f.entries, entry)
+	if len(f.entries) > maxIFTTTEntries {
+		f.entries = f.entries[len(f.entries)-maxIFTTTEntries:]
+	}
+	var matched []string
+	for identity, trigger := range f.identities {
+		if trigger.matches(entry) {
+			matched = append(matched, identity)
+		}
+	}
+	f.Unlock()
+
+	if len(matched) == 0 {
+		return nil
+	}
+	return notifyIFTTT(matched)
+}
+
+// notifyIFTTT tells ifttt through the realtime api that the triggers of the identities have new events
+func notifyIFTTT(identities []string) error {
+	type identity struct {
+		TriggerIdentity string `json:"trigger_identity"`
+	}
+	body := struct {
+		Data []identity `json:"data"`
+	}{}
+	for _, id := range identities {
+		body.Data = append(body.Data, identity{id})
+	}
+	jsn, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", iftttRealtimeURL, bytes.NewReader(jsn))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("IFTTT-Service-Key", secrets.Get("ifttt-service-key"))
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("the ifttt realtime api responded with " + resp.Status)
+	}
+	return nil
+}
+
+// matches reports whether the entry is an event of the trigger. The fields have been validated
+func (t iftttTrigger) matches(e iftttEntry) bool {
+	if thermostat := t.fields["thermostat"]; thermostat != "" && thermostat != strconv.Itoa(e.thermostatID) && !strings.EqualFold(thermostat, e.name) {
+		return false
+	}
+
+	switch t.slug {
+	case iftttAlertFired:
+		typ := t.fields["alert_type"]
+		return e.alert && (typ == "" || typ == "any" || typ == e.alertType)
+	case iftttTemperatureAbove:
+		threshold, _ := strconv.Atoi(t.fields["temperature"])
+		return !e.alert && e.from < threshold && e.to >= threshold
+	case iftttTemperatureBelow:
+		threshold, _ := strconv.Atoi(t.fields["temperature"])
+		return !e.alert && e.from >= threshold && e.to < threshold
+	}
+	return false
+}
+
+// validateIFTTTTrigger makes sure the trigger exists and its fields are filled in
+func validateIFTTTTrigger(t iftttTrigger) (int, string) {
+	switch t.slug {
+	case iftttAlertFired:
+		if typ := t.fields["alert_type"]; typ != "" && typ != "any" && validAlertType(typ) != nil {
+			return http.StatusBadRequest, "The alert type '" + typ + "' is not valid. Valid choices are 'any', 'anomaly', 'safety' or 'offline'."
+		}
+	case iftttTemperatureAbove, iftttTemperatureBelow:
+		if _, err := strconv.Atoi(t.fields["temperature"]); err != nil {
+			return http.StatusBadRequest, "The trigger field 'temperature' must be a whole number of degrees."
+		}
+	default:
+		return http.StatusNotFound, "There is no trigger '" + t.slug + "'."
+	}
+	return 0, ""
+}
+
+// Poll returns the events of the trigger, newest first, remembering the trigger so ifttt is told about new
+// ones through the realtime api
+func (f *iftttFeed) Poll(identity string, t iftttTrigger, limit int) []map[string]interface{} {
+	f.Lock()
+	defer f.Unlock()
+
+	if identity != "" {
+		f.identities[identity] = t
+	}
+
+	data := []map[string]interface{}{}
+	for i := len(f.entries) - 1; i >= 0 && len(data) < limit; i-- {
+		e := f.entries[i]
+		if !t.matches(e) {
+			continue
+		}
+		item := map[string]interface{}{
+			"thermostat":    e.name,
+			"thermostat_id": e.thermostatID,
+			"created_at":    e.time.Format(time.RFC3339),
+			"meta": map[string]interface{}{
+				"id":        strconv.Itoa(e.seq),
+				"timestamp": e.time.Unix(),
+			},
+		}
+		if e.alert {
+			item["alert_type"], item["severity"], item["detail"] = e.alertType, e.severity, e.detail
+		} else {
+			item["temperature"] = e.to
+		}
+		data = append(data, item)
+	}
+	return data
+}
+
+// Forget stops telling ifttt about new events for the trigger identity
+func (f *iftttFeed) Forget(identity string) {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.identities, identity)
+}
+
+// sendIFTTTError sends back the error in the layout ifttt expects
+func sendIFTTTError(req *fasthttp.RequestCtx, code int, status, message string) {
+	req.SetStatusCode(code)
+	sendJSON(req, iftttErrors{Errors: []iftttError{{Status: status, Message: message}}})
+}
+
+// HandleIFTTT checks the service key ifttt sends with every request and, once api users are configured,
+// the access token of the user who connected the service, passing their username on
+func HandleIFTTT(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(req *fasthttp.RequestCtx) {
+		req.SetContentType("application/json")
+		serviceKey := secrets.Get("ifttt-service-key")
+		if serviceKey == "" {
+			sendIFTTTError(req, http.StatusNotFound, "", "The ifttt service isn't configured, see -ifttt-service-key.")
+			return
+		}
+		key := req.Request.Header.Peek("IFTTT-Service-Key")
+		if subtle.ConstantTimeCompare(key, []byte(serviceKey)) != 1 {
+			sendIFTTTError(req, http.StatusUnauthorized, "", "The IFTTT-Service-Key header doesn't match -ifttt-service-key.")
+			return
+		}
+		if sessions.Enabled() {
+			username, errRes := authorize(req)
+			if errRes != nil {
+				sendIFTTTError(req, http.StatusUnauthorized, "", errRes.Description)
+				return
+			}
+			req.SetUserValue(usernameKey, username)
+		}
+		h(req)
+	}
+}
+
+// GetIFTTTStatus is the handler ifttt checks the service is up with
+func GetIFTTTStatus(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+}
+
+// PostIFTTTTestSetup is the handler ifttt gets the samples to test the triggers and actions with from
+func PostIFTTTTestSetup(req *fasthttp.RequestCtx) {
+	t, _ := home.Thermostat(1)
+	thermostat := "1"
+	if t != nil {
+		thermostat = t.Name
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, map[string]interface{}{
+		"data": map[string]interface{}{
+			"samples": map[string]interface{}{
+				"triggers": map[string]interface{}{
+					iftttTemperatureAbove: map[string]string{"thermostat": thermostat, "temperature": "75"},
+					iftttTemperatureBelow: map[string]string{"thermostat": thermostat, "temperature": "60"},
+					iftttAlertFired:       map[string]string{"thermostat": thermostat, "alert_type": "any"},
+				},
+				"actions": map[string]interface{}{
+					iftttSetTemperature: map[string]string{"thermostat": thermostat, "set_point": "heat", "temperature": "68"},
+					iftttSetMode:        map[string]string{"thermostat": thermostat, "mode": "auto"},
+				},
+				"actionRecordSkipping": map[string]interface{}{
+					iftttSetTemperature: map[string]string{"thermostat": "no such thermostat", "temperature": "68"},
+					iftttSetMode:        map[string]string{"thermostat": thermostat, "mode": "sideways"},
+				},
+			},
+		},
+	})
+}
+
+// PostIFTTTTrigger is the handler ifttt polls the events of a trigger from
+func PostIFTTTTrigger(req *fasthttp.RequestCtx) {
+	var body iftttRequest
+	if err := json.Unmarshal(req.PostBody(), &body); err != nil {
+		sendIFTTTError(req, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if body.TriggerFields == nil {
+		body.TriggerFields = make(map[string]string)
+	}
+
+	t := iftttTrigger{slug: req.UserValue("trigger").(string), fields: body.TriggerFields}
+	if code, message := validateIFTTTTrigger(t); code != 0 {
+		sendIFTTTError(req, code, "", message)
+		return
+	}
+	limit := iftttDefaultLimit
+	if body.Limit != nil {
+		limit = *body.Limit
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, map[string]interface{}{"data": ifttt.Poll(body.TriggerIdentity, t, limit)})
+}
+
+// DeleteIFTTTTrigger is the handler ifttt tells the service a trigger is no longer used with
+func DeleteIFTTTTrigger(req *fasthttp.RequestCtx) {
+	ifttt.Forget(req.UserValue("identity").(string))
+	req.SetStatusCode(http.StatusOK)
+}
+
+// PostIFTTTAction is the handler ifttt runs the actions of the service with. They go through the api as the
+// user who connected the service, so they are held to the same checks. Actions that can't succeed are
+// skipped rather than retried
+func PostIFTTTAction(req *fasthttp.RequestCtx) {
+	var body iftttRequest
+	if err := json.Unmarshal(req.PostBody(), &body); err != nil {
+		sendIFTTTError(req, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	fields := body.ActionFields
+
+	t, message := chatThermostat(fields["thermostat"])
+	if t == nil {
+		sendIFTTTError(req, http.StatusBadRequest, "SKIP", message)
+		return
+	}
+
+	var update map[string]interface{}
+	switch action := req.UserValue("action").(string); action {
+	case iftttSetTemperature:
+		temp, err := strconv.Atoi(fields["temperature"])
+		if err != nil {
+			sendIFTTTError(req, http.StatusBadRequest, "SKIP", "The action field 'temperature' must be a whole number of degrees.")
+			return
+		}
+		setPoint := fields["set_point"]
+		if setPoint == "" && (t.OperatingMode == "heat" || t.OperatingMode == "cool") {
+			setPoint = t.OperatingMode
+		}
+		if setPoint != "heat" && setPoint != "cool" {
+			sendIFTTTError(req, http.StatusBadRequest, "SKIP", "The action field 'set_point' must be 'heat' or 'cool' while "+t.Name+" is in "+t.OperatingMode+" mode.")
+			return
+		}
+		update = map[string]interface{}{setPoint + "SetPoint": temp}
+	case iftttSetMode:
+		update = map[string]interface{}{"mode": fields["mode"]}
+	default:
+		sendIFTTTError(req, http.StatusNotFound, "", "There is no action '"+action+"'.")
+		return
+	}
+
+	status, message, ok := requestAs(requestUser(req), "PUT", "/v1/thermostats/"+strconv.Itoa(t.ID), update, nil)
+	if !ok {
+		log.Println("skipped ifttt action on thermostat", t.ID, "-", message)
+		sendIFTTTError(req, http.StatusBadRequest, "SKIP", message)
+		return
+	}
+	if status == http.StatusAccepted {
+		log.Println("queued ifttt action on thermostat", t.ID, "until its device reconnects")
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, map[string]interface{}{
+		"data": []map[string]string{{"id": strconv.Itoa(t.ID) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)}},
+	})
+}
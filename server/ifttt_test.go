@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// iftttCall makes a request to the ifttt service api with the service key, decoding the response into v
+func iftttCall(method, url, key, body string, t *testing.T, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create new request: %s", err)
+	}
+	req.Header.Set("IFTTT-Service-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestIFTTT(t *testing.T) {
+	notified := make(chan string, 10)
+	realtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Data []struct {
+				TriggerIdentity string `json:"trigger_identity"`
+			} `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, d := range body.Data {
+			notified <- d.TriggerIdentity
+		}
+	}))
+	defer realtime.Close()
+	defer func(u string) { iftttRealtimeURL = u }(iftttRealtimeURL)
+	iftttRealtimeURL = realtime.URL
+
+	base := newTestServer(t, func(c *config) { c.IFTTTServiceKey = "service-key" }) + "/ifttt/v1"
+
+	if code := iftttCall("GET", base+"/status", "guess", "", t, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d without the service key, got %d", http.StatusUnauthorized, code)
+	}
+	if code := iftttCall("GET", base+"/status", "service-key", "", t, nil); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	var setup struct {
+		Data struct {
+			Samples struct {
+				Triggers map[string]map[string]string `json:"triggers"`
+			} `json:"samples"`
+		} `json:"data"`
+	}
+	if iftttCall("POST", base+"/test/setup", "service-key", "", t, &setup); len(setup.Data.Samples.Triggers) != 3 {
+		t.Fatalf("expected samples of every trigger, got %+v", setup)
+	}
+
+	// a trigger polled once is told about through the realtime api
+	var polled struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	above := `{"trigger_identity": "abc", "triggerFields": {"thermostat": "1", "temperature": "80"}}`
+	if code := iftttCall("POST", base+"/triggers/temperature_above", "service-key", above, t, &polled); code != http.StatusOK || len(polled.Data) != 0 {
+		t.Fatalf("expected no events yet, got %d %+v", code, polled)
+	}
+	t1, _ := home.Thermostat(1)
+	t1, _ = home.RecordTemp(t1, 72)
+	home.RecordTemp(t1, 82)
+	select {
+	case identity := <-notified:
+		if identity != "abc" {
+			t.Fatalf("expected the trigger identity abc, got %s", identity)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected ifttt to be notified")
+	}
+	iftttCall("POST", base+"/triggers/temperature_above", "service-key", above, t, &polled)
+	if len(polled.Data) != 1 || polled.Data[0]["temperature"] != float64(82) {
+		t.Fatalf("expected the temperature to have crossed 80, got %+v", polled)
+	}
+	if code := iftttCall("POST", base+"/triggers/alert_fired", "service-key", `{"triggerFields": {"alert_type": "change"}}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid alert type, got %d", http.StatusBadRequest, code)
+	}
+	if code := iftttCall("DELETE", base+"/triggers/temperature_above/trigger_identity/abc", "service-key", "", t, nil); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// actions go through the api, and are skipped when they can't succeed
+	if code := iftttCall("POST", base+"/actions/set_temperature", "service-key", `{"actionFields": {"thermostat": "1", "set_point": "heat", "temperature": "69"}}`, t, nil); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if t1, _ = home.Thermostat(1); t1.HeatSetPoint != 69 {
+		t.Fatalf("expected a heat set point of 69, got %d", t1.HeatSetPoint)
+	}
+	var errs iftttErrors
+	if code := iftttCall("POST", base+"/actions/set_mode", "service-key", `{"actionFields": {"thermostat": "1", "mode": "sideways"}}`, t, &errs); code != http.StatusBadRequest || len(errs.Errors) != 1 || errs.Errors[0].Status != "SKIP" {
+		t.Fatalf("expected the action to be skipped, got %d %+v", code, errs)
+	}
+}
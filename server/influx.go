@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxExporter periodically writes a sample of every thermostat to an influxdb 2.x bucket using the line
+// protocol, so dashboards can chart temperatures and setpoints over time
+type influxExporter struct {
+	writeURL string
+	token    string
+	client   *http.Client
+	breaker  *breaker
+}
+
+// tagEscaper escapes the characters the line protocol treats specially in tag keys and values
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// newInfluxExporter creates an exporter writing to the bucket of the org on the influxdb server at addr
+func newInfluxExporter(addr, org, bucket, token string) *influxExporter {
+	q := url.Values{}
+	q.Set("org", org)
+	q.Set("bucket", bucket)
+	q.Set("precision", "s")
+
+	return &influxExporter{
+		writeURL: strings.TrimRight(addr, "/") + "/api/v2/write?" + q.Encode(),
+		token:    token,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		breaker:  newBreaker("influx"),
+	}
+}
+
+// lineProtocol formats a sample of the thermostat taken at the given time as a single line
+func lineProtocol(t *thermostat, at time.Time) string {
+	return "thermostat" +
+		",home=" + tagEscaper.Replace(cfg.Home) +
+		",id=" + strconv.Itoa(t.ID) +
+		",name=" + tagEscaper.Replace(t.Name) +
+		",mode=" + tagEscaper.Replace(t.OperatingMode) +
+		",fan=" + tagEscaper.Replace(t.FanMode) +
+		" currentTemp=" + strconv.Itoa(t.CurrentTemp) + "i" +
+		",previousTemp=" + strconv.Itoa(t.PreviousTemp) + "i" +
+		",coolSetPoint=" + strconv.Itoa(t.CoolSetPoint) + "i" +
+		",heatSetPoint=" + strconv.Itoa(t.HeatSetPoint) + "i" +
+		" " + strconv.FormatInt(at.Unix(), 10)
+}
+
+// write sends a sample of every thermostat to influxdb in a single request
+func (i *influxExporter) write(therms []*thermostat, at time.Time) error {
+	var body bytes.Buffer
+	for _, t := range therms {
+		body.WriteString(lineProtocol(t, at))
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", i.writeURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.token != "" {
+		req.Header.Set("Authorization", "Token "+i.token)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("influxdb responded with " + resp.Status + ": " + string(msg))
+	}
+
+	return nil
+}
+
+// run writes a sample of every enabled thermostat on the given interval until stop is closed. In a cluster
+// only the leader writes
+func (i *influxExporter) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var at time.Time
+		select {
+		case <-stop:
+			return
+		case at = <-ticker.C:
+		}
+
+		if !cluster.IsLeader() {
+			continue
+		}
+		therms := activeThermostats(home.Thermostats())
+		if err := i.breaker.call(func() error { return i.write(therms, at) }); err != nil {
+			log.Println("failed to write telemetry to influxdb with error:", err)
+		}
+	}
+}
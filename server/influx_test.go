@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineProtocol(t *testing.T) {
+	th := &thermostat{
+		ID:            3,
+		Name:          "Living Room, East",
+		CurrentTemp:   70,
+		PreviousTemp:  68,
+		OperatingMode: "heat",
+		CoolSetPoint:  74,
+		HeatSetPoint:  67,
+		FanMode:       "auto",
+	}
+
+	expected := `thermostat,home=home,id=3,name=Living\ Room\,\ East,mode=heat,fan=auto currentTemp=70i,previousTemp=68i,coolSetPoint=74i,heatSetPoint=67i 1500000000`
+	if line := lineProtocol(th, time.Unix(1500000000, 0)); line != expected {
+		t.Fatalf("unexpected line protocol, expected:\n%s\ngot:\n%s", expected, line)
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	var body, auth, bucket string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		auth = r.Header.Get("Authorization")
+		bucket = r.URL.Query().Get("bucket")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	exporter := newInfluxExporter(srv.URL, "acme", "temps", "secret")
+	therms := []*thermostat{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}
+	if err := exporter.write(therms, time.Now()); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	if lines := strings.Count(body, "\n"); lines != 2 {
+		t.Fatalf("expected %d lines to be written, got %d", 2, lines)
+	}
+	if auth != "Token secret" {
+		t.Fatalf("expected authorization header %q, got %q", "Token secret", auth)
+	}
+	if bucket != "temps" {
+		t.Fatalf("expected bucket %s, got %s", "temps", bucket)
+	}
+}
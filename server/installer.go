@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// defaultInstallerWindow is how long installer access lasts unless the grant gives it, and
+	// maxInstallerWindow the longest it can be granted for
+	defaultInstallerWindow = "4h"
+	maxInstallerWindow     = 24 * time.Hour
+
+	// maxAuditEntries is how many entries the audit log keeps. Once there are more, the oldest are forgotten
+	maxAuditEntries = 1000
+
+	// roleInstaller and roleAdmin tag the entries of the audit log by who made them
+	roleInstaller = "installer"
+	roleAdmin     = "admin"
+)
+
+// installerGrant gives an api user installer access until it expires, sent in and returned through the api
+// @ /v1/admin/installers. Installers may change the installation of a thermostat: its equipment and the
+// safety limits it's protected by
+type installerGrant struct {
+	Username  string    `json:"username"`
+	Duration  string    `json:"duration,omitempty"` // e.g. "2h", defaults to 4 hours
+	Reason    string    `json:"reason,omitempty"`
+	GrantedBy string    `json:"grantedBy,omitempty"`
+	GrantedAt time.Time `json:"grantedAt"`
+	Expires   time.Time `json:"expires"`
+}
+
+// installation is how a thermostat is installed, sent in and returned through the api @
+// /v1/thermostats/:id/installation. Equipment is the profile its wiring is checked against, conventional
+// unless given. Stages is 1 for single-stage equipment, which never runs a second stage. The safety limits replace -freeze-protect-temp and -overheat-protect-temp for the thermostat, 0
+// disabling them. Whatever is left out follows the configuration of the server
+type installation struct {
+	Equipment           string `json:"equipment,omitempty"`
+	Stages              int    `json:"stages,omitempty"`
+	FreezeProtectTemp   *int   `json:"freezeProtectTemp,omitempty"`
+	OverheatProtectTemp *int   `json:"overheatProtectTemp,omitempty"`
+}
+
+// auditEntry is a write made with elevated access, returned through the api @ /v1/admin/audit
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username,omitempty"`
+	Role     string    `json:"role"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// installerStore holds the installer grants and the installations of the thermostats, persisting them to
+// -installers-file so they survive a restart, along with the audit log of what installers did
+type installerStore struct {
+	sync.Mutex
+	grants        map[string]installerGrant
+	installations map[int]installation
+	audit         []auditEntry
+}
+
+var installers = &installerStore{grants: make(map[string]installerGrant), installations: make(map[int]installation)}
+
+// savedInstallers is how the grants and installations are persisted
+type savedInstallers struct {
+	Grants        map[string]installerGrant `json:"grants"`
+	Installations map[int]installation      `json:"installations"`
+}
+
+// load restores the grants and installations persisted at path. A missing file means there are none
+func (s *installerStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := savedInstallers{Grants: make(map[string]installerGrant), Installations: make(map[int]installation)}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.grants, s.installations = saved.Grants, saved.Installations
+	return nil
+}
+
+// save persists the grants and installations to -installers-file, if given. The lock must be held
+func (s *installerStore) save() error {
+	if cfg.InstallersFile == "" {
+		return nil
+	}
+
+	jsn, err := json.Marshal(savedInstallers{Grants: s.grants, Installations: s.installations})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.InstallersFile, jsn, 0644)
+}
+
+// reset forgets every grant, installation and audit entry
+func (s *installerStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.grants = make(map[string]installerGrant)
+	s.installations = make(map[int]installation)
+	s.audit = nil
+}
+
+// Active reports whether the user has installer access at the given time
+func (s *installerStore) Active(username string, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	g, ok := s.grants[username]
+	return ok && now.Before(g.Expires)
+}
+
+// Grants returns the grants that haven't expired, in order by when they expire
+func (s *installerStore) Grants(now time.Time) []installerGrant {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []installerGrant{}
+	for _, g := range s.grants {
+		if now.Before(g.Expires) {
+			list = append(list, g)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+// Grant gives the user installer access, replacing any grant they had, and forgets the grants that expired
+func (s *installerStore) Grant(g installerGrant) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous := make(map[string]installerGrant, len(s.grants))
+	for username, other := range s.grants {
+		previous[username] = other
+		if !g.GrantedAt.Before(other.Expires) {
+			delete(s.grants, username)
+		}
+	}
+	s.grants[g.Username] = g
+	if err := s.save(); err != nil {
+		s.grants = previous
+		return err
+	}
+	return nil
+}
+
+// Revoke ends the installer access of the user, returning false when they had none
+func (s *installerStore) Revoke(username string, now time.Time) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	g, ok := s.grants[username]
+	if !ok || !now.Before(g.Expires) {
+		return false, nil
+	}
+	delete(s.grants, username)
+	if err := s.save(); err != nil {
+		s.grants[username] = g
+		return true, err
+	}
+	return true, nil
+}
+
+// RemoveGrant removes the grant of the user whether it expired or not, reporting whether there was one
+func (s *installerStore) RemoveGrant(username string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	g, ok := s.grants[username]
+	if !ok {
+		return false, nil
+	}
+	delete(s.grants, username)
+	if err := s.save(); err != nil {
+		s.grants[username] = g
+		return true, err
+	}
+	return true, nil
+}
+
+// Installation returns the installation of the thermostat, which is empty when it follows the configuration
+func (s *installerStore) Installation(thermostatID int) installation {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.installations[thermostatID]
+}
+
+// SetInstallation replaces the installation of the thermostat
+func (s *installerStore) SetInstallation(thermostatID int, in installation) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, had := s.installations[thermostatID]
+	s.installations[thermostatID] = in
+	if err := s.save(); err != nil {
+		if had {
+			s.installations[thermostatID] = previous
+		} else {
+			delete(s.installations, thermostatID)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveInstallation forgets the installation of the thermostat
+func (s *installerStore) RemoveInstallation(thermostatID int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, had := s.installations[thermostatID]
+	if !had {
+		return nil
+	}
+	delete(s.installations, thermostatID)
+	if err := s.save(); err != nil {
+		s.installations[thermostatID] = previous
+		return err
+	}
+	return nil
+}
+
+// Audit adds the entry to the audit log, and to the log of the server
+func (s *installerStore) Audit(e auditEntry) {
+	log.Println("audit - " + e.Role + " " + e.Username + " - " + e.Method + " " + e.Path + " " + strconv.Itoa(e.Status) + " " + e.Detail)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.audit = append(s.audit, e)
+	if len(s.audit) > maxAuditEntries {
+		s.audit = s.audit[len(s.audit)-maxAuditEntries:]
+	}
+}
+
+// PurgeAudit removes the audit entries of the user, or of every user when empty, made before the given time,
+// or every one of them when it's zero, and returns how many were removed
+func (s *installerStore) PurgeAudit(username string, before time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.audit[:0]
+	for _, e := range s.audit {
+		if (username == "" || e.Username == username) && (before.IsZero() || e.Time.Before(before)) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	purged := len(s.audit) - len(kept)
+	s.audit = kept
+	return purged
+}
+
+// AuditLog returns the audit log, newest first, limited to the entries of the user and role when given
+func (s *installerStore) AuditLog(username, role string) []auditEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []auditEntry{}
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		e := s.audit[i]
+		if (username == "" || e.Username == username) && (role == "" || e.Role == role) {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// auditInstaller tags the write of the request in the audit log when it was made by an installer
+func auditInstaller(req *fasthttp.RequestCtx) {
+	if req.IsGet() || req.IsHead() {
+		return
+	}
+	now := time.Now()
+	if username := requestUser(req); username != "" && installers.Active(username, now) {
+		installers.Audit(auditEntry{Time: now, Username: username, Role: roleInstaller, Method: string(req.Method()), Path: string(req.Path()), Status: req.Response.StatusCode()})
+	}
+}
+
+// installerStages returns how many stages the equipment of the thermostat has, 2 unless it's installed with
+// single-stage equipment
+func installerStages(thermostatID int) int {
+	if in := installers.Installation(thermostatID); in.Stages != 0 {
+		return in.Stages
+	}
+	return 2
+}
+
+// safetyLimits returns the freeze floor and overheat ceiling the thermostat is protected by, those of its
+// installation or else of the configuration
+func safetyLimits(thermostatID int) (int, int) {
+	freeze, overheat := cfg.FreezeProtectTemp, cfg.OverheatProtectTemp
+	in := installers.Installation(thermostatID)
+	if in.FreezeProtectTemp != nil {
+		freeze = *in.FreezeProtectTemp
+	}
+	if in.OverheatProtectTemp != nil {
+		overheat = *in.OverheatProtectTemp
+	}
+	return freeze, overheat
+}
+
+// checkInstaller makes sure the request was made with installer access. Requests that need no
+// authentication always have it
+func checkInstaller(req *fasthttp.RequestCtx) *errResponse {
+	if username := requestUser(req); username != "" && !installers.Active(username, time.Now()) {
+		return &errResponse{
+			Code:        http.StatusForbidden,
+			Msg:         "Forbidden",
+			Description: "User " + username + " needs installer access, granted through /v1/admin/installers, to change the installation of a thermostat.",
+		}
+	}
+	return nil
+}
+
+// validateInstallation validates the installation sent in
+func validateInstallation(in installation) *errResponse {
+	invalid := func(description string) *errResponse {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Installation",
+			Description: description,
+		}
+	}
+
+	if in.Equipment != "" && !inArray(in.Equipment, equipmentProfiles) {
+		return invalid("The equipment must be " + listChoices(equipmentProfiles) + ".")
+	}
+	if in.Stages != 0 && in.Stages != 1 && in.Stages != 2 {
+		return invalid("The stages must be 1 or 2.")
+	}
+	if t := in.FreezeProtectTemp; t != nil && *t != 0 && (*t < minHeatSetPt || *t > maxHeatSetPt) {
+		return invalid("The freeze protection temperature must be 0 to disable it or from " + strconv.Itoa(minHeatSetPt) + " to " + strconv.Itoa(maxHeatSetPt) + ".")
+	}
+	if t := in.OverheatProtectTemp; t != nil && *t != 0 && (*t < minCoolSetPt || *t > maxCoolSetPt) {
+		return invalid("The overheat protection temperature must be 0 to disable it or from " + strconv.Itoa(minCoolSetPt) + " to " + strconv.Itoa(maxCoolSetPt) + ".")
+	}
+	if in.FreezeProtectTemp != nil && in.OverheatProtectTemp != nil && *in.FreezeProtectTemp != 0 && *in.OverheatProtectTemp != 0 && *in.FreezeProtectTemp >= *in.OverheatProtectTemp {
+		return invalid("The freeze protection temperature must be below the overheat protection temperature.")
+	}
+	return nil
+}
+
+// sendInstallersError sends back the error of persisting the grants and installations
+func sendInstallersError(req *fasthttp.RequestCtx, err error) {
+	res := &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Failed to persist installers",
+		Description: err.Error(),
+	}
+	reportError(req, err)
+	req.SetStatusCode(http.StatusInternalServerError)
+	sendJSON(req, res)
+}
+
+// GetInstallation is the handler to return the installation of a thermostat
+func GetInstallation(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, installers.Installation(t.ID))
+}
+
+// PutInstallation is the handler to change the installation of a thermostat, which takes installer access.
+// The safety limits apply from the next reading of the thermostat on
+func PutInstallation(req *fasthttp.RequestCtx) {
+	if errRes := checkInstaller(req); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	var body installation
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	if errRes := validateInstallation(body); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	t := req.UserValue("thermostat").(*thermostat)
+	if err := installers.SetInstallation(t.ID, body); err != nil {
+		sendInstallersError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, body)
+}
+
+// GetInstallers is the handler to return the installer grants that haven't expired
+func GetInstallers(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, installers.Grants(time.Now()))
+}
+
+// PostInstaller is the handler to give an api user installer access for a limited window, after which it
+// expires by itself
+func PostInstaller(req *fasthttp.RequestCtx) {
+	var body installerGrant
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	invalid := func(description string) {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Installer Grant",
+			Description: description,
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+	}
+	if !sessions.Enabled() {
+		invalid("Installer access is granted to api users, and there are none, see -users.")
+		return
+	}
+	if !sessions.Known(body.Username) {
+		invalid("There is no api user " + body.Username + ".")
+		return
+	}
+	if body.Duration == "" {
+		body.Duration = defaultInstallerWindow
+	}
+	window, err := time.ParseDuration(body.Duration)
+	if err != nil || window <= 0 || window > maxInstallerWindow {
+		invalid("The duration must be positive and at most " + maxInstallerWindow.String() + ", e.g. 4h.")
+		return
+	}
+
+	body.GrantedBy = requestUser(req)
+	body.GrantedAt = time.Now()
+	body.Expires = body.GrantedAt.Add(window)
+	if err := installers.Grant(body); err != nil {
+		sendInstallersError(req, err)
+		return
+	}
+	installers.Audit(auditEntry{Time: body.GrantedAt, Username: body.GrantedBy, Role: roleAdmin, Method: string(req.Method()), Path: string(req.Path()), Status: http.StatusCreated,
+		Detail: "granted installer access to " + body.Username + " until " + body.Expires.Format(time.RFC3339)})
+
+	req.Response.Header.Set("Location", "/v1/admin/installers/"+body.Username)
+	req.SetStatusCode(http.StatusCreated)
+	sendJSON(req, body)
+}
+
+// DeleteInstaller is the handler to end the installer access of a user before it expires
+func DeleteInstaller(req *fasthttp.RequestCtx) {
+	username := req.UserValue("user").(string)
+
+	found, err := installers.Revoke(username, time.Now())
+	if err != nil {
+		sendInstallersError(req, err)
+		return
+	}
+	if !found {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "User " + username + " has no installer access.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+	installers.Audit(auditEntry{Time: time.Now(), Username: requestUser(req), Role: roleAdmin, Method: string(req.Method()), Path: string(req.Path()), Status: http.StatusNoContent,
+		Detail: "revoked the installer access of " + username})
+
+	req.SetStatusCode(http.StatusNoContent)
+}
+
+// GetAudit is the handler to return the audit log of the writes made with elevated access, newest first,
+// with ?user= and ?role= narrowing it down
+func GetAudit(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, installers.AuditLog(string(req.QueryArgs().Peek("user")), string(req.QueryArgs().Peek("role"))))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authed sends the request as the user logged in with the access token, decoding the response into v
+func authed(method, url, token, body string, t *testing.T, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create new %s request: %s", method, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestInstaller(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1/installation"
+
+	if code := postJSON(base+"/v1/admin/installers", `{"username": "tech"}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected no installer access without api users, got %d", code)
+	}
+
+	// reset the users afterwards so the shared test server goes back to being unauthenticated
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+	sessions.Lock()
+	sessions.users["owner"] = string(hash)
+	sessions.admins["owner"] = true
+	sessions.users["tech"] = string(hash)
+	sessions.Unlock()
+	defer sessions.reset()
+
+	login := func(username string) string {
+		tokens, errRes := sessions.Login(credentials{Username: username, Password: "secret"})
+		if errRes != nil {
+			t.Fatalf("failed to log in as %s: %s", username, errRes.Description)
+		}
+		return tokens.AccessToken
+	}
+	owner, tech := login("owner"), login("tech")
+
+	if code := authed("PUT", url, tech, `{"stages": 1}`, t, nil); code != http.StatusForbidden {
+		t.Fatalf("expected the installation to need installer access, got %d", code)
+	}
+	// only admins grant installer access, so nobody can grant it to themselves
+	if code := authed("POST", base+"/v1/admin/installers", tech, `{"username": "tech"}`, t, nil); code != http.StatusForbidden {
+		t.Fatalf("expected a user who isn't an admin to be forbidden, got %d", code)
+	}
+	for _, body := range []string{`{"username": "dave"}`, `{"username": "tech", "duration": "48h"}`, `{"username": "tech", "duration": "-1h"}`} {
+		if code := authed("POST", base+"/v1/admin/installers", owner, body, t, nil); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+	var g installerGrant
+	if code := authed("POST", base+"/v1/admin/installers", owner, `{"username": "tech", "reason": "furnace swap"}`, t, &g); code != http.StatusCreated ||
+		g.GrantedBy != "owner" || g.Expires.Sub(g.GrantedAt) != 4*time.Hour {
+		t.Fatalf("expected tech to be granted 4 hours, got %d %+v", code, g)
+	}
+
+	// installers change the equipment and the limits, which apply in place of the configuration
+	if code := authed("PUT", url, tech, `{"stages": 3}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a third stage to be rejected, got %d", code)
+	}
+	if code := authed("PUT", url, tech, `{"stages": 1, "freezeProtectTemp": 50}`, t, nil); code != http.StatusOK {
+		t.Fatalf("expected the installation to be changed, got %d", code)
+	}
+	var in installation
+	if authed("GET", url, owner, "", t, &in); in.Stages != 1 || in.FreezeProtectTemp == nil || *in.FreezeProtectTemp != 50 {
+		t.Fatalf("expected the installation, got %+v", in)
+	}
+	if freeze, overheat := safetyLimits(1); freeze != 50 || overheat != cfg.OverheatProtectTemp {
+		t.Fatalf("expected the floor of the installation and the configured ceiling, got %d and %d", freeze, overheat)
+	}
+	cold := &thermostat{ID: 1, HeatSetPoint: 72, CurrentTemp: 60}
+	if stage := hvacStage(cold, hvacHeating); stage != 1 {
+		t.Fatalf("expected single-stage equipment to stay in the first stage, got %d", stage)
+	}
+	if cold.ID = 2; hvacStage(cold, hvacHeating) != 2 {
+		t.Fatal("expected other thermostats to keep their second stage")
+	}
+
+	// what installers write is tagged in the audit log
+	var audit []auditEntry
+	authed("GET", base+"/v1/admin/audit?role=installer", owner, "", t, &audit)
+	if len(audit) != 2 || audit[0].Username != "tech" || audit[0].Status != http.StatusOK || audit[1].Status != http.StatusBadRequest {
+		t.Fatalf("expected both writes of tech, newest first, got %+v", audit)
+	}
+	authed("GET", base+"/v1/admin/audit?user=owner", owner, "", t, &audit)
+	if len(audit) != 1 || audit[0].Role != roleAdmin || !strings.Contains(audit[0].Detail, "tech") {
+		t.Fatalf("expected the grant, got %+v", audit)
+	}
+
+	// the installation survives a restart
+	installers.reset()
+	if err := installers.load(cfg.InstallersFile); err != nil {
+		t.Fatalf("failed to load the installers: %s", err)
+	}
+	if !installers.Active("tech", time.Now()) || installerStages(1) != 1 {
+		t.Fatal("expected the persisted grant and installation")
+	}
+
+	// access expires by itself, or can be revoked before then
+	if installers.Active("tech", g.Expires) {
+		t.Fatal("expected the grant to expire")
+	}
+	if code := authed("DELETE", base+"/v1/admin/installers/tech", owner, "", t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected the grant to be revoked, got %d", code)
+	}
+	if code := authed("DELETE", base+"/v1/admin/installers/tech", owner, "", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected no grant to revoke, got %d", code)
+	}
+	if code := authed("PUT", url, tech, `{}`, t, nil); code != http.StatusForbidden {
+		t.Fatalf("expected installer access to be gone, got %d", code)
+	}
+}
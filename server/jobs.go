@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	jobPending   = "pending"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobDelivery is how far the change of a job got with a single device driver
+type jobDelivery struct {
+	Driver string `json:"driver"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// job tracks an asynchronous write until every device driver delivered it, returned through the api @
+// /v1/jobs/:job. A job succeeds once every driver delivered the change, and fails as soon as one gives up on
+// it, with the reason the driver gave
+type job struct {
+	ID           string        `json:"id"`
+	Status       string        `json:"status"`
+	ThermostatID int           `json:"thermostatId"`
+	Error        string        `json:"error,omitempty"`
+	Deliveries   []jobDelivery `json:"deliveries"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	FinishedAt   *time.Time    `json:"finishedAt,omitempty"`
+
+	// claimed is how many drivers have queued the change, which is no longer waited on once all have
+	claimed int
+}
+
+// jobStore holds the asynchronous writes for -job-ttl after they were made
+type jobStore struct {
+	sync.Mutex
+	jobs map[string]*job
+
+	// waiting holds the jobs whose change hasn't been queued by every driver yet, by the record it committed
+	waiting map[*thermostat]*job
+}
+
+var jobs = &jobStore{jobs: make(map[string]*job), waiting: make(map[*thermostat]*job)}
+
+// wantsAsync reports whether the client asked for the write to be made asynchronously, with the
+// Prefer: respond-async header or ?async=true
+func wantsAsync(req *fasthttp.RequestCtx) bool {
+	for _, pref := range strings.Split(string(req.Request.Header.Peek("Prefer")), ",") {
+		if strings.TrimSpace(pref) == "respond-async" {
+			return true
+		}
+	}
+	return string(req.QueryArgs().Peek("async")) == "true"
+}
+
+// run makes the write and starts a job waiting for every device driver to deliver the record it commits.
+// The lock is held while writing, so the drivers can't pick up the change before the job waits on it. A write
+// that fails starts no job
+func (s *jobStore) run(id int, write func() (*thermostat, error)) (*job, error) {
+	jobID, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	drivers := commands.Drivers()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.expire()
+	t, err := write()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		ID:           jobID,
+		Status:       jobPending,
+		ThermostatID: id,
+		Deliveries:   make([]jobDelivery, 0, len(drivers)),
+		CreatedAt:    time.Now(),
+	}
+	for _, driver := range drivers {
+		j.Deliveries = append(j.Deliveries, jobDelivery{Driver: driver, Status: jobPending})
+	}
+	s.jobs[j.ID] = j
+
+	// without device drivers the write is done as soon as it's committed
+	if len(drivers) == 0 {
+		j.finish()
+	} else {
+		s.waiting[t] = j
+	}
+
+	copied := j.copy()
+	return &copied, nil
+}
+
+// claim returns the function the driver reports the delivery of the record with, or nil when no job waits
+// on it
+func (s *jobStore) claim(t *thermostat, driver string) func(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	j, ok := s.waiting[t]
+	if !ok {
+		return nil
+	}
+	if j.claimed++; j.claimed >= len(j.Deliveries) {
+		delete(s.waiting, t)
+	}
+
+	return func(err error) {
+		s.Lock()
+		defer s.Unlock()
+
+		j.deliver(driver, err)
+	}
+}
+
+// deliver records the outcome of the delivery by the driver
+func (j *job) deliver(driver string, err error) {
+	for i := range j.Deliveries {
+		d := &j.Deliveries[i]
+		if d.Driver != driver || d.Status != jobPending {
+			continue
+		}
+
+		d.Status = jobSucceeded
+		if err != nil {
+			d.Status = jobFailed
+			d.Error = err.Error()
+		}
+	}
+	j.finish()
+}
+
+// finish settles the status of the job once a delivery failed or all succeeded
+func (j *job) finish() {
+	if j.Status != jobPending {
+		return
+	}
+
+	status := jobSucceeded
+	for _, d := range j.Deliveries {
+		if d.Status == jobFailed {
+			status = jobFailed
+			j.Error = d.Driver + ": " + d.Error
+			break
+		}
+		if d.Status == jobPending {
+			status = jobPending
+		}
+	}
+	if status == jobPending {
+		return
+	}
+
+	now := time.Now()
+	j.Status = status
+	j.FinishedAt = &now
+}
+
+// copy returns a copy of the job that's safe to use without the lock
+func (j *job) copy() job {
+	copied := *j
+	copied.Deliveries = append([]jobDelivery(nil), j.Deliveries...)
+	return copied
+}
+
+// Job returns the job with the given id
+func (s *jobStore) Job(id string) (job, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expire()
+	j, ok := s.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return j.copy(), true
+}
+
+// expire forgets the jobs made longer than -job-ttl ago. The caller must hold the lock
+func (s *jobStore) expire() {
+	cutoff := time.Now().Add(-cfg.JobTTL)
+	for id, j := range s.jobs {
+		if j.CreatedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+	for t, j := range s.waiting {
+		if j.CreatedAt.Before(cutoff) {
+			delete(s.waiting, t)
+		}
+	}
+}
+
+// reset forgets every job
+func (s *jobStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.jobs = make(map[string]*job)
+	s.waiting = make(map[*thermostat]*job)
+}
+
+// sendJob sends back the job of an asynchronous write with 202 Accepted, pointing the client to its status
+func sendJob(req *fasthttp.RequestCtx, j *job) {
+	req.Response.Header.Set("Location", "/v1/jobs/"+j.ID)
+	req.SetStatusCode(http.StatusAccepted)
+	sendJSON(req, j)
+}
+
+// GetJob is the handler to return the status of an asynchronous write
+func GetJob(req *fasthttp.RequestCtx) {
+	id, _ := req.UserValue("job").(string)
+	j, ok := jobs.Job(id)
+	if !ok {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "No job found for id: " + id + ". Jobs are kept for " + cfg.JobTTL.String() + ".",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, j)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAsyncPut(t *testing.T) {
+	base := newTestServer(t)
+
+	req, err := http.NewRequest("PUT", base+"/v1/thermostats/1", bytes.NewBufferString(`{"fan": "on"}`))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	req.Header.Set("Prefer", "respond-async")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	var accepted job
+	if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil {
+		t.Fatalf("failed to decode the job: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != "/v1/jobs/"+accepted.ID {
+		t.Fatalf("expected 202 pointing to the job, got %d with location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// without device drivers the write is done as soon as it's committed
+	var j job
+	get(base+resp.Header.Get("Location"), t, &j)
+	if j.Status != jobSucceeded || j.ThermostatID != 1 || j.FinishedAt == nil {
+		t.Fatalf("expected the job to have succeeded, got %+v", j)
+	}
+	var th thermostat
+	get(base+"/v1/thermostats/1", t, &th)
+	if th.FanMode != "on" {
+		t.Fatalf("expected the write to be made, got fan %s", th.FanMode)
+	}
+}
+
+func TestJobDeliveries(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.DeviceAttempts = 2
+		c.DeviceRetryBase = time.Millisecond
+		c.DeviceRetryMax = time.Millisecond
+	})
+	commands.register("devices")
+	b := newBreaker("devices")
+
+	cases := map[bool]job{
+		true:  {Status: jobSucceeded},
+		false: {Status: jobFailed, Error: "devices: device unreachable"},
+	}
+	for reachable, want := range cases {
+		target, _ := home.Thermostat(1)
+		var updated *thermostat
+		j, err := jobs.run(1, func() (*thermostat, error) {
+			var err error
+			updated, err = home.UpdateThermostat(target, updateThermostat{FanMode: "on"})
+			return updated, err
+		})
+		if err != nil {
+			t.Fatalf("failed to start the job: %s", err)
+		}
+		if j.Status != jobPending || len(j.Deliveries) != 1 {
+			t.Fatalf("expected the job to wait on the device, got %+v", j)
+		}
+
+		device := &flakyDevice{reachable: reachable}
+		sendCommand(b, updated, "desired", device.send("desired"))
+
+		var got job
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			get(base+"/v1/jobs/"+j.ID, t, &got)
+			if got.Status != jobPending {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the job to finish, got %+v", got)
+			}
+		}
+		if got.Status != want.Status || got.Error != want.Error {
+			t.Fatalf("expected the job to be %s with error %q, got %+v", want.Status, want.Error, got)
+		}
+	}
+}
+
+func TestGetJobNotFound(t *testing.T) {
+	base := newTestServer(t)
+	resp, err := http.Get(base + "/v1/jobs/unknown")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d for an unknown job, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// the kinds of changes written to the thermostats
+const (
+	changeAdd          = "add"
+	changeDelete       = "delete"
+	changeUpdate       = "update"
+	changeOrder        = "order"
+	changeMaintenance  = "maintenance"
+	changeEnabled      = "enabled"
+	changeReading      = "reading"
+	changeOffline      = "offline"
+	changeHVAC         = "hvac"
+	changeBoost        = "boost"
+	changeFanTimer     = "fan-timer"
+	changeQuiet        = "quiet"
+	changeSleep        = "sleep"
+	changePrecondition = "precondition"
+	changeReplicated   = "replicated"
+)
+
+// change is a single mutation of the thermostats. Every write is made by appending a change to the log of
+// the home, which is the write-ahead log or the replication log when there is one, and the thermostats are
+// the projection of those changes. Every change carries the complete records it writes, so projecting it
+// has the same result wherever and however often it's done. A snapshot holds every thermostat and replaces
+// whatever came before it. Deleted holds the last records of the thermostats the change removes
+type change struct {
+	Seq         uint64        `json:"seq"`
+	Type        string        `json:"type,omitempty"`
+	Time        time.Time     `json:"time"`
+	Snapshot    bool          `json:"snapshot,omitempty"`
+	Thermostats []*thermostat `json:"thermostats"`
+	Deleted     []*thermostat `json:"deleted,omitempty"`
+	// Outbox holds the events of the change that are published once it's in the write-ahead log
+	Outbox []event `json:"outbox,omitempty"`
+}
+
+// newChange returns a change of the given kind writing the changed thermostats
+func newChange(typ string, changed []*thermostat) change {
+	return change{Type: typ, Time: clock.Now(), Thermostats: changed}
+}
+
+// journal is the log of the changes projected into the home since its last snapshot, numbered in the order
+// they were projected. Only the latest -journal-size changes are kept, the older ones are folded into the
+// base they're projected onto, so the state can always be rebuilt from the log
+type journal struct {
+	seq     uint64
+	base    map[int]*thermostat
+	changes []change
+}
+
+// project writes the change to the thermostats
+func project(thermostats map[int]*thermostat, c change) {
+	for _, t := range c.Thermostats {
+		thermostats[t.ID] = t
+	}
+	for _, t := range c.Deleted {
+		delete(thermostats, t.ID)
+	}
+}
+
+// record appends the change to the journal, numbering it. The home must be locked
+func (j *journal) record(c change) change {
+	j.seq++
+	c.Seq = j.seq
+	if c.Snapshot {
+		j.base = make(map[int]*thermostat, len(c.Thermostats))
+		project(j.base, c)
+		j.changes = nil
+		return c
+	}
+	if j.base == nil {
+		j.base = make(map[int]*thermostat)
+	}
+
+	j.changes = append(j.changes, c)
+	if over := len(j.changes) - cfg.JournalSize; over > 0 {
+		for _, old := range j.changes[:over] {
+			project(j.base, old)
+		}
+		j.changes = j.changes[over:]
+	}
+	return c
+}
+
+// rebuild projects every change of the journal onto its base
+func (j *journal) rebuild() map[int]*thermostat {
+	thermostats := make(map[int]*thermostat, len(j.base))
+	for id, t := range j.base {
+		thermostats[id] = t
+	}
+	for _, c := range j.changes {
+		project(thermostats, c)
+	}
+	return thermostats
+}
+
+// Changes returns the changes of the journal after the given sequence number, oldest first
+func (home *currentState) Changes(since uint64) []change {
+	home.Lock()
+	defer home.Unlock()
+
+	changes := []change{}
+	for _, c := range home.journal.changes {
+		if c.Seq > since {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// ForgetHistory drops the records of the thermostat with the given id from the changes of the journal,
+// folding its current record into the base instead, so its changes, cycles and comfort are no longer known.
+// The changes themselves stay, keeping their sequence numbers. It returns how many records were dropped
+func (home *currentState) ForgetHistory(id int) int {
+	home.Lock()
+	defer home.Unlock()
+
+	j := &home.journal
+	dropped := 0
+	for i, c := range j.changes {
+		kept := make([]*thermostat, 0, len(c.Thermostats))
+		for _, t := range c.Thermostats {
+			if t.ID == id {
+				dropped++
+				continue
+			}
+			kept = append(kept, t)
+		}
+		// the changes handed out share their records, so they're replaced rather than changed in place
+		j.changes[i].Thermostats = kept
+	}
+	if t, ok := home.thermostats[id]; ok && dropped > 0 {
+		if j.base == nil {
+			j.base = make(map[int]*thermostat)
+		}
+		j.base[id] = t
+	}
+	return dropped
+}
+
+// Rebuild replaces the thermostats with the projection of the journal, dropping anything that was written
+// to them without going through it
+func (home *currentState) Rebuild() {
+	home.Lock()
+	defer home.Unlock()
+
+	home.thermostats = home.journal.rebuild()
+}
+
+// GetChanges is the handler to return the changes written to the thermostats, optionally only those after
+// the sequence number given by ?since
+func GetChanges(req *fasthttp.RequestCtx) {
+	var since uint64
+	if s := req.QueryArgs().Peek("since"); len(s) > 0 {
+		var err error
+		if since, err = strconv.ParseUint(string(s), 10, 64); err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Query",
+				Description: "The since parameter must be a sequence number.",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, home.Changes(since))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.JournalSize = 3
+	})
+
+	target, _ := home.Thermostat(1)
+	for i := 0; i < 4; i++ {
+		target, _ = home.UpdateThermostat(target, updateThermostat{Name: "Den " + strconv.Itoa(i)})
+	}
+	home.SetEnabled(target, false)
+
+	// only the latest changes are kept, in the order they were made
+	var changes []change
+	get(base+"/v1/admin/changes", t, &changes)
+	if len(changes) != 3 || changes[0].Type != changeUpdate || changes[2].Type != changeEnabled {
+		t.Fatalf("expected the latest 3 changes, got %+v", changes)
+	}
+	if changes[1].Seq != changes[0].Seq+1 || changes[2].Seq != changes[1].Seq+1 {
+		t.Fatalf("expected the changes to be numbered in order, got %d, %d and %d", changes[0].Seq, changes[1].Seq, changes[2].Seq)
+	}
+	get(base+"/v1/admin/changes?since="+strconv.FormatUint(changes[1].Seq, 10), t, &changes)
+	if len(changes) != 1 || changes[0].Type != changeEnabled {
+		t.Fatalf("expected only the change after the given sequence number, got %+v", changes)
+	}
+
+	// the thermostats are rebuilt from the log, including the changes folded out of it
+	home.Lock()
+	home.thermostats = map[int]*thermostat{}
+	home.Unlock()
+	home.Rebuild()
+
+	therms := home.Thermostats()
+	if len(therms) != 2 {
+		t.Fatalf("expected 2 thermostats to be rebuilt from the journal, got %d", len(therms))
+	}
+	if therms[0].Name != "Den 3" || !therms[0].Disabled || therms[1].Name != defaultName2 {
+		t.Fatalf("expected the thermostats to be rebuilt from the journal, got %+v and %+v", therms[0], therms[1])
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaPublisher writes events to one topic per event type, named <prefix>.<type>. Messages are keyed by
+// thermostat id so every event for a unit lands on the same partition and stays in order
+type kafkaPublisher struct {
+	writer *kafka.Writer
+	prefix string
+}
+
+// newKafkaPublisher creates a publisher for the given brokers. Writes are asynchronous and batched, and
+// delivery failures are logged once the brokers report them
+func newKafkaPublisher(brokers []string, prefix string) *kafkaPublisher {
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+			Async:                  true,
+			Completion: func(messages []kafka.Message, err error) {
+				if err != nil {
+					log.Println("failed to deliver", len(messages), "messages to kafka with error:", err)
+				}
+			},
+		},
+		prefix: prefix,
+	}
+}
+
+// Publish implements the publisher interface
+func (k *kafkaPublisher) Publish(e event) error {
+	jsn, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return k.writer.WriteMessages(context.Background(), kafka.Message{
+		Topic: k.prefix + "." + e.Type,
+		Key:   []byte(strconv.Itoa(e.ID)),
+		Value: jsn,
+		Headers: []kafka.Header{
+			{Key: "schema", Value: []byte(strconv.Itoa(e.Schema))},
+		},
+	})
+}
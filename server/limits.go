@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// validateLimits checks the timeouts and connection limits of the configuration
+func validateLimits(c config) error {
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return errors.New("-read-timeout, -write-timeout and -idle-timeout can't be negative")
+	}
+	if c.MaxConnsPerIP < 0 || c.Concurrency < 0 {
+		return errors.New("-max-conns-per-ip and -concurrency can't be negative")
+	}
+	return nil
+}
+
+// newFastServer returns a fasthttp server for the handler with the configured timeouts and connection
+// limits. Connections beyond the limits are answered with an error and closed
+func newFastServer(h fasthttp.RequestHandler) *fasthttp.Server {
+	// fasthttp falls back to its default for 0 rather than lifting the limit
+	concurrency := cfg.Concurrency
+	if concurrency == 0 {
+		concurrency = math.MaxInt32
+	}
+
+	return &fasthttp.Server{
+		Handler:       h,
+		ReadTimeout:   cfg.ReadTimeout,
+		WriteTimeout:  cfg.WriteTimeout,
+		IdleTimeout:   cfg.IdleTimeout,
+		MaxConnsPerIP: cfg.MaxConnsPerIP,
+		Concurrency:   concurrency,
+	}
+}
+
+// newNetServer returns a net/http server for the handler with the configured timeouts. net/http has no
+// connection limits of its own, so the listeners it serves are wrapped with limitListener
+func newNetServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      h,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+}
+
+// limitListener wraps ln so it holds no more than the configured connections at once, in total and from any
+// single ip. Connections beyond the limits are closed as soon as they're accepted, since the listener can't
+// tell whether the client expects tls
+func limitListener(ln net.Listener) net.Listener {
+	if cfg.MaxConnsPerIP == 0 && cfg.Concurrency == 0 {
+		return ln
+	}
+	return &connLimiter{Listener: ln, perIP: make(map[string]int)}
+}
+
+// connLimiter is a listener that limits the connections it holds open
+type connLimiter struct {
+	net.Listener
+
+	sync.Mutex
+	open  int
+	perIP map[string]int
+}
+
+// Accept waits for the next connection within the limits, closing every one that isn't
+func (l *connLimiter) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// only tcp connections have an ip to count, unix socket ones are only held to the total
+		var ip string
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP.String()
+		}
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+		conn.Close()
+	}
+}
+
+// acquire counts a connection from the ip, reporting false when it's over a limit
+func (l *connLimiter) acquire(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if cfg.Concurrency > 0 && l.open >= cfg.Concurrency {
+		return false
+	}
+	if ip != "" && cfg.MaxConnsPerIP > 0 && l.perIP[ip] >= cfg.MaxConnsPerIP {
+		return false
+	}
+
+	l.open++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	return true
+}
+
+// release stops counting a connection from the ip
+func (l *connLimiter) release(ip string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.open--
+	if ip != "" {
+		if l.perIP[ip]--; l.perIP[ip] == 0 {
+			delete(l.perIP, ip)
+		}
+	}
+}
+
+// limitedConn is a connection that's counted against the limits until it's closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection, no longer counting it against the limits
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
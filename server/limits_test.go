@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	for _, server := range []string{"fasthttp", "nethttp"} {
+		base := newTestServer(t, func(c *config) {
+			c.Server = server
+			c.ReadTimeout = 100 * time.Millisecond
+		})
+
+		// a client that never finishes its request is cut off instead of holding the connection
+		conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+		if err != nil {
+			t.Fatalf("[%s]: failed to connect: %s", server, err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("GET /v1/thermostats HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+			t.Fatalf("[%s]: failed to write: %s", server, err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+			t.Fatalf("[%s]: expected the server to close the connection, got %s", server, err)
+		}
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	// no connection is left idle for the shutdown to close, which fasthttp races with the connection
+	// still being read when it limits the connections per ip
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, server := range []string{"fasthttp", "nethttp"} {
+		base := newTestServer(t, func(c *config) {
+			c.Server = server
+			c.MaxConnsPerIP = 1
+		})
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+		if err != nil {
+			t.Fatalf("[%s]: failed to connect: %s", server, err)
+		}
+
+		// give the server a moment to accept the first connection before the second comes in
+		time.Sleep(50 * time.Millisecond)
+		if resp, err := client.Get(base + "/v1/thermostats"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				t.Fatalf("[%s]: expected a second connection from the same ip to be turned away", server)
+			}
+		}
+
+		// the limit applies to connections held open, so the next one is served once the first is closed
+		conn.Close()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			resp, err := client.Get(base + "/v1/thermostats")
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("[%s]: expected a connection to be served after the first was closed", server)
+			}
+		}
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	for _, configure := range []func(c *config){
+		func(c *config) { c.ReadTimeout = -time.Second },
+		func(c *config) { c.MaxConnsPerIP = -1 },
+		func(c *config) { c.Concurrency = -1 },
+	} {
+		c := defaultConfig()
+		configure(&c)
+		if err := validateLimits(c); err == nil {
+			t.Fatalf("expected an error for negative limits in %+v", c)
+		}
+	}
+
+	if err := validateLimits(defaultConfig()); err != nil {
+		t.Fatalf("expected the default limits to be valid, got %s", err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// route groups, which each listener can serve any of
+	groupAPI   = "api"
+	groupAdmin = "admin"
+	groupAuth  = "auth"
+
+	// trustedKey marks requests that came in on a listener without token authentication
+	trustedKey = "trusted"
+)
+
+// listenerSpec is a single listener given by -listen, e.g. ":8443,tls,groups=api+auth",
+// "unix:/run/thermostat/admin.sock,groups=admin,auth=none" or "systemd:thermostat.socket"
+type listenerSpec struct {
+	Addr   string
+	TLS    bool
+	Groups []string
+	NoAuth bool
+}
+
+// parseListener parses a -listen value: the address followed by comma separated options
+func parseListener(v string) (listenerSpec, error) {
+	parts := strings.Split(v, ",")
+	spec := listenerSpec{Addr: parts[0]}
+	if spec.Addr == "" {
+		return spec, errors.New("listener address can't be empty")
+	}
+
+	for _, opt := range parts[1:] {
+		switch {
+		case opt == "tls":
+			spec.TLS = true
+		case strings.HasPrefix(opt, "groups="):
+			for _, group := range strings.Split(strings.TrimPrefix(opt, "groups="), "+") {
+				if group != groupAPI && group != groupAdmin && group != groupAuth {
+					return spec, errors.New("invalid route group '" + group + "' - valid choices are 'api', 'admin' or 'auth'")
+				}
+				spec.Groups = append(spec.Groups, group)
+			}
+		case opt == "auth=none":
+			spec.NoAuth = true
+		case opt == "auth=token":
+			spec.NoAuth = false
+		default:
+			return spec, errors.New("invalid listener option '" + opt + "'")
+		}
+	}
+
+	return spec, nil
+}
+
+// serves reports whether the listener serves the route group. A listener without groups serves every group
+func (l listenerSpec) serves(group string) bool {
+	return len(l.Groups) == 0 || inArray(group, l.Groups)
+}
+
+// middleware wraps the handler of every route served by the listener
+func (l listenerSpec) middleware(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	h = recordRequests(logRequests(h))
+	if !l.NoAuth {
+		return h
+	}
+
+	return fasthttp.RequestHandler(func(req *fasthttp.RequestCtx) {
+		req.SetUserValue(trustedKey, true)
+		h(req)
+	})
+}
+
+// listen opens the listener, a unix socket when the address starts with unix: or the socket passed in by
+// systemd socket activation when it starts with systemd:
+func (l listenerSpec) listen() (net.Listener, error) {
+	if strings.HasPrefix(l.Addr, "systemd:") {
+		ln, ok := activatedSockets[strings.TrimPrefix(l.Addr, "systemd:")]
+		if !ok {
+			return nil, errors.New("no socket named '" + strings.TrimPrefix(l.Addr, "systemd:") + "' was passed in by systemd")
+		}
+		return ln, nil
+	}
+
+	if strings.HasPrefix(l.Addr, "unix:") {
+		path := strings.TrimPrefix(l.Addr, "unix:")
+
+		// remove the socket left behind by an earlier run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", l.Addr)
+}
+
+// serveListener serves the routes of the listener on ln with the configured http server, blocking until it
+// fails or stop is closed
+func serveListener(l listenerSpec, ln net.Listener, stop <-chan struct{}) error {
+	if cfg.Server == "nethttp" {
+		srv := newNetServer("", newHTTPHandler(l))
+		ln = limitListener(ln)
+		go func() {
+			<-stop
+			srv.Shutdown(context.Background())
+		}()
+
+		var err error
+		if l.TLS {
+			err = srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+
+	srv := newFastServer(newRouter(l).Handler)
+	go func() {
+		<-stop
+		srv.Shutdown()
+	}()
+
+	if l.TLS {
+		return srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+	}
+	return srv.Serve(ln)
+}
+
+// listenerFlags collects every -listen flag
+type listenerFlags []listenerSpec
+
+// String implements the flag.Value interface
+func (f *listenerFlags) String() string {
+	var addrs []string
+	for _, l := range *f {
+		addrs = append(addrs, l.Addr)
+	}
+	return strings.Join(addrs, " ")
+}
+
+// Set implements the flag.Value interface
+func (f *listenerFlags) Set(v string) error {
+	spec, err := parseListener(v)
+	if err != nil {
+		return err
+	}
+
+	*f = append(*f, spec)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListener(t *testing.T) {
+	l, err := parseListener("unix:/run/thermostat/admin.sock,groups=admin+auth,auth=none")
+	if err != nil {
+		t.Fatalf("failed to parse listener: %s", err)
+	}
+	if l.Addr != "unix:/run/thermostat/admin.sock" || l.TLS || !l.NoAuth || len(l.Groups) != 2 {
+		t.Fatalf("expected an admin and auth unix socket without token authentication, got %+v", l)
+	}
+	if !l.serves(groupAdmin) || l.serves(groupAPI) {
+		t.Fatalf("expected only the admin and auth groups to be served, got %v", l.Groups)
+	}
+
+	for _, v := range []string{"", ":8443,groups=billing", ":8443,h2"} {
+		if _, err := parseListener(v); err == nil {
+			t.Fatalf("expected an error parsing listener %q", v)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l := listenerSpec{Addr: "unix:" + path, Groups: []string{groupAdmin}}
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", l.Addr, err)
+	}
+	go serveListener(l, ln, nil)
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://admin/v1/admin/readonly")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d for an admin route, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = client.Get("http://admin/v1/thermostats")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d for a route outside the admin group, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
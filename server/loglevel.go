@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// the subsystems debug logging can be turned on for: the drivers sending commands to and reading from
+	// devices, the scheduler running the scheduled actions and the http requests served
+	subsystemDrivers   = "drivers"
+	subsystemScheduler = "scheduler"
+	subsystemHTTP      = "http"
+
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+
+	// defaultDebugWindow is how long debug logging lasts unless it's given, and maxDebugWindow the longest
+	// it can be turned on for before it reverts to info
+	defaultDebugWindow = "15m"
+	maxDebugWindow     = 4 * time.Hour
+)
+
+var (
+	logSubsystems = []string{subsystemDrivers, subsystemScheduler, subsystemHTTP}
+	logLevels     = []string{logLevelInfo, logLevelDebug}
+)
+
+// logLevelChange is the body sent in through the api @ /v1/admin/loglevel. Without a subsystem, the level
+// applies to every subsystem
+type logLevelChange struct {
+	Level     string `json:"level"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Duration  string `json:"duration,omitempty"` // e.g. "30m", defaults to 15 minutes
+}
+
+// subsystemLevel is the level a subsystem logs at, returned through the api @ /v1/admin/loglevel. Until is
+// when debug logging reverts to info
+type subsystemLevel struct {
+	Subsystem string     `json:"subsystem"`
+	Level     string     `json:"level"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+// logLevelStore holds until when each subsystem logs at debug level. Everything else logs at info level
+type logLevelStore struct {
+	sync.RWMutex
+	debugUntil map[string]time.Time
+}
+
+var logLevel = &logLevelStore{debugUntil: make(map[string]time.Time)}
+
+// reset reverts every subsystem to info
+func (s *logLevelStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.debugUntil = make(map[string]time.Time)
+}
+
+// Debug reports whether the subsystem logs at debug level at the given time
+func (s *logLevelStore) Debug(subsystem string, now time.Time) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	until, ok := s.debugUntil[subsystem]
+	return ok && now.Before(until)
+}
+
+// Set logs the subsystems at debug level until the given time, or at info level from now on when it's zero
+func (s *logLevelStore) Set(subsystems []string, until time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, subsystem := range subsystems {
+		if until.IsZero() {
+			delete(s.debugUntil, subsystem)
+		} else {
+			s.debugUntil[subsystem] = until
+		}
+	}
+}
+
+// Levels returns the level every subsystem logs at
+func (s *logLevelStore) Levels(now time.Time) []subsystemLevel {
+	s.RLock()
+	defer s.RUnlock()
+
+	levels := make([]subsystemLevel, 0, len(logSubsystems))
+	for _, subsystem := range logSubsystems {
+		l := subsystemLevel{Subsystem: subsystem, Level: logLevelInfo}
+		if until, ok := s.debugUntil[subsystem]; ok && now.Before(until) {
+			l.Level = logLevelDebug
+			l.Until = &until
+		}
+		levels = append(levels, l)
+	}
+	return levels
+}
+
+// debugln logs like log.Println while the subsystem logs at debug level
+func debugln(subsystem string, v ...interface{}) {
+	if !logLevel.Debug(subsystem, time.Now()) {
+		return
+	}
+	log.Println(append([]interface{}{"debug -", subsystem, "-"}, v...)...)
+}
+
+// logRequests logs every request the handler serves, with its status and how long it took, while http
+// logs at debug level
+func logRequests(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(req *fasthttp.RequestCtx) {
+		if !logLevel.Debug(subsystemHTTP, time.Now()) {
+			h(req)
+			return
+		}
+
+		start := time.Now()
+		h(req)
+		debugln(subsystemHTTP, string(req.Method()), string(req.RequestURI()), req.Response.StatusCode(), "in", time.Since(start), "from", req.RemoteAddr().String())
+	})
+}
+
+// GetLogLevel is the handler to return the level every subsystem logs at
+func GetLogLevel(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, logLevel.Levels(time.Now()))
+}
+
+// PutLogLevel is the handler to raise the logging of a subsystem, or every subsystem, to debug level for a
+// limited window after which it reverts to info by itself, or to revert it early
+func PutLogLevel(req *fasthttp.RequestCtx) {
+	var body logLevelChange
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	invalid := func(description string) {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Log Level",
+			Description: description,
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+	}
+	if !inArray(body.Level, logLevels) {
+		invalid("The level must be " + listChoices(logLevels) + ".")
+		return
+	}
+	subsystems := logSubsystems
+	if body.Subsystem != "" {
+		if !inArray(body.Subsystem, logSubsystems) {
+			invalid("The subsystem must be " + listChoices(logSubsystems) + ", or left out for every subsystem.")
+			return
+		}
+		subsystems = []string{body.Subsystem}
+	}
+
+	now := time.Now()
+	var until time.Time
+	if body.Level == logLevelDebug {
+		if body.Duration == "" {
+			body.Duration = defaultDebugWindow
+		}
+		window, err := time.ParseDuration(body.Duration)
+		if err != nil || window <= 0 || window > maxDebugWindow {
+			invalid("The duration must be positive and at most " + maxDebugWindow.String() + ", e.g. 30m.")
+			return
+		}
+		until = now.Add(window)
+	} else if body.Duration != "" {
+		invalid("A duration can only be given for the debug level.")
+		return
+	}
+
+	logLevel.Set(subsystems, until)
+	if until.IsZero() {
+		log.Println("logging", subsystems, "at info level")
+	} else {
+		log.Println("logging", subsystems, "at debug level until", until.Format(time.RFC3339))
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, logLevel.Levels(now))
+}
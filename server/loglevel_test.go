@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logged reports whether a line of the recent log contains s
+func logged(s string) bool {
+	for _, line := range recentLogs.Lines() {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogLevel(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/admin/loglevel"
+
+	for _, body := range []string{
+		`{"level": "trace"}`,
+		`{"level": "debug", "subsystem": "kafka"}`,
+		`{"level": "debug", "duration": "24h"}`,
+		`{"level": "info", "duration": "1h"}`,
+	} {
+		if code := put(url, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	get(base+"/v1/thermostats/1?marker=before", t, nil)
+	if code := put(url, `{"level": "debug", "subsystem": "http", "duration": "30m"}`, t); code != http.StatusOK {
+		t.Fatalf("expected http to log at debug level, got %d", code)
+	}
+	var levels []subsystemLevel
+	get(url, t, &levels)
+	if len(levels) != 3 || levels[2].Subsystem != subsystemHTTP || levels[2].Level != logLevelDebug || levels[0].Level != logLevelInfo {
+		t.Fatalf("expected only http at debug level, got %+v", levels)
+	}
+
+	get(base+"/v1/thermostats/1?marker=after", t, nil)
+	if !logged("debug - http - GET /v1/thermostats/1?marker=after 200") || logged("marker=before") {
+		t.Fatal("expected only the request made at debug level to be logged")
+	}
+
+	// debug logging reverts by itself, or early
+	if until := levels[2].Until; until == nil || logLevel.Debug(subsystemHTTP, *until) || until.Sub(time.Now()) > 30*time.Minute {
+		t.Fatalf("expected debug logging to revert within 30 minutes, got %v", until)
+	}
+	if code := put(url, `{"level": "info"}`, t); code != http.StatusOK || logLevel.Debug(subsystemHTTP, time.Now()) {
+		t.Fatalf("expected every subsystem back at info level, got %d", code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maintenanceRequest is the body sent in through the api @ /v1/thermostats/:id/maintenance
+type maintenanceRequest struct {
+	Enabled  bool   `json:"enabled"`
+	Duration string `json:"duration"` // e.g. "90m", defaults to the configured maintenance duration
+}
+
+// inMaintenance reports whether the thermostat is in maintenance mode right now. Maintenance mode expires on
+// its own once the window has passed
+func inMaintenance(t *thermostat) bool {
+	return t.MaintenanceUntil != nil && clock.Now().Before(*t.MaintenanceUntil)
+}
+
+// checkAutomatedWrite returns the error automated writes (anything not sent in by a person through the
+// api, such as cloud sync) are rejected with while the thermostat is in maintenance mode
+func checkAutomatedWrite(t *thermostat) *errResponse {
+	if !inMaintenance(t) {
+		return nil
+	}
+
+	return &errResponse{
+		Code:        http.StatusLocked,
+		Msg:         "Under Maintenance",
+		Description: "Thermostat " + strconv.Itoa(t.ID) + " is in maintenance mode until " + t.MaintenanceUntil.Format(time.RFC3339) + ". Automated writes are suspended until then.",
+	}
+}
+
+// SetMaintenance puts the thermostat into maintenance mode until the given time, or takes it out of
+// maintenance mode when until is nil
+func (home *currentState) SetMaintenance(target *thermostat, until *time.Time) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	updated.MaintenanceUntil = until
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeMaintenance, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, &updated)
+	publishHVAC(transitions)
+
+	return &updated, nil
+}
+
+// PutMaintenance is the handler to start or end maintenance mode on a specific thermostat
+func PutMaintenance(req *fasthttp.RequestCtx) {
+	var body maintenanceRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	if !body.Enabled {
+		updated, err := home.SetMaintenance(target, nil)
+		if err != nil {
+			sendCommitError(req, err)
+			return
+		}
+
+		req.SetStatusCode(http.StatusOK)
+		sendJSON(req, updated)
+		return
+	}
+
+	duration := cfg.MaintenanceDuration
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 || d > cfg.MaxMaintenanceDuration {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Duration",
+				Description: "The duration provided must be a positive duration such as '90m' or '4h', no longer than " + cfg.MaxMaintenanceDuration.String() + ".",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+		duration = d
+	}
+
+	until := clock.Now().Add(duration)
+
+	updated, err := home.SetMaintenance(target, &until)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func putMaintenance(base string, id int, body string, t *testing.T) int {
+	client := http.Client{}
+	req, err := http.NewRequest("PUT", base+"/v1/thermostats/"+strconv.Itoa(id)+"/maintenance", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	base := newTestServer(t)
+	id, _ := home.AddThermostat(updateThermostat{Name: "Hallway Thermostat", OperatingMode: "heat"})
+
+	if code := putMaintenance(base, id, `{"enabled": true, "duration": "forever"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for invalid duration, got %d", http.StatusBadRequest, code)
+	}
+	if code := putMaintenance(base, id, `{"enabled": true, "duration": "30m"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	var th *thermostat
+	get(base+"/v1/thermostats/"+strconv.Itoa(id), t, &th)
+	if th.MaintenanceUntil == nil {
+		t.Fatal("expected maintenanceUntil to be set")
+	}
+
+	// automated writes such as cloud deltas are rejected during maintenance
+	s := &shadowSync{prefix: "thermostat-"}
+	topic := "$aws/things/thermostat-" + strconv.Itoa(id) + "/shadow/update/delta"
+	s.handleDelta(nil, &fakeMessage{topic: topic, payload: []byte(`{"state": {"mode": "cool"}}`)})
+
+	get(base+"/v1/thermostats/"+strconv.Itoa(id), t, &th)
+	if th.OperatingMode != "heat" {
+		t.Fatalf("expected automated write to be rejected during maintenance, mode is now %s", th.OperatingMode)
+	}
+	if errRes := checkAutomatedWrite(th); errRes == nil || errRes.Code != http.StatusLocked {
+		t.Fatal("expected automated writes to be locked during maintenance")
+	}
+
+	if code := putMaintenance(base, id, `{"enabled": false}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	var ended *thermostat
+	get(base+"/v1/thermostats/"+strconv.Itoa(id), t, &ended)
+	if ended.MaintenanceUntil != nil {
+		t.Fatal("expected maintenanceUntil to be cleared")
+	}
+}
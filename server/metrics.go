@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// the labels the metrics of a thermostat can carry, in the order they're exported in
+const (
+	labelHome       = "home"
+	labelZone       = "zone"
+	labelThermostat = "thermostat_id"
+	labelName       = "name"
+)
+
+// metricLabels are the labels every metric of a thermostat carries unless -metrics-labels leaves some out
+var metricLabels = []string{labelHome, labelZone, labelThermostat, labelName}
+
+// zoneTag is the prefix of the tag that names the zone of a thermostat, e.g. "zone:upstairs"
+const zoneTag = "zone:"
+
+// GetMetrics is the handler to return the metrics of the server in the prometheus text format, or the
+// openmetrics format to scrapers that accept it
+var GetMetrics = fasthttpadaptor.NewFastHTTPHandler(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+	promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+
+// parseMetricLabels returns the labels of -metrics-labels in the order they're exported in. The id of the
+// thermostat can't be left out, as it's what tells the series of two thermostats apart
+func parseMetricLabels(s string) ([]string, error) {
+	given := make(map[string]bool)
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		if !inArray(l, metricLabels) {
+			return nil, errors.New("invalid metrics label: " + l + " - valid choices are " + listChoices(metricLabels))
+		}
+		given[l] = true
+	}
+	if !given[labelThermostat] {
+		return nil, errors.New("-metrics-labels must include " + labelThermostat)
+	}
+
+	var labels []string
+	for _, l := range metricLabels {
+		if given[l] {
+			labels = append(labels, l)
+		}
+	}
+	return labels, nil
+}
+
+// metricsAllowed returns whether the thermostat is exported per -metrics-thermostats: every thermostat for
+// *, or those whose id or one of whose tags is listed
+func metricsAllowed(t *thermostat, allow []string) bool {
+	for _, a := range allow {
+		if a == "*" || a == strconv.Itoa(t.ID) || inArray(a, t.Tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// thermostatZone returns the zone of the thermostat: the zone tag when it has one, the room it's located in
+// otherwise
+func thermostatZone(t *thermostat) string {
+	for _, tag := range t.Tags {
+		if strings.HasPrefix(tag, zoneTag) {
+			return strings.TrimPrefix(tag, zoneTag)
+		}
+	}
+	if t.Location != nil {
+		return t.Location.Room
+	}
+	return ""
+}
+
+// thermostatCollector exports the temperature, setpoints and state of every thermostat allowed by
+// -metrics-thermostats, up to -metrics-max-thermostats of them, so fleets of thousands of units only
+// export the series they need. Its labels depend on the configuration, so it describes nothing up front
+type thermostatCollector struct{}
+
+func init() {
+	prometheus.MustRegister(thermostatCollector{})
+}
+
+// the metrics of a thermostat, whose descriptions are built with the labels of -metrics-labels
+var thermostatMetrics = []struct {
+	name, help string
+	value      func(t *thermostat) float64
+}{
+	{"thermostat_temperature_fahrenheit", "Current temperature of a thermostat", func(t *thermostat) float64 { return float64(t.CurrentTemp) }},
+	{"thermostat_heat_setpoint_fahrenheit", "Heat setpoint of a thermostat", func(t *thermostat) float64 { return float64(t.HeatSetPoint) }},
+	{"thermostat_cool_setpoint_fahrenheit", "Cool setpoint of a thermostat", func(t *thermostat) float64 { return float64(t.CoolSetPoint) }},
+	{"thermostat_up", "Whether the device of a thermostat can be reached: 1 online, 0 offline", func(t *thermostat) float64 {
+		if t.Offline {
+			return 0
+		}
+		return 1
+	}},
+	{"thermostat_running", "Whether the equipment of a thermostat is heating or cooling: 1 running, 0 not", func(t *thermostat) float64 {
+		if t.HVACState == hvacHeating || t.HVACState == hvacCooling {
+			return 1
+		}
+		return 0
+	}},
+}
+
+var metricsDroppedDesc = prometheus.NewDesc("thermostat_metrics_dropped",
+	"Number of thermostats allowed by -metrics-thermostats that weren't exported for being over -metrics-max-thermostats",
+	nil, nil)
+
+// Describe implements the prometheus.Collector interface
+func (thermostatCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements the prometheus.Collector interface
+func (thermostatCollector) Collect(ch chan<- prometheus.Metric) {
+	if cfg.MetricsThermostats == "" {
+		return
+	}
+	labels, err := parseMetricLabels(cfg.MetricsLabels)
+	if err != nil {
+		return
+	}
+	allow := strings.Split(cfg.MetricsThermostats, ",")
+	for i := range allow {
+		allow[i] = strings.TrimSpace(allow[i])
+	}
+
+	var allowed []*thermostat
+	for _, t := range home.Thermostats() {
+		if metricsAllowed(t, allow) {
+			allowed = append(allowed, t)
+		}
+	}
+	// the lowest ids are kept, so the exported thermostats don't change as others are added
+	sort.Slice(allowed, func(i, j int) bool { return allowed[i].ID < allowed[j].ID })
+	dropped := 0
+	if len(allowed) > cfg.MetricsMaxThermostats {
+		allowed, dropped = allowed[:cfg.MetricsMaxThermostats], len(allowed)-cfg.MetricsMaxThermostats
+	}
+	ch <- prometheus.MustNewConstMetric(metricsDroppedDesc, prometheus.GaugeValue, float64(dropped))
+
+	descs := make([]*prometheus.Desc, len(thermostatMetrics))
+	for i, m := range thermostatMetrics {
+		descs[i] = prometheus.NewDesc(m.name, m.help, labels, nil)
+	}
+	for _, t := range allowed {
+		values := make([]string, len(labels))
+		for i, l := range labels {
+			switch l {
+			case labelHome:
+				values[i] = cfg.Home
+			case labelZone:
+				values[i] = thermostatZone(t)
+			case labelThermostat:
+				values[i] = strconv.Itoa(t.ID)
+			case labelName:
+				values[i] = t.Name
+			}
+		}
+		for i, m := range thermostatMetrics {
+			ch <- prometheus.MustNewConstMetric(descs[i], prometheus.GaugeValue, m.value(t), values...)
+		}
+	}
+}
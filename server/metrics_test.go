@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// getMetrics returns the metrics of the server in the format negotiated with the given accept header
+func getMetrics(base, accept string, t *testing.T) string {
+	req, err := http.NewRequest("GET", base+"/metrics", nil)
+	if err != nil {
+		t.Fatalf("failed to create new get request: %s", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to get the metrics: %s", err)
+	}
+	defer resp.Body.Close()
+
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	return string(metrics)
+}
+
+func TestThermostatMetrics(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.MetricsThermostats = "1, zone:upstairs"
+		c.MetricsMaxThermostats = 2
+	})
+
+	upstairs, _ := home.AddThermostat(updateThermostat{Name: "Guest Room", Tags: []string{"zone:upstairs"}})
+	home.AddThermostat(updateThermostat{Name: "Attic", Tags: []string{"zone:upstairs"}})
+	home.AddThermostat(updateThermostat{Name: "Garage"})
+	first, _ := home.Thermostat(1)
+
+	metrics := getMetrics(base, "", t)
+	for _, line := range []string{
+		`thermostat_temperature_fahrenheit{home="home",name="` + first.Name + `",thermostat_id="1",zone=""} ` + strconv.Itoa(first.CurrentTemp),
+		`thermostat_heat_setpoint_fahrenheit{home="home",name="Guest Room",thermostat_id="` + strconv.Itoa(upstairs) + `",zone="upstairs"}`,
+		`thermostat_up{home="home",name="Guest Room",thermostat_id="` + strconv.Itoa(upstairs) + `",zone="upstairs"} 1`,
+		// the attic is allowed by its tag, but over the limit
+		`thermostat_metrics_dropped 1`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Fatalf("expected the metrics to contain %s, got:\n%s", line, metrics)
+		}
+	}
+	for _, name := range []string{"Attic", "Garage", `thermostat_id="2"`} {
+		if strings.Contains(metrics, name) {
+			t.Fatalf("expected %s not to be exported, got:\n%s", name, metrics)
+		}
+	}
+
+	// scrapers that accept openmetrics get it
+	if metrics := getMetrics(base, "application/openmetrics-text; version=1.0.0", t); !strings.HasSuffix(metrics, "# EOF\n") {
+		t.Fatalf("expected openmetrics, got:\n%s", metrics)
+	}
+
+	// without the name, renaming a thermostat keeps its series
+	cfg.MetricsLabels = "thermostat_id,home"
+	if metrics := getMetrics(base, "", t); !strings.Contains(metrics, `thermostat_up{home="home",thermostat_id="1"} 1`) {
+		t.Fatalf("expected only the allowed labels, got:\n%s", metrics)
+	}
+}
+
+func TestParseMetricLabels(t *testing.T) {
+	if labels, err := parseMetricLabels("name, thermostat_id"); err != nil || strings.Join(labels, ",") != "thermostat_id,name" {
+		t.Fatalf("expected the labels in order, got %v %v", labels, err)
+	}
+	for _, s := range []string{"home,zone", "thermostat_id,floor"} {
+		if _, err := parseMetricLabels(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
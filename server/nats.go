@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsPublisher publishes events on <prefix>.<type>.<id> subjects so subscribers can filter by event type
+// and thermostat with wildcards. It also answers reads sent as requests on the <prefix>.get subject
+type natsPublisher struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// newNATSPublisher connects to the nats server at url and starts answering read requests. The connection
+// keeps reconnecting for as long as the server runs
+func newNATSPublisher(url, prefix string) (*natsPublisher, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("thermostat-api"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Println("disconnected from nats with error:", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Println("reconnected to nats at", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &natsPublisher{
+		conn:   conn,
+		prefix: prefix,
+	}
+
+	// use a queue group so only one instance answers each request when several are running
+	if _, err := conn.QueueSubscribe(prefix+".get", "thermostat-api", n.handleGet); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Publish implements the publisher interface
+func (n *natsPublisher) Publish(e event) error {
+	jsn, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return n.conn.Publish(n.prefix+"."+e.Type+"."+strconv.Itoa(e.ID), jsn)
+}
+
+// handleGet replies with every thermostat when the request is empty, or with a single thermostat when the
+// request holds its id
+func (n *natsPublisher) handleGet(msg *nats.Msg) {
+	var v interface{}
+
+	body := strings.TrimSpace(string(msg.Data))
+	if body == "" {
+		v = home.Thermostats()
+	} else if id, err := strconv.Atoi(body); err != nil {
+		v = &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid identifier provided",
+			Description: err.Error(),
+		}
+	} else if t, errRes := home.Thermostat(id); errRes != nil {
+		v = errRes
+	} else {
+		v = t
+	}
+
+	jsn, err := json.Marshal(v)
+	if err != nil {
+		log.Println("failed to marshal nats reply with error:", err)
+		return
+	}
+
+	if err := msg.Respond(jsn); err != nil {
+		log.Println("failed to send nats reply with error:", err)
+	}
+}
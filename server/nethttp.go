@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/valyala/fasthttp"
+)
+
+// newHTTPHandler builds a chi router serving the routes of the listener over net/http, for use with standard
+// middleware, httptest and proxies. fasthttp remains the default and faster server
+func newHTTPHandler(l listenerSpec) http.Handler {
+	r := chi.NewRouter()
+
+	for _, rt := range routes() {
+		if l.serves(rt.group) {
+			r.MethodFunc(rt.method, chiPattern(rt.path), adaptHandler(l.middleware(rt.handler)))
+		}
+	}
+
+	// chi leaves setting the Allow header to a handler of our own
+	r.MethodNotAllowed(func(w http.ResponseWriter, req *http.Request) {
+		allow := allowedMethods(r, req.URL.Path)
+		adaptHandler(func(ctx *fasthttp.RequestCtx) {
+			ctx.Response.Header.Set("Allow", allow)
+			MethodNotAllowed(ctx)
+		})(w, req)
+	})
+
+	return r
+}
+
+// allowedMethods returns the methods the chi router serves the path with, for the Allow header
+func allowedMethods(r *chi.Mux, path string) string {
+	var allow []string
+	for _, method := range []string{"GET", "PUT", "POST", "DELETE"} {
+		if r.Match(chi.NewRouteContext(), method, path) {
+			allow = append(allow, method)
+		}
+	}
+	return strings.Join(allow, ", ")
+}
+
+// chiPattern converts a fasthttprouter path such as /v1/thermostats/:id to the chi pattern
+// /v1/thermostats/{id}
+func chiPattern(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// adaptHandler serves a fasthttp handler over net/http, so both servers share every handler. Connection
+// upgrades such as websockets need fasthttp to hijack the connection and are rejected
+func adaptHandler(h fasthttp.RequestHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var freq fasthttp.Request
+		freq.Header.SetMethod(r.Method)
+		freq.SetRequestURI(r.URL.RequestURI())
+		for key, values := range r.Header {
+			for _, v := range values {
+				freq.Header.Add(key, v)
+			}
+		}
+		freq.Header.SetHost(r.Host)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		freq.SetBody(body)
+
+		var ctx fasthttp.RequestCtx
+		remoteAddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		ctx.Init(&freq, remoteAddr, nil)
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			for i, key := range rctx.URLParams.Keys {
+				ctx.SetUserValue(key, rctx.URLParams.Values[i])
+			}
+		}
+
+		serveAdapted(h, &ctx)
+
+		if ctx.Hijacked() {
+			res := &errResponse{
+				Code:        http.StatusNotImplemented,
+				Msg:         "Not Implemented",
+				Description: "Websockets are only available with the fasthttp server.",
+			}
+			ctx.Response.Reset()
+			ctx.SetStatusCode(http.StatusNotImplemented)
+			sendJSON(&ctx, res)
+		}
+
+		ctx.Response.Header.VisitAll(func(key, value []byte) {
+			w.Header().Add(string(key), string(value))
+		})
+		w.WriteHeader(ctx.Response.StatusCode())
+		ctx.Response.BodyWriteTo(w)
+	}
+}
+
+// serveAdapted runs the handler, recovering from panics the same way the fasthttp router does
+func serveAdapted(h fasthttp.RequestHandler, ctx *fasthttp.RequestCtx) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			handlePanic(ctx, rcv)
+		}
+	}()
+
+	h(ctx)
+}
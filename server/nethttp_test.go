@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNetHTTPServer(t *testing.T) {
+	srv := httptest.NewServer(newHTTPHandler(listenerSpec{}))
+	defer srv.Close()
+
+	var th thermostat
+	get(srv.URL+"/v1/thermostats/1", t, &th)
+	if th.ID != 1 || th.Name == "" {
+		t.Fatalf("expected thermostat 1, got %+v", th)
+	}
+
+	var res errResponse
+	get(srv.URL+"/v1/thermostats/1/humidity", t, &res)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid field, got %d", http.StatusBadRequest, res.Code)
+	}
+
+	resp, err := http.Post(srv.URL+"/v1/thermostats", "application/json", bytes.NewBufferString(`{"name": "Pantry Thermostat"}`))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&th); err != nil || th.Name != "Pantry Thermostat" {
+		t.Fatalf("expected the new thermostat to be returned, got %+v (%v)", th, err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected content type application/json, got %s", ct)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/v1/thermostats/"+strconv.Itoa(th.ID) {
+		t.Fatalf("expected status %d with the location of the new thermostat, got %d %q", http.StatusCreated, resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// methods the path isn't served with are listed by the Allow header
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/thermostats/1/name", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, DELETE" {
+		t.Fatalf("expected status %d allowing GET and DELETE, got %+v (%v)", http.StatusMethodNotAllowed, resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// websockets need fasthttp to hijack the connection
+	req, _ = http.NewRequest("GET", srv.URL+"/v1/rpc", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected status %d for a websocket, got %d", http.StatusNotImplemented, resp.StatusCode)
+	}
+}
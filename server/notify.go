@@ -0,0 +1,691 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// deliveryImmediate sends every alert as it fires, deliveryDigest sends a single summary a day
+	deliveryImmediate = "immediate"
+	deliveryDigest    = "digest"
+
+	// channelWebhook posts the notification as json to a url
+	channelWebhook = "webhook"
+
+	// defaultDigestAt is the time of day the digest is sent at, unless the preferences give one
+	defaultDigestAt = "08:00"
+
+	// digestInterval is how often the digests are checked for being due
+	digestInterval = time.Minute
+
+	// deliveryQueueSize is how many notifications can wait to be sent before new ones are dropped
+	deliveryQueueSize = 256
+)
+
+// notificationChannel is somewhere notifications are sent to. Channel is the slack channel a bot posts
+// to and ChatID the telegram chat. Secret signs what is posted to a webhook, see sendWebhook. Severities route alerts by severity, so critical ones can go somewhere else than the rest; the
+// channel receives alerts of every severity when empty, and always receives the digests
+type notificationChannel struct {
+	Type       string   `json:"type"`
+	URL        string   `json:"url,omitempty"`
+	Channel    string   `json:"channel,omitempty"`
+	ChatID     string   `json:"chatId,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Severities []string `json:"severities,omitempty"`
+}
+
+// notificationPrefs is the body sent in and returned through the api @ /v1/notifications/:user. Types are
+// the alert types the user receives, every type when empty. LastDigest is when the last digest was sent,
+// the next one covers everything since
+type notificationPrefs struct {
+	Username   string                `json:"username"`
+	Types      []string              `json:"types"`
+	Channels   []notificationChannel `json:"channels"`
+	Delivery   string                `json:"delivery"`
+	DigestAt   string                `json:"digestAt,omitempty"`
+	LastDigest *time.Time            `json:"lastDigest,omitempty"`
+}
+
+// notification is the json sent to the channels of a user, either a single alert or a digest
+type notification struct {
+	Kind     string  `json:"kind"`
+	Home     string  `json:"home"`
+	Username string  `json:"username"`
+	Alert    *alert  `json:"alert,omitempty"`
+	Digest   *digest `json:"digest,omitempty"`
+}
+
+// digest summarizes a day of the home: the alerts that fired and how warm or cold each thermostat got and
+// how long its equipment ran
+type digest struct {
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	Alerts      []alert            `json:"alerts"`
+	Thermostats []thermostatDigest `json:"thermostats"`
+}
+
+// thermostatDigest is the part of a digest about a single thermostat. The extremes and runtimes are
+// derived from the journal, so only what happened within the latest -journal-size changes is known
+type thermostatDigest struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	MinTemp        int    `json:"minTemp"`
+	MaxTemp        int    `json:"maxTemp"`
+	HeatingRuntime string `json:"heatingRuntime"`
+	CoolingRuntime string `json:"coolingRuntime"`
+}
+
+// delivery is a notification waiting to be sent to a channel, or to be sent again when it failed before
+type delivery struct {
+	channel      notificationChannel
+	n            notification
+	redeliveryOf int
+	// attempt is how many times the delivery was tried already
+	attempt int
+}
+
+// notificationStore holds the notification preferences of every user, persisting them to
+// -notifications-file so they survive a restart
+type notificationStore struct {
+	sync.Mutex
+	prefs map[string]*notificationPrefs
+}
+
+var notifications = &notificationStore{prefs: make(map[string]*notificationPrefs)}
+
+// deliveries queues the notifications for deliverNotifications to send, so slow channels never hold up
+// the alerts
+var deliveries = make(chan delivery, deliveryQueueSize)
+
+// notifyClient sends the notifications
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// validateNotificationPrefs validates the preferences sent in, filling in the defaults
+func validateNotificationPrefs(p *notificationPrefs) *errResponse {
+	invalid := func(description string) *errResponse {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Notification Preferences",
+			Description: description,
+		}
+	}
+
+	for _, typ := range p.Types {
+		if errRes := validAlertType(typ); errRes != nil {
+			return errRes
+		}
+	}
+	if len(p.Channels) == 0 {
+		return invalid("At least one channel must be given to notify on.")
+	}
+	for _, ch := range p.Channels {
+		if ch.URL != "" {
+			if u, err := url.Parse(ch.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return invalid("The url '" + ch.URL + "' of a " + ch.Type + " channel must be an absolute http or https url.")
+			}
+		}
+		switch ch.Type {
+		case channelWebhook, channelDiscord:
+			if ch.URL == "" || ch.Channel != "" || ch.ChatID != "" {
+				return invalid("A " + ch.Type + " channel needs the 'url' to post to, and nothing else.")
+			}
+			if ch.Type == channelDiscord && ch.Secret != "" {
+				return invalid("Only webhook channels are signed with a 'secret'.")
+			}
+		case channelSlack:
+			if ch.ChatID != "" || ch.Secret != "" {
+				return invalid("A slack channel is given by its 'channel', not a 'chatId'.")
+			}
+			if description := validateSlackChannel(ch); description != "" {
+				return invalid(description)
+			}
+		case channelTelegram:
+			if ch.ChatID == "" || ch.URL != "" || ch.Channel != "" || ch.Secret != "" {
+				return invalid("A telegram channel needs the 'chatId' of the chat the bot sends to, and nothing else.")
+			}
+			if secrets.Get("telegram-token") == "" {
+				return invalid("Telegram chats can only be sent to once -telegram-token is given.")
+			}
+		default:
+			return invalid("The channel type '" + ch.Type + "' is not valid. Valid choices are '" + channelWebhook + "', '" + channelSlack + "', '" + channelTelegram + "' or '" + channelDiscord + "'.")
+		}
+		for _, severity := range ch.Severities {
+			if severity != severityInfo && severity != severityWarning && severity != severityCritical {
+				return invalid("The severity '" + severity + "' is not valid. Valid choices are '" + severityInfo + "', '" + severityWarning + "' or '" + severityCritical + "'.")
+			}
+		}
+	}
+
+	if p.Delivery == "" {
+		p.Delivery = deliveryImmediate
+	}
+	switch p.Delivery {
+	case deliveryImmediate:
+		p.DigestAt = ""
+	case deliveryDigest:
+		if p.DigestAt == "" {
+			p.DigestAt = defaultDigestAt
+		}
+		if _, ok := minutesOf(p.DigestAt); !ok {
+			return invalid("The digest time '" + p.DigestAt + "' must be a time of day given as HH:MM, e.g. 08:00.")
+		}
+	default:
+		return invalid("The delivery '" + p.Delivery + "' is not valid. Valid choices are '" + deliveryImmediate + "' or '" + deliveryDigest + "'.")
+	}
+	return nil
+}
+
+// wants reports whether the preferences ask for alerts of the given type
+func (p *notificationPrefs) wants(typ string) bool {
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// load restores the preferences persisted at path. A missing file means no user has any
+func (s *notificationStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []*notificationPrefs
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, p := range saved {
+		s.prefs[p.Username] = p
+	}
+	return nil
+}
+
+// save persists the preferences to -notifications-file, if given. The lock must be held
+func (s *notificationStore) save() error {
+	if cfg.NotificationsFile == "" {
+		return nil
+	}
+
+	jsn, err := json.Marshal(s.list())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.NotificationsFile, jsn, 0644)
+}
+
+// list returns a copy of the preferences of every user by username. The lock must be held
+func (s *notificationStore) list() []notificationPrefs {
+	list := make([]notificationPrefs, 0, len(s.prefs))
+	for _, p := range s.prefs {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// reset forgets the preferences of every user
+func (s *notificationStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.prefs = make(map[string]*notificationPrefs)
+}
+
+// Prefs returns the preferences of the user, if any
+func (s *notificationStore) Prefs(username string) (notificationPrefs, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.prefs[username]
+	if !ok {
+		return notificationPrefs{}, false
+	}
+	return *p, true
+}
+
+// Set replaces the preferences of the user. A digest covers what happened since it was last sent, or since
+// the user first asked for one
+func (s *notificationStore) Set(p notificationPrefs, now time.Time) (notificationPrefs, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, existed := s.prefs[p.Username]
+	p.LastDigest = &now
+	if existed && previous.LastDigest != nil {
+		p.LastDigest = previous.LastDigest
+	}
+	s.prefs[p.Username] = &p
+	if err := s.save(); err != nil {
+		if existed {
+			s.prefs[p.Username] = previous
+		} else {
+			delete(s.prefs, p.Username)
+		}
+		return notificationPrefs{}, err
+	}
+	return p, nil
+}
+
+// Remove removes the preferences of the user, reporting whether there were any
+func (s *notificationStore) Remove(username string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.prefs[username]
+	if !ok {
+		return false, nil
+	}
+	delete(s.prefs, username)
+	if err := s.save(); err != nil {
+		s.prefs[username] = p
+		return true, err
+	}
+	return true, nil
+}
+
+// Immediate returns the preferences of every user to notify of an alert of the given type as it fires
+func (s *notificationStore) Immediate(typ string) []notificationPrefs {
+	s.Lock()
+	defer s.Unlock()
+
+	var list []notificationPrefs
+	for _, p := range s.list() {
+		if p.Delivery == deliveryImmediate && p.wants(typ) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// DueDigests returns the preferences of every user whose digest is due at the given time, marking them as
+// sent. Each returned copy still has the time of the digest before, which the digest runs from
+func (s *notificationStore) DueDigests(now time.Time) []notificationPrefs {
+	s.Lock()
+	defer s.Unlock()
+
+	var due []notificationPrefs
+	for _, p := range s.prefs {
+		if p.Delivery != deliveryDigest {
+			continue
+		}
+		m, _ := minutesOf(p.DigestAt)
+		local := now.In(time.Local)
+		at := time.Date(local.Year(), local.Month(), local.Day(), m/60, m%60, 0, 0, time.Local)
+		if at.After(now) {
+			at = at.AddDate(0, 0, -1)
+		}
+		if p.LastDigest != nil && !p.LastDigest.Before(at) {
+			continue
+		}
+
+		due = append(due, *p)
+		sent := now
+		p.LastDigest = &sent
+	}
+	if len(due) > 0 {
+		if err := s.save(); err != nil {
+			log.Println("failed to persist the notification preferences with error:", err)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Username < due[j].Username })
+	return due
+}
+
+// notifyAlert queues the alert for every user who wants it straight away. An equipment alert only goes to
+// the technician of the on-call rotation who is on call, whatever their preferences, and not to the others
+func notifyAlert(a alert) {
+	var technicians []string
+	if a.Type == eventEquipment {
+		_, technicians = onCall.Routes(a.FiredAt)
+	}
+
+	for _, p := range notifications.Immediate(a.Type) {
+		if inArray(p.Username, technicians) || p.Username == a.OnCall {
+			continue
+		}
+		a := a
+		queueNotification(p, notification{Kind: "alert", Home: cfg.Home, Username: p.Username, Alert: &a})
+	}
+	if a.OnCall != "" {
+		if p, ok := notifications.Prefs(a.OnCall); ok {
+			queueNotification(p, notification{Kind: "alert", Home: cfg.Home, Username: p.Username, Alert: &a})
+		} else {
+			log.Println("failed to page " + a.OnCall + ", who is on call but has no notification preferences")
+		}
+	}
+}
+
+// routes reports whether the notification is for the channel, which only holds back alerts of the
+// severities it isn't routed
+func (ch notificationChannel) routes(n notification) bool {
+	if n.Alert == nil || len(ch.Severities) == 0 {
+		return true
+	}
+	for _, severity := range ch.Severities {
+		if severity == n.Alert.Severity {
+			return true
+		}
+	}
+	return false
+}
+
+// queueNotification queues the notification for every channel of the user it's routed to, dropping it
+// when the queue is full rather than holding up the caller
+func queueNotification(p notificationPrefs, n notification) {
+	for _, ch := range p.Channels {
+		if !ch.routes(n) {
+			continue
+		}
+		select {
+		case deliveries <- delivery{channel: ch, n: n}:
+		default:
+			log.Println("dropped a " + n.Kind + " notification to " + p.Username + ", the delivery queue is full")
+		}
+	}
+}
+
+// deliverNotifications sends the queued notifications until stop is closed, logging every delivery and
+// retrying the failed ones with the policy
+func deliverNotifications(policy retryPolicy, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case d := <-deliveries:
+			id := deliveryLog.reserve()
+			start := time.Now()
+			status, err := d.channel.send(d.n, id)
+			deliveryLog.add(id, d, start, status, err)
+			if err != nil {
+				retryDelivery(d, err, policy)
+			}
+		}
+	}
+}
+
+// retryDelivery queues the failed delivery again after a backoff, as the policy of -delivery-attempts says,
+// so a channel that is down doesn't hold up the deliveries to every other one. A delivery that fails every
+// attempt lands in the dead letter queue
+func retryDelivery(d delivery, err error, policy retryPolicy) {
+	d.attempt++
+	if d.attempt >= policy.Attempts {
+		log.Println("failed to send a "+d.n.Kind+" notification to "+d.n.Username+" after", d.attempt, "attempts with error:", err)
+		n := d.n
+		d.redeliveryOf = 0
+		deadLetters.add(&deadLetter{
+			Kind:         deadLetterNotification,
+			Target:       d.channel.Type,
+			Notification: &n,
+			Error:        err.Error(),
+			Attempts:     d.attempt,
+			delivery:     d,
+		})
+		return
+	}
+
+	time.AfterFunc(policy.backoff(d.attempt), func() {
+		select {
+		case deliveries <- d:
+		default:
+			log.Println("dropped a retry of a " + d.n.Kind + " notification to " + d.n.Username + ", the delivery queue is full")
+		}
+	})
+}
+
+// send sends the notification to the channel, returning the status the channel responded with
+func (ch notificationChannel) send(n notification, deliveryID int) (int, error) {
+	switch ch.Type {
+	case channelSlack:
+		return ch.sendSlack(n)
+	case channelTelegram:
+		return ch.sendTelegram(n)
+	case channelDiscord:
+		return ch.sendDiscord(n)
+	}
+	return ch.sendWebhook(n, deliveryID)
+}
+
+// runDigests sends the digests that are due every interval until stop is closed. Only the leader sends
+// them, so a cluster sends each digest once
+func runDigests(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !cluster.IsLeader() {
+			continue
+		}
+		sendDueDigests(time.Now())
+	}
+}
+
+// sendDueDigests queues the digest of every user whose digest is due at the given time
+func sendDueDigests(now time.Time) {
+	for _, p := range notifications.DueDigests(now) {
+		from := now.AddDate(0, 0, -1)
+		if p.LastDigest != nil {
+			from = *p.LastDigest
+		}
+
+		d := &digest{From: from, To: now, Alerts: []alert{}, Thermostats: home.Digest(from, now)}
+		for _, a := range alerts.Alerts("", 0, "") {
+			if !a.Suppressed && p.wants(a.Type) && a.FiredAt.After(from) && !a.FiredAt.After(now) {
+				d.Alerts = append(d.Alerts, a)
+			}
+		}
+		queueNotification(p, notification{Kind: "digest", Home: cfg.Home, Username: p.Username, Digest: d})
+	}
+}
+
+// Digest returns the temperature extremes and runtimes of every thermostat between from and to, by id
+func (home *currentState) Digest(from, to time.Time) []thermostatDigest {
+	home.Lock()
+	extremes := make(map[int]*thermostatDigest)
+	record := func(id, temp int) {
+		d, ok := extremes[id]
+		switch {
+		case !ok:
+			extremes[id] = &thermostatDigest{ID: id, MinTemp: temp, MaxTemp: temp}
+		case temp < d.MinTemp:
+			d.MinTemp = temp
+		case temp > d.MaxTemp:
+			d.MaxTemp = temp
+		}
+	}
+
+	// the temperature a thermostat had as the window started counts as well
+	before := make(map[int]int)
+	for id, t := range home.journal.base {
+		before[id] = t.CurrentTemp
+	}
+	for _, c := range home.journal.changes {
+		if c.Time.After(to) {
+			break
+		}
+		for _, t := range c.Thermostats {
+			if c.Time.After(from) {
+				record(t.ID, t.CurrentTemp)
+			} else {
+				before[t.ID] = t.CurrentTemp
+			}
+		}
+	}
+	for id, temp := range before {
+		record(id, temp)
+	}
+	names := make(map[int]string)
+	for id, t := range home.thermostats {
+		names[id] = t.Name
+	}
+	home.Unlock()
+
+	list := make([]thermostatDigest, 0, len(names))
+	for id, name := range names {
+		d := thermostatDigest{ID: id}
+		if e, ok := extremes[id]; ok {
+			d = *e
+		}
+		d.Name = name
+
+		var heating, cooling time.Duration
+		for _, c := range home.Cycles(id) {
+			start, end := c.Start, to
+			if c.End != nil && c.End.Before(to) {
+				end = *c.End
+			}
+			if start.Before(from) {
+				start = from
+			}
+			if end.After(start) && c.Mode == hvacHeating {
+				heating += end.Sub(start)
+			} else if end.After(start) {
+				cooling += end.Sub(start)
+			}
+		}
+		d.HeatingRuntime, d.CoolingRuntime = heating.Round(time.Second).String(), cooling.Round(time.Second).String()
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// checkOwnPrefs makes sure an authenticated user only manages their own preferences
+func checkOwnPrefs(req *fasthttp.RequestCtx, username string) *errResponse {
+	if u := requestUser(req); u != "" && u != username {
+		return &errResponse{
+			Code:        http.StatusForbidden,
+			Msg:         "Forbidden",
+			Description: "User " + u + " may only manage their own notification preferences.",
+		}
+	}
+	return nil
+}
+
+// sendNotificationsError sends back the error of persisting the preferences
+func sendNotificationsError(req *fasthttp.RequestCtx, err error) {
+	res := &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Failed to persist notification preferences",
+		Description: err.Error(),
+	}
+	reportError(req, err)
+	req.SetStatusCode(http.StatusInternalServerError)
+	sendJSON(req, res)
+}
+
+// prefsNotFound builds the error response for a user without notification preferences
+func prefsNotFound(username string) *errResponse {
+	return &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "User " + username + " has no notification preferences.",
+	}
+}
+
+// GetNotifications is the handler to return the notification preferences of a user
+func GetNotifications(req *fasthttp.RequestCtx) {
+	username := req.UserValue("user").(string)
+	if errRes := checkOwnPrefs(req, username); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	p, ok := notifications.Prefs(username)
+	if !ok {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, prefsNotFound(username))
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, p)
+}
+
+// PutNotifications is the handler to set the notification preferences of a user
+func PutNotifications(req *fasthttp.RequestCtx) {
+	username := req.UserValue("user").(string)
+	if errRes := checkOwnPrefs(req, username); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	var body notificationPrefs
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	body.Username = username
+	if errRes := validateNotificationPrefs(&body); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	p, err := notifications.Set(body, time.Now())
+	if err != nil {
+		sendNotificationsError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, p)
+}
+
+// DeleteNotifications is the handler to stop notifying a user
+func DeleteNotifications(req *fasthttp.RequestCtx) {
+	username := req.UserValue("user").(string)
+	if errRes := checkOwnPrefs(req, username); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	found, err := notifications.Remove(username)
+	if err != nil {
+		sendNotificationsError(req, err)
+		return
+	}
+	if !found {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, prefsNotFound(username))
+		return
+	}
+
+	req.SetStatusCode(http.StatusNoContent)
+}
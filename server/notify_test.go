@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// putNotifications sets the notification preferences of the user, returning the status code and the
+// preferences
+func putNotifications(base, username, body string, t *testing.T) (int, notificationPrefs) {
+	req, err := http.NewRequest("PUT", base+"/v1/notifications/"+username, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var p notificationPrefs
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+			t.Fatalf("failed to decode the preferences: %s", err)
+		}
+	}
+	return resp.StatusCode, p
+}
+
+// newWebhook starts a server receiving notifications, returning its url and the notifications it receives
+func newWebhook(t *testing.T) (string, <-chan notification) {
+	received := make(chan notification, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("failed to decode the notification: %s", err)
+		}
+		received <- n
+	}))
+	t.Cleanup(hook.Close)
+	return hook.URL, received
+}
+
+// receive waits for the next notification
+func receive(received <-chan notification, t *testing.T) notification {
+	select {
+	case n := <-received:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a notification")
+	}
+	return notification{}
+}
+
+func TestNotifications(t *testing.T) {
+	base := newTestServer(t)
+	hook, received := newWebhook(t)
+
+	for _, body := range []string{
+		`{"channels": []}`,
+		`{"channels": [{"type": "pager", "url": "` + hook + `"}]}`,
+		`{"channels": [{"type": "webhook", "url": "/relative"}]}`,
+		`{"types": ["change"], "channels": [{"type": "webhook", "url": "` + hook + `"}]}`,
+		`{"channels": [{"type": "webhook", "url": "` + hook + `"}], "delivery": "weekly"}`,
+		`{"channels": [{"type": "webhook", "url": "` + hook + `"}], "delivery": "digest", "digestAt": "8am"}`,
+	} {
+		if code, _ := putNotifications(base, "alice", body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	code, p := putNotifications(base, "alice", `{"types": ["offline"], "channels": [{"type": "webhook", "url": "`+hook+`"}]}`, t)
+	if code != http.StatusOK || p.Delivery != deliveryImmediate || p.Username != "alice" {
+		t.Fatalf("expected immediate delivery, got %d %+v", code, p)
+	}
+
+	// only new alerts of the types asked for are sent
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventAnomaly, t1, severityWarning, "Temperature jumped.")
+	publishDetail(eventOffline, t1, severityWarning, "Thermostat 1 went offline.")
+	publishDetail(eventOffline, t1, severityWarning, "Thermostat 1 went offline.")
+	n := receive(received, t)
+	if n.Kind != "alert" || n.Username != "alice" || n.Alert == nil || n.Alert.Type != eventOffline {
+		t.Fatalf("expected the offline alert, got %+v", n)
+	}
+	select {
+	case n := <-received:
+		t.Fatalf("expected a single notification, got %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var got notificationPrefs
+	get(base+"/v1/notifications/alice", t, &got)
+	if len(got.Types) != 1 || len(got.Channels) != 1 {
+		t.Fatalf("expected the preferences to be returned, got %+v", got)
+	}
+	if code := del(base+"/v1/notifications/alice", t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+	if code := del(base+"/v1/notifications/alice", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d without preferences, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestNotificationDigest(t *testing.T) {
+	base := newTestServer(t)
+	hook, received := newWebhook(t)
+
+	now := time.Now()
+	code, p := putNotifications(base, "bob", `{"channels": [{"type": "webhook", "url": "`+hook+`"}], "delivery": "digest", "digestAt": "`+now.Add(-time.Minute).Format(clockLayout)+`"}`, t)
+	if code != http.StatusOK || p.LastDigest == nil {
+		t.Fatalf("expected digest delivery, got %d %+v", code, p)
+	}
+
+	// the digest isn't due until its time has come round after it was asked for
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventAnomaly, t1, severityWarning, "Temperature jumped.")
+	home.RecordTemp(t1, t1.CurrentTemp-5)
+	t1, _ = home.Thermostat(1)
+	home.RecordTemp(t1, t1.CurrentTemp+8)
+	sendDueDigests(now)
+	select {
+	case n := <-received:
+		t.Fatalf("expected no digest yet, got %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	tomorrow := now.AddDate(0, 0, 1)
+	sendDueDigests(tomorrow)
+	n := receive(received, t)
+	if n.Kind != "digest" || n.Digest == nil || len(n.Digest.Alerts) != 1 || !n.Digest.To.Equal(tomorrow) {
+		t.Fatalf("expected a digest with the anomaly, got %+v", n)
+	}
+	d := n.Digest.Thermostats[0]
+	if d.ID != 1 || d.MaxTemp-d.MinTemp != 8 || d.HeatingRuntime == "" {
+		t.Fatalf("expected the extremes of thermostat 1, got %+v", d)
+	}
+
+	// and it's sent once a day
+	sendDueDigests(tomorrow.Add(time.Minute))
+	select {
+	case n := <-received:
+		t.Fatalf("expected a single digest, got %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
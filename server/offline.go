@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// queuedWrite is a field of an update made to a thermostat while its device was offline, waiting to be
+// applied once the device reconnects. Returned through the api @ /v1/thermostats/:id/queued
+type queuedWrite struct {
+	Field    string      `json:"field"`
+	Value    interface{} `json:"value"`
+	User     string      `json:"user,omitempty"`
+	QueuedAt time.Time   `json:"queuedAt"`
+	Expires  time.Time   `json:"expires"`
+
+	// update sets only this field of the thermostat
+	update updateThermostat
+}
+
+// splitUpdate splits an update into a write for every field it sets
+func splitUpdate(d updateThermostat) []*queuedWrite {
+	var writes []*queuedWrite
+	add := func(field string, value interface{}, update updateThermostat) {
+		writes = append(writes, &queuedWrite{Field: field, Value: value, update: update})
+	}
+
+	if d.Name != "" {
+		add("name", d.Name, updateThermostat{Name: d.Name})
+	}
+	if d.OperatingMode != "" {
+		add("mode", d.OperatingMode, updateThermostat{OperatingMode: d.OperatingMode})
+	}
+	if d.CoolSetPoint != 0 {
+		add("coolSetPoint", d.CoolSetPoint, updateThermostat{CoolSetPoint: d.CoolSetPoint})
+	}
+	if d.HeatSetPoint != 0 {
+		add("heatSetPoint", d.HeatSetPoint, updateThermostat{HeatSetPoint: d.HeatSetPoint})
+	}
+	if d.FanMode != "" {
+		add("fan", d.FanMode, updateThermostat{FanMode: d.FanMode})
+	}
+	if d.Tags != nil {
+		add("tags", d.Tags, updateThermostat{Tags: d.Tags})
+	}
+	if d.Location != nil {
+		add("location", d.Location, updateThermostat{Location: d.Location})
+	}
+	return writes
+}
+
+// mergeUpdate sets every field the source sets on the destination
+func mergeUpdate(dst *updateThermostat, src updateThermostat) {
+	if src.Name != "" {
+		dst.Name = src.Name
+	}
+	if src.OperatingMode != "" {
+		dst.OperatingMode = src.OperatingMode
+	}
+	if src.CoolSetPoint != 0 {
+		dst.CoolSetPoint = src.CoolSetPoint
+	}
+	if src.HeatSetPoint != 0 {
+		dst.HeatSetPoint = src.HeatSetPoint
+	}
+	if src.FanMode != "" {
+		dst.FanMode = src.FanMode
+	}
+	if src.Tags != nil {
+		dst.Tags = src.Tags
+	}
+	if src.Location != nil {
+		dst.Location = src.Location
+	}
+}
+
+// offlineQueue holds the updates made to thermostats while their devices are offline, by field, so the
+// latest write of every field wins once a device reconnects. A write that isn't applied before it expires
+// is dropped, so a device that was gone for long isn't handed stale settings
+type offlineQueue struct {
+	sync.Mutex
+	queued map[int]map[string]*queuedWrite
+}
+
+// offlineWrites are the updates waiting for devices to reconnect
+var offlineWrites = &offlineQueue{queued: make(map[int]map[string]*queuedWrite)}
+
+// expire drops the writes queued for the thermostat that expired by now. Must be called with the lock held
+func (q *offlineQueue) expire(id int, now time.Time) {
+	for field, w := range q.queued[id] {
+		if !now.Before(w.Expires) {
+			delete(q.queued[id], field)
+		}
+	}
+	if len(q.queued[id]) == 0 {
+		delete(q.queued, id)
+	}
+}
+
+// Queue queues every field the update sets for the thermostat until it expires, replacing the writes
+// already queued for those fields, and returns every write now queued for it
+func (q *offlineQueue) Queue(id int, desired updateThermostat, user string, ttl time.Duration) []*queuedWrite {
+	q.Lock()
+	now := time.Now()
+	q.expire(id, now)
+	for _, w := range splitUpdate(desired) {
+		w.User = user
+		w.QueuedAt = now
+		w.Expires = now.Add(ttl)
+		if q.queued[id] == nil {
+			q.queued[id] = make(map[string]*queuedWrite)
+		}
+		q.queued[id][w.Field] = w
+	}
+	q.Unlock()
+
+	return q.Pending(id)
+}
+
+// Pending returns the writes queued for the thermostat that haven't expired, in order by field
+func (q *offlineQueue) Pending(id int) []*queuedWrite {
+	q.Lock()
+	defer q.Unlock()
+
+	q.expire(id, time.Now())
+	pending := make([]*queuedWrite, 0, len(q.queued[id]))
+	for _, w := range q.queued[id] {
+		pending = append(pending, w)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Field < pending[j].Field })
+	return pending
+}
+
+// take removes every write queued for the thermostat, returning those that haven't expired merged into a
+// single update
+func (q *offlineQueue) take(id int) (updateThermostat, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.expire(id, time.Now())
+	var merged updateThermostat
+	for _, w := range q.queued[id] {
+		mergeUpdate(&merged, w.update)
+	}
+	_, ok := q.queued[id]
+	delete(q.queued, id)
+	return merged, ok
+}
+
+// Clear drops every write queued for the thermostat
+func (q *offlineQueue) Clear(id int) {
+	q.Lock()
+	delete(q.queued, id)
+	q.Unlock()
+}
+
+// reset drops every queued write
+func (q *offlineQueue) reset() {
+	q.Lock()
+	q.queued = make(map[int]map[string]*queuedWrite)
+	q.Unlock()
+}
+
+// applyQueued applies the writes queued for the thermostat as its device reconnects, unless it was
+// disabled in the meantime
+func (home *currentState) applyQueued(target *thermostat) (*thermostat, error) {
+	desired, ok := offlineWrites.take(target.ID)
+	if !ok || checkDisabled(target, desired) != nil {
+		return target, nil
+	}
+	return home.UpdateThermostat(target, desired)
+}
+
+// queuesOffline reports whether the write is taken while the device of the thermostat is offline: an
+// update that is queued until the device reconnects, or dropping the updates queued for it
+func queuesOffline(req *fasthttp.RequestCtx, t *thermostat) bool {
+	if cfg.OfflineTTL <= 0 {
+		return false
+	}
+
+	path := "/v1/thermostats/" + strconv.Itoa(t.ID)
+	return req.IsPut() && string(req.Path()) == path || req.IsDelete() && string(req.Path()) == path+"/queued"
+}
+
+// queueOffline is the response to an update of a thermostat whose device is offline, queueing the update
+// for the configured ttl, or the ?ttl= given as a duration such as 15m
+func queueOffline(req *fasthttp.RequestCtx, target *thermostat, desired updateThermostat) {
+	ttl := cfg.OfflineTTL
+	if v := string(req.QueryArgs().Peek("ttl")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid ttl provided",
+				Description: "The ttl '" + v + "' must be a positive duration, e.g. 15m or 2h.",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+		ttl = d
+	}
+
+	req.SetStatusCode(http.StatusAccepted)
+	sendJSON(req, offlineWrites.Queue(target.ID, desired, requestUser(req), ttl))
+}
+
+// GetQueued is the handler to return the writes waiting for the device of a specific thermostat to
+// reconnect
+func GetQueued(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, offlineWrites.Pending(t.ID))
+}
+
+// DeleteQueued is the handler to drop the writes waiting for the device of a specific thermostat to
+// reconnect
+func DeleteQueued(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+	offlineWrites.Clear(t.ID)
+
+	req.SetStatusCode(http.StatusNoContent)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOfflineQueue(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.OfflineTTL = time.Hour
+	})
+	therm, _ := home.Thermostat(1)
+	fan := therm.FanMode
+	home.SetOffline(therm, true)
+
+	// updates are validated before they are queued, and the latest write of a field wins
+	url := base + "/v1/thermostats/1"
+	if code := put(url, `{"mode": "warm"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid mode, got %d", http.StatusBadRequest, code)
+	}
+	for _, body := range []string{`{"mode": "cool", "heatSetPoint": 60}`, `{"heatSetPoint": 62}`} {
+		if code := put(url, body, t); code != http.StatusAccepted {
+			t.Fatalf("expected the update to be queued, got %d", code)
+		}
+	}
+	if code := put(url+"?ttl=1ms", `{"fan": "on"}`, t); code != http.StatusAccepted {
+		t.Fatalf("expected the update to be queued, got %d", code)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	var queued []queuedWrite
+	get(url+"/queued", t, &queued)
+	if len(queued) != 2 || queued[0].Field != "heatSetPoint" || queued[0].Value != float64(62) || queued[1].Field != "mode" {
+		t.Fatalf("expected the heat setpoint and the mode to be queued and the fan to expire, got %+v", queued)
+	}
+
+	// the queued updates are applied once the device reconnects
+	therm, _ = home.Thermostat(1)
+	home.SetOffline(therm, false)
+	if therm, _ = home.Thermostat(1); therm.OperatingMode != "cool" || therm.HeatSetPoint != 62 || therm.FanMode != fan {
+		t.Fatalf("expected the queued updates to be applied, got %+v", therm)
+	}
+	if pending := offlineWrites.Pending(1); len(pending) != 0 {
+		t.Fatalf("expected nothing left queued, got %+v", pending)
+	}
+
+	// queued updates can be dropped while the device is offline
+	home.SetOffline(therm, true)
+	put(url, `{"fan": "on"}`, t)
+	if code := del(url+"/queued", t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected the queued updates to be dropped, got %d", code)
+	}
+	therm, _ = home.Thermostat(1)
+	if therm, _ = home.SetOffline(therm, false); therm.FanMode != fan {
+		t.Fatalf("expected the dropped update not to be applied, got %+v", therm)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// defaultShift is how long each technician of a rotation is on call for, unless the rotation gives it
+const defaultShift = "168h"
+
+// onCallOverride puts a technician on call instead of the rotation until a given time, e.g. to cover for
+// whoever is out sick
+type onCallOverride struct {
+	Username string    `json:"username"`
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// onCallRotation is the body sent in and returned through the api @ /v1/oncall. The technicians take turns
+// being on call for a shift each, in order, from Start on. Equipment alerts are routed to whoever is on
+// call instead of every technician, through their notification preferences
+type onCallRotation struct {
+	Technicians []string        `json:"technicians"`
+	Start       time.Time       `json:"start"`
+	Shift       string          `json:"shift"` // e.g. "24h", defaults to a week
+	Override    *onCallOverride `json:"override,omitempty"`
+}
+
+// onCallStatus is who is on call and until when, returned through the api @ /v1/oncall along with the
+// rotation. Next is who takes over at the next handoff
+type onCallStatus struct {
+	onCallRotation
+	OnCall string    `json:"onCall"`
+	Until  time.Time `json:"until"`
+	Next   string    `json:"next"`
+}
+
+// onCallHandoff is the optional body sent in through the api @ /v1/oncall/handoff. To defaults to the next
+// technician of the rotation
+type onCallHandoff struct {
+	To string `json:"to"`
+}
+
+// onCallStore holds the on-call rotation, persisting it to -oncall-file so it survives a restart
+type onCallStore struct {
+	sync.Mutex
+	rotation *onCallRotation
+}
+
+var onCall = &onCallStore{}
+
+// load restores the rotation persisted at path. A missing file means there is no rotation
+func (s *onCallStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved *onCallRotation
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.rotation = saved
+	return nil
+}
+
+// save persists the rotation to -oncall-file, if given. The lock must be held
+func (s *onCallStore) save() error {
+	if cfg.OnCallFile == "" {
+		return nil
+	}
+
+	jsn, err := json.Marshal(s.rotation)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.OnCallFile, jsn, 0644)
+}
+
+// reset forgets the rotation
+func (s *onCallStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.rotation = nil
+}
+
+// status returns who of the rotation is on call at the given time
+func (r onCallRotation) status(now time.Time) onCallStatus {
+	shift, _ := time.ParseDuration(r.Shift)
+	n := len(r.Technicians)
+
+	// shifts before the start of the rotation count backwards, so there is always someone on call
+	turn := int(now.Sub(r.Start) / shift)
+	if now.Before(r.Start) {
+		turn--
+	}
+	i := (turn%n + n) % n
+
+	st := onCallStatus{
+		onCallRotation: r,
+		OnCall:         r.Technicians[i],
+		Until:          r.Start.Add(time.Duration(turn+1) * shift),
+		Next:           r.Technicians[(i+1)%n],
+	}
+	if r.Override != nil && now.Before(r.Override.Until) {
+		st.OnCall = r.Override.Username
+		if r.Override.Until.Before(st.Until) {
+			st.Until, st.Next = r.Override.Until, r.Technicians[i]
+		}
+	}
+	return st
+}
+
+// Status returns who is on call at the given time, and false when there is no rotation
+func (s *onCallStore) Status(now time.Time) (onCallStatus, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rotation == nil {
+		return onCallStatus{}, false
+	}
+	return s.rotation.status(now), true
+}
+
+// Routes returns who an equipment alert fired at the given time is routed to, and the technicians it's
+// held back from. Both are empty when there is no rotation
+func (s *onCallStore) Routes(now time.Time) (string, []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rotation == nil {
+		return "", nil
+	}
+	return s.rotation.status(now).OnCall, append([]string(nil), s.rotation.Technicians...)
+}
+
+// Set replaces the rotation, or removes it when nil
+func (s *onCallStore) Set(r *onCallRotation) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous := s.rotation
+	s.rotation = r
+	if err := s.save(); err != nil {
+		s.rotation = previous
+		return err
+	}
+	return nil
+}
+
+// Update changes the rotation with the given function, which returns the error response to give instead
+func (s *onCallStore) Update(now time.Time, change func(r *onCallRotation) *errResponse) (onCallStatus, *errResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rotation == nil {
+		return onCallStatus{}, noRotation(), nil
+	}
+	previous := *s.rotation
+	if errRes := change(s.rotation); errRes != nil {
+		*s.rotation = previous
+		return onCallStatus{}, errRes, nil
+	}
+	if err := s.save(); err != nil {
+		*s.rotation = previous
+		return onCallStatus{}, nil, err
+	}
+	return s.rotation.status(now), nil, nil
+}
+
+// Forget takes the user off the rotation, along with an override putting them on call, removing the
+// rotation once nobody is left on it. It reports whether the user was on it
+func (s *onCallStore) Forget(username string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rotation == nil {
+		return false, nil
+	}
+	previous := s.rotation
+	r := *previous
+	r.Technicians = nil
+	for _, technician := range previous.Technicians {
+		if technician != username {
+			r.Technicians = append(r.Technicians, technician)
+		}
+	}
+	named := len(r.Technicians) != len(previous.Technicians)
+	if r.Override != nil && r.Override.Username == username {
+		r.Override, named = nil, true
+	}
+	if !named {
+		return false, nil
+	}
+
+	s.rotation = &r
+	if len(r.Technicians) == 0 {
+		s.rotation = nil
+	}
+	if err := s.save(); err != nil {
+		s.rotation = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// noRotation builds the error response for when there is no on-call rotation
+func noRotation() *errResponse {
+	return &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "There is no on-call rotation.",
+	}
+}
+
+// checkTechnician makes sure alerts can reach the user, who needs notification preferences
+func checkTechnician(username string) *errResponse {
+	if _, ok := notifications.Prefs(username); !ok {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Technician",
+			Description: "User " + username + " has no notification preferences to send alerts to.",
+		}
+	}
+	return nil
+}
+
+// validateRotation validates the rotation sent in, filling in the defaults
+func validateRotation(r *onCallRotation, now time.Time) *errResponse {
+	invalid := func(description string) *errResponse {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid On-Call Rotation",
+			Description: description,
+		}
+	}
+
+	if len(r.Technicians) == 0 {
+		return invalid("At least one technician must be given to be on call.")
+	}
+	for i, username := range r.Technicians {
+		if inArray(username, r.Technicians[:i]) {
+			return invalid("Technician " + username + " is listed more than once.")
+		}
+		if errRes := checkTechnician(username); errRes != nil {
+			return errRes
+		}
+	}
+	if r.Start.IsZero() {
+		r.Start = now
+	}
+	if r.Shift == "" {
+		r.Shift = defaultShift
+	}
+	if shift, err := time.ParseDuration(r.Shift); err != nil || shift < time.Hour {
+		return invalid("The shift must be a duration of at least an hour, e.g. 24h or 168h.")
+	}
+	if r.Override != nil {
+		return invalid("An override is set through /v1/oncall/override.")
+	}
+	return nil
+}
+
+// sendOnCallError sends back the error of persisting the rotation
+func sendOnCallError(req *fasthttp.RequestCtx, err error) {
+	res := &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Failed to persist on-call rotation",
+		Description: err.Error(),
+	}
+	reportError(req, err)
+	req.SetStatusCode(http.StatusInternalServerError)
+	sendJSON(req, res)
+}
+
+// GetOnCall is the handler to return the on-call rotation and who is on call now
+func GetOnCall(req *fasthttp.RequestCtx) {
+	st, ok := onCall.Status(time.Now())
+	if !ok {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, noRotation())
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, st)
+}
+
+// PutOnCall is the handler to set the on-call rotation, starting now unless a start is given
+func PutOnCall(req *fasthttp.RequestCtx) {
+	var body onCallRotation
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	now := time.Now()
+	if errRes := validateRotation(&body, now); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+	if err := onCall.Set(&body); err != nil {
+		sendOnCallError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, body.status(now))
+}
+
+// DeleteOnCall is the handler to remove the on-call rotation, so equipment alerts go to every technician
+// who wants them again
+func DeleteOnCall(req *fasthttp.RequestCtx) {
+	if _, ok := onCall.Status(time.Now()); !ok {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, noRotation())
+		return
+	}
+	if err := onCall.Set(nil); err != nil {
+		sendOnCallError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusNoContent)
+}
+
+// PostOnCallOverride is the handler to put a technician on call instead of the rotation until a given time
+func PostOnCallOverride(req *fasthttp.RequestCtx) {
+	var body onCallOverride
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	now := time.Now()
+	errRes := checkTechnician(body.Username)
+	if errRes == nil && !body.Until.After(now) {
+		errRes = &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Override",
+			Description: "The override must last until after now.",
+		}
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	st, errRes, err := onCall.Update(now, func(r *onCallRotation) *errResponse {
+		r.Override = &body
+		return nil
+	})
+	if err != nil {
+		sendOnCallError(req, err)
+		return
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, st)
+}
+
+// DeleteOnCallOverride is the handler to end an override early, handing back to the rotation
+func DeleteOnCallOverride(req *fasthttp.RequestCtx) {
+	st, errRes, err := onCall.Update(time.Now(), func(r *onCallRotation) *errResponse {
+		if r.Override == nil {
+			return &errResponse{
+				Code:        http.StatusNotFound,
+				Msg:         "Not Found",
+				Description: "The on-call rotation has no override.",
+			}
+		}
+		r.Override = nil
+		return nil
+	})
+	if err != nil {
+		sendOnCallError(req, err)
+		return
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, st)
+}
+
+// PostOnCallHandoff is the handler to hand the pager over before the end of the shift, to the next
+// technician of the rotation or the one given. Their shift starts now and the rotation carries on from it,
+// ending any override
+func PostOnCallHandoff(req *fasthttp.RequestCtx) {
+	var body onCallHandoff
+	if len(req.PostBody()) > 0 {
+		if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid JSON body provided",
+				Description: err.Error(),
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	now := time.Now()
+	st, errRes, err := onCall.Update(now, func(r *onCallRotation) *errResponse {
+		to := body.To
+		if to == "" {
+			to = r.status(now).Next
+		}
+		i := -1
+		for j, username := range r.Technicians {
+			if username == to {
+				i = j
+			}
+		}
+		if i < 0 {
+			return &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Technician",
+				Description: "User " + to + " isn't part of the on-call rotation. Valid choices are: " + listChoices(r.Technicians) + ".",
+			}
+		}
+
+		shift, _ := time.ParseDuration(r.Shift)
+		r.Start = now.Add(-time.Duration(i) * shift)
+		r.Override = nil
+		return nil
+	})
+	if err != nil {
+		sendOnCallError(req, err)
+		return
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, st)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveUsers waits for the next n notifications, returning who they were sent to in order by name, and
+// makes sure no more follow
+func receiveUsers(received <-chan notification, n int, t *testing.T) string {
+	var users []string
+	for i := 0; i < n; i++ {
+		users = append(users, receive(received, t).Username)
+	}
+	select {
+	case n := <-received:
+		t.Fatalf("expected no more notifications, got %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	sort.Strings(users)
+	return strings.Join(users, ",")
+}
+
+func TestOnCall(t *testing.T) {
+	base := newTestServer(t)
+	hook, received := newWebhook(t)
+	url := base + "/v1/oncall"
+
+	// bob only wants a digest and carol manages the site, so she isn't part of the rotation
+	channels := `"channels": [{"type": "webhook", "url": "` + hook + `"}]`
+	putNotifications(base, "alice", `{`+channels+`}`, t)
+	putNotifications(base, "bob", `{`+channels+`, "delivery": "digest"}`, t)
+	putNotifications(base, "carol", `{"types": ["equipment"], `+channels+`}`, t)
+
+	var missing errResponse
+	if get(url, t, &missing); missing.Code != http.StatusNotFound {
+		t.Fatalf("expected no rotation to start with, got %+v", missing)
+	}
+	for _, body := range []string{
+		`{"technicians": []}`,
+		`{"technicians": ["alice", "dave"]}`,
+		`{"technicians": ["alice", "alice"]}`,
+		`{"technicians": ["alice"], "shift": "10m"}`,
+	} {
+		if code := put(url, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+	if code := put(url, `{"technicians": ["alice", "bob"], "shift": "24h"}`, t); code != http.StatusOK {
+		t.Fatalf("expected the rotation to be set, got %d", code)
+	}
+	var st onCallStatus
+	get(url, t, &st)
+	if st.OnCall != "alice" || st.Next != "bob" || st.Until.Sub(st.Start) != 24*time.Hour {
+		t.Fatalf("expected alice on call for a day, got %+v", st)
+	}
+
+	// an equipment alert pages whoever is on call, and the others who want it who aren't technicians
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventEquipment, t1, severityWarning, "The compressor short cycles.")
+	if users := receiveUsers(received, 2, t); users != "alice,carol" {
+		t.Fatalf("expected alice and carol to be notified, got %s", users)
+	}
+	if a := alerts.Alerts("", 1, eventEquipment); len(a) != 1 || a[0].OnCall != "alice" {
+		t.Fatalf("expected the alert to be routed to alice, got %+v", a)
+	}
+
+	// handing off goes to the next technician, whatever their preferences
+	if code := postJSON(url+"/handoff", ``, t, &st); code != http.StatusOK || st.OnCall != "bob" || st.Next != "alice" {
+		t.Fatalf("expected bob to take over, got %d %+v", code, st)
+	}
+	t2, _ := home.Thermostat(2)
+	publishDetail(eventEquipment, t2, severityWarning, "The blower is weak.")
+	if users := receiveUsers(received, 2, t); users != "bob,carol" {
+		t.Fatalf("expected bob and carol to be notified, got %s", users)
+	}
+	if code := postJSON(url+"/handoff", `{"to": "dave"}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a handoff outside the rotation to be rejected, got %d", code)
+	}
+
+	// an override puts someone else on call until it ends
+	if code := postJSON(url+"/override", `{"username": "carol", "until": "2000-01-01T00:00:00Z"}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected an override in the past to be rejected, got %d", code)
+	}
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if code := postJSON(url+"/override", `{"username": "carol", "until": "`+until+`", "reason": "bob is out"}`, t, &st); code != http.StatusOK || st.OnCall != "carol" || st.Next != "bob" {
+		t.Fatalf("expected carol to cover until the override ends, got %d %+v", code, st)
+	}
+	alerts.reset()
+	publishDetail(eventEquipment, t1, severityWarning, "The furnace failed to ignite.")
+	if users := receiveUsers(received, 1, t); users != "carol" {
+		t.Fatalf("expected only carol to be paged, got %s", users)
+	}
+	if code := del(url+"/override", t, nil); code != http.StatusOK {
+		t.Fatalf("expected the override to end, got %d", code)
+	}
+	if code := del(url+"/override", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected no override to end, got %d", code)
+	}
+
+	// the rotation survives a restart
+	onCall.reset()
+	if err := onCall.load(cfg.OnCallFile); err != nil {
+		t.Fatalf("failed to load the rotation: %s", err)
+	}
+	if st, ok := onCall.Status(time.Now()); !ok || st.OnCall != "bob" {
+		t.Fatalf("expected the persisted rotation, got %+v", st)
+	}
+
+	if code := del(url, t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected the rotation to be removed, got %d", code)
+	}
+	if code := postJSON(url+"/handoff", ``, t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected no rotation to hand off, got %d", code)
+	}
+}
+
+func TestOnCallStatus(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	r := onCallRotation{Technicians: []string{"alice", "bob", "carol"}, Start: start, Shift: "24h"}
+
+	for _, tc := range []struct {
+		at     time.Time
+		onCall string
+	}{
+		{start, "alice"},
+		{start.Add(25 * time.Hour), "bob"},
+		{start.Add(3 * 24 * time.Hour), "alice"},
+		// before the start, the rotation runs backwards
+		{start.Add(-time.Hour), "carol"},
+	} {
+		if st := r.status(tc.at); st.OnCall != tc.onCall {
+			t.Fatalf("expected %s on call at %s, got %+v", tc.onCall, tc.at, st)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// SetOrder moves the thermostats with the given ids to the front of the display order, in the order given.
+// Every other thermostat keeps its relative order after them
+func (home *currentState) SetOrder(ids []int) *errResponse {
+	home.writes.Lock()
+	defer home.writes.Unlock()
+
+	home.Lock()
+	changed, errRes := home.reorder(ids)
+	home.Unlock()
+	if errRes != nil {
+		return errRes
+	}
+
+	transitions, err := home.commitHeld(changeOrder, changed...)
+	if err != nil {
+		return commitError(err)
+	}
+	for _, t := range changed {
+		publish(eventChange, t)
+	}
+	publishHVAC(transitions)
+
+	return nil
+}
+
+// reorder returns the copies of the thermostats whose display order changes when the ids are moved to the
+// front. The home must be locked
+func (home *currentState) reorder(ids []int) ([]*thermostat, *errResponse) {
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if _, ok := home.thermostats[id]; !ok {
+			return nil, &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Order",
+				Description: "No thermostat found for id: " + strconv.Itoa(id),
+			}
+		}
+		if seen[id] {
+			return nil, &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Order",
+				Description: "Thermostat " + strconv.Itoa(id) + " is listed more than once.",
+			}
+		}
+		seen[id] = true
+	}
+
+	order := ids
+	for _, t := range sortThermostats(home.thermostats) {
+		if !seen[t.ID] {
+			order = append(order, t.ID)
+		}
+	}
+
+	// thermostats are never modified in place, so work on copies
+	var changed []*thermostat
+	for i, id := range order {
+		if home.thermostats[id].DisplayOrder == i+1 {
+			continue
+		}
+		updated := *home.thermostats[id]
+		updated.DisplayOrder = i + 1
+		changed = append(changed, &updated)
+	}
+
+	return changed, nil
+}
+
+// PutOrder is the handler to set the order the thermostats are listed in from an ordered list of ids
+func PutOrder(req *fasthttp.RequestCtx) {
+	var ids []int
+	if err := unmarshalStrict(req.PostBody(), &ids); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	if errRes := home.SetOrder(ids); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendThermostats(req, home.Thermostats())
+}
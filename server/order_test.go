@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestPutOrder(t *testing.T) {
+	base := newTestServer(t)
+	id, _ := home.AddThermostat(updateThermostat{Name: "Nursery Thermostat"})
+
+	var therms []*thermostat
+	get(base+"/v1/thermostats", t, &therms)
+	if last := therms[len(therms)-1]; last.ID != id {
+		t.Fatalf("expected the new thermostat %d to be listed last, got %d", id, last.ID)
+	}
+
+	if code := put(base+"/v1/thermostats/order", "["+strconv.Itoa(id)+", 2]", t); code != http.StatusOK {
+		t.Fatalf("expected status %d setting the order, got %d", http.StatusOK, code)
+	}
+
+	get(base+"/v1/thermostats", t, &therms)
+	if therms[0].ID != id || therms[1].ID != 2 || therms[2].ID != 1 {
+		t.Fatalf("expected thermostats %d, 2 and 1 to be listed first, got %d, %d and %d", id, therms[0].ID, therms[1].ID, therms[2].ID)
+	}
+	for i, th := range therms {
+		if th.DisplayOrder != i+1 {
+			t.Fatalf("expected thermostat %d to have display order %d, got %d", th.ID, i+1, th.DisplayOrder)
+		}
+	}
+
+	if code := put(base+"/v1/thermostats/order", "[1, 1]", t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a duplicate id, got %d", http.StatusBadRequest, code)
+	}
+
+	// restore the default order for the other tests
+	if code := put(base+"/v1/thermostats/order", "[1, 2]", t); code != http.StatusOK {
+		t.Fatalf("expected status %d restoring the order, got %d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eventOutbox holds the change events that were written to the write-ahead log along with their change and
+// haven't been published yet. The events are numbered, and the number of the last one every publisher was
+// handed is kept in a file next to the log, so after a crash publishing picks up where it left off rather
+// than losing the events of changes that made it to disk, or sending those that went out again
+type eventOutbox struct {
+	sync.Mutex
+	path      string
+	seq       uint64
+	published uint64
+	pending   []event
+	handed    int
+
+	// ready is signalled whenever events are added
+	ready chan struct{}
+}
+
+// changeEvents returns the change events of every thermostat the change writes. Devices going offline and
+// the equipment switching publish events of their own
+func changeEvents(c change) []event {
+	if c.Type == changeOffline || c.Type == changeHVAC {
+		return nil
+	}
+
+	outbox := make([]event, 0, len(c.Thermostats)+len(c.Deleted))
+	for _, t := range c.Thermostats {
+		outbox = append(outbox, event{
+			Schema:     eventSchema,
+			Type:       eventChange,
+			ID:         t.ID,
+			Thermostat: t,
+			Time:       c.Time,
+		})
+	}
+	for _, t := range c.Deleted {
+		outbox = append(outbox, event{
+			Schema:     eventSchema,
+			Type:       eventDeleted,
+			ID:         t.ID,
+			Thermostat: t,
+			Time:       c.Time,
+		})
+	}
+	return outbox
+}
+
+// newOutbox returns the outbox of the write-ahead log at walPath, reading how far it was published
+func newOutbox(walPath string) (*eventOutbox, error) {
+	o := &eventOutbox{path: walPath + ".outbox", ready: make(chan struct{}, 1)}
+
+	data, err := ioutil.ReadFile(o.path)
+	switch {
+	case os.IsNotExist(err):
+		return o, nil
+	case err != nil:
+		return nil, err
+	}
+	if o.published, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return nil, err
+	}
+	o.seq = o.published
+	return o, nil
+}
+
+// number numbers the events of a change before it's logged. The lock of the log must be held
+func (o *eventOutbox) number(outbox []event) {
+	for i := range outbox {
+		o.seq++
+		outbox[i].Seq = o.seq
+	}
+}
+
+// replayed takes in the events of a change replayed from the log, keeping those that weren't published.
+// The events of a snapshot replace any that were pending, as it carries every one of them
+func (o *eventOutbox) replayed(c change) {
+	o.Lock()
+	defer o.Unlock()
+
+	if c.Snapshot {
+		o.pending = nil
+	}
+	for _, e := range c.Outbox {
+		if e.Seq > o.seq {
+			o.seq = e.Seq
+		}
+		if e.Seq > o.published {
+			o.pending = append(o.pending, e)
+		}
+	}
+}
+
+// add queues the events of a change once it's logged
+func (o *eventOutbox) add(outbox []event) {
+	if len(outbox) == 0 {
+		return
+	}
+
+	o.Lock()
+	o.pending = append(o.pending, outbox...)
+	o.Unlock()
+
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the events that haven't been published, to be carried over into a snapshot
+func (o *eventOutbox) Pending() []event {
+	o.Lock()
+	defer o.Unlock()
+
+	return append([]event(nil), o.pending...)
+}
+
+// next returns the next event to hand to the publishers, waiting for one until stop is closed
+func (o *eventOutbox) next(stop <-chan struct{}) (event, bool) {
+	for {
+		o.Lock()
+		if o.handed < len(o.pending) {
+			e := o.pending[o.handed]
+			o.handed++
+			o.Unlock()
+			e.outbox = o
+			return e, true
+		}
+		o.Unlock()
+
+		select {
+		case <-stop:
+			return event{}, false
+		case <-o.ready:
+		}
+	}
+}
+
+// drain hands the pending events to the event dispatcher in order until stop is closed. Each is taken out
+// of the outbox once every publisher was handed it
+func (o *eventOutbox) drain(stop <-chan struct{}) {
+	for {
+		e, ok := o.next(stop)
+		if !ok {
+			return
+		}
+		select {
+		case events <- e:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ack takes the event out of the outbox once every publisher was handed it, either publishing it or
+// putting it in the dead letter queue, and records it as published
+func (o *eventOutbox) ack(e event) error {
+	o.Lock()
+	defer o.Unlock()
+
+	for len(o.pending) > 0 && o.pending[0].Seq <= e.Seq {
+		o.pending = o.pending[1:]
+		if o.handed > 0 {
+			o.handed--
+		}
+	}
+	if e.Seq <= o.published {
+		return nil
+	}
+	o.published = e.Seq
+
+	// the file is replaced rather than rewritten, so a crash part way through leaves the old or new number
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatUint(o.published, 10) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(o.path))
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logChange writes a change to the log the way the home commits it, with its events in the outbox
+func logChange(w *writeAheadLog, therms ...*thermostat) {
+	c := newChange(changeUpdate, therms)
+	c.Outbox = changeEvents(c)
+	w.Write(c)
+}
+
+func TestOutboxSurvivesCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	h := newWALHome()
+	w, err := openWAL(path, 3, h)
+	if err != nil {
+		t.Fatalf("failed to open the write-ahead log: %s", err)
+	}
+	for _, name := range []string{"Study", "Library", "Office", "Nursery"} {
+		logChange(w, renamed(h, 1, name))
+	}
+	pending := w.outbox.Pending()
+	if len(pending) != 4 || pending[0].Seq != 1 || pending[3].Seq != 4 || pending[3].Thermostat.Name != "Nursery" {
+		t.Fatalf("expected the 4 change events in the outbox, got %+v", pending)
+	}
+
+	// the first two are published before the process is killed, the others survive the compaction
+	if err := w.outbox.ack(pending[1]); err != nil {
+		t.Fatalf("failed to record the events as published: %s", err)
+	}
+	_, recovered := recoverHome(t, path)
+	pending = recovered.outbox.Pending()
+	if len(pending) != 2 || pending[0].Seq != 3 || pending[1].Seq != 4 {
+		t.Fatalf("expected only the events that weren't published to be recovered, got %+v", pending)
+	}
+
+	// and numbering carries on where it left off
+	logChange(recovered, renamed(recovered.home, 1, "Gym"))
+	if pending = recovered.outbox.Pending(); len(pending) != 3 || pending[2].Seq != 5 {
+		t.Fatalf("expected the next event to be numbered 5, got %+v", pending)
+	}
+}
+
+func TestOutboxPublishes(t *testing.T) {
+	walFile := filepath.Join(t.TempDir(), "thermostats.wal")
+	base := newTestServer(t, func(c *config) { c.WALFile = walFile })
+
+	rec := make(recorder, 16)
+	saved := publishers.List()
+	publishers.Set(append(saved[:len(saved):len(saved)], rec))
+	defer publishers.Set(saved)
+
+	if code := put(base+"/v1/thermostats/1", `{"name": "Attic"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	select {
+	case e := <-rec:
+		if e.Type != eventChange || e.Seq != 1 || e.Thermostat.Name != "Attic" {
+			t.Fatalf("expected the change event from the outbox, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change event was published")
+	}
+
+	var marker string
+	for i := 0; i < 100 && marker != "1"; i++ {
+		data, _ := os.ReadFile(walFile + ".outbox")
+		marker = strings.TrimSpace(string(data))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if marker != "1" {
+		t.Fatalf("expected the event to be recorded as published, got %q", marker)
+	}
+	if pending := wal.outbox.Pending(); len(pending) != 0 {
+		t.Fatalf("expected the outbox to be drained, got %+v", pending)
+	}
+}
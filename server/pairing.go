@@ -0,0 +1,299 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// qrSize is the width of a provisioning qr code in pixels unless ?size is given, and qrMinSize and
+	// qrMaxSize the range it can be given in
+	qrSize    = 256
+	qrMinSize = 64
+	qrMaxSize = 1024
+
+	// maxSerialLength is the longest serial number a device can pair with
+	maxSerialLength = 64
+)
+
+// pairingScheme is the scheme of what a provisioning qr code encodes: the server and the token a device
+// claims its thermostat with, e.g. thermostat-pair:?server=https%3A%2F%2Fhq.example.com&id=3&token=...
+const pairingScheme = "thermostat-pair"
+
+// pairingToken lets a device claim a thermostat until it expires, once
+type pairingToken struct {
+	thermostatID int
+	expires      time.Time
+}
+
+// pairedDevice is the physical device that claimed a thermostat, returned through the api @
+// /v1/thermostats/:id/pairing and /v1/pair
+type pairedDevice struct {
+	ThermostatID int       `json:"thermostatId"`
+	Serial       string    `json:"serial"`
+	PairedAt     time.Time `json:"pairedAt"`
+}
+
+// pairingClaim is the body a device sends in through the api @ /v1/pair with the token it scanned
+type pairingClaim struct {
+	Token  string `json:"token"`
+	Serial string `json:"serial"`
+}
+
+// pairingStore holds the outstanding pairing tokens and the devices that claimed thermostats with them
+type pairingStore struct {
+	sync.Mutex
+	tokens  map[string]pairingToken
+	devices map[int]pairedDevice
+}
+
+var pairing = &pairingStore{tokens: make(map[string]pairingToken), devices: make(map[int]pairedDevice)}
+
+// reset forgets every token and paired device
+func (s *pairingStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.tokens = make(map[string]pairingToken)
+	s.devices = make(map[int]pairedDevice)
+}
+
+// Token returns the pairing token of the thermostat, issuing one when it has none that is still valid, so
+// printing the code again doesn't invalidate the one already on the device's box
+func (s *pairingStore) Token(thermostatID int, now time.Time) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for token, p := range s.tokens {
+		if !now.Before(p.expires) {
+			delete(s.tokens, token)
+		} else if p.thermostatID == thermostatID {
+			return token, nil
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	s.tokens[token] = pairingToken{thermostatID: thermostatID, expires: now.Add(cfg.PairingTTL)}
+	return token, nil
+}
+
+// Claim pairs the device with the thermostat of the token, which can't be used again, replacing any device
+// paired with it before. It returns false when the token is unknown or expired
+func (s *pairingStore) Claim(token, serial string, now time.Time) (pairedDevice, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.tokens[token]
+	if !ok || !now.Before(p.expires) {
+		return pairedDevice{}, false
+	}
+	delete(s.tokens, token)
+
+	d := pairedDevice{ThermostatID: p.thermostatID, Serial: serial, PairedAt: now}
+	s.devices[p.thermostatID] = d
+	return d, true
+}
+
+// Device returns the device paired with the thermostat, if any
+func (s *pairingStore) Device(thermostatID int) (pairedDevice, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	d, ok := s.devices[thermostatID]
+	return d, ok
+}
+
+// Forget drops the tokens of the thermostat and the device paired with it
+func (s *pairingStore) Forget(thermostatID int) {
+	s.Lock()
+	defer s.Unlock()
+
+	for token, p := range s.tokens {
+		if p.thermostatID == thermostatID {
+			delete(s.tokens, token)
+		}
+	}
+	delete(s.devices, thermostatID)
+}
+
+// serverURL returns the url devices reach the server at, -public-url or else the one the request came in on
+func serverURL(req *fasthttp.RequestCtx) string {
+	if cfg.PublicURL != "" {
+		return strings.TrimRight(cfg.PublicURL, "/")
+	}
+	scheme := "http"
+	if req.IsTLS() {
+		scheme = "https"
+	}
+	return scheme + "://" + string(req.Host())
+}
+
+// pairingPayload returns what the provisioning qr code of the thermostat encodes
+func pairingPayload(server string, thermostatID int, token string) string {
+	q := url.Values{}
+	q.Set("server", server)
+	q.Set("id", strconv.Itoa(thermostatID))
+	q.Set("token", token)
+	return pairingScheme + ":?" + q.Encode()
+}
+
+// qrSVG draws the modules of the qr code as an svg of the given width, a square for every dark module
+func qrSVG(q *qrcode.QRCode, size int) string {
+	bitmap := q.Bitmap()
+	n := strconv.Itoa(len(bitmap))
+
+	var b strings.Builder
+	b.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" width="` + strconv.Itoa(size) + `" height="` + strconv.Itoa(size) +
+		`" viewBox="0 0 ` + n + ` ` + n + `" shape-rendering="crispEdges">`)
+	b.WriteString(`<rect width="` + n + `" height="` + n + `" fill="#fff"/><path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				b.WriteString("M" + strconv.Itoa(x) + " " + strconv.Itoa(y) + "h1v1h-1z")
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+// GetQR is the handler to return the provisioning qr code of a thermostat, encoding the server and a
+// pairing token, for installers to print and scan instead of typing ids. ?format is png or svg and ?size
+// the width in pixels
+func GetQR(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	format := string(req.QueryArgs().Peek("format"))
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Format",
+			Description: "The format must be 'png' or 'svg'.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	size := qrSize
+	if s := req.QueryArgs().Peek("size"); len(s) > 0 {
+		var err error
+		if size, err = strconv.Atoi(string(s)); err != nil || size < qrMinSize || size > qrMaxSize {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Size",
+				Description: "The size must be a number from " + strconv.Itoa(qrMinSize) + " to " + strconv.Itoa(qrMaxSize) + ".",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	token, err := pairing.Token(t.ID, time.Now())
+	var q *qrcode.QRCode
+	if err == nil {
+		q, err = qrcode.New(pairingPayload(serverURL(req), t.ID, token), qrcode.Medium)
+	}
+	var png []byte
+	if err == nil && format == "png" {
+		png, err = q.PNG(size)
+	}
+	if err != nil {
+		res := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to generate qr code",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, res)
+		return
+	}
+
+	req.Response.Header.Set("Cache-Control", "no-store")
+	req.SetStatusCode(http.StatusOK)
+	if format == "svg" {
+		req.SetContentType("image/svg+xml")
+		req.SetBodyString(qrSVG(q, size))
+		return
+	}
+	req.SetContentType("image/png")
+	req.SetBody(png)
+}
+
+// GetPairing is the handler to return the device paired with a thermostat
+func GetPairing(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	d, ok := pairing.Device(t.ID)
+	if !ok {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "No device is paired with thermostat " + strconv.Itoa(t.ID) + ".",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, d)
+}
+
+// PostPair is the handler for a device to claim the thermostat of the provisioning qr code it was scanned
+// from. The pairing token proves the claim, so it needs no access token
+func PostPair(req *fasthttp.RequestCtx) {
+	req.SetContentType("application/json")
+
+	var body pairingClaim
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	if body.Serial == "" || len(body.Serial) > maxSerialLength {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Serial",
+			Description: "The serial number of the device must be 1 to " + strconv.Itoa(maxSerialLength) + " characters long.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	if errRes := checkReadOnly(); errRes != nil {
+		req.SetStatusCode(http.StatusServiceUnavailable)
+		sendJSON(req, errRes)
+		return
+	}
+
+	d, ok := pairing.Claim(body.Token, body.Serial, time.Now())
+	if !ok {
+		req.SetStatusCode(http.StatusUnauthorized)
+		sendJSON(req, unauthorized("The pairing token is unknown, used or expired. Generate a new qr code for the thermostat."))
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, d)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getQR returns the status code, content type and body of the provisioning qr code at url
+func getQR(url string, t *testing.T) (int, string, []byte) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Content-Type"), b
+}
+
+func TestPairing(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.PublicURL = "https://hq.example.com/"
+	})
+
+	code, contentType, b := getQR(base+"/v1/thermostats/1/qr?size=128", t)
+	if code != http.StatusOK || contentType != "image/png" {
+		t.Fatalf("expected a png, got %d %s", code, contentType)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil || img.Bounds().Dx() != 128 {
+		t.Fatalf("expected a 128px png, got %v %v", img, err)
+	}
+
+	code, contentType, b = getQR(base+"/v1/thermostats/1/qr?format=svg", t)
+	if code != http.StatusOK || contentType != "image/svg+xml" || !strings.HasPrefix(string(b), "<svg") || !strings.Contains(string(b), `width="256"`) {
+		t.Fatalf("expected an svg, got %d %s %s", code, contentType, b)
+	}
+
+	for _, query := range []string{"?format=gif", "?size=10", "?size=big"} {
+		if code, _, _ := getQR(base+"/v1/thermostats/1/qr"+query, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, query, code)
+		}
+	}
+
+	// generating the code again encodes the same token
+	token, _ := pairing.Token(1, time.Now())
+	if again, _ := pairing.Token(1, time.Now()); again != token {
+		t.Fatalf("expected the token to be reused, got %s and %s", token, again)
+	}
+	if other, _ := pairing.Token(2, time.Now()); other == token {
+		t.Fatal("expected every thermostat to have a token of its own")
+	}
+
+	var missing errResponse
+	if get(base+"/v1/thermostats/1/pairing", t, &missing); missing.Code != http.StatusNotFound {
+		t.Fatalf("expected no device to be paired yet, got %+v", missing)
+	}
+	if code := postJSON(base+"/v1/pair", `{"token": "`+token+`"}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a claim without a serial to be rejected, got %d", code)
+	}
+
+	var d pairedDevice
+	if code := postJSON(base+"/v1/pair", `{"token": "`+token+`", "serial": "TH-0001"}`, t, &d); code != http.StatusOK || d.ThermostatID != 1 || d.Serial != "TH-0001" {
+		t.Fatalf("expected the device to claim thermostat 1, got %d %+v", code, d)
+	}
+	if code := postJSON(base+"/v1/pair", `{"token": "`+token+`", "serial": "TH-0002"}`, t, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a used token to be rejected, got %d", code)
+	}
+	get(base+"/v1/thermostats/1/pairing", t, &d)
+	if d.Serial != "TH-0001" {
+		t.Fatalf("expected the paired device, got %+v", d)
+	}
+
+	// tokens expire
+	expired, _ := pairing.Token(addThermostat(t, updateThermostat{Name: "Lobby"}), time.Now().Add(-cfg.PairingTTL))
+	if _, ok := pairing.Claim(expired, "TH-0003", time.Now()); ok {
+		t.Fatal("expected an expired token to be rejected")
+	}
+}
+
+func TestPairingPayload(t *testing.T) {
+	u, err := url.Parse(pairingPayload("https://hq.example.com", 3, "abc"))
+	if err != nil || u.Scheme != pairingScheme {
+		t.Fatalf("expected a %s uri, got %v %v", pairingScheme, u, err)
+	}
+	q := u.Query()
+	if q.Get("server") != "https://hq.example.com" || q.Get("id") != "3" || q.Get("token") != "abc" {
+		t.Fatalf("expected the server, id and token, got %v", q)
+	}
+}
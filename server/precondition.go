@@ -0,0 +1,334 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// preconditionInterval is how often the setpoints of pre-conditioned thermostats are moved to their plan
+	preconditionInterval = time.Minute
+
+	// maxPreconditionOffset is the most degrees pre-conditioning can move the setpoints by, and
+	// maxPreconditionLead the longest it can run ahead of a heat wave or cold snap
+	maxPreconditionOffset = 5
+	maxPreconditionLead   = 6 * time.Hour
+
+	// the kinds of planned action
+	planPrecool = "precool"
+	planPreheat = "preheat"
+)
+
+// preconditionProfile is the body sent in and returned through the api @ /v1/thermostats/:id/precondition.
+// A forecast at or above HotAbove is a heat wave, which thermostats cooling or in auto mode pre-cool for,
+// and one at or below ColdBelow a cold snap, which thermostats heating or in auto mode pre-heat for. Both
+// setpoints move by the offset for the lead before it, keeping the cool setpoint at or above Lowest and the
+// heat setpoint at or below Highest. The offset and lead bound the extra runtime it costs
+type preconditionProfile struct {
+	HotAbove  int    `json:"hotAbove"`
+	ColdBelow int    `json:"coldBelow"`
+	Offset    int    `json:"offset"`
+	Lead      string `json:"lead"`
+	Lowest    int    `json:"lowest"`
+	Highest   int    `json:"highest"`
+}
+
+// plannedAction is a stretch of pre-conditioning planned from the forecast, returned through the api @
+// /v1/thermostats/:id/plan. The setpoints are the ones it moves the thermostat to
+type plannedAction struct {
+	Kind         string    `json:"kind"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Offset       int       `json:"offset"`
+	HeatSetPoint int       `json:"heatSetPoint"`
+	CoolSetPoint int       `json:"coolSetPoint"`
+	Reason       string    `json:"reason"`
+}
+
+// preconditionPlan is returned through the api @ /v1/thermostats/:id/plan
+type preconditionPlan struct {
+	ThermostatID int                  `json:"thermostatId"`
+	Profile      *preconditionProfile `json:"profile"`
+	ForecastAt   *time.Time           `json:"forecastAt,omitempty"`
+	Actions      []plannedAction      `json:"actions"`
+}
+
+// validatePreconditionProfile makes sure the profile has bounds the setpoints can move within
+func validatePreconditionProfile(p *preconditionProfile) *errResponse {
+	invalid := func(description string) *errResponse {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Pre-conditioning Profile",
+			Description: description,
+		}
+	}
+
+	if p.ColdBelow >= p.HotAbove {
+		return invalid("The forecast a cold snap is below, 'coldBelow', must be lower than the one a heat wave is above, 'hotAbove'.")
+	}
+	if p.Offset < 1 || p.Offset > maxPreconditionOffset {
+		return invalid("The offset must be from 1 to " + strconv.Itoa(maxPreconditionOffset) + " degrees.")
+	}
+	lead, err := time.ParseDuration(p.Lead)
+	if err != nil || lead <= 0 || lead > maxPreconditionLead {
+		return invalid("The lead must be a positive duration such as '3h', up to " + maxPreconditionLead.String() + ".")
+	}
+	if errRes := validateCoolSetPt(p.Lowest); errRes != nil || p.Lowest == 0 {
+		return invalid("The lowest the cool setpoint is pre-cooled to must be between " + strconv.Itoa(minCoolSetPt) + " and " + strconv.Itoa(maxCoolSetPt) + " degrees Fahrenheit.")
+	}
+	if errRes := validateHeatSetPt(p.Highest); errRes != nil || p.Highest == 0 {
+		return invalid("The highest the heat setpoint is pre-heated to must be between " + strconv.Itoa(minHeatSetPt) + " and " + strconv.Itoa(maxHeatSetPt) + " degrees Fahrenheit.")
+	}
+	return nil
+}
+
+// planPrecondition plans the pre-conditioning of the thermostat for the heat waves and cold snaps in the
+// forecast after the given time. The setpoints are planned from where they are without pre-conditioning
+func planPrecondition(t *thermostat, points []forecastPoint, now time.Time) []plannedAction {
+	actions := []plannedAction{}
+	p := t.Precondition
+	if p == nil {
+		return actions
+	}
+	lead, _ := time.ParseDuration(p.Lead)
+	heat, cool := t.HeatSetPoint-t.PreconditionOffset, t.CoolSetPoint-t.PreconditionOffset
+
+	var kind string
+	var peak forecastPoint
+	var start time.Time
+	flush := func() {
+		if kind == "" {
+			return
+		}
+		defer func() { kind = "" }()
+
+		a := plannedAction{Kind: kind, Start: start.Add(-lead), End: start}
+		switch {
+		case !start.After(now):
+			// it's too late to pre-condition for weather that has arrived
+			return
+		case kind == planPrecool && (t.OperatingMode == "cool" || t.OperatingMode == "auto"):
+			a.Offset = -p.Offset
+			if cool+a.Offset < p.Lowest {
+				a.Offset = p.Lowest - cool
+			}
+			a.Reason = "Forecast high of " + strconv.Itoa(int(math.Round(peak.Temp))) + "°F at " + peak.Time.Format(time.RFC3339) + "."
+		case kind == planPreheat && (t.OperatingMode == "heat" || t.OperatingMode == "auto"):
+			a.Offset = p.Offset
+			if heat+a.Offset > p.Highest {
+				a.Offset = p.Highest - heat
+			}
+			a.Reason = "Forecast low of " + strconv.Itoa(int(math.Round(peak.Temp))) + "°F at " + peak.Time.Format(time.RFC3339) + "."
+		}
+		if (kind == planPrecool && a.Offset >= 0) || (kind == planPreheat && a.Offset <= 0) {
+			return
+		}
+		a.HeatSetPoint, a.CoolSetPoint = heat, cool
+		if heat != 0 {
+			a.HeatSetPoint += a.Offset
+		}
+		if cool != 0 {
+			a.CoolSetPoint += a.Offset
+		}
+		actions = append(actions, a)
+	}
+
+	for _, pt := range points {
+		if !pt.Time.Add(time.Hour).After(now) {
+			continue
+		}
+		next := ""
+		switch {
+		case pt.Temp >= float64(p.HotAbove):
+			next = planPrecool
+		case pt.Temp <= float64(p.ColdBelow):
+			next = planPreheat
+		}
+		if next != kind {
+			flush()
+			kind, start, peak = next, pt.Time, pt
+		}
+		if (kind == planPrecool && pt.Temp > peak.Temp) || (kind == planPreheat && pt.Temp < peak.Temp) {
+			peak = pt
+		}
+	}
+	flush()
+
+	return actions
+}
+
+// preconditionStep returns the thermostat with its setpoints moved to where its plan has them at the given
+// time, or nil when they are already there. Setpoints changed during an action are held until it ends
+func preconditionStep(t *thermostat, points []forecastPoint, now time.Time) *thermostat {
+	offset, active := 0, false
+	for _, a := range planPrecondition(t, points, now) {
+		if !now.Before(a.Start) && now.Before(a.End) {
+			offset, active = a.Offset, true
+			break
+		}
+	}
+	held := t.PreconditionHeld && active
+	if held {
+		offset = 0
+	}
+	if offset == t.PreconditionOffset && held == t.PreconditionHeld {
+		return nil
+	}
+
+	// thermostats are never modified in place, so work on a copy
+	updated := *t
+	shiftSetPoints(&updated, offset-t.PreconditionOffset)
+	if validateHeatSetPt(updated.HeatSetPoint) != nil || validateCoolSetPt(updated.CoolSetPoint) != nil {
+		return nil
+	}
+	updated.PreconditionOffset = offset
+	updated.PreconditionHeld = held
+	return &updated
+}
+
+// SetPrecondition sets the pre-conditioning profile of the thermostat, or removes it and moves the
+// setpoints back when p is nil
+func (home *currentState) SetPrecondition(target *thermostat, p *preconditionProfile) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	updated.Precondition = p
+	if p == nil {
+		shiftSetPoints(&updated, -target.PreconditionOffset)
+		updated.PreconditionOffset = 0
+		updated.PreconditionHeld = false
+	} else {
+		points, _ := forecast.Forecast()
+		if step := preconditionStep(&updated, points, clock.Now()); step != nil {
+			updated = *step
+		}
+	}
+
+	return home.commitPrecondition(&updated)
+}
+
+// commitPrecondition commits the thermostat with its pre-conditioning profile or setpoints changed
+func (home *currentState) commitPrecondition(updated *thermostat) (*thermostat, error) {
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changePrecondition, updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, updated)
+	publishHVAC(transitions)
+
+	return updated, nil
+}
+
+// runPrecondition moves the setpoints of pre-conditioned thermostats to their plan until stop is closed.
+// Only the leader writes, as with every other automated change, and nothing is written while read-only
+func runPrecondition(interval time.Duration, stop <-chan struct{}) {
+	for clock.sleep(interval, stop) {
+		if !cluster.IsLeader() || checkReadOnly() != nil {
+			continue
+		}
+		updatePrecondition(clock.Now())
+	}
+}
+
+// updatePrecondition moves the setpoints of every thermostat with a pre-conditioning profile to where its
+// plan has them by now. Thermostats that can't be written to, or that are boosted, are left until they can be
+func updatePrecondition(now time.Time) {
+	points, _ := forecast.Forecast()
+	for _, t := range home.Thermostats() {
+		_, err := retryChanged(t, func(current *thermostat) (*thermostat, error) {
+			if current.Precondition == nil || current.Disabled || current.Boost != nil || checkAutomatedWrite(current) != nil || checkOffline(current) != nil {
+				return current, nil
+			}
+			if updated := preconditionStep(current, points, now); updated != nil {
+				return home.commitPrecondition(updated)
+			}
+			return current, nil
+		})
+		if err != nil {
+			log.Println("failed to pre-condition thermostat", t.ID, "with error:", err)
+		}
+	}
+}
+
+// GetPlan is the handler to return the pre-conditioning planned for a thermostat from the forecast
+func GetPlan(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	points, fetchedAt := forecast.Forecast()
+	plan := preconditionPlan{ThermostatID: t.ID, Profile: t.Precondition, Actions: planPrecondition(t, points, clock.Now())}
+	if !fetchedAt.IsZero() {
+		plan.ForecastAt = &fetchedAt
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, plan)
+}
+
+// PutPrecondition is the handler to set the pre-conditioning profile of a specific thermostat
+func PutPrecondition(req *fasthttp.RequestCtx) {
+	var body preconditionProfile
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	errRes := validatePreconditionProfile(&body)
+	if errRes == nil {
+		// the bounds must be setpoints the user could set themselves
+		errRes = checkUserRange(requestUser(req), body.Highest, body.Lowest)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	updated, err := home.SetPrecondition(target, &body)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// DeletePrecondition is the handler to remove the pre-conditioning profile of a specific thermostat
+func DeletePrecondition(req *fasthttp.RequestCtx) {
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	if target.Precondition == nil {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "Thermostat " + strconv.Itoa(target.ID) + " has no pre-conditioning profile.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	updated, err := home.SetPrecondition(target, nil)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
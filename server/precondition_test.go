@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// putPrecondition sets the pre-conditioning profile of the thermostat at url, returning the status code
+// and the thermostat
+func putPrecondition(url, body string, t *testing.T) (int, thermostat) {
+	req, err := http.NewRequest("PUT", url+"/precondition", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var th thermostat
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&th); err != nil {
+			t.Fatalf("failed to decode the thermostat: %s", err)
+		}
+	}
+	return resp.StatusCode, th
+}
+
+// hourlyForecast returns a forecast with an hour of each temperature from the given hour on
+func hourlyForecast(from time.Time, temps ...float64) []forecastPoint {
+	points := make([]forecastPoint, 0, len(temps))
+	for i, temp := range temps {
+		points = append(points, forecastPoint{Time: from.Add(time.Duration(i) * time.Hour), Temp: temp})
+	}
+	return points
+}
+
+func TestPlanPrecondition(t *testing.T) {
+	hour := time.Date(2026, 7, 1, 9, 0, 0, 0, time.UTC)
+	p := &preconditionProfile{HotAbove: 95, ColdBelow: 20, Offset: 3, Lead: "2h", Lowest: 72, Highest: 72}
+	therm := &thermostat{ID: 1, OperatingMode: "cool", HeatSetPoint: 68, CoolSetPoint: 74, Precondition: p}
+	points := hourlyForecast(hour, 85, 90, 92, 97, 99, 96, 90, 10)
+
+	// the heat wave from noon is pre-cooled for, only down to the lowest, and the cold snap is left alone
+	actions := planPrecondition(therm, points, hour.Add(30*time.Minute))
+	if len(actions) != 1 {
+		t.Fatalf("expected a single action, got %+v", actions)
+	}
+	a := actions[0]
+	if a.Kind != planPrecool || !a.Start.Equal(hour.Add(time.Hour)) || !a.End.Equal(hour.Add(3*time.Hour)) || a.Offset != -2 || a.CoolSetPoint != 72 || a.HeatSetPoint != 66 {
+		t.Fatalf("expected to pre-cool by 2 degrees from 10:00 until noon, got %+v", a)
+	}
+
+	// in auto mode the cold snap is pre-heated for as well, up to the highest
+	therm.OperatingMode = "auto"
+	if actions := planPrecondition(therm, points, hour); len(actions) != 2 || actions[1].Kind != planPreheat || actions[1].Offset != 3 {
+		t.Fatalf("expected to pre-heat for the cold snap as well, got %+v", actions)
+	}
+
+	// and once the heat wave arrived there is nothing left to pre-cool for
+	therm.OperatingMode = "cool"
+	if actions := planPrecondition(therm, points, hour.Add(3*time.Hour)); len(actions) != 0 {
+		t.Fatalf("expected no actions during the heat wave, got %+v", actions)
+	}
+}
+
+func TestPrecondition(t *testing.T) {
+	hour := time.Now().UTC().Truncate(time.Hour)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("temperature_unit") != "fahrenheit" {
+			t.Errorf("expected the forecast in fahrenheit, got %s", r.URL.RawQuery)
+		}
+		var res openMeteoForecast
+		for i, temp := range []float64{85, 88, 92, 97.4, 99} {
+			res.Hourly.Time = append(res.Hourly.Time, hour.Add(time.Duration(i)*time.Hour).Format(forecastHourLayout))
+			res.Hourly.Temperature = append(res.Hourly.Temperature, temp)
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer api.Close()
+
+	base := newTestServer(t, func(c *config) { c.ForecastURL = api.URL })
+	url := base + "/v1/thermostats/1"
+	target, _ := home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "cool", HeatSetPoint: 68, CoolSetPoint: 76})
+
+	for _, body := range []string{`{"hotAbove": 95, "coldBelow": 20, "offset": 9, "lead": "2h", "lowest": 70, "highest": 72}`,
+		`{"hotAbove": 95, "coldBelow": 20, "offset": 3, "lead": "1d", "lowest": 70, "highest": 72}`,
+		`{"hotAbove": 20, "coldBelow": 95, "offset": 3, "lead": "2h", "lowest": 70, "highest": 72}`} {
+		if code, _ := putPrecondition(url, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+	if code, _ := putPrecondition(url, `{"hotAbove": 95, "coldBelow": 20, "offset": 3, "lead": "2h", "lowest": 70, "highest": 72}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	var plan preconditionPlan
+	for i := 0; i < 100 && plan.ForecastAt == nil; i++ {
+		get(url+"/plan", t, &plan)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(plan.Actions) != 1 || plan.Actions[0].Kind != planPrecool || plan.Actions[0].CoolSetPoint != 73 || plan.Profile == nil {
+		t.Fatalf("expected to pre-cool for the heat wave in 3 hours, got %+v", plan)
+	}
+
+	// the setpoints move while it pre-cools, are held once changed by hand and move back when it ends
+	updatePrecondition(plan.Actions[0].Start)
+	if target, _ = home.Thermostat(1); target.CoolSetPoint != 73 || target.HeatSetPoint != 65 || target.PreconditionOffset != -3 {
+		t.Fatalf("expected the setpoints to be pre-cooled, got %+v", target)
+	}
+	target, _ = home.UpdateThermostat(target, updateThermostat{CoolSetPoint: 75})
+	if !target.PreconditionHeld || target.PreconditionOffset != 0 || target.HeatSetPoint != 68 || target.CoolSetPoint != 75 {
+		t.Fatalf("expected the setpoint changed by hand to be held, got %+v", target)
+	}
+	updatePrecondition(plan.Actions[0].End)
+	if target, _ = home.Thermostat(1); target.PreconditionHeld || target.CoolSetPoint != 75 {
+		t.Fatalf("expected the hold to end with the action, got %+v", target)
+	}
+
+	if code := del(url+"/precondition", t, nil); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := del(url+"/precondition", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d without a profile, got %d", http.StatusNotFound, code)
+	}
+}
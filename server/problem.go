@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/valyala/fasthttp"
+)
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// problem is an RFC 7807 problem details object. Errors are sent in this format instead of errResponse to
+// clients that ask for it with an Accept header of application/problem+json
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// wantsProblem reports whether the client asked for errors as problem details
+func wantsProblem(req *fasthttp.RequestCtx) bool {
+	return strings.Contains(string(req.Request.Header.Peek("Accept")), problemContentType)
+}
+
+// problemType returns the stable type uri of an error, derived from its message, e.g. "Invalid Property"
+// becomes /problems/invalid-property
+func problemType(msg string) string {
+	slug := strings.FieldsFunc(strings.ToLower(msg), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return "/problems/" + strings.Join(slug, "-")
+}
+
+// newProblem converts the error to problem details about the request
+func newProblem(req *fasthttp.RequestCtx, errRes *errResponse) *problem {
+	return &problem{
+		Type:     problemType(errRes.Msg),
+		Title:    errRes.Msg,
+		Status:   errRes.Code,
+		Detail:   errRes.Description,
+		Instance: string(req.Path()),
+	}
+}
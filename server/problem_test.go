@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProblemDetails(t *testing.T) {
+	base := newTestServer(t)
+	req, err := http.NewRequest("GET", base+"/v1/thermostats/1/humidity", nil)
+	if err != nil {
+		t.Fatalf("failed to create new get request: %s", err)
+	}
+	req.Header.Set("Accept", problemContentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != problemContentType {
+		t.Fatalf("expected content type %s, got %s", problemContentType, ct)
+	}
+
+	var p problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode problem details: %s", err)
+	}
+	if p.Type != "/problems/invalid-property" || p.Title != "Invalid Property" || p.Status != http.StatusBadRequest || p.Instance != "/v1/thermostats/1/humidity" {
+		t.Fatalf("expected invalid property problem details, got %+v", p)
+	}
+
+	// clients that don't ask for problem details keep getting the original format
+	var res errResponse
+	get(base+"/v1/thermostats/1/humidity", t, &res)
+	if res.Code != http.StatusBadRequest || res.Msg != "Invalid Property" {
+		t.Fatalf("expected an invalid property error, got %+v", res)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// quietInterval is how often the thermostats are checked for quiet hours starting or ending
+	quietInterval = time.Second
+
+	// maxQuietWindows is the most quiet hours windows a thermostat can have
+	maxQuietWindows = 7
+
+	clockLayout = "15:04"
+)
+
+// quietWindow is a daily stretch of quiet hours in the local time of the server, e.g. 22:00 to 07:00.
+// Windows that end before they start run past midnight
+type quietWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// quietHours is the body sent in and returned through the api @ /v1/thermostats/:id/quiet-hours. During
+// quiet hours the fan only runs along with heating or cooling and the equipment stays in its first stage.
+// Allow lifts the restrictions without dropping the windows, e.g. for a single night
+type quietHours struct {
+	Windows []quietWindow `json:"windows"`
+	Allow   bool          `json:"allow"`
+}
+
+// minutesOf returns the minutes past midnight of a time of day such as 22:00
+func minutesOf(clock string) (int, bool) {
+	t, err := time.Parse(clockLayout, clock)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// validateQuietHours makes sure every window starts and ends at a valid time of day
+func validateQuietHours(q quietHours) *errResponse {
+	if len(q.Windows) == 0 || len(q.Windows) > maxQuietWindows {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Quiet Hours",
+			Description: "Quiet hours need from 1 to " + strconv.Itoa(maxQuietWindows) + " windows. Remove them with DELETE instead.",
+		}
+	}
+	for _, w := range q.Windows {
+		start, okStart := minutesOf(w.Start)
+		end, okEnd := minutesOf(w.End)
+		if !okStart || !okEnd || start == end {
+			return &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Quiet Hours",
+				Description: "The window from '" + w.Start + "' to '" + w.End + "' is not valid. Windows start and end at different times of day given as HH:MM, e.g. 22:00 to 07:00.",
+			}
+		}
+	}
+	return nil
+}
+
+// inQuietHours returns whether the restrictions of the quiet hours apply at the given time
+func inQuietHours(q *quietHours, now time.Time) bool {
+	if q == nil || q.Allow {
+		return false
+	}
+
+	now = now.In(time.Local)
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range q.Windows {
+		start, _ := minutesOf(w.Start)
+		end, _ := minutesOf(w.End)
+		if start < end && minute >= start && minute < end {
+			return true
+		}
+		if start > end && (minute >= start || minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetQuietHours sets the quiet hours of the thermostat, or removes them when q is nil
+func (home *currentState) SetQuietHours(target *thermostat, q *quietHours) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	updated.QuietHours = q
+	updated.Quiet = inQuietHours(q, clock.Now())
+
+	return home.commitQuiet(&updated)
+}
+
+// commitQuiet commits the thermostat with its quiet hours changed, started or ended
+func (home *currentState) commitQuiet(updated *thermostat) (*thermostat, error) {
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeQuiet, updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, updated)
+	publishHVAC(transitions)
+
+	return updated, nil
+}
+
+// runQuietHours starts and ends the quiet hours of the thermostats until stop is closed. Only the leader
+// writes, as with every other automated change, and nothing is written while the service is read-only
+func runQuietHours(interval time.Duration, stop <-chan struct{}) {
+	for clock.sleep(interval, stop) {
+		if !cluster.IsLeader() || checkReadOnly() != nil {
+			continue
+		}
+		updateQuiet(clock.Now())
+	}
+}
+
+// updateQuiet starts or ends the quiet hours of every thermostat whose window began or ended by now
+func updateQuiet(now time.Time) {
+	for _, t := range home.Thermostats() {
+		if quiet := inQuietHours(t.QuietHours, now); quiet != t.Quiet {
+			_, err := retryChanged(t, func(current *thermostat) (*thermostat, error) {
+				// thermostats are never modified in place, so work on a copy
+				updated := *current
+				updated.Quiet = inQuietHours(current.QuietHours, now)
+				return home.commitQuiet(&updated)
+			})
+			if err != nil {
+				log.Println("failed to update the quiet hours of thermostat", t.ID, "with error:", err)
+			}
+		}
+	}
+}
+
+// PutQuietHours is the handler to set the quiet hours of a specific thermostat
+func PutQuietHours(req *fasthttp.RequestCtx) {
+	var body quietHours
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	if errRes := validateQuietHours(body); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	updated, err := home.SetQuietHours(target, &body)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// DeleteQuietHours is the handler to remove the quiet hours of a specific thermostat
+func DeleteQuietHours(req *fasthttp.RequestCtx) {
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	if target.QuietHours == nil {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "Thermostat " + strconv.Itoa(target.ID) + " has no quiet hours.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	updated, err := home.SetQuietHours(target, nil)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
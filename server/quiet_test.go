@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// putQuietHours sets the quiet hours of the thermostat at url, returning the status code and the thermostat
+func putQuietHours(url, body string, t *testing.T) (int, thermostat) {
+	req, err := http.NewRequest("PUT", url+"/quiet-hours", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var th thermostat
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&th); err != nil {
+			t.Fatalf("failed to decode the thermostat: %s", err)
+		}
+	}
+	return resp.StatusCode, th
+}
+
+func TestInQuietHours(t *testing.T) {
+	q := &quietHours{Windows: []quietWindow{{Start: "22:00", End: "07:00"}, {Start: "13:00", End: "14:30"}}}
+	day := func(hour, min int) time.Time { return time.Date(2026, 3, 4, hour, min, 0, 0, time.Local) }
+
+	for _, tt := range []struct {
+		at    time.Time
+		quiet bool
+	}{
+		{day(23, 0), true},
+		{day(3, 0), true},
+		{day(7, 0), false},
+		{day(12, 59), false},
+		{day(14, 29), true},
+		{day(21, 59), false},
+	} {
+		if quiet := inQuietHours(q, tt.at); quiet != tt.quiet {
+			t.Fatalf("expected quiet hours at %s to be %v", tt.at.Format(clockLayout), tt.quiet)
+		}
+	}
+
+	q.Allow = true
+	if inQuietHours(q, day(23, 0)) {
+		t.Fatalf("expected allow to lift the quiet hours")
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.HVACMinOff = 0
+		c.SecondStageDelta = 3
+	})
+	url := base + "/v1/thermostats/1"
+
+	for _, body := range []string{`{"windows": []}`, `{"windows": [{"start": "22:00", "end": "22:00"}]}`, `{"windows": [{"start": "10pm", "end": "7am"}]}`} {
+		if code, _ := putQuietHours(url, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	// the equipment runs its second stage far from the setpoint
+	target, _ := home.Thermostat(1)
+	target, _ = home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", FanMode: "on", HeatSetPoint: 68, CoolSetPoint: 74})
+	target, _ = home.RecordTemp(target, 60)
+	if target.HVACState != hvacHeating || target.HVACStage != 2 {
+		t.Fatalf("expected the second stage to heat, got %s in stage %d", target.HVACState, target.HVACStage)
+	}
+
+	// quiet hours around now keep it in the first stage
+	now := time.Now()
+	window := `{"windows": [{"start": "` + now.Add(-time.Hour).Format(clockLayout) + `", "end": "` + now.Add(time.Hour).Format(clockLayout) + `"}]}`
+	code, th := putQuietHours(url, window, t)
+	if code != http.StatusOK || !th.Quiet || th.HVACStage != 1 {
+		t.Fatalf("expected quiet hours to keep the first stage, got %d %+v", code, th)
+	}
+
+	// and the fan doesn't run on its own
+	target, _ = home.Thermostat(1)
+	if target, _ = home.RecordTemp(target, 69); target.HVACState != hvacIdle {
+		t.Fatalf("expected the fan to stay off during quiet hours, got %s", target.HVACState)
+	}
+
+	// allowing noise lets the fan run again
+	allowed := window[:len(window)-1] + `, "allow": true}`
+	if _, th = putQuietHours(url, allowed, t); th.Quiet || th.HVACState != hvacFanOnly {
+		t.Fatalf("expected allow to lift the quiet hours, got %+v", th)
+	}
+
+	// quiet hours start once their window begins
+	later := `{"windows": [{"start": "` + now.Add(2*time.Hour).Format(clockLayout) + `", "end": "` + now.Add(3*time.Hour).Format(clockLayout) + `"}]}`
+	if _, th = putQuietHours(url, later, t); th.Quiet {
+		t.Fatalf("expected no quiet hours before the window")
+	}
+	updateQuiet(now.Add(150 * time.Minute))
+	if target, _ = home.Thermostat(1); !target.Quiet || target.HVACState != hvacIdle {
+		t.Fatalf("expected the quiet hours to have started, got %+v", target)
+	}
+
+	var removed thermostat
+	if code := del(url+"/quiet-hours", t, &removed); code != http.StatusOK || removed.QuietHours != nil || removed.Quiet {
+		t.Fatalf("expected the quiet hours to be removed, got %d %+v", code, removed)
+	}
+	if code := del(url+"/quiet-hours", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d without quiet hours, got %d", http.StatusNotFound, code)
+	}
+}
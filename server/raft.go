@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// replicator replicates changes to the thermostats across a cluster. Replicate returns once the change has
+// been committed, which is when it's applied to the home of every node
+type replicator interface {
+	Replicate(c change) error
+}
+
+// replication is the replicator changes are committed through, or nil when the state isn't replicated
+var replication replicator
+
+const (
+	// raftApplyTimeout bounds how long a write waits to be committed by a quorum of the cluster
+	raftApplyTimeout = 10 * time.Second
+
+	// raftContactTimeout is how long a follower can go without hearing from the leader and still be healthy
+	raftContactTimeout = 5 * time.Second
+)
+
+// raftStore replicates the state of the home across the nodes of a raft cluster. It's also the elector of
+// the cluster, since only the raft leader can commit writes. Nodes are identified by the address clients
+// reach them on, so the leader can be named to clients
+type raftStore struct {
+	raft *raft.Raft
+	node string
+}
+
+// parseRaftPeers parses the comma separated nodes of the initial cluster, each given as the address clients
+// reach it on followed by its raft address, e.g. http://10.0.0.5:8080=10.0.0.5:7000
+func parseRaftPeers(s string) (raft.Configuration, error) {
+	var configuration raft.Configuration
+	for _, peer := range strings.Split(s, ",") {
+		node, addr, ok := strings.Cut(strings.TrimSpace(peer), "=")
+		if !ok || node == "" || addr == "" {
+			return configuration, errors.New("invalid raft peer '" + peer + "', expected <node>=<raft address>")
+		}
+
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(node),
+			Address:  raft.ServerAddress(addr),
+		})
+	}
+
+	return configuration, nil
+}
+
+// newRaftStore starts the raft node, keeping its log and snapshots in dir. The cluster is bootstrapped with
+// the peers the first time the node starts, after which the membership is read back from the log
+func newRaftStore(node, bindAddr, dir string, peers raft.Configuration) (*raftStore, error) {
+	var advertise string
+	for _, peer := range peers.Servers {
+		if string(peer.ID) == node {
+			advertise = string(peer.Address)
+		}
+	}
+	if advertise == "" {
+		return nil, errors.New("node " + node + " isn't one of the raft peers")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(bindAddr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrapped, err := raft.HasExistingState(logs, logs, snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(node)
+
+	s := &raftStore{node: node}
+	s.raft, err = raft.NewRaft(config, s, logs, logs, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	if !bootstrapped {
+		if err := s.raft.BootstrapCluster(peers).Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Replicate implements the replicator interface
+func (s *raftStore) Replicate(c change) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return s.raft.Apply(data, raftApplyTimeout).Error()
+}
+
+// Apply implements the raft.FSM interface, applying a committed change to the home. Changes carry the
+// complete records they write, so applying them has the same result on every node
+func (s *raftStore) Apply(l *raft.Log) interface{} {
+	var c change
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		log.Println("failed to decode raft command", l.Index, "with error:", err)
+		return err
+	}
+
+	home.apply(c)
+	return nil
+}
+
+// Snapshot implements the raft.FSM interface. Thermostats are never modified in place, so holding on to
+// the current records is enough to snapshot them
+func (s *raftStore) Snapshot() (raft.FSMSnapshot, error) {
+	return raftSnapshot(home.Thermostats()), nil
+}
+
+// Restore implements the raft.FSM interface, replacing every thermostat with those of the snapshot
+func (s *raftStore) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	var therms []*thermostat
+	if err := json.NewDecoder(snapshot).Decode(&therms); err != nil {
+		return err
+	}
+
+	home.replace(therms)
+	return nil
+}
+
+// raftSnapshot is every thermostat at the time of a snapshot
+type raftSnapshot []*thermostat
+
+// Persist implements the raft.FSMSnapshot interface
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+// Release implements the raft.FSMSnapshot interface
+func (s raftSnapshot) Release() {}
+
+// Close leaves the cluster and closes the raft log
+func (s *raftStore) Close() error {
+	return s.raft.Shutdown().Error()
+}
+
+// IsLeader implements the elector interface
+func (s *raftStore) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// Leader implements the elector interface
+func (s *raftStore) Leader() string {
+	_, id := s.raft.LeaderWithID()
+	return string(id)
+}
+
+// Status implements the elector interface, listing every member of the cluster. A node is healthy while it
+// leads, or while it has heard from the leader recently
+func (s *raftStore) Status() clusterStatus {
+	status := clusterStatus{
+		Node:    s.node,
+		Leader:  s.Leader(),
+		Leading: s.IsLeader(),
+		State:   s.raft.State().String(),
+	}
+	status.Healthy = status.Leading || (status.Leader != "" && time.Since(s.raft.LastContact()) < raftContactTimeout)
+
+	status.AppliedIndex = s.raft.AppliedIndex()
+	status.LastIndex = s.raft.LastIndex()
+
+	if future := s.raft.GetConfiguration(); future.Error() != nil {
+		log.Println("failed to read the raft configuration with error:", future.Error())
+	} else {
+		for _, server := range future.Configuration().Servers {
+			status.Members = append(status.Members, clusterMember{
+				Node:    string(server.ID),
+				Address: string(server.Address),
+				Voter:   server.Suffrage == raft.Voter,
+				Leader:  string(server.ID) == status.Leader,
+			})
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRaftPeers(t *testing.T) {
+	peers, err := parseRaftPeers("http://10.0.0.5:8080=10.0.0.5:7000, http://10.0.0.6:8080=10.0.0.6:7000")
+	if err != nil {
+		t.Fatalf("failed to parse raft peers: %s", err)
+	}
+	if len(peers.Servers) != 2 || peers.Servers[1].ID != "http://10.0.0.6:8080" || peers.Servers[1].Address != "10.0.0.6:7000" {
+		t.Fatalf("unexpected raft peers: %+v", peers.Servers)
+	}
+
+	if _, err := parseRaftPeers("10.0.0.5:7000"); err == nil {
+		t.Fatal("expected a peer without a node address to be rejected")
+	}
+}
+
+func TestRaftReplication(t *testing.T) {
+	base := newTestServer(t)
+	// pick a free port for the raft transport of a single node cluster
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	node := base
+	peers, err := parseRaftPeers(node + "=" + addr)
+	if err != nil {
+		t.Fatalf("failed to parse raft peers: %s", err)
+	}
+	s, err := newRaftStore(node, addr, t.TempDir(), peers)
+	if err != nil {
+		t.Fatalf("failed to start raft: %s", err)
+	}
+	defer s.raft.Shutdown()
+
+	for deadline := time.Now().Add(10 * time.Second); !s.IsLeader(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the node to be elected")
+		}
+	}
+
+	id, _ := home.AddThermostat(updateThermostat{Name: "Workshop Thermostat"})
+
+	cluster, replication = s, s
+	defer func() { cluster, replication = standalone{}, nil }()
+
+	applied := s.raft.AppliedIndex()
+	url := base + "/v1/thermostats/" + strconv.Itoa(id)
+	if code := put(url, `{"fan": "on"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d for a write to the leader, got %d", http.StatusOK, code)
+	}
+	if s.raft.AppliedIndex() <= applied {
+		t.Fatal("expected the write to be committed through the raft log")
+	}
+
+	var th *thermostat
+	get(url, t, &th)
+	if th == nil || th.FanMode != "on" {
+		t.Fatalf("expected the committed write to be applied, got %+v", th)
+	}
+
+	var status clusterStatus
+	get(base+"/v1/cluster/status", t, &status)
+	if !status.Leading || !status.Healthy || status.Leader != node || len(status.Members) != 1 || !status.Members[0].Leader {
+		t.Fatalf("unexpected cluster status: %+v", status)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// readOnlyMode is the body sent in and returned through the api @ /v1/admin/readonly. It is also what gets
+// persisted so the mode survives a restart
+type readOnlyMode struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// writeFreeze provides safe concurrent access to the read-only mode of the whole service
+type writeFreeze struct {
+	sync.Mutex
+	mode readOnlyMode
+}
+
+var readOnly writeFreeze
+
+// load restores the read-only mode persisted at path. A missing file means the service is writable
+func (f *writeFreeze) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var mode readOnlyMode
+	if err := json.Unmarshal(b, &mode); err != nil {
+		return err
+	}
+
+	f.Lock()
+	f.mode = mode
+	f.Unlock()
+
+	return nil
+}
+
+// Mode is a getter to provide safe concurrent read access to the read-only mode
+func (f *writeFreeze) Mode() readOnlyMode {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.mode
+}
+
+// SetMode changes the read-only mode and persists it to path, if given. The mode is left unchanged if it
+// can't be persisted, so it never differs from what a restart would load
+func (f *writeFreeze) SetMode(mode readOnlyMode, path string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if mode.Enabled {
+		now := time.Now()
+		mode.Since = &now
+	} else {
+		mode.Reason = ""
+		mode.Since = nil
+	}
+
+	if path != "" {
+		jsn, err := json.Marshal(mode)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, jsn, 0644); err != nil {
+			return err
+		}
+	}
+
+	f.mode = mode
+	return nil
+}
+
+// checkReadOnly returns the error every mutation is rejected with while the service is read-only
+func checkReadOnly() *errResponse {
+	mode := readOnly.Mode()
+	if !mode.Enabled {
+		return nil
+	}
+
+	description := "The service is in read-only mode and is not accepting changes."
+	if mode.Reason != "" {
+		description += " Reason: " + mode.Reason
+	}
+
+	return &errResponse{
+		Code:        http.StatusServiceUnavailable,
+		Msg:         "Read-Only Mode",
+		Description: description,
+	}
+}
+
+// GetReadOnly is the handler to return the current read-only mode of the service
+func GetReadOnly(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, readOnly.Mode())
+}
+
+// PutReadOnly is the handler to put the whole service into or out of read-only mode
+func PutReadOnly(req *fasthttp.RequestCtx) {
+	var mode readOnlyMode
+	if err := unmarshalStrict(req.PostBody(), &mode); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	if err := readOnly.SetMode(mode, cfg.ReadOnlyFile); err != nil {
+		res := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to persist read-only mode",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, res)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, readOnly.Mode())
+}
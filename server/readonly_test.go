@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func put(url, body string, t *testing.T) int {
+	client := http.Client{}
+	req, err := http.NewRequest("PUT", url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	base := newTestServer(t)
+
+	url := base + "/v1/thermostats/" + strconv.Itoa(addThermostat(t, updateThermostat{Name: "Porch Thermostat"}))
+
+	if code := put(base+"/v1/admin/readonly", `{"enabled": true, "reason": "database migration"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d enabling read-only mode, got %d", http.StatusOK, code)
+	}
+
+	if code := put(url, `{"fan": "on"}`, t); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d for a write in read-only mode, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	var th *thermostat
+	get(url, t, &th)
+	if th == nil {
+		t.Fatal("expected reads to keep working in read-only mode")
+	}
+
+	// the mode must survive a restart
+	var restored writeFreeze
+	if err := restored.load(cfg.ReadOnlyFile); err != nil {
+		t.Fatalf("failed to load persisted read-only mode: %s", err)
+	}
+	if mode := restored.Mode(); !mode.Enabled || mode.Reason != "database migration" {
+		t.Fatalf("expected persisted mode to be enabled with its reason, got %+v", mode)
+	}
+
+	if code := put(base+"/v1/admin/readonly", `{"enabled": false}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d disabling read-only mode, got %d", http.StatusOK, code)
+	}
+	if code := put(url, `{"fan": "on"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d for a write after read-only mode ended, got %d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// defaultRecordingWindow is how long the recorder runs unless it's given, and maxRecordingWindow the
+	// longest it can run before it stops by itself
+	defaultRecordingWindow = "15m"
+	maxRecordingWindow     = time.Hour
+
+	// maxRecorded is how many exchanges a recording holds, the oldest being forgotten beyond it, and
+	// maxRecordedBody how much of a body is kept
+	maxRecorded     = 1000
+	maxRecordedBody = 64 << 10
+
+	// maxReplayed is how many recorded requests a single replay sends, and replayDeadline how long it takes
+	// at most, so the handler returns in time. The rest are replayed by calling it again after the last one
+	maxReplayed    = 100
+	replayDeadline = 30 * time.Second
+
+	// recordingPath is where the recorder is managed, which it never records itself
+	recordingPath = "/v1/admin/recording"
+)
+
+// recordingRedacted replaces the values of headers and json fields that may hold secrets
+const recordingRedacted = "REDACTED"
+
+// replayClient replays recorded requests against another instance
+var replayClient = &http.Client{Timeout: 10 * time.Second}
+
+// recordedExchange is a request served while recording and the response to it, sanitized of credentials
+// and secrets, returned through the api @ /v1/admin/recording/exchanges
+type recordedExchange struct {
+	ID           int               `json:"id"`
+	Time         time.Time         `json:"time"`
+	Method       string            `json:"method"`
+	URI          string            `json:"uri"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Body         string            `json:"body,omitempty"`
+	Status       int               `json:"status"`
+	ContentType  string            `json:"contentType,omitempty"`
+	ResponseBody string            `json:"responseBody,omitempty"`
+	Duration     string            `json:"duration"`
+}
+
+// recordingStatus is the state of the recorder, returned through the api @ /v1/admin/recording
+type recordingStatus struct {
+	Recording bool       `json:"recording"`
+	Until     *time.Time `json:"until,omitempty"`
+	Exchanges int        `json:"exchanges"`
+}
+
+// recordingWindow is the body sent in through the api @ /v1/admin/recording to start recording
+type recordingWindow struct {
+	Duration string `json:"duration,omitempty"` // e.g. "30m", defaults to 15 minutes
+}
+
+// replayTarget is the body sent in through the api @ /v1/admin/recording/replay. Token is the access token
+// the requests are replayed with, as the recording holds none, and After the id of the last exchange a
+// previous replay got to, which this one picks up after
+type replayTarget struct {
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+	After int    `json:"after,omitempty"`
+}
+
+// replayResult is how a recorded request fared when it was replayed
+type replayResult struct {
+	ID             int    `json:"id"`
+	Method         string `json:"method"`
+	URI            string `json:"uri"`
+	RecordedStatus int    `json:"recordedStatus"`
+	ReplayedStatus int    `json:"replayedStatus,omitempty"`
+	Match          bool   `json:"match"`
+	Error          string `json:"error,omitempty"`
+	ResponseBody   string `json:"responseBody,omitempty"` // of the replayed request, when the statuses differ
+}
+
+// replayReport is the outcome of replaying a recording, returned through the api @
+// /v1/admin/recording/replay. Remaining is how many exchanges are left to replay after the last result
+type replayReport struct {
+	URL       string         `json:"url"`
+	Replayed  int            `json:"replayed"`
+	Matched   int            `json:"matched"`
+	Remaining int            `json:"remaining"`
+	Results   []replayResult `json:"results"`
+}
+
+// requestRecorder captures the exchanges served while it runs, which it only does when it's asked to
+type requestRecorder struct {
+	sync.Mutex
+	until     time.Time
+	exchanges []recordedExchange
+	lastID    int
+}
+
+var recording = &requestRecorder{}
+
+// reset stops recording and forgets every exchange
+func (r *requestRecorder) reset() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.until = time.Time{}
+	r.exchanges = nil
+	r.lastID = 0
+}
+
+// Recording reports whether exchanges are recorded at the given time
+func (r *requestRecorder) Recording(now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return now.Before(r.until)
+}
+
+// Start records from now until the given time, starting over from an empty recording
+func (r *requestRecorder) Start(until time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.until = until
+	r.exchanges = nil
+	r.lastID = 0
+}
+
+// Status returns the state of the recorder at the given time
+func (r *requestRecorder) Status(now time.Time) recordingStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	st := recordingStatus{Recording: now.Before(r.until), Exchanges: len(r.exchanges)}
+	if st.Recording {
+		until := r.until
+		st.Until = &until
+	}
+	return st
+}
+
+// Add keeps the exchange, numbering it, while recording
+func (r *requestRecorder) Add(e recordedExchange) {
+	r.Lock()
+	defer r.Unlock()
+
+	if !e.Time.Before(r.until) {
+		return
+	}
+	r.lastID++
+	e.ID = r.lastID
+	r.exchanges = append(r.exchanges, e)
+	if len(r.exchanges) > maxRecorded {
+		r.exchanges = r.exchanges[len(r.exchanges)-maxRecorded:]
+	}
+}
+
+// Exchanges returns the exchanges recorded, oldest first
+func (r *requestRecorder) Exchanges() []recordedExchange {
+	r.Lock()
+	defer r.Unlock()
+
+	return append([]recordedExchange{}, r.exchanges...)
+}
+
+// Forget drops the exchanges that mention the user in their request or response, and returns how many were
+// dropped
+func (r *requestRecorder) Forget(username string) int {
+	r.Lock()
+	defer r.Unlock()
+
+	kept := r.exchanges[:0]
+	for _, e := range r.exchanges {
+		mentioned := strings.Contains(e.URI, username) || strings.Contains(e.Body, username) || strings.Contains(e.ResponseBody, username)
+		for _, value := range e.Headers {
+			mentioned = mentioned || strings.Contains(value, username)
+		}
+		if !mentioned {
+			kept = append(kept, e)
+		}
+	}
+	forgotten := len(r.exchanges) - len(kept)
+	r.exchanges = kept
+	return forgotten
+}
+
+// secretName reports whether a header or json field by the name may hold a secret
+func secretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"authorization", "cookie", "password", "token", "secret", "key", "signature"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactJSON replaces the values of the fields of the json document that may hold secrets, at any depth
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if secretName(k) {
+				v[k] = recordingRedacted
+			} else {
+				v[k] = redactJSON(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	}
+	return v
+}
+
+// sanitizeBody returns the body as it's recorded: json with its secrets redacted, other text as is as long
+// as it's short enough, and only the size and type of anything else
+func sanitizeBody(b []byte, contentType string) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var v interface{}
+	if json.Unmarshal(b, &v) == nil {
+		if jsn, err := json.Marshal(redactJSON(v)); err == nil && len(jsn) <= maxRecordedBody {
+			return string(jsn)
+		}
+	}
+	if strings.HasPrefix(contentType, "text/") && len(b) <= maxRecordedBody {
+		return string(b)
+	}
+	return "<" + strconv.Itoa(len(b)) + " bytes of " + contentType + ">"
+}
+
+// sanitizeURI returns the uri as it's recorded, with the values of query parameters that may hold secrets
+// redacted
+func sanitizeURI(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil || u.RawQuery == "" {
+		return uri
+	}
+	q := u.Query()
+	for name := range q {
+		if secretName(name) {
+			q.Set(name, recordingRedacted)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// recordRequests records every request the handler serves and the response to it while the recorder runs
+func recordRequests(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(req *fasthttp.RequestCtx) {
+		start := time.Now()
+		if !recording.Recording(start) || strings.HasPrefix(string(req.Path()), recordingPath) {
+			h(req)
+			return
+		}
+
+		// the request is copied before it's served, as handlers may change it
+		e := recordedExchange{
+			Time:   start,
+			Method: string(req.Method()),
+			URI:    sanitizeURI(string(req.RequestURI())),
+			Body:   sanitizeBody(req.PostBody(), string(req.Request.Header.ContentType())),
+		}
+		req.Request.Header.VisitAll(func(key, value []byte) {
+			name := string(key)
+			if name == "Content-Length" || name == "Host" || name == "Connection" {
+				return
+			}
+			if e.Headers == nil {
+				e.Headers = make(map[string]string)
+			}
+			if secretName(name) {
+				e.Headers[name] = recordingRedacted
+			} else {
+				e.Headers[name] = string(value)
+			}
+		})
+
+		h(req)
+
+		e.Status = req.Response.StatusCode()
+		e.ContentType = string(req.Response.Header.ContentType())
+		// a streamed body, such as the events of a thermostat, is only written after the handler returns
+		if !req.Response.IsBodyStream() {
+			e.ResponseBody = sanitizeBody(req.Response.Body(), e.ContentType)
+		}
+		e.Duration = time.Since(start).String()
+		recording.Add(e)
+	})
+}
+
+// replay sends the recorded request to the instance at target, with the access token when given, giving up
+// once ctx is done
+func replay(ctx context.Context, target string, token string, e recordedExchange) replayResult {
+	res := replayResult{ID: e.ID, Method: e.Method, URI: e.URI, RecordedStatus: e.Status}
+
+	var body []byte
+	if e.Body != "" && !strings.HasPrefix(e.Body, "<") {
+		body = []byte(e.Body)
+	}
+	r, err := http.NewRequestWithContext(ctx, e.Method, target+e.URI, bytes.NewReader(body))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	for name, value := range e.Headers {
+		if value != recordingRedacted {
+			r.Header.Set(name, value)
+		}
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := replayClient.Do(r)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+
+	res.ReplayedStatus = resp.StatusCode
+	res.Match = resp.StatusCode == e.Status
+	if !res.Match {
+		b, _ := ioutil.ReadAll(resp.Body)
+		res.ResponseBody = sanitizeBody(b, resp.Header.Get("Content-Type"))
+	}
+	return res
+}
+
+// GetRecording is the handler to return the state of the recorder
+func GetRecording(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, recording.Status(time.Now()))
+}
+
+// PutRecording is the handler to start recording the requests served, and the responses to them, for a
+// limited window after which it stops by itself. Whatever was recorded before is discarded
+func PutRecording(req *fasthttp.RequestCtx) {
+	var body recordingWindow
+	if len(req.PostBody()) > 0 {
+		if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid JSON body provided",
+				Description: err.Error(),
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+	if body.Duration == "" {
+		body.Duration = defaultRecordingWindow
+	}
+	window, err := time.ParseDuration(body.Duration)
+	if err != nil || window <= 0 || window > maxRecordingWindow {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Duration",
+			Description: "The duration must be positive and at most " + maxRecordingWindow.String() + ", e.g. 15m.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	now := time.Now()
+	recording.Start(now.Add(window))
+	log.Println("recording requests until", now.Add(window).Format(time.RFC3339))
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, recording.Status(now))
+}
+
+// DeleteRecording is the handler to stop recording and discard the recording
+func DeleteRecording(req *fasthttp.RequestCtx) {
+	recording.reset()
+	req.SetStatusCode(http.StatusNoContent)
+}
+
+// GetRecordedExchanges is the handler to download the recording, e.g. to attach to a bug report
+func GetRecordedExchanges(req *fasthttp.RequestCtx) {
+	req.Response.Header.Set("Content-Disposition", `attachment; filename="recording-`+time.Now().UTC().Format("20060102T150405Z")+`.json"`)
+	req.Response.Header.Set("Cache-Control", "no-store")
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, recording.Exchanges())
+}
+
+// PostReplay is the handler to replay the recording against another instance, such as a staging one, in
+// the order it was recorded, reporting the requests whose status differs. At most maxReplayed requests are
+// sent within replayDeadline, and the report tells how many are left for the next call
+func PostReplay(req *fasthttp.RequestCtx) {
+	var body replayTarget
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	u, err := url.Parse(body.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid URL",
+			Description: "The url of the instance to replay against must be an absolute http or https url, e.g. https://staging.example.com.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	exchanges := recording.Exchanges()
+	if len(exchanges) == 0 {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "Nothing was recorded. Start recording with PUT " + recordingPath + ".",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	pending := exchanges[:0]
+	for _, e := range exchanges {
+		if e.ID > body.After {
+			pending = append(pending, e)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), replayDeadline)
+	defer cancel()
+
+	target := strings.TrimRight(body.URL, "/")
+	report := replayReport{URL: target, Results: make([]replayResult, 0, len(pending))}
+	for i, e := range pending {
+		if i == maxReplayed || ctx.Err() != nil {
+			report.Remaining = len(pending) - i
+			break
+		}
+		res := replay(ctx, target, body.Token, e)
+		// a request cut off by the deadline is left for the next call rather than reported as failed
+		if res.Error != "" && ctx.Err() != nil {
+			report.Remaining = len(pending) - i
+			break
+		}
+		report.Replayed++
+		if res.Match {
+			report.Matched++
+		}
+		report.Results = append(report.Results, res)
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, report)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRecording(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/admin/recording"
+
+	get(base+"/v1/thermostats/1", t, nil)
+	if code := put(url, `{"duration": "2h"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected a window over an hour to be rejected, got %d", code)
+	}
+	if code := put(url, ``, t); code != http.StatusOK {
+		t.Fatalf("expected recording to start, got %d", code)
+	}
+
+	get(base+"/v1/thermostats/1?token=abc", t, nil)
+	put(base+"/v1/thermostats/1", `{"name": "Den", "wifi": {"password": "hunter2"}}`, t)
+	var st recordingStatus
+	if get(url, t, &st); !st.Recording || st.Until == nil || st.Exchanges != 2 {
+		t.Fatalf("expected two exchanges to be recorded, got %+v", st)
+	}
+
+	var exchanges []recordedExchange
+	get(url+"/exchanges", t, &exchanges)
+	if len(exchanges) != 2 || exchanges[0].Method != "GET" || exchanges[0].Status != http.StatusOK || !strings.Contains(exchanges[0].ResponseBody, `"id":1`) {
+		t.Fatalf("expected the exchanges in order, got %+v", exchanges)
+	}
+	if exchanges[0].URI != "/v1/thermostats/1?token=REDACTED" || strings.Contains(exchanges[1].Body, "hunter2") || !strings.Contains(exchanges[1].Body, `"password":"REDACTED"`) {
+		t.Fatalf("expected the secrets to be redacted, got %+v", exchanges)
+	}
+
+	// replaying against another instance reports the requests that fared differently
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer staging-token" || r.Method != "GET" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(errResponse{Code: http.StatusUnauthorized})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer staging.Close()
+
+	if code := postJSON(url+"/replay", `{"url": "staging"}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a relative url to be rejected, got %d", code)
+	}
+	var report replayReport
+	if code := postJSON(url+"/replay", `{"url": "`+staging.URL+`/", "token": "staging-token"}`, t, &report); code != http.StatusOK {
+		t.Fatalf("expected the recording to be replayed, got %d", code)
+	}
+	if report.Replayed != 2 || report.Matched != 1 || report.Results[1].Match || report.Results[1].ReplayedStatus != http.StatusUnauthorized {
+		t.Fatalf("expected the update to fare differently, got %+v", report)
+	}
+
+	// a replay picks up after the last exchange a previous one got to, and sends at most maxReplayed
+	report = replayReport{}
+	postJSON(url+"/replay", `{"url": "`+staging.URL+`", "token": "staging-token", "after": `+strconv.Itoa(exchanges[0].ID)+`}`, t, &report)
+	if report.Replayed != 1 || report.Remaining != 0 || report.Results[0].ID != exchanges[1].ID {
+		t.Fatalf("expected only the update to be replayed, got %+v", report)
+	}
+	for i := 0; i < maxReplayed; i++ {
+		get(base+"/v1/thermostats/1", t, nil)
+	}
+	report = replayReport{}
+	postJSON(url+"/replay", `{"url": "`+staging.URL+`", "token": "staging-token"}`, t, &report)
+	if report.Replayed != maxReplayed || report.Remaining != 2 {
+		t.Fatalf("expected %d exchanges to be replayed with 2 left, got %d with %d left", maxReplayed, report.Replayed, report.Remaining)
+	}
+
+	if code := del(url, t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected the recording to be discarded, got %d", code)
+	}
+	if get(url, t, &st); st.Recording || st.Exchanges != 0 {
+		t.Fatalf("expected recording to stop, got %+v", st)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/valyala/fasthttp"
+)
+
+// sentryEnabled is set once sentry has been initialized with a dsn
+var sentryEnabled bool
+
+// initSentry configures the sentry client errors and panics are reported to
+func initSentry(dsn, environment string) error {
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: environment,
+	}); err != nil {
+		return err
+	}
+
+	sentryEnabled = true
+	return nil
+}
+
+// reportError sends an internal error or a recovered panic to sentry, tagged with the request it happened in
+// and the thermostat it targeted
+func reportError(req *fasthttp.RequestCtx, err interface{}) {
+	if !sentryEnabled {
+		return
+	}
+
+	hub := sentry.CurrentHub().Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("method", string(req.Method()))
+		scope.SetTag("path", string(req.Path()))
+		if id, ok := req.UserValue("id").(string); ok {
+			scope.SetTag("thermostat_id", id)
+		}
+		scope.SetContext("request", sentry.Context{
+			"url":         req.URI().String(),
+			"remote_addr": req.RemoteAddr().String(),
+		})
+
+		if e, ok := err.(error); ok {
+			hub.CaptureException(e)
+		} else {
+			hub.Recover(err)
+		}
+	})
+}
+
+// handlePanic is the router's panic handler. It recovers from a panic in any route, reports it and sends
+// the client an internal server error so one bad request can't crash the server
+func handlePanic(req *fasthttp.RequestCtx, rcv interface{}) {
+	log.Printf("recovered from panic serving %s %s: %v\n%s", req.Method(), req.Path(), rcv, debug.Stack())
+	reportError(req, rcv)
+
+	res := &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Internal Server Error",
+		Description: "An unexpected error occurred while handling the request.",
+	}
+	req.ResetBody()
+	req.SetStatusCode(http.StatusInternalServerError)
+	sendJSON(req, res)
+}
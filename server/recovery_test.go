@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+func TestHandlePanic(t *testing.T) {
+	r := fasthttprouter.New()
+	r.PanicHandler = handlePanic
+	r.GET("/boom", func(req *fasthttp.RequestCtx) {
+		var th *thermostat
+		req.SetBodyString(th.Name) // nil pointer dereference
+	})
+
+	var req fasthttp.RequestCtx
+	req.Request.Header.SetMethod("GET")
+	req.Request.SetRequestURI("/boom")
+	r.Handler(&req)
+
+	if code := req.Response.StatusCode(); code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+
+	errRes := new(errResponse)
+	if err := json.Unmarshal(req.Response.Body(), errRes); err != nil {
+		t.Fatalf("failed to unmarshal response into *errResponse: %s", err)
+	}
+	if errRes.Code != http.StatusInternalServerError {
+		t.Fatalf("expected error code %d, got %d", http.StatusInternalServerError, errRes.Code)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+const (
+	// replicaRetryInterval is how long a replica waits before reconnecting to its primary
+	replicaRetryInterval = 5 * time.Second
+
+	// replicaPingInterval is how often a replica checks that its primary is still there, and
+	// replicaTimeout how long it waits to hear back before reconnecting
+	replicaPingInterval = 15 * time.Second
+	replicaTimeout      = 2 * replicaPingInterval
+)
+
+// replicaMessage is anything the primary sends a replica over the json-rpc websocket, either the response
+// to a call or an event notification
+type replicaMessage struct {
+	Method string          `json:"method"`
+	Params event           `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// replicaSync keeps the thermostats of a read replica in sync with its primary through the change stream
+// of the json-rpc websocket. It's also the elector of the replica, which never leads: writes are sent to
+// the primary
+type replicaSync struct {
+	sync.Mutex
+	home      *currentState
+	primary   string
+	username  string
+	password  string
+	connected bool
+}
+
+// newReplicaSync returns the sync of the home with the primary at the given base url, e.g.
+// http://10.0.0.5:8080. The credentials are only needed when the primary requires authentication
+func newReplicaSync(primary, username, password string) *replicaSync {
+	return &replicaSync{
+		home:     &home,
+		primary:  strings.TrimSuffix(primary, "/"),
+		username: username,
+		password: password,
+	}
+}
+
+// IsLeader implements the elector interface
+func (r *replicaSync) IsLeader() bool { return false }
+
+// Leader implements the elector interface
+func (r *replicaSync) Leader() string { return r.primary }
+
+// Status implements the elector interface. A replica is healthy while it's following the change stream of
+// its primary
+func (r *replicaSync) Status() clusterStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	return clusterStatus{
+		Leader:  r.primary,
+		Healthy: r.connected,
+		State:   "Replica",
+	}
+}
+
+// run follows the primary until stop is closed, reconnecting whenever the connection is lost
+func (r *replicaSync) run(stop <-chan struct{}) {
+	for {
+		err := r.follow(stop)
+
+		r.Lock()
+		r.connected = false
+		r.Unlock()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		log.Println("lost the change stream of primary", r.primary, "with error:", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// login exchanges the credentials of the replica for an access token of the primary
+func (r *replicaSync) login() (string, error) {
+	body, err := json.Marshal(credentials{Username: r.username, Password: r.password})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.Post(r.primary+"/v1/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("login to the primary failed with status " + resp.Status)
+	}
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+
+	return tokens.AccessToken, nil
+}
+
+// follow subscribes to every change of the primary and then loads every thermostat, applying the changes
+// as they come in until the connection is lost. Changes that arrive before the thermostats are loaded are
+// already part of them, so loading them last never misses a change. Closing stop drops the connection
+func (r *replicaSync) follow(stop <-chan struct{}) error {
+	header := http.Header{}
+	if r.username != "" {
+		token, err := r.login()
+		if err != nil {
+			return err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	// http:// becomes ws:// and https:// becomes wss://
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(r.primary, "http")+"/v1/rpc", header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	calls := `[
+		{"jsonrpc": "2.0", "method": "subscribe", "id": "subscribe"},
+		{"jsonrpc": "2.0", "method": "listThermostats", "id": "list"}
+	]`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(calls)); err != nil {
+		return err
+	}
+
+	// ping the primary so a connection that silently went away is noticed
+	conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(replicaPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(rpcWriteTimeout))
+			case <-stop:
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+
+		// the responses to the calls come back as a batch
+		var messages []replicaMessage
+		if bytes.HasPrefix(bytes.TrimSpace(msg), []byte("[")) {
+			err = json.Unmarshal(msg, &messages)
+		} else {
+			messages = make([]replicaMessage, 1)
+			err = json.Unmarshal(msg, &messages[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, m := range messages {
+			if err := r.handle(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle applies a single message from the primary
+func (r *replicaSync) handle(m replicaMessage) error {
+	if m.Error != nil {
+		return errors.New("call to the primary failed with error: " + m.Error.Message)
+	}
+
+	switch {
+	case m.Method == "event" && m.Params.Type == eventChange && m.Params.Thermostat != nil:
+		r.home.apply(change{Type: changeReplicated, Time: m.Params.Time, Thermostats: []*thermostat{m.Params.Thermostat}})
+
+	case m.Method == "event" && m.Params.Type == eventDeleted && m.Params.Thermostat != nil:
+		r.home.apply(change{Type: changeDelete, Time: m.Params.Time, Deleted: []*thermostat{m.Params.Thermostat}})
+
+	case string(m.ID) == `"list"`:
+		var therms []*thermostat
+		if err := json.Unmarshal(m.Result, &therms); err != nil {
+			return err
+		}
+		r.home.replace(therms)
+
+		r.Lock()
+		r.connected = true
+		r.Unlock()
+		log.Println("synced", len(therms), "thermostats from primary", r.primary)
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReplicaSync(t *testing.T) {
+	base := newTestServer(t)
+	id, _ := home.AddThermostat(updateThermostat{Name: "Mudroom Thermostat"})
+
+	// follow the test server into a home of its own
+	replica := newReplicaSync(base+"/", "", "")
+	replica.home = &currentState{thermostats: make(map[int]*thermostat)}
+	stop := make(chan struct{})
+	defer close(stop)
+	go replica.follow(stop)
+
+	waitFor := func(what string, ok func(t *thermostat) bool) {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			if th, errRes := replica.home.Thermostat(id); errRes == nil && ok(th) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the replica to %s", what)
+			}
+		}
+	}
+
+	waitFor("load the thermostats", func(th *thermostat) bool { return th.Name == "Mudroom Thermostat" })
+	if status := replica.Status(); !status.Healthy || status.Leader != base {
+		t.Fatalf("unexpected replica status: %+v", status)
+	}
+
+	if code := put(base+"/v1/thermostats/"+strconv.Itoa(id), `{"fan": "on"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d for a write to the primary, got %d", http.StatusOK, code)
+	}
+	waitFor("apply the change", func(th *thermostat) bool { return th.FanMode == "on" })
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fieldResets return the desired state that resets a property of a thermostat to its default, by the json
+// key of the property. Every default is non-empty, or the empty location that removes it, so the reset goes
+// through the same update path as any other change
+var fieldResets = map[string]func(t *thermostat) updateThermostat{
+	"name": func(t *thermostat) updateThermostat {
+		return updateThermostat{Name: defaultNamePrefix + strconv.Itoa(t.ID)}
+	},
+	"mode": func(t *thermostat) updateThermostat {
+		return updateThermostat{OperatingMode: defaultOpMode}
+	},
+	"coolSetPoint": func(t *thermostat) updateThermostat {
+		return updateThermostat{CoolSetPoint: defaultSetPt}
+	},
+	"heatSetPoint": func(t *thermostat) updateThermostat {
+		return updateThermostat{HeatSetPoint: defaultSetPt}
+	},
+	"fan": func(t *thermostat) updateThermostat {
+		return updateThermostat{FanMode: defaultFan}
+	},
+	"location": func(t *thermostat) updateThermostat {
+		return updateThermostat{Location: &location{}}
+	},
+}
+
+// ResetThermostat restores every setting of the thermostat to the defaults of a newly added thermostat and
+// ends maintenance mode
+func (home *currentState) ResetThermostat(target *thermostat) (*thermostat, error) {
+	desired := updateThermostat{
+		Name:          defaultNamePrefix + strconv.Itoa(target.ID),
+		OperatingMode: defaultOpMode,
+		CoolSetPoint:  defaultSetPt,
+		HeatSetPoint:  defaultSetPt,
+		FanMode:       defaultFan,
+	}
+
+	// maintenance mode is only carried over from the target, so clearing it on a copy ends it
+	cleared := *target
+	cleared.MaintenanceUntil = nil
+
+	return home.UpdateThermostat(&cleared, desired)
+}
+
+// DeleteField is the handler to reset a specific property of a specific thermostat to its default
+func DeleteField(req *fasthttp.RequestCtx) {
+	f, ok := thermostatFields[req.UserValue("field").(string)]
+	if !ok || f.reset == nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Property",
+			Description: "The property provided can't be reset. Valid choices are: " + listChoices(resettableFieldNames()) + ".",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+	desired := f.reset(target)
+
+	// disabled thermostats can't be controlled until they are enabled again
+	if errRes := checkDisabled(target, desired); errRes != nil {
+		req.SetStatusCode(http.StatusConflict)
+		sendJSON(req, errRes)
+		return
+	}
+
+	updated, err := home.UpdateThermostat(target, desired)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// PostReset is the handler to factory reset a specific thermostat. The reset can't be undone, so it must be
+// confirmed with ?confirm=true
+func PostReset(req *fasthttp.RequestCtx) {
+	if string(req.QueryArgs().Peek("confirm")) != "true" {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Confirmation Required",
+			Description: "A factory reset restores every setting of the thermostat to its default and can't be undone. Pass ?confirm=true to go ahead.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	// disabled thermostats can't be controlled until they are enabled again
+	if errRes := checkDisabled(target, updateThermostat{OperatingMode: defaultOpMode}); errRes != nil {
+		req.SetStatusCode(http.StatusConflict)
+		sendJSON(req, errRes)
+		return
+	}
+
+	updated, err := home.ResetThermostat(target)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func del(url string, t *testing.T, v interface{}) int {
+	client := http.Client{}
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		t.Fatalf("failed to create new DELETE request: %s", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestDeleteField(t *testing.T) {
+	base := newTestServer(t)
+	id, _ := home.AddThermostat(updateThermostat{Name: "Sunroom Thermostat", OperatingMode: "cool", CoolSetPoint: 65, FanMode: "on"})
+	url := base + "/v1/thermostats/" + strconv.Itoa(id)
+
+	var th thermostat
+	if code := del(url+"/mode", t, &th); code != http.StatusOK {
+		t.Fatalf("expected status %d resetting the mode, got %d", http.StatusOK, code)
+	}
+	if th.OperatingMode != defaultOpMode || th.FanMode != "on" {
+		t.Fatalf("expected only the mode to be reset to %s, got %+v", defaultOpMode, th)
+	}
+
+	th = thermostat{}
+	if code := del(url+"/name", t, &th); code != http.StatusOK {
+		t.Fatalf("expected status %d resetting the name, got %d", http.StatusOK, code)
+	}
+	if th.Name != "Thermostat #"+strconv.Itoa(id) {
+		t.Fatalf("expected the name to be reset to its default, got %s", th.Name)
+	}
+
+	th = thermostat{}
+	if code := del(url+"/coolSetPoint", t, &th); code != http.StatusOK {
+		t.Fatalf("expected status %d resetting the cool set point, got %d", http.StatusOK, code)
+	}
+	if th.CoolSetPoint != defaultSetPt {
+		t.Fatalf("expected the cool set point to be reset to %d, got %d", defaultSetPt, th.CoolSetPoint)
+	}
+
+	if code := del(url+"/currentTemp", t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d resetting the current temperature, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestPostReset(t *testing.T) {
+	base := newTestServer(t)
+	id, _ := home.AddThermostat(updateThermostat{Name: "Basement Thermostat", OperatingMode: "heat", HeatSetPoint: 75})
+	target, _ := home.Thermostat(id)
+	until := time.Now().Add(time.Hour)
+	home.SetMaintenance(target, &until)
+	url := base + "/v1/thermostats/" + strconv.Itoa(id) + "/reset"
+
+	resp, err := http.Post(url, "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an unconfirmed reset, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp, err = http.Post(url+"?confirm=true", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d for a confirmed reset, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var th thermostat
+	if err := json.NewDecoder(resp.Body).Decode(&th); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if th.Name != "Thermostat #"+strconv.Itoa(id) || th.OperatingMode != defaultOpMode || th.HeatSetPoint != defaultSetPt || th.FanMode != defaultFan {
+		t.Fatalf("expected every setting to be reset to its default, got %+v", th)
+	}
+	if th.MaintenanceUntil != nil {
+		t.Fatal("expected the reset to end maintenance mode")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// the categories of data a deletion receipt counts what was deleted of. Retention limits apply to the
+	// history, the audit log and the notifications: the delivery log and the dead-lettered notifications.
+	// The alerts of a purged user are kept but count as well, as they no longer name the user
+	dataHistory                 = "history"
+	dataChanges                 = "changes"
+	dataAlerts                  = "alerts"
+	dataAudit                   = "audit"
+	dataNotifications           = "notifications"
+	dataNotificationPreferences = "notificationPreferences"
+	dataInstallerGrants         = "installerGrants"
+	dataSessions                = "sessions"
+	dataOnCall                  = "onCall"
+	dataRecordings              = "recordings"
+
+	// the subjects of deletion receipts: the data of a user or of a thermostat purged through the api, or
+	// the data past its retention limit
+	purgeUser       = "user"
+	purgeThermostat = "thermostat"
+	purgeRetention  = "retention"
+
+	// retentionInterval is how often the data past its retention limit is deleted
+	retentionInterval = time.Hour
+)
+
+// deletionReceipt records what was deleted, when and at whose request, returned through the api @
+// /v1/admin/receipts. Target is the username or the id of the thermostat whose data was purged. Deleted
+// counts what was deleted by category
+type deletionReceipt struct {
+	ID          int            `json:"id"`
+	Time        time.Time      `json:"time"`
+	Subject     string         `json:"subject"`
+	Target      string         `json:"target,omitempty"`
+	RequestedBy string         `json:"requestedBy,omitempty"`
+	Deleted     map[string]int `json:"deleted"`
+}
+
+// receiptStore holds the deletion receipts, oldest first, persisting them to -receipts-file so they survive
+// a restart
+type receiptStore struct {
+	sync.Mutex
+	receipts []deletionReceipt
+	lastID   int
+}
+
+var receipts = &receiptStore{}
+
+// load restores the receipts persisted at path. A missing file means nothing was deleted yet
+func (s *receiptStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []deletionReceipt
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.receipts = saved
+	s.lastID = 0
+	for _, r := range saved {
+		if r.ID > s.lastID {
+			s.lastID = r.ID
+		}
+	}
+	return nil
+}
+
+// save persists the receipts to -receipts-file, if given. The lock must be held
+func (s *receiptStore) save() error {
+	if cfg.ReceiptsFile == "" {
+		return nil
+	}
+
+	jsn, err := json.Marshal(s.receipts)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.ReceiptsFile, jsn, 0644)
+}
+
+// reset forgets every receipt
+func (s *receiptStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.receipts = nil
+	s.lastID = 0
+}
+
+// Add records the receipt, giving it the next id
+func (s *receiptStore) Add(r deletionReceipt) (deletionReceipt, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	r.ID = s.lastID + 1
+	s.receipts = append(s.receipts, r)
+	if err := s.save(); err != nil {
+		s.receipts = s.receipts[:len(s.receipts)-1]
+		return deletionReceipt{}, err
+	}
+	s.lastID = r.ID
+	return r, nil
+}
+
+// List returns the receipts, newest first, only those of the subject if one is given
+func (s *receiptStore) List(subject string) []deletionReceipt {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []deletionReceipt{}
+	for i := len(s.receipts) - 1; i >= 0; i-- {
+		if subject == "" || s.receipts[i].Subject == subject {
+			list = append(list, s.receipts[i])
+		}
+	}
+	return list
+}
+
+// Receipt returns the receipt with the given id
+func (s *receiptStore) Receipt(id int) (deletionReceipt, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, r := range s.receipts {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return deletionReceipt{}, false
+}
+
+// purgeUserData deletes everything held about the user: the notification preferences, the delivery log
+// and dead-lettered notifications, the installer grant, the audit entries, the sessions, their place in the
+// on-call rotation and the recorded exchanges mentioning them. The alerts they were routed, acknowledged,
+// resolved or annotated are kept without their name. The account itself lives in the -users file, which the
+// server never writes
+func purgeUserData(username, requestedBy string, now time.Time) (deletionReceipt, error) {
+	removed, err := notifications.Remove(username)
+	if err != nil {
+		return deletionReceipt{}, err
+	}
+	revoked, err := installers.RemoveGrant(username)
+	if err != nil {
+		return deletionReceipt{}, err
+	}
+	rotated, err := onCall.Forget(username)
+	if err != nil {
+		return deletionReceipt{}, err
+	}
+
+	deleted := map[string]int{
+		dataNotificationPreferences: 0,
+		dataInstallerGrants:         0,
+		dataNotifications:           deliveryLog.Purge(username, time.Time{}) + deadLetters.PurgeNotifications(username, time.Time{}),
+		dataAudit:                   installers.PurgeAudit(username, time.Time{}),
+		dataSessions:                sessions.EndSessions(username),
+		dataAlerts:                  alerts.ForgetUser(username),
+		dataOnCall:                  0,
+		dataRecordings:              recording.Forget(username),
+	}
+	if removed {
+		deleted[dataNotificationPreferences] = 1
+	}
+	if revoked {
+		deleted[dataInstallerGrants] = 1
+	}
+	if rotated {
+		deleted[dataOnCall] = 1
+	}
+	return receipts.Add(deletionReceipt{Time: now, Subject: purgeUser, Target: username, RequestedBy: requestedBy, Deleted: deleted})
+}
+
+// purgeThermostatHistory deletes the full history of the thermostat: the history imported for it, the
+// alerts it raised that were resolved and its past records in the journal, which its cycles and comfort
+// are derived from. The write-ahead log is compacted so they don't linger on disk either, while the
+// replication log of a cluster keeps them for as long as the cluster does
+func purgeThermostatHistory(id int, requestedBy string, now time.Time) (deletionReceipt, error) {
+	purged, err := history.Purge(id, time.Time{})
+	if err != nil {
+		return deletionReceipt{}, err
+	}
+
+	deleted := map[string]int{
+		dataHistory: purged,
+		dataChanges: home.ForgetHistory(id),
+		dataAlerts:  alerts.PurgeResolved(id),
+	}
+	if wal != nil {
+		if err := wal.Compact(); err != nil {
+			return deletionReceipt{}, err
+		}
+	}
+	return receipts.Add(deletionReceipt{Time: now, Subject: purgeThermostat, Target: strconv.Itoa(id), RequestedBy: requestedBy, Deleted: deleted})
+}
+
+// applyRetention deletes the data past the retention limit of its category at the given time, recording a
+// receipt when anything was deleted. It reports whether anything was
+func applyRetention(now time.Time) (deletionReceipt, bool, error) {
+	deleted := make(map[string]int)
+	if cfg.RetainHistory > 0 {
+		purged, err := history.Purge(0, now.Add(-cfg.RetainHistory))
+		if err != nil {
+			return deletionReceipt{}, false, err
+		}
+		deleted[dataHistory] = purged
+	}
+	if cfg.RetainAudit > 0 {
+		deleted[dataAudit] = installers.PurgeAudit("", now.Add(-cfg.RetainAudit))
+	}
+	if cfg.RetainNotifications > 0 {
+		cutoff := now.Add(-cfg.RetainNotifications)
+		deleted[dataNotifications] = deliveryLog.Purge("", cutoff) + deadLetters.PurgeNotifications("", cutoff)
+	}
+
+	total := 0
+	for _, n := range deleted {
+		total += n
+	}
+	if total == 0 {
+		return deletionReceipt{}, false, nil
+	}
+	r, err := receipts.Add(deletionReceipt{Time: now, Subject: purgeRetention, Deleted: deleted})
+	return r, err == nil, err
+}
+
+// runRetention deletes the data past its retention limit every interval until stop is closed, starting
+// straight away. Every node holds its own copy of the data, so every node deletes from it
+func runRetention(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if r, purged, err := applyRetention(time.Now()); err != nil {
+			log.Println("failed to apply the retention limits with error:", err)
+		} else if purged {
+			log.Println("retention limits deleted", r.Deleted, "- receipt", r.ID)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendPurgeError responds that the data couldn't be purged
+func sendPurgeError(req *fasthttp.RequestCtx, err error) {
+	res := &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Failed to purge the data",
+		Description: err.Error(),
+	}
+	reportError(req, err)
+	req.SetStatusCode(http.StatusInternalServerError)
+	sendJSON(req, res)
+}
+
+// DeleteUserData is the handler to delete everything held about a user, e.g. when they ask to be forgotten,
+// responding with the receipt of what was deleted
+func DeleteUserData(req *fasthttp.RequestCtx) {
+	r, err := purgeUserData(req.UserValue("user").(string), requestUser(req), time.Now())
+	if err != nil {
+		sendPurgeError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, r)
+}
+
+// DeleteHistory is the handler to delete the full history of a thermostat, responding with the receipt of
+// what was deleted
+func DeleteHistory(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	r, err := purgeThermostatHistory(t.ID, requestUser(req), time.Now())
+	if err != nil {
+		sendPurgeError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, r)
+}
+
+// GetReceipts is the handler to return the deletion receipts, newest first, with ?subject= narrowing them
+// down to those of user, thermostat or retention
+func GetReceipts(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, receipts.List(string(req.QueryArgs().Peek("subject"))))
+}
+
+// GetReceipt is the handler to return a single deletion receipt
+func GetReceipt(req *fasthttp.RequestCtx) {
+	id, errRes := paramID(req, "receipt")
+	if errRes == nil {
+		if r, ok := receipts.Receipt(id); ok {
+			req.SetStatusCode(http.StatusOK)
+			sendJSON(req, r)
+			return
+		}
+		errRes = &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "No deletion receipt found for id: " + strconv.Itoa(id) + ".",
+		}
+	}
+
+	req.SetStatusCode(errRes.Code)
+	sendJSON(req, errRes)
+}
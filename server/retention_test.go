@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeUserData(t *testing.T) {
+	base := newTestServer(t)
+	now := time.Now()
+
+	if code, _ := putNotifications(base, "alice", `{"types": ["offline"], "channels": [{"type": "webhook", "url": "http://127.0.0.1:1/hook"}]}`, t); code != http.StatusOK {
+		t.Fatalf("failed to set the notification preferences, got %d", code)
+	}
+	if err := installers.Grant(installerGrant{Username: "alice", GrantedAt: now, Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("failed to grant installer access: %s", err)
+	}
+	n := notification{Kind: "alert", Username: "alice"}
+	deliveryLog.add(deliveryLog.reserve(), delivery{n: n}, now, 0, errors.New("unreachable"))
+	deliveryLog.add(deliveryLog.reserve(), delivery{n: notification{Kind: "alert", Username: "bob"}}, now, http.StatusOK, nil)
+	deadLetters.add(&deadLetter{Kind: deadLetterNotification, Target: channelWebhook, Notification: &n})
+	installers.Audit(auditEntry{Time: now, Username: "alice", Role: roleInstaller, Method: "PUT", Path: "/v1/thermostats/1/installation", Status: http.StatusOK})
+	installers.Audit(auditEntry{Time: now, Username: "bob", Role: roleAdmin, Method: "GET", Path: "/v1/admin/diagnostics", Status: http.StatusOK})
+	fired, _ := alerts.fire(eventOffline, 1, severityWarning, "offline", now)
+	alerts.Update(fired.ID, alertAcknowledged, "alice", "on it", now)
+	alerts.Update(fired.ID, "", "bob", "thanks", now)
+	if err := onCall.Set(&onCallRotation{Technicians: []string{"alice", "bob"}, Start: now, Shift: "24h", Override: &onCallOverride{Username: "alice", Until: now.Add(time.Hour)}}); err != nil {
+		t.Fatalf("failed to set the on-call rotation: %s", err)
+	}
+	recording.Start(now.Add(time.Hour))
+	recording.Add(recordedExchange{Time: now, Method: "GET", URI: "/v1/admin/users/alice/notifications"})
+	recording.Add(recordedExchange{Time: now, Method: "GET", URI: "/v1/thermostats"})
+
+	var r deletionReceipt
+	if code := del(base+"/v1/admin/users/alice/data", t, &r); code != http.StatusOK {
+		t.Fatalf("expected the data of the user to be purged, got %d", code)
+	}
+	want := map[string]int{dataNotificationPreferences: 1, dataInstallerGrants: 1, dataNotifications: 2, dataAudit: 1, dataSessions: 0, dataAlerts: 1, dataOnCall: 1, dataRecordings: 1}
+	if r.ID != 1 || r.Subject != purgeUser || r.Target != "alice" || len(r.Deleted) != len(want) {
+		t.Fatalf("expected a receipt of the purge, got %+v", r)
+	}
+	for category, count := range want {
+		if r.Deleted[category] != count {
+			t.Fatalf("expected %d deleted of %s, got %+v", count, category, r.Deleted)
+		}
+	}
+
+	if _, ok := notifications.Prefs("alice"); ok || installers.Active("alice", now) {
+		t.Fatal("expected the preferences and the grant to be gone")
+	}
+	if len(deliveryLog.Deliveries("alice", false)) != 0 || len(deliveryLog.Deliveries("bob", false)) != 1 || len(deadLetters.List("")) != 0 {
+		t.Fatal("expected only the notifications of the user to be gone")
+	}
+	if audit := installers.AuditLog("", ""); len(audit) != 1 || audit[0].Username != "bob" {
+		t.Fatalf("expected only the audit entries of the user to be gone, got %+v", audit)
+	}
+	if a, _ := alerts.Alert(fired.ID); a.AcknowledgedBy != "" || a.Notes[0].Author != "" || a.Notes[0].Text != "on it" || a.Notes[1].Author != "bob" {
+		t.Fatalf("expected the alert to be kept without the user, got %+v", a)
+	}
+	if st, _ := onCall.Status(now); len(st.Technicians) != 1 || st.OnCall != "bob" || st.Override != nil {
+		t.Fatalf("expected the user to be off the rotation, got %+v", st)
+	}
+	for _, e := range recording.Exchanges() {
+		if strings.Contains(e.URI, "/users/alice/notifications") {
+			t.Fatalf("expected the exchanges mentioning the user to be gone, got %+v", e)
+		}
+	}
+	recording.reset()
+
+	// purging again deletes nothing, but still gives a receipt
+	del(base+"/v1/admin/users/alice/data", t, &r)
+	if r.ID != 2 || r.Deleted[dataNotifications] != 0 {
+		t.Fatalf("expected an empty receipt, got %+v", r)
+	}
+
+	var list []deletionReceipt
+	if get(base+"/v1/admin/receipts?subject=user", t, &list); len(list) != 2 || list[0].ID != 2 {
+		t.Fatalf("expected the receipts newest first, got %+v", list)
+	}
+	get(base+"/v1/admin/receipts/1", t, &r)
+	if r.ID != 1 || r.Deleted[dataAudit] != 1 {
+		t.Fatalf("expected the first receipt, got %+v", r)
+	}
+	var errRes errResponse
+	if get(base+"/v1/admin/receipts/9", t, &errRes); errRes.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown receipt to be not found, got %+v", errRes)
+	}
+}
+
+func TestDeleteHistory(t *testing.T) {
+	base := newTestServer(t)
+	now := time.Now()
+
+	records := []runtimeRecord{
+		{Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour), Source: "ecobee", HeatSeconds: 600},
+		{Start: now.Add(-time.Hour), End: now, Source: "ecobee", HeatSeconds: 300},
+	}
+	for _, id := range []int{1, 2} {
+		if _, err := history.Import(id, records); err != nil {
+			t.Fatalf("failed to import the history: %s", err)
+		}
+	}
+	alerts.fire(eventOffline, 1, severityWarning, "offline", now)
+	alerts.clear(eventOffline, 1, now)
+	alerts.fire(eventAnomaly, 1, severityWarning, "spike", now)
+	for _, id := range []string{"1", "2"} {
+		put(base+"/v1/thermostats/"+id, `{"heatSetPoint": 64}`, t)
+	}
+	before, _ := home.Thermostat(1)
+
+	var r deletionReceipt
+	if code := del(base+"/v1/thermostats/1/history", t, &r); code != http.StatusOK {
+		t.Fatalf("expected the history to be purged, got %d", code)
+	}
+	if r.Subject != purgeThermostat || r.Target != "1" || r.Deleted[dataHistory] != 2 || r.Deleted[dataAlerts] != 1 || r.Deleted[dataChanges] == 0 {
+		t.Fatalf("expected a receipt of the purge, got %+v", r)
+	}
+	if len(history.History(1, time.Time{}, time.Time{}).Records) != 0 || len(history.History(2, time.Time{}, time.Time{}).Records) != 2 {
+		t.Fatal("expected only the history of the thermostat to be gone")
+	}
+	if open := alerts.Alerts("", 1, ""); len(open) != 1 || open[0].Type != eventAnomaly {
+		t.Fatalf("expected the open alert to be kept, got %+v", open)
+	}
+	others := 0
+	for _, c := range home.Changes(0) {
+		for _, th := range c.Thermostats {
+			if th.ID == 1 {
+				t.Fatalf("expected the past records of the thermostat to be gone, got %+v", c)
+			}
+			others++
+		}
+	}
+	if others == 0 {
+		t.Fatal("expected the records of the other thermostats to be kept")
+	}
+	if home.Rebuild(); len(home.Cycles(1)) != 0 {
+		t.Fatal("expected no cycles of the thermostat to be known")
+	}
+	if after, _ := home.Thermostat(1); after != before {
+		t.Fatalf("expected the thermostat itself to be kept, got %+v", after)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	newTestServer(t, func(c *config) {
+		c.RetainHistory = 24 * time.Hour
+		c.RetainAudit = time.Hour
+	})
+	now := time.Now()
+
+	history.Import(1, []runtimeRecord{
+		{Start: now.Add(-49 * time.Hour), End: now.Add(-48 * time.Hour), Source: "nest"},
+		{Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour), Source: "nest"},
+	})
+	installers.Audit(auditEntry{Time: now.Add(-2 * time.Hour), Username: "alice", Role: roleAdmin})
+	installers.Audit(auditEntry{Time: now, Username: "alice", Role: roleAdmin})
+	deliveryLog.add(deliveryLog.reserve(), delivery{n: notification{Username: "alice"}}, now.Add(-48*time.Hour), http.StatusOK, nil)
+
+	r, purged, err := applyRetention(now)
+	if err != nil || !purged {
+		t.Fatalf("expected the data past its limit to be deleted, got %v", err)
+	}
+	if r.Subject != purgeRetention || r.Deleted[dataHistory] != 1 || r.Deleted[dataAudit] != 1 {
+		t.Fatalf("expected a receipt of what was deleted, got %+v", r)
+	}
+	if _, ok := r.Deleted[dataNotifications]; ok || len(deliveryLog.Deliveries("alice", false)) != 1 {
+		t.Fatal("expected the notifications without a limit to be kept")
+	}
+	if len(history.History(1, time.Time{}, time.Time{}).Records) != 1 || len(installers.AuditLog("", "")) != 1 {
+		t.Fatal("expected the data within its limit to be kept")
+	}
+
+	if _, purged, _ := applyRetention(now); purged || len(receipts.List("")) != 1 {
+		t.Fatal("expected no receipt when nothing is past its limit")
+	}
+}
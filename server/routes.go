@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+// route is a single endpoint of the api. Routes are shared by the fasthttp and net/http servers, so the path
+// uses the :param syntax of fasthttprouter
+type route struct {
+	group   string
+	method  string
+	path    string
+	handler fasthttp.RequestHandler
+}
+
+// routes returns every endpoint of the api
+func routes() []route {
+	rs := []route{
+		{groupAPI, "GET", "/", Index},
+		{groupAPI, "GET", "/v1/version", HandleRoute(GetVersion)},
+		{groupAPI, "GET", "/v1/thermostats", HandleRoute(GetThermostats)},
+		{groupAPI, "PUT", "/v1/thermostats", HandleRoute(PutThermostats)},
+		{groupAPI, "GET", "/v1/thermostats/:id", HandleStatic("id", map[string]fasthttp.RequestHandler{
+			"search":  HandleRoute(SearchThermostats),
+			"compare": HandleRoute(CompareThermostats),
+		}, HandleRoute(GetThermostat))},
+		{groupAPI, "GET", "/v1/thermostats/:id/:field", HandleStatic("field", map[string]fasthttp.RequestHandler{
+			"comfort":      HandleRoute(GetComfort),
+			"commands":     HandleRoute(GetCommands),
+			"cycles":       HandleRoute(GetCycles),
+			"equipment":    HandleRoute(GetEquipment),
+			"events":       HandleRoute(GetEvents),
+			"history":      HandleRoute(GetHistory),
+			"installation": HandleRoute(GetInstallation),
+			"pairing":      HandleRoute(GetPairing),
+			"plan":         HandleRoute(GetPlan),
+			"qr":           HandleRoute(GetQR),
+			"queued":       HandleRoute(GetQueued),
+			"schedule":     HandleRoute(GetSchedule),
+			"settings":     HandleRoute(GetSettings),
+		}, HandleRoute(GetField))},
+		{groupAPI, "GET", "/v1/thermostats/:id/:field/next", HandleStatic("field", map[string]fasthttp.RequestHandler{
+			"schedule": HandleRoute(GetScheduleNext),
+		}, NotFound)},
+		{groupAPI, "PUT", "/v1/thermostats/:id", HandleStatic("id", map[string]fasthttp.RequestHandler{
+			"order": HandleRoute(PutOrder),
+		}, HandleRoute(PutThermostat))},
+		{groupAPI, "PUT", "/v1/thermostats/:id/maintenance", HandleRoute(PutMaintenance)},
+		{groupAPI, "PUT", "/v1/thermostats/:id/installation", HandleRoute(PutInstallation)},
+		{groupAPI, "PUT", "/v1/thermostats/:id/enabled", HandleRoute(PutEnabled)},
+		{groupAPI, "PUT", "/v1/thermostats/:id/quiet-hours", HandleRoute(PutQuietHours)},
+		{groupAPI, "PUT", "/v1/thermostats/:id/schedule", HandleRoute(PutSchedule)},
+		{groupAPI, "PUT", "/v1/thermostats/:id/sleep", HandleRoute(PutSleep)},
+		{groupAPI, "PUT", "/v1/thermostats/:id/precondition", HandleRoute(PutPrecondition)},
+		{groupAPI, "POST", "/v1/thermostats", HandleRoute(PostThermostat)},
+		{groupAPI, "DELETE", "/v1/thermostats/:id", HandleRoute(DeleteThermostat)},
+		{groupAPI, "GET", "/v1/home/summary", HandleRoute(GetSummary)},
+		{groupAPI, "GET", "/v1/home/config", HandleRoute(GetHomeConfig)},
+		{groupAPI, "PUT", "/v1/home/config", HandleRoute(PutHomeConfig)},
+		{groupAPI, "POST", "/v1/import/:vendor/:kind", HandleRoute(PostImport)},
+		{groupAPI, "POST", "/v1/thermostats/:id/reset", HandleRoute(PostReset)},
+		{groupAPI, "POST", "/v1/thermostats/:id/boost", HandleRoute(PostBoost)},
+		{groupAPI, "POST", "/v1/thermostats/:id/fan-timer", HandleRoute(PostFanTimer)},
+		{groupAPI, "POST", "/v1/thermostats/:id/increment", HandleRoute(PostIncrement)},
+		{groupAPI, "POST", "/v1/thermostats/:id/decrement", HandleRoute(PostDecrement)},
+		{groupAPI, "POST", "/v1/thermostats/:id/simulate", HandleRoute(PostSimulate)},
+		{groupAPI, "POST", "/v1/thermostats/:id/wiring", HandleRoute(PostWiring)},
+		{groupAPI, "DELETE", "/v1/thermostats/:id/:field", HandleStatic("field", map[string]fasthttp.RequestHandler{
+			"boost":        HandleRoute(DeleteBoost),
+			"fan-timer":    HandleRoute(DeleteFanTimer),
+			"history":      HandleRoute(DeleteHistory),
+			"quiet-hours":  HandleRoute(DeleteQuietHours),
+			"sleep":        HandleRoute(DeleteSleep),
+			"precondition": HandleRoute(DeletePrecondition),
+			"overrides":    HandleRoute(DeleteOverrides),
+			"queued":       HandleRoute(DeleteQueued),
+		}, HandleRoute(DeleteField))},
+		{groupAPI, "GET", "/v1/buildings", HandleRoute(GetBuildings)},
+		{groupAPI, "GET", "/v1/buildings/:building", HandleRoute(GetSite)},
+		{groupAPI, "PUT", "/v1/buildings/:building", HandleRoute(PutSite)},
+		{groupAPI, "GET", "/v1/buildings/:building/floors/:floor", HandleRoute(GetSite)},
+		{groupAPI, "PUT", "/v1/buildings/:building/floors/:floor", HandleRoute(PutSite)},
+		{groupAPI, "GET", "/v1/buildings/:building/floors/:floor/rooms/:room", HandleRoute(GetSite)},
+		{groupAPI, "PUT", "/v1/buildings/:building/floors/:floor/rooms/:room", HandleRoute(PutSite)},
+		{groupAPI, "GET", "/v1/groups", HandleRoute(GetGroups)},
+		{groupAPI, "GET", "/v1/groups/:group", HandleRoute(GetGroup)},
+		{groupAPI, "PUT", "/v1/groups/:group", HandleRoute(PutGroup)},
+		{groupAPI, "DELETE", "/v1/groups/:group", HandleRoute(DeleteGroup)},
+		{groupAPI, "GET", "/v1/jobs/:job", HandleRoute(GetJob)},
+
+		// scheduled actions
+		{groupAPI, "GET", "/v1/actions", HandleRoute(GetActions)},
+		{groupAPI, "POST", "/v1/actions", HandleRoute(PostAction)},
+		{groupAPI, "GET", "/v1/actions/:action", HandleStatic("action", map[string]fasthttp.RequestHandler{
+			"preview": HandleRoute(GetActionPreview),
+		}, HandleRoute(GetAction))},
+		{groupAPI, "DELETE", "/v1/actions/:action", HandleRoute(DeleteAction)},
+		{groupAPI, "GET", "/v1/holidays", HandleRoute(GetHolidays)},
+		{groupAPI, "PUT", "/v1/holidays", HandleRoute(PutHolidays)},
+		{groupAPI, "PUT", "/v1/holidays/:date", HandleRoute(PutHoliday)},
+		{groupAPI, "DELETE", "/v1/holidays/:date", HandleRoute(DeleteHoliday)},
+
+		// alerts, the windows they are suppressed in and who is notified of them
+		{groupAPI, "GET", "/v1/alerts", HandleRoute(GetAlerts)},
+		{groupAPI, "GET", "/v1/alerts/:alert", HandleRoute(GetAlert)},
+		{groupAPI, "POST", "/v1/alerts/:alert/acknowledge", HandleRoute(PostAcknowledge)},
+		{groupAPI, "POST", "/v1/alerts/:alert/resolve", HandleRoute(PostResolve)},
+		{groupAPI, "POST", "/v1/alerts/:alert/notes", HandleRoute(PostAlertNote)},
+		{groupAPI, "GET", "/v1/suppressions", HandleRoute(GetSuppressions)},
+		{groupAPI, "POST", "/v1/suppressions", HandleRoute(PostSuppression)},
+		{groupAPI, "DELETE", "/v1/suppressions/:suppression", HandleRoute(DeleteSuppression)},
+		{groupAPI, "GET", "/v1/oncall", HandleRoute(GetOnCall)},
+		{groupAPI, "PUT", "/v1/oncall", HandleRoute(PutOnCall)},
+		{groupAPI, "DELETE", "/v1/oncall", HandleRoute(DeleteOnCall)},
+		{groupAPI, "POST", "/v1/oncall/override", HandleRoute(PostOnCallOverride)},
+		{groupAPI, "DELETE", "/v1/oncall/override", HandleRoute(DeleteOnCallOverride)},
+		{groupAPI, "POST", "/v1/oncall/handoff", HandleRoute(PostOnCallHandoff)},
+		{groupAPI, "GET", "/v1/notifications/:user", HandleRoute(GetNotifications)},
+		{groupAPI, "PUT", "/v1/notifications/:user", HandleRoute(PutNotifications)},
+		{groupAPI, "DELETE", "/v1/notifications/:user", HandleRoute(DeleteNotifications)},
+		{groupAPI, "GET", "/v1/notifications/:user/deliveries", HandleRoute(GetDeliveries)},
+		{groupAPI, "POST", "/v1/notifications/:user/deliveries/:delivery/redeliver", HandleRoute(PostRedeliver)},
+
+		// pairing of devices, which are authenticated by the token of the qr code they were scanned from
+		{groupAPI, "POST", "/v1/pair", PostPair},
+
+		// chat bots, which are authenticated by the chat platform rather than an access token
+		{groupAPI, "POST", "/v1/chat/telegram", PostTelegram},
+		{groupAPI, "POST", "/v1/chat/discord", PostDiscord},
+
+		// the ifttt service api, which is authenticated by the ifttt service key
+		{groupAPI, "GET", "/ifttt/v1/status", HandleIFTTT(GetIFTTTStatus)},
+		{groupAPI, "POST", "/ifttt/v1/test/setup", HandleIFTTT(PostIFTTTTestSetup)},
+		{groupAPI, "POST", "/ifttt/v1/triggers/:trigger", HandleIFTTT(PostIFTTTTrigger)},
+		{groupAPI, "DELETE", "/ifttt/v1/triggers/:trigger/trigger_identity/:identity", HandleIFTTT(DeleteIFTTTTrigger)},
+		{groupAPI, "POST", "/ifttt/v1/actions/:action", HandleIFTTT(PostIFTTTAction)},
+
+		// clustering
+		{groupAPI, "GET", "/v1/cluster/status", HandleRoute(GetClusterStatus)},
+
+		// probes and monitoring, which must stay reachable without an access token
+		{groupAPI, "GET", "/readyz", GetReadyz},
+		{groupAdmin, "GET", "/metrics", GetMetrics},
+
+		// administration
+		{groupAdmin, "GET", "/v1/admin/readonly", HandleRoute(GetReadOnly)},
+		{groupAdmin, "PUT", "/v1/admin/readonly", HandleRoute(PutReadOnly)},
+		{groupAdmin, "GET", "/v1/admin/config", HandleRoute(GetConfig)},
+		{groupAdmin, "GET", "/v1/admin/secrets", HandleRoute(GetSecrets)},
+		{groupAdmin, "GET", "/v1/admin/changes", HandleRoute(GetChanges)},
+		{groupAdmin, "GET", "/v1/admin/installers", HandleRoute(GetInstallers)},
+		{groupAdmin, "POST", "/v1/admin/installers", HandleRoute(PostInstaller)},
+		{groupAdmin, "DELETE", "/v1/admin/installers/:user", HandleRoute(DeleteInstaller)},
+		{groupAdmin, "GET", "/v1/admin/audit", HandleRoute(GetAudit)},
+		{groupAdmin, "GET", "/v1/admin/diagnostics", HandleRoute(GetDiagnostics)},
+		{groupAdmin, "DELETE", "/v1/admin/users/:user/data", HandleRoute(DeleteUserData)},
+		{groupAdmin, "GET", "/v1/admin/receipts", HandleRoute(GetReceipts)},
+		{groupAdmin, "GET", "/v1/admin/receipts/:receipt", HandleRoute(GetReceipt)},
+		{groupAdmin, "GET", "/v1/admin/loglevel", HandleRoute(GetLogLevel)},
+		{groupAdmin, "PUT", "/v1/admin/loglevel", HandleRoute(PutLogLevel)},
+		{groupAdmin, "GET", "/v1/admin/recording", HandleRoute(GetRecording)},
+		{groupAdmin, "PUT", "/v1/admin/recording", HandleRoute(PutRecording)},
+		{groupAdmin, "DELETE", "/v1/admin/recording", HandleRoute(DeleteRecording)},
+		{groupAdmin, "GET", "/v1/admin/recording/exchanges", HandleRoute(GetRecordedExchanges)},
+		{groupAdmin, "POST", "/v1/admin/recording/replay", HandleRoute(PostReplay)},
+		{groupAdmin, "GET", "/v1/admin/dlq", HandleRoute(GetDeadLetters)},
+		{groupAdmin, "DELETE", "/v1/admin/dlq", HandleRoute(DeleteDeadLetters)},
+		{groupAdmin, "GET", "/v1/admin/dlq/:letter", HandleRoute(GetDeadLetter)},
+		{groupAdmin, "DELETE", "/v1/admin/dlq/:letter", HandleRoute(DeleteDeadLetter)},
+		{groupAdmin, "POST", "/v1/admin/dlq/:letter/redrive", HandleRoute(PostRedrive)},
+
+		// json-rpc 2.0, over http or a websocket
+		{groupAPI, "POST", "/v1/rpc", PostRPC},
+		{groupAPI, "GET", "/v1/rpc", GetRPC},
+
+		// session management, which must stay reachable without an access token
+		{groupAuth, "POST", "/v1/auth/login", PostLogin},
+		{groupAuth, "POST", "/v1/auth/refresh", PostRefresh},
+		{groupAuth, "POST", "/v1/auth/logout", PostLogout},
+	}
+
+	// chaos testing, which must never be reachable in production
+	if cfg.Chaos {
+		rs = append(rs,
+			route{groupAdmin, "GET", "/v1/admin/chaos", HandleRoute(GetChaos)},
+			route{groupAdmin, "PUT", "/v1/admin/chaos", HandleRoute(PutChaos)},
+			route{groupAdmin, "POST", "/v1/admin/chaos/thermostats/:id/spike", HandleRoute(PostSpike)},
+			route{groupAdmin, "PUT", "/v1/admin/chaos/thermostats/:id/offline", HandleRoute(PutOffline)},
+		)
+	}
+
+	// the fleet of sites syncing to this central instance, and the sync stream of this site as an agent
+	if cfg.SyncListen != "" {
+		rs = append(rs,
+			route{groupAPI, "GET", "/v1/fleet", HandleRoute(GetFleet)},
+			route{groupAPI, "GET", "/v1/fleet/:site", HandleRoute(GetFleetSite)},
+		)
+	}
+	if cfg.SyncCentral != "" {
+		rs = append(rs, route{groupAdmin, "GET", "/v1/admin/sync", HandleRoute(GetSync)})
+	}
+
+	// the virtual clock, for demos and tests of schedules
+	if cfg.VirtualClock {
+		rs = append(rs,
+			route{groupAdmin, "GET", "/v1/admin/clock", HandleRoute(GetClock)},
+			route{groupAdmin, "PUT", "/v1/admin/clock", HandleRoute(PutClock)},
+			route{groupAdmin, "DELETE", "/v1/admin/clock", HandleRoute(DeleteClock)},
+			route{groupAdmin, "POST", "/v1/admin/clock/advance", HandleRoute(PostAdvance)},
+		)
+	}
+
+	return rs
+}
+
+// newRouter builds the fasthttp router serving the routes of the listener
+func newRouter(l listenerSpec) *fasthttprouter.Router {
+	r := fasthttprouter.New()
+	r.PanicHandler = handlePanic
+	r.MethodNotAllowed = MethodNotAllowed
+
+	for _, rt := range routes() {
+		if l.serves(rt.group) {
+			r.Handle(rt.method, rt.path, l.middleware(rt.handler))
+		}
+	}
+
+	return r
+}
+
+// inProcessRouter is the router requestAs serves the requests of the integrations with. It's built on first
+// use rather than for every request, and dropped when the server starts over, as the routes depend on the
+// configuration
+type inProcessRouter struct {
+	sync.Mutex
+	router *fasthttprouter.Router
+}
+
+var integrationRouter = &inProcessRouter{}
+
+// Handler returns the handler of the router, building it first if it isn't yet
+func (r *inProcessRouter) Handler() fasthttp.RequestHandler {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.router == nil {
+		// the route itself doesn't authenticate, the integration authenticated the user
+		r.router = newRouter(listenerSpec{NoAuth: true})
+	}
+	return r.router.Handler
+}
+
+// reset drops the router, so the next request builds it from the current configuration
+func (r *inProcessRouter) reset() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.router = nil
+}
+
+// requestAs makes the api request in-process as the user, decoding a successful response into v if given,
+// so integrations are held to exactly the same checks as a request made with the token of the user. It
+// returns the status of the response, which is any 2xx when it succeeds, e.g. 202 when an update of an
+// offline thermostat was queued. When it fails the returned message is the reason why
+func requestAs(username, method, path string, body, v interface{}) (int, string, bool) {
+	var req fasthttp.RequestCtx
+	req.Request.Header.SetMethod(method)
+	req.Request.SetRequestURI(path)
+	if body != nil {
+		jsn, err := json.Marshal(body)
+		if err != nil {
+			return 0, err.Error(), false
+		}
+		req.Request.SetBody(jsn)
+	}
+	req.SetUserValue(usernameKey, username)
+
+	integrationRouter.Handler()(&req)
+
+	status := req.Response.StatusCode()
+	if status < http.StatusOK || status >= http.StatusMultipleChoices {
+		var errRes errResponse
+		if err := json.Unmarshal(req.Response.Body(), &errRes); err != nil || errRes.Description == "" {
+			return status, "The request failed with status " + strconv.Itoa(status) + ".", false
+		}
+		return status, errRes.Msg + ": " + errRes.Description, false
+	}
+	if v == nil {
+		return status, "", true
+	}
+	if err := json.Unmarshal(req.Response.Body(), v); err != nil {
+		return status, err.Error(), false
+	}
+	return status, "", true
+}
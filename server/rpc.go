@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+)
+
+// rpcRequest is a single JSON-RPC 2.0 call sent in through the api @ /v1/rpc. A call without an id is a
+// notification and gets no response
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcResponse is the JSON-RPC 2.0 response to a single call
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcError is the JSON-RPC 2.0 error object. Errors the rest of the api would respond with are carried in
+// the data member
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcNotification is sent to websocket clients for every event they subscribed to
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  event  `json:"params"`
+}
+
+// rpcThermostatParams are the params of the calls that target a single thermostat
+type rpcThermostatParams struct {
+	ID int `json:"id"`
+}
+
+// rpcUpdateParams are the params of updateThermostat, the id of the thermostat along with its desired state
+type rpcUpdateParams struct {
+	ID int `json:"id"`
+	updateThermostat
+}
+
+const (
+	rpcVersion = "2.0"
+
+	// error codes defined by the JSON-RPC 2.0 spec
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+
+	// rpcWriteTimeout bounds how long a slow websocket client can hold up a response or notification
+	rpcWriteTimeout = 10 * time.Second
+)
+
+// rpcSubscriber is a websocket connection to /v1/rpc. Writes are serialized so event notifications never
+// interleave with responses
+type rpcSubscriber struct {
+	sync.Mutex
+	conn *websocket.Conn
+}
+
+// send writes v to the websocket as a single json message
+func (s *rpcSubscriber) send(v interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(rpcWriteTimeout))
+	return s.conn.WriteJSON(v)
+}
+
+// rpcHub forwards events to every websocket connection that has subscribed to them. The value of each
+// subscriber is the id of the thermostat it subscribed to, or 0 for every thermostat
+type rpcHub struct {
+	sync.Mutex
+	subscribers map[*rpcSubscriber]int
+}
+
+var rpcSubscribers = &rpcHub{subscribers: make(map[*rpcSubscriber]int)}
+
+// subscribe starts forwarding events about the thermostat, or every thermostat when id is 0
+func (h *rpcHub) subscribe(s *rpcSubscriber, id int) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.subscribers[s] = id
+}
+
+// unsubscribe stops forwarding events to the subscriber
+func (h *rpcHub) unsubscribe(s *rpcSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.subscribers, s)
+}
+
+// Publish implements the publisher interface
+func (h *rpcHub) Publish(e event) error {
+	h.Lock()
+	subscribers := make(map[*rpcSubscriber]int, len(h.subscribers))
+	for s, id := range h.subscribers {
+		subscribers[s] = id
+	}
+	h.Unlock()
+
+	note := rpcNotification{
+		JSONRPC: rpcVersion,
+		Method:  "event",
+		Params:  e,
+	}
+
+	for s, id := range subscribers {
+		if id != 0 && id != e.ID {
+			continue
+		}
+		if err := s.send(note); err != nil {
+			log.Println("failed to send", e.Type, "event to rpc subscriber with error:", err)
+		}
+	}
+
+	return nil
+}
+
+// serverError wraps an error the rest of the api would respond with
+func serverError(errRes *errResponse) *rpcError {
+	return &rpcError{
+		Code:    rpcServerError,
+		Message: errRes.Msg,
+		Data:    errRes,
+	}
+}
+
+// decodeParams unmarshals the params of the call into v. Only params by-name are supported
+func decodeParams(call rpcRequest, v interface{}) *rpcError {
+	if len(call.Params) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(call.Params, v); err != nil {
+		return &rpcError{
+			Code:    rpcInvalidParams,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		}
+	}
+
+	return nil
+}
+
+// invokeRPC runs the method of the call. username is who the call was authenticated as, if anyone, and sub
+// the websocket the call came in on, or nil for http
+func invokeRPC(call rpcRequest, username string, sub *rpcSubscriber) (interface{}, *rpcError) {
+	switch call.Method {
+	case "listThermostats":
+		therms := home.Thermostats()
+		if therms == nil {
+			// a successful response must always carry a result
+			therms = []*thermostat{}
+		}
+		return therms, nil
+
+	case "getThermostat":
+		var params rpcThermostatParams
+		if rpcErr := decodeParams(call, &params); rpcErr != nil {
+			return nil, rpcErr
+		}
+
+		t, errRes := home.Thermostat(params.ID)
+		if errRes != nil {
+			return nil, serverError(errRes)
+		}
+		return t, nil
+
+	case "updateThermostat":
+		var params rpcUpdateParams
+		if rpcErr := decodeParams(call, &params); rpcErr != nil {
+			return nil, rpcErr
+		}
+
+		// run the same checks as a PUT so nothing can be written that the api wouldn't accept
+		if errRes := checkReadOnly(); errRes != nil {
+			return nil, serverError(errRes)
+		}
+		if errRes := checkLeader(); errRes != nil {
+			return nil, serverError(errRes)
+		}
+		target, errRes := home.Thermostat(params.ID)
+		if errRes != nil {
+			return nil, serverError(errRes)
+		}
+		if errRes := validateData(params.updateThermostat); errRes != nil {
+			return nil, &rpcError{
+				Code:    rpcInvalidParams,
+				Message: errRes.Msg,
+				Data:    errRes,
+			}
+		}
+		if errRes := checkUserRange(username, params.HeatSetPoint, params.CoolSetPoint); errRes != nil {
+			return nil, serverError(errRes)
+		}
+		if errRes := checkDisabled(target, params.updateThermostat); errRes != nil {
+			return nil, serverError(errRes)
+		}
+
+		updated, err := home.UpdateThermostat(target, params.updateThermostat)
+		if err != nil {
+			return nil, serverError(commitError(err))
+		}
+		return updated, nil
+
+	case "subscribe":
+		if sub == nil {
+			return nil, &rpcError{
+				Code:    rpcServerError,
+				Message: "Subscriptions require a websocket",
+				Data:    "Open a websocket to /v1/rpc to subscribe to events.",
+			}
+		}
+
+		var params rpcThermostatParams
+		if rpcErr := decodeParams(call, &params); rpcErr != nil {
+			return nil, rpcErr
+		}
+		if params.ID != 0 {
+			if _, errRes := home.Thermostat(params.ID); errRes != nil {
+				return nil, serverError(errRes)
+			}
+		}
+
+		rpcSubscribers.subscribe(sub, params.ID)
+		return true, nil
+	}
+
+	return nil, &rpcError{
+		Code:    rpcMethodNotFound,
+		Message: "Method not found",
+		Data:    "Valid methods are: 'getThermostat', 'listThermostats', 'updateThermostat' and 'subscribe'.",
+	}
+}
+
+// callRPC runs a single call and returns its response, or nil for a notification
+func callRPC(raw []byte, username string, sub *rpcSubscriber) *rpcResponse {
+	var call rpcRequest
+	if err := json.Unmarshal(raw, &call); err != nil {
+		code, msg := rpcInvalidRequest, "Invalid Request"
+		if !json.Valid(raw) {
+			code, msg = rpcParseError, "Parse error"
+		}
+		return &rpcResponse{
+			JSONRPC: rpcVersion,
+			Error:   &rpcError{Code: code, Message: msg, Data: err.Error()},
+		}
+	}
+
+	if call.JSONRPC != rpcVersion || call.Method == "" {
+		return &rpcResponse{
+			JSONRPC: rpcVersion,
+			Error:   &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request"},
+			ID:      call.ID,
+		}
+	}
+
+	result, rpcErr := invokeRPC(call, username, sub)
+	if call.ID == nil {
+		return nil
+	}
+
+	res := &rpcResponse{
+		JSONRPC: rpcVersion,
+		ID:      call.ID,
+	}
+	if rpcErr != nil {
+		res.Error = rpcErr
+	} else {
+		res.Result = result
+	}
+
+	return res
+}
+
+// handleRPC runs a single call or a batch of calls and returns what should be sent back, or nil when
+// there is nothing to send because every call was a notification
+func handleRPC(body []byte, username string, sub *rpcSubscriber) interface{} {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		if res := callRPC(body, username, sub); res != nil {
+			return res
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return &rpcResponse{
+			JSONRPC: rpcVersion,
+			Error:   &rpcError{Code: rpcParseError, Message: "Parse error", Data: err.Error()},
+		}
+	}
+	if len(batch) == 0 {
+		return &rpcResponse{
+			JSONRPC: rpcVersion,
+			Error:   &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request", Data: "The batch is empty."},
+		}
+	}
+
+	var responses []*rpcResponse
+	for _, raw := range batch {
+		if res := callRPC(raw, username, sub); res != nil {
+			responses = append(responses, res)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+
+	return responses
+}
+
+// PostRPC is the handler for JSON-RPC 2.0 calls over http
+func PostRPC(req *fasthttp.RequestCtx) {
+	var username string
+	if requiresAuth(req) {
+		var errRes *errResponse
+		if username, errRes = authorize(req); errRes != nil {
+			req.SetStatusCode(http.StatusUnauthorized)
+			sendJSON(req, errRes)
+			return
+		}
+	}
+
+	res := handleRPC(req.PostBody(), username, nil)
+	if res == nil {
+		req.SetStatusCode(http.StatusNoContent)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, res)
+}
+
+var rpcUpgrader = websocket.FastHTTPUpgrader{}
+
+// GetRPC is the handler to open a websocket for JSON-RPC 2.0 calls, which also allows subscribing to events
+func GetRPC(req *fasthttp.RequestCtx) {
+	var username string
+	if requiresAuth(req) {
+		var errRes *errResponse
+		if username, errRes = authorize(req); errRes != nil {
+			req.SetStatusCode(http.StatusUnauthorized)
+			sendJSON(req, errRes)
+			return
+		}
+	}
+
+	err := rpcUpgrader.Upgrade(req, func(conn *websocket.Conn) {
+		sub := &rpcSubscriber{conn: conn}
+		defer rpcSubscribers.unsubscribe(sub)
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if res := handleRPC(msg, username, sub); res != nil {
+				if err := sub.send(res); err != nil {
+					log.Println("failed to send rpc response with error:", err)
+					return
+				}
+			}
+		}
+	})
+	if err != nil {
+		log.Println("failed to open rpc websocket with error:", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestRPCBatch(t *testing.T) {
+	base := newTestServer(t)
+	batch := `[
+		{"jsonrpc": "2.0", "method": "getThermostat", "params": {"id": 1}, "id": 1},
+		{"jsonrpc": "2.0", "method": "listThermostats"},
+		{"jsonrpc": "2.0", "method": "getThermostat", "params": {"id": 999}, "id": 2},
+		{"jsonrpc": "2.0", "method": "setThermostat", "id": 3}
+	]`
+
+	resp, err := http.Post(base+"/v1/rpc", "application/json", bytes.NewBufferString(batch))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var responses []struct {
+		Result *thermostat `json:"result"`
+		Error  *rpcError   `json:"error"`
+		ID     int         `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		t.Fatalf("failed to decode batch response: %s", err)
+	}
+
+	// the notification must not get a response
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses, got %d", len(responses))
+	}
+	if responses[0].ID != 1 || responses[0].Result == nil || responses[0].Result.ID != 1 {
+		t.Fatalf("expected thermostat 1 in response to call 1, got %+v", responses[0])
+	}
+	if responses[1].ID != 2 || responses[1].Error == nil || responses[1].Error.Code != rpcServerError {
+		t.Fatalf("expected a server error in response to call 2, got %+v", responses[1])
+	}
+	if responses[2].ID != 3 || responses[2].Error == nil || responses[2].Error.Code != rpcMethodNotFound {
+		t.Fatalf("expected method not found in response to call 3, got %+v", responses[2])
+	}
+}
+
+func TestRPCSubscribe(t *testing.T) {
+	base := newTestServer(t)
+	id, _ := home.AddThermostat(updateThermostat{Name: "Attic Thermostat"})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/v1/rpc", nil)
+	if err != nil {
+		t.Fatalf("failed to open rpc websocket: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var res rpcResponse
+	if err := conn.WriteJSON(json.RawMessage(`{"jsonrpc": "2.0", "method": "subscribe", "params": {"id": ` + strconv.Itoa(id) + `}, "id": 1}`)); err != nil {
+		t.Fatalf("failed to send subscribe call: %s", err)
+	}
+	if err := conn.ReadJSON(&res); err != nil || res.Error != nil {
+		t.Fatalf("failed to subscribe: %v %+v", err, res.Error)
+	}
+
+	if err := conn.WriteJSON(json.RawMessage(`{"jsonrpc": "2.0", "method": "updateThermostat", "params": {"id": ` + strconv.Itoa(id) + `, "fan": "on"}}`)); err != nil {
+		t.Fatalf("failed to send update notification: %s", err)
+	}
+
+	var note rpcNotification
+	if err := conn.ReadJSON(&note); err != nil {
+		t.Fatalf("failed to read event notification: %s", err)
+	}
+	if note.Method != "event" || note.Params.Type != eventChange || note.Params.ID != id || note.Params.Thermostat.FanMode != "on" {
+		t.Fatalf("expected a change event for thermostat %d, got %+v", id, note)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+// safetyAction describes a safety limit that was just activated or deactivated on a thermostat
+type safetyAction struct {
+	Severity string
+	Detail   string
+}
+
+// applySafetyLimits enforces the safety limits on the new state of a thermostat, those of its installation or
+// else the configured ones, overriding whatever mode or setpoints were asked for. It returns the safety
+// action when a limit was just activated or deactivated, or nil. previous is nil for newly added thermostats
+func applySafetyLimits(previous, updated *thermostat) *safetyAction {
+	var action *safetyAction
+	freezeProtectTemp, overheatProtectTemp := safetyLimits(updated.ID)
+
+	switch {
+	// freeze protection forces the heat on below the floor so pipes can't freeze, regardless of mode
+	case freezeProtectTemp > 0 && updated.CurrentTemp < freezeProtectTemp:
+		updated.OperatingMode = "heat"
+		if updated.HeatSetPoint < freezeProtectTemp {
+			updated.HeatSetPoint = freezeProtectTemp
+		}
+		updated.FreezeProtection = true
+
+		if previous == nil || !previous.FreezeProtection {
+			action = &safetyAction{
+				Severity: severityWarning,
+				Detail: "Freeze protection activated: temperature " + strconv.Itoa(updated.CurrentTemp) +
+					" is below the safety floor of " + strconv.Itoa(freezeProtectTemp) + " degrees Fahrenheit, forcing heat on.",
+			}
+		}
+
+	// overheat protection either forces cooling or shuts the equipment down above the ceiling, regardless
+	// of mode
+	case overheatProtectTemp > 0 && updated.CurrentTemp > overheatProtectTemp:
+		if cfg.OverheatAction == "off" {
+			updated.OperatingMode = "off"
+			updated.FanMode = "auto"
+		} else {
+			updated.OperatingMode = "cool"
+			if updated.CoolSetPoint > overheatProtectTemp {
+				updated.CoolSetPoint = overheatProtectTemp
+			}
+		}
+		updated.OverheatProtection = true
+
+		if previous == nil || !previous.OverheatProtection {
+			action = &safetyAction{
+				Severity: severityCritical,
+				Detail: "Overheat protection activated: temperature " + strconv.Itoa(updated.CurrentTemp) +
+					" is above the safety ceiling of " + strconv.Itoa(overheatProtectTemp) + " degrees Fahrenheit, setting mode to " + updated.OperatingMode + ".",
+			}
+		}
+	}
+
+	if action == nil && previous != nil {
+		if previous.FreezeProtection && !updated.FreezeProtection {
+			action = &safetyAction{
+				Severity: severityInfo,
+				Detail:   "Freeze protection deactivated: temperature " + strconv.Itoa(updated.CurrentTemp) + " is back above the safety floor.",
+			}
+		} else if previous.OverheatProtection && !updated.OverheatProtection {
+			action = &safetyAction{
+				Severity: severityInfo,
+				Detail:   "Overheat protection deactivated: temperature " + strconv.Itoa(updated.CurrentTemp) + " is back below the safety ceiling.",
+			}
+		}
+	}
+
+	if action != nil {
+		log.Println(action.Severity, "- thermostat", updated.ID, "-", action.Detail)
+	}
+
+	return action
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestFreezeProtection(t *testing.T) {
+	id, _ := home.AddThermostat(updateThermostat{Name: "Cabin Thermostat", OperatingMode: "off"})
+	target, _ := home.Thermostat(id)
+
+	// dropping both setpoints brings the temperature down to 32, below the default floor of 40
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "off", CoolSetPoint: 32, HeatSetPoint: 32})
+
+	th, _ := home.Thermostat(id)
+	if !th.FreezeProtection {
+		t.Fatal("expected freeze protection to be active")
+	}
+	if th.OperatingMode != "heat" {
+		t.Fatalf("expected freeze protection to force mode %s, got %s", "heat", th.OperatingMode)
+	}
+	if th.HeatSetPoint != cfg.FreezeProtectTemp {
+		t.Fatalf("expected heat set point to be raised to %d, got %d", cfg.FreezeProtectTemp, th.HeatSetPoint)
+	}
+
+	// once the temperature is back above the floor the protection turns off again
+	home.UpdateThermostat(th, updateThermostat{CoolSetPoint: 72, HeatSetPoint: 68})
+
+	th, _ = home.Thermostat(id)
+	if th.FreezeProtection {
+		t.Fatal("expected freeze protection to be inactive above the floor")
+	}
+}
+
+func TestOverheatProtection(t *testing.T) {
+	id, _ := home.AddThermostat(updateThermostat{Name: "Server Room Thermostat", OperatingMode: "heat"})
+	target, _ := home.Thermostat(id)
+
+	// raising both setpoints brings the temperature up to 96, above the default ceiling of 90
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", CoolSetPoint: 96, HeatSetPoint: 96})
+
+	th, _ := home.Thermostat(id)
+	if !th.OverheatProtection {
+		t.Fatal("expected overheat protection to be active")
+	}
+	if th.OperatingMode != "cool" {
+		t.Fatalf("expected overheat protection to force mode %s, got %s", "cool", th.OperatingMode)
+	}
+	if th.CoolSetPoint != cfg.OverheatProtectTemp {
+		t.Fatalf("expected cool set point to be lowered to %d, got %d", cfg.OverheatProtectTemp, th.CoolSetPoint)
+	}
+
+	action := applySafetyLimits(th, &thermostat{ID: id, CurrentTemp: 70})
+	if action == nil || action.Severity != severityInfo {
+		t.Fatal("expected overheat protection to be reported as deactivated below the ceiling")
+	}
+}
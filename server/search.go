@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// matchScore ranks how well the value matches the lower cased query: an exact match ranks highest, then a
+// prefix, then the prefix of a word and finally a substring. 0 means no match
+func matchScore(value, query string) int {
+	value = strings.ToLower(value)
+
+	switch {
+	case value == query:
+		return 4
+	case strings.HasPrefix(value, query):
+		return 3
+	case strings.Contains(value, " "+query):
+		return 2
+	case strings.Contains(value, query):
+		return 1
+	}
+	return 0
+}
+
+// searchScore ranks how well the thermostat matches the lower cased query. Matches on the name outrank
+// matches on a tag of the same kind
+func searchScore(t *thermostat, query string) int {
+	score := matchScore(t.Name, query) * 2
+	for _, tag := range t.Tags {
+		if s := matchScore(tag, query)*2 - 1; s > score {
+			score = s
+		}
+	}
+	return score
+}
+
+// SearchThermostats is the handler to find thermostats whose name or tags match ?q=, best matches first
+func SearchThermostats(req *fasthttp.RequestCtx) {
+	query := strings.ToLower(strings.TrimSpace(string(req.QueryArgs().Peek("q"))))
+	if query == "" {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Query Required",
+			Description: "A search query must be given with ?q=.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	scores := make(map[int]int)
+	matches := []*thermostat{}
+	for _, t := range home.Thermostats() {
+		if score := searchScore(t, query); score > 0 {
+			scores[t.ID] = score
+			matches = append(matches, t)
+		}
+	}
+
+	// equally good matches stay in display order
+	sort.SliceStable(matches, func(i, j int) bool {
+		return scores[matches[i].ID] > scores[matches[j].ID]
+	})
+
+	req.SetStatusCode(http.StatusOK)
+	sendThermostats(req, matches)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSearchThermostats(t *testing.T) {
+	base := newTestServer(t)
+	study, _ := home.AddThermostat(updateThermostat{Name: "Study"})
+	guest, _ := home.AddThermostat(updateThermostat{Name: "Guest Study"})
+	library, _ := home.AddThermostat(updateThermostat{Name: "Library", Tags: []string{"study-room"}})
+
+	var therms []*thermostat
+	get(base+"/v1/thermostats/search?q=STUDY", t, &therms)
+	if len(therms) != 3 {
+		t.Fatalf("expected 3 matches, got %d", len(therms))
+	}
+	// a name starting with the query outranks a tag starting with it, which outranks a word within a name
+	if therms[0].ID != study || therms[1].ID != library || therms[2].ID != guest {
+		t.Fatalf("expected thermostats %d, %d and %d in rank order, got %d, %d and %d", study, library, guest, therms[0].ID, therms[1].ID, therms[2].ID)
+	}
+}
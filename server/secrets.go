@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// liveSecrets are the secrets read every time they're used, so a rotated value takes effect straight away.
+// The others are handed to their clients at startup, so a rotated value only takes effect on restart
+var liveSecrets = []string{"slack-token", "telegram-token", "telegram-secret", "ifttt-service-key", "sync-token"}
+
+// secretsClient loads the secrets from vault or aws secrets manager
+var secretsClient = &http.Client{Timeout: 10 * time.Second}
+
+// secretsManagerEndpoint is where aws secrets manager is reached, {region} being the region of the secret
+var secretsManagerEndpoint = "https://secretsmanager.{region}.amazonaws.com/"
+
+// secretFields returns the settings of the configuration that can be loaded from a secret, by the name of
+// their flag, which is what the values of the secret are named after
+func (c *config) secretFields() map[string]*string {
+	return map[string]*string{
+		"influx-token":      &c.InfluxToken,
+		"sentry-dsn":        &c.SentryDSN,
+		"replica-password":  &c.ReplicaPassword,
+		"sync-token":        &c.SyncToken,
+		"slack-token":       &c.SlackToken,
+		"telegram-token":    &c.TelegramToken,
+		"telegram-secret":   &c.TelegramSecret,
+		"ifttt-service-key": &c.IFTTTServiceKey,
+		"amqp-url":          &c.AMQPURL,
+		"nats-url":          &c.NATSURL,
+	}
+}
+
+// secretSource is somewhere the secrets are loaded from. Fetch returns the values of the secret by the
+// name of the flag they set, along with the version of the secret
+type secretSource interface {
+	Name() string
+	Fetch() (map[string]string, string, error)
+}
+
+// newSecretSource returns where the configuration loads its secrets from, nil when they come from their
+// flags
+func newSecretSource(c config) (secretSource, error) {
+	switch {
+	case c.VaultAddr != "" && c.AWSSecretID != "":
+		return nil, errors.New("only one of -vault-addr and -aws-secret-id can be used")
+	case c.VaultAddr != "":
+		token := c.VaultToken
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		if token == "" {
+			return nil, errors.New("-vault-addr needs -vault-token, or VAULT_TOKEN to be set")
+		}
+		return vaultSource{addr: strings.TrimRight(c.VaultAddr, "/"), token: token, path: strings.Trim(c.VaultSecret, "/")}, nil
+	case c.AWSSecretID != "":
+		region := c.AWSSecretRegion
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			return nil, errors.New("-aws-secret-id needs -aws-secret-region, or AWS_REGION to be set")
+		}
+		creds := awsCredentials{
+			accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+			return nil, errors.New("-aws-secret-id needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+		}
+		return awsSecretSource{id: c.AWSSecretID, region: region, creds: creds}, nil
+	}
+	return nil, nil
+}
+
+// loadSecrets sets the settings of the configuration the secret of the source has values for
+func loadSecrets(c *config, src secretSource) (string, error) {
+	values, version, err := src.Fetch()
+	if err != nil {
+		return "", err
+	}
+	if err := checkSecretNames(values); err != nil {
+		return "", err
+	}
+
+	fields := c.secretFields()
+	for name, value := range values {
+		*fields[name] = value
+	}
+	return version, nil
+}
+
+// checkSecretNames makes sure every value of a secret sets a setting that can be loaded from one, so a
+// misspelled name doesn't go unnoticed
+func checkSecretNames(values map[string]string) error {
+	fields := (&config{}).secretFields()
+	for name := range values {
+		if _, ok := fields[name]; !ok {
+			names := make([]string, 0, len(fields))
+			for n := range fields {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return errors.New("the secret has a value for '" + name + "', which isn't one of " + strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// vaultSource loads the secrets from the fields of a kv version 2 secret in vault
+type vaultSource struct {
+	addr  string
+	token string
+	path  string
+}
+
+// vaultSecret is the response of vault to reading a kv version 2 secret
+type vaultSecret struct {
+	Data struct {
+		Data     map[string]string `json:"data"`
+		Metadata struct {
+			Version json.Number `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// Name tells where the secrets come from
+func (v vaultSource) Name() string {
+	return "vault"
+}
+
+// Fetch reads the latest version of the secret
+func (v vaultSource) Fetch() (map[string]string, string, error) {
+	req, err := http.NewRequest("GET", v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, "", errors.New("vault responded with a secret that isn't a kv version 2 secret of strings: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("vault responded with " + resp.Status + " " + strings.Join(secret.Errors, ", "))
+	}
+	return secret.Data.Data, secret.Data.Metadata.Version.String(), nil
+}
+
+// awsCredentials sign the requests to aws
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// awsSecretSource loads the secrets from the json object an aws secrets manager secret holds
+type awsSecretSource struct {
+	id     string
+	region string
+	creds  awsCredentials
+}
+
+// Name tells where the secrets come from
+func (a awsSecretSource) Name() string {
+	return "aws secrets manager"
+}
+
+// Fetch reads the current version of the secret
+func (a awsSecretSource) Fetch() (map[string]string, string, error) {
+	body, err := json.Marshal(map[string]string{"SecretId": a.id})
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest("POST", strings.Replace(secretsManagerEndpoint, "{region}", a.region, 1), bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWS(req, body, "secretsmanager", a.region, a.creds, time.Now())
+
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var res struct {
+		SecretString string `json:"SecretString"`
+		VersionID    string `json:"VersionId"`
+		Message      string `json:"message"`
+	}
+	json.Unmarshal(b, &res)
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("aws secrets manager responded with " + resp.Status + " " + res.Message)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal([]byte(res.SecretString), &values); err != nil {
+		return nil, "", errors.New("the secret isn't a json object of strings: " + err.Error())
+	}
+	return values, res.VersionID, nil
+}
+
+// signAWS signs the request with aws signature version 4, signing every header set on it along with the
+// host
+func signAWS(req *http.Request, body []byte, service, region string, creds awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payload := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{req.Method, path, req.URL.Query().Encode(), canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payload[:])}, "\n")
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(key))
+}
+
+// secretStatus is the state of a single secret, returned through the api @ /v1/admin/secrets. Its value is
+// never returned
+type secretStatus struct {
+	Name      string     `json:"name"`
+	Set       bool       `json:"set"`
+	Live      bool       `json:"live"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty"`
+}
+
+// secretsStatus is where the secrets come from and when they were last loaded, returned through the api @
+// /v1/admin/secrets
+type secretsStatus struct {
+	Source       string         `json:"source"`
+	Version      string         `json:"version,omitempty"`
+	LoadedAt     *time.Time     `json:"loadedAt,omitempty"`
+	LastError    string         `json:"lastError,omitempty"`
+	Refresh      string         `json:"refresh,omitempty"`
+	Secrets      []secretStatus `json:"secrets"`
+	NeedsRestart []string       `json:"needsRestart,omitempty"`
+}
+
+// secretStore holds the current values of the secrets, which rotate while the server runs when they're
+// loaded from a secret source
+type secretStore struct {
+	sync.RWMutex
+	values       map[string]string
+	rotatedAt    map[string]time.Time
+	source       string
+	version      string
+	loadedAt     time.Time
+	lastError    string
+	needsRestart map[string]bool
+}
+
+var secrets = &secretStore{values: make(map[string]string)}
+
+// reset puts the secrets back to the values the configuration runs with
+func (s *secretStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.values = make(map[string]string)
+	for name, field := range cfg.secretFields() {
+		s.values[name] = *field
+	}
+	s.rotatedAt = make(map[string]time.Time)
+	s.needsRestart = make(map[string]bool)
+	s.source, s.version, s.loadedAt, s.lastError = "flags", "", time.Time{}, ""
+}
+
+// Get returns the current value of the secret set by the flag of the name
+func (s *secretStore) Get(name string) string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.values[name]
+}
+
+// Loaded records that the version of the secret of the source was loaded at the given time
+func (s *secretStore) Loaded(source, version string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.source, s.version, s.loadedAt, s.lastError = source, version, now, ""
+}
+
+// Failed records that loading the secrets failed, keeping the values loaded before
+func (s *secretStore) Failed(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastError = err.Error()
+}
+
+// Rotate takes on the values loaded at the given time and returns the names of those that changed. The
+// secrets that aren't live keep their value until a restart, which they're marked as needing
+func (s *secretStore) Rotate(values map[string]string, now time.Time) (rotated, needsRestart []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for name, value := range values {
+		if s.values[name] == value {
+			continue
+		}
+		if !inArray(name, liveSecrets) {
+			if !s.needsRestart[name] {
+				s.needsRestart[name] = true
+				needsRestart = append(needsRestart, name)
+			}
+			continue
+		}
+		s.values[name] = value
+		s.rotatedAt[name] = now
+		rotated = append(rotated, name)
+	}
+	sort.Strings(rotated)
+	sort.Strings(needsRestart)
+	return rotated, needsRestart
+}
+
+// Status returns where the secrets come from and the state of each one
+func (s *secretStore) Status() secretsStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	st := secretsStatus{Source: s.source, Version: s.version, LastError: s.lastError, Secrets: []secretStatus{}}
+	if !s.loadedAt.IsZero() {
+		loadedAt := s.loadedAt
+		st.LoadedAt = &loadedAt
+		if cfg.SecretsRefresh > 0 {
+			st.Refresh = cfg.SecretsRefresh.String()
+		}
+	}
+	names := make([]string, 0, len(s.values))
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ss := secretStatus{Name: name, Set: s.values[name] != "", Live: inArray(name, liveSecrets)}
+		if at, ok := s.rotatedAt[name]; ok {
+			ss.RotatedAt = &at
+		}
+		st.Secrets = append(st.Secrets, ss)
+		if s.needsRestart[name] {
+			st.NeedsRestart = append(st.NeedsRestart, name)
+		}
+	}
+	return st
+}
+
+// refreshSecrets loads the secrets of the source again, rotating those that changed
+func refreshSecrets(src secretSource, now time.Time) error {
+	values, version, err := src.Fetch()
+	if err == nil {
+		err = checkSecretNames(values)
+	}
+	if err != nil {
+		secrets.Failed(err)
+		return err
+	}
+
+	rotated, needsRestart := secrets.Rotate(values, now)
+	secrets.Loaded(src.Name(), version, now)
+	if len(rotated) > 0 {
+		log.Println("rotated the secrets", rotated, "loaded from", src.Name())
+	}
+	if len(needsRestart) > 0 {
+		log.Println("the secrets", needsRestart, "changed in", src.Name(), "and take effect on restart")
+	}
+	return nil
+}
+
+// runSecretRotation loads the secrets of the source again every interval until stop is closed, so those
+// rotated in the source take effect without a restart
+func runSecretRotation(src secretSource, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := refreshSecrets(src, time.Now()); err != nil {
+			log.Println("failed to load the secrets from", src.Name(), "with error:", err)
+		}
+	}
+}
+
+// GetSecrets is the handler to return where the secrets come from and which are set, never their values
+func GetSecrets(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, secrets.Status())
+}
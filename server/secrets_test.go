@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVaultSecrets(t *testing.T) {
+	var mu sync.Mutex
+	version, values := 1, map[string]string{"slack-token": "xoxb-1", "influx-token": "influx-1"}
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/thermostat" || r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": values, "metadata": map[string]int{"version": version}},
+		})
+	}))
+	defer vault.Close()
+
+	base := newTestServer(t, func(c *config) {
+		c.SlackToken = "xoxb-flag"
+		c.VaultAddr = vault.URL
+		c.VaultToken = "root"
+	})
+	if cfg.SlackToken != "xoxb-1" || cfg.InfluxToken != "influx-1" || secrets.Get("slack-token") != "xoxb-1" {
+		t.Fatalf("expected the secrets of vault to override the flags, got %q and %q", cfg.SlackToken, cfg.InfluxToken)
+	}
+
+	mu.Lock()
+	version, values = 2, map[string]string{"slack-token": "xoxb-2", "influx-token": "influx-2"}
+	mu.Unlock()
+	src, _ := newSecretSource(cfg)
+	if err := refreshSecrets(src, time.Now()); err != nil {
+		t.Fatalf("failed to refresh the secrets: %s", err)
+	}
+	if secrets.Get("slack-token") != "xoxb-2" || secrets.Get("influx-token") != "influx-1" {
+		t.Fatal("expected only the live secrets to rotate")
+	}
+
+	var st secretsStatus
+	if get(base+"/v1/admin/secrets", t, &st); st.Source != "vault" || st.Version != "2" || len(st.NeedsRestart) != 1 || st.NeedsRestart[0] != "influx-token" {
+		t.Fatalf("expected the status of the secrets, got %+v", st)
+	}
+	for _, s := range st.Secrets {
+		if s.Name == "slack-token" && (!s.Set || !s.Live || s.RotatedAt == nil) {
+			t.Fatalf("expected the slack token to have rotated, got %+v", s)
+		}
+	}
+
+	// a misspelled secret, or one the token can't read, fails the startup
+	mu.Lock()
+	values = map[string]string{"slack-tokn": "xoxb-3"}
+	mu.Unlock()
+	for _, token := range []string{"root", "wrong"} {
+		c := defaultConfig()
+		c.VaultAddr, c.VaultToken = vault.URL, token
+		if _, err := NewServer(c); err == nil {
+			t.Fatalf("expected loading the secrets with token %s to fail", token)
+		}
+	}
+	t.Setenv("VAULT_TOKEN", "")
+	if _, err := newSecretSource(config{VaultAddr: vault.URL}); err == nil {
+		t.Fatal("expected vault to need a token")
+	}
+}
+
+func TestAWSSecrets(t *testing.T) {
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || string(body) != `{"SecretId":"thermostat"}` ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request") || r.Header.Get("X-Amz-Security-Token") != "session" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "bad request"}`))
+			return
+		}
+		w.Write([]byte(`{"SecretString": "{\"sync-token\": \"sync-1\"}", "VersionId": "v1"}`))
+	}))
+	defer aws.Close()
+	endpoint := secretsManagerEndpoint
+	secretsManagerEndpoint = aws.URL + "/"
+	defer func() { secretsManagerEndpoint = endpoint }()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	src, err := newSecretSource(config{AWSSecretID: "thermostat", AWSSecretRegion: "eu-west-1"})
+	if err != nil {
+		t.Fatalf("failed to create the source: %s", err)
+	}
+	values, version, err := src.Fetch()
+	if err != nil || version != "v1" || values["sync-token"] != "sync-1" {
+		t.Fatalf("expected the secret, got %v %s (%v)", values, version, err)
+	}
+
+	if _, err := newSecretSource(config{AWSSecretID: "thermostat", VaultAddr: "http://vault"}); err == nil {
+		t.Fatal("expected only one source to be allowed")
+	}
+}
+
+func TestSignAWS(t *testing.T) {
+	// the example of the aws documentation on signing requests with signature version 4
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	signAWS(req, nil, "iam", "us-east-1", awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, now)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/buaazp/fasthttprouter"
 	"github.com/valyala/fasthttp"
 )
 
@@ -25,6 +28,66 @@ type thermostat struct {
 	HeatSetPoint  int       `json:"heatSetPoint"`
 	FanMode       string    `json:"fan"`
 	LastChanged   time.Time `json:"lastChanged"`
+
+	// FreezeProtection and OverheatProtection are set while a safety limit is overriding the mode
+	FreezeProtection   bool `json:"freezeProtection"`
+	OverheatProtection bool `json:"overheatProtection"`
+
+	// MaintenanceUntil is set while the thermostat is in maintenance mode and automated writes are suspended
+	MaintenanceUntil *time.Time `json:"maintenanceUntil,omitempty"`
+
+	// Disabled is set on decommissioned or seasonal units, which stay visible but can't be controlled
+	Disabled bool `json:"disabled"`
+
+	// DisplayOrder is the position the thermostat is listed in, starting at 1
+	DisplayOrder int `json:"displayOrder"`
+
+	// Tags organize thermostats into groups, e.g. "floor:2" or "wing:north"
+	Tags []string `json:"tags,omitempty"`
+
+	// Location places the thermostat in a room of a floor of a building, which it's rolled up by
+	Location *location `json:"location,omitempty"`
+
+	// Offline is set while the device can't be reached and writes to it are rejected
+	Offline bool `json:"offline,omitempty"`
+
+	// HVACState is what the equipment is doing since HVACSince, see runHVAC, HVACStage the stage it heats
+	// or cools in and CycleEnded when it last stopped heating or cooling
+	HVACState  string     `json:"hvacState,omitempty"`
+	HVACStage  int        `json:"hvacStage,omitempty"`
+	HVACSince  *time.Time `json:"hvacSince,omitempty"`
+	CycleEnded *time.Time `json:"cycleEnded,omitempty"`
+
+	// Boost is set while the setpoints are temporarily moved, see PostBoost
+	Boost *boost `json:"boost,omitempty"`
+
+	// FanTimer is set while the fan runs for a while, see PostFanTimer
+	FanTimer *fanTimer `json:"fanTimer,omitempty"`
+
+	// QuietHours are the windows the fan and equipment are kept quiet in, and Quiet is set during them
+	QuietHours *quietHours `json:"quietHours,omitempty"`
+	Quiet      bool        `json:"quiet,omitempty"`
+
+	// Sleep is the profile the setpoints ramp overnight by, SleepOffset the degrees it has them moved by and
+	// SleepHeld is set when they were changed during the night, holding them until wake time
+	Sleep       *sleepProfile `json:"sleep,omitempty"`
+	SleepOffset int           `json:"sleepOffset,omitempty"`
+	SleepHeld   bool          `json:"sleepHeld,omitempty"`
+
+	// Precondition is the profile the setpoints are moved ahead of a heat wave or cold snap by,
+	// PreconditionOffset the degrees it has them moved by and PreconditionHeld is set when they were changed
+	// while it did, holding them until the action ends
+	Precondition       *preconditionProfile `json:"precondition,omitempty"`
+	PreconditionOffset int                  `json:"preconditionOffset,omitempty"`
+	PreconditionHeld   bool                 `json:"preconditionHeld,omitempty"`
+
+	// Overrides are the settings set on the thermostat itself that its groups define too, which it keeps
+	// rather than inheriting them from the groups, see applyGroups
+	Overrides []string `json:"overrides,omitempty"`
+
+	// Revision counts the changes committed to the thermostat, so a change made to a copy that was read
+	// before another one was committed is rejected rather than overwriting it, see commitHeld
+	Revision int `json:"revision,omitempty"`
 }
 
 // updateThermostat is the desired thermostat state sent in through the api @ /v1/thermostats/:id
@@ -35,6 +98,16 @@ type updateThermostat struct {
 	CoolSetPoint  int    `json:"coolSetPoint"`
 	HeatSetPoint  int    `json:"heatSetPoint"`
 	FanMode       string `json:"fan"`
+
+	// Tags replace every tag of the thermostat when given, an empty list removes them all
+	Tags []string `json:"tags"`
+
+	// Location replaces the location of the thermostat when given, an empty one removes it
+	Location *location `json:"location"`
+
+	// inherit applies the settings the groups of the thermostat define to every one it doesn't override,
+	// which otherwise only happens as it joins a group
+	inherit bool
 }
 
 // currentState provides safe concurrent access for reads. It is held in a map to provide a faster lookups of
@@ -42,6 +115,20 @@ type updateThermostat struct {
 type currentState struct {
 	sync.Mutex
 	thermostats map[int]*thermostat
+
+	// journal holds the changes the thermostats are projected from
+	journal journal
+
+	// lastID is the highest id a thermostat was ever projected with, so the ids of removed thermostats are
+	// never given out again
+	lastID int
+
+	// changed is closed by the next change projected into the home, waking the event streams waiting on it
+	changed chan struct{}
+
+	// writes serializes every change, so each one sees the state the previous one committed, e.g. the next
+	// id to give out, or that the thermostat it writes was removed
+	writes sync.Mutex
 }
 
 // errResponse is the structure of any errors that may be returned to the client
@@ -71,47 +158,67 @@ const (
 
 	defaultFan1 = "auto"
 	defaultFan2 = "on"
+
+	// specify default values for thermostats added through the api, which are also what a field is
+	// reset to
+
+	defaultNamePrefix = "Thermostat #"
+	defaultOpMode     = "off"
+	defaultSetPt      = 71
+	defaultFan        = "auto"
 )
 
 var (
 	home          currentState
 	validOpModes  []string
 	validFanModes []string
-	validFields   []string
 	minCoolSetPt  = 30
 	maxCoolSetPt  = 100
 	minHeatSetPt  = 30
 	maxHeatSetPt  = 100
+	maxTagLength  = 64
 )
 
 func init() {
 	// initialize the initial state of the home with generic values for both thermostats
-	home.thermostats = make(map[int]*thermostat)
-	home.thermostats[1] = &thermostat{
-		ID:            1,
-		Name:          defaultName1,
-		CurrentTemp:   71,
-		OperatingMode: defaultOpMode1,
-		CoolSetPoint:  defaultCoolSetPt1,
-		HeatSetPoint:  defaultHeatSetPt1,
-		FanMode:       defaultFan1,
-		LastChanged:   time.Now(),
-	}
-	home.thermostats[2] = &thermostat{
-		ID:            2,
-		Name:          defaultName2,
-		CurrentTemp:   72,
-		OperatingMode: defaultOpMode2,
-		CoolSetPoint:  defaultCoolSetPt2,
-		HeatSetPoint:  defaultHeatSetPt2,
-		FanMode:       defaultFan2,
-		LastChanged:   time.Now(),
-	}
+	home.replace(defaultThermostats())
 
 	// set the valid modes
 	validOpModes = []string{"cool", "heat", "off"}
 	validFanModes = []string{"auto", "on"}
-	validFields = []string{"name", "currentTemp", "mode", "coolSetPoint", "heatSetPoint", "fan"}
+}
+
+// defaultThermostats returns the generic thermostats every home starts out with
+func defaultThermostats() []*thermostat {
+	therms := []*thermostat{
+		{
+			ID:            1,
+			Name:          defaultName1,
+			CurrentTemp:   71,
+			OperatingMode: defaultOpMode1,
+			CoolSetPoint:  defaultCoolSetPt1,
+			HeatSetPoint:  defaultHeatSetPt1,
+			FanMode:       defaultFan1,
+			LastChanged:   clock.Now(),
+			DisplayOrder:  1,
+		},
+		{
+			ID:            2,
+			Name:          defaultName2,
+			CurrentTemp:   72,
+			OperatingMode: defaultOpMode2,
+			CoolSetPoint:  defaultCoolSetPt2,
+			HeatSetPoint:  defaultHeatSetPt2,
+			FanMode:       defaultFan2,
+			LastChanged:   clock.Now(),
+			DisplayOrder:  2,
+		},
+	}
+	for _, t := range therms {
+		runHVAC(nil, t, clock.Now())
+	}
+
+	return therms
 }
 
 // Thermostat is a getter to provide safe concurrent read access to a specific thermostat
@@ -131,12 +238,36 @@ func (home *currentState) Thermostat(id int) (*thermostat, *errResponse) {
 	return t, nil
 }
 
-// UpdateThermostat provides a type safe way to perform updates on a specific thermostat
-func (home *currentState) UpdateThermostat(target *thermostat, desired updateThermostat) {
+// Thermostats is a getter to provide safe concurrent read access to every thermostat, in display order
+func (home *currentState) Thermostats() []*thermostat {
 	home.Lock()
+	defer home.Unlock()
+
+	return sortThermostats(home.thermostats)
+}
+
+// sortThermostats returns the thermostats in display order, falling back to the id
+func sortThermostats(thermostats map[int]*thermostat) []*thermostat {
+	var therms []*thermostat
+	for _, t := range thermostats {
+		therms = append(therms, t)
+	}
+	sort.Slice(therms, func(i, j int) bool {
+		if therms[i].DisplayOrder != therms[j].DisplayOrder {
+			return therms[i].DisplayOrder < therms[j].DisplayOrder
+		}
+		return therms[i].ID < therms[j].ID
+	})
 
+	return therms
+}
+
+// UpdateThermostat provides a type safe way to perform updates on a specific thermostat, returning the
+// updated thermostat, or the error the change couldn't be committed with
+func (home *currentState) UpdateThermostat(target *thermostat, desired updateThermostat) (*thermostat, error) {
 	updated := &thermostat{
-		ID: target.ID,
+		ID:       target.ID,
+		Revision: target.Revision,
 	}
 
 	// make sure new name isn't empty before changing
@@ -174,107 +305,531 @@ func (home *currentState) UpdateThermostat(target *thermostat, desired updateThe
 		updated.FanMode = target.FanMode
 	}
 
+	// make sure tags were given before changing
+	if desired.Tags != nil {
+		updated.Tags = desired.Tags
+	} else {
+		updated.Tags = target.Tags
+	}
+
+	// make sure a location was given before changing, an empty one removes it
+	if desired.Location != nil {
+		if *desired.Location != (location{}) {
+			updated.Location = desired.Location
+		}
+	} else {
+		updated.Location = target.Location
+	}
+
+	// inherit the settings of the groups the thermostat is in, unless it overrides them
+	applyGroups(target, updated, desired)
+
 	// make sure that the previousTemp only gets changed if the currentTemp does
 	temp := (updated.CoolSetPoint + updated.HeatSetPoint) / 2
 	if temp != target.CurrentTemp {
 		updated.CurrentTemp = temp
 		updated.PreviousTemp = target.CurrentTemp
+	} else {
+		updated.CurrentTemp = target.CurrentTemp
+		updated.PreviousTemp = target.PreviousTemp
+	}
+
+	// carry over the maintenance window unless it has expired
+	if inMaintenance(target) {
+		updated.MaintenanceUntil = target.MaintenanceUntil
+	}
+	// carry over the boost unless the setpoints or mode it moved were changed
+	if desired.OperatingMode == "" && desired.HeatSetPoint == 0 && desired.CoolSetPoint == 0 {
+		updated.Boost = target.Boost
 	}
+	// carry over the fan timer unless the fan mode was changed
+	if desired.FanMode == "" {
+		updated.FanTimer = target.FanTimer
+	}
+	updated.QuietHours = target.QuietHours
+	updated.Quiet = target.Quiet
+	// carry over the sleep ramp unless the setpoints were changed, which holds them until wake time with
+	// the ones that weren't given moved back
+	updated.Sleep = target.Sleep
+	if desired.HeatSetPoint == 0 && desired.CoolSetPoint == 0 {
+		updated.SleepOffset = target.SleepOffset
+		updated.SleepHeld = target.SleepHeld
+	} else if _, sleeping := sleepOffset(target.Sleep, clock.Now()); sleeping {
+		updated.SleepHeld = true
+		if desired.HeatSetPoint == 0 && updated.HeatSetPoint != 0 {
+			updated.HeatSetPoint -= target.SleepOffset
+		}
+		if desired.CoolSetPoint == 0 && updated.CoolSetPoint != 0 {
+			updated.CoolSetPoint -= target.SleepOffset
+		}
+	}
+	// the same goes for pre-conditioning, which is held until the action ends
+	updated.Precondition = target.Precondition
+	if desired.HeatSetPoint == 0 && desired.CoolSetPoint == 0 {
+		updated.PreconditionOffset = target.PreconditionOffset
+		updated.PreconditionHeld = target.PreconditionHeld
+	} else if target.PreconditionOffset != 0 || target.PreconditionHeld {
+		updated.PreconditionHeld = true
+		if desired.HeatSetPoint == 0 && updated.HeatSetPoint != 0 {
+			updated.HeatSetPoint -= target.PreconditionOffset
+		}
+		if desired.CoolSetPoint == 0 && updated.CoolSetPoint != 0 {
+			updated.CoolSetPoint -= target.PreconditionOffset
+		}
+	}
+	updated.Disabled = target.Disabled
+	updated.DisplayOrder = target.DisplayOrder
+	updated.Offline = target.Offline
+
+	// the safety limits override anything that was asked for
+	safety := applySafetyLimits(target, updated)
 
 	// set the last time the thermostat's settings were changed to now
-	updated.LastChanged = time.Now()
-	home.thermostats[target.ID] = updated
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeUpdate, updated)
+	if err != nil {
+		return nil, err
+	}
 
-	home.Unlock()
+	publish(eventChange, updated)
+	if safety != nil {
+		publishDetail(eventSafety, updated, safety.Severity, safety.Detail)
+	}
+	publishHVAC(transitions)
+	anomalies.Observe(updated)
+
+	return updated, nil
 }
 
-// AddThermostat takes the desired thermostat state and adds it to our map of thermostats
-func (home *currentState) AddThermostat(desired updateThermostat) int {
-	home.Lock()
+// AddThermostat takes the desired thermostat state and adds it to our map of thermostats, returning its id
+func (home *currentState) AddThermostat(desired updateThermostat) (int, error) {
+	home.writes.Lock()
+	defer home.writes.Unlock()
 
-	// find the next id to use as the identifier for the new thermostat
-	var ints []int
-	for key := range home.thermostats {
-		ints = append(ints, key)
+	// take the id after the last one ever given out as the identifier for the new thermostat, so the id of a
+	// removed thermostat is never reused, and list it last
+	var lastOrder int
+	home.Lock()
+	for _, t := range home.thermostats {
+		if t.DisplayOrder > lastOrder {
+			lastOrder = t.DisplayOrder
+		}
 	}
-	sort.Ints(ints)
-	newID := ints[len(ints)-1] + 1 // +1 because our first id starts at 1, not 0
+	newID := home.lastID + 1
+	home.Unlock()
 
 	updated := &thermostat{
-		ID: newID,
+		ID:           newID,
+		DisplayOrder: lastOrder + 1,
 	}
 
 	// set default name if not provided
 	if desired.Name != "" {
 		updated.Name = desired.Name
 	} else {
-		updated.Name = "Thermostat #" + strconv.Itoa(newID)
+		updated.Name = defaultNamePrefix + strconv.Itoa(newID)
 	}
 
 	// set operating mode to 'off' if not provided
 	if desired.OperatingMode != "" {
 		updated.OperatingMode = desired.OperatingMode
 	} else {
-		updated.OperatingMode = "off"
+		updated.OperatingMode = defaultOpMode
 	}
 
 	// set cool set point to 71 if not provided
 	if desired.CoolSetPoint != 0 {
 		updated.CoolSetPoint = desired.CoolSetPoint
 	} else {
-		updated.CoolSetPoint = 71
+		updated.CoolSetPoint = defaultSetPt
 	}
 
 	// set heat set point to 71 if not provided
 	if desired.HeatSetPoint != 0 {
 		updated.HeatSetPoint = desired.HeatSetPoint
 	} else {
-		updated.HeatSetPoint = 71
+		updated.HeatSetPoint = defaultSetPt
 	}
 
 	// set fan mode to 'auto' if not provided
 	if desired.FanMode != "" {
 		updated.FanMode = desired.FanMode
 	} else {
-		updated.FanMode = "auto"
+		updated.FanMode = defaultFan
 	}
 
+	updated.Tags = desired.Tags
+	if desired.Location != nil && *desired.Location != (location{}) {
+		updated.Location = desired.Location
+	}
+
+	// settings that weren't provided are inherited from the groups the thermostat joins
+	applyGroups(nil, updated, desired)
+
 	if updated.CoolSetPoint != 0 && updated.HeatSetPoint != 0 {
 		updated.CurrentTemp = (updated.CoolSetPoint + updated.HeatSetPoint) / 2
 	} else {
 		updated.CurrentTemp = 71
 	}
 
+	// the safety limits override anything that was asked for
+	safety := applySafetyLimits(nil, updated)
+
 	// set the last time the thermostat's settings were changed to now
-	updated.LastChanged = time.Now()
-	home.thermostats[newID] = updated
-	home.Unlock()
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commitHeld(changeAdd, updated)
+	if err != nil {
+		return 0, err
+	}
+
+	publish(eventChange, updated)
+	if safety != nil {
+		publishDetail(eventSafety, updated, safety.Severity, safety.Detail)
+	}
+	publishHVAC(transitions)
+
+	return newID, nil
+}
+
+// RemoveThermostat takes the thermostat out of the home for good, along with what is kept about it
+// elsewhere: its actions, installation, queued writes, pairing, imported history, alerts and readings. Its
+// id is never given to another thermostat while the server runs, and without a write-ahead log nothing of
+// it survives a restart for a thermostat that gets the id afterwards to inherit
+func (home *currentState) RemoveThermostat(target *thermostat) error {
+	home.writes.Lock()
+	defer home.writes.Unlock()
+
+	if err := home.write(change{Type: changeDelete, Time: clock.Now(), Deleted: []*thermostat{target}}); err != nil {
+		return err
+	}
+	publish(eventDeleted, target)
+
+	if _, err := actions.Replace(target.ID, nil); err != nil {
+		log.Println("failed to remove the scheduled actions of thermostat", target.ID, "with error:", err)
+	}
+	if err := installers.RemoveInstallation(target.ID); err != nil {
+		log.Println("failed to remove the installation of thermostat", target.ID, "with error:", err)
+	}
+	offlineWrites.Clear(target.ID)
+	pairing.Forget(target.ID)
+	if _, err := history.Purge(target.ID, time.Time{}); err != nil {
+		log.Println("failed to remove the history of thermostat", target.ID, "with error:", err)
+	}
+	alerts.Forget(target.ID)
+	anomalies.Forget(target.ID)
+	ifttt.ForgetThermostat(target.ID)
+	return nil
+}
+
+var (
+	// errThermostatRemoved is the error of a change to a thermostat that was removed since it was read
+	errThermostatRemoved = errors.New("the thermostat was removed")
+	// errThermostatChanged is the error of a change to a thermostat that was changed since it was read
+	errThermostatChanged = errors.New("the thermostat was changed")
+	// errReadOnly is the error of a change made while the service is read-only, which the automated
+	// writers running in the background would otherwise get through
+	errReadOnly = errors.New("the service is read-only")
+)
+
+// commit appends a change of the given kind writing the changed thermostats to the log of the home. When
+// the state is replicated the change goes through the replication log, and is applied once it has been
+// committed there. Otherwise it's appended to the write-ahead log first, when there is one. It returns the
+// transitions of the operating states the change made, for the caller to publish after its own events. A
+// change that couldn't be written was never applied, so the caller must not publish anything for it
+func (home *currentState) commit(typ string, changed ...*thermostat) ([]*hvacTransition, error) {
+	home.writes.Lock()
+	defer home.writes.Unlock()
+
+	return home.commitHeld(typ, changed...)
+}
+
+// commitHeld commits the change while the writes are already serialized by the caller. Changes to a
+// thermostat that was removed or changed in the meantime are rejected, as the caller read it before then and
+// would bring it back or undo the other change, and so is every change while the service is read-only
+func (home *currentState) commitHeld(typ string, changed ...*thermostat) ([]*hvacTransition, error) {
+	if checkReadOnly() != nil {
+		return nil, errReadOnly
+	}
+	if typ != changeAdd {
+		home.Lock()
+		for _, t := range changed {
+			current, ok := home.thermostats[t.ID]
+			if !ok {
+				home.Unlock()
+				return nil, errThermostatRemoved
+			}
+			if current.Revision != t.Revision {
+				home.Unlock()
+				return nil, errThermostatChanged
+			}
+		}
+		home.Unlock()
+	}
+	for _, t := range changed {
+		t.Revision++
+	}
+
+	transitions := home.runHVACs(changed)
+	if err := home.write(newChange(typ, changed)); err != nil {
+		return nil, err
+	}
+	return transitions, nil
+}
+
+// maxChangedRetries bounds how many times an automated change is made again on the current record of a
+// thermostat that keeps being changed under it
+const maxChangedRetries = 5
+
+// retryChanged makes the change to the thermostat, making it again on its current record when it was changed
+// before the change could be committed. Automated writers have no client to retry for them, so they go
+// through this rather than dropping their change or overwriting the other one
+func retryChanged(target *thermostat, change func(current *thermostat) (*thermostat, error)) (*thermostat, error) {
+	for i := 0; ; i++ {
+		updated, err := change(target)
+		if err != errThermostatChanged || i == maxChangedRetries {
+			return updated, err
+		}
+
+		current, errRes := home.Thermostat(target.ID)
+		if errRes != nil {
+			return nil, errThermostatRemoved
+		}
+		target = current
+	}
+}
+
+// write appends the change to the replication log or the write-ahead log, whichever there is, or else
+// applies it right away
+func (home *currentState) write(c change) error {
+	var err error
+	switch {
+	case replication != nil:
+		if err = replication.Replicate(c); err != nil {
+			log.Println("failed to replicate the change of", len(c.Thermostats)+len(c.Deleted), "thermostats with error:", err)
+		}
+	case wal != nil:
+		c.Outbox = changeEvents(c)
+		if err = wal.Write(c); err != nil {
+			log.Println("failed to log the change of", len(c.Thermostats)+len(c.Deleted), "thermostats with error:", err)
+		}
+	default:
+		home.apply(c)
+	}
+	return err
+}
+
+// commitError returns the error response of a change that couldn't be written to the log of the home, so
+// it was never applied. The replication log fails while the cluster can't commit, which clients can retry,
+// as they can a change to a thermostat that was changed in the meantime, while a thermostat that was
+// removed is gone for good
+func commitError(err error) *errResponse {
+	if err == errThermostatChanged {
+		return &errResponse{
+			Code:        http.StatusConflict,
+			Msg:         "Conflict",
+			Description: "The thermostat was changed while the change was being made. Read it again and retry.",
+		}
+	}
+	if err == errReadOnly {
+		if errRes := checkReadOnly(); errRes != nil {
+			return errRes
+		}
+		return &errResponse{
+			Code:        http.StatusServiceUnavailable,
+			Msg:         "Read-Only Mode",
+			Description: "The service was read-only when the change was made.",
+		}
+	}
+	if err == errThermostatRemoved {
+		return &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "The thermostat was removed before the change could be made.",
+		}
+	}
+	if replication != nil {
+		return &errResponse{
+			Code:        http.StatusServiceUnavailable,
+			Msg:         "Failed to replicate the change",
+			Description: err.Error(),
+		}
+	}
+	return &errResponse{
+		Code:        http.StatusInternalServerError,
+		Msg:         "Failed to save the change",
+		Description: err.Error(),
+	}
+}
+
+// sendCommitError responds that the change couldn't be committed
+func sendCommitError(req *fasthttp.RequestCtx, err error) {
+	res := commitError(err)
+	if res.Code == http.StatusInternalServerError {
+		reportError(req, err)
+	}
+	req.SetStatusCode(res.Code)
+	sendJSON(req, res)
+}
+
+// apply projects the change into the home, recording it in the journal
+func (home *currentState) apply(c change) {
+	home.Lock()
+	defer home.Unlock()
+
+	c.Outbox = nil
+	c.Thermostats = home.existing(c)
+	c = home.journal.record(c)
+	if c.Snapshot {
+		home.thermostats = make(map[int]*thermostat, len(c.Thermostats))
+	}
+	project(home.thermostats, c)
+	for _, t := range c.Thermostats {
+		if t.ID > home.lastID {
+			home.lastID = t.ID
+		}
+	}
+	if home.changed != nil {
+		close(home.changed)
+		home.changed = nil
+	}
+}
+
+// existing returns the records of the change that may be projected: an update of a thermostat that was
+// removed before it was applied would bring it back, so it's dropped. Additions, snapshots and the records
+// a replica copies from its primary write whatever they hold. The home must be locked
+func (home *currentState) existing(c change) []*thermostat {
+	if c.Snapshot || c.Type == changeAdd || c.Type == changeReplicated {
+		return c.Thermostats
+	}
+
+	kept := c.Thermostats[:0:0]
+	for _, t := range c.Thermostats {
+		if _, ok := home.thermostats[t.ID]; ok {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
 
-	return newID
+// replace swaps every thermostat of the home for the given ones, e.g. when restoring a snapshot
+func (home *currentState) replace(therms []*thermostat) {
+	home.apply(change{Time: clock.Now(), Snapshot: true, Thermostats: therms})
 }
 
-// sendJSON sends the provided data back to the client as a json byte array
+// sendJSON sends the provided data back to the client as a json byte array. Errors are sent as problem
+// details to clients that ask for them
 func sendJSON(req *fasthttp.RequestCtx, v interface{}) error {
-	jsn, err := json.Marshal(v)
+	contentType := "application/json"
+	if errRes, ok := v.(*errResponse); ok && wantsProblem(req) {
+		v = newProblem(req, errRes)
+		contentType = problemContentType
+	}
+
+	buf, jsn, err := marshalJSON(v)
+	defer releaseJSON(buf, jsn)
 	if err != nil {
+		reportError(req, err)
 		return err
 	}
 
-	req.Response.Header.Set("Content-Type", "application/json")
+	req.Response.Header.Set("Content-Type", contentType)
 	_, err = req.Write(jsn)
 	if err != nil {
+		reportError(req, err)
 		return err
 	}
 
 	return nil
 }
 
+// streamMinThermostats is the size from which lists of thermostats are streamed. Smaller lists are cheaper
+// to marshal in one go than to stream
+const streamMinThermostats = 100
+
+// sendThermostats sends the thermostats back to the client as a json array. Large lists are encoded one
+// thermostat at a time straight into the response as it's written to the client, so the whole payload is
+// never held in memory at once
+func sendThermostats(req *fasthttp.RequestCtx, therms []*thermostat) {
+	if len(therms) < streamMinThermostats {
+		sendJSON(req, therms)
+		return
+	}
+
+	req.Response.Header.Set("Content-Type", "application/json")
+	req.SetBodyStreamWriter(func(w *bufio.Writer) {
+		buf := jsonBuffers.Get().(*[]byte)
+		jsn := (*buf)[:0]
+		defer func() { releaseJSON(buf, jsn) }()
+
+		w.WriteByte('[')
+		for i, t := range therms {
+			var err error
+			if jsn, err = marshalThermostat(jsn[:0], t); err != nil {
+				// the status has already been sent, so all that's left is to cut the response short
+				log.Println("failed to encode thermostat", t.ID, "with error:", err)
+				return
+			}
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.Write(jsn)
+		}
+		w.WriteByte(']')
+	})
+}
+
 // HandleRoute is middleware that sets the content type to json and performs validation of the desired
 // thermostat if an id is present in the query string before continuing on to any routes
 func HandleRoute(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(req *fasthttp.RequestCtx) {
 		req.SetContentType("application/json")
 
+		// chaos testing slows down and fails requests on purpose
+		if errRes := chaos.inject(req); errRes != nil {
+			req.SetStatusCode(errRes.Code)
+			sendJSON(req, errRes)
+			return
+		}
+
+		// when api users are configured, every route requires a valid access token
+		if requiresAuth(req) {
+			username, errRes := authorize(req)
+			if errRes != nil {
+				req.SetStatusCode(http.StatusUnauthorized)
+				sendJSON(req, errRes)
+				return
+			}
+			req.SetUserValue(usernameKey, username)
+
+			// the admin routes are reserved to the admins among the api users
+			if strings.HasPrefix(string(req.Path()), "/v1/admin/") && !sessions.Admin(username) {
+				res := &errResponse{
+					Code:        http.StatusForbidden,
+					Msg:         "Forbidden",
+					Description: "User " + username + " isn't an admin, which " + string(req.Path()) + " is reserved to.",
+				}
+				req.SetStatusCode(http.StatusForbidden)
+				sendJSON(req, res)
+				return
+			}
+		}
+
+		// while the service is read-only every mutation is rejected, and so is every mutation on a node that
+		// isn't leading the cluster, except for the admin routes of the node itself such as turning
+		// read-only mode back off
+		if !req.IsGet() && !req.IsHead() && !strings.HasPrefix(string(req.Path()), "/v1/admin/") {
+			if errRes := checkReadOnly(); errRes != nil {
+				req.SetStatusCode(http.StatusServiceUnavailable)
+				sendJSON(req, errRes)
+				return
+			}
+			if errRes := checkLeader(); errRes != nil {
+				req.SetStatusCode(http.StatusServiceUnavailable)
+				sendJSON(req, errRes)
+				return
+			}
+		}
+
 		// if there is an :id param in the query string, we validate that the id provided is a
 		// valid integer and that we can find a thermostat based on that id
 		idCheck := req.UserValue("id")
@@ -288,6 +843,7 @@ func HandleRoute(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 				}
 				req.SetStatusCode(http.StatusBadRequest)
 				sendJSON(req, res)
+				return
 			}
 
 			// verify id passed exists in our map of thermostats
@@ -298,9 +854,38 @@ func HandleRoute(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 				return
 			}
 
+			// writes can't reach a device that is offline, except for updates that are queued until it
+			// reconnects and removing the thermostat, which doesn't need its device
+			removing := req.IsDelete() && string(req.Path()) == "/v1/thermostats/"+strconv.Itoa(t.ID)
+			if !req.IsGet() && !req.IsHead() && !strings.HasPrefix(string(req.Path()), "/v1/admin/") && !queuesOffline(req, t) && !removing {
+				if errRes := checkOffline(t); errRes != nil {
+					req.SetStatusCode(http.StatusServiceUnavailable)
+					sendJSON(req, errRes)
+					return
+				}
+			}
+
 			req.SetUserValue("thermostat", t)
 		}
 
+		h(req)
+		auditInstaller(req)
+	})
+}
+
+// HandleStatic dispatches requests whose param is one of the given static segments to their own handler. The
+// router doesn't allow a static segment next to a wildcard, e.g. /v1/thermostats/order next to
+// /v1/thermostats/:id
+func HandleStatic(param string, static map[string]fasthttp.RequestHandler, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(req *fasthttp.RequestCtx) {
+		if v, ok := req.UserValue(param).(string); ok {
+			if s, ok := static[v]; ok {
+				req.RemoveUserValue(param)
+				s(req)
+				return
+			}
+		}
+
 		h(req)
 	})
 }
@@ -311,13 +896,33 @@ func Index(req *fasthttp.RequestCtx) {
 	req.SetBodyString("Index Page")
 }
 
-// GetThermostats is the handler to return the information about all of the thermostats in the home
-func GetThermostats(req *fasthttp.RequestCtx) {
-	var therms []*thermostat
-	for _, thermostat := range home.thermostats {
-		therms = append(therms, thermostat)
+// MethodNotAllowed is the handler for a path that is served, just not with the method of the request. The
+// router has already set the Allow header to the methods it is served with
+func MethodNotAllowed(req *fasthttp.RequestCtx) {
+	res := &errResponse{
+		Code:        http.StatusMethodNotAllowed,
+		Msg:         "Method Not Allowed",
+		Description: "The method " + string(req.Method()) + " is not allowed on " + string(req.Path()) + ". Allowed methods are: " + string(req.Response.Header.Peek("Allow")) + ".",
 	}
+	req.SetStatusCode(http.StatusMethodNotAllowed)
+	sendJSON(req, res)
+}
 
+// NotFound is the handler for a path under a wildcard that isn't served
+func NotFound(req *fasthttp.RequestCtx) {
+	res := &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "Nothing is served at " + string(req.Path()) + ".",
+	}
+	req.SetStatusCode(http.StatusNotFound)
+	sendJSON(req, res)
+}
+
+// GetThermostats is the handler to return the information about all of the thermostats in the home, or
+// only those with every tag given by ?tag=
+func GetThermostats(req *fasthttp.RequestCtx) {
+	therms := withTags(home.Thermostats(), queryTags(req))
 	if len(therms) == 0 {
 		res := &errResponse{
 			Code:        http.StatusNotFound,
@@ -330,7 +935,7 @@ func GetThermostats(req *fasthttp.RequestCtx) {
 	}
 
 	req.SetStatusCode(http.StatusOK)
-	sendJSON(req, therms)
+	sendThermostats(req, therms)
 }
 
 // GetThermostat is the handler to return all information about a specific thermostat based on the id given
@@ -339,14 +944,16 @@ func GetThermostat(req *fasthttp.RequestCtx) {
 	sendJSON(req, req.UserValue("thermostat").(*thermostat))
 }
 
-// GetField is the handler to return a specific property of a specific thermostat
+// GetField is the handler to return a specific property of a specific thermostat, any of those it's
+// returned with by its json key
 func GetField(req *fasthttp.RequestCtx) {
 	field := req.UserValue("field").(string)
-	if !inArray(field, validFields) {
+	f, ok := thermostatFields[field]
+	if !ok {
 		res := &errResponse{
 			Code:        http.StatusBadRequest,
 			Msg:         "Invalid Property",
-			Description: "The property provided is not a valid property of a thermostat. Valid choices are: 'name', 'currentTemp', 'mode', 'coolSetPoint', 'heatSetPoint', or 'fan'.",
+			Description: "The property provided is not a valid property of a thermostat. Valid choices are: " + listChoices(fieldNames) + ".",
 		}
 		req.SetStatusCode(http.StatusBadRequest)
 		sendJSON(req, res)
@@ -356,49 +963,8 @@ func GetField(req *fasthttp.RequestCtx) {
 	// no need to check if this exists, already validated in middleware
 	t := req.UserValue("thermostat").(*thermostat)
 
-	var returnVal interface{}
-	var isEmpty bool
-
-	switch field {
-	case "name":
-		if t.Name == "" {
-			isEmpty = true
-		} else {
-			returnVal = t.Name
-		}
-	case "currentTemp":
-		if t.CurrentTemp == 0 {
-			isEmpty = true
-		} else {
-			returnVal = t.CurrentTemp
-		}
-	case "mode":
-		if t.OperatingMode == "" {
-			isEmpty = true
-		} else {
-			returnVal = t.OperatingMode
-		}
-	case "coolSetPoint":
-		if t.CoolSetPoint == 0 {
-			isEmpty = true
-		} else {
-			returnVal = t.CoolSetPoint
-		}
-	case "heatSetPoint":
-		if t.HeatSetPoint == 0 {
-			isEmpty = true
-		} else {
-			returnVal = t.HeatSetPoint
-		}
-	case "fan":
-		if t.FanMode == "" {
-			isEmpty = true
-		} else {
-			returnVal = t.FanMode
-		}
-	}
-
-	if isEmpty {
+	returnVal, ok := f.value(t)
+	if !ok {
 		res := &errResponse{
 			Code:        http.StatusNotFound,
 			Msg:         "Not Found",
@@ -418,7 +984,7 @@ func PutThermostat(req *fasthttp.RequestCtx) {
 
 	// verify json body was valid to api spec
 	var desired updateThermostat
-	if err := json.Unmarshal(req.PostBody(), &desired); err != nil {
+	if err := unmarshalStrict(req.PostBody(), &desired); err != nil {
 		res := &errResponse{
 			Code:        http.StatusBadRequest,
 			Msg:         "Invalid JSON body provided",
@@ -440,10 +1006,45 @@ func PutThermostat(req *fasthttp.RequestCtx) {
 	// retrieve our target thermostat found by the id provided in the query string
 	target := req.UserValue("thermostat").(*thermostat)
 
-	// update the thermostat once all data has been validated
-	home.UpdateThermostat(target, desired)
+	// users restricted to a range of setpoints can't set any outside of it
+	if errRes := checkUserRange(requestUser(req), desired.HeatSetPoint, desired.CoolSetPoint); errRes != nil {
+		req.SetStatusCode(http.StatusForbidden)
+		sendJSON(req, errRes)
+		return
+	}
+
+	// disabled thermostats can't be controlled until they are enabled again
+	if errRes := checkDisabled(target, desired); errRes != nil {
+		req.SetStatusCode(http.StatusConflict)
+		sendJSON(req, errRes)
+		return
+	}
+
+	// updates of a thermostat whose device is offline wait for it to reconnect
+	if target.Offline {
+		queueOffline(req, target, desired)
+		return
+	}
+
+	// update the thermostat once all data has been validated, leaving the devices to catch up in a job when
+	// the client asked not to wait for them
+	if wantsAsync(req) {
+		j, err := jobs.run(target.ID, func() (*thermostat, error) { return home.UpdateThermostat(target, desired) })
+		if err != nil {
+			sendCommitError(req, err)
+			return
+		}
+		sendJob(req, j)
+		return
+	}
+	updated, commitErr := home.UpdateThermostat(target, desired)
+	if commitErr != nil {
+		sendCommitError(req, commitErr)
+		return
+	}
 
 	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
 }
 
 // PostThermostat is the handler to add a new thermostat to the home
@@ -451,7 +1052,7 @@ func PostThermostat(req *fasthttp.RequestCtx) {
 
 	// verify json body was valid to api spec
 	var desired updateThermostat
-	if err := json.Unmarshal(req.PostBody(), &desired); err != nil {
+	if err := unmarshalStrict(req.PostBody(), &desired); err != nil {
 		res := &errResponse{
 			Code:        http.StatusBadRequest,
 			Msg:         "Invalid JSON body provided",
@@ -470,8 +1071,19 @@ func PostThermostat(req *fasthttp.RequestCtx) {
 		return
 	}
 
+	// users restricted to a range of setpoints can't set any outside of it
+	if errRes := checkUserRange(requestUser(req), desired.HeatSetPoint, desired.CoolSetPoint); errRes != nil {
+		req.SetStatusCode(http.StatusForbidden)
+		sendJSON(req, errRes)
+		return
+	}
+
 	// add new thermostat based on the desired state given
-	newID := home.AddThermostat(desired)
+	newID, commitErr := home.AddThermostat(desired)
+	if commitErr != nil {
+		sendCommitError(req, commitErr)
+		return
+	}
 
 	newThermostat, err := home.Thermostat(newID)
 	if err != nil {
@@ -480,28 +1092,566 @@ func PostThermostat(req *fasthttp.RequestCtx) {
 		return
 	}
 
-	req.SetStatusCode(http.StatusOK)
-
-	// send back the new thermostat so the client has access to the new id
+	// send back the new thermostat and where it lives so the client has access to the new id
+	req.Response.Header.Set("Location", "/v1/thermostats/"+strconv.Itoa(newID))
+	req.SetStatusCode(http.StatusCreated)
 	sendJSON(req, newThermostat)
 }
 
+// DeleteThermostat is the handler to remove a thermostat from the home. Its id is never given to another
+// thermostat while the server runs, so clients holding on to it can't end up writing to a different one
+func DeleteThermostat(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	if err := home.RemoveThermostat(t); err != nil {
+		res := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to remove thermostat",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, res)
+		return
+	}
+
+	req.SetStatusCode(http.StatusNoContent)
+}
+
 func main() {
+	flag.Parse()
+	serve()
+}
+
+// serve runs a server with the configuration given on the command line, blocking until a listener fails
+func serve() {
+	s, err := NewServer(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := s.Start(); err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Fatalln(s.Wait())
+}
+
+// Server is a single instance of the api. The thermostats and the services behind the api are shared by the
+// whole process, so a new server starts over from the default thermostats and only one should run at a time.
+// Everything a server runs in the background, the event dispatcher included, ends with Shutdown, so the next
+// server starts over without anything of the last one still running
+type Server struct {
+	replica *replicaSync
+	influx  *influxExporter
+	raft    *raftStore
+	secrets secretSource
+
+	addrs    []string
+	syncAddr string
+	stop     chan struct{}
+	errs     chan error
+	serving  sync.WaitGroup
+	shutdown sync.Once
+}
 
-	// initialize router
-	r := fasthttprouter.New()
+// resetState puts the thermostats and the services behind the api back into the state of a fresh start
+func resetState() {
+	clock.reset()
+	// a fresh start gives out the ids after the default thermostats again
+	home.Lock()
+	home.lastID = 0
+	home.Unlock()
+	home.replace(defaultThermostats())
+	cluster = standalone{}
+	replication = nil
+	agent = nil
+	wal = nil
+	publishers.reset()
+
+	readOnly.SetMode(readOnlyMode{}, "")
+	sessions.reset()
+	chaos.SetSettings(chaosSettings{})
+	anomalies.reset()
+	breakers.reset()
+	commands.reset()
+	jobs.reset()
+	hvacStats.reset()
+	actions.reset()
+	holidays.reset()
+	groups.reset()
+	history.reset()
+	receipts.reset()
+	onCall.reset()
+	installers.reset()
+	logLevel.reset()
+	recording.reset()
+	secrets.reset()
+	integrationRouter.reset()
+	pairing.reset()
+	offlineWrites.reset()
+	alerts.reset()
+	notifications.reset()
+	deliveryLog.reset()
+	deadLetters.reset()
+	forecast.reset()
+	ifttt.reset()
+	fleet.reset()
+}
+
+// NewServer prepares a server with the given configuration, restoring its state and connecting to every
+// configured service. Nothing is served until the server is started
+func NewServer(c config) (*Server, error) {
+	// load the secrets first, as they take part in the configuration
+	src, err := newSecretSource(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.SecretsRefresh < 0 {
+		return nil, errors.New("-secrets-refresh can't be negative")
+	}
+	var secretsVersion string
+	if src != nil {
+		if secretsVersion, err = loadSecrets(&c, src); err != nil {
+			return nil, errors.New("failed to load the secrets from " + src.Name() + " with error: " + err.Error())
+		}
+	}
+
+	if c.Server != "fasthttp" && c.Server != "nethttp" {
+		return nil, errors.New("invalid server: " + c.Server + " - valid choices are 'fasthttp' or 'nethttp'")
+	}
+	if c.OverheatAction != "cool" && c.OverheatAction != "off" {
+		return nil, errors.New("invalid overheat action: " + c.OverheatAction + " - valid choices are 'cool' or 'off'")
+	}
+	if (c.ClusterEtcd != "" && c.RaftAddr != "") || (c.ReplicaOf != "" && (c.ClusterEtcd != "" || c.RaftAddr != "")) {
+		return nil, errors.New("only one of -cluster-etcd, -raft-addr and -replica-of can be used")
+	}
+	if c.WALFile != "" && (c.RaftAddr != "" || c.ReplicaOf != "") {
+		return nil, errors.New("-wal-file can't be used with -raft-addr or -replica-of, which get their state from the cluster")
+	}
+
+	if c.BreakerFailures < 0 || c.BreakerCooldown < 0 || c.BreakerTimeout < 0 {
+		return nil, errors.New("-breaker-failures, -breaker-cooldown and -breaker-timeout can't be negative")
+	}
+	if c.DeviceAttempts < 1 || c.DeviceRetryBase < 0 || c.DeviceRetryMax < c.DeviceRetryBase {
+		return nil, errors.New("-device-attempts must be at least 1 and -device-retry-max at least -device-retry-base")
+	}
+	if c.OfflineTTL < 0 {
+		return nil, errors.New("-offline-ttl can't be negative")
+	}
+	if c.PairingTTL <= 0 {
+		return nil, errors.New("-pairing-ttl must be positive")
+	}
+	if _, err := parseMetricLabels(c.MetricsLabels); err != nil {
+		return nil, err
+	}
+	if c.MetricsMaxThermostats < 0 {
+		return nil, errors.New("-metrics-max-thermostats can't be negative")
+	}
+	if c.DeliveryAttempts < 1 || c.DeliveryRetryBase < 0 || c.DeliveryRetryMax < c.DeliveryRetryBase {
+		return nil, errors.New("-delivery-attempts must be at least 1 and -delivery-retry-max at least -delivery-retry-base")
+	}
+	if c.ForecastURL != "" && c.ForecastInterval <= 0 {
+		return nil, errors.New("-forecast-interval must be positive")
+	}
+	if c.EquipmentInterval < 0 || c.EquipmentDegradation < 0 || c.EquipmentMaxCycle < 0 {
+		return nil, errors.New("-equipment-interval, -equipment-degradation and -equipment-max-cycle can't be negative")
+	}
+	if c.HVACMinOff < 0 {
+		return nil, errors.New("-hvac-min-off can't be negative")
+	}
+	if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+		return nil, errors.New("-latitude must be within -90 and 90 and -longitude within -180 and 180")
+	}
+	if c.SecondStageDelta < 0 {
+		return nil, errors.New("-second-stage-delta can't be negative")
+	}
+	if c.JournalSize < 0 {
+		return nil, errors.New("-journal-size can't be negative")
+	}
+	if c.BoostDuration <= 0 || c.BoostDuration > c.MaxBoostDuration {
+		return nil, errors.New("-boost-duration must be positive and no longer than -max-boost-duration")
+	}
+	if c.FanTimerDuration <= 0 || c.FanTimerDuration > c.MaxFanTimerDuration {
+		return nil, errors.New("-fan-timer-duration must be positive and no longer than -max-fan-timer-duration")
+	}
+	if c.JobTTL <= 0 {
+		return nil, errors.New("-job-ttl must be positive")
+	}
+	if c.RetainHistory < 0 || c.RetainAudit < 0 || c.RetainNotifications < 0 {
+		return nil, errors.New("-retain-history, -retain-audit and -retain-notifications can't be negative")
+	}
+	if c.TelegramToken != "" && c.TelegramSecret == "" {
+		return nil, errors.New("-telegram-secret must be given with -telegram-token, or anyone could post commands to the bot")
+	}
+	if _, ok := discordKey(c.DiscordPublicKey); !ok && c.DiscordPublicKey != "" {
+		return nil, errors.New("-discord-public-key must be the hex encoded ed25519 public key of the discord application")
+	}
+	if c.SyncCentral != "" && c.SyncBuffer < 1 {
+		return nil, errors.New("-sync-buffer must be at least 1")
+	}
+	if c.SyncTLS && c.SyncListen != "" && (c.TLSCert == "" || c.TLSKey == "") {
+		return nil, errors.New("-sync-tls needs -tls-cert and -tls-key to serve the sync streams with")
+	}
+	if c.ClockSpeed < 0 || c.ClockSpeed > maxClockSpeed {
+		return nil, errors.New("-clock-speed must be from 0 to " + strconv.Itoa(maxClockSpeed))
+	}
+	if err := validateLimits(c); err != nil {
+		return nil, err
+	}
 
-	// build router specs
-	r.GET("/", Index)
-	r.GET("/v1/thermostats", HandleRoute(GetThermostats))
-	r.GET("/v1/thermostats/:id", HandleRoute(GetThermostat))
-	r.GET("/v1/thermostats/:id/:field", HandleRoute(GetField))
-	r.PUT("/v1/thermostats/:id", HandleRoute(PutThermostat))
-	r.POST("/v1/thermostats", HandleRoute(PostThermostat))
+	cfg = c
+	resetState()
+	if cfg.ClockSpeed != 1 {
+		clock.SetSpeed(cfg.ClockSpeed)
+	}
+	s := &Server{
+		secrets: src,
+		stop:    make(chan struct{}),
+	}
+	if src != nil {
+		secrets.Loaded(src.Name(), secretsVersion, time.Now())
+	}
+
+	// report panics and internal errors to sentry
+	if cfg.SentryDSN != "" {
+		if err := initSentry(cfg.SentryDSN, cfg.SentryEnvironment); err != nil {
+			return nil, errors.New("failed to initialize sentry with error: " + err.Error())
+		}
+	}
 
-	// serve api on port 8080
-	log.Println("Serving on port :8080")
-	if err := fasthttp.ListenAndServe(":8080", r.Handler); err != nil {
-		log.Fatalln("failed to serve on port :8080 with error:", err)
+	// restore the read-only mode from before the last restart
+	if cfg.ReadOnlyFile != "" {
+		if err := readOnly.load(cfg.ReadOnlyFile); err != nil {
+			return nil, errors.New("failed to load read-only mode from " + cfg.ReadOnlyFile + " with error: " + err.Error())
+		}
+	}
+
+	// restore the holiday calendar and the scheduled actions that follow it from before the last restart
+	if cfg.HolidaysFile != "" {
+		if err := holidays.load(cfg.HolidaysFile); err != nil {
+			return nil, errors.New("failed to load the holiday calendar from " + cfg.HolidaysFile + " with error: " + err.Error())
+		}
+	}
+	if cfg.GroupsFile != "" {
+		if err := groups.load(cfg.GroupsFile); err != nil {
+			return nil, errors.New("failed to load the thermostat groups from " + cfg.GroupsFile + " with error: " + err.Error())
+		}
 	}
+	if cfg.OnCallFile != "" {
+		if err := onCall.load(cfg.OnCallFile); err != nil {
+			return nil, errors.New("failed to load the on-call rotation from " + cfg.OnCallFile + " with error: " + err.Error())
+		}
+	}
+	if cfg.InstallersFile != "" {
+		if err := installers.load(cfg.InstallersFile); err != nil {
+			return nil, errors.New("failed to load the installers from " + cfg.InstallersFile + " with error: " + err.Error())
+		}
+	}
+	if cfg.ReceiptsFile != "" {
+		if err := receipts.load(cfg.ReceiptsFile); err != nil {
+			return nil, errors.New("failed to load the deletion receipts from " + cfg.ReceiptsFile + " with error: " + err.Error())
+		}
+	}
+	if cfg.HistoryFile != "" {
+		if err := history.load(cfg.HistoryFile); err != nil {
+			return nil, errors.New("failed to load the imported history from " + cfg.HistoryFile + " with error: " + err.Error())
+		}
+	}
+	if cfg.NotificationsFile != "" {
+		if err := notifications.load(cfg.NotificationsFile); err != nil {
+			return nil, errors.New("failed to load the notification preferences from " + cfg.NotificationsFile + " with error: " + err.Error())
+		}
+	}
+	if cfg.ActionsFile != "" {
+		if err := actions.load(cfg.ActionsFile); err != nil {
+			return nil, errors.New("failed to load the scheduled actions from " + cfg.ActionsFile + " with error: " + err.Error())
+		}
+	}
+
+	// load the api users, which turns on authentication for every route behind HandleRoute
+	if cfg.UsersFile != "" {
+		if err := sessions.loadUsers(cfg.UsersFile); err != nil {
+			return nil, errors.New("failed to load users from " + cfg.UsersFile + " with error: " + err.Error())
+		}
+	}
+
+	// join the cluster to find out whether this node leads, replicating the thermostats when using raft
+	if cfg.ReplicaOf != "" {
+		s.replica = newReplicaSync(cfg.ReplicaOf, cfg.ReplicaUser, cfg.ReplicaPassword)
+		cluster = s.replica
+	}
+	if cfg.RaftAddr != "" {
+		node, err := advertisedNode()
+		if err != nil {
+			return nil, errors.New("failed to determine the cluster node address with error: " + err.Error())
+		}
+		peers, err := parseRaftPeers(cfg.RaftPeers)
+		if err != nil {
+			return nil, errors.New("failed to parse -raft-peers with error: " + err.Error())
+		}
+		s.raft, err = newRaftStore(node, cfg.RaftAddr, cfg.RaftDir, peers)
+		if err != nil {
+			return nil, errors.New("failed to start raft with error: " + err.Error())
+		}
+		cluster = s.raft
+		replication = s.raft
+	}
+	if cfg.ClusterEtcd != "" {
+		node, err := advertisedNode()
+		if err != nil {
+			return nil, errors.New("failed to determine the cluster node address with error: " + err.Error())
+		}
+		e, err := newEtcdElector(strings.Split(cfg.ClusterEtcd, ","), "/thermostat/"+cfg.Home+"/leader", node)
+		if err != nil {
+			return nil, errors.New("failed to connect to etcd with error: " + err.Error())
+		}
+		cluster = e
+	}
+
+	// restore the thermostats from the write-ahead log. Replicated nodes get their state from the cluster
+	if cfg.WALFile != "" {
+		w, err := openWAL(cfg.WALFile, cfg.WALCompactAfter, &home)
+		if err != nil {
+			return nil, errors.New("failed to replay the write-ahead log " + cfg.WALFile + " with error: " + err.Error())
+		}
+		wal = w
+	}
+
+	// hook up the configured event publishers, always including the json-rpc websocket subscribers. Every
+	// publisher outside of the process goes through a circuit breaker, the device drivers through their own
+	// as they queue commands for every device
+	ps := []publisher{rpcSubscribers}
+	if cfg.IFTTTServiceKey != "" {
+		ps = append(ps, ifttt)
+	}
+	if cfg.KafkaBrokers != "" {
+		ps = append(ps, guard("kafka", newKafkaPublisher(strings.Split(cfg.KafkaBrokers, ","), cfg.KafkaTopicPrefix)))
+	}
+	if cfg.NATSURL != "" {
+		n, err := newNATSPublisher(cfg.NATSURL, cfg.NATSSubjectPrefix)
+		if err != nil {
+			return nil, errors.New("failed to connect to nats with error: " + err.Error())
+		}
+		ps = append(ps, guard("nats", n))
+	}
+	if cfg.AMQPURL != "" {
+		a, err := newAMQPPublisher(cfg.AMQPURL, cfg.AMQPExchange, cfg.AMQPRoutingKey, cfg.Home)
+		if err != nil {
+			return nil, errors.New("failed to connect to rabbitmq with error: " + err.Error())
+		}
+		ps = append(ps, guard("amqp", a))
+	}
+	if cfg.AWSIoTEndpoint != "" {
+		sh, err := newShadowSync(cfg.AWSIoTEndpoint, cfg.AWSIoTClientID, cfg.AWSIoTCert, cfg.AWSIoTKey, cfg.AWSIoTCA, cfg.AWSIoTThingPrefix)
+		if err != nil {
+			return nil, errors.New("failed to connect to aws iot with error: " + err.Error())
+		}
+		ps = append(ps, sh)
+	}
+	if cfg.DeviceBroker != "" {
+		d, err := newDeviceBridge(cfg.DeviceBroker, cfg.DeviceClientID, cfg.DeviceTopicPrefix)
+		if err != nil {
+			return nil, errors.New("failed to connect to the device broker with error: " + err.Error())
+		}
+		ps = append(ps, d)
+	}
+
+	// sync the state and telemetry of this site to the central instance of the fleet. The agent buffers
+	// the events it can't send yet on its own, so it isn't guarded by a circuit breaker
+	if cfg.SyncCentral != "" {
+		site := cfg.SyncSite
+		if site == "" {
+			site = cfg.Home
+		}
+		agent = newSyncAgent(cfg.SyncCentral, site, cfg.SyncToken, cfg.SyncTLS, cfg.SyncBuffer)
+		ps = append(ps, agent)
+	}
+	publishers.Set(ps)
+
+	// export telemetry to influxdb
+	if cfg.InfluxURL != "" {
+		s.influx = newInfluxExporter(cfg.InfluxURL, cfg.InfluxOrg, cfg.InfluxBucket, cfg.InfluxToken)
+	}
+
+	return s, nil
+}
+
+// Handler returns the handler of every route of the api, for serving the server on a listener of your own
+// or calling it directly
+func (s *Server) Handler() fasthttp.RequestHandler {
+	return newRouter(listenerSpec{}).Handler
+}
+
+// Start opens every configured listener and serves the api on them in the background. Use an address with
+// port 0 to serve on a random port, which Addrs tells
+func (s *Server) Start() error {
+	// run the background work of the server until it's shut down
+	if s.replica != nil {
+		s.background(func() { s.replica.run(s.stop) })
+	}
+	if agent != nil {
+		a := agent
+		s.background(func() { a.run(s.stop) })
+	}
+	policy := deliveryPolicy(cfg)
+	s.background(func() { dispatchEvents(policy, s.stop) })
+	if wal != nil {
+		outbox := wal.outbox
+		s.background(func() { outbox.drain(s.stop) })
+	}
+	if cfg.TelemetryInterval > 0 {
+		s.background(func() { publishTelemetry(cfg.TelemetryInterval, s.stop) })
+	}
+	if s.influx != nil {
+		s.background(func() { s.influx.run(cfg.InfluxInterval, s.stop) })
+	}
+	if cfg.HVACMinOff > 0 {
+		s.background(func() { releaseLockouts(lockoutInterval, s.stop) })
+	}
+	if cfg.EquipmentInterval > 0 {
+		s.background(func() { analyzeAllEquipment(cfg.EquipmentInterval, s.stop) })
+	}
+	s.background(func() { runActions(actionInterval, s.stop) })
+	s.background(func() { endBoosts(boostInterval, s.stop) })
+	s.background(func() { endFanTimers(fanTimerInterval, s.stop) })
+	s.background(func() { runQuietHours(quietInterval, s.stop) })
+	s.background(func() { runSleep(sleepInterval, s.stop) })
+	s.background(func() { runPrecondition(preconditionInterval, s.stop) })
+	if cfg.ForecastURL != "" {
+		s.background(func() { runForecast(cfg.ForecastInterval, s.stop) })
+	}
+	s.background(func() { runDigests(digestInterval, s.stop) })
+	if s.secrets != nil && cfg.SecretsRefresh > 0 {
+		src := s.secrets
+		s.background(func() { runSecretRotation(src, cfg.SecretsRefresh, s.stop) })
+	}
+	if cfg.RetainHistory > 0 || cfg.RetainAudit > 0 || cfg.RetainNotifications > 0 {
+		s.background(func() { runRetention(retentionInterval, s.stop) })
+	}
+	s.background(func() { deliverNotifications(policy, s.stop) })
+	s.background(func() { sweepSessions(sessionSweepInterval, s.stop) })
+
+	// take over the sockets when started through systemd socket activation
+	activated, err := loadActivatedSockets()
+	if err != nil {
+		return errors.New("failed to take over the sockets passed in by systemd with error: " + err.Error())
+	}
+
+	// serve api on every configured listener, or else on every socket passed in by systemd, or else on the
+	// configured address
+	listeners := cfg.Listeners
+	if len(listeners) == 0 {
+		for _, name := range activated {
+			listeners = append(listeners, listenerSpec{Addr: "systemd:" + name})
+		}
+	}
+	if len(listeners) == 0 {
+		listeners = listenerFlags{{Addr: cfg.Addr}}
+	}
+
+	// serve api over tls with http/2 and http/3 alongside the main listener
+	s.errs = make(chan error, len(listeners)+2)
+	if cfg.TLSAddr != "" {
+		log.Println("Serving tls on port " + cfg.TLSAddr)
+		s.background(func() {
+			if err := serveTLS(cfg.TLSAddr, cfg.TLSCert, cfg.TLSKey, cfg.HTTP3, s.stop); err != nil {
+				s.errs <- errors.New("failed to serve tls on port " + cfg.TLSAddr + " with error: " + err.Error())
+			}
+		})
+	}
+
+	for _, l := range listeners {
+		ln, err := l.listen()
+		if err != nil {
+			s.Shutdown()
+			return errors.New("failed to listen on port " + l.Addr + " with error: " + err.Error())
+		}
+		s.addrs = append(s.addrs, ln.Addr().String())
+
+		log.Println("Serving on port " + ln.Addr().String() + " with " + cfg.Server)
+		l := l
+		s.background(func() {
+			if err := serveListener(l, ln, s.stop); err != nil {
+				s.errs <- errors.New("failed to serve on port " + l.Addr + " with error: " + err.Error())
+			}
+		})
+	}
+
+	// accept the sync streams of the agents of the fleet
+	if cfg.SyncListen != "" {
+		ln, err := net.Listen("tcp", cfg.SyncListen)
+		if err != nil {
+			s.Shutdown()
+			return errors.New("failed to listen for sync streams on port " + cfg.SyncListen + " with error: " + err.Error())
+		}
+		s.syncAddr = ln.Addr().String()
+
+		log.Println("Serving sync streams on port " + s.syncAddr)
+		s.background(func() {
+			if err := serveSync(ln, s.stop); err != nil {
+				s.errs <- errors.New("failed to serve sync streams on port " + cfg.SyncListen + " with error: " + err.Error())
+			}
+		})
+	}
+
+	// every listener is open, so let systemd know the service is ready
+	if err := sdNotify("READY=1"); err != nil {
+		log.Println("failed to notify systemd of readiness with error:", err)
+	}
+	s.background(func() { sdWatchdog(s.stop) })
+
+	return nil
+}
+
+// background runs f until the server is shut down
+func (s *Server) background(f func()) {
+	s.serving.Add(1)
+	go func() {
+		defer s.serving.Done()
+		f()
+	}()
+}
+
+// Addrs returns the addresses the server is listening on, in the order of the configured listeners
+func (s *Server) Addrs() []string {
+	return s.addrs
+}
+
+// SyncAddr returns the address the sync streams of the agents are accepted on, if any
+func (s *Server) SyncAddr() string {
+	return s.syncAddr
+}
+
+// Wait blocks until a listener fails, returning its error, or until the server is shut down
+func (s *Server) Wait() error {
+	select {
+	case err := <-s.errs:
+		return err
+	case <-s.stop:
+		return nil
+	}
+}
+
+// Shutdown stops serving, stops the background work and closes the write-ahead log and raft. The
+// connections to the event publishers and etcd live as long as the process
+func (s *Server) Shutdown() error {
+	var err error
+	s.shutdown.Do(func() {
+		close(s.stop)
+		// the listeners wait for the open event streams to end before they stop
+		eventStreams.closeAll()
+		s.serving.Wait()
+		commands.reset()
+
+		if wal != nil {
+			err = wal.Close()
+		}
+		if s.raft != nil {
+			if raftErr := s.raft.Close(); raftErr != nil && err == nil {
+				err = raftErr
+			}
+		}
+	})
+
+	return err
 }
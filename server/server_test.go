@@ -5,13 +5,69 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
 )
 
-func init() {
-	// start webserver to be used in unit tests
-	go main()
+// newTestServer starts a server of its own for the test on a random port and returns its base url. The
+// server starts from the default thermostats and is shut down when the test ends. configure changes the
+// configuration before the server starts
+// testServer is the test server started last. The state behind the api is shared by the whole process, so
+// it's shut down before the next one starts
+var testServer *Server
+
+func newTestServer(t testing.TB, configure ...func(c *config)) string {
+	c := defaultConfig()
+	c.Addr = "127.0.0.1:0"
+	c.ReadOnlyFile = filepath.Join(t.TempDir(), "readonly.json")
+	c.ActionsFile = filepath.Join(t.TempDir(), "actions.json")
+	c.HolidaysFile = filepath.Join(t.TempDir(), "holidays.json")
+	c.NotificationsFile = filepath.Join(t.TempDir(), "notifications.json")
+	c.GroupsFile = filepath.Join(t.TempDir(), "groups.json")
+	c.HistoryFile = filepath.Join(t.TempDir(), "history.json")
+	c.OnCallFile = filepath.Join(t.TempDir(), "oncall.json")
+	c.InstallersFile = filepath.Join(t.TempDir(), "installers.json")
+	c.ReceiptsFile = filepath.Join(t.TempDir(), "receipts.json")
+	for _, f := range configure {
+		f(&c)
+	}
+
+	if testServer != nil {
+		if err := testServer.Shutdown(); err != nil {
+			t.Errorf("failed to shut down the last server: %s", err)
+		}
+	}
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatalf("failed to create the server: %s", err)
+	}
+	testServer = s
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start the server: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := s.Shutdown(); err != nil {
+			t.Errorf("failed to shut down the server: %s", err)
+		}
+	})
+
+	return "http://" + s.Addrs()[0]
+}
+
+// addThermostat adds a thermostat to the home, failing the test when it can't be committed
+func addThermostat(t testing.TB, desired updateThermostat) int {
+	t.Helper()
+	id, err := home.AddThermostat(desired)
+	if err != nil {
+		t.Fatalf("failed to add the thermostat: %s", err)
+	}
+	return id
 }
 
 func get(url string, t *testing.T, v interface{}) {
@@ -44,14 +100,16 @@ func get(url string, t *testing.T, v interface{}) {
 }
 
 func TestGetThermostats(t *testing.T) {
+	base := newTestServer(t)
 	var th []*thermostat
-	get("http://localhost:8080/v1/thermostats", t, &th)
+	get(base+"/v1/thermostats", t, &th)
 	if len(th) < 2 {
 		t.Fatalf("received unexpected number of thermostats, expected %d, got %d", 2, len(th))
 	}
 }
 
 func TestGetThermostat(t *testing.T) {
+	base := newTestServer(t)
 	cases := map[string]struct {
 		num string
 	}{
@@ -61,7 +119,7 @@ func TestGetThermostat(t *testing.T) {
 
 	for key, tc := range cases {
 		var th *thermostat
-		get("http://localhost:8080/v1/thermostats/"+tc.num, t, &th)
+		get(base+"/v1/thermostats/"+tc.num, t, &th)
 		if th == nil {
 			t.Fatalf("[%s]: thermostat received was nil", key)
 		}
@@ -69,6 +127,7 @@ func TestGetThermostat(t *testing.T) {
 }
 
 func TestGetField(t *testing.T) {
+	base := newTestServer(t)
 	stringCases := map[string]struct {
 		field, num, expected string
 	}{
@@ -82,7 +141,7 @@ func TestGetField(t *testing.T) {
 
 	for key, tc := range stringCases {
 		var s string
-		get("http://localhost:8080/v1/thermostats/"+tc.num+"/"+tc.field, t, &s)
+		get(base+"/v1/thermostats/"+tc.num+"/"+tc.field, t, &s)
 		if s != tc.expected {
 			t.Fatalf("[%s]: received field '%s' is incorrect. expected %s, got %s", key, tc.field, tc.expected, s)
 		}
@@ -102,20 +161,21 @@ func TestGetField(t *testing.T) {
 
 	for key, tc := range intCases {
 		var i int
-		get("http://localhost:8080/v1/thermostats/"+tc.num+"/"+tc.field, t, &i)
+		get(base+"/v1/thermostats/"+tc.num+"/"+tc.field, t, &i)
 		if i != tc.expected {
 			t.Fatalf("[%s]: received field '%s' is incorrect. expected %d, got %d", key, tc.field, tc.expected, i)
 		}
 	}
 
 	err := new(errResponse)
-	get("http://localhost:8080/v1/thermostats/1/other", t, &err)
+	get(base+"/v1/thermostats/1/other", t, &err)
 	if err == nil {
 		t.Fatal("err response expected was empty")
 	}
 }
 
 func TestPutThermostatBulk(t *testing.T) {
+	base := newTestServer(t)
 	jsn := `{
 		"name": "Other Thermostat",
 		"coolSetPoint": 74,
@@ -125,7 +185,7 @@ func TestPutThermostatBulk(t *testing.T) {
 	}`
 
 	client := http.Client{}
-	req, err := http.NewRequest("PUT", "http://localhost:8080/v1/thermostats/1", bytes.NewBuffer([]byte(jsn)))
+	req, err := http.NewRequest("PUT", base+"/v1/thermostats/1", bytes.NewBuffer([]byte(jsn)))
 	if err != nil {
 		t.Fatalf("failed to create new PUT request: %s", err)
 	}
@@ -137,8 +197,13 @@ func TestPutThermostatBulk(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
+	var updated thermostat
+	if err := json.NewDecoder(resp.Body).Decode(&updated); err != nil || updated.Name != "Other Thermostat" {
+		t.Fatalf("expected the updated thermostat to be returned, got %+v (%v)", updated, err)
+	}
+
 	var th *thermostat
-	get("http://localhost:8080/v1/thermostats/1", t, &th)
+	get(base+"/v1/thermostats/1", t, &th)
 
 	if th.Name != "Other Thermostat" {
 		t.Fatalf("expected name to be %s, got %s", "Other Thermostat", th.Name)
@@ -158,6 +223,7 @@ func TestPutThermostatBulk(t *testing.T) {
 }
 
 func TestPutThermostatSingle(t *testing.T) {
+	base := newTestServer(t)
 	stringCases := map[string]struct {
 		field, num, val string
 	}{
@@ -173,7 +239,7 @@ func TestPutThermostatSingle(t *testing.T) {
 	for key, tc := range stringCases {
 		b := []byte(`{"` + tc.field + `": "` + tc.val + `"}`)
 		client := http.Client{}
-		req, err := http.NewRequest("PUT", "http://localhost:8080/v1/thermostats/"+tc.num, bytes.NewBuffer(b))
+		req, err := http.NewRequest("PUT", base+"/v1/thermostats/"+tc.num, bytes.NewBuffer(b))
 		if err != nil {
 			t.Fatalf("[%s]: failed to create new PUT request: %s", key, err)
 		}
@@ -186,7 +252,7 @@ func TestPutThermostatSingle(t *testing.T) {
 		resp.Body.Close()
 
 		var s string
-		get("http://localhost:8080/v1/thermostats/"+tc.num+"/"+tc.field, t, &s)
+		get(base+"/v1/thermostats/"+tc.num+"/"+tc.field, t, &s)
 		if s != tc.val || s == "" {
 			t.Fatalf("[%s]: setting field: '%s' failed, expected '%s', got '%s'", key, tc.field, tc.val, s)
 		}
@@ -205,7 +271,7 @@ func TestPutThermostatSingle(t *testing.T) {
 	for key, tc := range intCases {
 		b := []byte(`{"` + tc.field + `": ` + strconv.Itoa(tc.val) + `}`)
 		client := http.Client{}
-		req, err := http.NewRequest("PUT", "http://localhost:8080/v1/thermostats/"+tc.num, bytes.NewBuffer(b))
+		req, err := http.NewRequest("PUT", base+"/v1/thermostats/"+tc.num, bytes.NewBuffer(b))
 		if err != nil {
 			t.Fatalf("[%s]: failed to create new PUT request: %s", key, err)
 		}
@@ -218,7 +284,7 @@ func TestPutThermostatSingle(t *testing.T) {
 		resp.Body.Close()
 
 		var i int
-		get("http://localhost:8080/v1/thermostats/"+tc.num+"/"+tc.field, t, &i)
+		get(base+"/v1/thermostats/"+tc.num+"/"+tc.field, t, &i)
 		if i != tc.val || i == 0 {
 			t.Fatalf("[%s]: setting field: '%s' failed, expected %d, got %d", key, tc.field, tc.val, i)
 		}
@@ -234,7 +300,7 @@ func TestPutThermostatSingle(t *testing.T) {
 	for key, tc := range errStringCases {
 		b := []byte(`{"` + tc.field + `": "` + tc.val + `"}`)
 		client := http.Client{}
-		req, err := http.NewRequest("PUT", "http://localhost:8080/v1/thermostats/1", bytes.NewBuffer(b))
+		req, err := http.NewRequest("PUT", base+"/v1/thermostats/1", bytes.NewBuffer(b))
 		if err != nil {
 			t.Fatalf("[%s]: failed to create new PUT request: %s", key, err)
 		}
@@ -267,6 +333,7 @@ func TestPutThermostatSingle(t *testing.T) {
 }
 
 func TestPostThermostat(t *testing.T) {
+	base := newTestServer(t)
 	jsn := `{
 		"name": "Basement Thermostat",
 		"coolSetPoint": 72,
@@ -276,7 +343,7 @@ func TestPostThermostat(t *testing.T) {
 	}`
 
 	client := http.Client{}
-	req, err := http.NewRequest("POST", "http://localhost:8080/v1/thermostats", bytes.NewBuffer([]byte(jsn)))
+	req, err := http.NewRequest("POST", base+"/v1/thermostats", bytes.NewBuffer([]byte(jsn)))
 	if err != nil {
 		t.Fatalf("failed to create new POST request: %s", err)
 	}
@@ -298,9 +365,12 @@ func TestPostThermostat(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to unmarshal response body into thermostat: %s", err)
 	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/v1/thermostats/"+strconv.Itoa(th.ID) {
+		t.Fatalf("expected status %d with the location of the new thermostat, got %d %q", http.StatusCreated, resp.StatusCode, resp.Header.Get("Location"))
+	}
 
 	var thCheck *thermostat
-	get("http://localhost:8080/v1/thermostats/"+strconv.Itoa(th.ID), t, &thCheck)
+	get(base+"/v1/thermostats/"+strconv.Itoa(th.ID), t, &thCheck)
 
 	if thCheck.Name != "Basement Thermostat" {
 		t.Fatalf("expected name to be %s, got %s", "Basement Thermostat", thCheck.Name)
@@ -318,3 +388,223 @@ func TestPostThermostat(t *testing.T) {
 		t.Fatalf("expected fan mode to be %s, got %s", "on", thCheck.FanMode)
 	}
 }
+
+func TestDeleteThermostat(t *testing.T) {
+	base := newTestServer(t)
+
+	id, _ := home.AddThermostat(updateThermostat{Name: "Garage Thermostat"})
+	url := base + "/v1/thermostats/" + strconv.Itoa(id)
+	token, _ := pairing.Token(id, time.Now())
+	if code := put(url+"/installation", `{"stages": 1}`, t); code != http.StatusOK {
+		t.Fatalf("expected the installation to be changed, got %d", code)
+	}
+
+	if _, err := history.Import(id, []runtimeRecord{{Start: time.Now().Add(-time.Hour), End: time.Now(), Source: "nest"}}); err != nil {
+		t.Fatalf("failed to import the history: %s", err)
+	}
+
+	// removing a thermostat doesn't need its device
+	target, _ := home.Thermostat(id)
+	home.SetOffline(target, true)
+	if len(alerts.Alerts("", id, "")) != 1 {
+		t.Fatal("expected the thermostat going offline to raise an alert")
+	}
+	if code := del(url, t, nil); code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+	var missing errResponse
+	if get(url, t, &missing); missing.Code != http.StatusNotFound {
+		t.Fatalf("expected the thermostat to be gone, got %+v", missing)
+	}
+	if code := del(url, t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d removing it again, got %d", http.StatusNotFound, code)
+	}
+
+	// what is kept about it elsewhere goes with it
+	if _, ok := pairing.Claim(token, "TH-0001", time.Now()); ok {
+		t.Fatal("expected the pairing token of the removed thermostat to be dropped")
+	}
+	if installerStages(id) != 2 {
+		t.Fatal("expected the installation of the removed thermostat to be dropped")
+	}
+	if len(history.History(id, time.Time{}, time.Time{}).Records) != 0 || len(alerts.Alerts("", id, "")) != 0 {
+		t.Fatal("expected the history and the alerts of the removed thermostat to be dropped")
+	}
+
+	// the id of a removed thermostat is never given out again, even when it was the highest
+	if next, _ := home.AddThermostat(updateThermostat{}); next != id+1 {
+		t.Fatalf("expected the new thermostat to get id %d, got %d", id+1, next)
+	}
+}
+
+func TestDeleteRacesUpdates(t *testing.T) {
+	newTestServer(t)
+
+	for i := 0; i < 50; i++ {
+		target, _ := home.Thermostat(addThermostat(t, updateThermostat{Name: "Porch"}))
+
+		// updates holding on to the thermostat they read race its removal, and must never bring it back
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for n := 0; n < 5; n++ {
+					if _, err := home.UpdateThermostat(target, updateThermostat{HeatSetPoint: 60 + w + n}); err != nil && err != errThermostatRemoved {
+						t.Errorf("expected the update to be made or rejected as removed, got %s", err)
+					}
+				}
+			}(w)
+		}
+		if err := home.RemoveThermostat(target); err != nil {
+			t.Fatalf("failed to remove the thermostat: %s", err)
+		}
+		wg.Wait()
+
+		if _, errRes := home.Thermostat(target.ID); errRes == nil {
+			t.Fatalf("expected thermostat %d to stay removed", target.ID)
+		}
+		if _, err := home.UpdateThermostat(target, updateThermostat{Name: "Back"}); err != errThermostatRemoved {
+			t.Fatalf("expected an update after the removal to be rejected, got %v", err)
+		}
+
+		// a change that was logged before the removal but applied after it, e.g. by a follower, is dropped
+		home.apply(newChange(changeUpdate, []*thermostat{target}))
+		if _, errRes := home.Thermostat(target.ID); errRes == nil {
+			t.Fatalf("expected applying an update of thermostat %d not to bring it back", target.ID)
+		}
+	}
+}
+
+func TestServerIsolation(t *testing.T) {
+	for _, server := range []string{"fasthttp", "nethttp"} {
+		c := defaultConfig()
+		c.Addr = "127.0.0.1:0"
+		c.Server = server
+		c.ReadOnlyFile = filepath.Join(t.TempDir(), "readonly.json")
+
+		s, err := NewServer(c)
+		if err != nil {
+			t.Fatalf("[%s]: failed to create the server: %s", server, err)
+		}
+		if err := s.Start(); err != nil {
+			t.Fatalf("[%s]: failed to start the server: %s", server, err)
+		}
+		base := "http://" + s.Addrs()[0]
+		home.AddThermostat(updateThermostat{Name: "Shed Thermostat"})
+
+		var th []*thermostat
+		get(base+"/v1/thermostats", t, &th)
+		if len(th) != 3 {
+			t.Fatalf("[%s]: expected 3 thermostats, got %d", server, len(th))
+		}
+
+		if err := s.Shutdown(); err != nil {
+			t.Fatalf("[%s]: failed to shut down the server: %s", server, err)
+		}
+		if err := s.Wait(); err != nil {
+			t.Fatalf("[%s]: expected no error after a shutdown, got %s", server, err)
+		}
+		if resp, err := http.Get(base + "/v1/thermostats"); err == nil {
+			resp.Body.Close()
+			t.Fatalf("[%s]: expected the server to stop serving after a shutdown", server)
+		}
+	}
+
+	// a new server starts over from the default thermostats
+	base := newTestServer(t)
+	var th []*thermostat
+	get(base+"/v1/thermostats", t, &th)
+	if len(th) != 2 {
+		t.Fatalf("expected a new server to start with the 2 default thermostats, got %d", len(th))
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	s, err := NewServer(defaultConfig())
+	if err != nil {
+		t.Fatalf("failed to create the server: %s", err)
+	}
+
+	var req fasthttp.RequestCtx
+	req.Request.SetRequestURI("/v1/thermostats/1/name")
+	s.Handler()(&req)
+
+	if req.Response.StatusCode() != http.StatusOK || string(req.Response.Body()) != `"`+defaultName1+`"` {
+		t.Fatalf("unexpected response from the handler: %d %s", req.Response.StatusCode(), req.Response.Body())
+	}
+
+	if _, err := NewServer(config{Server: "gin"}); err == nil {
+		t.Fatal("expected an unknown http server to be rejected")
+	}
+}
+
+func TestStreamThermostats(t *testing.T) {
+	for _, server := range []string{"fasthttp", "nethttp"} {
+		base := newTestServer(t, func(c *config) { c.Server = server })
+		for i := 0; i < streamMinThermostats; i++ {
+			home.AddThermostat(updateThermostat{Name: "Unit <" + strconv.Itoa(i) + ">"})
+		}
+
+		resp, err := http.Get(base + "/v1/thermostats")
+		if err != nil {
+			t.Fatalf("[%s]: request failed: %s", server, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("[%s]: body read failed: %s", server, err)
+		}
+
+		// the streamed list must be exactly what marshaling it in one go gives
+		expected, _ := json.Marshal(home.Thermostats())
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(b, expected) {
+			t.Fatalf("[%s]: expected the streamed list to match the marshaled one, got %d:\n%s", server, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	base := newTestServer(t)
+
+	req, _ := http.NewRequest("POST", base+"/v1/thermostats/1/name", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var res errResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusMethodNotAllowed || res.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d %+v (%v)", http.StatusMethodNotAllowed, resp.StatusCode, res, err)
+	}
+	allow := resp.Header.Get("Allow")
+	if !strings.Contains(allow, "GET") || !strings.Contains(allow, "DELETE") || strings.Contains(allow, "POST") {
+		t.Fatalf("expected GET and DELETE to be allowed, got %q", allow)
+	}
+}
+
+func TestInvalidIDShortCircuits(t *testing.T) {
+	base := newTestServer(t)
+	before, _ := home.Thermostat(1)
+
+	req, _ := http.NewRequest("PUT", base+"/v1/thermostats/one", bytes.NewBufferString(`{"name": "Attic Thermostat"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	// a single error is sent back and nothing is written
+	var res errResponse
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&res); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d %+v (%v)", http.StatusBadRequest, resp.StatusCode, res, err)
+	}
+	if dec.More() {
+		t.Fatalf("expected nothing to be sent after the error")
+	}
+	if after, _ := home.Thermostat(1); after.Name != before.Name || !after.LastChanged.Equal(before.LastChanged) {
+		t.Fatalf("expected no thermostat to be written, got %+v", after)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// shadowTimeout is how long to wait for aws iot to acknowledge a connect, publish or subscribe
+const shadowTimeout = 10 * time.Second
+
+// shadowDocument is the body of a shadow update carrying the reported state of a thermostat
+type shadowDocument struct {
+	State struct {
+		Reported *thermostat `json:"reported"`
+	} `json:"state"`
+}
+
+// shadowDelta is the body aws iot publishes whenever the desired state of a shadow differs from the
+// reported state
+type shadowDelta struct {
+	Version int             `json:"version"`
+	State   json.RawMessage `json:"state"`
+}
+
+// shadowSync mirrors every thermostat into an aws iot thing shadow named <prefix><id>. Changes made here are
+// written as the reported state, and desired-state deltas made in the cloud are applied back through the
+// same validation as the rest of the api
+type shadowSync struct {
+	client  mqtt.Client
+	prefix  string
+	breaker *breaker
+}
+
+// newShadowSync connects to the aws iot endpoint using the device certificate and key, reports the current
+// state of every thermostat and starts listening for deltas
+func newShadowSync(endpoint, clientID, certFile, keyFile, caFile, prefix string) (*shadowSync, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+
+	s := &shadowSync{
+		prefix:  prefix,
+		breaker: newBreaker("aws-iot"),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("ssl://" + endpoint + ":8883").
+		SetClientID(clientID).
+		SetTLSConfig(tlsCfg).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("lost connection to aws iot with error:", err)
+		}).
+		SetOnConnectHandler(s.onConnect)
+
+	s.client = mqtt.NewClient(opts)
+	if err := waitIoT(s.client.Connect()); err != nil {
+		return nil, err
+	}
+	commands.register("aws-iot")
+
+	return s, nil
+}
+
+// waitIoT blocks until the token completes or times out
+func waitIoT(token mqtt.Token) error {
+	if !token.WaitTimeout(shadowTimeout) {
+		return errors.New("timed out waiting for aws iot")
+	}
+	return token.Error()
+}
+
+// onConnect subscribes to the deltas of every shadow and reports the current state, so the shadows are
+// brought up to date after every (re)connect
+func (s *shadowSync) onConnect(c mqtt.Client) {
+	if err := waitIoT(c.Subscribe("$aws/things/+/shadow/update/delta", 1, s.handleDelta)); err != nil {
+		log.Println("failed to subscribe to aws iot shadow deltas with error:", err)
+	}
+
+	for _, t := range home.Thermostats() {
+		s.send(t)
+	}
+}
+
+// send queues the thermostat to be reported to its shadow, which is retried until aws iot takes it
+func (s *shadowSync) send(t *thermostat) {
+	sendCommand(s.breaker, t, "report", func() error { return s.report(t) })
+}
+
+// report writes the thermostat as the reported state of its shadow
+func (s *shadowSync) report(t *thermostat) error {
+	var doc shadowDocument
+	doc.State.Reported = t
+
+	jsn, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return waitIoT(s.client.Publish("$aws/things/"+s.prefix+strconv.Itoa(t.ID)+"/shadow/update", 1, false, jsn))
+}
+
+// Publish implements the publisher interface. Telemetry is left out since it never changes the state
+func (s *shadowSync) Publish(e event) error {
+	if e.Type != eventTelemetry {
+		s.send(e.Thermostat)
+	}
+	return nil
+}
+
+// handleDelta applies the desired state sent by aws iot to the matching thermostat
+func (s *shadowSync) handleDelta(_ mqtt.Client, msg mqtt.Message) {
+	// every node of a cluster receives the deltas, but only the leader applies them
+	if !cluster.IsLeader() {
+		return
+	}
+
+	// topics look like $aws/things/<thing>/shadow/update/delta
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) < 3 || !strings.HasPrefix(parts[2], s.prefix) {
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(parts[2], s.prefix))
+	if err != nil {
+		return
+	}
+
+	target, errRes := home.Thermostat(id)
+	if errRes != nil {
+		log.Println("ignoring aws iot delta for thing", parts[2], "-", errRes.Description)
+		return
+	}
+
+	// cloud writes are automated, so they are suspended while technicians work on the thermostat, and like
+	// any other write they are rejected while the service is read-only
+	if errRes := checkReadOnly(); errRes != nil {
+		log.Println("ignoring aws iot delta for thermostat", id, "-", errRes.Description)
+		return
+	}
+	if errRes := checkAutomatedWrite(target); errRes != nil {
+		log.Println("ignoring aws iot delta for thermostat", id, "-", errRes.Description)
+		return
+	}
+
+	var delta shadowDelta
+	if err := json.Unmarshal(msg.Payload(), &delta); err != nil {
+		log.Println("failed to unmarshal aws iot delta for thermostat", id, "with error:", err)
+		return
+	}
+
+	var desired updateThermostat
+	if err := json.Unmarshal(delta.State, &desired); err != nil {
+		log.Println("failed to unmarshal aws iot desired state for thermostat", id, "with error:", err)
+		return
+	}
+
+	// perform the same validation as a PUT so the cloud can't write anything the api wouldn't accept
+	if errRes := validateData(desired); errRes != nil {
+		log.Println("rejected aws iot desired state for thermostat", id, "-", errRes.Description)
+		return
+	}
+	if errRes := checkDisabled(target, desired); errRes != nil {
+		log.Println("rejected aws iot desired state for thermostat", id, "-", errRes.Description)
+		return
+	}
+
+	// the update publishes a change event, which reports the new state and clears the delta
+	if _, err := home.UpdateThermostat(target, desired); err != nil {
+		log.Println("failed to apply the aws iot desired state for thermostat", id, "with error:", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// fakeMessage is the minimal mqtt.Message needed to drive handleDelta
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+func TestShadowDelta(t *testing.T) {
+	s := &shadowSync{prefix: "thermostat-"}
+	id, _ := home.AddThermostat(updateThermostat{Name: "Garage Thermostat"})
+	topic := "$aws/things/thermostat-" + strconv.Itoa(id) + "/shadow/update/delta"
+
+	s.handleDelta(nil, &fakeMessage{topic: topic, payload: []byte(`{"version": 3, "state": {"mode": "cool", "coolSetPoint": 75}}`)})
+
+	th, errRes := home.Thermostat(id)
+	if errRes != nil {
+		t.Fatalf("thermostat %d not found: %s", id, errRes.Description)
+	}
+	if th.OperatingMode != "cool" || th.CoolSetPoint != 75 {
+		t.Fatalf("expected delta to set mode cool and cool set point 75, got %s and %d", th.OperatingMode, th.CoolSetPoint)
+	}
+
+	// invalid desired states must be rejected by the same validation as the api
+	s.handleDelta(nil, &fakeMessage{topic: topic, payload: []byte(`{"version": 4, "state": {"mode": "turbo"}}`)})
+
+	th, _ = home.Thermostat(id)
+	if th.OperatingMode != "cool" {
+		t.Fatalf("expected invalid delta to be rejected, mode is now %s", th.OperatingMode)
+	}
+}
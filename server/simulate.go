@@ -0,0 +1,169 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// simulationStep is how far the room is moved on at a time, the step of the scenarios cmd/simdevice
+	// emulates rooms with
+	simulationStep = 10 * time.Minute
+
+	// simulationHours is how many hours ahead a simulation runs unless it's given, and simulationMaxHours the
+	// most it can run
+	simulationHours    = 24
+	simulationMaxHours = 168
+
+	// simHeatRate and simCoolRate are how many degrees the equipment moves the room per step while running,
+	// and simLeakRate the share of the difference with the outdoor temperature the room drifts by per step,
+	// as cmd/simdevice emulates them
+	simHeatRate = 1.0
+	simCoolRate = 1.0
+	simLeakRate = 0.05
+
+	// simOutdoorTemp is the outdoor temperature simulated without a forecast or one given, the default of
+	// cmd/simdevice
+	simOutdoorTemp = 50
+)
+
+// simulationRequest is the body sent in through the api @ /v1/thermostats/:id/simulate. Settings that
+// aren't given are those of the thermostat, and the outdoor temperature is read from the forecast when
+// it's fetched with -forecast-url
+type simulationRequest struct {
+	OperatingMode string   `json:"mode"`
+	CoolSetPoint  int      `json:"coolSetPoint"`
+	HeatSetPoint  int      `json:"heatSetPoint"`
+	Hours         int      `json:"hours"`
+	OutdoorTemp   *float64 `json:"outdoorTemp"`
+}
+
+// simulationPoint is the predicted room temperature at the end of a step, with what the equipment did
+// during it
+type simulationPoint struct {
+	Time  time.Time `json:"time"`
+	Temp  float64   `json:"temp"`
+	State string    `json:"state"`
+}
+
+// simulation is what a thermostat is predicted to do with the settings it was simulated with, returned
+// through the api @ /v1/thermostats/:id/simulate
+type simulation struct {
+	OperatingMode  string            `json:"mode"`
+	CoolSetPoint   int               `json:"coolSetPoint"`
+	HeatSetPoint   int               `json:"heatSetPoint"`
+	Hours          int               `json:"hours"`
+	HeatingRuntime string            `json:"heatingRuntime"`
+	CoolingRuntime string            `json:"coolingRuntime"`
+	Trajectory     []simulationPoint `json:"trajectory"`
+}
+
+// outdoorAt returns the outdoor temperature of the forecast hour the time falls in, holding the last hour
+// past the end of the forecast, or the fallback without a forecast
+func outdoorAt(points []forecastPoint, at time.Time, fallback float64) float64 {
+	temp := fallback
+	for i, p := range points {
+		if i > 0 && p.Time.After(at) {
+			break
+		}
+		temp = p.Temp
+	}
+	return temp
+}
+
+// simulate runs the room of the thermostat for the given hours from its current temperature with the
+// settings given, the equipment heating or cooling it toward the setpoint and the room drifting toward
+// the outdoor temperature otherwise
+func simulate(t *thermostat, s simulation, outdoor func(time.Time) float64, now time.Time) simulation {
+	temp := float64(t.CurrentTemp)
+	var heating, cooling time.Duration
+
+	s.Trajectory = []simulationPoint{{Time: now, Temp: temp, State: hvacIdle}}
+	end := now.Add(time.Duration(s.Hours) * time.Hour)
+	for at := now; at.Before(end); at = at.Add(simulationStep) {
+		state := hvacIdle
+		switch {
+		case s.OperatingMode == "heat" && temp < float64(s.HeatSetPoint):
+			temp = math.Min(temp+simHeatRate, float64(s.HeatSetPoint))
+			state, heating = hvacHeating, heating+simulationStep
+		case s.OperatingMode == "cool" && temp > float64(s.CoolSetPoint):
+			temp = math.Max(temp-simCoolRate, float64(s.CoolSetPoint))
+			state, cooling = hvacCooling, cooling+simulationStep
+		default:
+			temp += (outdoor(at) - temp) * simLeakRate
+		}
+		s.Trajectory = append(s.Trajectory, simulationPoint{Time: at.Add(simulationStep), Temp: math.Round(temp*10) / 10, State: state})
+	}
+
+	s.HeatingRuntime, s.CoolingRuntime = heating.String(), cooling.String()
+	return s
+}
+
+// PostSimulate is the handler to predict the room temperature and the runtime of the equipment of a
+// specific thermostat over the next hours with hypothetical settings, without changing anything
+func PostSimulate(req *fasthttp.RequestCtx) {
+	var body simulationRequest
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// the settings are held to the same rules as an update of the thermostat
+	if errRes := validateData(updateThermostat{OperatingMode: body.OperatingMode, CoolSetPoint: body.CoolSetPoint, HeatSetPoint: body.HeatSetPoint}); errRes != nil {
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, errRes)
+		return
+	}
+
+	if body.Hours == 0 {
+		body.Hours = simulationHours
+	}
+	if body.Hours < 1 || body.Hours > simulationMaxHours {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Hours",
+			Description: "The hours must be a number from 1 to " + strconv.Itoa(simulationMaxHours) + ".",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	s := simulation{
+		OperatingMode: target.OperatingMode,
+		CoolSetPoint:  target.CoolSetPoint,
+		HeatSetPoint:  target.HeatSetPoint,
+		Hours:         body.Hours,
+	}
+	if body.OperatingMode != "" {
+		s.OperatingMode = body.OperatingMode
+	}
+	if body.CoolSetPoint != 0 {
+		s.CoolSetPoint = body.CoolSetPoint
+	}
+	if body.HeatSetPoint != 0 {
+		s.HeatSetPoint = body.HeatSetPoint
+	}
+
+	points, _ := forecast.Forecast()
+	outdoor := func(at time.Time) float64 { return outdoorAt(points, at, simOutdoorTemp) }
+	if body.OutdoorTemp != nil {
+		outdoor = func(time.Time) float64 { return *body.OutdoorTemp }
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, simulate(target, s, outdoor, clock.Now()))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	base := newTestServer(t)
+	therm, _ := home.Thermostat(1)
+	home.RecordTemp(therm, 65)
+	url := base + "/v1/thermostats/1/simulate"
+
+	if code := postJSON(url, `{"mode": "warm"}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid mode, got %d", http.StatusBadRequest, code)
+	}
+	if code := postJSON(url, `{"hours": 1000}`, t, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for too many hours, got %d", http.StatusBadRequest, code)
+	}
+
+	// the room is heated a degree a step up to the setpoint, then drifts toward the outdoor temperature
+	var s simulation
+	if code := postJSON(url, `{"mode": "heat", "heatSetPoint": 70, "hours": 2, "outdoorTemp": 40}`, t, &s); code != http.StatusOK {
+		t.Fatalf("expected the simulation, got %d", code)
+	}
+	if len(s.Trajectory) != 13 || s.Trajectory[5].Temp != 70 || s.Trajectory[5].State != hvacHeating ||
+		s.Trajectory[6].Temp != 68.5 || s.Trajectory[6].State != hvacIdle {
+		t.Fatalf("expected the room to be heated to 70 in 5 steps and drift off after, got %+v", s.Trajectory)
+	}
+	if s.HeatingRuntime != "1h30m0s" || s.CoolingRuntime != "0s" {
+		t.Fatalf("expected 9 steps of heating, got %s heating and %s cooling", s.HeatingRuntime, s.CoolingRuntime)
+	}
+	if th, _ := home.Thermostat(1); th.OperatingMode == "heat" && th.HeatSetPoint == 70 {
+		t.Fatalf("expected the thermostat to be left as it was, got %+v", th)
+	}
+
+	// without an outdoor temperature the forecast is followed
+	now := clock.Now()
+	forecast.set([]forecastPoint{{Time: now.Add(-time.Hour), Temp: 85}}, now)
+	if code := postJSON(url, `{"mode": "off", "hours": 1}`, t, &s); code != http.StatusOK {
+		t.Fatalf("expected the simulation, got %d", code)
+	}
+	if last := s.Trajectory[len(s.Trajectory)-1]; last.Temp <= 65 || last.State != hvacIdle {
+		t.Fatalf("expected the room to warm toward the forecast, got %+v", s.Trajectory)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// channelSlack posts the notification as a formatted message to slack, through an incoming webhook or as
+// the bot of -slack-token
+const channelSlack = "slack"
+
+// slackPostMessageURL is the slack web api method bots post messages with
+var slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+
+// slackSeverityIcons lead the alert messages so the severity shows at a glance
+var slackSeverityIcons = map[string]string{
+	severityInfo:     ":information_source:",
+	severityWarning:  ":warning:",
+	severityCritical: ":rotating_light:",
+}
+
+// slackMessage is the body posted to an incoming webhook or to chat.postMessage
+type slackMessage struct {
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+// slackResponse is what chat.postMessage responds with, which is a 200 even when the post failed
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// validateSlackChannel makes sure the channel can be posted to, either through an incoming webhook or by
+// the bot in a slack channel
+func validateSlackChannel(ch notificationChannel) string {
+	switch {
+	case ch.URL != "" && ch.Channel != "":
+		return "A slack channel is posted to through either an incoming webhook 'url' or a 'channel' of the bot, not both."
+	case ch.URL != "" && !strings.HasPrefix(ch.URL, "https://"):
+		return "The url '" + ch.URL + "' of a slack incoming webhook must be an https url."
+	case ch.URL == "" && ch.Channel == "":
+		return "A slack channel needs an incoming webhook 'url' or the 'channel' to post to, e.g. #alerts."
+	case ch.Channel != "" && secrets.Get("slack-token") == "":
+		return "Slack channels can only be posted to by name once -slack-token is given; use an incoming webhook 'url' instead."
+	}
+	return ""
+}
+
+// slackText formats the notification as a slack message
+func slackText(n notification) string {
+	if n.Alert != nil {
+		a := n.Alert
+		name := "thermostat " + strconv.Itoa(a.ThermostatID)
+		if t, errRes := home.Thermostat(a.ThermostatID); errRes == nil && t.Name != "" {
+			name = "*" + t.Name + "* (" + name + ")"
+		}
+		return slackSeverityIcons[a.Severity] + " *" + strings.ToUpper(a.Severity[:1]) + a.Severity[1:] + "* " + a.Type + " alert on " + name +
+			"\n" + a.Detail +
+			"\nAlert " + strconv.Itoa(a.ID) + " fired at " + a.FiredAt.Format(time.RFC1123)
+	}
+
+	d := n.Digest
+	var b strings.Builder
+	b.WriteString(":bar_chart: *Daily summary of " + n.Home + "* since " + d.From.Format(time.RFC1123))
+	for _, t := range d.Thermostats {
+		b.WriteString("\n• *" + t.Name + "*: " + strconv.Itoa(t.MinTemp) + "–" + strconv.Itoa(t.MaxTemp) + "°F, heating " + t.HeatingRuntime + ", cooling " + t.CoolingRuntime)
+	}
+	if len(d.Alerts) == 0 {
+		b.WriteString("\nNo alerts fired.")
+		return b.String()
+	}
+	b.WriteString("\n" + strconv.Itoa(len(d.Alerts)) + " alerts fired:")
+	for _, a := range d.Alerts {
+		b.WriteString("\n" + slackSeverityIcons[a.Severity] + " " + a.Type + " on thermostat " + strconv.Itoa(a.ThermostatID) + ": " + a.Detail)
+	}
+	return b.String()
+}
+
+// sendSlack posts the notification to the slack channel, returning the status slack responded with
+func (ch notificationChannel) sendSlack(n notification) (int, error) {
+	msg := slackMessage{Text: slackText(n)}
+	target := ch.URL
+	if target == "" {
+		msg.Channel = ch.Channel
+		target = slackPostMessageURL
+	}
+	jsn, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(jsn))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if ch.URL == "" {
+		req.Header.Set("Authorization", "Bearer "+secrets.Get("slack-token"))
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, errors.New("slack responded with " + resp.Status)
+	}
+	if ch.URL == "" {
+		var res slackResponse
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return resp.StatusCode, err
+		}
+		if !res.OK {
+			return resp.StatusCode, errors.New("slack failed to post to " + ch.Channel + ": " + res.Error)
+		}
+	}
+	return resp.StatusCode, nil
+}
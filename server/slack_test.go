@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlackNotifications(t *testing.T) {
+	posted := make(chan slackMessage, 10)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			t.Errorf("expected the bot token, got %q", r.Header.Get("Authorization"))
+		}
+		var msg slackMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		posted <- msg
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer api.Close()
+	defer func(u string) { slackPostMessageURL = u }(slackPostMessageURL)
+	slackPostMessageURL = api.URL
+
+	base := newTestServer(t, func(c *config) { c.SlackToken = "xoxb-test" })
+
+	for _, body := range []string{
+		`{"channels": [{"type": "slack"}]}`,
+		`{"channels": [{"type": "slack", "url": "http://hooks.slack.com/services/x"}]}`,
+		`{"channels": [{"type": "slack", "channel": "#alerts", "severities": ["urgent"]}]}`,
+	} {
+		if code, _ := putNotifications(base, "carol", body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	// critical alerts are routed to the on-call channel, the rest to the home channel
+	code, _ := putNotifications(base, "carol", `{"channels": [
+		{"type": "slack", "channel": "#oncall", "severities": ["critical"]},
+		{"type": "slack", "channel": "#home", "severities": ["info", "warning"]}
+	]}`, t)
+	if code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	receive := func() slackMessage {
+		select {
+		case msg := <-posted:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a slack message")
+		}
+		return slackMessage{}
+	}
+
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventAnomaly, t1, severityWarning, "Temperature jumped.")
+	if msg := receive(); msg.Channel != "#home" || !strings.Contains(msg.Text, "*Warning* anomaly alert on *"+t1.Name+"*") {
+		t.Fatalf("expected the warning in #home, got %+v", msg)
+	}
+	publishDetail(eventSafety, t1, severityCritical, "Freeze protection activated.")
+	if msg := receive(); msg.Channel != "#oncall" || !strings.Contains(msg.Text, ":rotating_light:") {
+		t.Fatalf("expected the critical alert in #oncall, got %+v", msg)
+	}
+	select {
+	case msg := <-posted:
+		t.Fatalf("expected each alert to be posted once, got %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the daily summary goes to both
+	putNotifications(base, "carol", `{"channels": [{"type": "slack", "channel": "#oncall", "severities": ["critical"]}, {"type": "slack", "channel": "#home"}], "delivery": "digest"}`, t)
+	sendDueDigests(time.Now().AddDate(0, 0, 1))
+	for i := 0; i < 2; i++ {
+		if msg := receive(); !strings.Contains(msg.Text, "Daily summary") || !strings.Contains(msg.Text, "2 alerts fired") {
+			t.Fatalf("expected the daily summary, got %+v", msg)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// sleepInterval is how often the setpoints of sleeping thermostats are moved along their ramp
+	sleepInterval = time.Second
+
+	// defaultSleepRamp is how long the setpoints take to move at bedtime and before waking, unless the
+	// profile gives a ramp of its own
+	defaultSleepRamp = time.Hour
+
+	// maxSleepDelta is the most degrees a sleep profile can move the setpoints by
+	maxSleepDelta = 10
+)
+
+// sleepProfile is the body sent in and returned through the api @ /v1/thermostats/:id/sleep. From bedtime
+// the setpoints move gradually by the delta over the ramp, stay there and move back over the ramp before
+// waking, so they are back where they were at wake time. Both setpoints move together, keeping the gap
+// between them. Times of day are in the local time of the server and the window may run past midnight
+type sleepProfile struct {
+	Bedtime string `json:"bedtime"`
+	Wake    string `json:"wake"`
+	Delta   int    `json:"delta"`
+	Ramp    string `json:"ramp"`
+}
+
+// validateSleepProfile makes sure the profile has a valid window long enough to ramp down and back up in,
+// filling in the default ramp
+func validateSleepProfile(p *sleepProfile) *errResponse {
+	invalid := func(description string) *errResponse {
+		return &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Sleep Profile",
+			Description: description,
+		}
+	}
+
+	bed, okBed := minutesOf(p.Bedtime)
+	wake, okWake := minutesOf(p.Wake)
+	if !okBed || !okWake || bed == wake {
+		return invalid("The bedtime '" + p.Bedtime + "' and wake time '" + p.Wake + "' must be different times of day given as HH:MM, e.g. 22:30 and 06:30.")
+	}
+	if p.Delta == 0 || p.Delta > maxSleepDelta || p.Delta < -maxSleepDelta {
+		return invalid("The delta must be from 1 to " + strconv.Itoa(maxSleepDelta) + " degrees up or down, e.g. -4.")
+	}
+
+	if p.Ramp == "" {
+		p.Ramp = defaultSleepRamp.String()
+	}
+	ramp, err := time.ParseDuration(p.Ramp)
+	length := time.Duration((wake-bed+24*60)%(24*60)) * time.Minute
+	if err != nil || ramp <= 0 || 2*ramp > length {
+		return invalid("The ramp must be a positive duration such as '1h' and fit twice between bedtime and wake time.")
+	}
+	return nil
+}
+
+// sleepOffset returns the degrees the profile has the setpoints moved by at the given time, and whether
+// it's within the sleep window
+func sleepOffset(p *sleepProfile, now time.Time) (int, bool) {
+	if p == nil {
+		return 0, false
+	}
+	bed, _ := minutesOf(p.Bedtime)
+	wake, _ := minutesOf(p.Wake)
+	length := time.Duration((wake-bed+24*60)%(24*60)) * time.Minute
+
+	now = now.In(time.Local)
+	start := time.Date(now.Year(), now.Month(), now.Day(), bed/60, bed%60, 0, 0, time.Local)
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	elapsed := now.Sub(start)
+	if elapsed >= length {
+		return 0, false
+	}
+
+	ramp, _ := time.ParseDuration(p.Ramp)
+	fraction := 1.0
+	switch {
+	case elapsed < ramp:
+		fraction = float64(elapsed) / float64(ramp)
+	case length-elapsed < ramp:
+		fraction = float64(length-elapsed) / float64(ramp)
+	}
+	return int(math.Round(float64(p.Delta) * fraction)), true
+}
+
+// shiftSetPoints moves the setpoints of the thermostat that are set by the given degrees
+func shiftSetPoints(t *thermostat, by int) {
+	if t.HeatSetPoint != 0 {
+		t.HeatSetPoint += by
+	}
+	if t.CoolSetPoint != 0 {
+		t.CoolSetPoint += by
+	}
+}
+
+// sleepStep returns the thermostat with its setpoints moved to where its sleep profile has them at the
+// given time, or nil when they are already there or can't go any further. Setpoints changed during the
+// sleep window are held until wake time
+func sleepStep(t *thermostat, now time.Time) *thermostat {
+	offset, sleeping := sleepOffset(t.Sleep, now)
+	held := t.SleepHeld && sleeping
+	if held {
+		offset = 0
+	}
+	if offset == t.SleepOffset && held == t.SleepHeld {
+		return nil
+	}
+
+	// thermostats are never modified in place, so work on a copy
+	updated := *t
+	shiftSetPoints(&updated, offset-t.SleepOffset)
+	if validateHeatSetPt(updated.HeatSetPoint) != nil || validateCoolSetPt(updated.CoolSetPoint) != nil {
+		return nil
+	}
+	updated.SleepOffset = offset
+	updated.SleepHeld = held
+	return &updated
+}
+
+// SetSleep sets the sleep profile of the thermostat, moving the setpoints to where it has them now, or
+// removes it and moves them back when p is nil
+func (home *currentState) SetSleep(target *thermostat, p *sleepProfile) (*thermostat, error) {
+	// thermostats are never modified in place, so work on a copy
+	updated := *target
+	updated.Sleep = p
+	if p == nil {
+		shiftSetPoints(&updated, -target.SleepOffset)
+		updated.SleepOffset = 0
+		updated.SleepHeld = false
+	} else if step := sleepStep(&updated, clock.Now()); step != nil {
+		updated = *step
+	}
+
+	return home.commitSleep(&updated)
+}
+
+// commitSleep commits the thermostat with its sleep profile or setpoints changed
+func (home *currentState) commitSleep(updated *thermostat) (*thermostat, error) {
+	updated.LastChanged = clock.Now()
+	transitions, err := home.commit(changeSleep, updated)
+	if err != nil {
+		return nil, err
+	}
+
+	publish(eventChange, updated)
+	publishHVAC(transitions)
+
+	return updated, nil
+}
+
+// runSleep moves the setpoints of sleeping thermostats along their ramps until stop is closed. Only the
+// leader writes, as with every other automated change, and nothing is written while the service is read-only
+func runSleep(interval time.Duration, stop <-chan struct{}) {
+	for clock.sleep(interval, stop) {
+		if !cluster.IsLeader() || checkReadOnly() != nil {
+			continue
+		}
+		updateSleep(clock.Now())
+	}
+}
+
+// updateSleep moves the setpoints of every thermostat with a sleep profile to where it has them by now.
+// Thermostats that can't be written to, or that are boosted, are left until they can be
+func updateSleep(now time.Time) {
+	for _, t := range home.Thermostats() {
+		_, err := retryChanged(t, func(current *thermostat) (*thermostat, error) {
+			if current.Sleep == nil || current.Disabled || current.Boost != nil || checkAutomatedWrite(current) != nil || checkOffline(current) != nil {
+				return current, nil
+			}
+			if updated := sleepStep(current, now); updated != nil {
+				return home.commitSleep(updated)
+			}
+			return current, nil
+		})
+		if err != nil {
+			log.Println("failed to move the sleep setpoints of thermostat", t.ID, "with error:", err)
+		}
+	}
+}
+
+// PutSleep is the handler to set the sleep profile of a specific thermostat
+func PutSleep(req *fasthttp.RequestCtx) {
+	var body sleepProfile
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	if errRes := validateSleepProfile(&body); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	// the setpoints must stay within range all night
+	asleep := *target
+	shiftSetPoints(&asleep, body.Delta-target.SleepOffset)
+	errRes := validateHeatSetPt(asleep.HeatSetPoint)
+	if errRes == nil {
+		errRes = validateCoolSetPt(asleep.CoolSetPoint)
+	}
+	if errRes == nil {
+		errRes = checkUserRange(requestUser(req), asleep.HeatSetPoint, asleep.CoolSetPoint)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	updated, err := home.SetSleep(target, &body)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
+
+// DeleteSleep is the handler to remove the sleep profile of a specific thermostat
+func DeleteSleep(req *fasthttp.RequestCtx) {
+	// no need to check if this exists, already validated in middleware
+	target := req.UserValue("thermostat").(*thermostat)
+
+	if target.Sleep == nil {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "Thermostat " + strconv.Itoa(target.ID) + " has no sleep profile.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	updated, err := home.SetSleep(target, nil)
+	if err != nil {
+		sendCommitError(req, err)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putSleep sets the sleep profile of the thermostat at url, returning the status code and the thermostat
+func putSleep(url, body string, t *testing.T) (int, thermostat) {
+	req, err := http.NewRequest("PUT", url+"/sleep", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create new PUT request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var th thermostat
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&th); err != nil {
+			t.Fatalf("failed to decode the thermostat: %s", err)
+		}
+	}
+	return resp.StatusCode, th
+}
+
+func TestSleepOffset(t *testing.T) {
+	p := &sleepProfile{Bedtime: "22:00", Wake: "06:00", Delta: -4, Ramp: "1h"}
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 3, day, hour, min, 0, 0, time.Local) }
+
+	for _, tt := range []struct {
+		at       time.Time
+		offset   int
+		sleeping bool
+	}{
+		{at(4, 21, 59), 0, false},
+		{at(4, 22, 0), 0, true},
+		{at(4, 22, 30), -2, true},
+		{at(4, 23, 0), -4, true},
+		{at(5, 3, 0), -4, true},
+		{at(5, 5, 30), -2, true},
+		{at(5, 6, 0), 0, false},
+	} {
+		if offset, sleeping := sleepOffset(p, tt.at); offset != tt.offset || sleeping != tt.sleeping {
+			t.Fatalf("expected an offset of %d at %s, got %d", tt.offset, tt.at.Format(clockLayout), offset)
+		}
+	}
+}
+
+func TestSleep(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1"
+
+	target, _ := home.Thermostat(1)
+	home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+
+	for _, body := range []string{
+		`{"bedtime": "22:00", "wake": "22:00", "delta": -4}`,
+		`{"bedtime": "10pm", "wake": "06:00", "delta": -4}`,
+		`{"bedtime": "22:00", "wake": "06:00", "delta": 0}`,
+		`{"bedtime": "22:00", "wake": "23:00", "delta": -4}`,
+		`{"bedtime": "22:00", "wake": "06:00", "delta": -4, "ramp": "slowly"}`,
+	} {
+		if code, _ := putSleep(url, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	// in the middle of the night the setpoints are moved by the whole delta straight away
+	now := time.Now()
+	night := `{"bedtime": "` + now.Add(-2*time.Hour).Format(clockLayout) + `", "wake": "` + now.Add(2*time.Hour).Format(clockLayout) + `", "delta": -4}`
+	code, th := putSleep(url, night, t)
+	if code != http.StatusOK || th.HeatSetPoint != 64 || th.CoolSetPoint != 70 || th.SleepOffset != -4 || th.Sleep.Ramp != "1h0m0s" {
+		t.Fatalf("expected the setpoints to be moved by -4, got %d %+v", code, th)
+	}
+
+	// the schedule shows the sleep window, which isn't imported back
+	resp, err := http.Get(url + "/schedule")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	calendar, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(calendar), "SUMMARY:Sleep") || !strings.Contains(string(calendar), icalSleepProp+":") {
+		t.Fatalf("expected the schedule to show the sleep window, got %s", calendar)
+	}
+	if _, skipped := importEvent(1, []icalProp{{name: icalSleepProp, value: "{}"}}); skipped.Reason == "" {
+		t.Fatalf("expected the sleep window to be skipped on import")
+	}
+
+	// changing the setpoints holds them until wake time
+	target, _ = home.Thermostat(1)
+	target, _ = home.UpdateThermostat(target, updateThermostat{HeatSetPoint: 70})
+	if !target.SleepHeld || target.SleepOffset != 0 || target.HeatSetPoint != 70 || target.CoolSetPoint != 74 {
+		t.Fatalf("expected the setpoints to be held, got %+v", target)
+	}
+	updateSleep(now.Add(time.Minute))
+	if target, _ = home.Thermostat(1); target.HeatSetPoint != 70 || !target.SleepHeld {
+		t.Fatalf("expected the setpoints to stay held during the night, got %+v", target)
+	}
+	updateSleep(now.Add(3 * time.Hour))
+	if target, _ = home.Thermostat(1); target.HeatSetPoint != 70 || target.SleepHeld {
+		t.Fatalf("expected the hold to end at wake time, got %+v", target)
+	}
+
+	// removing the profile puts the setpoints back
+	putSleep(url, night, t)
+	var removed thermostat
+	if code := del(url+"/sleep", t, &removed); code != http.StatusOK || removed.Sleep != nil || removed.HeatSetPoint != 70 || removed.CoolSetPoint != 74 {
+		t.Fatalf("expected the setpoints to be put back, got %d %+v", code, removed)
+	}
+	if code := del(url+"/sleep", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d without a sleep profile, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestSleepReadOnly(t *testing.T) {
+	newTestServer(t)
+
+	target, _ := home.Thermostat(1)
+	target, _ = home.UpdateThermostat(target, updateThermostat{OperatingMode: "heat", HeatSetPoint: 68, CoolSetPoint: 74})
+	now := time.Now()
+	p := &sleepProfile{Bedtime: now.Add(time.Hour).Format(clockLayout), Wake: now.Add(5 * time.Hour).Format(clockLayout), Delta: -4, Ramp: "1h"}
+	if _, err := home.SetSleep(target, p); err != nil {
+		t.Fatalf("failed to set the sleep profile: %s", err)
+	}
+
+	// the ramp doesn't move the setpoints while the service is read-only
+	readOnly.SetMode(readOnlyMode{Enabled: true, Reason: "maintenance"}, "")
+	updateSleep(now.Add(3 * time.Hour))
+	if target, _ = home.Thermostat(1); target.HeatSetPoint != 68 || target.SleepOffset != 0 {
+		t.Fatalf("expected the setpoints to stay put while read-only, got %+v", target)
+	}
+
+	readOnly.SetMode(readOnlyMode{}, "")
+	updateSleep(now.Add(3 * time.Hour))
+	if target, _ = home.Thermostat(1); target.HeatSetPoint != 64 || target.SleepOffset != -4 {
+		t.Fatalf("expected the setpoints to be moved once writable again, got %+v", target)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// the types of server-sent events @ /v1/thermostats/:id/events: the temperature or setpoints of the
+	// thermostat changed, or the thermostat was deleted, which ends the stream
+	sseTemperature = "temperature"
+	sseDeleted     = "deleted"
+
+	// sseKeepAlive is how often a comment is sent on a stream without updates, so proxies keep it open and
+	// a client that went away is noticed
+	sseKeepAlive = 15 * time.Second
+
+	// sseRetry is how many milliseconds a client waits before reconnecting once a stream ends
+	sseRetry = 1000
+)
+
+// temperatureUpdate is the data of a server-sent event about the temperature and setpoints of a thermostat.
+// Seq is the sequence number of the change that made it, which is the id of the event
+type temperatureUpdate struct {
+	Seq          uint64    `json:"-"`
+	ID           int       `json:"id"`
+	CurrentTemp  int       `json:"currentTemp"`
+	HeatSetPoint int       `json:"heatSetPoint"`
+	CoolSetPoint int       `json:"coolSetPoint"`
+	Time         time.Time `json:"time"`
+}
+
+// newTemperatureUpdate returns the update the thermostat record written by the change of the sequence
+// number makes
+func newTemperatureUpdate(seq uint64, t *thermostat, at time.Time) temperatureUpdate {
+	return temperatureUpdate{Seq: seq, ID: t.ID, CurrentTemp: t.CurrentTemp, HeatSetPoint: t.HeatSetPoint, CoolSetPoint: t.CoolSetPoint, Time: at}
+}
+
+// temperatureFeed is what the changes after a sequence number did to the temperature and setpoints of a
+// thermostat. Complete is false when the journal doesn't hold every change after it, and Current is the
+// thermostat as of the latest change, Seq, nil once it's deleted. Next is closed by the change after it
+type temperatureFeed struct {
+	Updates  []temperatureUpdate
+	Complete bool
+	Current  *thermostat
+	Seq      uint64
+	Next     <-chan struct{}
+}
+
+// TemperatureUpdates returns the updates of the temperature and setpoints of the thermostat made by the
+// changes of the journal after the sequence number, oldest first. Changes to the rest of the thermostat
+// aren't updates
+func (home *currentState) TemperatureUpdates(id int, since uint64) temperatureFeed {
+	home.Lock()
+	defer home.Unlock()
+
+	if home.changed == nil {
+		home.changed = make(chan struct{})
+	}
+	j := &home.journal
+	feed := temperatureFeed{Current: home.thermostats[id], Seq: j.seq, Next: home.changed}
+
+	first := j.seq + 1
+	if len(j.changes) > 0 {
+		first = j.changes[0].Seq
+	}
+	// an id past the journal was given out before the server restarted
+	feed.Complete = since+1 >= first && since <= j.seq
+	if !feed.Complete {
+		return feed
+	}
+
+	prev := j.base[id]
+	for _, c := range j.changes {
+		for _, t := range c.Thermostats {
+			if t.ID != id {
+				continue
+			}
+			if c.Seq > since && (prev == nil || t.CurrentTemp != prev.CurrentTemp || t.HeatSetPoint != prev.HeatSetPoint || t.CoolSetPoint != prev.CoolSetPoint) {
+				feed.Updates = append(feed.Updates, newTemperatureUpdate(c.Seq, t, c.Time))
+			}
+			prev = t
+		}
+		for _, t := range c.Deleted {
+			if t.ID == id {
+				prev = nil
+			}
+		}
+	}
+	return feed
+}
+
+// streamHub ends the open event streams when the server shuts down, which would otherwise wait for them
+type streamHub struct {
+	sync.Mutex
+	done chan struct{}
+}
+
+var eventStreams = &streamHub{}
+
+// Done returns a channel that's closed once the open streams must end
+func (h *streamHub) Done() <-chan struct{} {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.done == nil {
+		h.done = make(chan struct{})
+	}
+	return h.done
+}
+
+// closeAll ends every open stream
+func (h *streamHub) closeAll() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.done != nil {
+		close(h.done)
+		h.done = nil
+	}
+}
+
+// writeEvent writes a single server-sent event to the stream
+func writeEvent(w *bufio.Writer, seq uint64, typ string, data interface{}) error {
+	jsn, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	w.WriteString("id: " + strconv.FormatUint(seq, 10) + "\nevent: " + typ + "\ndata: ")
+	w.Write(jsn)
+	w.WriteString("\n\n")
+	return w.Flush()
+}
+
+// GetEvents is the handler of the server-sent event stream of a thermostat, for clients that can't use the
+// websocket @ /v1/rpc. It sends the temperature and setpoints as they change, starting with where they are
+// now. A client reconnecting with the Last-Event-ID header is sent the updates it missed instead, or where
+// they are now if they're too old to still be in the journal. Streams end before -write-timeout cuts them
+// off, which clients reconnect from
+func GetEvents(req *fasthttp.RequestCtx) {
+	if cfg.Server == "nethttp" {
+		res := &errResponse{
+			Code:        http.StatusNotImplemented,
+			Msg:         "Not Implemented",
+			Description: "Server-sent events are only available with the fasthttp server.",
+		}
+		req.SetStatusCode(http.StatusNotImplemented)
+		sendJSON(req, res)
+		return
+	}
+
+	t := req.UserValue("thermostat").(*thermostat)
+	id := t.ID
+	since, err := strconv.ParseUint(string(req.Request.Header.Peek("Last-Event-ID")), 10, 64)
+	resumed := err == nil
+
+	var deadline <-chan time.Time
+	if cfg.WriteTimeout > 0 {
+		deadline = time.After(cfg.WriteTimeout * 9 / 10)
+	}
+	done := eventStreams.Done()
+
+	req.Response.Header.Set("Content-Type", "text/event-stream")
+	req.Response.Header.Set("Cache-Control", "no-store")
+	req.Response.Header.Set("X-Accel-Buffering", "no")
+	req.SetStatusCode(http.StatusOK)
+	req.SetBodyStreamWriter(func(w *bufio.Writer) {
+		keepAlive := time.NewTicker(sseKeepAlive)
+		defer keepAlive.Stop()
+
+		w.WriteString("retry: " + strconv.Itoa(sseRetry) + "\n\n")
+		first := true
+		for {
+			feed := home.TemperatureUpdates(id, since)
+			updates := feed.Updates
+			if ((first && !resumed) || !feed.Complete) && feed.Current != nil {
+				updates = []temperatureUpdate{newTemperatureUpdate(feed.Seq, feed.Current, feed.Current.LastChanged)}
+			}
+			first = false
+			for _, u := range updates {
+				if err := writeEvent(w, u.Seq, sseTemperature, u); err != nil {
+					return
+				}
+			}
+			if feed.Current == nil {
+				writeEvent(w, feed.Seq, sseDeleted, map[string]int{"id": id})
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+			since = feed.Seq
+
+			for waiting := true; waiting; {
+				select {
+				case <-feed.Next:
+					waiting = false
+				case <-keepAlive.C:
+					w.WriteString(": keepalive\n\n")
+					if err := w.Flush(); err != nil {
+						return
+					}
+				case <-deadline:
+					return
+				case <-done:
+					return
+				}
+			}
+		}
+	})
+}
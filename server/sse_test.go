@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id, typ string
+	update  temperatureUpdate
+}
+
+// openEvents opens the event stream of the thermostat, resuming after lastID when given
+func openEvents(url, lastID string, t *testing.T) (*bufio.Reader, func()) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("failed to create new get request: %s", err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+// readEvent reads the next event of the stream, skipping the comments and the retry field
+func readEvent(r *bufio.Reader, t *testing.T) sseEvent {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read the stream: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.typ != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.update); err != nil {
+				t.Fatalf("failed to decode the event: %s", err)
+			}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1/events"
+
+	stream, closeStream := openEvents(url, "", t)
+	e := readEvent(stream, t)
+	if e.typ != sseTemperature || e.update.ID != 1 || e.id == "" {
+		t.Fatalf("expected the current temperature first, got %+v", e)
+	}
+
+	// changing the setpoint and the temperature are updates, renaming the thermostat isn't
+	put(base+"/v1/thermostats/1", `{"heatSetPoint": 66}`, t)
+	put(base+"/v1/thermostats/1", `{"name": "Attic"}`, t)
+	target, _ := home.Thermostat(1)
+	home.RecordTemp(target, 61)
+
+	setpoint := readEvent(stream, t)
+	if setpoint.update.HeatSetPoint != 66 {
+		t.Fatalf("expected the setpoint change, got %+v", setpoint)
+	}
+	temp := readEvent(stream, t)
+	if temp.update.CurrentTemp != 61 || temp.update.HeatSetPoint != 66 {
+		t.Fatalf("expected the temperature change, got %+v", temp)
+	}
+	first, _ := strconv.Atoi(e.id)
+	if next, _ := strconv.Atoi(setpoint.id); first == 0 || next <= first {
+		t.Fatalf("expected the ids to grow, got %s then %s", e.id, setpoint.id)
+	}
+	closeStream()
+
+	// resuming after the setpoint change only sends what came after it
+	stream, closeStream = openEvents(url, setpoint.id, t)
+	if resumed := readEvent(stream, t); resumed.id != temp.id || resumed.update.CurrentTemp != 61 {
+		t.Fatalf("expected only the missed temperature change, got %+v", resumed)
+	}
+
+	if code := del(base+"/v1/thermostats/1", t, nil); code != http.StatusNoContent {
+		t.Fatalf("failed to delete the thermostat, got %d", code)
+	}
+	if deleted := readEvent(stream, t); deleted.typ != sseDeleted {
+		t.Fatalf("expected the stream to end with the thermostat, got %+v", deleted)
+	}
+	closeStream()
+
+	// an id the journal doesn't know, from before a restart, starts over with the current temperature
+	stream, closeStream = openEvents(base+"/v1/thermostats/2/events", "99999", t)
+	defer closeStream()
+	if e := readEvent(stream, t); e.update.ID != 2 {
+		t.Fatalf("expected the current temperature, got %+v", e)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// unmarshalStrict unmarshals a json body sent in to the api like json.Unmarshal does, but rejects keys that
+// aren't fields of v, naming each along with the fields it was most likely meant to be. Unlike
+// json.Unmarshal, keys must match the case of the field, so a typo such as "coolSetpoint" isn't taken for
+// "coolSetPoint" either
+func unmarshalStrict(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var unknown []string
+	unknownFields(reflect.TypeOf(v), doc, "", &unknown)
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	if len(unknown) == 1 {
+		return errors.New("unknown field " + unknown[0])
+	}
+	return errors.New("unknown fields " + strings.Join(unknown, ", "))
+}
+
+// unknownFields adds the keys of the json value that have no field in the type to unknown, each quoted by its
+// path and followed by the fields it was most likely meant to be
+func unknownFields(typ reflect.Type, doc interface{}, path string, unknown *[]string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	// types that unmarshal themselves decide which keys they take
+	if reflect.PtrTo(typ).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := jsonFields(typ)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field, ok := fields[key]
+			if !ok {
+				*unknown = append(*unknown, `"`+path+key+`"`+suggestFields(key, fields))
+				continue
+			}
+			unknownFields(field, obj[key], path+key+".", unknown)
+		}
+	case reflect.Slice, reflect.Array:
+		if list, ok := doc.([]interface{}); ok {
+			for _, item := range list {
+				unknownFields(typ.Elem(), item, path, unknown)
+			}
+		}
+	case reflect.Map:
+		if obj, ok := doc.(map[string]interface{}); ok {
+			for _, value := range obj {
+				unknownFields(typ.Elem(), value, path, unknown)
+			}
+		}
+	}
+}
+
+// jsonFields returns the type of every field of the struct by its json key, including the fields of the
+// structs embedded in it
+func jsonFields(typ reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-" || (f.PkgPath != "" && !f.Anonymous):
+			continue
+		case f.Anonymous && name == "":
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for key, t := range jsonFields(embedded) {
+					fields[key] = t
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// suggestFields returns the fields the unknown key was most likely meant to be, e.g. (did you mean
+// "coolSetPoint"?), or nothing when none come close
+func suggestFields(key string, fields map[string]reflect.Type) string {
+	best := len(key)/3 + 1
+	var nearest []string
+	for name := range fields {
+		d := editDistance(strings.ToLower(key), strings.ToLower(name))
+		switch {
+		case d < best:
+			best, nearest = d, []string{name}
+		case d == best:
+			nearest = append(nearest, name)
+		}
+	}
+	if len(nearest) == 0 {
+		return ""
+	}
+
+	sort.Strings(nearest)
+	return ` (did you mean "` + strings.Join(nearest, `" or "`) + `"?)`
+}
+
+// editDistance returns the number of single character insertions, deletions and substitutions it takes to
+// turn a into b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
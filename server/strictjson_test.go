@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalStrict(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		{`{"coolSetPoint": 74, "fan": "on"}`, ""},
+		{`{"coolSetpoint": 74}`, `unknown field "coolSetpoint" (did you mean "coolSetPoint"?)`},
+		{`{"mdoe": "heat", "colour": "red"}`, `unknown fields "colour", "mdoe" (did you mean "mode"?)`},
+		{`{"thermostatId": 1, "update": {"heatSetPiont": 68}}`, `unknown field "update.heatSetPiont" (did you mean "heatSetPoint"?)`},
+	}
+
+	for _, tt := range tests {
+		var err error
+		if strings.Contains(tt.body, "update") {
+			var a scheduledAction
+			err = unmarshalStrict([]byte(tt.body), &a)
+		} else {
+			var u updateThermostat
+			err = unmarshalStrict([]byte(tt.body), &u)
+		}
+
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.body, tt.want, got)
+		}
+	}
+}
+
+func TestUnknownFieldsRejected(t *testing.T) {
+	base := newTestServer(t)
+	before, _ := home.Thermostat(1)
+
+	resp, err := http.Post(base+"/v1/thermostats", "application/json", bytes.NewBufferString(`{"name": "Garage Thermostat", "coolSetpoint": 80}`))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	var res errResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusBadRequest || !strings.Contains(res.Description, `did you mean "coolSetPoint"`) {
+		t.Fatalf("expected status %d suggesting coolSetPoint, got %d %+v (%v)", http.StatusBadRequest, resp.StatusCode, res, err)
+	}
+	if code := put(base+"/v1/thermostats/1", `{"coolSetpoint": 80}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an unknown field, got %d", http.StatusBadRequest, code)
+	}
+	if after, _ := home.Thermostat(1); after.CoolSetPoint != before.CoolSetPoint {
+		t.Fatalf("expected the cool set point to be left alone, got %d", after.CoolSetPoint)
+	}
+}
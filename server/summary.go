@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// homeSummary holds the statistics returned through the api @ /v1/home/summary. Disabled thermostats are
+// only counted, they are left out of every other statistic
+type homeSummary struct {
+	Home            string         `json:"home"`
+	Thermostats     int            `json:"thermostats"`
+	Disabled        int            `json:"disabled"`
+	Modes           map[string]int `json:"modes"`
+	CurrentTemp     *tempSummary   `json:"currentTemp,omitempty"`
+	InMaintenance   int            `json:"inMaintenance"`
+	SafetyOverrides int            `json:"safetyOverrides"`
+	LastChanged     *time.Time     `json:"lastChanged,omitempty"`
+}
+
+// tempSummary holds the statistics of the current temperature across the home
+type tempSummary struct {
+	Average float64 `json:"average"`
+	Min     int     `json:"min"`
+	Max     int     `json:"max"`
+}
+
+// summarize computes the statistics of the thermostats
+func summarize(therms []*thermostat) *homeSummary {
+	summary := &homeSummary{
+		Home:  cfg.Home,
+		Modes: make(map[string]int),
+	}
+	for _, mode := range validOpModes {
+		summary.Modes[mode] = 0
+	}
+
+	var total int
+	for _, t := range therms {
+		if t.Disabled {
+			summary.Disabled++
+			continue
+		}
+
+		summary.Thermostats++
+		summary.Modes[t.OperatingMode]++
+
+		if summary.CurrentTemp == nil {
+			summary.CurrentTemp = &tempSummary{Min: t.CurrentTemp, Max: t.CurrentTemp}
+		}
+		if t.CurrentTemp < summary.CurrentTemp.Min {
+			summary.CurrentTemp.Min = t.CurrentTemp
+		}
+		if t.CurrentTemp > summary.CurrentTemp.Max {
+			summary.CurrentTemp.Max = t.CurrentTemp
+		}
+		total += t.CurrentTemp
+
+		if inMaintenance(t) {
+			summary.InMaintenance++
+		}
+		if t.FreezeProtection || t.OverheatProtection {
+			summary.SafetyOverrides++
+		}
+		if summary.LastChanged == nil || t.LastChanged.After(*summary.LastChanged) {
+			lastChanged := t.LastChanged
+			summary.LastChanged = &lastChanged
+		}
+	}
+
+	if summary.CurrentTemp != nil {
+		// round to a tenth of a degree
+		summary.CurrentTemp.Average = math.Round(float64(total)/float64(summary.Thermostats)*10) / 10
+	}
+
+	return summary
+}
+
+// GetSummary is the handler to return statistics across every enabled thermostat in the home
+func GetSummary(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, summarize(home.Thermostats()))
+}
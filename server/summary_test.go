@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	until := time.Now().Add(time.Hour)
+	therms := []*thermostat{
+		{ID: 1, OperatingMode: "heat", CurrentTemp: 68, LastChanged: time.Unix(100, 0)},
+		{ID: 2, OperatingMode: "cool", CurrentTemp: 75, LastChanged: time.Unix(300, 0), MaintenanceUntil: &until},
+		{ID: 3, OperatingMode: "heat", CurrentTemp: 39, LastChanged: time.Unix(200, 0), FreezeProtection: true},
+		{ID: 4, OperatingMode: "cool", CurrentTemp: 99, LastChanged: time.Unix(400, 0), Disabled: true},
+	}
+
+	summary := summarize(therms)
+	if summary.Thermostats != 3 || summary.Disabled != 1 {
+		t.Fatalf("expected 3 enabled and 1 disabled thermostat, got %d and %d", summary.Thermostats, summary.Disabled)
+	}
+	if summary.Modes["heat"] != 2 || summary.Modes["cool"] != 1 || summary.Modes["off"] != 0 {
+		t.Fatalf("expected 2 heating, 1 cooling and none off, got %v", summary.Modes)
+	}
+	if summary.CurrentTemp.Min != 39 || summary.CurrentTemp.Max != 75 || summary.CurrentTemp.Average != 60.7 {
+		t.Fatalf("expected temperatures between 39 and 75 averaging 60.7, got %+v", summary.CurrentTemp)
+	}
+	if summary.InMaintenance != 1 || summary.SafetyOverrides != 1 {
+		t.Fatalf("expected 1 thermostat in maintenance and 1 safety override, got %d and %d", summary.InMaintenance, summary.SafetyOverrides)
+	}
+	if !summary.LastChanged.Equal(time.Unix(300, 0)) {
+		t.Fatalf("expected the last change of an enabled thermostat, got %s", summary.LastChanged)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// the events of the sun scheduled actions can be anchored to
+const (
+	sunrise = "sunrise"
+	sunset  = "sunset"
+)
+
+// sunSearchDays is how many days ahead the next sunrise or sunset is looked for, which covers the polar
+// night and midnight sun
+const sunSearchDays = 366
+
+// sunTimes returns the sunrise and sunset at the given position on the day of date, using the sunrise
+// equation, which is accurate to about a minute. ok is false on days the sun doesn't rise or set
+func sunTimes(date time.Time, lat, lon float64) (rise, set time.Time, ok bool) {
+	const rad = math.Pi / 180
+
+	// days since noon on 1 January 2000, the epoch of the equation
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	n := math.Round(noon.Sub(time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)).Hours() / 24)
+
+	meanNoon := n - lon/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+	longitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := meanNoon + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*longitude*rad)
+
+	declination := math.Asin(math.Sin(longitude*rad) * math.Sin(23.4397*rad))
+	cosHourAngle := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*math.Sin(declination)) / (math.Cos(lat*rad) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / rad
+
+	epoch := time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(days float64) time.Time {
+		return epoch.Add(time.Duration(days * 24 * float64(time.Hour))).Truncate(time.Second).In(date.Location())
+	}
+	return at(transit - hourAngle/360), at(transit + hourAngle/360), true
+}
+
+// sunSchedule fires every day at sunrise or sunset at the position of the home, moved by an offset. It
+// implements cron.Schedule, so scheduled actions run the same whichever way they're anchored
+type sunSchedule struct {
+	event  string
+	offset time.Duration
+	lat    float64
+	lon    float64
+}
+
+// Next returns the first time the schedule fires after t, or the zero time when the sun doesn't rise or
+// set again within a year
+func (s sunSchedule) Next(t time.Time) time.Time {
+	// start a day early, so an offset that moves the event across midnight isn't missed
+	day := t.AddDate(0, 0, -1)
+	for i := 0; i <= sunSearchDays; i++ {
+		rise, set, ok := sunTimes(day.AddDate(0, 0, i), s.lat, s.lon)
+		if !ok {
+			continue
+		}
+		at := rise
+		if s.event == sunset {
+			at = set
+		}
+		if at = at.Add(s.offset); at.After(t) {
+			return at
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSunTimes(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat, lon float64
+		date     time.Time
+		rise     time.Time
+		set      time.Time
+	}{
+		{"london midsummer", 51.5074, -0.1278, time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 6, 21, 3, 43, 0, 0, time.UTC), time.Date(2024, 6, 21, 20, 21, 0, 0, time.UTC)},
+		{"chicago midwinter", 41.8781, -87.6298, time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 12, 21, 13, 15, 0, 0, time.UTC), time.Date(2024, 12, 21, 22, 22, 0, 0, time.UTC)},
+		{"sydney", -33.8688, 151.2093, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 2, 29, 19, 43, 0, 0, time.UTC), time.Date(2024, 3, 1, 8, 32, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		rise, set, ok := sunTimes(tt.date, tt.lat, tt.lon)
+		if !ok {
+			t.Fatalf("%s: expected the sun to rise and set", tt.name)
+		}
+		if d := rise.Sub(tt.rise); d < -2*time.Minute || d > 2*time.Minute {
+			t.Fatalf("%s: expected sunrise around %s, got %s", tt.name, tt.rise, rise)
+		}
+		if d := set.Sub(tt.set); d < -2*time.Minute || d > 2*time.Minute {
+			t.Fatalf("%s: expected sunset around %s, got %s", tt.name, tt.set, set)
+		}
+	}
+
+	// the polar night in tromsø
+	if _, _, ok := sunTimes(time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC), 69.6492, 18.9553); ok {
+		t.Fatalf("expected the sun not to rise in the polar night")
+	}
+}
+
+func TestSunSchedule(t *testing.T) {
+	s := sunSchedule{event: sunset, offset: -30 * time.Minute, lat: 51.5074, lon: -0.1278}
+
+	// before the sunset the next run is the same day, after it the day after
+	_, set, _ := sunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), s.lat, s.lon)
+	if next := s.Next(time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)); !next.Equal(set.Add(-30 * time.Minute)) {
+		t.Fatalf("expected the next run 30 minutes before sunset, got %s", next)
+	}
+	_, set, _ = sunTimes(time.Date(2024, 6, 22, 0, 0, 0, 0, time.UTC), s.lat, s.lon)
+	if next := s.Next(time.Date(2024, 6, 21, 21, 0, 0, 0, time.UTC)); !next.Equal(set.Add(-30 * time.Minute)) {
+		t.Fatalf("expected the next run to be the day after, got %s", next)
+	}
+
+	// the sun doesn't rise again until the polar night is over
+	polar := sunSchedule{event: sunrise, lat: 69.6492, lon: 18.9553}
+	if next := polar.Next(time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)); next.Month() != time.January {
+		t.Fatalf("expected the next sunrise after the polar night, got %s", next)
+	}
+}
+
+func TestSunActions(t *testing.T) {
+	base := newTestServer(t)
+
+	if code, _ := postAction(base, `{"thermostatId": 1, "sun": "sunset", "update": {"heatSetPoint": 64}}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d without a location, got %d", http.StatusBadRequest, code)
+	}
+
+	base = newTestServer(t, func(c *config) {
+		c.Latitude, c.Longitude = 41.8781, -87.6298
+	})
+	for _, body := range []string{
+		`{"thermostatId": 1, "sun": "noon", "update": {"heatSetPoint": 64}}`,
+		`{"thermostatId": 1, "sun": "sunset", "offset": "half an hour", "update": {"heatSetPoint": 64}}`,
+		`{"thermostatId": 1, "sun": "sunset", "cron": "0 7 * * *", "update": {"heatSetPoint": 64}}`,
+		`{"thermostatId": 1, "cron": "0 7 * * *", "offset": "1h", "update": {"heatSetPoint": 64}}`,
+	} {
+		if code, _ := postAction(base, body, t); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	code, a := postAction(base, `{"thermostatId": 1, "sun": "sunset", "offset": "-30m", "update": {"heatSetPoint": 64}}`, t)
+	if code != http.StatusCreated || len(a.NextRuns) != actionPreviews {
+		t.Fatalf("expected the action to be scheduled, got %d %+v", code, a)
+	}
+	for i := 1; i < len(a.NextRuns); i++ {
+		if gap := a.NextRuns[i].Sub(a.NextRuns[i-1]); gap < 23*time.Hour || gap > 25*time.Hour {
+			t.Fatalf("expected a run every day, got %s between runs", gap)
+		}
+	}
+
+	var runs []time.Time
+	get(base+"/v1/actions/preview?sun=sunrise&offset=1h", t, &runs)
+	if len(runs) != actionPreviews {
+		t.Fatalf("expected %d runs, got %v", actionPreviews, runs)
+	}
+}
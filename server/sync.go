@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// syncRetryInterval is how long an agent waits before reconnecting to the central instance
+	syncRetryInterval = 5 * time.Second
+
+	// syncPingInterval is how often an agent checks that the central instance is still there, and
+	// syncTimeout how long it waits to hear back before reconnecting
+	syncPingInterval = 15 * time.Second
+	syncTimeout      = 2 * syncPingInterval
+
+	// syncStreamMethod is the full name of the sync stream of the grpc service
+	syncStreamMethod = "/thermostat.Sync/Stream"
+
+	syncSnapshot = "snapshot"
+	syncEvent    = "event"
+)
+
+// syncMessage is sent by an agent to the central instance over the sync stream. Every connection starts
+// with a snapshot of every thermostat of the site, followed by the events published since then. Events are
+// numbered by Seq, and a snapshot carries the last one the central instance acknowledged, so events sent
+// again after a reconnect are only applied once
+type syncMessage struct {
+	Type        string        `json:"type"`
+	Seq         uint64        `json:"seq"`
+	Thermostats []*thermostat `json:"thermostats,omitempty"`
+	Event       *event        `json:"event,omitempty"`
+}
+
+// syncAck is sent back by the central instance for every message it applied, acknowledging every event up
+// to Seq so the agent stops buffering them
+type syncAck struct {
+	Seq uint64 `json:"seq"`
+}
+
+// syncCodec encodes the messages of the sync stream as json, so the grpc service needs no generated code
+type syncCodec struct{}
+
+func (syncCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (syncCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (syncCodec) Name() string                               { return "json" }
+
+// syncServiceDesc describes the grpc service of the central instance, a single stream of messages from an
+// agent answered by acknowledgements
+var syncServiceDesc = grpc.ServiceDesc{
+	ServiceName: "thermostat.Sync",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Stream",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(*syncHub).serve(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+// syncStatus is returned through the api @ /v1/admin/sync on an agent
+type syncStatus struct {
+	Central   string     `json:"central"`
+	Site      string     `json:"site"`
+	Connected bool       `json:"connected"`
+	Buffered  int        `json:"buffered"` // events not acknowledged by the central instance yet
+	Dropped   uint64     `json:"dropped"`  // events dropped because the buffer was full
+	LastAck   *time.Time `json:"lastAck,omitempty"`
+}
+
+// syncAgent syncs the state and telemetry of this site to a central instance over a persistent grpc stream.
+// It's a publisher, so it gets every event published; events are buffered until the central instance
+// acknowledges them, so nothing is lost while it can't be reached unless the buffer fills up, when the
+// oldest are dropped. The snapshot every connection starts with brings the central instance up to date
+// with whatever was dropped
+type syncAgent struct {
+	sync.Mutex
+	central string
+	site    string
+	token   string
+	tls     bool
+	size    int
+
+	seq       uint64
+	acked     uint64
+	buffer    []syncMessage
+	dropped   uint64
+	connected bool
+	lastAck   *time.Time
+
+	// pending is signaled whenever an event is buffered
+	pending chan struct{}
+}
+
+// agent is the sync agent of this site when -sync-central is given
+var agent *syncAgent
+
+// newSyncAgent returns the agent syncing the site to the central instance at the given grpc address,
+// buffering at most size events while it can't be reached
+func newSyncAgent(central, site, token string, useTLS bool, size int) *syncAgent {
+	return &syncAgent{
+		central: central,
+		site:    site,
+		token:   token,
+		tls:     useTLS,
+		size:    size,
+		pending: make(chan struct{}, 1),
+	}
+}
+
+// Publish implements the publisher interface. It never fails, the event is sent once the central instance
+// can be reached
+func (a *syncAgent) Publish(e event) error {
+	e.outbox = nil
+
+	a.Lock()
+	a.seq++
+	a.buffer = append(a.buffer, syncMessage{Type: syncEvent, Seq: a.seq, Event: &e})
+	if over := len(a.buffer) - a.size; over > 0 {
+		n := copy(a.buffer, a.buffer[over:])
+		a.buffer = a.buffer[:n]
+		a.dropped += uint64(over)
+	}
+	a.Unlock()
+
+	select {
+	case a.pending <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Status returns whether the agent is connected and how many events it's holding on to
+func (a *syncAgent) Status() syncStatus {
+	a.Lock()
+	defer a.Unlock()
+
+	return syncStatus{
+		Central:   a.central,
+		Site:      a.site,
+		Connected: a.connected,
+		Buffered:  len(a.buffer),
+		Dropped:   a.dropped,
+		LastAck:   a.lastAck,
+	}
+}
+
+// acknowledge drops the events up to seq from the buffer
+func (a *syncAgent) acknowledge(seq uint64) {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	a.connected = true
+	a.lastAck = &now
+	if seq <= a.acked {
+		return
+	}
+	a.acked = seq
+
+	i := sort.Search(len(a.buffer), func(i int) bool { return a.buffer[i].Seq > seq })
+	n := copy(a.buffer, a.buffer[i:])
+	a.buffer = a.buffer[:n]
+}
+
+// unsent returns the buffered events after seq, in order
+func (a *syncAgent) unsent(seq uint64) []syncMessage {
+	a.Lock()
+	defer a.Unlock()
+
+	i := sort.Search(len(a.buffer), func(i int) bool { return a.buffer[i].Seq > seq })
+	return append([]syncMessage(nil), a.buffer[i:]...)
+}
+
+// run syncs the site until stop is closed, reconnecting whenever the stream is lost
+func (a *syncAgent) run(stop <-chan struct{}) {
+	for {
+		err := a.stream(stop)
+
+		a.Lock()
+		a.connected = false
+		a.Unlock()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		log.Println("lost the sync stream to", a.central, "with error:", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(syncRetryInterval):
+		}
+	}
+}
+
+// stream connects to the central instance and sends a snapshot of the site followed by every event it
+// hasn't acknowledged, then every event as it's published until the stream is lost. Closing stop drops
+// the stream
+func (a *syncAgent) stream(stop <-chan struct{}) error {
+	creds := insecure.NewCredentials()
+	if a.tls {
+		creds = grpccredentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.NewClient(a.central,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(syncCodec{})),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: syncPingInterval, Timeout: syncTimeout}),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	md := metadata.Pairs("site", a.site)
+	if a.token != "" {
+		md.Set("authorization", "Bearer "+a.token)
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), md))
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stream, err := conn.NewStream(ctx, &syncServiceDesc.Streams[0], syncStreamMethod)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	sent := a.acked
+	a.Unlock()
+	if err := stream.SendMsg(&syncMessage{Type: syncSnapshot, Seq: sent, Thermostats: home.Thermostats()}); err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			var ack syncAck
+			if err := stream.RecvMsg(&ack); err != nil {
+				errs <- err
+				return
+			}
+			a.acknowledge(ack.Seq)
+		}
+	}()
+
+	for {
+		for _, m := range a.unsent(sent) {
+			if err := stream.SendMsg(&m); err != nil {
+				return err
+			}
+			sent = m.Seq
+		}
+
+		select {
+		case <-a.pending:
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fleetSite is a site synced to the central instance, returned through the api @ /v1/fleet
+type fleetSite struct {
+	Site        string        `json:"site"`
+	Connected   bool          `json:"connected"`
+	LastSeen    time.Time     `json:"lastSeen"`
+	Events      uint64        `json:"events"` // events applied since the central instance started
+	Summary     *homeSummary  `json:"summary"`
+	Thermostats []*thermostat `json:"thermostats,omitempty"`
+}
+
+// syncedSite is the state of a site as synced by its agent
+type syncedSite struct {
+	streams     int
+	lastSeen    time.Time
+	events      uint64
+	seq         uint64
+	thermostats map[int]*thermostat
+}
+
+// syncHub is the central instance of a fleet, holding the state of every site synced to it by their agents
+type syncHub struct {
+	sync.Mutex
+	sites map[string]*syncedSite
+}
+
+var fleet = &syncHub{sites: make(map[string]*syncedSite)}
+
+// reset forgets every site
+func (h *syncHub) reset() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.sites = make(map[string]*syncedSite)
+}
+
+// newSyncServer returns the grpc server the agents sync to
+func newSyncServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ForceServerCodec(syncCodec{}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: syncPingInterval / 2, PermitWithoutStream: true}),
+	)
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&syncServiceDesc, fleet)
+	return srv
+}
+
+// serveSync serves the sync stream of the agents on the listener until stop is closed
+func serveSync(ln net.Listener, stop <-chan struct{}) error {
+	var opts []grpc.ServerOption
+	if cfg.SyncTLS {
+		creds, err := grpccredentials.NewServerTLSFromFile(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	srv := newSyncServer(opts...)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-stop:
+		srv.Stop()
+		return nil
+	}
+}
+
+// serve applies the messages of the stream of an agent to the state of its site, acknowledging each one
+func (h *syncHub) serve(stream grpc.ServerStream) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if token := secrets.Get("sync-token"); token != "" {
+		auth := md.Get("authorization")
+		if len(auth) != 1 || subtle.ConstantTimeCompare([]byte(auth[0]), []byte("Bearer "+token)) != 1 {
+			return status.Error(codes.Unauthenticated, "the agent must authenticate with the -sync-token of the central instance")
+		}
+	}
+	site := md.Get("site")
+	if len(site) != 1 || site[0] == "" {
+		return status.Error(codes.InvalidArgument, "the agent must name its site")
+	}
+
+	h.connect(site[0], 1)
+	defer h.connect(site[0], -1)
+
+	for {
+		var m syncMessage
+		if err := stream.RecvMsg(&m); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		h.apply(site[0], m)
+		if err := stream.SendMsg(&syncAck{Seq: m.Seq}); err != nil {
+			return err
+		}
+	}
+}
+
+// connect counts a stream of the site being opened, or closed when delta is -1
+func (h *syncHub) connect(name string, delta int) {
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.sites[name]
+	if !ok {
+		s = &syncedSite{thermostats: make(map[int]*thermostat)}
+		h.sites[name] = s
+	}
+	s.streams += delta
+	s.lastSeen = time.Now()
+}
+
+// apply applies a message of the agent of the site. A snapshot replaces every thermostat of the site, while
+// an event only changes the thermostat it's about, unless it was applied before
+func (h *syncHub) apply(name string, m syncMessage) {
+	h.Lock()
+	defer h.Unlock()
+
+	s := h.sites[name]
+	s.lastSeen = time.Now()
+	switch m.Type {
+	case syncSnapshot:
+		s.thermostats = make(map[int]*thermostat)
+		for _, t := range m.Thermostats {
+			s.thermostats[t.ID] = t
+		}
+		s.seq = m.Seq
+	case syncEvent:
+		if m.Seq <= s.seq {
+			return
+		}
+		s.seq = m.Seq
+		s.events++
+		switch {
+		case m.Event != nil && m.Event.Type == eventDeleted:
+			delete(s.thermostats, m.Event.ID)
+		case m.Event != nil && m.Event.Thermostat != nil:
+			s.thermostats[m.Event.Thermostat.ID] = m.Event.Thermostat
+		}
+	}
+}
+
+// Sites returns every site synced to the central instance by name, with the thermostats when given
+func (h *syncHub) Sites(thermostats bool) []fleetSite {
+	h.Lock()
+	defer h.Unlock()
+
+	list := []fleetSite{}
+	for name, s := range h.sites {
+		therms := make([]*thermostat, 0, len(s.thermostats))
+		for _, t := range s.thermostats {
+			therms = append(therms, t)
+		}
+		sort.Slice(therms, func(i, j int) bool { return therms[i].ID < therms[j].ID })
+
+		site := fleetSite{
+			Site:      name,
+			Connected: s.streams > 0,
+			LastSeen:  s.lastSeen,
+			Events:    s.events,
+			Summary:   summarize(therms),
+		}
+		site.Summary.Home = name
+		if thermostats {
+			site.Thermostats = therms
+		}
+		list = append(list, site)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Site < list[j].Site })
+	return list
+}
+
+// GetSync is the handler to return the state of the sync stream of an agent
+func GetSync(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, agent.Status())
+}
+
+// GetFleet is the handler to list every site synced to the central instance along with its statistics
+func GetFleet(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, fleet.Sites(false))
+}
+
+// GetFleetSite is the handler to return a single site synced to the central instance with its thermostats
+func GetFleetSite(req *fasthttp.RequestCtx) {
+	name := req.UserValue("site").(string)
+	for _, site := range fleet.Sites(true) {
+		if site.Site == name {
+			req.SetStatusCode(http.StatusOK)
+			sendJSON(req, site)
+			return
+		}
+	}
+
+	res := &errResponse{
+		Code:        http.StatusNotFound,
+		Msg:         "Not Found",
+		Description: "No site '" + name + "' has synced to this instance.",
+	}
+	req.SetStatusCode(http.StatusNotFound)
+	sendJSON(req, res)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSyncAgentBuffer(t *testing.T) {
+	a := newSyncAgent("127.0.0.1:1", "branch", "", false, 2)
+	for i := 1; i <= 3; i++ {
+		a.Publish(event{Type: eventTelemetry, ID: i})
+	}
+	if st := a.Status(); st.Buffered != 2 || st.Dropped != 1 {
+		t.Fatalf("expected the oldest event to be dropped from a full buffer, got %+v", st)
+	}
+	if unsent := a.unsent(0); len(unsent) != 2 || unsent[0].Seq != 2 {
+		t.Fatalf("expected events 2 and 3 to be left, got %+v", unsent)
+	}
+
+	a.acknowledge(2)
+	if unsent := a.unsent(0); len(unsent) != 1 || unsent[0].Seq != 3 {
+		t.Fatalf("expected only event 3 to be left after event 2 was acknowledged, got %+v", unsent)
+	}
+}
+
+func TestSync(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.SyncListen = "127.0.0.1:0"
+		c.SyncToken = "secret"
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go serveSync(ln, stop)
+
+	// an agent with the wrong token is turned away, holding on to its events
+	intruder := newSyncAgent(ln.Addr().String(), "intruder", "wrong", false, 10)
+	intruder.Publish(event{Type: eventTelemetry, ID: 1})
+	intruderStop := make(chan struct{})
+	defer close(intruderStop)
+	go intruder.run(intruderStop)
+
+	// events published while the agent wasn't connected yet are sent once it is
+	a := newSyncAgent(ln.Addr().String(), "branch", "secret", false, 10)
+	therm, _ := home.Thermostat(1)
+	changed := *therm
+	changed.OperatingMode = "cool"
+	a.Publish(event{Type: eventChange, ID: 1, Thermostat: &changed})
+	go a.run(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Status().Buffered > 0 || !a.Status().Connected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the buffered event to be acknowledged, got %+v", a.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var site fleetSite
+	get(base+"/v1/fleet/branch", t, &site)
+	if !site.Connected || site.Events != 1 || len(site.Thermostats) != len(home.Thermostats()) || site.Thermostats[0].OperatingMode != "cool" {
+		t.Fatalf("expected the snapshot and the event of the site, got %+v", site)
+	}
+
+	var sites []fleetSite
+	get(base+"/v1/fleet", t, &sites)
+	if len(sites) != 1 || sites[0].Site != "branch" || sites[0].Summary.Home != "branch" {
+		t.Fatalf("expected only the authenticated site, got %+v", sites)
+	}
+	if st := intruder.Status(); st.Connected || st.Buffered != 1 {
+		t.Fatalf("expected the intruder to be turned away with its event buffered, got %+v", st)
+	}
+}
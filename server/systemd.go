@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor systemd passes sockets in on
+const listenFdsStart = 3
+
+// activatedSockets holds the sockets passed in by systemd socket activation by their name, which is the
+// FileDescriptorName of the socket unit
+var activatedSockets = make(map[string]net.Listener)
+
+// loadActivatedSockets takes over the sockets passed in by systemd socket activation and returns their
+// names in the order they were passed
+func loadActivatedSockets() ([]string, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the sockets are ours now, so they must not be passed on to any child process
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var order []string
+	for i := 0; i < count; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		activatedSockets[name] = ln
+		order = append(order, name)
+	}
+
+	return order, nil
+}
+
+// sdNotify sends the state to systemd, e.g. READY=1. It does nothing unless systemd started the service
+// with Type=notify
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog keeps the systemd watchdog from restarting the service for as long as the thermostats can be
+// read, or until stop is closed. It does nothing unless the unit sets WatchdogSec
+func sdWatchdog(stop <-chan struct{}) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	// ping at half the interval so a single late ping doesn't trip the watchdog
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		home.Thermostats()
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Println("failed to ping the systemd watchdog with error:", err)
+		}
+	}
+}
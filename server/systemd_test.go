@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSDNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", path, err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("failed to notify: %s", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read notification: %s", err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Fatalf("expected READY=1, got %s", buf[:n])
+	}
+}
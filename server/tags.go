@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+)
+
+// queryTags returns every tag given by ?tag= in the query string
+func queryTags(req *fasthttp.RequestCtx) []string {
+	var tags []string
+	for _, tag := range req.QueryArgs().PeekMulti("tag") {
+		tags = append(tags, string(tag))
+	}
+	return tags
+}
+
+// hasTags reports whether the thermostat has every one of the tags
+func hasTags(t *thermostat, tags []string) bool {
+	for _, tag := range tags {
+		if !inArray(tag, t.Tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// withTags filters the thermostats down to those with every one of the tags
+func withTags(therms []*thermostat, tags []string) []*thermostat {
+	if len(tags) == 0 {
+		return therms
+	}
+
+	var tagged []*thermostat
+	for _, t := range therms {
+		if hasTags(t, tags) {
+			tagged = append(tagged, t)
+		}
+	}
+	return tagged
+}
+
+// PutThermostats is the handler to apply the same update to every enabled thermostat with the tags given by
+// ?tag=. At least one tag is required so the whole home can't be changed by accident
+func PutThermostats(req *fasthttp.RequestCtx) {
+	tags := queryTags(req)
+	if len(tags) == 0 {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Tag Required",
+			Description: "At least one tag must be given with ?tag= to select the thermostats to update.",
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	putAll(req, func() []*thermostat { return withTags(home.Thermostats(), tags) }, "No enabled thermostats were found with the tags given.")
+}
+
+// putAll applies the update sent in to every enabled thermostat the selection returns, responding with the
+// updated thermostats, or with notFound when there are none
+func putAll(req *fasthttp.RequestCtx, selection func() []*thermostat, notFound string) {
+	// verify json body was valid to api spec
+	var desired updateThermostat
+	if err := unmarshalStrict(req.PostBody(), &desired); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// perform validation of the new desired state of the thermostats
+	if err := validateData(desired); err != nil {
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, err)
+		return
+	}
+	if errRes := checkUserRange(requestUser(req), desired.HeatSetPoint, desired.CoolSetPoint); errRes != nil {
+		req.SetStatusCode(http.StatusForbidden)
+		sendJSON(req, errRes)
+		return
+	}
+
+	// disabled thermostats are left out of bulk updates
+	targets := activeThermostats(selection())
+	if len(targets) == 0 {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: notFound,
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	var updated []*thermostat
+	for _, target := range targets {
+		t, err := home.UpdateThermostat(target, desired)
+		if err != nil {
+			sendCommitError(req, err)
+			return
+		}
+		updated = append(updated, t)
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, updated)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	base := newTestServer(t)
+	north, _ := home.AddThermostat(updateThermostat{Name: "North Office", Tags: []string{"floor:3", "wing:north"}})
+	south, _ := home.AddThermostat(updateThermostat{Name: "South Office", Tags: []string{"floor:3", "wing:south"}})
+
+	var therms []*thermostat
+	get(base+"/v1/thermostats?tag=floor:3&tag=wing:north", t, &therms)
+	if len(therms) != 1 || therms[0].ID != north {
+		t.Fatalf("expected only thermostat %d to have both tags, got %+v", north, therms)
+	}
+
+	if code := put(base+"/v1/thermostats?tag=floor:3", `{"fan": "on"}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d for a bulk update, got %d", http.StatusOK, code)
+	}
+	for _, id := range []int{north, south} {
+		th, _ := home.Thermostat(id)
+		if th.FanMode != "on" || len(th.Tags) != 2 {
+			t.Fatalf("expected the bulk update to turn the fan on and keep the tags of thermostat %d, got %+v", id, th)
+		}
+	}
+
+	if code := put(base+"/v1/thermostats", `{"fan": "on"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a bulk update without tags, got %d", http.StatusBadRequest, code)
+	}
+	if code := put(base+"/v1/thermostats?tag=floor:3", `{"tags": ["floor 3"]}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid tag, got %d", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// channelTelegram sends the notification as a message from the bot of -telegram-token to a telegram chat
+const channelTelegram = "telegram"
+
+// telegramAPI is the telegram bot api the bot sends its messages through
+var telegramAPI = "https://api.telegram.org"
+
+// telegramUpdate is what telegram posts to the webhook @ /v1/chat/telegram for every message to the bot
+type telegramUpdate struct {
+	Message *struct {
+		From struct {
+			ID int64 `json:"id"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// telegramMessage is a message the bot sends, either as the reply to an update or through sendMessage
+type telegramMessage struct {
+	Method string `json:"method,omitempty"`
+	ChatID string `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+// telegramResponse is what the bot api responds with, which tells whether the call succeeded
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+}
+
+// sendTelegram sends the notification to the telegram chat of the channel, returning the status telegram
+// responded with
+func (ch notificationChannel) sendTelegram(n notification) (int, error) {
+	jsn, err := json.Marshal(telegramMessage{ChatID: ch.ChatID, Text: chatText(n)})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := notifyClient.Post(telegramAPI+"/bot"+secrets.Get("telegram-token")+"/sendMessage", "application/json", bytes.NewReader(jsn))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var res telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return resp.StatusCode, errors.New("telegram responded with " + resp.Status)
+	}
+	if !res.OK {
+		return resp.StatusCode, errors.New("telegram failed to send to chat " + ch.ChatID + ": " + res.Description)
+	}
+	return resp.StatusCode, nil
+}
+
+// PostTelegram is the handler of the webhook telegram posts the messages to the bot to. Only messages of
+// telegram accounts linked to an api user are acted on, as that user. The reply is sent back as the
+// response, so telegram delivers it without another call
+func PostTelegram(req *fasthttp.RequestCtx) {
+	req.SetContentType("application/json")
+	if secrets.Get("telegram-token") == "" {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "The telegram bot isn't configured, see -telegram-token.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	// telegram sends the secret given when the webhook was set, proving the update comes from telegram
+	secret := req.Request.Header.Peek("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare(secret, []byte(secrets.Get("telegram-secret"))) != 1 {
+		req.SetStatusCode(http.StatusUnauthorized)
+		sendJSON(req, unauthorized("The X-Telegram-Bot-Api-Secret-Token header doesn't match -telegram-secret."))
+		return
+	}
+
+	var update telegramUpdate
+	if err := json.Unmarshal(req.PostBody(), &update); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	// edits, joins and the like are acknowledged without a reply
+	req.SetStatusCode(http.StatusOK)
+	if update.Message == nil || update.Message.Text == "" {
+		req.SetBodyString("{}")
+		return
+	}
+
+	from := strconv.FormatInt(update.Message.From.ID, 10)
+	reply := chatUnlinked(channelTelegram, from)
+	if username, ok := sessions.ChatUser(channelTelegram, from); ok {
+		reply = runChatCommand(username, update.Message.Text)
+	}
+	sendJSON(req, telegramMessage{Method: "sendMessage", ChatID: strconv.FormatInt(update.Message.Chat.ID, 10), Text: reply})
+}
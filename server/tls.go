@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// serveTLS serves the api over tls on the configured address alongside the main listener. Clients that
+// support it are served over http/2, and over http/3 on the same udp port when enabled, which copes better
+// with lossy mobile networks. It blocks until a listener fails or stop is closed
+func serveTLS(addr, certFile, keyFile string, enableHTTP3 bool, stop <-chan struct{}) error {
+	handler := newHTTPHandler(listenerSpec{Addr: addr})
+	errs := make(chan error, 2)
+
+	var h3 *http3.Server
+	if enableHTTP3 {
+		h3 = &http3.Server{
+			Addr:    addr,
+			Handler: handler,
+		}
+		go func() {
+			errs <- h3.ListenAndServeTLS(certFile, keyFile)
+		}()
+
+		// advertise http/3 on every tcp response so clients switch over
+		tcpHandler := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := h3.SetQUICHeaders(w.Header()); err != nil {
+				log.Println("failed to set http/3 alt-svc header with error:", err)
+			}
+			tcpHandler.ServeHTTP(w, r)
+		})
+	}
+
+	// net/http negotiates http/2 over tls on its own
+	srv := newNetServer(addr, handler)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		errs <- srv.ServeTLS(limitListener(ln), certFile, keyFile)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-stop:
+		if h3 != nil {
+			h3.Close()
+		}
+		return srv.Close()
+	}
+}
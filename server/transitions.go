@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// transitionCount is how many of the next transitions of a thermostat are returned, unless ?count is
+	// given
+	transitionCount = 5
+
+	// transitionMaxCount is the most transitions that can be returned at once
+	transitionMaxCount = 100
+
+	// transitionLookback is how far back the transition that started the active period is looked for, which
+	// covers every action that runs at least once a week
+	transitionLookback = 8 * 24 * time.Hour
+)
+
+// scheduleTransition is a run of a scheduled action of a thermostat, with the update it applies described
+// for display, e.g. 'Mode heat, Heat 72'
+type scheduleTransition struct {
+	At          time.Time        `json:"at"`
+	ActionID    int              `json:"actionId"`
+	Update      updateThermostat `json:"update"`
+	Description string           `json:"description"`
+}
+
+// schedulePreview is the schedule of a thermostat from a client's point of view, returned through the api
+// @ /v1/thermostats/:id/schedule/next: the transition that started the active period, which lasts until the
+// first of the next ones. Active is empty when no action of the thermostat ran within the last week
+type schedulePreview struct {
+	Active *scheduleTransition  `json:"active"`
+	Next   []scheduleTransition `json:"next"`
+}
+
+// transition returns the run of the action at the given time
+func transition(a scheduledAction, at time.Time) scheduleTransition {
+	return scheduleTransition{At: at, ActionID: a.ID, Update: a.Update, Description: describeUpdate(a.Update)}
+}
+
+// previewSchedule returns the active period and the next n transitions of the scheduled actions of the
+// thermostat. Runs at the same time are in order by action, as they are applied
+func previewSchedule(t *thermostat, now time.Time, n int) schedulePreview {
+	preview := schedulePreview{Next: []scheduleTransition{}}
+	for _, a := range actions.Actions(t.ID) {
+		for _, run := range nextRuns(a.schedule, now, n) {
+			preview.Next = append(preview.Next, transition(a, run))
+		}
+
+		var last time.Time
+		for run := a.schedule.Next(now.Add(-transitionLookback)); !run.IsZero() && !run.After(now); run = a.schedule.Next(run) {
+			last = run
+		}
+		if !last.IsZero() && (preview.Active == nil || !last.Before(preview.Active.At)) {
+			active := transition(a, last)
+			preview.Active = &active
+		}
+	}
+
+	sort.SliceStable(preview.Next, func(i, j int) bool { return preview.Next[i].At.Before(preview.Next[j].At) })
+	if len(preview.Next) > n {
+		preview.Next = preview.Next[:n]
+	}
+	return preview
+}
+
+// GetScheduleNext is the handler to return the active period and the next transitions of the schedule of a
+// thermostat, so clients can show e.g. 'Heat to 72 at 6:00 AM' without evaluating the schedule themselves.
+// ?count sets how many transitions are returned
+func GetScheduleNext(req *fasthttp.RequestCtx) {
+	t := req.UserValue("thermostat").(*thermostat)
+
+	count := transitionCount
+	if s := req.QueryArgs().Peek("count"); len(s) > 0 {
+		var err error
+		if count, err = strconv.Atoi(string(s)); err != nil || count < 1 || count > transitionMaxCount {
+			res := &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Count",
+				Description: "The count must be a number from 1 to " + strconv.Itoa(transitionMaxCount) + ".",
+			}
+			req.SetStatusCode(http.StatusBadRequest)
+			sendJSON(req, res)
+			return
+		}
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, previewSchedule(t, clock.Now(), count))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	base := newTestServer(t)
+	_, morning := postAction(base, `{"thermostatId": 1, "cron": "CRON_TZ=UTC 0 6 * * *", "update": {"mode": "heat", "heatSetPoint": 72}}`, t)
+	_, night := postAction(base, `{"thermostatId": 1, "cron": "CRON_TZ=UTC 0 22 * * *", "update": {"heatSetPoint": 62}}`, t)
+	postAction(base, `{"thermostatId": 2, "cron": "CRON_TZ=UTC 0 12 * * *", "update": {"fan": "on"}}`, t)
+
+	therm, _ := home.Thermostat(1)
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+	preview := previewSchedule(therm, now, 3)
+	if a := preview.Active; a == nil || a.ActionID != morning.ID || !a.At.Equal(now.Add(-6*time.Hour)) || a.Description != "Mode heat, Heat 72" {
+		t.Fatalf("expected the morning action to be active since 6:00, got %+v", a)
+	}
+	want := []struct {
+		id int
+		at time.Time
+	}{
+		{night.ID, now.Add(10 * time.Hour)},
+		{morning.ID, now.Add(18 * time.Hour)},
+		{night.ID, now.Add(34 * time.Hour)},
+	}
+	if len(preview.Next) != len(want) {
+		t.Fatalf("expected %d transitions, got %+v", len(want), preview.Next)
+	}
+	for i, w := range want {
+		if next := preview.Next[i]; next.ActionID != w.id || !next.At.Equal(w.at) {
+			t.Fatalf("expected transition %d to be action %d at %s, got %+v", i, w.id, w.at, next)
+		}
+	}
+
+	var empty schedulePreview
+	get(base+"/v1/thermostats/"+strconv.Itoa(addThermostat(t, updateThermostat{Name: "Attic"}))+"/schedule/next", t, &empty)
+	if empty.Active != nil || empty.Next == nil || len(empty.Next) != 0 {
+		t.Fatalf("expected a thermostat without actions to have no transitions, got %+v", empty)
+	}
+	var invalid errResponse
+	get(base+"/v1/thermostats/1/schedule/next?count=0", t, &invalid)
+	if invalid.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid count, got %+v", http.StatusBadRequest, invalid)
+	}
+	var missing errResponse
+	get(base+"/v1/thermostats/1/plan/next", t, &missing)
+	if missing.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d for a path that isn't served, got %+v", http.StatusNotFound, missing)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"net/http"
 	"strconv"
+	"strings"
+	"unicode"
 )
 
 // inArray determines whether or not a string is in the provided string array
@@ -65,6 +67,63 @@ func validateHeatSetPt(val int) *errResponse {
 	return nil
 }
 
+// validateTags makes sure every tag passed is a non-empty word no longer than the max allowed, and that no
+// tag is given twice
+func validateTags(tags []string) *errResponse {
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if tag == "" || len(tag) > maxTagLength || strings.IndexFunc(tag, unicode.IsSpace) != -1 {
+			return &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Tag",
+				Description: "The tag '" + tag + "' is not valid. Tags can't be empty, contain whitespace or be longer than " + strconv.Itoa(maxTagLength) + " characters, e.g. 'floor:2'.",
+			}
+		}
+		if seen[tag] {
+			return &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Tag",
+				Description: "The tag '" + tag + "' is given more than once.",
+			}
+		}
+		seen[tag] = true
+	}
+	return nil
+}
+
+// validateLocation makes sure the location passed names a building, a floor of it and a room of the floor
+// from the top down, each a word no longer than the max allowed
+func validateLocation(l *location) *errResponse {
+	if l == nil {
+		return nil
+	}
+
+	for _, level := range []struct{ name, value, parent string }{
+		{"building", l.Building, "-"},
+		{"floor", l.Floor, l.Building},
+		{"room", l.Room, l.Floor},
+	} {
+		if level.value == "" {
+			continue
+		}
+		if level.parent == "" {
+			return &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Location",
+				Description: "The " + level.name + " '" + level.value + "' must be given along with the levels above it: a building, a floor and a room.",
+			}
+		}
+		if len(level.value) > maxTagLength || strings.IndexFunc(level.value, unicode.IsSpace) != -1 || strings.Contains(level.value, "/") {
+			return &errResponse{
+				Code:        http.StatusBadRequest,
+				Msg:         "Invalid Location",
+				Description: "The " + level.name + " '" + level.value + "' is not valid. It can't contain whitespace or slashes or be longer than " + strconv.Itoa(maxTagLength) + " characters, e.g. 'hq'.",
+			}
+		}
+	}
+	return nil
+}
+
 // validateData takes in the desired new state of a thermostat and makes sure all fields pass
 // their specific validation
 func validateData(desired updateThermostat) *errResponse {
@@ -96,5 +155,15 @@ func validateData(desired updateThermostat) *errResponse {
 		return err
 	}
 
+	// verify every tag is well formed
+	if err := validateTags(desired.Tags); err != nil {
+		return err
+	}
+
+	// verify the location names its levels from the top down
+	if err := validateLocation(desired.Location); err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// the vendors whose data exports can be imported, and what can be imported from them
+const (
+	vendorEcobee = "ecobee"
+	vendorNest   = "nest"
+
+	importSettings = "settings"
+	importRuntime  = "runtime"
+)
+
+// ecobeeInterval is the length of a row of an ecobee runtime report
+const ecobeeInterval = 5 * time.Minute
+
+// ecobeeClimate is a comfort setting of an ecobee program, its temperatures in tenths of a degree Fahrenheit
+type ecobeeClimate struct {
+	Name       string `json:"name"`
+	ClimateRef string `json:"climateRef"`
+	HeatTemp   int    `json:"heatTemp"`
+	CoolTemp   int    `json:"coolTemp"`
+}
+
+// ecobeeThermostat is the part of a thermostat of the ecobee api, requested with includeSettings,
+// includeRuntime and includeProgram, that is imported. The schedule of its program names the climate of
+// every half hour of the week, from monday on
+type ecobeeThermostat struct {
+	Name     string `json:"name"`
+	Settings struct {
+		HVACMode string `json:"hvacMode"`
+	} `json:"settings"`
+	Runtime struct {
+		DesiredHeat    int    `json:"desiredHeat"`
+		DesiredCool    int    `json:"desiredCool"`
+		DesiredFanMode string `json:"desiredFanMode"`
+	} `json:"runtime"`
+	Program struct {
+		Schedule [][]string      `json:"schedule"`
+		Climates []ecobeeClimate `json:"climates"`
+	} `json:"program"`
+}
+
+// nestDevice is the part of a thermostat of the nest smart device management api that is imported, its
+// temperatures in degrees Celsius
+type nestDevice struct {
+	Traits struct {
+		Info struct {
+			CustomName string `json:"customName"`
+		} `json:"sdm.devices.traits.Info"`
+		Mode struct {
+			Mode string `json:"mode"`
+		} `json:"sdm.devices.traits.ThermostatMode"`
+		SetPoint struct {
+			HeatCelsius float64 `json:"heatCelsius"`
+			CoolCelsius float64 `json:"coolCelsius"`
+		} `json:"sdm.devices.traits.ThermostatTemperatureSetpoint"`
+		Fan struct {
+			TimerMode string `json:"timerMode"`
+		} `json:"sdm.devices.traits.Fan"`
+	} `json:"traits"`
+	ParentRelations []struct {
+		DisplayName string `json:"displayName"`
+	} `json:"parentRelations"`
+}
+
+// nestCycle is a run of the equipment from the daily summaries of a google takeout export of nest
+type nestCycle struct {
+	StartTs string `json:"startTs"`
+	EndTs   string `json:"endTs"`
+	Heat1   bool   `json:"heat1"`
+	Heat2   bool   `json:"heat2"`
+	HeatAux bool   `json:"heatAux"`
+	Cool1   bool   `json:"cool1"`
+	Cool2   bool   `json:"cool2"`
+	Fan     bool   `json:"fan"`
+}
+
+// importedThermostat is a thermostat whose settings were imported, along with how many scheduled actions
+// its schedule was turned into
+type importedThermostat struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Created bool   `json:"created"`
+	Actions int    `json:"actions"`
+}
+
+// vendorImport is the result of importing a data export of another vendor, returned through the api @
+// /v1/import/:vendor/:kind. Skipped tells what couldn't be mapped into the model of this server and why
+type vendorImport struct {
+	Vendor      string               `json:"vendor"`
+	Thermostats []importedThermostat `json:"thermostats,omitempty"`
+	Read        int                  `json:"read,omitempty"`
+	Added       int                  `json:"added,omitempty"`
+	Skipped     []string             `json:"skipped,omitempty"`
+}
+
+// fromTenths converts a temperature in tenths of a degree to whole degrees
+func fromTenths(t int) int {
+	return int(math.Round(float64(t) / 10))
+}
+
+// fromCelsius converts a temperature in degrees Celsius to whole degrees Fahrenheit
+func fromCelsius(c float64) int {
+	return int(math.Round(c*9/5 + 32))
+}
+
+// ecobeeMode maps the hvac mode of an ecobee to an operating mode, which is empty for auto as there is no
+// such mode here
+func ecobeeMode(mode string) string {
+	switch mode {
+	case "heat", "auxHeatOnly":
+		return "heat"
+	case "cool", "off":
+		return mode
+	}
+	return ""
+}
+
+// nestMode maps the mode of a nest to an operating mode, which is empty for heat-cool as there is no such
+// mode here
+func nestMode(mode string) string {
+	switch mode {
+	case "HEAT", "COOL", "OFF":
+		return strings.ToLower(mode)
+	}
+	return ""
+}
+
+// ecobeeSettings maps the settings of an ecobee to the desired state of a thermostat
+func ecobeeSettings(e ecobeeThermostat) (updateThermostat, []string) {
+	var skipped []string
+	desired := updateThermostat{
+		Name:          e.Name,
+		OperatingMode: ecobeeMode(e.Settings.HVACMode),
+		HeatSetPoint:  fromTenths(e.Runtime.DesiredHeat),
+		CoolSetPoint:  fromTenths(e.Runtime.DesiredCool),
+	}
+	if desired.OperatingMode == "" && e.Settings.HVACMode != "" {
+		skipped = append(skipped, e.Name+": the hvac mode '"+e.Settings.HVACMode+"' has no equivalent, so the mode was left as it was")
+	}
+	switch e.Runtime.DesiredFanMode {
+	case "on", "auto":
+		desired.FanMode = e.Runtime.DesiredFanMode
+	}
+	return desired, skipped
+}
+
+// ecobeeActions turns the program of an ecobee into scheduled actions, one for every time of the day a
+// climate starts on, running on the days of the week it does
+func ecobeeActions(e ecobeeThermostat) ([]scheduledAction, []string) {
+	var skipped []string
+	climates := make(map[string]ecobeeClimate)
+	for _, c := range e.Program.Climates {
+		climates[c.ClimateRef] = c
+	}
+
+	type start struct {
+		minute int
+		ref    string
+	}
+	days := make(map[start][]int)
+	schedule := e.Program.Schedule
+	for d, slots := range schedule {
+		prev := ""
+		if last := schedule[(d+len(schedule)-1)%len(schedule)]; len(last) > 0 {
+			prev = last[len(last)-1]
+		}
+		for i, ref := range slots {
+			if ref != prev {
+				s := start{i * 24 * 60 / len(slots), ref}
+				// the schedule starts on monday while cron counts from sunday
+				days[s] = append(days[s], (d+1)%7)
+			}
+			prev = ref
+		}
+	}
+
+	starts := make([]start, 0, len(days))
+	for s := range days {
+		starts = append(starts, s)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		if starts[i].minute != starts[j].minute {
+			return starts[i].minute < starts[j].minute
+		}
+		return starts[i].ref < starts[j].ref
+	})
+
+	var imported []scheduledAction
+	for _, s := range starts {
+		c, ok := climates[s.ref]
+		if !ok {
+			skipped = append(skipped, e.Name+": the schedule names the climate '"+s.ref+"', which isn't defined")
+			continue
+		}
+
+		dow := "*"
+		if sort.Ints(days[s]); len(days[s]) < 7 {
+			list := make([]string, len(days[s]))
+			for i, d := range days[s] {
+				list[i] = strconv.Itoa(d)
+			}
+			dow = strings.Join(list, ",")
+		}
+		a := scheduledAction{
+			Cron:   strconv.Itoa(s.minute%60) + " " + strconv.Itoa(s.minute/60) + " * * " + dow,
+			Update: updateThermostat{HeatSetPoint: fromTenths(c.HeatTemp), CoolSetPoint: fromTenths(c.CoolTemp)},
+		}
+		schedule, errRes := parseTrigger(a)
+		if errRes == nil {
+			errRes = validateData(a.Update)
+		}
+		if errRes != nil {
+			skipped = append(skipped, e.Name+": the climate '"+c.Name+"' at "+a.Cron+" couldn't be scheduled: "+errRes.Description)
+			continue
+		}
+		a.schedule = schedule
+		imported = append(imported, a)
+	}
+	return imported, skipped
+}
+
+// nestSettings maps the traits of a nest to the desired state of a thermostat
+func nestSettings(n nestDevice) (updateThermostat, []string) {
+	var skipped []string
+	name := n.Traits.Info.CustomName
+	if name == "" && len(n.ParentRelations) > 0 {
+		name = n.ParentRelations[0].DisplayName
+	}
+
+	desired := updateThermostat{Name: name, OperatingMode: nestMode(n.Traits.Mode.Mode)}
+	if desired.OperatingMode == "" && n.Traits.Mode.Mode != "" {
+		skipped = append(skipped, name+": the mode '"+n.Traits.Mode.Mode+"' has no equivalent, so the mode was left as it was")
+	}
+	if n.Traits.SetPoint.HeatCelsius != 0 {
+		desired.HeatSetPoint = fromCelsius(n.Traits.SetPoint.HeatCelsius)
+	}
+	if n.Traits.SetPoint.CoolCelsius != 0 {
+		desired.CoolSetPoint = fromCelsius(n.Traits.SetPoint.CoolCelsius)
+	}
+	switch n.Traits.Fan.TimerMode {
+	case "ON":
+		desired.FanMode = "on"
+	case "OFF":
+		desired.FanMode = "auto"
+	}
+	return desired, skipped
+}
+
+// importThermostat applies the imported settings to the thermostat by the same name, adding one when there
+// is none, and replaces its scheduled actions with the imported ones when there are any
+func importThermostat(desired updateThermostat, imported []scheduledAction, user string) (importedThermostat, *errResponse) {
+	if desired.Name == "" {
+		return importedThermostat{}, &errResponse{Code: http.StatusBadRequest, Msg: "Invalid Thermostat", Description: "The thermostat has no name to be matched by."}
+	}
+	if errRes := validateData(desired); errRes != nil {
+		return importedThermostat{}, errRes
+	}
+	if errRes := checkUserRange(user, desired.HeatSetPoint, desired.CoolSetPoint); errRes != nil {
+		return importedThermostat{}, errRes
+	}
+
+	var target *thermostat
+	for _, t := range home.Thermostats() {
+		if t.Name == desired.Name {
+			if target != nil {
+				return importedThermostat{}, &errResponse{Code: http.StatusConflict, Msg: "Ambiguous Thermostat", Description: "More than one thermostat is named '" + desired.Name + "'."}
+			}
+			target = t
+		}
+	}
+
+	res := importedThermostat{Name: desired.Name}
+	if target == nil {
+		id, err := home.AddThermostat(desired)
+		if err != nil {
+			return importedThermostat{}, commitError(err)
+		}
+		res.ID, res.Created = id, true
+	} else {
+		if errRes := checkDisabled(target, desired); errRes != nil {
+			return importedThermostat{}, errRes
+		}
+		if _, err := home.UpdateThermostat(target, desired); err != nil {
+			return importedThermostat{}, commitError(err)
+		}
+		res.ID = target.ID
+	}
+
+	if len(imported) > 0 {
+		replaced, err := actions.Replace(res.ID, imported)
+		if err != nil {
+			return importedThermostat{}, &errResponse{Code: http.StatusInternalServerError, Msg: "Failed to persist scheduled action", Description: err.Error()}
+		}
+		res.Actions = len(replaced)
+	}
+	return res, nil
+}
+
+// parseEcobeeReport reads the rows of an ecobee runtime report, a csv whose header names the columns and
+// whose times are in the given location. Lines starting with # are comments, and temperatures are in the
+// unit their column names
+func parseEcobeeReport(body []byte, loc *time.Location) ([]runtimeRecord, []string, error) {
+	var lines [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] != '#' {
+			lines = append(lines, trimmed)
+		}
+	}
+	r := csv.NewReader(bytes.NewReader(bytes.Join(lines, []byte("\n"))))
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	col := func(prefix string) int {
+		for i, name := range header {
+			if strings.HasPrefix(strings.TrimSpace(name), prefix) {
+				return i
+			}
+		}
+		return -1
+	}
+	var heatCols, coolCols []int
+	for i, name := range header {
+		switch name = strings.TrimSpace(name); {
+		case strings.HasPrefix(name, "Heat Stage"), strings.HasPrefix(name, "Aux Heat"):
+			heatCols = append(heatCols, i)
+		case strings.HasPrefix(name, "Cool Stage"):
+			coolCols = append(coolCols, i)
+		}
+	}
+	date, clockCol := col("Date"), col("Time")
+	if date < 0 || clockCol < 0 {
+		return nil, nil, errMissingColumns
+	}
+	mode, heatSet, coolSet, indoor, outdoor, fan := col("System Setting"), col("Heat Set Temp"), col("Cool Set Temp"), col("Current Temp"), col("Outdoor Temp"), col("Fan")
+
+	cell := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	temp := func(row []string, i int) *float64 {
+		v, err := strconv.ParseFloat(cell(row, i), 64)
+		if err != nil {
+			return nil
+		}
+		if strings.Contains(header[i], "(C)") {
+			v = v*9/5 + 32
+		}
+		v = math.Round(v*10) / 10
+		return &v
+	}
+	seconds := func(row []string, cols ...int) int {
+		total := 0
+		for _, i := range cols {
+			n, _ := strconv.Atoi(cell(row, i))
+			total += n
+		}
+		return total
+	}
+
+	var records []runtimeRecord
+	var skipped []string
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		start, err := time.ParseInLocation("2006-01-02 15:04:05", cell(row, date)+" "+cell(row, clockCol), loc)
+		if err != nil {
+			skipped = append(skipped, "row "+strconv.Itoa(line)+": the time '"+cell(row, date)+" "+cell(row, clockCol)+"' isn't valid")
+			continue
+		}
+		rec := runtimeRecord{
+			Start:       start,
+			End:         start.Add(ecobeeInterval),
+			Source:      vendorEcobee,
+			Mode:        ecobeeMode(cell(row, mode)),
+			IndoorTemp:  temp(row, indoor),
+			OutdoorTemp: temp(row, outdoor),
+			HeatSeconds: seconds(row, heatCols...),
+			CoolSeconds: seconds(row, coolCols...),
+			FanSeconds:  seconds(row, fan),
+		}
+		if t := temp(row, heatSet); t != nil {
+			rec.HeatSetPoint = int(math.Round(*t))
+		}
+		if t := temp(row, coolSet); t != nil {
+			rec.CoolSetPoint = int(math.Round(*t))
+		}
+		records = append(records, rec)
+	}
+	return records, skipped, nil
+}
+
+// parseNestSummary reads the cycles of the daily summaries of a google takeout export of nest, a json
+// object of the days of a month each with the cycles of the equipment
+func parseNestSummary(body []byte) ([]runtimeRecord, []string, error) {
+	var days map[string]struct {
+		Cycles []nestCycle `json:"cycles"`
+	}
+	if err := json.Unmarshal(body, &days); err != nil {
+		return nil, nil, err
+	}
+
+	var records []runtimeRecord
+	var skipped []string
+	for day, summary := range days {
+		for _, c := range summary.Cycles {
+			start, err := time.Parse(time.RFC3339, c.StartTs)
+			end, endErr := time.Parse(time.RFC3339, c.EndTs)
+			if err != nil || endErr != nil || end.Before(start) {
+				skipped = append(skipped, day+": the cycle from '"+c.StartTs+"' to '"+c.EndTs+"' isn't valid")
+				continue
+			}
+
+			rec := runtimeRecord{Start: start, End: end, Source: vendorNest}
+			secs := int(end.Sub(start) / time.Second)
+			switch {
+			case c.Heat1 || c.Heat2 || c.HeatAux:
+				rec.Mode, rec.HeatSeconds = "heat", secs
+			case c.Cool1 || c.Cool2:
+				rec.Mode, rec.CoolSeconds = "cool", secs
+			}
+			if c.Fan {
+				rec.FanSeconds = secs
+			}
+			records = append(records, rec)
+		}
+	}
+	return records, skipped, nil
+}
+
+// errMissingColumns is returned for a runtime report without the date and time of its rows
+var errMissingColumns = errors.New("the report has no Date and Time columns")
+
+// invalidImport builds the error response for an export that can't be read
+func invalidImport(description string) *errResponse {
+	return &errResponse{
+		Code:        http.StatusBadRequest,
+		Msg:         "Invalid Export",
+		Description: description,
+	}
+}
+
+// PostImport is the handler to import a data export of another vendor, so a home can move over with its
+// history intact. /v1/import/:vendor/settings takes the thermostats of the api of the vendor as json,
+// applying their settings, and for ecobee their programs as scheduled actions, to the thermostats by the
+// same names or adding them. /v1/import/:vendor/runtime takes the runtime history of the thermostat given by
+// ?thermostat: an ecobee report as csv, its times in the zone given by ?tz, or the summary of a month of a
+// google takeout of nest
+func PostImport(req *fasthttp.RequestCtx) {
+	vendor, kind := req.UserValue("vendor").(string), req.UserValue("kind").(string)
+	if vendor != vendorEcobee && vendor != vendorNest || kind != importSettings && kind != importRuntime {
+		res := &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "Nothing can be imported at " + string(req.Path()) + ". Valid vendors are '" + vendorEcobee + "' and '" + vendorNest + "', with '" + importSettings + "' or '" + importRuntime + "'.",
+		}
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, res)
+		return
+	}
+
+	res := vendorImport{Vendor: vendor}
+	if kind == importSettings {
+		var errRes *errResponse
+		if vendor == vendorEcobee {
+			errRes = importEcobeeSettings(req, &res)
+		} else {
+			errRes = importNestSettings(req, &res)
+		}
+		if errRes != nil {
+			req.SetStatusCode(errRes.Code)
+			sendJSON(req, errRes)
+			return
+		}
+
+		req.SetStatusCode(http.StatusOK)
+		sendJSON(req, res)
+		return
+	}
+
+	id, err := strconv.Atoi(string(req.QueryArgs().Peek("thermostat")))
+	if err != nil {
+		res := invalidImport("The runtime history is imported into the thermostat given by ?thermostat=<id>.")
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+	t, errRes := home.Thermostat(id)
+	if errRes != nil {
+		req.SetStatusCode(http.StatusNotFound)
+		sendJSON(req, errRes)
+		return
+	}
+
+	var records []runtimeRecord
+	if vendor == vendorEcobee {
+		loc := time.Local
+		if tz := string(req.QueryArgs().Peek("tz")); tz != "" {
+			if loc, err = time.LoadLocation(tz); err != nil {
+				res := invalidImport("The time zone '" + tz + "' is not valid, e.g. America/Chicago.")
+				req.SetStatusCode(http.StatusBadRequest)
+				sendJSON(req, res)
+				return
+			}
+		}
+		records, res.Skipped, err = parseEcobeeReport(req.PostBody(), loc)
+	} else {
+		records, res.Skipped, err = parseNestSummary(req.PostBody())
+	}
+	if err != nil {
+		res := invalidImport("The " + vendor + " export couldn't be read: " + err.Error())
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	res.Read = len(records)
+	if res.Added, err = history.Import(t.ID, records); err != nil {
+		res := &errResponse{
+			Code:        http.StatusInternalServerError,
+			Msg:         "Failed to persist history",
+			Description: err.Error(),
+		}
+		reportError(req, err)
+		req.SetStatusCode(http.StatusInternalServerError)
+		sendJSON(req, res)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, res)
+}
+
+// importEcobeeSettings imports the thermostats of the ecobee api given either on their own or as the
+// thermostatList of a response
+func importEcobeeSettings(req *fasthttp.RequestCtx, res *vendorImport) *errResponse {
+	var body struct {
+		ecobeeThermostat
+		ThermostatList []ecobeeThermostat `json:"thermostatList"`
+	}
+	if err := json.Unmarshal(req.PostBody(), &body); err != nil {
+		return invalidImport("The ecobee export couldn't be read: " + err.Error())
+	}
+	list := body.ThermostatList
+	if list == nil {
+		list = []ecobeeThermostat{body.ecobeeThermostat}
+	}
+
+	for _, e := range list {
+		desired, skipped := ecobeeSettings(e)
+		imported, skippedActions := ecobeeActions(e)
+		imp, errRes := importThermostat(desired, imported, requestUser(req))
+		if errRes != nil {
+			return errRes
+		}
+		res.Thermostats = append(res.Thermostats, imp)
+		res.Skipped = append(append(res.Skipped, skipped...), skippedActions...)
+	}
+	return nil
+}
+
+// importNestSettings imports the devices of the nest smart device management api given either on their own
+// or as the devices of a response. Nest doesn't expose schedules, so only the settings are imported
+func importNestSettings(req *fasthttp.RequestCtx, res *vendorImport) *errResponse {
+	var body struct {
+		nestDevice
+		Devices []nestDevice `json:"devices"`
+	}
+	if err := json.Unmarshal(req.PostBody(), &body); err != nil {
+		return invalidImport("The nest export couldn't be read: " + err.Error())
+	}
+	list := body.Devices
+	if list == nil {
+		list = []nestDevice{body.nestDevice}
+	}
+
+	for _, n := range list {
+		desired, skipped := nestSettings(n)
+		imp, errRes := importThermostat(desired, nil, requestUser(req))
+		if errRes != nil {
+			return errRes
+		}
+		res.Thermostats = append(res.Thermostats, imp)
+		res.Skipped = append(res.Skipped, skipped...)
+	}
+	return nil
+}
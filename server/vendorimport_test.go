@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postImport sends the export as is, returning the status code and the result of the import
+func postImport(url, body string, t *testing.T) (int, vendorImport) {
+	resp, err := http.Post(url, "application/octet-stream", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var res vendorImport
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode the import: %s", err)
+		}
+	}
+	return resp.StatusCode, res
+}
+
+// ecobeeWeek is the schedule of an ecobee program that is home from 6 to 22 on weekdays and all day on the
+// weekend, and asleep otherwise
+func ecobeeWeek() [][]string {
+	week := make([][]string, 7)
+	for d := range week {
+		week[d] = make([]string, 48)
+		for i := range week[d] {
+			switch {
+			case d >= 5, i >= 12 && i < 44:
+				week[d][i] = "home"
+			default:
+				week[d][i] = "sleep"
+			}
+		}
+	}
+	return week
+}
+
+func TestImportEcobeeSettings(t *testing.T) {
+	base := newTestServer(t)
+
+	var e ecobeeThermostat
+	e.Name = "Basement"
+	e.Settings.HVACMode = "auxHeatOnly"
+	e.Runtime.DesiredHeat, e.Runtime.DesiredCool, e.Runtime.DesiredFanMode = 685, 760, "on"
+	e.Program.Schedule = ecobeeWeek()
+	e.Program.Climates = []ecobeeClimate{
+		{Name: "Home", ClimateRef: "home", HeatTemp: 700, CoolTemp: 760},
+		{Name: "Sleep", ClimateRef: "sleep", HeatTemp: 640, CoolTemp: 780},
+	}
+	body, _ := json.Marshal(map[string][]ecobeeThermostat{"thermostatList": {e}})
+
+	code, res := postImport(base+"/v1/import/ecobee/settings", string(body), t)
+	if code != http.StatusOK || len(res.Thermostats) != 1 || !res.Thermostats[0].Created {
+		t.Fatalf("expected the thermostat to be added, got %d %+v", code, res)
+	}
+	imported, _ := home.Thermostat(res.Thermostats[0].ID)
+	if imported.OperatingMode != "heat" || imported.HeatSetPoint != 69 || imported.CoolSetPoint != 76 || imported.FanMode != "on" {
+		t.Fatalf("expected the settings to be mapped, got %+v", imported)
+	}
+
+	// weekdays are home from 6 to 22, and the weekend is home from the start of saturday to that of monday
+	crons := make(map[string]int)
+	for _, a := range actions.Actions(imported.ID) {
+		crons[a.Cron] = a.Update.HeatSetPoint
+	}
+	expected := map[string]int{"0 6 * * 1,2,3,4,5": 70, "0 22 * * 1,2,3,4,5": 64, "0 0 * * 6": 70, "0 0 * * 1": 64}
+	if len(crons) != len(expected) || res.Thermostats[0].Actions != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, crons)
+	}
+	for cron, heat := range expected {
+		if crons[cron] != heat {
+			t.Fatalf("expected %s to heat to %d, got %v", cron, heat, crons)
+		}
+	}
+
+	// importing again matches the thermostat by name, and auto has nothing to map to
+	e.Settings.HVACMode = "auto"
+	body, _ = json.Marshal(e)
+	code, res = postImport(base+"/v1/import/ecobee/settings", string(body), t)
+	if code != http.StatusOK || res.Thermostats[0].Created || res.Thermostats[0].ID != imported.ID || len(res.Skipped) != 1 {
+		t.Fatalf("expected the thermostat to be updated with auto skipped, got %d %+v", code, res)
+	}
+
+	if code, _ := postImport(base+"/v1/import/honeywell/settings", "{}", t); code != http.StatusNotFound {
+		t.Fatalf("expected an unknown vendor to be 404, got %d", code)
+	}
+	if code, _ := postImport(base+"/v1/import/ecobee/settings", "{", t); code != http.StatusBadRequest {
+		t.Fatalf("expected an unreadable export to be 400, got %d", code)
+	}
+}
+
+func TestImportEcobeeRuntime(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/import/ecobee/runtime?thermostat=1&tz=UTC"
+
+	report := `#,,,
+#Data for thermostat Main Floor
+Date,Time,System Setting,Calendar Event,Program Mode,Cool Set Temp (F),Heat Set Temp (F),Current Temp (F),Outdoor Temp (F),Cool Stage 1 (sec),Heat Stage 1 (sec),Aux Heat 1 (sec),Fan (sec)
+2024-01-15,00:00:00,heat,,Sleep,78,64,63.5,20.1,0,300,0,300
+2024-01-15,00:05:00,heat,,Sleep,78,64,64.2,20.0,0,120,60,180
+2024-01-15,00:10:00,heat,,Sleep,78,64,,,0,0,0,0
+not a time,00:15:00,heat,,Sleep,78,64,64,20,0,0,0,0
+`
+	code, res := postImport(url, report, t)
+	if code != http.StatusOK || res.Read != 3 || res.Added != 3 || len(res.Skipped) != 1 {
+		t.Fatalf("expected 3 records added and 1 skipped, got %d %+v", code, res)
+	}
+
+	// importing the same report again doesn't count it twice
+	if code, res = postImport(url, report, t); code != http.StatusOK || res.Added != 0 {
+		t.Fatalf("expected nothing new, got %d %+v", code, res)
+	}
+
+	var h runtimeHistory
+	get(base+"/v1/thermostats/1/history", t, &h)
+	if len(h.Records) != 3 || h.HeatingRuntime != "8m0s" || h.FanRuntime != "8m0s" {
+		t.Fatalf("expected 3 records with 8m of heat, got %+v", h)
+	}
+	if r := h.Records[0]; r.Source != vendorEcobee || r.Mode != "heat" || r.HeatSetPoint != 64 || r.IndoorTemp == nil || *r.IndoorTemp != 63.5 {
+		t.Fatalf("expected the row to be mapped, got %+v", r)
+	}
+	if h.Records[2].IndoorTemp != nil {
+		t.Fatalf("expected a missing temperature to be left out, got %+v", h.Records[2])
+	}
+
+	get(base+"/v1/thermostats/1/history?from=2024-01-15T00:05:00Z&to=2024-01-15T00:10:00Z", t, &h)
+	if len(h.Records) != 1 || h.HeatingRuntime != "3m0s" {
+		t.Fatalf("expected the one record within the range, got %+v", h)
+	}
+
+	// the history survives a restart
+	history.reset()
+	if err := history.load(cfg.HistoryFile); err != nil {
+		t.Fatalf("failed to load the history: %s", err)
+	}
+	if got := history.History(1, time.Time{}, time.Time{}); len(got.Records) != 3 {
+		t.Fatalf("expected the persisted history, got %+v", got)
+	}
+
+	if code, _ := postImport(base+"/v1/import/ecobee/runtime", report, t); code != http.StatusBadRequest {
+		t.Fatalf("expected a missing thermostat to be 400, got %d", code)
+	}
+	if code, _ := postImport(base+"/v1/import/ecobee/runtime?thermostat=1", "a,b\n1,2\n", t); code != http.StatusBadRequest {
+		t.Fatalf("expected a report without times to be 400, got %d", code)
+	}
+}
+
+func TestImportNest(t *testing.T) {
+	base := newTestServer(t)
+	existing, _ := home.Thermostat(2)
+
+	device := `{"devices": [{
+		"traits": {
+			"sdm.devices.traits.Info": {"customName": ""},
+			"sdm.devices.traits.ThermostatMode": {"mode": "COOL"},
+			"sdm.devices.traits.ThermostatTemperatureSetpoint": {"coolCelsius": 24.5},
+			"sdm.devices.traits.Fan": {"timerMode": "OFF"}
+		},
+		"parentRelations": [{"displayName": "` + existing.Name + `"}]
+	}]}`
+	code, res := postImport(base+"/v1/import/nest/settings", device, t)
+	if code != http.StatusOK || len(res.Thermostats) != 1 || res.Thermostats[0].ID != existing.ID || res.Thermostats[0].Created {
+		t.Fatalf("expected the thermostat to be matched by its room, got %d %+v", code, res)
+	}
+	if updated, _ := home.Thermostat(existing.ID); updated.OperatingMode != "cool" || updated.CoolSetPoint != 76 || updated.FanMode != "auto" {
+		t.Fatalf("expected the settings to be mapped, got %+v", updated)
+	}
+
+	summary := `{
+		"2024-01-15T00:00:00Z": {"cycles": [
+			{"startTs": "2024-01-15T06:00:00Z", "endTs": "2024-01-15T06:20:00Z", "heat1": true, "fan": true},
+			{"startTs": "2024-01-15T14:00:00Z", "endTs": "2024-01-15T14:10:00Z", "cool1": true}
+		]},
+		"2024-01-16T00:00:00Z": {"cycles": [
+			{"startTs": "2024-01-16T06:00:00Z", "endTs": "2024-01-16T05:00:00Z", "heat1": true}
+		]}
+	}`
+	code, res = postImport(base+"/v1/import/nest/runtime?thermostat="+strconv.Itoa(existing.ID), summary, t)
+	if code != http.StatusOK || res.Added != 2 || len(res.Skipped) != 1 {
+		t.Fatalf("expected 2 cycles added and 1 skipped, got %d %+v", code, res)
+	}
+
+	var h runtimeHistory
+	get(base+"/v1/thermostats/"+strconv.Itoa(existing.ID)+"/history", t, &h)
+	if len(h.Records) != 2 || h.HeatingRuntime != "20m0s" || h.CoolingRuntime != "10m0s" || h.FanRuntime != "20m0s" {
+		t.Fatalf("expected the cycles in the history, got %+v", h)
+	}
+}
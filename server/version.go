@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// version, commit and buildDate describe the build, injected at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// When they aren't, the commit and build date fall back to the ones the go toolchain stamped the binary with
+var (
+	version   = "0.0.0-dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// startedAt is when the process started, for its uptime
+var startedAt = time.Now()
+
+// buildInfo is what the running binary was built from and the features it runs with, returned through the
+// api @ /v1/version and included in the diagnostics bundle
+type buildInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	BuildDate string    `json:"buildDate,omitempty"`
+	GoVersion string    `json:"goVersion"`
+	Platform  string    `json:"platform"`
+	Features  []string  `json:"features"`
+	StartedAt time.Time `json:"startedAt"`
+	Uptime    string    `json:"uptime"`
+}
+
+// currentBuild returns what the running binary was built from
+func currentBuild(now time.Time) buildInfo {
+	b := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  enabledFeatures(cfg),
+		StartedAt: startedAt,
+		Uptime:    now.Sub(startedAt).Round(time.Second).String(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildDate == "":
+				b.BuildDate = s.Value
+			}
+		}
+	}
+	return b
+}
+
+// enabledFeatures returns the optional features the configuration turns on, by the flag that does, in order
+// by name
+func enabledFeatures(c config) []string {
+	features := []string{}
+	for name, enabled := range map[string]bool{
+		"users":              sessions.Enabled(),
+		"tls-addr":           c.TLSAddr != "",
+		"http3":              c.HTTP3,
+		"chaos":              c.Chaos,
+		"virtual-clock":      c.VirtualClock,
+		"cluster-etcd":       c.ClusterEtcd != "",
+		"raft-addr":          c.RaftAddr != "",
+		"wal-file":           c.WALFile != "",
+		"replica-of":         c.ReplicaOf != "",
+		"sync-listen":        c.SyncListen != "",
+		"sync-central":       c.SyncCentral != "",
+		"kafka-brokers":      c.KafkaBrokers != "",
+		"nats-url":           c.NATSURL != "",
+		"amqp-url":           c.AMQPURL != "",
+		"aws-iot-endpoint":   c.AWSIoTEndpoint != "",
+		"device-broker":      c.DeviceBroker != "",
+		"influx-url":         c.InfluxURL != "",
+		"forecast-url":       c.ForecastURL != "",
+		"slack-token":        c.SlackToken != "",
+		"telegram-token":     c.TelegramToken != "",
+		"discord-public-key": c.DiscordPublicKey != "",
+		"ifttt-service-key":  c.IFTTTServiceKey != "",
+		"sentry-dsn":         c.SentryDSN != "",
+		"vault-addr":         c.VaultAddr != "",
+		"aws-secret-id":      c.AWSSecretID != "",
+	} {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// GetVersion is the handler to return the build of the server and the features it runs with, so operators
+// can tell what is deployed
+func GetVersion(req *fasthttp.RequestCtx) {
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, currentBuild(time.Now()))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.Chaos = true
+		c.VirtualClock = true
+	})
+
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "3f2c1ab", "2024-05-01T12:00:00Z"
+
+	var b buildInfo
+	get(base+"/v1/version", t, &b)
+	if b.Version != "1.4.0" || b.Commit != "3f2c1ab" || b.BuildDate != "2024-05-01T12:00:00Z" || b.GoVersion != runtime.Version() {
+		t.Fatalf("expected the injected build, got %+v", b)
+	}
+	if features := strings.Join(b.Features, ","); features != "chaos,virtual-clock" {
+		t.Fatalf("expected the chaos and virtual clock features, got %s", features)
+	}
+}
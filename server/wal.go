@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// walFile is the file the write-ahead log is kept in. Tests swap it for one that fails on purpose
+type walFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// writeAheadLog makes changes to the thermostats durable by appending them to a file of json lines before
+// they are applied, numbered by their position in the file. The log starts with a snapshot and is compacted
+// into a new one every compactAfter entries, so replaying it at startup never has to read more than that
+type writeAheadLog struct {
+	sync.Mutex
+	home         *currentState
+	path         string
+	file         walFile
+	size         int64
+	seq          uint64
+	entries      int
+	compactAfter int
+	outbox       *eventOutbox
+}
+
+// wal is the write-ahead log changes are committed through, or nil when changes aren't logged
+var wal *writeAheadLog
+
+// openWAL replays the log at path into the home and opens it for appending, starting a new log from the
+// current state of the home when there is none. A torn entry at the end of the log is the write that was
+// in progress during a crash and is cut off, while damage anywhere else fails the replay
+func openWAL(path string, compactAfter int, into *currentState) (*writeAheadLog, error) {
+	w := &writeAheadLog{
+		home:         into,
+		path:         path,
+		compactAfter: compactAfter,
+	}
+
+	outbox, err := newOutbox(path)
+	if err != nil {
+		return nil, err
+	}
+	w.outbox = outbox
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	good, err := w.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.file = f
+	w.size = good
+
+	// every log starts with a snapshot, so a new log is started by compacting it
+	if good == 0 {
+		if err := w.compact(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// replay applies every complete entry of the log to the home, returning the offset the last one ends at
+func (w *writeAheadLog) replay(f *os.File) (int64, error) {
+	var good int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Println("discarding the torn entry at the end of the write-ahead log", w.path)
+			}
+			return good, nil
+		}
+		if err != nil {
+			return good, err
+		}
+
+		var c change
+		if err := json.Unmarshal(line, &c); err != nil {
+			// only the last entry can have been torn by a crash
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				log.Println("discarding the torn entry at the end of the write-ahead log", w.path)
+				return good, nil
+			}
+			return good, errors.New("write-ahead log " + w.path + " is damaged at offset " + strconv.FormatInt(good, 10) + ": " + err.Error())
+		}
+
+		w.home.apply(c)
+		w.outbox.replayed(c)
+		if c.Snapshot {
+			w.entries = 0
+		} else {
+			w.entries++
+		}
+		w.seq = c.Seq
+		good += int64(len(line))
+	}
+}
+
+// Write appends the change to the log and flushes it to disk before applying it, compacting the log once it
+// has grown long enough. The events of the change are logged along with it and queued in the outbox once
+// it's on disk. Nothing is applied or published when the change can't be logged
+func (w *writeAheadLog) Write(c change) error {
+	w.Lock()
+	defer w.Unlock()
+
+	seq := w.outbox.seq
+	w.outbox.number(c.Outbox)
+	if err := w.append(c); err != nil {
+		w.outbox.seq = seq
+		return err
+	}
+	w.home.apply(c)
+	w.outbox.add(c.Outbox)
+
+	w.entries++
+	if w.compactAfter > 0 && w.entries >= w.compactAfter {
+		if err := w.compact(); err != nil {
+			// the log is still intact, so compacting is simply tried again after the next change
+			log.Println("failed to compact the write-ahead log", w.path, "with error:", err)
+		}
+	}
+
+	return nil
+}
+
+// append writes a single entry to the end of the log and flushes it to disk. When either fails the log is
+// cut back to where it was, so a partly written entry never ends up in front of the next one
+func (w *writeAheadLog) append(c change) error {
+	c.Seq = w.seq + 1
+
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	_, err = w.file.Write(line)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		if _, seekErr := w.file.Seek(w.size, io.SeekStart); seekErr == nil {
+			w.file.Truncate(w.size)
+		}
+		return err
+	}
+
+	w.seq++
+	w.size += int64(len(line))
+	return nil
+}
+
+// Compact replaces the log with a snapshot of every thermostat straight away, e.g. so the history of a
+// thermostat that was purged doesn't linger on disk
+func (w *writeAheadLog) Compact() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.compact()
+}
+
+// compact replaces the log with a snapshot of every thermostat, carrying over the events of the outbox that
+// weren't published yet. The snapshot is written next to the log and
+// renamed over it, so a crash part way through leaves either the old or the new log behind
+func (w *writeAheadLog) compact() error {
+	w.seq++
+	line, err := json.Marshal(change{
+		Seq:         w.seq,
+		Time:        clock.Now(),
+		Snapshot:    true,
+		Thermostats: w.home.Thermostats(),
+		Outbox:      w.outbox.Pending(),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		f.Close()
+		return err
+	}
+	syncDir(filepath.Dir(w.path))
+
+	w.file.Close()
+	w.file = f
+	w.size = int64(len(line)) + 1
+	w.entries = 0
+
+	return nil
+}
+
+// syncDir flushes a rename in the directory to disk. Not every platform supports it, so failures are ignored
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close flushes and closes the log
+func (w *writeAheadLog) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.file.Close()
+}
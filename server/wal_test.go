@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newWALHome returns a home holding a single thermostat, standing in for the state a server starts with
+func newWALHome() *currentState {
+	return &currentState{thermostats: map[int]*thermostat{
+		1: {ID: 1, Name: "Den", OperatingMode: "off", FanMode: "auto", DisplayOrder: 1},
+	}}
+}
+
+// renamed returns a copy of the thermostat of the home with a new name
+func renamed(h *currentState, id int, name string) *thermostat {
+	t, _ := h.Thermostat(id)
+	updated := *t
+	updated.Name = name
+	updated.LastChanged = time.Now()
+	return &updated
+}
+
+// walEntries counts the entries of the log at path
+func walEntries(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the write-ahead log: %s", err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// recoverHome replays the log at path into a home that starts out empty, as after a crash
+func recoverHome(t *testing.T, path string) (*currentState, *writeAheadLog) {
+	h := &currentState{thermostats: make(map[int]*thermostat)}
+	w, err := openWAL(path, 0, h)
+	if err != nil {
+		t.Fatalf("failed to replay the write-ahead log: %s", err)
+	}
+	return h, w
+}
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	h := newWALHome()
+	w, err := openWAL(path, 0, h)
+	if err != nil {
+		t.Fatalf("failed to open the write-ahead log: %s", err)
+	}
+	w.Write(newChange(changeUpdate, []*thermostat{renamed(h, 1, "Study")}))
+	w.Write(newChange(changeAdd, []*thermostat{{ID: 2, Name: "Loft", DisplayOrder: 2}}))
+	w.Write(newChange(changeUpdate, []*thermostat{renamed(h, 1, "Library")}))
+
+	// the log is never closed, just like when the process is killed
+	recovered, _ := recoverHome(t, path)
+	if therms := recovered.Thermostats(); len(therms) != 2 || therms[0].Name != "Library" || therms[1].Name != "Loft" {
+		t.Fatalf("expected both thermostats with their last names to be recovered, got %+v", therms)
+	}
+}
+
+func TestWALDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	h := newWALHome()
+	w, err := openWAL(path, 0, h)
+	if err != nil {
+		t.Fatalf("failed to open the write-ahead log: %s", err)
+	}
+	w.Write(newChange(changeAdd, []*thermostat{{ID: 2, Name: "Loft", DisplayOrder: 2}}))
+	loft, _ := h.Thermostat(2)
+	w.Write(change{Type: changeDelete, Time: time.Now(), Deleted: []*thermostat{loft}})
+
+	recovered, _ := recoverHome(t, path)
+	if therms := recovered.Thermostats(); len(therms) != 1 || therms[0].ID != 1 {
+		t.Fatalf("expected the removed thermostat to stay removed, got %+v", therms)
+	}
+	if recovered.lastID != 2 {
+		t.Fatalf("expected the id of the removed thermostat to stay taken, got %d", recovered.lastID)
+	}
+}
+
+func TestWALTornEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	h := newWALHome()
+	w, err := openWAL(path, 0, h)
+	if err != nil {
+		t.Fatalf("failed to open the write-ahead log: %s", err)
+	}
+	w.Write(newChange(changeUpdate, []*thermostat{renamed(h, 1, "Study")}))
+	entries := walEntries(t, path)
+
+	// crash part way through writing the next entry
+	w.file.Write([]byte(`{"seq":3,"thermostats":[{"id":1,"na`))
+
+	recovered, rw := recoverHome(t, path)
+	if th, _ := recovered.Thermostat(1); th == nil || th.Name != "Study" {
+		t.Fatalf("expected the last complete entry to be recovered, got %+v", th)
+	}
+	if got := walEntries(t, path); got != entries {
+		t.Fatalf("expected the torn entry to be cut off, leaving %d entries, got %d", entries, got)
+	}
+
+	// the recovered log must carry on from the last complete entry
+	rw.Write(newChange(changeUpdate, []*thermostat{renamed(recovered, 1, "Office")}))
+	if again, _ := recoverHome(t, path); again.thermostats[1].Name != "Office" {
+		t.Fatalf("expected changes after recovery to be logged, got %+v", again.thermostats[1])
+	}
+}
+
+func TestWALDamaged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	h := newWALHome()
+	w, err := openWAL(path, 0, h)
+	if err != nil {
+		t.Fatalf("failed to open the write-ahead log: %s", err)
+	}
+	w.file.Write([]byte("not json\n"))
+	w.Write(newChange(changeUpdate, []*thermostat{renamed(h, 1, "Study")}))
+
+	if _, err := openWAL(path, 0, &currentState{thermostats: make(map[int]*thermostat)}); err == nil {
+		t.Fatal("expected damage before the end of the log to fail the replay")
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermostats.wal")
+
+	h := newWALHome()
+	w, err := openWAL(path, 3, h)
+	if err != nil {
+		t.Fatalf("failed to open the write-ahead log: %s", err)
+	}
+	for _, name := range []string{"Study", "Library", "Office", "Nursery", "Gym"} {
+		w.Write(newChange(changeUpdate, []*thermostat{renamed(h, 1, name)}))
+	}
+
+	// the snapshot taken after the third change is followed by the last two changes
+	if got := walEntries(t, path); got != 3 {
+		t.Fatalf("expected the log to be compacted down to 3 entries, got %d", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected the compaction to clean up after itself, got %v", err)
+	}
+
+	recovered, _ := recoverHome(t, path)
+	if th, _ := recovered.Thermostat(1); th == nil || th.Name != "Gym" {
+		t.Fatalf("expected the last change to survive compaction, got %+v", th)
+	}
+}
+
+func TestWALWriteFailure(t *testing.T) {
+	base := newTestServer(t, func(c *config) {
+		c.WALFile = filepath.Join(t.TempDir(), "thermostats.wal")
+	})
+	file := wal.file
+	wal.file = &faultyFile{walFile: file, failWrite: 1, failSync: 1}
+	defer func() { wal.file = file }()
+
+	before := home.Thermostats()
+	if code := put(base+"/v1/thermostats/1", `{"name": "Attic"}`, t); code != http.StatusInternalServerError {
+		t.Fatalf("expected an update that can't be logged to fail, got %d", code)
+	}
+	if code := postJSON(base+"/v1/thermostats", `{"name": "Shed"}`, t, nil); code != http.StatusInternalServerError {
+		t.Fatalf("expected an addition that can't be logged to fail, got %d", code)
+	}
+	if after := home.Thermostats(); len(after) != len(before) || after[0] != before[0] {
+		t.Fatal("expected nothing to be applied")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// the headers every webhook delivery carries. The signature is the hex hmac-sha256 of the timestamp, a
+	// dot and the body, keyed with the secret of the channel, so consumers can tell the payload came from
+	// this server and reject old deliveries being replayed by their timestamp
+	webhookSignatureHeader = "X-Thermostat-Signature"
+	webhookTimestampHeader = "X-Thermostat-Timestamp"
+	webhookDeliveryHeader  = "X-Thermostat-Delivery"
+
+	// maxDeliveries is how many deliveries are kept in the log
+	maxDeliveries = 1000
+)
+
+// deliveryRecord is a single attempt to send a notification to a channel, returned through the api @
+// /v1/notifications/:user/deliveries. The status is the one the channel responded with, none when it
+// couldn't be reached. Secrets of the channel are never returned
+type deliveryRecord struct {
+	ID           int                 `json:"id"`
+	Username     string              `json:"username"`
+	Channel      notificationChannel `json:"channel"`
+	Kind         string              `json:"kind"`
+	AlertID      int                 `json:"alertId,omitempty"`
+	RedeliveryOf int                 `json:"redeliveryOf,omitempty"`
+	AttemptedAt  time.Time           `json:"attemptedAt"`
+	Duration     string              `json:"duration"`
+	StatusCode   int                 `json:"statusCode,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Delivered    bool                `json:"delivered"`
+
+	// the delivery as it was queued, to send again
+	delivery delivery
+}
+
+// deliveryStore keeps the log of the latest deliveries, by id
+type deliveryStore struct {
+	sync.Mutex
+	records []*deliveryRecord
+	lastID  int
+}
+
+var deliveryLog = &deliveryStore{}
+
+// signPayload returns the signature of the body sent at the timestamp, as sent in webhookSignatureHeader
+func signPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts the notification as json to the url of the channel, signed with its secret if it has
+// one, returning the status the url responded with
+func (ch notificationChannel) sendWebhook(n notification, deliveryID int) (int, error) {
+	jsn, err := json.Marshal(n)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", ch.URL, bytes.NewReader(jsn))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookDeliveryHeader, strconv.Itoa(deliveryID))
+	if ch.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signPayload(ch.Secret, timestamp, jsn))
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, errors.New(ch.URL + " responded with " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// reset empties the log
+func (s *deliveryStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.records = nil
+	s.lastID = 0
+}
+
+// reserve returns the id of the next delivery, which is sent along with it before it's logged
+func (s *deliveryStore) reserve() int {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastID++
+	return s.lastID
+}
+
+// add logs the delivery that started at the given time with the outcome of sending it
+func (s *deliveryStore) add(id int, d delivery, start time.Time, status int, err error) {
+	rec := &deliveryRecord{
+		ID:           id,
+		Username:     d.n.Username,
+		Channel:      d.channel,
+		Kind:         d.n.Kind,
+		RedeliveryOf: d.redeliveryOf,
+		AttemptedAt:  start,
+		Duration:     time.Since(start).String(),
+		StatusCode:   status,
+		Delivered:    err == nil,
+		delivery:     d,
+	}
+	rec.Channel.Secret = ""
+	if d.n.Alert != nil {
+		rec.AlertID = d.n.Alert.ID
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.records = append(s.records, rec)
+	if len(s.records) > maxDeliveries {
+		s.records = s.records[len(s.records)-maxDeliveries:]
+	}
+}
+
+// Deliveries returns the logged deliveries to the user, newest first, only those that failed if asked
+func (s *deliveryStore) Deliveries(username string, failed bool) []deliveryRecord {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []deliveryRecord{}
+	for i := len(s.records) - 1; i >= 0; i-- {
+		if rec := s.records[i]; rec.Username == username && (!failed || !rec.Delivered) {
+			list = append(list, *rec)
+		}
+	}
+	return list
+}
+
+// Purge drops the logged deliveries to the user, or to every user when empty, attempted before the given
+// time, or every one of them when it's zero, and returns how many were dropped
+func (s *deliveryStore) Purge(username string, before time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.records[:0]
+	for _, rec := range s.records {
+		if (username == "" || rec.Username == username) && (before.IsZero() || rec.AttemptedAt.Before(before)) {
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	purged := len(s.records) - len(kept)
+	s.records = kept
+	return purged
+}
+
+// Redeliver queues the failed delivery to the user to be sent again as it was
+func (s *deliveryStore) Redeliver(username string, id int) *errResponse {
+	s.Lock()
+	var found *deliveryRecord
+	for _, rec := range s.records {
+		if rec.ID == id && rec.Username == username {
+			found = rec
+		}
+	}
+	s.Unlock()
+
+	switch {
+	case found == nil:
+		return &errResponse{
+			Code:        http.StatusNotFound,
+			Msg:         "Not Found",
+			Description: "No delivery " + strconv.Itoa(id) + " to user " + username + " is logged.",
+		}
+	case found.Delivered:
+		return &errResponse{
+			Code:        http.StatusConflict,
+			Msg:         "Already Delivered",
+			Description: "Delivery " + strconv.Itoa(id) + " succeeded, only failed deliveries can be sent again.",
+		}
+	}
+
+	d := found.delivery
+	d.redeliveryOf = id
+	d.attempt = 0
+	select {
+	case deliveries <- d:
+		return nil
+	default:
+		return &errResponse{
+			Code:        http.StatusServiceUnavailable,
+			Msg:         "Service Unavailable",
+			Description: "The delivery queue is full, try again later.",
+		}
+	}
+}
+
+// GetDeliveries is the handler to return the log of the notifications sent to a user, with ?failed=true
+// for those that failed only
+func GetDeliveries(req *fasthttp.RequestCtx) {
+	username := req.UserValue("user").(string)
+	if errRes := checkOwnPrefs(req, username); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, deliveryLog.Deliveries(username, string(req.QueryArgs().Peek("failed")) == "true"))
+}
+
+// PostRedeliver is the handler to send a failed notification to a user again. The outcome shows up in the
+// log as a new delivery
+func PostRedeliver(req *fasthttp.RequestCtx) {
+	username := req.UserValue("user").(string)
+	if errRes := checkOwnPrefs(req, username); errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+	id, errRes := paramID(req, "delivery")
+	if errRes == nil {
+		errRes = deliveryLog.Redeliver(username, id)
+	}
+	if errRes != nil {
+		req.SetStatusCode(errRes.Code)
+		sendJSON(req, errRes)
+		return
+	}
+
+	req.SetStatusCode(http.StatusAccepted)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignedWebhookDeliveries(t *testing.T) {
+	var calls int32
+	verified := make(chan bool, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		verified <- r.Header.Get(webhookSignatureHeader) == signPayload("s3cret", timestamp, body) && r.Header.Get(webhookDeliveryHeader) != ""
+
+		// the first delivery fails
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer hook.Close()
+
+	// without retries, so the failed delivery is left to be redelivered by hand
+	base := newTestServer(t, func(c *config) { c.DeliveryAttempts = 1 })
+	if code, _ := putNotifications(base, "dave", `{"channels": [{"type": "slack", "channel": "#x", "secret": "s3cret"}]}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a secret on a slack channel, got %d", http.StatusBadRequest, code)
+	}
+	if code, _ := putNotifications(base, "dave", `{"channels": [{"type": "webhook", "url": "`+hook.URL+`", "secret": "s3cret"}]}`, t); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	wait := func() {
+		select {
+		case ok := <-verified:
+			if !ok {
+				t.Fatalf("expected the delivery to be signed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a delivery")
+		}
+	}
+	deliveriesOf := func(query string) []deliveryRecord {
+		var list []deliveryRecord
+		for i := 0; i < 100; i++ {
+			get(base+"/v1/notifications/dave/deliveries"+query, t, &list)
+			if len(list) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return list
+	}
+
+	t1, _ := home.Thermostat(1)
+	publishDetail(eventOffline, t1, severityWarning, "Thermostat 1 went offline.")
+	wait()
+	failed := deliveriesOf("?failed=true")
+	if len(failed) != 1 || failed[0].StatusCode != http.StatusBadGateway || failed[0].Delivered || failed[0].AlertID == 0 || failed[0].Channel.Secret != "" {
+		t.Fatalf("expected the failed delivery to be logged without the secret, got %+v", failed)
+	}
+
+	url := base + "/v1/notifications/dave/deliveries/" + strconv.Itoa(failed[0].ID) + "/redeliver"
+	if code := postJSON(url, "", t, nil); code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, code)
+	}
+	wait()
+	var list []deliveryRecord
+	for i := 0; i < 100 && len(list) < 2; i++ {
+		get(base+"/v1/notifications/dave/deliveries", t, &list)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(list) != 2 || !list[0].Delivered || list[0].RedeliveryOf != failed[0].ID || list[0].StatusCode != http.StatusOK {
+		t.Fatalf("expected the redelivery to succeed, got %+v", list)
+	}
+	if code := postJSON(base+"/v1/notifications/dave/deliveries/"+strconv.Itoa(list[0].ID)+"/redeliver", "", t, nil); code != http.StatusConflict {
+		t.Fatalf("expected status %d redelivering a delivered notification, got %d", http.StatusConflict, code)
+	}
+	if code := postJSON(base+"/v1/notifications/erin/deliveries/"+strconv.Itoa(failed[0].ID)+"/redeliver", "", t, nil); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for the delivery of another user, got %d", http.StatusNotFound, code)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// equipmentConventional is a furnace or boiler heating on W with air conditioning cooling on Y, and the
+	// profile of a thermostat unless its installation gives another
+	equipmentConventional = "conventional"
+	equipmentHeatPump     = "heatPump"
+	equipmentHeatOnly     = "heatOnly"
+	equipmentCoolOnly     = "coolOnly"
+)
+
+// equipmentProfiles are the kinds of equipment the wiring of a thermostat can be checked against
+var equipmentProfiles = []string{equipmentConventional, equipmentHeatPump, equipmentHeatOnly, equipmentCoolOnly}
+
+// wiringTerminals are the terminals a thermostat can have wired, and wiringAliases the other names they go by
+var (
+	wiringTerminals = []string{"R", "Rh", "Rc", "C", "W", "W2", "Y", "Y2", "G", "O/B", "AUX", "E"}
+	wiringAliases   = map[string]string{"RH": "Rh", "RC": "Rc", "W1": "W", "Y1": "Y", "O": "O/B", "B": "O/B", "OB": "O/B"}
+)
+
+// wiringCheck is the body an installer sends in through the api @ /v1/thermostats/:id/wiring with the
+// terminals that have a wire on them, e.g. ["R", "C", "W", "Y", "G"]
+type wiringCheck struct {
+	Terminals []string `json:"terminals"`
+}
+
+// wiringIssue is something wrong with the wiring of a thermostat. Critical issues make it incompatible with
+// its equipment or settings, warnings limit what it can do
+type wiringIssue struct {
+	Severity string `json:"severity"`
+	Terminal string `json:"terminal,omitempty"`
+	Message  string `json:"message"`
+}
+
+// wiringReport is the outcome of checking the wiring of a thermostat against its installation, returned
+// through the api @ /v1/thermostats/:id/wiring. Modes are the operating modes the wiring supports
+type wiringReport struct {
+	ThermostatID int           `json:"thermostatId"`
+	Equipment    string        `json:"equipment"`
+	Stages       int           `json:"stages"`
+	Terminals    []string      `json:"terminals"`
+	Modes        []string      `json:"modes"`
+	Compatible   bool          `json:"compatible"`
+	Issues       []wiringIssue `json:"issues"`
+}
+
+// normalizeTerminals returns the terminals by their canonical names, in the order of wiringTerminals, and
+// the first one it doesn't know, if any
+func normalizeTerminals(terminals []string) ([]string, string) {
+	wired := make(map[string]bool, len(terminals))
+	for _, terminal := range terminals {
+		name := strings.ToUpper(strings.TrimSpace(terminal))
+		if alias, ok := wiringAliases[name]; ok {
+			name = alias
+		}
+		if !inArray(name, wiringTerminals) {
+			return nil, terminal
+		}
+		wired[name] = true
+	}
+
+	normalized := []string{}
+	for _, terminal := range wiringTerminals {
+		if wired[terminal] {
+			normalized = append(normalized, terminal)
+		}
+	}
+	return normalized, ""
+}
+
+// checkWiring checks the terminals wired to the thermostat against the equipment and stages of its
+// installation and the modes it's set to
+func checkWiring(t *thermostat, in installation, terminals []string) wiringReport {
+	r := wiringReport{
+		ThermostatID: t.ID,
+		Equipment:    in.Equipment,
+		Stages:       installerStages(t.ID),
+		Terminals:    terminals,
+		Modes:        []string{},
+		Issues:       []wiringIssue{},
+	}
+	if r.Equipment == "" {
+		r.Equipment = equipmentConventional
+	}
+	wired := func(terminal string) bool { return inArray(terminal, terminals) }
+	flag := func(severity, terminal, message string) {
+		r.Issues = append(r.Issues, wiringIssue{Severity: severity, Terminal: terminal, Message: message})
+	}
+
+	// power
+	switch {
+	case !wired("R") && !wired("Rh") && !wired("Rc"):
+		flag(severityCritical, "R", "Nothing is wired to R, Rh or Rc, so the thermostat has no power from the equipment.")
+	case !wired("R") && wired("Rh") != wired("Rc"):
+		flag(severityWarning, "Rc", "Only one of Rh and Rc is wired. Jumper them when heating and cooling share a transformer.")
+	}
+	if !wired("C") {
+		flag(severityWarning, "C", "Nothing is wired to C, so the thermostat has to steal power from the equipment or run on batteries.")
+	}
+
+	// what the wiring can heat and cool with
+	var heat, cool bool
+	switch r.Equipment {
+	case equipmentHeatPump:
+		heat = wired("Y") && wired("O/B")
+		cool = heat
+		if !wired("Y") {
+			flag(severityCritical, "Y", "The compressor of a heat pump runs on Y, which isn't wired.")
+		}
+		if !wired("O/B") {
+			flag(severityCritical, "O/B", "Heat pump modes need O/B to switch the reversing valve between heating and cooling, which isn't wired.")
+		}
+	default:
+		heat = r.Equipment != equipmentCoolOnly && wired("W")
+		cool = r.Equipment != equipmentHeatOnly && wired("Y")
+		if r.Equipment != equipmentCoolOnly && !heat {
+			flag(severityWarning, "W", "W isn't wired, so the thermostat can't heat. Install it as "+equipmentCoolOnly+" if the equipment has no heating.")
+		}
+		if r.Equipment != equipmentHeatOnly && !cool {
+			flag(severityWarning, "Y", "Y isn't wired, so the thermostat can't cool. Install it as "+equipmentHeatOnly+" if the equipment has no air conditioning.")
+		}
+		if wired("O/B") {
+			flag(severityWarning, "O/B", "O/B is wired, which switches the reversing valve of a heat pump, but the equipment is installed as "+r.Equipment+".")
+		}
+		if wired("E") {
+			flag(severityWarning, "E", "E is wired, which runs the emergency heat of a heat pump, but the equipment is installed as "+r.Equipment+".")
+		}
+		if r.Equipment == equipmentHeatOnly && wired("Y") {
+			flag(severityWarning, "Y", "Y is wired, but the equipment is installed as "+equipmentHeatOnly+", so it's never used.")
+		}
+		if r.Equipment == equipmentCoolOnly && wired("W") {
+			flag(severityWarning, "W", "W is wired, but the equipment is installed as "+equipmentCoolOnly+", so it's never used.")
+		}
+	}
+
+	for _, mode := range validOpModes {
+		if mode == "off" || mode == "heat" && heat || mode == "cool" && cool {
+			r.Modes = append(r.Modes, mode)
+		}
+	}
+	if !inArray(t.OperatingMode, r.Modes) {
+		flag(severityCritical, "", "The thermostat is set to "+t.OperatingMode+", which its wiring can't do.")
+	}
+
+	// second stages, which only run when -second-stage-delta is set
+	if r.Stages > 1 && cfg.SecondStageDelta > 0 {
+		if heat && r.Equipment != equipmentHeatPump && !wired("W2") {
+			flag(severityWarning, "W2", "W2 isn't wired, so heating can't run a second stage. Install the thermostat with 1 stage.")
+		}
+		if heat && r.Equipment == equipmentHeatPump && !wired("Y2") && !wired("W") && !wired("AUX") {
+			flag(severityWarning, "AUX", "Neither Y2 nor auxiliary heat on W or AUX is wired, so heating can't run a second stage. Install the thermostat with 1 stage.")
+		}
+		if cool && !wired("Y2") {
+			flag(severityWarning, "Y2", "Y2 isn't wired, so cooling can't run a second stage. Install the thermostat with 1 stage.")
+		}
+	}
+	if r.Stages == 1 {
+		for _, terminal := range []string{"W2", "Y2"} {
+			if wired(terminal) {
+				flag(severityInfo, terminal, terminal+" is wired, but the thermostat is installed with 1 stage, so it's never used.")
+			}
+		}
+	}
+
+	// the fan
+	if !wired("G") {
+		severity := severityWarning
+		if t.FanMode == "on" {
+			severity = severityCritical
+		}
+		flag(severity, "G", "G isn't wired, so the fan can't run on its own and the fan mode can only be auto.")
+	}
+
+	r.Compatible = true
+	for _, issue := range r.Issues {
+		if issue.Severity == severityCritical {
+			r.Compatible = false
+		}
+	}
+	return r
+}
+
+// PostWiring is the handler for an installer to check the wiring of a thermostat against its installation,
+// flagging the modes and settings it isn't compatible with. Nothing is changed
+func PostWiring(req *fasthttp.RequestCtx) {
+	var body wiringCheck
+	if err := unmarshalStrict(req.PostBody(), &body); err != nil {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid JSON body provided",
+			Description: err.Error(),
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	terminals, unknown := normalizeTerminals(body.Terminals)
+	if len(body.Terminals) == 0 || unknown != "" {
+		res := &errResponse{
+			Code:        http.StatusBadRequest,
+			Msg:         "Invalid Wiring",
+			Description: "The terminals must be one or more of " + listChoices(wiringTerminals) + ".",
+		}
+		if unknown != "" {
+			res.Description = "Unknown terminal '" + unknown + "'. " + res.Description
+		}
+		req.SetStatusCode(http.StatusBadRequest)
+		sendJSON(req, res)
+		return
+	}
+
+	t := req.UserValue("thermostat").(*thermostat)
+	req.SetStatusCode(http.StatusOK)
+	sendJSON(req, checkWiring(t, installers.Installation(t.ID), terminals))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// issueTerminals returns the terminals of the issues of the given severity, in order
+func issueTerminals(r wiringReport, severity string) string {
+	var terminals []string
+	for _, issue := range r.Issues {
+		if issue.Severity == severity {
+			terminals = append(terminals, issue.Terminal)
+		}
+	}
+	return strings.Join(terminals, ",")
+}
+
+func TestCheckWiring(t *testing.T) {
+	newTestServer(t)
+
+	for _, tc := range []struct {
+		name       string
+		mode, fan  string
+		in         installation
+		terminals  []string
+		modes      string
+		compatible bool
+		critical   string
+		warning    string
+	}{
+		{"conventional two-stage", "heat", "auto", installation{}, []string{"R", "C", "W", "W2", "Y", "Y2", "G"}, "cool,heat,off", true, "", ""},
+		{"conventional without a second stage", "heat", "auto", installation{}, []string{"R", "C", "W", "Y", "G"}, "cool,heat,off", true, "", "W2,Y2"},
+		{"single-stage without common", "cool", "auto", installation{Stages: 1}, []string{"Rh", "Rc", "W", "Y", "G"}, "cool,heat,off", true, "", "C"},
+		{"heat pump without O/B", "heat", "auto", installation{Equipment: equipmentHeatPump, Stages: 1}, []string{"R", "C", "Y", "G"}, "off", false, "O/B,", ""},
+		{"heat pump", "cool", "auto", installation{Equipment: equipmentHeatPump, Stages: 1}, []string{"R", "C", "Y", "O/B", "G"}, "cool,heat,off", true, "", ""},
+		{"conventional with a reversing valve", "heat", "auto", installation{Stages: 1}, []string{"R", "C", "W", "Y", "O/B", "G"}, "cool,heat,off", true, "", "O/B"},
+		{"heat only without a fan", "heat", "on", installation{Equipment: equipmentHeatOnly, Stages: 1}, []string{"R", "C", "W"}, "heat,off", false, "G", ""},
+		{"no power", "off", "auto", installation{Equipment: equipmentCoolOnly, Stages: 1}, []string{"C", "Y", "G"}, "cool,off", false, "R", ""},
+	} {
+		therm := &thermostat{ID: 1, OperatingMode: tc.mode, FanMode: tc.fan}
+		installers.SetInstallation(1, tc.in)
+		terminals, _ := normalizeTerminals(tc.terminals)
+		r := checkWiring(therm, tc.in, terminals)
+
+		if modes := strings.Join(r.Modes, ","); modes != tc.modes || r.Compatible != tc.compatible {
+			t.Fatalf("%s: expected modes %s and compatible %v, got %+v", tc.name, tc.modes, tc.compatible, r)
+		}
+		if critical := issueTerminals(r, severityCritical); critical != tc.critical {
+			t.Fatalf("%s: expected critical issues on %q, got %+v", tc.name, tc.critical, r.Issues)
+		}
+		if warning := issueTerminals(r, severityWarning); warning != tc.warning {
+			t.Fatalf("%s: expected warnings on %q, got %+v", tc.name, tc.warning, r.Issues)
+		}
+	}
+}
+
+func TestNormalizeTerminals(t *testing.T) {
+	terminals, unknown := normalizeTerminals([]string{"g", "O", "y1", "rc", " R ", "B"})
+	if unknown != "" || strings.Join(terminals, ",") != "R,Rc,Y,G,O/B" {
+		t.Fatalf("expected the canonical terminals in order, got %v %q", terminals, unknown)
+	}
+	if _, unknown := normalizeTerminals([]string{"R", "X9"}); unknown != "X9" {
+		t.Fatalf("expected X9 to be unknown, got %q", unknown)
+	}
+}
+
+func TestPostWiring(t *testing.T) {
+	base := newTestServer(t)
+	url := base + "/v1/thermostats/1/wiring"
+
+	for _, body := range []string{`{"terminals": []}`, `{"terminals": ["R", "Z"]}`} {
+		if code := postJSON(url, body, t, nil); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	// thermostat 1 heats, so a heat pump without O/B can't run it
+	if code := put(base+"/v1/thermostats/1/installation", `{"equipment": "heatPump", "stages": 1}`, t); code != http.StatusOK {
+		t.Fatalf("expected the installation to be changed, got %d", code)
+	}
+	if code := put(base+"/v1/thermostats/1/installation", `{"equipment": "geothermal"}`, t); code != http.StatusBadRequest {
+		t.Fatalf("expected unknown equipment to be rejected, got %d", code)
+	}
+	var r wiringReport
+	if code := postJSON(url, `{"terminals": ["R", "C", "Y", "G"]}`, t, &r); code != http.StatusOK || r.Compatible || r.Equipment != equipmentHeatPump {
+		t.Fatalf("expected the wiring to be incompatible, got %d %+v", code, r)
+	}
+	if !strings.Contains(r.Issues[0].Message, "O/B") || !strings.Contains(r.Issues[1].Message, "set to heat") {
+		t.Fatalf("expected O/B and the heat mode to be flagged, got %+v", r.Issues)
+	}
+}